@@ -1,234 +0,0 @@
-package main
-
-import (
-	"bytes"
-	"compress/gzip"
-	"fmt"
-	"io"
-	"strings"
-)
-
-func bindata_read(data []byte, name string) ([]byte, error) {
-	gz, err := gzip.NewReader(bytes.NewBuffer(data))
-	if err != nil {
-		return nil, fmt.Errorf("Read %q: %v", name, err)
-	}
-
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, gz)
-	gz.Close()
-
-	if err != nil {
-		return nil, fmt.Errorf("Read %q: %v", name, err)
-	}
-
-	return buf.Bytes(), nil
-}
-
-func static_index_html() ([]byte, error) {
-	return bindata_read([]byte{
-		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x00, 0xff, 0xec, 0x58,
-		0x5f, 0x6f, 0xdb, 0x38, 0x12, 0x7f, 0xae, 0x3f, 0xc5, 0x54, 0xe9, 0x01,
-		0x77, 0xbd, 0x48, 0x4a, 0xdc, 0x3f, 0x57, 0xb8, 0xb6, 0xef, 0x7a, 0xed,
-		0xe1, 0x36, 0xc0, 0x36, 0x5b, 0x34, 0x01, 0x8a, 0xdd, 0x37, 0x4a, 0xa4,
-		0x2d, 0x22, 0x94, 0x28, 0x90, 0x54, 0x9c, 0xb4, 0xc8, 0x77, 0xdf, 0x19,
-		0x52, 0x92, 0x25, 0xdb, 0x75, 0xb1, 0xc0, 0xee, 0x3e, 0x2c, 0xda, 0xa2,
-		0x8d, 0x34, 0x9c, 0xff, 0xf3, 0x9b, 0x19, 0x2a, 0xf3, 0xc7, 0xef, 0x7e,
-		0x7a, 0x7b, 0xfd, 0xf3, 0x87, 0xff, 0x41, 0xe1, 0x4a, 0xb5, 0x9c, 0xcc,
-		0xe9, 0x07, 0x28, 0x56, 0xad, 0x17, 0x91, 0xa8, 0xa2, 0xe5, 0x04, 0x60,
-		0x5e, 0x08, 0xc6, 0xe9, 0x01, 0x1f, 0x4b, 0xe1, 0x18, 0xe4, 0x05, 0x33,
-		0x56, 0xb8, 0x45, 0xd4, 0xb8, 0x55, 0xfc, 0x2a, 0x1a, 0x1e, 0x55, 0xac,
-		0x14, 0x8b, 0xe8, 0x56, 0x8a, 0x4d, 0xad, 0x8d, 0x8b, 0x20, 0xd7, 0x95,
-		0x13, 0x15, 0xb2, 0x6e, 0x24, 0x77, 0xc5, 0x82, 0x8b, 0x5b, 0x99, 0x8b,
-		0xd8, 0xbf, 0x9c, 0x82, 0xac, 0xa4, 0x93, 0x4c, 0xc5, 0x36, 0x67, 0x4a,
-		0x2c, 0xce, 0x0f, 0x28, 0xe2, 0xc2, 0xe6, 0x46, 0xd6, 0x4e, 0xea, 0x6a,
-		0xa0, 0xeb, 0x00, 0x23, 0x6b, 0x5c, 0xa1, 0xcd, 0x01, 0x1e, 0x27, 0x9d,
-		0x12, 0xcb, 0x37, 0xef, 0x2f, 0xe0, 0xa3, 0x20, 0x97, 0x60, 0xa5, 0x0d,
-		0x7c, 0xf9, 0x02, 0xc9, 0x95, 0xb0, 0x16, 0xd5, 0x26, 0x17, 0x95, 0x75,
-		0xac, 0xca, 0xc5, 0x25, 0xea, 0xb9, 0x66, 0x6b, 0x78, 0x78, 0x98, 0xa7,
-		0x41, 0x68, 0xf2, 0xe8, 0xd1, 0x5c, 0xc9, 0xea, 0x06, 0x8c, 0x50, 0x8b,
-		0xc8, 0xba, 0x7b, 0x25, 0x6c, 0x21, 0x04, 0x46, 0x55, 0x18, 0xb1, 0x5a,
-		0x44, 0x85, 0x73, 0xb5, 0x9d, 0xa5, 0x69, 0xc9, 0xee, 0x72, 0x5e, 0x25,
-		0x99, 0xd6, 0xce, 0x3a, 0xc3, 0x6a, 0x7a, 0xc9, 0x75, 0x99, 0xf6, 0x84,
-		0xf4, 0x59, 0xf2, 0x2c, 0x79, 0x91, 0xe6, 0xd6, 0x6e, 0x69, 0x49, 0x29,
-		0x91, 0xcb, 0xda, 0xe8, 0x8f, 0x35, 0x13, 0xbb, 0x42, 0x94, 0x62, 0x6c,
-		0xcc, 0x9b, 0x58, 0x4e, 0x26, 0xe9, 0xd3, 0x09, 0x3c, 0x85, 0xff, 0x32,
-		0x2b, 0x00, 0x79, 0x9b, 0xdc, 0x35, 0x46, 0x20, 0x25, 0xa5, 0x13, 0x78,
-		0xaf, 0x6f, 0x05, 0x70, 0xbd, 0xa9, 0xba, 0x94, 0x42, 0x26, 0x72, 0xd6,
-		0x20, 0xef, 0x46, 0x40, 0xc1, 0xf0, 0x90, 0xc1, 0x4a, 0xde, 0x09, 0x8e,
-		0x05, 0xb8, 0xcd, 0x98, 0x01, 0x57, 0x30, 0x07, 0xd2, 0xc2, 0x8b, 0xb3,
-		0xfa, 0x0e, 0x1c, 0x53, 0x8a, 0x34, 0x65, 0x9a, 0xdf, 0xc3, 0x17, 0xac,
-		0x44, 0xcd, 0x38, 0x97, 0xd5, 0x3a, 0x76, 0xba, 0x9e, 0x79, 0x96, 0xd7,
-		0x93, 0x87, 0x49, 0xe7, 0xc2, 0xff, 0x95, 0xce, 0x98, 0x02, 0x64, 0x89,
-		0x75, 0x65, 0x83, 0x0b, 0x89, 0x6d, 0xb2, 0x98, 0x80, 0x27, 0xcc, 0x48,
-		0x41, 0xa6, 0x9d, 0xd3, 0xe5, 0x0c, 0xce, 0xbd, 0x0e, 0x80, 0x4c, 0x1b,
-		0x64, 0xd9, 0x92, 0xd1, 0xb8, 0xd5, 0x4a, 0x72, 0x38, 0x11, 0x42, 0x78,
-		0x23, 0xc1, 0xc6, 0xb5, 0xae, 0xc9, 0x53, 0xb9, 0x66, 0x04, 0x26, 0xa2,
-		0xfc, 0x20, 0x39, 0x46, 0x28, 0x56, 0xac, 0x51, 0xae, 0x55, 0x03, 0x4e,
-		0x63, 0x15, 0x4a, 0x0a, 0x9d, 0x14, 0x61, 0x55, 0x44, 0xe2, 0xdd, 0x49,
-		0x42, 0x90, 0xb1, 0x8f, 0x98, 0x82, 0xf0, 0x3e, 0x05, 0xa1, 0x19, 0x9c,
-		0x0d, 0xec, 0x5c, 0xa1, 0x56, 0xe4, 0xec, 0xf3, 0xe8, 0xad, 0x10, 0xe6,
-		0x4a, 0x9d, 0x49, 0x25, 0x4e, 0xc1, 0x16, 0x7a, 0x83, 0xfd, 0xe5, 0xd0,
-		0x1a, 0x29, 0xb6, 0x81, 0xdf, 0xeb, 0xe3, 0xd2, 0xd6, 0x8a, 0xdd, 0xcf,
-		0xa0, 0xd2, 0x95, 0xf7, 0xfd, 0x3f, 0xa5, 0xe0, 0x92, 0xc1, 0xdf, 0xb1,
-		0x7c, 0xa1, 0x67, 0x66, 0xf0, 0xaf, 0x97, 0xaf, 0xea, 0xbb, 0x7f, 0x78,
-		0xf6, 0x91, 0x2c, 0x66, 0x48, 0x5b, 0x49, 0xb1, 0xcd, 0x42, 0x5d, 0x5e,
-		0x7b, 0x62, 0xc8, 0xf7, 0x79, 0xc8, 0x15, 0x79, 0x1c, 0xd2, 0x74, 0x16,
-		0x5e, 0x95, 0x58, 0xb9, 0xfe, 0xe5, 0x73, 0x2c, 0x2b, 0x2e, 0xee, 0x28,
-		0xb5, 0x67, 0x2d, 0xa9, 0x77, 0x28, 0x53, 0x3a, 0xbf, 0x09, 0xb4, 0xb6,
-		0x10, 0x33, 0x98, 0x9e, 0x75, 0x5a, 0x31, 0x5f, 0x66, 0xa5, 0xf4, 0x26,
-		0x46, 0xe1, 0x42, 0x72, 0x2e, 0xaa, 0x1d, 0x3a, 0x6a, 0xc0, 0x06, 0xd5,
-		0xaf, 0x01, 0x13, 0x72, 0x95, 0x1b, 0xad, 0x14, 0xcb, 0x94, 0xe8, 0x90,
-		0x65, 0x41, 0xae, 0xa0, 0x1b, 0x19, 0x04, 0x21, 0x4c, 0x91, 0xa1, 0xfc,
-		0x20, 0xa4, 0x7a, 0xf8, 0x25, 0x94, 0x2d, 0x1f, 0x02, 0xcb, 0x6f, 0xd6,
-		0x46, 0x37, 0x15, 0x8f, 0x73, 0xad, 0x34, 0xa6, 0xff, 0x64, 0xf5, 0x82,
-		0xfe, 0x76, 0x11, 0x7a, 0x3c, 0x18, 0xb9, 0x2e, 0xdc, 0x3e, 0x1c, 0x00,
-		0x1e, 0x42, 0xa9, 0xba, 0x3a, 0x0d, 0x30, 0xd1, 0xd5, 0x39, 0x1e, 0xa6,
-		0xb5, 0x64, 0x66, 0x8d, 0xc9, 0x6f, 0xd5, 0xc5, 0x53, 0xca, 0x24, 0x45,
-		0x41, 0xc1, 0x77, 0xa9, 0x80, 0x7f, 0x7a, 0x3b, 0x2d, 0x84, 0xbc, 0x9b,
-		0xad, 0x58, 0x97, 0xee, 0x2e, 0x55, 0x2d, 0x39, 0xa4, 0x3d, 0x9e, 0xb6,
-		0x6d, 0x30, 0x32, 0xba, 0x44, 0xd4, 0xe1, 0x7f, 0x6c, 0x04, 0xfa, 0xd6,
-		0x7c, 0xa7, 0xa6, 0x23, 0x07, 0x3d, 0x5f, 0x51, 0x93, 0xb0, 0xdc, 0x49,
-		0x04, 0x32, 0xea, 0x3a, 0x3d, 0x72, 0x36, 0x2b, 0xa8, 0x4a, 0x47, 0x39,
-		0x56, 0x3a, 0x6f, 0xac, 0xf7, 0xa7, 0x4f, 0xf8, 0x6a, 0xe5, 0x7b, 0x6f,
-		0xbf, 0x14, 0xcf, 0xa7, 0xaf, 0xb2, 0x9c, 0x0d, 0x9b, 0xfb, 0x3d, 0x93,
-		0x7d, 0x11, 0xdb, 0xd6, 0x2e, 0x89, 0x34, 0x88, 0x6f, 0x1b, 0xc3, 0x37,
-		0x00, 0xdf, 0x0b, 0xee, 0xa5, 0xe6, 0x79, 0x0f, 0xc6, 0x71, 0x72, 0x3a,
-		0x3a, 0x95, 0x3d, 0x88, 0x27, 0x35, 0x5b, 0x8b, 0xe1, 0x64, 0x69, 0x8b,
-		0xe2, 0x3b, 0xe5, 0x6c, 0xe8, 0xf9, 0x07, 0xc5, 0x72, 0x51, 0x68, 0x45,
-		0x8c, 0x9c, 0xd9, 0x22, 0xd3, 0xcc, 0x70, 0xc0, 0x14, 0xb1, 0x6e, 0x46,
-		0xd5, 0x5b, 0x0e, 0x3b, 0xd4, 0xd5, 0xd5, 0xfd, 0x59, 0x6b, 0xdd, 0x89,
-		0x3b, 0x17, 0x33, 0x25, 0xd7, 0xd8, 0x9c, 0x39, 0xe6, 0x41, 0x18, 0x5f,
-		0xb0, 0x91, 0x78, 0xf1, 0xfc, 0x90, 0x86, 0xb3, 0x5d, 0xc6, 0x43, 0x4c,
-		0x3d, 0x02, 0x86, 0x7c, 0xb2, 0x5c, 0x8f, 0x87, 0x8a, 0xac, 0x68, 0x9e,
-		0xc5, 0x7d, 0x2b, 0x77, 0x9d, 0xc2, 0xb8, 0x6c, 0x2c, 0x0d, 0xe5, 0xbf,
-		0x91, 0x0e, 0xdc, 0x0f, 0x69, 0xbb, 0x20, 0x70, 0x7b, 0xa6, 0x61, 0xf5,
-		0xd3, 0x23, 0x8d, 0x72, 0xff, 0x84, 0xcf, 0x88, 0x15, 0xc8, 0x15, 0xb3,
-		0x76, 0x11, 0xb5, 0xd3, 0xbf, 0x9d, 0x8f, 0xb2, 0x42, 0x30, 0xe1, 0x8e,
-		0xd8, 0x1d, 0x97, 0xed, 0x36, 0x46, 0x51, 0x2e, 0x7b, 0x51, 0x02, 0x05,
-		0x56, 0x04, 0x7d, 0x58, 0xa9, 0x46, 0xf2, 0x9e, 0x67, 0xcc, 0xd5, 0xaa,
-		0x0a, 0x05, 0xf3, 0x0b, 0x0c, 0xff, 0xcc, 0xd9, 0xce, 0x71, 0x66, 0x58,
-		0xc5, 0xbb, 0x8d, 0x79, 0x12, 0x2d, 0xdb, 0x65, 0xcf, 0x71, 0xce, 0xce,
-		0xfc, 0xba, 0xbf, 0xc4, 0xa9, 0x4b, 0xab, 0x9d, 0x0d, 0xac, 0xa4, 0x68,
-		0xa6, 0x77, 0x6c, 0xfb, 0x32, 0x4f, 0x51, 0x69, 0x17, 0xea, 0x51, 0x7f,
-		0xd1, 0x13, 0xba, 0x1e, 0x9d, 0x77, 0x1c, 0x03, 0x68, 0x45, 0xbf, 0xf5,
-		0xce, 0x51, 0x9c, 0x77, 0xb1, 0x35, 0xaa, 0x7d, 0x7a, 0x84, 0x32, 0x18,
-		0xd7, 0x5a, 0xc0, 0x93, 0x9b, 0x53, 0x78, 0x22, 0x61, 0xb6, 0x80, 0x5e,
-		0xd6, 0xa2, 0x54, 0xcb, 0x86, 0xd7, 0x87, 0xe5, 0x05, 0x9f, 0x01, 0x6e,
-		0x76, 0xa3, 0xab, 0xf5, 0x12, 0xc5, 0x9e, 0xc8, 0x9e, 0xf1, 0x82, 0x7b,
-		0xfd, 0xed, 0xd9, 0x3c, 0x45, 0xe6, 0x81, 0xdc, 0xf5, 0x7d, 0x2d, 0xbe,
-		0x26, 0x49, 0x67, 0xc7, 0x64, 0xdf, 0x5d, 0x5e, 0x01, 0x85, 0xb0, 0x2b,
-		0x8f, 0x74, 0x22, 0x1f, 0x13, 0x7d, 0x73, 0xcb, 0x24, 0x2e, 0x01, 0xa9,
-		0xa4, 0xbb, 0x87, 0x5f, 0x70, 0xdd, 0xed, 0xea, 0xf0, 0x0c, 0x74, 0x70,
-		0x4c, 0xcb, 0x8f, 0xac, 0xa9, 0xf2, 0x02, 0xae, 0xe5, 0xbe, 0x0f, 0xe1,
-		0x88, 0x4e, 0x8e, 0x29, 0xb8, 0x72, 0x1e, 0x20, 0x63, 0x51, 0x4f, 0x4c,
-		0x8e, 0x45, 0x80, 0x7c, 0xa2, 0xe2, 0x7d, 0x01, 0xe6, 0x29, 0x95, 0x8c,
-		0x9e, 0x87, 0x70, 0x31, 0x7a, 0xd3, 0xc2, 0x75, 0x0c, 0x22, 0xbc, 0xef,
-		0x96, 0xf1, 0xf9, 0x94, 0x86, 0x69, 0x5c, 0xf2, 0xf8, 0x65, 0x8f, 0xe9,
-		0x62, 0xda, 0x31, 0x6d, 0xef, 0x3e, 0xd1, 0xd2, 0xe3, 0x46, 0x37, 0x26,
-		0x17, 0x6f, 0x71, 0xd2, 0x3a, 0x34, 0x0a, 0x88, 0x2c, 0xdc, 0x99, 0x15,
-		0x04, 0x32, 0x82, 0x6c, 0x4d, 0xeb, 0x6b, 0x08, 0xb0, 0x70, 0x12, 0x0e,
-		0xb6, 0x91, 0x14, 0xd3, 0x2d, 0xf8, 0xc7, 0xd0, 0x76, 0xb4, 0x8f, 0x63,
-		0x23, 0x6c, 0x8d, 0x17, 0x30, 0x9c, 0xfb, 0xd1, 0x90, 0x91, 0x6e, 0xd1,
-		0x61, 0x5f, 0x0f, 0x98, 0x21, 0x88, 0x60, 0x72, 0x64, 0x2d, 0xf8, 0x0e,
-		0x3f, 0x49, 0x6c, 0x3f, 0x1a, 0xc6, 0x74, 0xd3, 0x25, 0x91, 0x42, 0x76,
-		0x85, 0x6f, 0x93, 0x0b, 0x8e, 0x77, 0xee, 0x62, 0xe7, 0xa0, 0x43, 0xe1,
-		0xe1, 0xd3, 0x4f, 0x85, 0xa8, 0x0e, 0x90, 0x3f, 0x0a, 0xbc, 0x5a, 0x61,
-		0x00, 0x07, 0x8e, 0x02, 0x69, 0xcf, 0xa1, 0x94, 0x3c, 0xda, 0xa3, 0x1d,
-		0xf2, 0x7e, 0xee, 0xc2, 0x0c, 0xec, 0x94, 0x8e, 0xbb, 0x93, 0xf9, 0xee,
-		0x0c, 0x89, 0x7f, 0x53, 0x4a, 0xdf, 0x9e, 0xdf, 0x8a, 0x9e, 0x7b, 0xc4,
-		0xb1, 0xa4, 0x6d, 0x51, 0x7c, 0x3f, 0x78, 0x3a, 0x6e, 0xe4, 0xaf, 0x70,
-		0x51, 0x42, 0x8e, 0x9d, 0x77, 0x99, 0x39, 0xcc, 0xb3, 0x1d, 0xa8, 0x99,
-		0xab, 0x00, 0xff, 0xc5, 0xb5, 0x91, 0xb8, 0x66, 0xee, 0xfd, 0xf3, 0x9d,
-		0xdd, 0xfd, 0x18, 0xc1, 0x59, 0x88, 0xf7, 0x2a, 0x91, 0xb0, 0x8d, 0x4d,
-		0x58, 0xc9, 0x3e, 0xeb, 0xf0, 0x2d, 0x22, 0xf2, 0x69, 0x7a, 0x3b, 0x4d,
-		0x0b, 0x5d, 0x8a, 0x7f, 0x1b, 0x8f, 0xbe, 0x05, 0x59, 0xef, 0x71, 0xf9,
-		0x4e, 0x58, 0x37, 0x46, 0xe5, 0x49, 0x68, 0xd4, 0x2e, 0xc6, 0x4f, 0xf2,
-		0x33, 0x2e, 0xd9, 0x19, 0x2b, 0xe5, 0x62, 0x90, 0x9a, 0x08, 0xf0, 0xce,
-		0x88, 0x5f, 0x79, 0x59, 0x83, 0x0b, 0x0f, 0x3f, 0x4a, 0x83, 0x0c, 0x0d,
-		0xf3, 0x10, 0xca, 0xe1, 0xa2, 0x0e, 0xea, 0xd4, 0x76, 0xeb, 0x1e, 0x57,
-		0x28, 0xe8, 0x0e, 0x91, 0x80, 0x3d, 0x6a, 0x94, 0xb0, 0x1a, 0x42, 0xa7,
-		0xfb, 0xc7, 0xdf, 0xa7, 0xab, 0x29, 0x19, 0x7b, 0x3d, 0x4d, 0xc4, 0x43,
-		0x1d, 0xbd, 0x9f, 0xb9, 0xef, 0xfd, 0xfc, 0x27, 0xf4, 0x33, 0xa5, 0xfd,
-		0x7b, 0x37, 0xff, 0xb5, 0xbb, 0x79, 0xdc, 0xd7, 0xf3, 0xfe, 0xf8, 0x52,
-		0xd3, 0xdd, 0xc0, 0x15, 0x58, 0x7d, 0x13, 0xee, 0x71, 0xba, 0x52, 0xf7,
-		0xd8, 0xa4, 0xb9, 0x6a, 0x38, 0xde, 0xbf, 0x7c, 0xcb, 0x96, 0xd8, 0xcf,
-		0xb0, 0x91, 0xae, 0x40, 0x46, 0x01, 0x73, 0xb9, 0xc4, 0x60, 0xe9, 0xbb,
-		0xa8, 0xa9, 0xe7, 0xa9, 0x5c, 0xe2, 0xf7, 0xb7, 0x56, 0xc9, 0xd0, 0xc2,
-		0x64, 0xeb, 0x03, 0xcc, 0x1f, 0xc7, 0x31, 0xa4, 0xfd, 0xb5, 0x12, 0xe2,
-		0x38, 0x5c, 0xba, 0x43, 0x1c, 0xd8, 0xdf, 0xfe, 0x37, 0x72, 0xbf, 0x06,
-		0x00, 0x00, 0xff, 0xff, 0x40, 0x9a, 0x3a, 0xf3, 0xa2, 0x13, 0x00, 0x00,
-	},
-		"static/index.html",
-	)
-}
-
-// Asset loads and returns the asset for the given name.
-// It returns an error if the asset could not be found or
-// could not be loaded.
-func Asset(name string) ([]byte, error) {
-	cannonicalName := strings.Replace(name, "\\", "/", -1)
-	if f, ok := _bindata[cannonicalName]; ok {
-		return f()
-	}
-	return nil, fmt.Errorf("Asset %s not found", name)
-}
-
-// AssetNames returns the names of the assets.
-func AssetNames() []string {
-	names := make([]string, 0, len(_bindata))
-	for name := range _bindata {
-		names = append(names, name)
-	}
-	return names
-}
-
-// _bindata is a table, holding each asset generator, mapped to its name.
-var _bindata = map[string]func() ([]byte, error){
-	"static/index.html": static_index_html,
-}
-// AssetDir returns the file names below a certain
-// directory embedded in the file by go-bindata.
-// For example if you run go-bindata on data/... and data contains the
-// following hierarchy:
-//     data/
-//       foo.txt
-//       img/
-//         a.png
-//         b.png
-// then AssetDir("data") would return []string{"foo.txt", "img"}
-// AssetDir("data/img") would return []string{"a.png", "b.png"}
-// AssetDir("foo.txt") and AssetDir("notexist") would return an error
-// AssetDir("") will return []string{"data"}.
-func AssetDir(name string) ([]string, error) {
-	node := _bintree
-	if len(name) != 0 {
-		cannonicalName := strings.Replace(name, "\\", "/", -1)
-		pathList := strings.Split(cannonicalName, "/")
-		for _, p := range pathList {
-			node = node.Children[p]
-			if node == nil {
-				return nil, fmt.Errorf("Asset %s not found", name)
-			}
-		}
-	}
-	if node.Func != nil {
-		return nil, fmt.Errorf("Asset %s not found", name)
-	}
-	rv := make([]string, 0, len(node.Children))
-	for name := range node.Children {
-		rv = append(rv, name)
-	}
-	return rv, nil
-}
-
-type _bintree_t struct {
-	Func func() ([]byte, error)
-	Children map[string]*_bintree_t
-}
-var _bintree = &_bintree_t{nil, map[string]*_bintree_t{
-	"static": &_bintree_t{nil, map[string]*_bintree_t{
-		"index.html": &_bintree_t{static_index_html, map[string]*_bintree_t{
-		}},
-	}},
-}}
@@ -0,0 +1,12 @@
+// Command amibackup is the standalone form of "amitools backup".
+package main
+
+import (
+	"os"
+
+	"github.com/AppliedTrust/amibackup/pkg/amibackup"
+)
+
+func main() {
+	os.Exit(amibackup.Main(os.Args[1:]))
+}
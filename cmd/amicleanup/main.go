@@ -0,0 +1,12 @@
+// Command amicleanup is the standalone form of "amitools cleanup".
+package main
+
+import (
+	"os"
+
+	"github.com/AppliedTrust/amibackup/pkg/amicleanup"
+)
+
+func main() {
+	amicleanup.Main(os.Args[1:])
+}
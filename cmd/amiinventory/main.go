@@ -0,0 +1,12 @@
+// Command amiinventory is the standalone form of "amitools inventory".
+package main
+
+import (
+	"os"
+
+	"github.com/AppliedTrust/amibackup/pkg/amiinventory"
+)
+
+func main() {
+	amiinventory.Main(os.Args[1:])
+}
@@ -0,0 +1,73 @@
+// Command amitools bundles amibackup, amicleanup, amiinventory and snapcleanup into one binary.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/AppliedTrust/amibackup/pkg/amibackup"
+	"github.com/AppliedTrust/amibackup/pkg/amicleanup"
+	"github.com/AppliedTrust/amibackup/pkg/amiinventory"
+	"github.com/AppliedTrust/amibackup/pkg/snapcleanup"
+)
+
+const version = "0.1"
+
+var usage = `amitools: AWS AMI backup tools in one binary
+
+Usage:
+  amitools <command> [<args>...]
+  amitools -h --help
+  amitools --version
+
+Commands:
+  backup       create cross-region AMI backups (amibackup)
+  cleanup      clean up old AMIs by name (amicleanup)
+  inventory    show AMIs created with amibackup (amiinventory)
+  snapcleanup  clean up snapshots (snapcleanup)
+
+Run "amitools <command> --help" for a command's options.
+`
+
+// commands maps each subcommand to the tool it runs, which returns its exit code
+var commands = map[string]func([]string) int{
+	"backup":      amibackup.Main,
+	"cleanup":     exitsOwn(amicleanup.Main),
+	"inventory":   exitsOwn(amiinventory.Main),
+	"snapcleanup": exitsOwn(snapcleanup.Main),
+}
+
+// exitsOwn adapts a tool that exits non-zero by itself, so it only ever returns 0
+func exitsOwn(main func([]string)) func([]string) int {
+	return func(args []string) int {
+		main(args)
+		return 0
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	case "--version":
+		fmt.Println(version)
+		return
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown command %q - want one of %v\n", os.Args[1], names)
+		os.Exit(1)
+	}
+	os.Exit(command(os.Args[2:]))
+}
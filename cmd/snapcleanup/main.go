@@ -0,0 +1,12 @@
+// Command snapcleanup is the standalone form of "amitools snapcleanup".
+package main
+
+import (
+	"os"
+
+	"github.com/AppliedTrust/amibackup/pkg/snapcleanup"
+)
+
+func main() {
+	snapcleanup.Main(os.Args[1:])
+}
@@ -0,0 +1,4299 @@
+package amibackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ebs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/docopt/docopt-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const version = "0.14-20171229"
+
+var usage = `amibackup: create cross-region AWS AMI backups
+
+Usage:
+  amibackup [options] [-d <region>]... [-p <window>]... [--retention=<rule>]... [--retention-class=<name=windows>]... [--exclude-tag=<tag>]... [--ssm-parameter=<key=value>]... [--instance-id=<id>]... [--filter-tag=<tag>]... ([-i <volume>]... [<instance_name_tag>...] | --simulate=<log-file> |
+      --retag [--rename-tag=<old:new>]... [--add-tag=<key=value>]... [<instance_name_tag>...])
+  amibackup -h --help
+  amibackup --version
+
+Options:
+  --instances-from=<file>   Also back up the instance name tags listed in this file (- for stdin), one per line.
+  --instance-id=<id>        Also back up this instance, found by its ID rather than a Name tag - multiple use ok.
+                            Its backups are named and hostname-tagged with the instance ID.
+  -s, --source=<region>     AWS region of running instance [default: us-east-1].
+  -d, --dest=<region>       AWS region to store backup AMI - multiple use ok, copying each backup to every one, and
+                            purging each independently [default: us-west-1].
+  --dest-map=<file>         JSON file of data classification to approved dest region(s), e.g. {"pci": "us-west-2"};
+                            each instance is copied to the regions for its --classification-tag instead of --dest.
+  --classification-tag=<key>  Instance tag holding the data classification for --dest-map.
+  --require-policy-tag=<key>  Only back up instances with this backup-policy tag; its value is copied to their AMIs and snapshots.
+  --allowed-policies=<list>  With --require-policy-tag, the comma-separated policy values to accept (default: any).
+  --policy-enforcement=<mode>  Instances without an approved policy are skipped (enforce) or backed up (warn) [default: enforce].
+                            Enforcing exits non-zero when any instance is skipped.
+  --copy-billing-tags=<keys>  Comma-separated instance tags (e.g. CostCenter,Project,Team) to copy to their AMIs and snapshots.
+  -t, --timeout=<secs>      Timeout waiting for AMI creation [default: 30m].
+                            Unless set, it grows by 5m for each volume past 8 on the biggest instance.
+  --not-found-grace=<t>     How long a new AMI may be missing from DescribeImages before it counts as failed [default: 5m].
+  --poll-stale-limit=<t>    Stop waiting for an AMI once DescribeImages has failed (throttled, say) for this long [default: 10m].
+  -e, --encrypted           Encrypts the EBS volumes attached to the ami with key supplied by -k, or the accounts default KMS key. [default: false]
+  -k, --kms-key-id=<keyid>  KMS key arn for encrypted EBS volumes. Implies -e.
+  --kms-key-alias=<alias>   KMS key alias (e.g. alias/my-backup-key) in the dest region, instead of --kms-key-id. Implies -e.
+  -p, --purge=<window>      One or more purge windows - see below for details.
+  --retention=<rule>        Simpler alternative to purge windows - see below for details.
+  --retention-class=<name=windows>  Named set of purge windows and/or retention rules separated by ;, e.g.
+                            gold=1d:4d:30d;7d:30d:90d - multiple use ok.  See Retention classes below.
+  --retention-class-tag=<key>  Instance tag naming its retention class, also stamped on its backups [default: amibackup:retention].
+  --keep-count=<n>          Keep the newest n backups of each host in each region and purge the rest, instead of
+                            purge windows - see below for details.
+  --combine-retention       Allow --keep-count with -p, --retention or --retention-class: a backup either keeps is kept.
+  --max-purge=<n>           Purge at most this many AMIs per host and region in one run, 0 for no limit [default: 10].
+  --max-purge-per-host=<n>  Refuse to purge a host and region whose plan deletes more AMIs, 0 for no limit [default: 25].
+  --confirm-large-purge     Go ahead with purges over --max-purge-per-host (otherwise a terminal is asked to confirm).
+  --purge-order=<order>     Purge oldest first (time) or largest snapshots first (size) [default: time].
+  --rate-limit-snapshots=<per-second>  Most snapshot deletions per second across all purges, 0 for no limit [default: 10].
+  -o, --purgeonly           Purge old AMIs without creating new ones.
+  --recover-failed          Only back up hosts with no available backup in the dest region newer than --recover-sla.
+  --recover-sla=<age>       Age of the newest backup that makes --recover-failed back a host up [default: 25h].
+  --no-cross-region-guard   Allow purging a backup even when the other region has no backup at least as new.
+  --purge-report=<path>     Write a CSV report of every AMI considered by the purge run.
+  --max-gap=<age>           Longest a host may go without a backup (e.g. 26h or 2d): the purge warns about every host
+                            and region whose kept backups leave a longer gap, or that has none.
+  --gap-report              With --max-gap, print the hosts and regions over it to stdout after the purge.
+  --metrics-file=<path>     At the end of the run, write each host and region's kept backups, oldest backup age and
+                            longest gap, and the instances --max-new-gb deferred, as Prometheus metrics to this file,
+                            for node_exporter's textfile collector.
+  --cloudwatch-namespace=<ns>  At the end of the run, also put those metrics to CloudWatch in the source region, in this namespace.
+  --summary-s3=<url>        At the end of the run, upload its JSON summary, gzip'd, to this S3 bucket and prefix
+                            (s3://bucket/prefix) as <prefix>/year=YYYY/month=MM/day=DD/run-<run ID>.json.gz, dated
+                            in UTC.  The bucket must be in the source region.  A failed upload is retried, then
+                            logged - it doesn't change the exit code.
+  --summary-s3-kms=<key>    Encrypt the uploaded summary with this KMS key (SSE-KMS) rather than the bucket's default.
+  --as-of=<time>            Measure purge windows and retention ages from this time instead of now - RFC 3339,
+                            "2006-01-02 15:04", a date or a Unix timestamp.
+  --plan-hash               Print the SHA-256 of the purge plan (as JSON, in a fixed order) to stdout - with --as-of,
+                            runs over the same backups give the same hash.
+  --simulate=<log-file>     Run the purge windows (and --keep-count) offline over a file of backup times (one Unix timestamp per line)
+                            and print the purge report (to stdout, or --purge-report).
+  -D, --dry-run             Do not actually create or purge anything, just say what would have happened.
+  --plan=<path>             With --dry-run, also write everything the run would do - the AMIs it would create and
+                            copy, with their volumes, sizes, encryption and tags, and its purge decisions - to this
+                            JSON file (described by schema/plan.schema.json), for review before the real run.
+  --progress                Show a status block for each instance while backing up (default when stdout is a terminal).
+  --no-progress             Never show the status block.
+  --progress-file=<path>    Keep a JSON file of each instance's backup phase and AMIs up to date, for monitoring tools.
+  --checkpoint-file=<path>  Record each instance's progress in this file as it happens; running again with the same
+                            file (and the same hosts and options) resumes an interrupted run.
+  --no-wait                 Start AMI creates and copies without waiting for them; the next run copies and checks them.
+  --wait-snapshots          Once a copy is available, also wait for its snapshots to finish copying their data, so
+                            instances launched from it aren't slow on first boot.  Can add hours to a run.
+  --ami-store-bucket=<s3-bucket>  Also archive each new AMI to this S3 bucket with the EC2 image store.
+  --ami-store-prefix=<prefix>  Path prefix for --ami-store-bucket archives [default: amibackup].
+  --backup-vault=<name>     Also back each instance up into this AWS Backup vault in the source region once its AMI
+                            is available, with the AMI's tags.  Vault failures are reported but don't fail the backup.
+  --backup-role-arn=<arn>   IAM role AWS Backup assumes for --backup-vault jobs.
+  --copy-snapshots-independently  Also copy each snapshot to the dest region on its own, apart from the AMI copy
+                            (purge leaves these copies alone).
+  --discard-source-after-copy  Deregister each new source AMI and delete its snapshots once its copy is verified.
+  --description-template=<template>  Go template for AMI descriptions [default: {{.InstanceNameTag}} {{.TimeString}} {{.InstanceId}}].
+                            Can use {{.InstanceNameTag}}, {{.TimeString}}, {{.InstanceId}}, {{.SourceRegion}} and
+                            {{index .Tags "key"}} (an instance tag).  Copies get the source AMI as {{.InstanceId}}, and
+                            also {{.DestRegion}} and {{.CopyIndex}} (its place among the instance's dest regions, from 1).
+  --verify-large-snapshots  Check that new snapshots over 2 TiB have content, using the EBS direct API.
+  --tag-snapshots-early     Tag the source region's snapshots as soon as the AMI is created, not after the copy.
+  --dedup-by-content        Skip instances whose volumes have had no writes since their last backup's snapshots
+                            (per CloudWatch VolumeWriteOps) and extend that backup's timestamp instead.
+  --overwrite-snapshot-name  Replace existing Name tags on backup snapshots with our "<hostname> <device> <date>" name.
+  --instance-state-tag      Tag each instance with its backup progress (amibackup-state=creating/copying/done/error[:ami-id]).
+  --shard=<i>/<n>           Split the run across n workers, this one being worker i (1 to n): back up only the
+                            instances whose ID hashes to shard i, and purge only the hosts whose name does.
+  --tag-instance            After each backup, tag the instance amibackup:last-success and amibackup:last-ami, or
+                            amibackup:last-failure with the reason.
+  --priority-tag=<key>      Instance tag holding a number that orders backups: lower values first, untagged last.
+  --deadline=<when>         Start no backup estimated to finish after this: a duration (4h), a time of day (05:00) or
+                            an RFC 3339 time.  Backups are estimated from the last one's time, or from volume sizes,
+                            and start in --priority-tag order; those deferred are tagged amibackup:deferred and go
+                            first next run.  Backups still running at it are stopped, as at --timeout.
+  --max-new-gb=<n>          Stop starting backups, in priority order, once their estimated new snapshot data would pass
+                            this many GB; the rest are deferred to a later run.  The estimate is an upper bound: the
+                            full size of each included volume, though snapshots are incremental.  0 for no limit [default: 0].
+  --per-account-copy-limit=<n>  Simultaneous AMI copies per AWS account, 0 for no limit [default: 5].
+  --copy-retries=<n>        Times to retry a copy that hits the simultaneous copy limit [default: 10].
+  --pipeline-retries=<n>    Times to re-run an instance's backup from the start when creating, copying or checking its
+                            images fails, a few minutes apart, before it counts as failed.  Retries adopt the images
+                            the failed attempt made rather than making more, and are bounded by --timeout [default: 0].
+  -i, --ignore=<volume>     Ignore volume mounted at this mount point - multiple use ok.
+  --only-devices=<list>     Back up only the volumes at these comma-separated devices (e.g. /dev/sda1,/dev/sdf),
+                            which must include the root device.
+  --unprotected-ok-tag=<tag>  Volume tag (key=value, or key) acknowledging that a persistent volume left out by -i
+                            (--ignore) or --only-devices is backed up some other way, or needn't be [default: backup=excluded-ok].
+  --strict-unprotected      Fail an instance that leaves out a persistent volume without that tag, rather than warn.
+  --strict-kms              Fail an instance whose copies are predicted to fail because of the KMS key its volumes
+                            are encrypted with, rather than warn.
+  --exclude-tag=<tag>       Skip instances tagged key=value, or with key (any value) - multiple use ok.
+  --filter-tag=<tag>        Also back up every instance tagged key=value, or with key (any value), each under its own
+                            Name tag, or its instance ID without one - multiple use ok, an instance matching them all.
+  --windows-policy=<mode>   For Windows instances: warn that NoReboot images may leave NTFS dirty, ignore, or vss [default: warn].
+                            vss runs the AWSEC2-CreateVssSnapshot SSM document (the instance needs the SSM agent, the
+                            AWS VSS components and a role that can create images), falling back to a NoReboot image.
+  --pre-freeze-ssm=<document>  Run this SSM document on each instance (e.g. to flush and lock a database) before imaging it.
+  --post-thaw-ssm=<document>  Run this SSM document on each instance once its AMI is available, even if the image failed.
+  --ssm-parameter=<key=value>  Parameter for the --pre-freeze-ssm and --post-thaw-ssm documents - multiple use ok.
+  --tag-prefix=<prefix>     Prefix for the hostname/instance/date/timestamp/sourceregion/destregion tags we write and read, e.g. amibackup:.
+  --legacy-tags             With --tag-prefix, also find and read backups tagged without the prefix.
+  --also-read-unprefixed    Same as --legacy-tags.
+  --case-insensitive        Match instance Name tags case-insensitively (Web-01 matches web-01).
+  --normalize=<mode>        Hostname tag written to backups: lower or preserve [default: preserve].
+  --freeze=<mode>           Change freeze: none, purge (back up but delete nothing) or all (do nothing) [default: none].
+                            A frozen run exits 3.
+  --freeze-parameter=<name>  SSM parameter whose value purge or all freezes every run; none to not check [default: /amibackup/freeze].
+                            The value may be time-boxed, e.g. "purge until 2026-01-02T00:00:00Z".
+  --latest-parameter=<path>  SSM parameter path holding each host's latest backup AMI ID in each region, as
+                            <path>/<hostname>.  When the purge deletes the AMI one names, it is pointed at the
+                            newest backup left, or deleted if there is none.
+  --gc-references           Point each host's --latest-parameter that names an AMI that no longer exists at its
+                            newest available backup, or delete it if there is none, then exit.
+  --purge-cache=<file>      Remember each dest region's last purge scan here, and skip the scan while no backup can be due.
+  --force-purge-scan        With --purge-cache, scan every dest region anyway (and refresh the cache).
+  --cleanup-failed-copies   Deregister the dest region AMIs left failed or error by a copy, and delete their snapshots.
+  --no-reconcile            Skip the startup check for incomplete backups left by crashed runs.
+  --incomplete-max-age=<t>  Delete incomplete backups older than this [default: 48h].
+  --in-progress-stale=<t>   Age (e.g. 24h or 2d) of a run past which its amibackup:in-progress tag no longer keeps
+                            reconciliation and the purge off an image - it's a crashed run's leftover [default: 24h].
+  --audit-tags              Report existing backups whose hostname tags differ only by case, then exit.
+  --retag                   Migrate the tags on existing backups and their snapshots, then exit.
+  --rename-tag=<old:new>    With --retag, copy tag key old to key new - multiple use ok.
+  --add-tag=<key=value>     With --retag, add this static tag - multiple use ok.
+  --remove-old              With --retag, delete the old keys after copying them.
+  --add-prefix              With --retag and --tag-prefix, copy each of our backup tags from its unprefixed key to
+                            its prefixed one, to move existing backups under the prefix.
+  --validate-tags           Report existing backups missing any of our standard tags, then exit.
+  --coverage-report         Report every running instance in the source region with no backups, none newer than the
+                            coverage max age, or no copy that new in a dest region, then exit.
+  --coverage-group-tag=<key>  Instance tag to group the coverage report by, e.g. Team or Environment [default: Team].
+  --coverage-max-age=<age>  Age (e.g. 25h or 2d) past which a host's newest backup no longer covers it [default: 25h].
+  --coverage-format=<fmt>   Print the coverage report as a table or json [default: table].
+  --coverage-csv=<path>     Also write the coverage report as CSV to this file.
+  --fail-on-uncovered       With --coverage-report, exit 11 if any running instance isn't covered.
+  --fix-tags                With --validate-tags, add the missing tags where their values can be recovered.
+  --reencrypt               Copy every dest region backup not under the -k or --kms-key-alias key to a copy under it, then
+                            deregister the old one; prints a JSON audit record per backup, then exit.
+  --reencrypt-rate=<per-hour>  Most --reencrypt copies started per hour, 0 for no limit [default: 60].
+  --min-keep=<n>            With --reencrypt, never deregister a backup if that leaves a host fewer available backups [default: 1].
+  --mutate-role-arn=<arn>   Make every call that changes something (create, copy, tag, deregister, delete...) as this
+                            assumed role; Describe, Get and List calls keep the default credentials.
+  --endpoint-url=<url>      Send AWS API calls to this endpoint instead of the regional AWS one (e.g. a local test stack).
+  --otel-endpoint=<url>     Export an OpenTelemetry trace of the run to this OTLP collector (http://, https://, grpc:// or grpcs://).
+  --debug                   Also log benign details, such as deletes that raced with a concurrent run and found
+                            the work already done.
+  --print-config            Show the effective value of every option and where it came from, then exit.
+  --generate-iam-policy     Print the IAM policy with just the permissions this run's options need, then exit.
+  --version                 Show version.
+  -h, --help                Show this screen.
+
+Environment:
+  Every option can also be set as AMIBACKUP_<OPTION>, e.g. AMIBACKUP_SOURCE, AMIBACKUP_KMS_KEY_ID,
+  AMIBACKUP_DRY_RUN=true.  Multiple-use options take a comma-separated list, e.g.
+  AMIBACKUP_PURGE=1d:4d:30d,7d:30d:90d.  Flags on the command line take precedence.
+
+Restoring:
+  amibackup restore launches an instance from a backup - see amibackup restore --help.
+
+Setting up:
+  amibackup init asks for the regions, instances and retention to use, checks them with AWS, and
+  writes them to a settings file of AMIBACKUP_* variables - see amibackup init --help.
+
+AWS Authentication:
+  Either setup a ~/.aws/credentials or ~/.aws/config file (AWS_PROFILE selects a profile)
+	OR set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	OR run on an instance with an IAM role (credentials are refreshed automatically during long runs).
+
+Purge windows:
+  Delete old AMIs (and associated snapshots) based on the Purge windows you define.
+  By default AMIs are kept.  AMIs in specified Purge Windows are purged.
+  Purge Window format is: PURGE_INTERVAL:PURGE_START:PURGE_END
+  Each is a time interval (second/minute/hour/day), such as: 1s:4m:9d
+  Where:
+    PURGE_INTERVAL  time interval in which to keep one backup
+    PURGE_START     start purging (ago)
+    PURGE_END       end purging (ago)
+  Where windows overlap, an AMI that any of them keeps is kept (a warning lists the overlaps).
+  Sample purge schedule:
+  -p 1d:4d:30d -p 7d:30d:90d -p 30d:90d:180d   Keep all for past 4 days, 1/day for past 30 days, 1/week for past 90 days, 1/mo forever.
+
+Retention rules:
+  Retention rule format is: COUNTxPERIOD[:FROM-TO] or COUNTxPERIOD:FROM+
+  Keep COUNT backups per PERIOD (hour/day/week/month/year) for backups aged FROM to TO (or older than FROM).
+  A rule without an age range applies from now until the next rule starts.
+  Rules are translated into purge windows; ages older than every rule are kept.
+  Sample retention schedule:
+  --retention 3xday --retention 1xday:7d-30d --retention 1xweek:30d+   Keep 3/day for the past week, 1/day for past 30 days, 1/week after that.
+
+Retention classes:
+  An instance tagged with a --retention-class name (amibackup:retention=gold) has the class stamped
+  on its backups, and they are purged by that class's windows alone.  Backups without a class, or
+  with one no longer defined, are purged by the -p and --retention windows.  In AMIBACKUP_RETENTION_CLASS,
+  separate classes with commas: gold=1d:4d:30d;7d:30d:90d,bronze=1xweek.
+
+Keeping a count:
+  --keep-count=14 keeps the 14 newest backups of each host in each region, whatever their age, and
+  purges the rest.  It replaces purge windows: with -p, --retention or --retention-class as well,
+  it needs --combine-retention, and then a backup is kept if the windows or the count keep it.
+  The purge report, --dry-run and --plan give the rule (window, count or both) behind each decision.
+
+Exit codes:
+  0    success
+  1    internal: any other error
+  2    config: invalid options, or an instance refused for a missing --require-policy-tag
+  3    frozen: a --freeze held the run back
+  4    discovery: finding instances failed, or none matched a name tag
+  5    credentials: AWS rejected the credentials, or they lack a permission
+  6    create: creating a backup failed
+  7    copy: a backup was created, but copying it failed
+  8    verify: a copy didn't match its source
+  9    purge: backups succeeded, but purging old ones failed
+  10   partial: some instances were backed up and others failed
+  11   uncovered: --fail-on-uncovered found running instances without current backups
+  124  the --timeout was hit
+  130  interrupted
+  When every instance fails, the earliest failing stage sets the code.  The Lambda result carries
+  the same outcome as status (success, partial, failed, frozen, interrupted or timeout) and error_class.
+`
+
+var apiPollInterval = 15 * time.Second
+
+// exit code when Ctrl-C stops a dry-run purge plan part way through
+const exitInterrupted = 130
+
+var errInterrupted = errors.New("interrupted")
+
+// set while a dry-run purge is being planned, so Ctrl-C stops it cleanly
+var purgePlanning int32
+
+// runSummary is the outcome of a run - the Lambda function's result
+type runSummary struct {
+	Backups          []backupResult  `json:"backups"`
+	Purged           int             `json:"purged"`
+	Failed           int             `json:"failed"`
+	Pending          []string        `json:"pending,omitempty"`             // AMIs still being created or copied (--no-wait)
+	Errors           []string        `json:"errors,omitempty"`              // resuming earlier runs' pending backups
+	PurgeErrors      []string        `json:"purge_errors,omitempty"`        // purging old backups
+	Retention        []retentionStat `json:"retention,omitempty"`           // each host and region's kept backups, after the purge
+	GapViolations    []string        `json:"gap_violations,omitempty"`      // hosts and regions over --max-gap
+	Deferred         []string        `json:"deferred,omitempty"`            // instances --max-new-gb left for a later run
+	DeadlineDeferred []string        `json:"deadline_deferred,omitempty"`   // instances --deadline left for a later run
+	PolicyMissing    []string        `json:"policy_missing,omitempty"`      // instances refused by --require-policy-tag
+	VaultFailed      []string        `json:"vault_failed,omitempty"`        // instances whose --backup-vault job didn't start
+	Unprotected      []string        `json:"unprotected_volumes,omitempty"` // persistent volumes left out of backups
+	Frozen           string          `json:"frozen,omitempty"`              // purge or all, if a freeze held the run back
+	Instances        int             `json:"instances"`
+	InstancesFrom    string          `json:"instances_from,omitempty"`            // the --instances-from list, if any
+	Shard            string          `json:"shard,omitempty"`                     // this worker's --shard
+	DataCopySeconds  int64           `json:"data_copy_seconds,omitempty"`         // every copy's snapshot data copy, summed (--wait-snapshots)
+	EBSDefault       []string        `json:"ebs_encryption_by_default,omitempty"` // regions where EBS encryption by default is on
+	Raced            int             `json:"raced,omitempty"`                     // deletes and tags a concurrent run had already done
+	Retries          int             `json:"retries,omitempty"`                   // instance pipelines re-run by --pipeline-retries
+	RunID            string          `json:"run_id"`
+	Mutations        []mutation      `json:"mutations"`
+	Status           string          `json:"status"`                // success, partial, failed, frozen, interrupted or timeout
+	ErrorClass       string          `json:"error_class,omitempty"` // what failed - see errorClass
+}
+
+// backupResult is the outcome of backing up one instance
+type backupResult struct {
+	Instance         string            `json:"instance"`
+	InstanceId       string            `json:"instance_id"`
+	SourceAMI        string            `json:"source_ami,omitempty"`
+	CopyAMI          string            `json:"copy_ami,omitempty"`
+	DestRegions      []string          `json:"dest_regions,omitempty"`
+	Copies           map[string]string `json:"copies,omitempty"` // dest region to copy, with --dest-map or more than one --dest
+	Pending          bool              `json:"pending,omitempty"`
+	Method           string            `json:"method,omitempty"`      // how the source AMI was made: create-image or vss
+	MethodNote       string            `json:"method_note,omitempty"` // why a Windows instance didn't get VSS
+	Status           string            `json:"status,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	ErrorClass       string            `json:"error_class,omitempty"` // the stage Error came from - see errorClass
+	VaultJob         string            `json:"vault_job,omitempty"`   // the --backup-vault job
+	VaultError       string            `json:"vault_error,omitempty"` // why it couldn't be started - not a failed backup
+	Unprotected      []string          `json:"unprotected_volumes,omitempty"`
+	DataCopySeconds  map[string]int64  `json:"data_copy_seconds,omitempty"` // dest region to its snapshots' data copy time (--wait-snapshots)
+	DeviceChecks     []deviceCheck     `json:"device_checks,omitempty"`     // the new AMI's volumes against --ignore and --only-devices
+	EstimatedGB      int64             `json:"estimated_gb,omitempty"`      // --max-new-gb's estimate of a deferred backup's new snapshot data
+	KMSProblems      []string          `json:"kms_problems,omitempty"`      // copies predicted to fail because of their volumes' KMS keys
+	Attempts         int               `json:"attempts,omitempty"`          // times the pipeline ran, with --pipeline-retries
+	EstimatedSeconds int64             `json:"estimated_seconds,omitempty"` // --deadline's estimate of a deferred backup's time
+	Stopped          bool              `json:"stopped,omitempty"`           // failed because --timeout or --deadline cancelled it
+}
+
+// backupResult status of an instance refused by --require-policy-tag
+const statusPolicyMissing = "policy missing"
+
+// backoff for copies that hit the per-region simultaneous copy limit
+var copyRetryStart = 60 * time.Second
+var copyRetryMax = 30 * time.Minute
+
+// error codes that mean our credentials (or the clock) went stale mid-run
+var expiredCredentialCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"RequestExpired":        true,
+	"SignatureDoesNotMatch": true,
+}
+
+// PurgeRecord is the purge decision for one AMI in one purge window
+type PurgeRecord struct {
+	InstanceTag string
+	Region      string
+	AmiId       string
+	CreatedAt   time.Time
+	Window      purge.Window
+	Action      string
+	SizeGB      int64  // total snapshot size, when --purge-order=size looked it up
+	Class       string // the retention class whose windows decided it, "" for the -p windows
+	Rule        string // with --keep-count, the rule that decided it: window, count or window+count
+}
+
+// purge actions recorded in the purge report
+const (
+	actionPurged         = "PURGED"
+	actionWouldPurge     = "WOULD_PURGE"
+	actionKeptOldest     = "KEPT_OLDEST"
+	actionKeptOnly       = "KEPT_ONLY"
+	actionKeptNoWindow   = "KEPT_NO_WINDOW"
+	actionKeptOverlap    = "KEPT_OVERLAP"     // purged by one window, but another overlapping window keeps it
+	actionKeptCount      = "KEPT_COUNT"       // among the --keep-count newest
+	actionKeptInProgress = "KEPT_IN_PROGRESS" // another run's amibackup:in-progress image
+	actionKeptGuard      = "KEPT_CROSS_REGION"
+	actionKeptLimit      = "KEPT_MAX_PURGE"
+	actionKeptLarge      = "KEPT_LARGE_PURGE"
+)
+
+type Config struct {
+	dryRun              bool
+	debug               bool
+	races               *atomic.Int64 // calls that lost a race with a concurrent run, counted as done - shared by forDest's copies
+	errorLevel          int
+	instanceNameTags    []string
+	instanceIds         map[string]bool // the instanceNameTags that are --instance-id IDs, not Name tags
+	filterTags          []tagMatch
+	filteredNames       map[string]bool // the instanceNameTags found by --filter-tag, whose instances must match it
+	instancesFrom       string
+	sourceRegion        string
+	destRegion          string   // the dest region being copied to - the first --dest, or set by forDest
+	dests               []string // every --dest, in order
+	destMap             map[string][]string
+	classificationTag   string
+	policyTag           string
+	allowedPolicies     []string
+	policyWarnOnly      bool
+	timeoutString       string
+	timeoutDefault      bool // --timeout wasn't set, so it scales with volume counts
+	watchdog            *watchdog
+	kmsKeyId            string
+	kmsKeyAlias         string
+	timeout             time.Duration
+	notFoundGrace       time.Duration
+	pollStaleLimit      time.Duration
+	windows             []purge.Window
+	purgeonly           bool
+	recoverFailed       bool
+	recoverSLA          time.Duration
+	crossRegionGuard    bool
+	encrypted           bool
+	ebsDefaultOn        map[string]bool // region to whether EBS encryption by default is on there
+	ignoreVolumes       []string
+	onlyDevices         []string
+	shard               shard
+	unprotectedOK       tagMatch
+	unprotectedOKSpec   string
+	strictUnprotected   bool
+	strictKMS           bool
+	excludeTags         []tagMatch
+	windowsPolicy       string
+	billingTags         []string
+	retentionClasses    map[string][]purge.Window
+	keepCount           int  // --keep-count: the newest backups of each host and region to keep, 0 for none
+	combineRetention    bool // --keep-count and purge windows together: a backup either keeps is kept
+	retentionClassTag   string
+	preFreezeSSM        string
+	postThawSSM         string
+	ssmParameters       map[string][]string
+	caseInsensitive     bool
+	normalize           string
+	tagPrefix           string
+	legacyTags          bool
+	auditTags           bool
+	validateTags        bool
+	coverageReport      bool
+	coverageGroupTag    string
+	coverageMaxAge      time.Duration
+	coverageFormat      string
+	coverageCSV         string
+	failOnUncovered     bool
+	retag               bool
+	retagRenames        [][2]string
+	retagAdds           [][2]string
+	retagRemoveOld      bool
+	retagAddPrefix      bool
+	noReconcile         bool
+	incompleteMaxAge    time.Duration
+	inProgressStale     time.Duration // how long another run's in-progress tag protects an image
+	fixTags             bool
+	copyRetries         int
+	pipelineRetries     int
+	attempt             int // the instance pipeline's attempt, from 1 - set by forAttempt on retries
+	perAccountCopyLimit int
+	accountID           string
+	maxPurge            int
+	maxPurgePerHost     int
+	confirmLargePurge   bool
+	purgeOrder          string
+	snapshotLimiter     *rate.Limiter // shared by every purge, so together they stay under the limit
+	instanceStateTag    bool
+	tagInstance         bool
+	progress            bool
+	progressFile        string
+	checkpointFile      string
+	cleanupFailedCopies bool
+	freeze              string
+	freezeSource        string // where the freeze came from, for the log
+	freezeParameter     string
+	latestParameter     string // SSM parameter path holding each host's latest backup
+	gcReferences        bool
+	mutateRoleArn       string
+	purgeCache          *purgeCache
+	forcePurgeScan      bool
+	purgeSpec           string // the purge options, to tell when a --purge-cache entry is stale
+	reencrypt           bool
+	reencryptLimiter    *rate.Limiter
+	minKeep             int
+	verifyLarge         bool
+	descTemplate        *template.Template
+	discardSource       bool
+	copySnapshots       bool
+	amiStoreBucket      string
+	backupVault         string
+	backupRoleArn       string
+	amiStorePrefix      string
+	overwriteSnapName   bool
+	tagEarly            bool
+	dedupByContent      bool
+	noWait              bool
+	waitSnapshots       bool
+	purgeReport         string
+	priorityTag         string
+	deadline            time.Time
+	deadlineEstimates   map[string]time.Duration // instance ID to --deadline's estimate of its backup time
+	maxNewGB            int64
+	maxGap              time.Duration
+	gapReport           bool
+	metricsFile         string
+	cloudWatchNamespace string
+	summaryS3Bucket     string // --summary-s3, split into bucket and prefix
+	summaryS3Prefix     string
+	summaryS3KMS        string
+	planFile            string
+	plan                *runPlan
+	asOf                time.Time
+	planHash            bool
+	simulate            string
+	otelEndpoint        string
+	runID               string
+	endpointURL         string
+	awsAccessKeyId      string
+	awsSecretAccessKey  string
+}
+
+// time formatting
+var runStart = time.Now()
+var timeStamp, timeString, timeSecs = backupTimes(runStart)
+var timeShortFormat = "01/02/2006@15:04:05"
+
+// backupTimes formats a backup time for AMI names, the date tag and the timestamp tag
+func backupTimes(t time.Time) (string, string, string) {
+	return t.Format("2006-01-02_15-04-05"), t.Format("2006-01-02 15:04:05 -0700"), fmt.Sprintf("%d", t.Unix())
+}
+
+// setRunStart resets the run's time - for Lambda, where one process may serve many runs
+func setRunStart(t time.Time) {
+	runStart = t
+	timeStamp, timeString, timeSecs = backupTimes(t)
+}
+
+// Main runs amibackup with the given command line arguments (without the program name), and
+// returns its exit code - every failure comes back here as a classed error, and runOutcome turns
+// it into the code
+func Main(args []string) int {
+	if inLambda() {
+		startLambda()
+		return 0
+	}
+	if len(args) > 0 && args[0] == "restore" {
+		if err := restoreMain(args[1:]); err != nil && err != errDone {
+			log.Print(err)
+			return classExitCodes[classOf(err, classInternal)]
+		}
+		return 0
+	}
+	if len(args) > 0 && args[0] == "init" {
+		dryRun, err := initMain(args[1:])
+		if err != nil && err != errDone {
+			log.Print(err)
+			return classExitCodes[classOf(err, classInternal)]
+		}
+		if dryRun == nil {
+			return 0
+		}
+		args = dryRun
+	}
+	c, err := handleOptions(args)
+	if err == errDone {
+		return 0
+	}
+	if err != nil {
+		log.Print(err)
+		return classExitCodes[classOf(err, classInternal)]
+	}
+	if c.otelEndpoint != "" {
+		if err := setupTracing(c.otelEndpoint); err != nil {
+			log.Printf("Error setting up tracing: %s", err.Error())
+			return classExitCodes[classConfig]
+		}
+		defer shutdownTracing()
+	}
+	ctx, runSpan := tracer.Start(context.Background(), "amibackup", trace.WithAttributes(
+		attribute.String("region.source", c.sourceRegion),
+		attribute.String("region.dest", c.destRegion),
+		attribute.Bool("dry_run", c.dryRun),
+	))
+	defer runSpan.End()
+	// the timeout cancels the run's context, so it stops and cleans up - only a run that doesn't,
+	// and a second signal, exit from here
+	var runCtx context.Context
+	runCtx, c.watchdog = startWatchdog(ctx, c.timeout, func(timeout time.Duration) {
+		runSpan.SetStatus(codes.Error, "timeout")
+		runSpan.End()
+		shutdownTracing()
+		log.Printf("Still running %s after the timeout of %s - goodbye!", timeoutGrace, timeout)
+		os.Exit(exitTimeout)
+	})
+	if !c.deadline.IsZero() {
+		// backups still running at the deadline stop just as at the timeout
+		if c.timeoutDefault {
+			c.watchdog.extend(time.Until(c.deadline), "--deadline is later")
+		}
+		var cancelDeadline context.CancelFunc
+		runCtx, cancelDeadline = context.WithDeadlineCause(runCtx, c.deadline, errDeadline)
+		defer cancelDeadline()
+	}
+	// during a dry-run purge, the first Ctrl-C stops planning cleanly so the partial plan can be shown
+	planCtx, cancelPlan := context.WithCancel(runCtx)
+	defer cancelPlan()
+	if c.otelEndpoint != "" || c.dryRun {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			for sig := range sigs {
+				if atomic.LoadInt32(&purgePlanning) == 1 && planCtx.Err() == nil {
+					log.Printf("Caught %s - stopping after the current host (again to quit now)", sig)
+					cancelPlan()
+					continue
+				}
+				// flush what we have if we're killed
+				runSpan.SetStatus(codes.Error, sig.String())
+				runSpan.End()
+				shutdownTracing()
+				log.Printf("Caught %s before we finished - goodbye!", sig)
+				os.Exit(exitInterrupted)
+			}
+		}()
+	}
+
+	summary, err := run(planCtx, c)
+	switch cause := context.Cause(runCtx); {
+	case errors.Is(cause, errDeadline) && !cutOff(summary, err):
+		// everything finished in time - the deadline came during the last of the clean up
+		log.Printf("Reached --deadline %s after the backups finished", c.deadline.Format(time.RFC3339))
+	case errors.Is(cause, errDeadline):
+		log.Printf("Reached --deadline %s - stopped the backups still running", c.deadline.Format(time.RFC3339))
+		err = errTimeout
+	case errors.Is(cause, errTimeout):
+		// whatever failed, failed for want of time
+		err = errTimeout
+	}
+	if err == nil && c.plan != nil {
+		if err = c.plan.write(c.planFile, c); err != nil {
+			err = classErrorf(classInternal, "Error writing plan: %s", err.Error())
+		} else {
+			log.Printf("Wrote the run's plan to %s", c.planFile)
+		}
+	}
+	code := summary.setOutcome(err)
+	if c.summaryS3Bucket != "" && c.simulate == "" {
+		uploadSummary(ctx, summary, c)
+	}
+	runSpan.SetAttributes(attribute.String("status", summary.Status), attribute.Int("exit_code", code))
+	if summary.ErrorClass != "" {
+		runSpan.SetAttributes(attribute.String("error.class", summary.ErrorClass))
+	}
+	switch {
+	case err == errInterrupted:
+		runSpan.SetStatus(codes.Error, "interrupted")
+	case err == errTimeout:
+		runSpan.SetStatus(codes.Error, "timeout")
+	case err != nil:
+		log.Print(err)
+	case len(summary.PolicyMissing) > 0:
+		log.Printf("Refused to back up %d instances without an approved %s tag: %s", len(summary.PolicyMissing), c.policyTag, strings.Join(summary.PolicyMissing, ", "))
+	}
+	if summary.Frozen != "" {
+		runSpan.SetAttributes(attribute.String("freeze", summary.Frozen))
+	}
+	switch summary.Status {
+	case statusSuccess, statusInterrupted, statusTimeout:
+	case statusFrozen:
+		// not a failure, but not a full run either
+		log.Printf("Run held back by a %s freeze (%s) - exiting %d", summary.Frozen, c.freezeSource, code)
+	default:
+		log.Printf("Run %s (%s) - exiting %d", summary.Status, summary.ErrorClass, code)
+	}
+	return code
+}
+
+// run does everything the options ask for: one of the reporting modes, or reconcile, purge and
+// back up.  Cancelling ctx stops a dry-run purge plan between hosts.
+func run(ctx context.Context, c *Config) (*runSummary, error) {
+	summary := &runSummary{Backups: []backupResult{}, RunID: c.runID, Instances: len(c.instanceNameTags), InstancesFrom: c.instancesFrom}
+	if c.simulate != "" {
+		if err := simulatePurge(c.simulate, c); err != nil {
+			return summary, classErrorf(classPurge, "Error simulating purge: %s", err.Error())
+		}
+		return summary, nil
+	}
+	// before connecting, as resuming a checkpoint takes on its run's ID
+	var cp *checkpoint
+	if c.checkpointFile != "" {
+		var err error
+		if cp, err = openCheckpoint(c.checkpointFile, c); err != nil {
+			return summary, classify(classConfig, err)
+		}
+		summary.RunID = c.runID
+	}
+
+	// connect to AWS - all clients share one config, and so one auto-refreshing credential cache
+	clients, err := newClientPool(ctx, c.endpointURL, c.runID)
+	if err != nil {
+		return summary, classify(classConfig, err)
+	}
+	defer func() {
+		summary.Mutations = clients.mutations.list()
+		logMutations(c.runID, summary.Mutations)
+		if c.races != nil {
+			summary.Raced = int(c.races.Load())
+		}
+	}()
+	metered := false // whether the run got far enough to have metrics
+	defer func() {
+		if metered {
+			// a run stopped by --timeout still reports what it got done
+			publishMetrics(context.WithoutCancel(ctx), clients, summary, c)
+		}
+	}()
+	if c.mutateRoleArn != "" {
+		// assume the role now, so a bad role fails the run before anything is touched
+		clients.setMutateRole(c.mutateRoleArn)
+		readAs, err := clients.callerIdentity(ctx, c.sourceRegion, "")
+		if err != nil {
+			return summary, classErrorf(classCredentials, "Error checking the default credentials: %s", err.Error())
+		}
+		mutateAs, err := clients.callerIdentity(ctx, c.sourceRegion, c.mutateRoleArn)
+		if err != nil {
+			return summary, classErrorf(classCredentials, "Error assuming mutate-role-arn %s: %s", c.mutateRoleArn, err.Error())
+		}
+		log.Printf("Describe, Get and List calls run as %s", readAs)
+		log.Printf("Calls that create, copy, tag, deregister or delete run as %s", mutateAs)
+	}
+	if c.coverageReport {
+		// only reads, so a freeze doesn't hold it back
+		dests := []string{}
+		for _, region := range c.destRegions() {
+			if region != c.sourceRegion {
+				dests = append(dests, region)
+			}
+		}
+		return summary, coverageReport(ctx, clients, dests, c)
+	}
+	checkFreeze(ctx, clients.SSM(c.sourceRegion, ""), c)
+	summary.Frozen = c.freeze
+	if c.freeze == freezeAll {
+		return summary, nil
+	}
+	if c.kmsKeyAlias != "" {
+		// resolve it before touching anything, so a bad alias fails the run up front
+		c.kmsKeyId, err = resolveKMSKey(ctx, clients.KMS(c.destRegion, ""), c.kmsKeyAlias)
+		if err != nil {
+			return summary, classErrorf(classConfig, "Invalid kms-key-alias: %s", err.Error())
+		}
+		log.Printf("Using KMS key %s for alias %s", c.kmsKeyId, c.kmsKeyAlias)
+	}
+	awsec2 := clients.EC2(c.sourceRegion, "")
+	if len(c.filterTags) > 0 {
+		// before anything acts on the hosts
+		if err := resolveFilterTags(ctx, awsec2, c); err != nil {
+			return summary, err
+		}
+		summary.Instances = len(c.instanceNameTags)
+	}
+	ebsSource := clients.EBS(c.sourceRegion, "")
+	cwSource := clients.CloudWatch(c.sourceRegion, "")
+	kmsSource := clients.KMS(c.sourceRegion, "")
+	copyKeys := newSourceKeys()
+	// the other regions backups are copied to - with --dest-map, any region in the map
+	dests := []string{}
+	for _, region := range c.destRegions() {
+		if region != c.sourceRegion {
+			dests = append(dests, region)
+		}
+	}
+	if (c.perAccountCopyLimit > 0 && len(dests) > 0 || c.backupVault != "") && !c.dryRun {
+		account, err := clients.accountID(ctx, c.destRegion, "")
+		if err != nil {
+			log.Printf("Error looking up the AWS account - copy limit applies to all copies: %s", err.Error())
+		}
+		c.accountID = account
+	}
+	if c.kmsKeyId != "" && (c.reencrypt || len(dests) > 0 && !c.purgeonly && !c.auditTags && !c.retag && !c.validateTags && !c.gcReferences) {
+		// catch a key EC2 can't use now, not when the copies fail an hour from now
+		caller, err := clients.callerIdentity(ctx, c.destRegion, c.mutateRoleArn)
+		if err != nil {
+			log.Printf("WARNING: can't tell who makes the copies: %s", err.Error())
+		}
+		if err := preflightKMS(ctx, clients.KMS(c.destRegion, ""), c.kmsKeyId, c.destRegion, caller); err != nil {
+			return summary, err
+		}
+	}
+	if !c.purgeonly && !c.auditTags && !c.retag && !c.validateTags && !c.reencrypt && !c.gcReferences {
+		// say up front why backups may come out encrypted that we didn't ask to encrypt
+		c.ebsDefaultOn = ebsEncryptionByDefault(ctx, clients, append([]string{c.sourceRegion}, dests...))
+		summary.EBSDefault = encryptedByDefault(c.ebsDefaultOn)
+	}
+
+	if c.auditTags {
+		for _, instanceNameTag := range c.instanceNameTags {
+			if err := auditTags(ctx, awsec2, c.sourceRegion, instanceNameTag, c); err != nil {
+				log.Printf("Error auditing tags for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			}
+			for _, region := range dests {
+				if err := auditTags(ctx, clients.EC2(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error auditing tags for %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+			}
+		}
+		return summary, nil
+	}
+
+	if c.retag {
+		for _, instanceNameTag := range c.instanceNameTags {
+			if err := retagBackups(ctx, awsec2, c.sourceRegion, instanceNameTag, c); err != nil {
+				log.Printf("Error retagging backups for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			}
+			for _, region := range dests {
+				if err := retagBackups(ctx, clients.EC2(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error retagging backups for %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+			}
+		}
+		return summary, nil
+	}
+
+	if c.gcReferences {
+		failed := 0
+		for _, instanceNameTag := range c.instanceNameTags {
+			for _, region := range append([]string{c.sourceRegion}, dests...) {
+				if err := gcReferences(ctx, clients.EC2(region, ""), clients.SSM(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error checking the latest-parameter of %s in %s: %s", instanceNameTag, region, err.Error())
+					failed++
+				}
+			}
+		}
+		if failed > 0 {
+			return summary, classErrorf(classPurge, "%d latest-parameters couldn't be checked", failed)
+		}
+		return summary, nil
+	}
+
+	if c.reencrypt && c.freeze != freezeNone {
+		log.Printf("FROZEN: not re-encrypting, as that deregisters the old backups")
+		return summary, nil
+	}
+	if c.reencrypt {
+		failed := reencryptAll(ctx, clients, c, cp)
+		cp.finish(failed)
+		if failed > 0 {
+			return summary, classErrorf(classCopy, "%d backups failed to re-encrypt", failed)
+		}
+		return summary, nil
+	}
+
+	if c.validateTags {
+		for _, instanceNameTag := range c.instanceNameTags {
+			if err := validateTags(ctx, awsec2, c.sourceRegion, instanceNameTag, c); err != nil {
+				log.Printf("Error validating tags for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			}
+			for _, region := range dests {
+				if err := validateTags(ctx, clients.EC2(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error validating tags for %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+			}
+		}
+		return summary, nil
+	}
+
+	// with --shard, each host's old backups are this worker's alone to clean up, resume and purge
+	if c.shard.count > 1 {
+		summary.Shard = c.shard.String()
+		log.Printf("Working as shard %s", c.shard)
+	}
+	hosts := shardHosts(c)
+
+	// clean up after any crashed runs before purging or creating anything
+	if !c.noReconcile {
+		for _, instanceNameTag := range hosts {
+			if err := reconcileIncomplete(ctx, awsec2, c.sourceRegion, instanceNameTag, c); err != nil {
+				log.Printf("Error reconciling incomplete AMIs for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			}
+			for _, region := range dests {
+				if err := reconcileIncomplete(ctx, clients.EC2(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error reconciling incomplete AMIs for %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+			}
+		}
+	}
+
+	// finish what earlier --no-wait runs started
+	for _, instanceNameTag := range hosts {
+		for _, region := range c.destRegions() {
+			pending, err := resumePending(ctx, awsec2, clients.EC2(region, ""), instanceNameTag, c.forDest(region))
+			summary.Pending = append(summary.Pending, pending...)
+			if err != nil {
+				summary.Errors = append(summary.Errors, err.Error())
+				log.Printf("Error resuming pending backups for %s: %s", instanceNameTag, err.Error())
+			}
+		}
+	}
+
+	if c.freeze != freezeNone && (c.cleanupFailedCopies || c.purging()) {
+		log.Printf("FROZEN: skipping the purge - no backups are deleted")
+	}
+	// failed copies never get a timestamp, so the purge below can't see them
+	if c.cleanupFailedCopies && c.freeze == freezeNone {
+		for _, instanceNameTag := range hosts {
+			for _, region := range dests {
+				if ctx.Err() != nil {
+					break
+				}
+				if _, err := cleanupFailedCopies(ctx, clients.EC2(region, ""), region, instanceNameTag, c); err != nil {
+					log.Printf("Error cleaning up failed copies for %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+			}
+		}
+	}
+
+	// purge old AMIs and snapshots in both regions
+	if c.purging() && c.freeze == freezeNone {
+		metered = true
+		records := []PurgeRecord{}
+		if c.dryRun {
+			atomic.StoreInt32(&purgePlanning, 1)
+		}
+		for _, instanceNameTag := range hosts {
+			if ctx.Err() != nil {
+				break
+			}
+			// never purge a backup unless the other region (any dest region) holds one at least as new
+			var sourceGuard, destGuard *time.Time
+			if c.crossRegionGuard && len(dests) > 0 {
+				sourceNewest, err := newestAvailableBackup(ctx, awsec2, instanceNameTag, c)
+				if err != nil {
+					log.Printf("Error checking backups for %s in %s - skipping purge: %s", instanceNameTag, c.sourceRegion, err.Error())
+					continue
+				}
+				destNewest, err := newestBackupIn(ctx, clients, dests, instanceNameTag, c)
+				if err != nil {
+					log.Printf("Error checking backups for %s - skipping purge: %s", instanceNameTag, err.Error())
+					continue
+				}
+				sourceGuard, destGuard = &destNewest, &sourceNewest
+				if c.discardSource {
+					// the source region is meant to be empty - the copies are the backups
+					destGuard = nil
+				}
+			}
+			_, span := tracer.Start(ctx, "purge", trace.WithAttributes(attribute.String("instance.name", instanceNameTag), attribute.String("region", c.sourceRegion)))
+			purged, err := purgeAMIs(ctx, awsec2, c.sourceRegion, instanceNameTag, c, sourceGuard)
+			records = append(records, purged...)
+			if err := gcLatestParameter(ctx, clients.SSM(c.sourceRegion, ""), c.sourceRegion, instanceNameTag, purged, c); err != nil {
+				summary.PurgeErrors = append(summary.PurgeErrors, err.Error())
+				log.Printf("Error updating the latest-parameter of %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			}
+			span.SetAttributes(attribute.Int("amis.considered", len(purged)))
+			endSpan(span, err)
+			if err != nil {
+				summary.PurgeErrors = append(summary.PurgeErrors, err.Error())
+				log.Printf("Error purging old AMIs for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+			} else if ctx.Err() == nil && !c.discardSource {
+				// with --discard-source-after-copy the source region is meant to be empty
+				summary.Retention = append(summary.Retention, measureRetention(instanceNameTag, c.sourceRegion, purged, c.asOf))
+			}
+			for _, region := range dests {
+				if ctx.Err() != nil {
+					break
+				}
+				if skipPurgeScan(region, instanceNameTag, c) {
+					if stat, ok := cachedRetention(instanceNameTag, region, c); ok {
+						summary.Retention = append(summary.Retention, stat)
+					}
+					continue
+				}
+				_, span := tracer.Start(ctx, "purge", trace.WithAttributes(attribute.String("instance.name", instanceNameTag), attribute.String("region", region)))
+				scanStart := time.Now()
+				purged, err = purgeAMIs(ctx, clients.EC2(region, ""), region, instanceNameTag, c, destGuard)
+				switch {
+				case c.dryRun:
+				case err != nil || ctx.Err() != nil:
+					c.purgeCache.forget(region, instanceNameTag)
+				default:
+					// this run's own backups, stamped with its start, come after the scan
+					c.purgeCache.record(region, instanceNameTag, purged, runStart, time.Since(scanStart), c)
+				}
+				records = append(records, purged...)
+				if err := gcLatestParameter(ctx, clients.SSM(region, ""), region, instanceNameTag, purged, c); err != nil {
+					summary.PurgeErrors = append(summary.PurgeErrors, err.Error())
+					log.Printf("Error updating the latest-parameter of %s in %s: %s", instanceNameTag, region, err.Error())
+				}
+				span.SetAttributes(attribute.Int("amis.considered", len(purged)))
+				endSpan(span, err)
+				if err != nil {
+					summary.PurgeErrors = append(summary.PurgeErrors, err.Error())
+					log.Printf("Error purging old AMIs for %s in %s: %s", instanceNameTag, region, err.Error())
+				} else if ctx.Err() == nil {
+					summary.Retention = append(summary.Retention, measureRetention(instanceNameTag, region, purged, c.asOf))
+				}
+			}
+		}
+		atomic.StoreInt32(&purgePlanning, 0)
+		if !c.dryRun {
+			if err := c.purgeCache.save(); err != nil {
+				log.Printf("Error writing purge cache: %s", err.Error())
+			}
+		}
+		for _, r := range records {
+			if r.Action == actionPurged || r.Action == actionWouldPurge {
+				summary.Purged++
+			}
+		}
+		if c.dryRun && errors.Is(context.Cause(ctx), context.Canceled) {
+			printPartialPlan(os.Stdout, records)
+			return summary, errInterrupted
+		}
+		if c.purgeOrder == "size" {
+			reclaimed := int64(0)
+			for _, r := range records {
+				if r.Action == actionPurged || r.Action == actionWouldPurge {
+					reclaimed += r.SizeGB
+				}
+			}
+			log.Printf("Reclaimed %d GB of snapshots in total", reclaimed)
+		}
+		c.plan.setPurges(records)
+		summary.GapViolations = reportRetention(summary.Retention, c)
+		if c.planHash {
+			hash, err := planHash(records)
+			if err != nil {
+				return summary, classErrorf(classInternal, "Error hashing purge plan: %s", err.Error())
+			}
+			fmt.Fprintln(os.Stdout, hash)
+		}
+		if c.purgeReport != "" {
+			if err := writePurgeReport(c.purgeReport, records); err != nil {
+				log.Printf("Error writing purge report: %s", err.Error())
+			} else {
+				log.Printf("Wrote purge report for %d AMIs to %s", len(records), c.purgeReport)
+			}
+		}
+		// cut off mid-purge: what was purged is reported above, and nothing more is started
+		if ctx.Err() != nil {
+			if errors.Is(context.Cause(ctx), context.Canceled) {
+				return summary, errInterrupted
+			}
+			return summary, errTimeout
+		}
+	}
+	if c.purgeonly {
+		log.Printf("Purging done and --purgeonly specified - exiting.")
+		return summary, nil
+	}
+
+	instanceNameTags := c.instanceNameTags
+	if c.recoverFailed {
+		instanceNameTags = []string{}
+		for _, instanceNameTag := range c.instanceNameTags {
+			needed, err := needsRecovery(ctx, clients, c.destRegions(), instanceNameTag, c)
+			if err != nil {
+				log.Printf("Error checking last backup of %s: %s", instanceNameTag, err.Error())
+				continue
+			}
+			if needed {
+				instanceNameTags = append(instanceNameTags, instanceNameTag)
+			}
+		}
+		if len(instanceNameTags) == 0 {
+			log.Printf("All backups are within the SLA of %s - nothing to recover", c.recoverSLA)
+			return summary, nil
+		}
+	}
+
+	// search for our instances
+	instanceset := map[string][]*types.Instance{}
+	for _, instanceNameTag := range instanceNameTags {
+		instanceset[instanceNameTag], err = findInstances(ctx, awsec2, instanceNameTag, c)
+		if err != nil {
+			return summary, err
+		}
+		if len(instanceset[instanceNameTag]) < 1 && c.instanceIds[instanceNameTag] {
+			return summary, classErrorf(classDiscovery, "Instance %s is excluded from backups", instanceNameTag)
+		} else if len(instanceset[instanceNameTag]) < 1 {
+			return summary, classErrorf(classDiscovery, "No instances with matching name tag: %s", instanceNameTag)
+		} else {
+			log.Printf("Found %d instances with matching Name tag: %s", len(instanceset[instanceNameTag]), instanceNameTag)
+		}
+		instanceset[instanceNameTag] = shardInstances(instanceset[instanceNameTag], instanceNameTag, c.shard)
+	}
+	metered = true
+	if c.maxNewGB > 0 {
+		deferred, err := applyBudget(ctx, awsec2, instanceset, c)
+		if err != nil {
+			return summary, err
+		}
+		for _, r := range deferred {
+			summary.Backups = append(summary.Backups, r)
+			summary.Deferred = append(summary.Deferred, fmt.Sprintf("%s (%s)", r.Instance, r.InstanceId))
+		}
+	}
+	if !c.deadline.IsZero() {
+		deferred, err := applyDeadline(ctx, awsec2, instanceset, c)
+		if err != nil {
+			return summary, err
+		}
+		for _, r := range deferred {
+			summary.Backups = append(summary.Backups, r)
+			summary.DeadlineDeferred = append(summary.DeadlineDeferred, fmt.Sprintf("%s (%s)", r.Instance, r.InstanceId))
+		}
+	}
+	if c.timeoutDefault {
+		// big instances take longer to snapshot - and they run at the same time, so the biggest sets the pace
+		most, biggest := 0, ""
+		for _, instances := range instanceset {
+			for _, instance := range instances {
+				if _, volumes, err := imageBlockDevices(instance, c); err == nil && volumes > most {
+					most, biggest = volumes, *instance.InstanceId
+				}
+			}
+		}
+		c.watchdog.extend(scaledTimeout(c.timeout, most), fmt.Sprintf("%s has %d volumes to image", biggest, most))
+	}
+
+	if c.progress {
+		ui.startProgress(os.Stdout, time.Second)
+		if isTerminal(os.Stderr) {
+			log.SetOutput(ui)
+		}
+		defer ui.stopProgress()
+	}
+
+	status := newProgressFile(c.progressFile, runStart)
+	done := make(chan backupResult)
+	i := 0
+	for instanceNameTag, instances := range instanceset {
+		for _, instance := range instances {
+			i++
+			instanceNameTag := instanceNameTag
+			instance := instance
+			go func() {
+				ictx, ispan := tracer.Start(ctx, "backup", trace.WithAttributes(
+					attribute.String("instance.name", instanceNameTag),
+					attribute.String("instance.id", *instance.InstanceId),
+					attribute.Int("instance.volumes", len(instance.BlockDeviceMappings)),
+				))
+				var err error
+				stage := classConfig // the class of a failure at this point in the pipeline
+				stateAMI := ""
+				result := backupResult{Instance: instanceNameTag, InstanceId: *instance.InstanceId}
+				inProgress := map[string]string{} // images carrying our in-progress tag, to their regions
+				label := progressLabel(instanceNameTag, *instance.InstanceId)
+				status.set(instanceNameTag, *instance.InstanceId, "creating", "", "")
+				started := time.Now()
+				defer func() {
+					// cleaning up goes on once --timeout has stopped the pipeline
+					cleanup := context.WithoutCancel(ctx)
+					if !c.noWait {
+						// with --no-wait they're still pending - the tag keeps them safe until it goes stale
+						clearInProgress(cleanup, clients, inProgress, c)
+					}
+					if err != nil {
+						result.Error = err.Error()
+						result.ErrorClass = string(classOf(err, stage))
+						result.Stopped = ctx.Err() != nil
+						ispan.SetAttributes(attribute.String("error.class", result.ErrorClass))
+						setInstanceState(cleanup, awsec2, instance, "error", stateAMI, c)
+						ui.set(*instance.InstanceId, label, "failed", stateAMI)
+						status.set(instanceNameTag, *instance.InstanceId, "error", result.SourceAMI, result.CopyAMI)
+					} else {
+						setInstanceState(cleanup, awsec2, instance, "done", stateAMI, c)
+						if result.Status == "" && !result.Pending {
+							made := "" // the source AMI, if this run made it - its time is the next --deadline estimate
+							if result.Method != "" && !c.discardSource {
+								made = result.SourceAMI
+							}
+							finishDeferred(cleanup, awsec2, instance, made, time.Since(started), c)
+						}
+						ui.set(*instance.InstanceId, label, "done", stateAMI)
+						status.set(instanceNameTag, *instance.InstanceId, "done", result.SourceAMI, result.CopyAMI)
+						if _, ok := cp.done(*instance.InstanceId, stepDone, ""); !ok {
+							cp.record(*instance.InstanceId, stepDone, "", result.SourceAMI)
+						}
+					}
+					endSpan(ispan, err)
+					done <- result
+				}()
+				finished := map[string]string{}  // dest region to a copy an earlier attempt finished
+				abandoned := map[string]string{} // copies a failed attempt left unfinished, to their regions
+				// backupInstance is one attempt at the pipeline, leaving its outcome in err and stage
+				backupInstance := func(attempt int) {
+					c := c.forAttempt(attempt)
+					// fail just this instance if it has no approved destination
+					var regions []string
+					regions, err = instanceDestinations(instance, c)
+					if err != nil {
+						log.Printf("Error finding the destination for %s: %s", instanceNameTag, err.Error())
+						return
+					}
+					result.DestRegions = regions
+					if c.destMap != nil {
+						log.Printf("Destination for %s (%s, %s=%s): %s", instanceNameTag, *instance.InstanceId, c.classificationTag, discovery.TagValue(instance.Tags, c.classificationTag), strings.Join(regions, ", "))
+					}
+					if err = checkPolicy(instance, c); err != nil {
+						if !c.policyWarnOnly {
+							result.Status = statusPolicyMissing
+							log.Printf("Skipping %s: %s", instanceNameTag, err.Error())
+							return
+						}
+						log.Printf("WARNING: backing up %s anyway: %s", instanceNameTag, err.Error())
+						err = nil
+					}
+					if len(c.ignoreVolumes) > 0 || len(c.onlyDevices) > 0 {
+						unprotected, uerr := unprotectedVolumes(ctx, awsec2, instance, c)
+						switch {
+						case uerr != nil && c.strictUnprotected:
+							err = fmt.Errorf("can't check for unprotected volumes: %s", uerr.Error())
+							log.Printf("Error backing up %s: %s", instanceNameTag, err.Error())
+							return
+						case uerr != nil:
+							log.Printf("WARNING: can't check %s for unprotected volumes: %s", instanceNameTag, uerr.Error())
+						case len(unprotected) > 0:
+							result.Unprotected = unprotected
+							if c.strictUnprotected {
+								err = fmt.Errorf("persistent volumes left out without a %s tag: %s", c.unprotectedOKSpec, strings.Join(unprotected, ", "))
+								log.Printf("Error backing up %s: %s", instanceNameTag, err.Error())
+								return
+							}
+							log.Printf("WARNING: backups of %s (%s) leave out persistent volumes without a %s tag - nothing here backs them up: %s",
+								instanceNameTag, *instance.InstanceId, c.unprotectedOKSpec, strings.Join(unprotected, ", "))
+						}
+					}
+					if copiesElsewhere(regions, c) {
+						problems, kerr := checkCopyKeys(ctx, awsec2, kmsSource, copyKeys, instance, regions, c)
+						switch {
+						case kerr != nil && c.strictKMS:
+							err = fmt.Errorf("can't check the KMS keys of its volumes: %s", kerr.Error())
+							log.Printf("Error backing up %s: %s", instanceNameTag, err.Error())
+							return
+						case kerr != nil:
+							log.Printf("WARNING: can't check the KMS keys of %s's volumes: %s", instanceNameTag, kerr.Error())
+						case len(problems) > 0:
+							result.KMSProblems = problems
+							if c.strictKMS {
+								err = fmt.Errorf("copies would fail: %s", strings.Join(problems, "; "))
+								log.Printf("Error backing up %s: %s", instanceNameTag, err.Error())
+								return
+							}
+							log.Printf("WARNING: copies of %s (%s) are likely to fail: %s", instanceNameTag, *instance.InstanceId, strings.Join(problems, "; "))
+						}
+					}
+					stage = classCreate
+					if ami, ok := cp.done(*instance.InstanceId, stepDone, ""); ok {
+						log.Printf("Skipping %s (%s) - the checkpoint has it backed up as %s", instanceNameTag, *instance.InstanceId, ami)
+						stateAMI = ami
+						result.SourceAMI = ami
+						for _, region := range regions {
+							if copied, ok := cp.done(*instance.InstanceId, stepCopied, region); ok && copied != "" {
+								stateAMI = copied
+								result.CopyAMI = copied
+							}
+						}
+						return
+					}
+
+					if c.dedupByContent {
+						awsec2dest := clients.EC2(c.destRegion, "")
+						existing, derr := unchangedBackup(ctx, awsec2, awsec2dest, cwSource, instance, instanceNameTag, c)
+						if derr != nil {
+							log.Printf("Error checking %s for changes since its last backup (backing it up): %s", instanceNameTag, derr.Error())
+						} else if existing != nil {
+							log.Printf("Skipping unchanged instance %s - extending timestamp on existing AMI %s", *instance.InstanceId, *existing.ImageId)
+							stateAMI = *existing.ImageId
+							result.SourceAMI = *existing.ImageId
+							err = extendBackup(ctx, awsec2, awsec2dest, existing, instanceNameTag, c)
+							return
+						}
+					}
+
+					// create local AMI, unless the checkpoint says an interrupted run already did
+					newAMI, created := cp.done(*instance.InstanceId, stepCreated, "")
+					var span trace.Span
+					if created {
+						log.Printf("Resuming backup of %s from AMI %s in the checkpoint", instanceNameTag, newAMI)
+						stateAMI = newAMI
+						result.SourceAMI = newAMI
+						inProgress[newAMI] = c.sourceRegion
+					} else {
+						setInstanceState(ctx, awsec2, instance, "creating", "", c)
+						ui.set(*instance.InstanceId, label, "create", "")
+						var sctx context.Context // the create span's, so the wait for the image nests under it
+						sctx, span = tracer.Start(ictx, "create", trace.WithAttributes(attribute.String("region", c.sourceRegion)))
+						result.Method = methodCreateImage
+						if isWindows(instance) && c.windowsPolicy == "vss" {
+							result.Method = methodVSS
+							newAMI, err = createVSSAMI(sctx, awsec2, clients.SSM(c.sourceRegion, ""), instance, c, instanceNameTag)
+							if unavailable, ok := err.(vssUnavailable); ok {
+								log.Printf("Falling back to a NoReboot image of %s (%s): %s", instanceNameTag, *instance.InstanceId, unavailable.reason)
+								result.Method, result.MethodNote = methodCreateImage, "VSS unavailable: "+unavailable.reason
+								err = nil
+							}
+						} else if isWindows(instance) && c.windowsPolicy == "warn" {
+							result.MethodNote = "Windows instance imaged without VSS"
+						}
+						if result.Method == methodCreateImage {
+							newAMI, err = createQuiescedAMI(sctx, awsec2, clients.SSM(c.sourceRegion, ""), instance, c, instanceNameTag)
+						}
+						stateAMI = newAMI
+						result.SourceAMI = newAMI
+						if newAMI != "" {
+							inProgress[newAMI] = c.sourceRegion
+						}
+						span.SetAttributes(attribute.String("ami.id", newAMI))
+						endSpan(span, err)
+						if err != nil {
+							log.Printf("Error creating AMI for %s: %s", instanceNameTag, err.Error())
+							return
+						}
+						cp.record(*instance.InstanceId, stepCreated, "", newAMI)
+					}
+
+					if c.noWait {
+						// a later run copies it once it's available
+						result.Pending = true
+						return
+					}
+					if (len(c.ignoreVolumes) > 0 || len(c.onlyDevices) > 0) && !c.dryRun {
+						// never copy an image whose exclusions didn't take
+						_, span = tracer.Start(ictx, "verify-exclusions", trace.WithAttributes(attribute.String("ami.id", newAMI)))
+						result.DeviceChecks, err = verifyExclusions(ctx, awsec2, instance, newAMI, c)
+						for _, check := range result.DeviceChecks {
+							span.SetAttributes(attribute.Bool("device.ok."+check.Device, check.OK))
+						}
+						endSpan(span, err)
+						if err != nil {
+							stage = classVerify
+							log.Printf("Error verifying the volumes of AMI %s for %s - not copying it: %s", newAMI, instanceNameTag, err.Error())
+							return
+						}
+					}
+					if c.backupVault != "" {
+						_, span = tracer.Start(ictx, "vault", trace.WithAttributes(attribute.String("vault", c.backupVault)))
+						jobId, verr := startVaultBackup(ctx, clients.Backup(c.sourceRegion, ""), instance, c, instanceNameTag)
+						result.VaultJob = jobId
+						endSpan(span, verr)
+						if verr != nil {
+							result.VaultError = verr.Error()
+							log.Printf("Error backing up %s into AWS Backup vault %s (the AMI backup goes on): %s", instanceNameTag, c.backupVault, verr.Error())
+						}
+					}
+					if c.tagEarly {
+						// tag the source snapshots now rather than after a copy that may take hours
+						ui.set(*instance.InstanceId, label, "tag", newAMI)
+						_, span = tracer.Start(ictx, "tag", trace.WithAttributes(attribute.String("region", c.sourceRegion)))
+						err = tagRegionSnapshots(ctx, c.hostname(instanceNameTag), awsec2, c)
+						endSpan(span, err)
+						if err != nil {
+							log.Printf("Error Tagging Snapshots for %s in %s: %s", instanceNameTag, c.sourceRegion, err.Error())
+							return
+						}
+					}
+					if c.verifyLarge && !c.dryRun {
+						verifyLargeSnapshots(ctx, awsec2, ebsSource, newAMI)
+					}
+					if _, stored := cp.done(*instance.InstanceId, stepStored, ""); c.amiStoreBucket != "" && !stored {
+						// the archive is extra - a failed store doesn't stop the copy
+						ui.set(*instance.InstanceId, label, "store", newAMI)
+						_, span = tracer.Start(ictx, "store", trace.WithAttributes(attribute.String("ami.id", newAMI)))
+						serr := storeAMI(ctx, awsec2, c, newAMI, instanceNameTag)
+						endSpan(span, serr)
+						if serr != nil {
+							log.Printf("Error storing AMI for %s in S3: %s", instanceNameTag, serr.Error())
+						} else {
+							cp.record(*instance.InstanceId, stepStored, "", newAMI)
+						}
+					}
+
+					// copy AMI to each backup region
+					stage = classCopy
+					copies := map[string]string{}
+					for _, region := range regions {
+						dc := c.forDest(region)
+						awsec2dest := clients.EC2(region, "")
+						setInstanceState(ctx, awsec2, instance, "copying", newAMI, c)
+						ui.set(*instance.InstanceId, label, "copy", newAMI)
+						status.set(instanceNameTag, *instance.InstanceId, "copying", newAMI, "")
+						copiedAMI, copied := cp.done(*instance.InstanceId, stepCopied, region)
+						if id, ok := finished[region]; ok && !copied {
+							// only what came after the copy failed last attempt
+							copiedAMI, copied = id, true
+						}
+						if !copied {
+							if _, started := cp.done(*instance.InstanceId, stepCopyStarted, region); started {
+								// the copy's client token is the run ID and source AMI, so this finds the copy already started
+								log.Printf("Resuming copy of %s to %s from the checkpoint", newAMI, region)
+							} else {
+								cp.record(*instance.InstanceId, stepCopyStarted, region, newAMI)
+							}
+							var sctx context.Context
+							sctx, span = tracer.Start(ictx, "copy", trace.WithAttributes(attribute.String("region", region), attribute.String("ami.source_id", newAMI)))
+							copiedAMI, err = copyAMI(sctx, awsec2dest, dc, newAMI, instance, instanceNameTag, runStart)
+							span.SetAttributes(attribute.String("ami.id", copiedAMI))
+							endSpan(span, err)
+							if err == nil {
+								cp.record(*instance.InstanceId, stepCopied, region, copiedAMI)
+								finished[region] = copiedAMI
+							} else if copiedAMI != "" {
+								abandoned[copiedAMI] = region
+							}
+						}
+						if copiedAMI != "" {
+							stateAMI = copiedAMI
+							result.CopyAMI = copiedAMI
+							copies[region] = copiedAMI
+							inProgress[copiedAMI] = region
+							status.set(instanceNameTag, *instance.InstanceId, "copying", newAMI, copiedAMI)
+						}
+						if err != nil {
+							log.Printf("Error copying AMI for %s to %s: %s", instanceNameTag, region, err.Error())
+							return
+						}
+						if c.waitSnapshots && c.dryRun {
+							log.Printf("DRYRUN: would have waited for the snapshots of the copy in %s to finish copying", region)
+						} else if c.waitSnapshots && copiedAMI != "" {
+							ui.set(*instance.InstanceId, label, "snaps", copiedAMI)
+							_, span = tracer.Start(ictx, "wait-snapshots", trace.WithAttributes(attribute.String("region", region), attribute.String("ami.id", copiedAMI)))
+							var took time.Duration
+							took, err = waitForSnapshots(ctx, awsec2dest, copiedAMI, instanceNameTag, *instance.InstanceId, dc)
+							endSpan(span, err)
+							if err != nil {
+								log.Printf("Error waiting for the snapshots of the copy for %s in %s: %s", instanceNameTag, region, err.Error())
+								return
+							}
+							if result.DataCopySeconds == nil {
+								result.DataCopySeconds = map[string]int64{}
+							}
+							result.DataCopySeconds[region] = int64(took.Seconds())
+						}
+						if c.verifyLarge && !c.dryRun && copiedAMI != "" {
+							// only once the copy is available, and its snapshots done if we waited for them
+							verifyLargeSnapshots(ctx, awsec2dest, clients.EBS(region, ""), copiedAMI)
+						}
+						// find and tag snaphots
+						if _, tagged := cp.done(*instance.InstanceId, stepTagged, region); !tagged {
+							ui.set(*instance.InstanceId, label, "tag", stateAMI)
+							if c.tagEarly {
+								// the source snapshots are done - just the copies' snapshots are left
+								_, span = tracer.Start(ictx, "tag", trace.WithAttributes(attribute.String("region", region)))
+								err = tagRegionSnapshots(ctx, c.hostname(instanceNameTag), awsec2dest, dc)
+							} else {
+								_, span = tracer.Start(ictx, "tag")
+								err = findTagVolumeSnapshots(ctx, c.hostname(instanceNameTag), awsec2, awsec2dest, dc)
+							}
+							endSpan(span, err)
+							if err != nil {
+								log.Printf("Error Tagging Snapshots for %s: %s", instanceNameTag, err.Error())
+								return
+							}
+							cp.record(*instance.InstanceId, stepTagged, region, stateAMI)
+						}
+						if _, snapsCopied := cp.done(*instance.InstanceId, stepSnapshotsCopied, region); c.copySnapshots && copiedAMI != "" && !snapsCopied {
+							// before any discard, which deletes the source snapshots
+							ui.set(*instance.InstanceId, label, "snaps", stateAMI)
+							_, span = tracer.Start(ictx, "copy-snapshots", trace.WithAttributes(attribute.String("region", region), attribute.String("ami.source_id", newAMI)))
+							err = copySnapshotsIndependently(ctx, awsec2, awsec2dest, dc, newAMI, instanceNameTag)
+							endSpan(span, err)
+							if err != nil {
+								log.Printf("Error copying snapshots for %s: %s", instanceNameTag, err.Error())
+								return
+							}
+							cp.record(*instance.InstanceId, stepSnapshotsCopied, region, copiedAMI)
+						}
+					}
+					if c.destMap != nil || len(c.dests) > 1 {
+						result.Copies = copies
+					}
+					if c.discardSource && c.freeze != freezeNone {
+						log.Printf("FROZEN: keeping source AMI %s of %s rather than discarding it", newAMI, instanceNameTag)
+					} else if c.discardSource {
+						// every copy must check out before the source goes
+						last := regions[len(regions)-1]
+						for _, region := range regions[:len(regions)-1] {
+							if copies[region] == "" || c.dryRun {
+								continue
+							}
+							if err = verifyCopy(ctx, awsec2, clients.EC2(region, ""), newAMI, copies[region], c.copiesEncrypted(region)); err != nil {
+								stage = classVerify
+								log.Printf("Error discarding source AMI for %s: keeping source AMI %s: %s", instanceNameTag, newAMI, err.Error())
+								return
+							}
+						}
+						_, span = tracer.Start(ictx, "discard", trace.WithAttributes(attribute.String("ami.id", newAMI)))
+						err = discardSource(ctx, awsec2, clients.EC2(last, ""), c.forDest(last), newAMI, copies[last])
+						endSpan(span, err)
+						if err != nil {
+							log.Printf("Error discarding source AMI for %s: %s", instanceNameTag, err.Error())
+							return
+						}
+					}
+				}
+				backoff := pipelineRetryStart
+				for attempt := 1; ; attempt++ {
+					err, stage, stateAMI = nil, classConfig, ""
+					result = backupResult{Instance: instanceNameTag, InstanceId: *instance.InstanceId}
+					if c.pipelineRetries > 0 {
+						result.Attempts = attempt
+					}
+					backupInstance(attempt)
+					if !retryPipeline(ctx, err, classOf(err, stage), attempt, c) {
+						break
+					}
+					if !c.deadline.IsZero() && time.Until(c.deadline) < backoff+c.deadlineEstimates[*instance.InstanceId] {
+						log.Printf("Not retrying backup of %s (%s): it wouldn't finish before --deadline", instanceNameTag, *instance.InstanceId)
+						break
+					}
+					log.Printf("Retrying backup of %s (%s) in %s - attempt %d of %d failed: %s", instanceNameTag, *instance.InstanceId, backoff, attempt, c.pipelineRetries+1, err.Error())
+					ui.set(*instance.InstanceId, label, "retry", stateAMI)
+					status.set(instanceNameTag, *instance.InstanceId, "retrying", result.SourceAMI, result.CopyAMI)
+					if pause(ctx, backoff) != nil {
+						break
+					}
+					discardAttempt(ctx, clients, abandoned, inProgress, c)
+					backoff *= 2
+					if backoff > pipelineRetryMax {
+						backoff = pipelineRetryMax
+					}
+				}
+			}()
+		}
+	}
+
+	for _, instances := range instanceset {
+		for _, _ = range instances {
+			r := <-done // wait for everyone to finish
+			summary.Backups = append(summary.Backups, r)
+			if r.Error != "" {
+				summary.Failed++
+			}
+			if r.Attempts > 1 {
+				summary.Retries += r.Attempts - 1
+			}
+			if r.Status == statusPolicyMissing {
+				summary.PolicyMissing = append(summary.PolicyMissing, fmt.Sprintf("%s (%s)", r.Instance, r.InstanceId))
+			}
+			if r.Pending {
+				summary.Pending = append(summary.Pending, r.SourceAMI)
+			}
+			if r.VaultError != "" {
+				summary.VaultFailed = append(summary.VaultFailed, fmt.Sprintf("%s (%s)", r.Instance, r.InstanceId))
+			}
+			for _, seconds := range r.DataCopySeconds {
+				summary.DataCopySeconds += seconds
+			}
+			for _, volume := range r.Unprotected {
+				summary.Unprotected = append(summary.Unprotected, fmt.Sprintf("%s (%s): %s", r.Instance, r.InstanceId, volume))
+			}
+			if len(r.DestRegions) > 0 && (c.destMap != nil || len(c.dests) > 1) {
+				log.Printf("All done with %s (%s, copied to %s)", r.Instance, r.InstanceId, strings.Join(r.DestRegions, ", "))
+			} else {
+				log.Printf("All done with %s", r.Instance)
+			}
+		}
+	}
+	if len(summary.Unprotected) > 0 {
+		log.Printf("WARNING: %d unprotected volumes - left out of backups, persistent, and without a %s tag: %s", len(summary.Unprotected), c.unprotectedOKSpec, strings.Join(summary.Unprotected, "; "))
+	}
+	if len(summary.VaultFailed) > 0 {
+		log.Printf("WARNING: %d AWS Backup vault jobs didn't start (their AMI backups are unaffected): %s", len(summary.VaultFailed), strings.Join(summary.VaultFailed, ", "))
+	}
+	// even once --timeout has stopped the backups, so the failures are recorded
+	tagInstanceResults(context.WithoutCancel(ctx), awsec2, summary.Backups, time.Now(), c)
+	cp.finish(summary.Failed)
+	log.Printf("All done!")
+	return summary, nil
+}
+
+// setInstanceState records the backup's progress in the instance's amibackup-state tag, if
+// --instance-state-tag is set.  Failing to tag is logged but never fails the backup.
+func setInstanceState(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, state, amiId string, c *Config) {
+	if !c.instanceStateTag {
+		return
+	}
+	if amiId != "" {
+		state = state + ":" + amiId
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have tagged instance %s amibackup-state=%s", *instance.InstanceId, state)
+		return
+	}
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{*instance.InstanceId},
+			Tags:      []types.Tag{{Key: aws.String("amibackup-state"), Value: aws.String(state)}},
+		})
+		return err
+	})
+	if err != nil {
+		log.Printf("Error tagging instance %s amibackup-state=%s: %s", *instance.InstanceId, state, err.Error())
+	}
+}
+
+// findInstances searches for our instances by "Name" tag
+func findInstances(ctx context.Context, awsec2 *ec2.Client, instanceNameTag string, c *Config) ([]*types.Instance, error) {
+	if c.instanceIds[instanceNameTag] {
+		return findInstanceById(ctx, awsec2, instanceNameTag, c)
+	}
+	filter := types.Filter{
+		Name:   aws.String("tag:Name"),
+		Values: []string{instanceNameTag},
+	}
+	if c.caseInsensitive {
+		// EC2 tag filters are case-sensitive, so list every named instance and match here
+		filter = types.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []string{"Name"},
+		}
+	}
+	params := &ec2.DescribeInstancesInput{Filters: []types.Filter{filter}}
+	if c.filteredNames[instanceNameTag] {
+		params.Filters = append(params.Filters, tagFilters(c.filterTags)...)
+	}
+	instances := []*types.Instance{}
+	pages := ec2.NewDescribeInstancesPaginator(awsec2, params)
+	for pages.HasMorePages() {
+		var page *ec2.DescribeInstancesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			page, err = pages.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, classErrorf(apiErrorClass(err, classDiscovery), "EC2 API DescribeInstances failed: %s", err.Error())
+		}
+		for _, reservation := range page.Reservations {
+			for i := range reservation.Instances {
+				instance := &reservation.Instances[i]
+				if instance.InstanceId == nil {
+					log.Printf("WARNING: DescribeInstances returned an instance tagged %s with no ID - skipping it", instanceNameTag)
+					continue
+				}
+				if c.caseInsensitive && !strings.EqualFold(discovery.TagValue(instance.Tags, "Name"), instanceNameTag) {
+					continue
+				}
+				if selectInstance(instance, instanceNameTag, c) {
+					instances = append(instances, instance)
+				}
+			}
+		}
+	}
+	return instances, nil
+}
+
+// findInstanceById finds an --instance-id instance.  Unlike a Name tag that matches nothing, an
+// ID that isn't in the source region is an error of its own.
+func findInstanceById(ctx context.Context, awsec2 *ec2.Client, id string, c *Config) ([]*types.Instance, error) {
+	var resp *ec2.DescribeInstancesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{id}})
+		return err
+	})
+	if errorCode(err) == "InvalidInstanceID.NotFound" {
+		return nil, classErrorf(classDiscovery, "Instance %s not found in %s", id, c.sourceRegion)
+	}
+	if err != nil {
+		return nil, classErrorf(apiErrorClass(err, classDiscovery), "EC2 API DescribeInstances failed: %s", err.Error())
+	}
+	instances := []*types.Instance{}
+	for _, reservation := range resp.Reservations {
+		for i := range reservation.Instances {
+			if instance := &reservation.Instances[i]; aws.ToString(instance.InstanceId) == id && selectInstance(instance, id, c) {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return instances, nil
+}
+
+// selectInstance reports whether a found instance is backed up, warning about anything off
+func selectInstance(instance *types.Instance, instanceNameTag string, c *Config) bool {
+	if match, excluded := excludedBy(instance, c); excluded {
+		log.Printf("Excluding instance %s (%s): tagged %s", *instance.InstanceId, instanceNameTag, match)
+		return false
+	}
+	if isWindows(instance) && c.windowsPolicy == "warn" {
+		log.Printf("WARNING: %s (%s) runs Windows - a NoReboot image can leave its NTFS volumes dirty; --windows-policy=vss takes VSS snapshots instead", instanceNameTag, *instance.InstanceId)
+	}
+	if class := discovery.TagValue(instance.Tags, c.retentionClassTag); class != "" && len(c.retentionClasses) > 0 && retentionClass(instance, c) == "" {
+		log.Printf("WARNING: %s (%s) has %s=%s, which is not a --retention-class - its backups are purged by the -p windows", instanceNameTag, *instance.InstanceId, c.retentionClassTag, class)
+	}
+	return true
+}
+
+// tagMatch is an --exclude-tag: a tag key, and the value it must have unless any is set
+type tagMatch struct {
+	key   string
+	value string
+	any   bool
+}
+
+// parseTagMatch parses key=value, or key alone to match any value
+func parseTagMatch(s string) (tagMatch, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if parts[0] == "" {
+		return tagMatch{}, fmt.Errorf("want key=value or key")
+	}
+	if len(parts) == 1 {
+		return tagMatch{key: parts[0], any: true}, nil
+	}
+	return tagMatch{key: parts[0], value: parts[1]}, nil
+}
+
+// excludedBy returns the --exclude-tag tag an instance matches, as key=value, if any
+func excludedBy(instance *types.Instance, c *Config) (string, bool) {
+	for _, m := range c.excludeTags {
+		for _, tag := range instance.Tags {
+			if aws.ToString(tag.Key) == m.key && (m.any || aws.ToString(tag.Value) == m.value) {
+				return m.key + "=" + aws.ToString(tag.Value), true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkPolicy returns why an instance may not be backed up under --require-policy-tag, or nil
+func checkPolicy(instance *types.Instance, c *Config) error {
+	if c.policyTag == "" {
+		return nil
+	}
+	policy := discovery.TagValue(instance.Tags, c.policyTag)
+	if policy == "" {
+		return fmt.Errorf("instance %s has no %s tag", *instance.InstanceId, c.policyTag)
+	}
+	if len(c.allowedPolicies) > 0 && !stringIn(policy, c.allowedPolicies) {
+		return fmt.Errorf("instance %s has %s=%s, which is not an allowed policy", *instance.InstanceId, c.policyTag, policy)
+	}
+	return nil
+}
+
+// policyTags returns the instance's --require-policy-tag tag to copy onto its backups - and so
+// onto their snapshots, which get the AMI's tags
+func policyTags(instance *types.Instance, c *Config) []types.Tag {
+	if c.policyTag == "" {
+		return nil
+	}
+	policy := discovery.TagValue(instance.Tags, c.policyTag)
+	if policy == "" {
+		return nil
+	}
+	return []types.Tag{{Key: aws.String(c.policyTag), Value: aws.String(policy)}}
+}
+
+// billingTags returns the instance's --copy-billing-tags tags, for cost allocation of its backups
+func billingTags(instance *types.Instance, c *Config) []types.Tag {
+	tags := []types.Tag{}
+	for _, key := range c.billingTags {
+		if value := discovery.TagValue(instance.Tags, key); value != "" {
+			tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+	}
+	return tags
+}
+
+// instanceTags returns the tags an instance passes on to its backups - and so, as snapshots
+// take their AMI's tags, to their snapshots too
+func instanceTags(instance *types.Instance, c *Config) []types.Tag {
+	tags := policyTags(instance, c)
+	tags = append(tags, retentionClassTags(instance, c)...)
+	return append(tags, billingTags(instance, c)...)
+}
+
+// hostname returns the hostname tag value written to (and searched for on) our backups
+func (c *Config) hostname(instanceNameTag string) string {
+	if c.normalize == "lower" {
+		return strings.ToLower(instanceNameTag)
+	}
+	return instanceNameTag
+}
+
+// backupTagNames are the backup tags --tag-prefix applies to
+var backupTagNames = []string{"hostname", "instance", "date", "timestamp", "sourceregion", "destregion", "duration"}
+
+// tags returns the keys our backup tags are written and read under
+func (c *Config) tags() discovery.Tags {
+	return discovery.Tags{Prefix: c.tagPrefix, Legacy: c.legacyTags}
+}
+
+// tagKey returns the key we write one of our backup tags under
+func (c *Config) tagKey(name string) string {
+	return c.tags().Key(name)
+}
+
+// hostnameKeys returns the hostname tag keys backups are found by
+func (c *Config) hostnameKeys() []string {
+	return c.tags().HostnameKeys()
+}
+
+// backupTag returns the value of one of our backup tags, falling back to the unprefixed key with --legacy-tags
+func (c *Config) backupTag(tags []types.Tag, name string) string {
+	return c.tags().Value(tags, name)
+}
+
+// describeBackups runs DescribeImages for a host's backups, once per hostname tag key, adding
+// the hostname filter to input's filters
+func describeBackups(ctx context.Context, awsec2 *ec2.Client, input *ec2.DescribeImagesInput, instanceNameTag string, c *Config) (*ec2.DescribeImagesOutput, error) {
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = discovery.DescribeBackups(ctx, awsec2, input, c.hostname(instanceNameTag), c.tags())
+		return err
+	})
+	return resp, err
+}
+
+// describeAllImages runs discovery.DescribeAllImages, retrying once with fresh credentials
+func describeAllImages(ctx context.Context, awsec2 *ec2.Client, input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = discovery.DescribeAllImages(ctx, awsec2, input)
+		return err
+	})
+	return resp, err
+}
+
+// auditTags reports backups for a host whose hostname tags differ only by case,
+// since purge treats each casing as a separate host
+func auditTags(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config) error {
+	resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{{
+			Name:   aws.String("tag-key"),
+			Values: c.hostnameKeys(),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	casings := map[string][]string{}
+	for _, image := range resp.Images {
+		hostname := c.backupTag(image.Tags, "hostname")
+		if strings.EqualFold(hostname, instanceNameTag) {
+			casings[hostname] = append(casings[hostname], *image.ImageId)
+		}
+	}
+	if len(casings) < 2 {
+		log.Printf("Hostname tags for %s in %s are consistent (%d AMIs)", instanceNameTag, regionName, len(casings[instanceNameTag]))
+		return nil
+	}
+	log.Printf("WARNING: backups for %s in %s use %d different hostname tag casings - purge windows apply to each separately:", instanceNameTag, regionName, len(casings))
+	for hostname, ids := range casings {
+		log.Printf("  hostname=%s: %d AMIs (%s)", hostname, len(ids), strings.Join(ids, ", "))
+	}
+	log.Printf("To migrate, run with --normalize=lower and retag the AMIs above with a lowercase hostname tag")
+	return nil
+}
+
+// findSnapshots returns a map of snapshots associated with an AMI
+func findSnapshots(ctx context.Context, amiid string, awsec2 *ec2.Client) (map[string]string, error) {
+	snaps := make(map[string]string)
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiid}})
+		return err
+	})
+	if err != nil {
+		return snaps, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	for _, image := range resp.Images {
+		for _, bd := range image.BlockDeviceMappings {
+			if bd.Ebs != nil && len(*bd.Ebs.SnapshotId) > 0 {
+				snaps[*bd.Ebs.SnapshotId] = *bd.DeviceName
+			}
+		}
+	}
+	return snaps, nil
+}
+
+func findAMIs(ctx context.Context, instanceNameTag string, awsec2 *ec2.Client, awsdestec2 *ec2.Client, c *Config) (map[string][]types.Tag, map[string]string, error) {
+	amis := make(map[string][]types.Tag)
+	devices := make(map[string]string)
+	for i, client := range []*ec2.Client{awsec2, awsdestec2} {
+		if i > 0 && client == awsec2 {
+			break // one region
+		}
+		resp, err := describeBackups(ctx, client, &ec2.DescribeImagesInput{}, instanceNameTag, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, image := range resp.Images {
+			for _, tag := range image.Tags {
+				amis[*image.ImageId] = append(amis[*image.ImageId], tag)
+			}
+			for _, bd := range image.BlockDeviceMappings {
+				if bd.Ebs != nil && bd.Ebs.SnapshotId != nil && bd.DeviceName != nil {
+					devices[*bd.Ebs.SnapshotId] = *bd.DeviceName
+				}
+			}
+		}
+	}
+	return amis, devices, nil
+}
+
+// restoreHintTag names each snapshot's host, device and backup time, for finding it during a restore
+const restoreHintTag = "amibackup:restore-hint"
+
+// snapshotTags returns the tags for a snapshot of a backup AMI: the AMI's own tags, plus a
+// human-readable Name and a restore hint.  An existing Name is kept unless overwriteName is set.
+func snapshotTags(amiTags, snapTags []types.Tag, device string, c *Config) []types.Tag {
+	tags := []types.Tag{}
+	for _, tag := range amiTags {
+		// CreateTags refuses an empty key, and would fail the whole batch over it
+		if key := aws.ToString(tag.Key); key != "" && key != "Name" {
+			tags = append(tags, types.Tag{Key: tag.Key, Value: aws.String(aws.ToString(tag.Value))})
+		}
+	}
+	hostname := c.backupTag(amiTags, "hostname")
+	secs, err := strconv.ParseInt(c.backupTag(amiTags, "timestamp"), 10, 64)
+	if hostname == "" || device == "" || err != nil {
+		return tags
+	}
+	t := time.Unix(secs, 0)
+	stamp, _, _ := backupTimes(t)
+	tags = append(tags, types.Tag{Key: aws.String(restoreHintTag), Value: aws.String(fmt.Sprintf("%s/%s/%s", hostname, device, stamp))})
+	if c.overwriteSnapName || discovery.TagValue(snapTags, "Name") == "" {
+		tags = append(tags, types.Tag{Key: aws.String("Name"), Value: aws.String(fmt.Sprintf("%s %s %s", hostname, device, t.Format("2006-01-02 15:04")))})
+	}
+	return tags
+}
+
+// snapshotAMI finds the AMI a snapshot was made for in its description
+var snapshotAMI = regexp.MustCompile(`ami-\w*`)
+
+func TagVolumeSnapshots(ctx context.Context, instanceNameTag string, awsec2 *ec2.Client, amis map[string][]types.Tag, devices map[string]string, c *Config) error {
+	snapshots := []types.Snapshot{}
+	pages := ec2.NewDescribeSnapshotsPaginator(awsec2, &ec2.DescribeSnapshotsInput{OwnerIds: []string{"self"}})
+	for pages.HasMorePages() {
+		var page *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			page, err = pages.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+	}
+	for _, snapshot := range snapshots {
+		snapshot_ami := snapshotAMI.FindString(aws.ToString(snapshot.Description))
+		if snapshot_ami == "" || amis[snapshot_ami] == nil {
+			continue
+		}
+		log.Printf("Tagging %s", *snapshot.SnapshotId)
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{
+				Resources: []string{*snapshot.SnapshotId},
+				Tags:      snapshotTags(amis[snapshot_ami], snapshot.Tags, devices[*snapshot.SnapshotId], c),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API CreateTags failed for %s: %s", *snapshot.SnapshotId, err.Error())
+		}
+	}
+	return nil
+}
+
+// Finds and tags volume snapshots
+func findTagVolumeSnapshots(ctx context.Context, instanceNameTag string, awsec2 *ec2.Client, awsdestec2 *ec2.Client, c *Config) error {
+	amis, devices, err := findAMIs(ctx, instanceNameTag, awsec2, awsdestec2, c)
+	if err != nil {
+		return err
+	}
+	// tag the copies even if the source region failed, then report both
+	srcErr := TagVolumeSnapshots(ctx, instanceNameTag, awsec2, amis, devices, c)
+	destErr := TagVolumeSnapshots(ctx, instanceNameTag, awsdestec2, amis, devices, c)
+	return errors.Join(srcErr, destErr)
+}
+
+// tagRegionSnapshots tags the snapshots of a host's backups in one region only, so
+// --tag-snapshots-early can tag the source region before the copy starts
+func tagRegionSnapshots(ctx context.Context, instanceNameTag string, awsec2 *ec2.Client, c *Config) error {
+	amis, devices, err := findAMIs(ctx, instanceNameTag, awsec2, awsec2, c)
+	if err != nil {
+		return err
+	}
+	return TagVolumeSnapshots(ctx, instanceNameTag, awsec2, amis, devices, c)
+}
+
+// retagBackups applies --rename-tag/--add-tag to a host's backups and their snapshots.  Resources
+// needing the same changes are tagged in one batch, and already-migrated resources are left alone.
+func retagBackups(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config) error {
+	// find backups by the hostname tag, by its new name if a previous run already migrated it, or
+	// by its old name if none has yet
+	hostnameKeys := c.hostnameKeys()
+	for _, rename := range c.retagRenames {
+		switch {
+		case stringIn(rename[0], hostnameKeys) && !stringIn(rename[1], hostnameKeys):
+			hostnameKeys = append(hostnameKeys, rename[1])
+		case stringIn(rename[1], hostnameKeys) && !stringIn(rename[0], hostnameKeys):
+			hostnameKeys = append(hostnameKeys, rename[0])
+		}
+	}
+	tags := map[string][]types.Tag{}
+	snapshotIds := []string{}
+	for _, key := range hostnameKeys {
+		resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+			Owners:  []string{"self"},
+			Filters: []types.Filter{{Name: aws.String("tag:" + key), Values: []string{c.hostname(instanceNameTag)}}},
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+		}
+		for _, image := range resp.Images {
+			tags[*image.ImageId] = image.Tags
+			for _, bd := range image.BlockDeviceMappings {
+				if bd.Ebs != nil && bd.Ebs.SnapshotId != nil {
+					snapshotIds = append(snapshotIds, *bd.Ebs.SnapshotId)
+				}
+			}
+		}
+	}
+	for len(snapshotIds) > 0 {
+		batch := snapshotIds
+		if len(batch) > 200 {
+			batch = batch[:200]
+		}
+		snapshotIds = snapshotIds[len(batch):]
+		var resp *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: batch})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+		}
+		for _, snapshot := range resp.Snapshots {
+			tags[*snapshot.SnapshotId] = snapshot.Tags
+		}
+	}
+
+	// work out the changes for each resource, grouping resources that need identical changes
+	type change struct {
+		add    []types.Tag
+		remove []types.Tag
+	}
+	changes := map[string]*change{}
+	batches := map[string][]string{}
+	added, removed := 0, 0
+	for id, resourceTags := range tags {
+		ch := change{}
+		for _, rename := range c.retagRenames {
+			old := discovery.TagValue(resourceTags, rename[0])
+			if old == "" {
+				continue
+			}
+			if discovery.TagValue(resourceTags, rename[1]) != old {
+				ch.add = append(ch.add, types.Tag{Key: aws.String(rename[1]), Value: aws.String(old)})
+			}
+			if c.retagRemoveOld {
+				ch.remove = append(ch.remove, types.Tag{Key: aws.String(rename[0])})
+			}
+		}
+		for _, add := range c.retagAdds {
+			if discovery.TagValue(resourceTags, add[0]) != add[1] {
+				ch.add = append(ch.add, types.Tag{Key: aws.String(add[0]), Value: aws.String(add[1])})
+			}
+		}
+		if len(ch.add) == 0 && len(ch.remove) == 0 {
+			continue
+		}
+		desc := []string{}
+		for _, t := range ch.add {
+			desc = append(desc, fmt.Sprintf("+%s=%s", *t.Key, *t.Value))
+		}
+		for _, t := range ch.remove {
+			desc = append(desc, fmt.Sprintf("-%s", *t.Key))
+		}
+		key := strings.Join(desc, " ")
+		if c.dryRun {
+			log.Printf("DRYRUN: would have retagged %s in %s: %s", id, regionName, key)
+		}
+		changes[key] = &ch
+		batches[key] = append(batches[key], id)
+		added += len(ch.add)
+		removed += len(ch.remove)
+	}
+	if !c.dryRun {
+		for key, ch := range changes {
+			resources := batches[key]
+			for len(resources) > 0 {
+				batch := resources
+				if len(batch) > 500 {
+					batch = batch[:500]
+				}
+				resources = resources[len(batch):]
+				if len(ch.add) > 0 {
+					err := withFreshCredentials(ctx, awsec2, func() error {
+						_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: batch, Tags: ch.add})
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("EC2 API CreateTags failed: %s", err.Error())
+					}
+				}
+				if len(ch.remove) > 0 {
+					err := withFreshCredentials(ctx, awsec2, func() error {
+						_, err := awsec2.DeleteTags(ctx, &ec2.DeleteTagsInput{Resources: batch, Tags: ch.remove})
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("EC2 API DeleteTags failed: %s", err.Error())
+					}
+				}
+			}
+			log.Printf("Retagged %d resources in %s: %s", len(batches[key]), regionName, key)
+		}
+	}
+	changed := 0
+	for _, resources := range batches {
+		changed += len(resources)
+	}
+	log.Printf("Retag of %s in %s: %d resources checked, %d changed, %d tags added, %d tags removed", instanceNameTag, regionName, len(tags), changed, added, removed)
+	return nil
+}
+
+// validateTags checks every backup of a host for the tags a backup made today would get,
+// and with --fix-tags adds the ones whose values can be recovered from the image itself
+func validateTags(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config) error {
+	hostname := c.hostname(instanceNameTag)
+	images := map[string]types.Image{}
+	// backups missing the hostname tag can still be found by name
+	filters := []types.Filter{{Name: aws.String("name"), Values: []string{amiNamePrefix(instanceNameTag) + "-*"}}}
+	for _, key := range c.hostnameKeys() {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + key), Values: []string{hostname}})
+	}
+	for _, filter := range filters {
+		resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+			Owners:  []string{"self"},
+			Filters: []types.Filter{filter},
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+		}
+		for _, image := range resp.Images {
+			images[*image.ImageId] = image
+		}
+	}
+	missingCount := 0
+	for id, image := range images {
+		expected := []string{"hostname", "instance", "date", "timestamp"}
+		if regionName != c.sourceRegion {
+			expected = append(expected, "sourceregion", "destregion")
+		}
+		fixes := []types.Tag{}
+		for _, key := range expected {
+			if c.backupTag(image.Tags, key) != "" {
+				continue
+			}
+			missingCount++
+			value := recoverTagValue(image, key, instanceNameTag, c.forDest(regionName))
+			if value == "" {
+				log.Printf("WARNING: AMI %s in %s is missing tag %s (value cannot be recovered)", id, regionName, key)
+				continue
+			}
+			log.Printf("WARNING: AMI %s in %s is missing tag %s (recoverable as %s)", id, regionName, key, value)
+			fixes = append(fixes, types.Tag{Key: aws.String(c.tagKey(key)), Value: aws.String(value)})
+		}
+		if !c.fixTags || len(fixes) == 0 {
+			continue
+		}
+		if c.dryRun {
+			log.Printf("DRYRUN: would have added %d tags to AMI %s", len(fixes), id)
+			continue
+		}
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{id}, Tags: fixes})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API CreateTags failed for %s: %s", id, err.Error())
+		}
+		log.Printf("Added %d missing tags to AMI %s", len(fixes), id)
+	}
+	log.Printf("Validated tags on %d AMIs for %s in %s: %d missing tags", len(images), instanceNameTag, regionName, missingCount)
+	return nil
+}
+
+// reconcileIncomplete finds backups left half-finished by crashed runs - images named like ours
+// that never got a timestamp tag, or still carry amibackup:incomplete - and resumes tagging the
+// recent available ones, deletes the stale ones, and only reports anything ambiguous
+func reconcileIncomplete(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config) error {
+	resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("name"), Values: []string{amiNamePrefix(instanceNameTag) + "-*"}}},
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	for _, image := range resp.Images {
+		id := *image.ImageId
+		if c.backupTag(image.Tags, "timestamp") != "" && discovery.TagValue(image.Tags, "amibackup:incomplete") == "" {
+			continue // a finished backup
+		}
+		if runID, ok := inFlight(image, c); ok {
+			log.Printf("Incomplete AMI %s in %s is still in progress in run %s - leaving it alone", id, regionName, runID)
+			continue
+		}
+		created, _, ok := parseBackupName(aws.ToString(image.Name), amiNamePrefix(instanceNameTag))
+		if owner := c.backupTag(image.Tags, "hostname"); owner != "" && owner != c.hostname(instanceNameTag) {
+			ok = false // named like ours, but another host's
+		}
+		if !ok {
+			log.Printf("Incomplete AMI %s (%s) in %s doesn't look like one of ours - leaving it alone", id, aws.ToString(image.Name), regionName)
+			continue
+		}
+		age := time.Since(created)
+		state := string(image.State)
+		switch {
+		case age > c.incompleteMaxAge && knownImageState(state) && !imageWorkingStates[state] && c.freeze == freezeNone:
+			if c.dryRun {
+				log.Printf("DRYRUN: would have deleted incomplete AMI %s in %s (%s, %s old)", id, regionName, state, age)
+				continue
+			}
+			if err := deregisterAMI(ctx, awsec2, id, c); err != nil {
+				return err
+			}
+			log.Printf("Deleted incomplete AMI %s in %s (%s, %s old)", id, regionName, state, age)
+		case state == "available" && discovery.TagValue(image.Tags, "amibackup:incomplete") == "":
+			// the image finished but the run died before tagging it - tag it so purge sees it
+			tags := []types.Tag{}
+			for _, key := range []string{"hostname", "instance", "date", "timestamp"} {
+				if value := recoverTagValue(image, key, instanceNameTag, c); value != "" {
+					tags = append(tags, types.Tag{Key: aws.String(c.tagKey(key)), Value: aws.String(value)})
+				}
+			}
+			if c.dryRun {
+				log.Printf("DRYRUN: would have resumed incomplete AMI %s in %s by tagging it", id, regionName)
+				continue
+			}
+			err := withFreshCredentials(ctx, awsec2, func() error {
+				_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{id}, Tags: tags})
+				return err
+			})
+			if err != nil {
+				if raced(err, "CreateTags", id, c) {
+					continue
+				}
+				return fmt.Errorf("EC2 API CreateTags failed for %s: %s", id, err.Error())
+			}
+			log.Printf("Resumed incomplete AMI %s in %s by tagging it", id, regionName)
+		default:
+			log.Printf("Found incomplete AMI %s in %s (%s, %s old) - leaving it for now", id, regionName, state, age)
+		}
+	}
+	return nil
+}
+
+// cleanupFailedCopies deregisters a host's AMIs in a region that are failed or error - copies
+// that died, which never get a timestamp tag and so are never purged - and deletes their
+// snapshots, including the ones CopyImage made but never attached.  It returns the AMIs cleaned up.
+func cleanupFailedCopies(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config) ([]string, error) {
+	cleaned := []string{}
+	states := []types.Filter{{Name: aws.String("state"), Values: []string{"failed", "error"}}}
+	tagged, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{Owners: []string{"self"}, Filters: states}, instanceNameTag, c)
+	if err != nil {
+		return cleaned, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	// a copy that failed before it was tagged still has our name
+	named, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: append(states, types.Filter{Name: aws.String("name"), Values: []string{amiNamePrefix(instanceNameTag) + "-*"}}),
+	})
+	if err != nil {
+		return cleaned, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	seen := map[string]bool{}
+	for _, image := range append(tagged.Images, named.Images...) {
+		id := *image.ImageId
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		snaps := []string{}
+		for _, bd := range image.BlockDeviceMappings {
+			if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+				snaps = append(snaps, *bd.Ebs.SnapshotId)
+			}
+		}
+		var orphans *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			orphans, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+				OwnerIds: []string{"self"},
+				Filters:  []types.Filter{{Name: aws.String("description"), Values: []string{"*" + id + "*"}}},
+			})
+			return err
+		})
+		if err != nil {
+			return cleaned, fmt.Errorf("EC2 API DescribeSnapshots failed for %s: %s", id, err.Error())
+		}
+		for _, snap := range orphans.Snapshots {
+			if !stringIn(*snap.SnapshotId, snaps) {
+				snaps = append(snaps, *snap.SnapshotId)
+			}
+		}
+		if c.dryRun {
+			log.Printf("DRYRUN: would have cleaned up %s AMI %s of %s in %s and its %d snapshots", string(image.State), id, instanceNameTag, regionName, len(snaps))
+			cleaned = append(cleaned, id)
+			continue
+		}
+		if err := deregisterImage(ctx, awsec2, id, c); err != nil {
+			return cleaned, err
+		}
+		if err := deleteSnapshots(ctx, awsec2, snaps, c); err != nil {
+			return cleaned, err
+		}
+		log.Printf("Cleaned up %s AMI %s of %s in %s and its %d snapshots", string(image.State), id, instanceNameTag, regionName, len(snaps))
+		cleaned = append(cleaned, id)
+	}
+	return cleaned, nil
+}
+
+// pendingCopyTag marks a source AMI that a --no-wait run left for a later run to copy
+const pendingCopyTag = "amibackup:pending-copy"
+
+// resumePending finishes what earlier --no-wait runs started: source AMIs that have become
+// available are copied, and copies still in progress are reported.  It returns the AMIs still pending.
+func resumePending(ctx context.Context, awsec2, awsec2dest *ec2.Client, instanceNameTag string, c *Config) ([]string, error) {
+	pending := []string{}
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("tag-key"), Values: []string{pendingCopyTag}}},
+	}, instanceNameTag, c)
+	if err != nil {
+		return pending, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	resumed := false
+	failed := []string{}
+	for _, image := range resp.Images {
+		id := *image.ImageId
+		switch state := string(image.State); {
+		case imageWorkingStates[state]:
+			pending = append(pending, id)
+			continue
+		case state == "available":
+		case imageFailedStates[state]:
+			log.Printf("Pending AMI %s for %s is %s - not copying it", id, instanceNameTag, state)
+		default:
+			// it may yet become available, so it keeps its tag for a later run
+			unknownState("image", state, "treating it as pending")
+			pending = append(pending, id)
+			continue
+		}
+		if c.dryRun {
+			log.Printf("DRYRUN: would have resumed copy of %s to %s", id, c.destRegion)
+			continue
+		}
+		if string(image.State) == "available" {
+			timestamp, err := strconv.ParseInt(c.backupTag(image.Tags, "timestamp"), 10, 64)
+			if err != nil {
+				log.Printf("Pending AMI %s has a corrupt timestamp tag - skipping", id)
+				continue
+			}
+			instance := &types.Instance{InstanceId: aws.String(c.backupTag(image.Tags, "instance"))}
+			copied, err := copyAMI(ctx, awsec2dest, c, id, instance, instanceNameTag, time.Unix(timestamp, 0))
+			if err != nil {
+				return pending, fmt.Errorf("Error resuming copy of %s: %s", id, err.Error())
+			}
+			if copied != "" {
+				pending = append(pending, copied)
+			}
+			resumed = true
+		}
+		// the --no-wait run that made it left it in progress, and it no longer is
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.DeleteTags(ctx, &ec2.DeleteTagsInput{Resources: []string{*image.ImageId}, Tags: []types.Tag{{Key: aws.String(pendingCopyTag)}, {Key: aws.String(inProgressTag)}}})
+			return err
+		})
+		if err != nil {
+			return pending, fmt.Errorf("EC2 API DeleteTags failed for %s: %s", id, err.Error())
+		}
+	}
+
+	// check on copies started by earlier runs
+	if c.destRegion != c.sourceRegion {
+		resp, err = describeBackups(ctx, awsec2dest, &ec2.DescribeImagesInput{
+			Owners:  []string{"self"},
+			Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"pending", "failed"}}},
+		}, instanceNameTag, c)
+		if err != nil {
+			return pending, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+		}
+		for _, image := range resp.Images {
+			if string(image.State) == "failed" {
+				failed = append(failed, *image.ImageId)
+				continue
+			}
+			if !stringIn(*image.ImageId, pending) {
+				pending = append(pending, *image.ImageId)
+			}
+		}
+	}
+	if resumed || len(pending) > 0 {
+		if err := findTagVolumeSnapshots(ctx, c.hostname(instanceNameTag), awsec2, awsec2dest, c); err != nil {
+			return pending, fmt.Errorf("Error tagging snapshots: %s", err.Error())
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Backups of %s still in progress: %s", instanceNameTag, strings.Join(pending, ", "))
+	}
+	if len(failed) > 0 {
+		return pending, fmt.Errorf("copies of %s failed in %s: %s", instanceNameTag, c.destRegion, strings.Join(failed, ", "))
+	}
+	return pending, nil
+}
+
+// stringIn reports whether s is in list
+func stringIn(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// deregisterAMI deregisters an AMI and deletes the snapshots behind it that no other AMI uses
+func deregisterAMI(ctx context.Context, awsec2 *ec2.Client, id string, c *Config) error {
+	// find snapshots associated with this AMI.
+	snaps, err := findSnapshots(ctx, id, awsec2)
+	if err != nil {
+		return fmt.Errorf("EC2 API findSnapshots failed for %s: %s", id, err.Error())
+	}
+	ids := []string{}
+	for snap := range snaps {
+		ids = append(ids, snap)
+	}
+	sort.Strings(ids)
+	// any other AMI of ours using one of them keeps it
+	images := []types.Image{}
+	if len(ids) > 0 {
+		resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+			Owners:  []string{"self"},
+			Filters: []types.Filter{{Name: aws.String("block-device-mapping.snapshot-id"), Values: ids}},
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeImages failed for the snapshots of %s: %s", id, err.Error())
+		}
+		images = resp.Images
+	}
+	refs := snapshotRefs(images)
+	for _, snap := range ids {
+		if !stringIn(id, refs[snap]) {
+			refs[snap] = append(refs[snap], id)
+		}
+	}
+	return purgeImage(ctx, awsec2, id, refs, map[string]bool{}, c)
+}
+
+// deregisterImage deregisters an AMI, leaving its snapshots alone.  An image already deregistered
+// counts as done.
+func deregisterImage(ctx context.Context, awsec2 *ec2.Client, id string, c *Config) error {
+	if c.freeze != freezeNone {
+		return errFrozen
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have deregistered image ID: %s", id)
+		return nil
+	}
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(id)})
+		return err
+	})
+	if err != nil && !raced(err, "DeregisterImage", id, c) {
+		return fmt.Errorf("EC2 API DeregisterImage failed for %s: %s", id, err.Error())
+	}
+	return nil
+}
+
+// deleteSnapshots deletes snapshots left behind by deregistered AMIs
+func deleteSnapshots(ctx context.Context, awsec2 *ec2.Client, snaps []string, c *Config) error {
+	if c.freeze != freezeNone && len(snaps) > 0 {
+		return errFrozen
+	}
+	for _, snap := range snaps {
+		if c.dryRun {
+			log.Printf("DRYRUN: would have deleted snapshot ID: %s", snap)
+			continue
+		}
+		if c.snapshotLimiter != nil {
+			if err := c.snapshotLimiter.Wait(ctx); err != nil {
+				return fmt.Errorf("Error waiting to delete snapshot %s: %s", snap, err.Error())
+			}
+		}
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snap)})
+			return err
+		})
+		if err != nil && !raced(err, "DeleteSnapshot", snap, c) {
+			return fmt.Errorf("EC2 API DeleteSnapshot failed for %s: %s", snap, err.Error())
+		}
+	}
+	return nil
+}
+
+// snapshotRefs maps each snapshot behind a set of AMIs to the AMIs using it
+func snapshotRefs(images []types.Image) map[string][]string {
+	refs := map[string][]string{}
+	for _, image := range images {
+		for _, bd := range image.BlockDeviceMappings {
+			if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" && !stringIn(*image.ImageId, refs[*bd.Ebs.SnapshotId]) {
+				refs[*bd.Ebs.SnapshotId] = append(refs[*bd.Ebs.SnapshotId], *image.ImageId)
+			}
+		}
+	}
+	return refs
+}
+
+// releasedSnapshots returns the snapshots of AMI id that no AMI still registered uses, and for the
+// rest, the AMIs still using them
+func releasedSnapshots(id string, refs map[string][]string, deregistered map[string]bool) ([]string, map[string][]string) {
+	released := []string{}
+	inUse := map[string][]string{}
+	for snap, amis := range refs {
+		if !stringIn(id, amis) {
+			continue
+		}
+		for _, ami := range amis {
+			if !deregistered[ami] {
+				inUse[snap] = append(inUse[snap], ami)
+			}
+		}
+		if len(inUse[snap]) == 0 {
+			released = append(released, snap)
+		}
+	}
+	sort.Strings(released)
+	return released, inUse
+}
+
+// purgeImage deregisters one AMI of a purge plan and deletes the snapshots it leaves unused.  A
+// snapshot shared with other AMIs of the host is deleted along with the last of them to go.
+func purgeImage(ctx context.Context, awsec2 *ec2.Client, id string, refs map[string][]string, deregistered map[string]bool, c *Config) error {
+	if err := deregisterImage(ctx, awsec2, id, c); err != nil {
+		return err
+	}
+	deregistered[id] = true
+	released, inUse := releasedSnapshots(id, refs, deregistered)
+	for snap, amis := range inUse {
+		log.Printf("Keeping snapshot %s of %s - still used by %s", snap, id, strings.Join(amis, ", "))
+	}
+	return deleteSnapshots(ctx, awsec2, released, c)
+}
+
+// largeSnapshotGB is the size above which snapshots are verified with the EBS direct API
+const largeSnapshotGB = 2048
+
+// verifyLargeSnapshots checks that each snapshot over 2 TiB behind an available AMI has at least
+// one block of content.  Problems are logged, never returned, so they don't hold up the backup.
+func verifyLargeSnapshots(ctx context.Context, awsec2 *ec2.Client, awsebs *ebs.Client, amiId string) {
+	snaps, err := findSnapshots(ctx, amiId, awsec2)
+	if err != nil || len(snaps) == 0 {
+		if err != nil {
+			log.Printf("Error finding snapshots of %s to verify: %s", amiId, err.Error())
+		}
+		return
+	}
+	ids := []string{}
+	for id := range snaps {
+		ids = append(ids, id)
+	}
+	var resp *ec2.DescribeSnapshotsOutput
+	err = withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: ids})
+		return err
+	})
+	if err != nil {
+		log.Printf("Error describing snapshots of %s to verify: EC2 API DescribeSnapshots failed: %s", amiId, err.Error())
+		return
+	}
+	for _, snapshot := range resp.Snapshots {
+		if snapshot.VolumeSize == nil || *snapshot.VolumeSize <= largeSnapshotGB {
+			continue
+		}
+		blocks, err := awsebs.ListSnapshotBlocks(ctx, &ebs.ListSnapshotBlocksInput{SnapshotId: snapshot.SnapshotId, MaxResults: aws.Int32(100)})
+		if err != nil {
+			log.Printf("WARNING: could not verify %d GB snapshot %s of %s: EBS API ListSnapshotBlocks failed: %s", *snapshot.VolumeSize, *snapshot.SnapshotId, amiId, err.Error())
+			continue
+		}
+		if len(blocks.Blocks) == 0 {
+			log.Printf("WARNING: %d GB snapshot %s of %s has no blocks - it may be empty", *snapshot.VolumeSize, *snapshot.SnapshotId, amiId)
+			continue
+		}
+		log.Printf("Verified %d GB snapshot %s of %s has content", *snapshot.VolumeSize, *snapshot.SnapshotId, amiId)
+	}
+}
+
+// amiNameUnsafe matches the characters AWS doesn't allow in AMI names (nor in name filters unescaped)
+var amiNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9()\[\] ./'@_-]`)
+
+// amiNamePrefixMax is the longest Name tag that starts our AMI names as is.  AWS allows 128
+// characters, and a copy's name adds up to 64 more: -YYYY-MM-DD_hh-mm-ss-ami-id-region.
+const amiNamePrefixMax = 64
+
+// amiNamePrefix returns a Name tag as it starts our AMI names.  A tag with characters AWS rejects
+// has them replaced by _ and gets a hash of the original after another _, and an overlong one is
+// cut short before its hash - so web,01 backs up as web_01_<hash>-YYYY-MM-DD_hh-mm-ss-id, never
+// matching web_01's backups.
+func amiNamePrefix(instanceNameTag string) string {
+	prefix := amiNameUnsafe.ReplaceAllString(instanceNameTag, "_")
+	if prefix == instanceNameTag && len(prefix) <= amiNamePrefixMax {
+		return prefix
+	}
+	sum := sha256.Sum256([]byte(instanceNameTag))
+	hash := "_" + hex.EncodeToString(sum[:4])
+	if len(prefix) > amiNamePrefixMax-len(hash) {
+		prefix = prefix[:amiNamePrefixMax-len(hash)]
+	}
+	return prefix + hash
+}
+
+// quoteField returns s as is if it's safe as one space-separated field of a line, or Go-quoted if not
+func quoteField(s string) string {
+	if s != "" && !strings.Contains(s, " ") && strconv.Quote(s) == `"`+s+`"` {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// parseBackupName splits one of our AMI names (hostname-YYYY-MM-DD_hh-mm-ss-id) into its
+// timestamp and what trails it: the instance id, or for a copy the source AMI id and (for newer
+// copies) the dest region
+func parseBackupName(name, hostname string) (time.Time, string, bool) {
+	if !strings.HasPrefix(name, hostname+"-") || len(name) < len(hostname)+22 {
+		return time.Time{}, "", false
+	}
+	name = name[len(hostname)+1:]
+	t, err := time.ParseInLocation("2006-01-02_15-04-05", name[:19], time.Local)
+	if err != nil || name[19] != '-' {
+		return time.Time{}, "", false
+	}
+	return t, name[20:], true
+}
+
+// recoverTagValue works out what a missing backup tag should have been from the image's
+// name (hostname-YYYY-MM-DD_hh-mm-ss-instanceid) and creation date, or "" if it can't
+func recoverTagValue(image types.Image, key, instanceNameTag string, c *Config) string {
+	created, suffix, _ := parseBackupName(aws.ToString(image.Name), amiNamePrefix(instanceNameTag))
+	if created.IsZero() && image.CreationDate != nil {
+		if t, err := time.Parse(time.RFC3339, *image.CreationDate); err == nil {
+			created = t.Local()
+		}
+	}
+	switch key {
+	case "hostname":
+		return c.hostname(instanceNameTag)
+	case "instance":
+		if strings.HasPrefix(suffix, "i-") {
+			return suffix
+		}
+	case "sourceregion":
+		return c.sourceRegion
+	case "destregion":
+		return c.destRegion
+	case "date":
+		if !created.IsZero() {
+			return created.Format("2006-01-02 15:04:05 -0700")
+		}
+	case "timestamp":
+		if !created.IsZero() {
+			return fmt.Sprintf("%d", created.Unix())
+		}
+	}
+	return ""
+}
+
+// descriptionData is what --description-template can use
+type descriptionData struct {
+	InstanceNameTag string
+	TimeString      string
+	InstanceId      string
+	SourceRegion    string
+	DestRegion      string // copies only
+	CopyIndex       int    // copies only: the dest region's place among the instance's, from 1
+	Tags            map[string]string
+}
+
+// description renders --description-template for a new AMI
+func (c *Config) description(instanceNameTag, timeString, instanceId string, instance *types.Instance) (string, error) {
+	return c.renderDescription(descriptionData{instanceNameTag, timeString, instanceId, c.sourceRegion, "", 0, map[string]string{}}, instance)
+}
+
+// copyDescription renders --description-template for a copy, to c's dest region
+func (c *Config) copyDescription(instanceNameTag, timeString, amiId string, instance *types.Instance) (string, error) {
+	return c.renderDescription(descriptionData{instanceNameTag, timeString, amiId, c.sourceRegion, c.destRegion, copyIndex(instance, c), map[string]string{}}, instance)
+}
+
+// renderDescription renders --description-template, with the instance's tags
+func (c *Config) renderDescription(data descriptionData, instance *types.Instance) (string, error) {
+	for _, tag := range instance.Tags {
+		data.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	var out bytes.Buffer
+	if err := c.descTemplate.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("Error rendering description template: %s", err.Error())
+	}
+	return out.String(), nil
+}
+
+// createAMI actually creates the AMI
+func createAMI(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, c *Config, instanceNameTag string) (string, error) {
+	newAMI := ""
+
+	backupAmiName := fmt.Sprintf("%s-%s-%s", amiNamePrefix(instanceNameTag), timeStamp, *instance.InstanceId)
+	backupDesc, err := c.description(instanceNameTag, timeString, *instance.InstanceId, instance)
+	if err != nil {
+		return newAMI, err
+	}
+	blockDevices, _, err := imageBlockDevices(instance, c)
+	if err != nil {
+		return newAMI, err
+	}
+	params := &ec2.CreateImageInput{
+		InstanceId:        instance.InstanceId,
+		Name:              aws.String(backupAmiName),
+		Description:       aws.String(backupDesc),
+		NoReboot:          aws.Bool(true),
+		TagSpecifications: inProgressTags(c),
+	}
+	if len(blockDevices) > 0 {
+		params.BlockDeviceMappings = blockDevices
+	}
+	if !c.dryRun {
+		var resp *ec2.CreateImageOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.CreateImage(ctx, params)
+			return err
+		})
+		if errorCode(err) == "InvalidAMIName.Duplicate" {
+			// names carry the run's start time, so this is the AMI an interrupted run started -
+			// a run resumed from its --checkpoint-file picks it up rather than failing
+			existing, ferr := findAMIByName(ctx, awsec2, backupAmiName)
+			if ferr == nil && existing != "" {
+				log.Printf("AMI %s already exists as %s - resuming it", backupAmiName, existing)
+				resp, err = &ec2.CreateImageOutput{ImageId: aws.String(existing)}, nil
+			}
+		}
+		if err != nil {
+			return newAMI, fmt.Errorf("Error creating new AMI named %s for instance %s: %s", backupAmiName, *instance.InstanceId, err.Error())
+		}
+		newAMI = *resp.ImageId
+		log.Printf("Creating new AMI %s for %s (%s)", *resp.ImageId, instanceNameTag, *instance.InstanceId)
+	} else {
+		log.Printf("DRYRUN: would have created AMI for: %s (%s)", instanceNameTag, *instance.InstanceId)
+		if err := c.plan.addCreate(ctx, awsec2, instance, instanceNameTag, methodCreateImage, params, c); err != nil {
+			return newAMI, err
+		}
+	}
+	return finishAMI(ctx, awsec2, instance, c, instanceNameTag, newAMI)
+}
+
+// finishAMI waits for a new AMI, unless --no-wait, and tags it as one of our backups
+func finishAMI(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, c *Config, instanceNameTag, newAMI string) (string, error) {
+	tags := backupTags(instance, c, instanceNameTag)
+	if c.dryRun {
+		// there's no AMI to wait for or tag
+		return newAMI, nil
+	}
+	if c.noWait {
+		// tag it now and leave the copy to a later run
+		if c.destRegion != c.sourceRegion {
+			tags = append(tags, types.Tag{Key: aws.String(pendingCopyTag), Value: aws.String(c.destRegion)})
+		}
+		log.Printf("Not waiting for new AMI %s - a later run will copy it", newAMI)
+	} else {
+		ui.update(*instance.InstanceId, "wait", newAMI)
+		if err := waitForAMI(ctx, awsec2, newAMI, instanceNameTag, *instance.InstanceId, false, c); err != nil {
+			return newAMI, err
+		}
+		log.Printf("Created new AMI %s in region %s", newAMI, c.sourceRegion)
+	}
+
+	// tag the AMI
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{newAMI}, Tags: tags})
+		return err
+	})
+	return newAMI, err
+}
+
+// backupTags returns the tags a new backup of an instance gets
+func backupTags(instance *types.Instance, c *Config, instanceNameTag string) []types.Tag {
+	tags := []types.Tag{
+		{Key: aws.String(c.tagKey("hostname")), Value: aws.String(c.hostname(instanceNameTag))},
+		{Key: aws.String(c.tagKey("instance")), Value: instance.InstanceId},
+		{Key: aws.String(c.tagKey("date")), Value: aws.String(timeString)},
+		{Key: aws.String(c.tagKey("timestamp")), Value: aws.String(timeSecs)},
+	}
+	return append(tags, instanceTags(instance, c)...)
+}
+
+// wait for AMI to be ready, through the shared poller for its client.  A new AMI can be missing
+// from DescribeImages for a while, so it counts as pending until --not-found-grace has passed -
+// but one that vanishes after being seen is gone.  The wait also gives up once the poller hasn't
+// had an answer for --poll-stale-limit.
+func waitForAMI(ctx context.Context, awsec2 *ec2.Client, newAMI, instanceNameTag, instanceId string, isCopy bool, c *Config) (err error) {
+	what := "AMI"
+	if isCopy {
+		what = "AMI copy"
+	}
+	_, span := tracer.Start(ctx, "wait", trace.WithAttributes(attribute.String("ami.id", newAMI), attribute.Bool("ami.copy", isCopy)))
+	defer func() { endSpan(span, err) }()
+	poller := pollerFor(awsec2)
+	w := poller.watch(newAMI)
+	defer poller.stop(w)
+	jobstate := "new"
+	seen := false
+	log.Printf("Waiting for %s %s for %s", what, newAMI, instanceNameTag)
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Stopped waiting for %s %s for %s: %s", what, newAMI, instanceNameTag, ctx.Err())
+		case u := <-w.updates:
+			if u.err != nil {
+				return fmt.Errorf("Error waiting for %s %s for %s: %s", what, newAMI, instanceNameTag, u.err.Error())
+			}
+			if u.image == nil {
+				if seen {
+					return fmt.Errorf("AMI %s for %s disappeared while %s", newAMI, instanceNameTag, jobstate)
+				}
+				log.Printf("AMI %s for %s is not visible yet - treating it as pending", newAMI, instanceNameTag)
+				continue
+			}
+			seen = true
+			state := string(u.image.State)
+			switch {
+			case state == "available":
+				span.SetAttributes(snapshotAttributes(*u.image)...)
+				return nil
+			case imageFailedStates[state]:
+				reason := ""
+				if u.image.StateReason != nil {
+					reason = ": " + aws.ToString(u.image.StateReason.Message)
+				}
+				return fmt.Errorf("%s %s for %s is %s%s", what, newAMI, instanceNameTag, state, reason)
+			case !imageWorkingStates[state]:
+				// bounded like any other wait, by the run's --timeout
+				unknownState("image", state, "treating it as pending")
+			}
+			if state != jobstate {
+				log.Printf("Waiting for %s %s %s for %s", state, what, newAMI, instanceNameTag)
+				jobstate = state
+			}
+			if isCopy && u.image.StateReason != nil && u.image.StateReason.Message != nil {
+				ui.update(instanceId, "", newAMI+" "+copyPercent(*u.image.StateReason.Message))
+			}
+		case <-time.After(apiPollInterval):
+			stale := poller.staleness(w)
+			if !seen && stale < time.Since(w.since) {
+				// polls are answering without it
+				if time.Since(w.since) > c.notFoundGrace {
+					return fmt.Errorf("AMI %s for %s still not found %s after it was created", newAMI, instanceNameTag, c.notFoundGrace)
+				}
+			}
+			if stale > c.pollStaleLimit {
+				return fmt.Errorf("Gave up waiting for %s %s for %s: no answer from DescribeImages for %s", what, newAMI, instanceNameTag, stale.Round(time.Second))
+			}
+			if stale > 2*apiPollInterval {
+				ui.update(instanceId, "", fmt.Sprintf("%s (no poll for %s)", newAMI, stale.Round(time.Second)))
+			}
+		}
+	}
+}
+
+// copyAMI copies a backup made at created to the dest region, waiting for it unless --no-wait
+func copyAMI(ctx context.Context, awsec2dest *ec2.Client, c *Config, amiId string, instance *types.Instance, instanceNameTag string, created time.Time) (string, error) {
+	timeStamp, timeString, _ := backupTimes(created)
+	if c.dryRun && c.destRegion == c.sourceRegion {
+		log.Printf("DRYRUN: would have copied new AMI from %s to %s", c.sourceRegion, c.destRegion)
+		return "", nil
+	}
+	if c.destRegion != c.sourceRegion {
+		// named for the dest region too, as copies of one image to several regions would share a name
+		backupAmiName := fmt.Sprintf("%s-%s-%s-%s", amiNamePrefix(instanceNameTag), timeStamp, amiId, c.destRegion)
+		// copies have always had the source AMI where creates have the instance
+		backupDesc, err := c.copyDescription(instanceNameTag, timeString, amiId, instance)
+		if err != nil {
+			return "", err
+		}
+		params := &ec2.CopyImageInput{
+			SourceRegion:  aws.String(c.sourceRegion),
+			SourceImageId: aws.String(amiId),
+			Name:          aws.String(backupAmiName),
+			Description:   aws.String(backupDesc),
+			ClientToken:   aws.String(copyToken(amiId, c)),
+			// the copy is in flight until the source's pipeline is done
+			TagSpecifications: inProgressTags(c),
+		}
+		if c.encrypted {
+			params.Encrypted = aws.Bool(true)
+			if c.kmsKeyId != "" {
+				params.KmsKeyId = aws.String(c.kmsKeyId)
+			} // else: uses default kms key
+		}
+		if c.dryRun {
+			log.Printf("DRYRUN: would have copied new AMI from %s to %s", c.sourceRegion, c.destRegion)
+			c.plan.addCopy(instance, instanceNameTag, c.destRegion, params, copyTags(instance, c, instanceNameTag, created), c.ebsDefaultOn[c.destRegion])
+			return "", nil
+		}
+		// hold the slot until the copy finishes (or until we stop waiting for it)
+		release := acquireCopySlot(c.accountID, c.perAccountCopyLimit)
+		defer release()
+
+		copyResp, err := startCopy(ctx, awsec2dest, params, c)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Started copy of %s from %s (%s) to %s (%s).", instanceNameTag, c.sourceRegion, amiId, c.destRegion, *copyResp.ImageId)
+		if err := pause(ctx, apiPollInterval); err != nil {
+			return *copyResp.ImageId, fmt.Errorf("Stopped before tagging copy %s: %s", *copyResp.ImageId, err)
+		}
+
+		err = withFreshCredentials(ctx, awsec2dest, func() error {
+			_, err := awsec2dest.CreateTags(ctx, &ec2.CreateTagsInput{
+				Resources: []string{*copyResp.ImageId},
+				Tags:      copyTags(instance, c, instanceNameTag, created),
+			})
+			return err
+		})
+
+		if err != nil {
+			return *copyResp.ImageId, fmt.Errorf("Error tagging new AMI: %s", err.Error())
+		}
+		if c.noWait {
+			return *copyResp.ImageId, nil
+		}
+
+		if err := waitForAMI(ctx, awsec2dest, *copyResp.ImageId, instanceNameTag, *instance.InstanceId, true, c); err != nil {
+			return *copyResp.ImageId, err
+		}
+
+		log.Printf("Finished copy of %s from %s (%s) to %s (%s).", instanceNameTag, c.sourceRegion, amiId, c.destRegion, *copyResp.ImageId)
+		return *copyResp.ImageId, nil
+	} else {
+		log.Printf("Not copying AMI %s - source and dest regions match", amiId)
+	}
+	return "", nil
+}
+
+// copyTags returns the tags a copy of an instance's backup made at created gets
+func copyTags(instance *types.Instance, c *Config, instanceNameTag string, created time.Time) []types.Tag {
+	_, timeString, timeSecs := backupTimes(created)
+	tags := []types.Tag{
+		{Key: aws.String(c.tagKey("hostname")), Value: aws.String(c.hostname(instanceNameTag))},
+		{Key: aws.String(c.tagKey("instance")), Value: instance.InstanceId},
+		{Key: aws.String(c.tagKey("sourceregion")), Value: aws.String(c.sourceRegion)},
+		{Key: aws.String(c.tagKey("destregion")), Value: aws.String(c.destRegion)},
+		{Key: aws.String(c.tagKey("date")), Value: aws.String(timeString)},
+		{Key: aws.String(c.tagKey("timestamp")), Value: aws.String(timeSecs)},
+	}
+	return append(tags, instanceTags(instance, c)...)
+}
+
+// startCopy starts an AMI copy into c.destRegion, retrying with backoff while the region is at
+// its simultaneous copy limit
+func startCopy(ctx context.Context, awsec2dest *ec2.Client, params *ec2.CopyImageInput, c *Config) (*ec2.CopyImageOutput, error) {
+	var copyResp *ec2.CopyImageOutput
+	backoff := copyRetryStart
+	for attempt := 1; ; attempt++ {
+		err := withFreshCredentials(ctx, awsec2dest, func() (err error) {
+			copyResp, err = awsec2dest.CopyImage(ctx, params)
+			return err
+		})
+		if err == nil {
+			return copyResp, nil
+		}
+		if errorCode(err) != "CopyLimitExceeded" || attempt > c.copyRetries {
+			return nil, fmt.Errorf("CopyImage failed: %s", err.Error())
+		}
+		log.Printf("Too many simultaneous AMI copies into %s - retrying copy of %s in %s (retry %d of %d)", c.destRegion, aws.ToString(params.SourceImageId), backoff, attempt, c.copyRetries)
+		if err := pause(ctx, backoff); err != nil {
+			return nil, fmt.Errorf("Stopped waiting to retry copy of %s: %s", aws.ToString(params.SourceImageId), err)
+		}
+		backoff *= 2
+		if backoff > copyRetryMax {
+			backoff = copyRetryMax
+		}
+	}
+}
+
+// copySnapshotsIndependently copies each snapshot of a source AMI to the dest region on its own,
+// for --copy-snapshots-independently, and waits for the copies to complete.  The copies are tagged
+// with the snapshot and AMI they came from, and are separate from the copied AMI's own snapshots.
+func copySnapshotsIndependently(ctx context.Context, awsec2, awsec2dest *ec2.Client, c *Config, amiId, instanceNameTag string) error {
+	snaps, err := findSnapshots(ctx, amiId, awsec2)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for snap := range snaps {
+		ids = append(ids, snap)
+	}
+	sort.Strings(ids)
+	if c.dryRun {
+		log.Printf("DRYRUN: would have copied %d snapshots of %s to %s independently", len(ids), amiId, c.destRegion)
+		return nil
+	}
+	copies := []string{}
+	for _, snap := range ids {
+		params := &ec2.CopySnapshotInput{
+			SourceRegion:     aws.String(c.sourceRegion),
+			SourceSnapshotId: aws.String(snap),
+			// our own description, so snapshot tagging doesn't take the copy for one of the AMI's
+			Description: aws.String(fmt.Sprintf("amibackup copy of %s (%s) from %s", snap, snaps[snap], c.sourceRegion)),
+			TagSpecifications: []types.TagSpecification{{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags: []types.Tag{
+					{Key: aws.String("source-ami"), Value: aws.String(amiId)},
+					{Key: aws.String("source-snapshot"), Value: aws.String(snap)},
+					{Key: aws.String(c.tagKey("hostname")), Value: aws.String(c.hostname(instanceNameTag))},
+					{Key: aws.String(c.tagKey("timestamp")), Value: aws.String(timeSecs)},
+				},
+			}},
+		}
+		if c.encrypted {
+			params.Encrypted = aws.Bool(true)
+			if c.kmsKeyId != "" {
+				params.KmsKeyId = aws.String(c.kmsKeyId)
+			}
+		}
+		var resp *ec2.CopySnapshotOutput
+		err := withFreshCredentials(ctx, awsec2dest, func() (err error) {
+			resp, err = awsec2dest.CopySnapshot(ctx, params)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API CopySnapshot failed for %s: %s", snap, err.Error())
+		}
+		log.Printf("Started independent copy of snapshot %s of %s to %s (%s)", snap, amiId, c.destRegion, *resp.SnapshotId)
+		copies = append(copies, *resp.SnapshotId)
+	}
+	for _, snap := range copies {
+		if err := waitForSnapshot(ctx, awsec2dest, snap); err != nil {
+			return err
+		}
+	}
+	log.Printf("Copied %d snapshots of %s to %s independently", len(copies), amiId, c.destRegion)
+	return nil
+}
+
+// waitForSnapshot waits for a snapshot to reach the completed state
+func waitForSnapshot(ctx context.Context, awsec2 *ec2.Client, snapId string) error {
+	for {
+		if err := pause(ctx, apiPollInterval); err != nil {
+			return fmt.Errorf("Stopped waiting for snapshot %s: %s", snapId, err)
+		}
+		var resp *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapId}})
+			return err
+		})
+		if err != nil {
+			log.Printf("Error waiting for snapshot %s (trying again): %s", snapId, err.Error())
+			continue
+		}
+		for _, snapshot := range resp.Snapshots {
+			switch snapshot.State {
+			case types.SnapshotStateCompleted:
+				return nil
+			case types.SnapshotStateError:
+				return fmt.Errorf("copy to snapshot %s failed: %s", snapId, aws.ToString(snapshot.StateMessage))
+			case types.SnapshotStatePending, types.SnapshotStateRecoverable, types.SnapshotStateRecovering:
+				log.Printf("Waiting for %s snapshot copy %s (%s)", snapshot.State, snapId, aws.ToString(snapshot.Progress))
+			default:
+				unknownState("snapshot", string(snapshot.State), "waiting for it to complete")
+				log.Printf("Waiting for %s snapshot copy %s (%s)", snapshot.State, snapId, aws.ToString(snapshot.Progress))
+			}
+		}
+	}
+}
+
+// discardSourceTag marks a copy whose source AMI --discard-source-after-copy deregistered
+const discardSourceTag = "amibackup:source-discarded"
+
+// verifyCopy checks that a copy is available and has a snapshot for every device the source AMI
+// has, encrypted wherever the source's is - or everywhere, if encrypted says every copy made in
+// its region is (-e, or EBS encryption by default there)
+func verifyCopy(ctx context.Context, awsec2, awsec2dest *ec2.Client, sourceAMI, copyAMI string, encrypted bool) error {
+	var resp, source *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2dest, func() (err error) {
+		resp, err = awsec2dest.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{copyAMI}})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API DescribeImages failed for %s: %s", copyAMI, err.Error())
+	}
+	if len(resp.Images) != 1 || string(resp.Images[0].State) != "available" {
+		return fmt.Errorf("copy %s is not available", copyAMI)
+	}
+	err = withFreshCredentials(ctx, awsec2, func() (err error) {
+		source, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{sourceAMI}})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	sourceEncrypted := map[string]bool{} // device to whether its snapshot is encrypted
+	for _, image := range source.Images {
+		for _, bd := range image.BlockDeviceMappings {
+			if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+				sourceEncrypted[aws.ToString(bd.DeviceName)] = aws.ToBool(bd.Ebs.Encrypted)
+			}
+		}
+	}
+	copied := map[string]bool{} // device to whether its snapshot is encrypted
+	for _, bd := range resp.Images[0].BlockDeviceMappings {
+		if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+			copied[aws.ToString(bd.DeviceName)] = aws.ToBool(bd.Ebs.Encrypted)
+		}
+	}
+	for device, wasEncrypted := range sourceEncrypted {
+		isEncrypted, ok := copied[device]
+		switch {
+		case !ok:
+			return fmt.Errorf("copy %s has no snapshot for %s", copyAMI, device)
+		case !isEncrypted && (wasEncrypted || encrypted):
+			return fmt.Errorf("copy %s has an unencrypted snapshot for %s", copyAMI, device)
+		}
+	}
+	if len(copied) != len(sourceEncrypted) {
+		return fmt.Errorf("copy %s has %d snapshots, source %s has %d", copyAMI, len(copied), sourceAMI, len(sourceEncrypted))
+	}
+	return nil
+}
+
+// discardSource deregisters a source AMI and deletes its snapshots once its copy is verified,
+// for --discard-source-after-copy.  If the copy can't be verified the source is left alone.
+func discardSource(ctx context.Context, awsec2, awsec2dest *ec2.Client, c *Config, sourceAMI, copyAMI string) error {
+	if c.dryRun {
+		log.Printf("DRYRUN: would have verified the copy, then deregistered the source AMI in %s, deleted its snapshots and tagged the copy %s=true", c.sourceRegion, discardSourceTag)
+		return nil
+	}
+	if copyAMI == "" {
+		log.Printf("Not discarding source AMI %s - there is no copy", sourceAMI)
+		return nil
+	}
+	if err := verifyCopy(ctx, awsec2, awsec2dest, sourceAMI, copyAMI, c.copiesEncrypted(c.destRegion)); err != nil {
+		return classErrorf(classVerify, "keeping source AMI %s: %s", sourceAMI, err.Error())
+	}
+	err := withFreshCredentials(ctx, awsec2dest, func() error {
+		_, err := awsec2dest.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{copyAMI},
+			Tags:      []types.Tag{{Key: aws.String(discardSourceTag), Value: aws.String("true")}},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API CreateTags failed for %s: %s", copyAMI, err.Error())
+	}
+	if err := deregisterAMI(ctx, awsec2, sourceAMI, c); err != nil {
+		return err
+	}
+	log.Printf("Discarded source AMI %s in %s - copy %s in %s verified", sourceAMI, c.sourceRegion, copyAMI, c.destRegion)
+	return nil
+}
+
+// storeAMI archives an AMI to the --ami-store-bucket S3 bucket with the EC2 image store, and waits
+// for the store task to finish.  The image store names the object itself (<ami-id>.bin), so our
+// <prefix>/<hostname>/<timestamp>/<ami-id>/ path is recorded in the object's amibackup:path tag.
+func storeAMI(ctx context.Context, awsec2 *ec2.Client, c *Config, amiId, instanceNameTag string) error {
+	// escape the hostname so it's always exactly one path segment
+	path := fmt.Sprintf("%s/%s/%s/%s/", strings.Trim(c.amiStorePrefix, "/"), url.PathEscape(c.hostname(instanceNameTag)), timeStamp, amiId)
+	path = strings.TrimPrefix(path, "/")
+	if c.dryRun {
+		log.Printf("DRYRUN: would have stored AMI %s in s3://%s (%s)", amiId, c.amiStoreBucket, path)
+		return nil
+	}
+	var resp *ec2.CreateStoreImageTaskOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.CreateStoreImageTask(ctx, &ec2.CreateStoreImageTaskInput{
+			Bucket:  aws.String(c.amiStoreBucket),
+			ImageId: aws.String(amiId),
+			S3ObjectTags: []types.S3ObjectTag{
+				{Key: aws.String("amibackup:path"), Value: aws.String(path)},
+				{Key: aws.String(c.tagKey("hostname")), Value: aws.String(c.hostname(instanceNameTag))},
+				{Key: aws.String(c.tagKey("timestamp")), Value: aws.String(timeSecs)},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API CreateStoreImageTask failed for %s: %s", amiId, err.Error())
+	}
+	log.Printf("Storing AMI %s for %s in s3://%s/%s (%s)", amiId, instanceNameTag, c.amiStoreBucket, aws.ToString(resp.ObjectKey), path)
+	for {
+		var tasks *ec2.DescribeStoreImageTasksOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			tasks, err = awsec2.DescribeStoreImageTasks(ctx, &ec2.DescribeStoreImageTasksInput{ImageIds: []string{amiId}})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeStoreImageTasks failed for %s: %s", amiId, err.Error())
+		}
+		for _, task := range tasks.StoreImageTaskResults {
+			switch aws.ToString(task.StoreTaskState) {
+			case "Completed":
+				log.Printf("Stored AMI %s for %s in s3://%s/%s", amiId, instanceNameTag, c.amiStoreBucket, aws.ToString(task.S3objectKey))
+				return nil
+			case "Failed":
+				return fmt.Errorf("storing AMI %s failed: %s", amiId, aws.ToString(task.StoreTaskFailureReason))
+			case "InProgress":
+				log.Printf("Waiting for store of AMI %s for %s (%d%%)", amiId, instanceNameTag, aws.ToInt32(task.ProgressPercentage))
+			default:
+				unknownState("store task", aws.ToString(task.StoreTaskState), "waiting for it to finish")
+				log.Printf("Waiting for store of AMI %s for %s (%d%%)", amiId, instanceNameTag, aws.ToInt32(task.ProgressPercentage))
+			}
+		}
+		if err := pause(ctx, apiPollInterval); err != nil {
+			return fmt.Errorf("Stopped waiting for store of AMI %s: %s", amiId, err)
+		}
+	}
+}
+
+// purgeAMIs purges AMIs based on specified windows, returning the decision made for each AMI.
+// If guard is set, AMIs newer than it (the newest backup in the other region) are kept.
+func purgeAMIs(ctx context.Context, awsec2 *ec2.Client, regionName, instanceNameTag string, c *Config, guard *time.Time) ([]PurgeRecord, error) {
+	records := []PurgeRecord{}
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{}, instanceNameTag, c)
+	if err != nil {
+		return records, fmt.Errorf("EC2 API Images failed: %s", err.Error())
+	}
+	log.Printf("Found %d total images for %s in %s", len(resp.Images), instanceNameTag, regionName)
+	// AMIs can share snapshots, and a snapshot mustn't go while a kept AMI still needs it
+	refs := snapshotRefs(resp.Images)
+	for snap, amis := range refs {
+		if len(amis) > 1 {
+			log.Printf("Snapshot %s is shared by %d AMIs of %s in %s (%s) - it is deleted only with the last of them", snap, len(amis), instanceNameTag, regionName, strings.Join(amis, ", "))
+		}
+	}
+	deregistered := map[string]bool{}
+	images := map[string]time.Time{}
+	classImages := map[string]map[string]time.Time{} // by retention class
+	inProgress := []PurgeRecord{}
+	backups, skipped := discovery.Classify(resp.Images, c.tags())
+	discovery.LogSkipped(skipped)
+	for _, b := range backups {
+		if runID, ok := inFlight(b.Image, c); ok {
+			// another run is still making or copying it - it isn't a backup yet
+			log.Printf("Keeping AMI %s: still in progress in run %s", b.Id, runID)
+			inProgress = append(inProgress, PurgeRecord{instanceNameTag, regionName, b.Id, b.When, purge.Window{}, actionKeptInProgress, 0, "", ""})
+			continue
+		}
+		images[b.Id] = b.When
+		class := imageRetentionClass(b.Image, c)
+		if classImages[class] == nil {
+			classImages[class] = map[string]time.Time{}
+		}
+		classImages[class][b.Id] = b.When
+	}
+	// each retention class is planned on its own, by its own windows
+	classes := []string{}
+	for class := range classImages {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	purgeIds := []string{}
+	for _, class := range classes {
+		windows := c.classWindows(class)
+		for _, w := range windows {
+			log.Printf("Window%s: 1 per %s from %s-%s", classNote(class), w.Interval.String(), w.Start, w.Stop)
+		}
+		for _, o := range purge.Overlaps(windows) {
+			log.Printf("WARNING: purge windows%s 1 per %s and 1 per %s overlap from %s to %s - an image either keeps there is kept",
+				classNote(class), o.A.Interval, o.B.Interval, o.Start.Format(timeShortFormat), o.End.Format(timeShortFormat))
+		}
+		records = append(records, planPurge(instanceNameTag, regionName, class, windows, classImages[class])...)
+		ids, _ := purge.SelectForPurge(windows, classImages[class], false)
+		purgeIds = append(purgeIds, ids...)
+	}
+	if c.keepCount > 0 {
+		records, purgeIds = applyKeepCount(records, images, c)
+		for _, r := range keptByCount(records) {
+			log.Printf("Keeping AMI %s @ %s: among the newest %d (--keep-count)", r.AmiId, r.CreatedAt.Format(timeShortFormat), c.keepCount)
+		}
+	}
+	if len(inProgress) > 0 {
+		log.Printf("Skipped %d AMIs of %s in %s that other runs are still working on", len(inProgress), instanceNameTag, regionName)
+		records = append(records, inProgress...)
+	}
+	for _, r := range records {
+		if r.Action == actionKeptOldest {
+			log.Printf("Keeping oldest AMI in this window: %s @ %s (%s->%s)%s", r.AmiId, images[r.AmiId].Format(timeShortFormat), r.Window.Start.Format(timeShortFormat), r.Window.Stop.Format(timeShortFormat), classNote(r.Class))
+		}
+	}
+	// act on the first window's record for each AMI the windows purge
+	selected := map[string]bool{}
+	toPurge := []int{}
+	for _, id := range purgeIds {
+		guarded := guard != nil && images[id].After(*guard)
+		if guarded {
+			log.Printf("Keeping AMI %s @ %s: the other region has no available backup at least as new", id, images[id].Format(timeShortFormat))
+		}
+		for i, r := range records {
+			if r.AmiId != id || r.Action != actionPurged {
+				continue
+			}
+			if guarded {
+				records[i].Action = actionKeptGuard
+			} else if !selected[id] {
+				selected[id] = true
+				toPurge = append(toPurge, i)
+			}
+		}
+	}
+	if c.purgeOrder == "size" && len(toPurge) > 0 {
+		sizes, err := imageSnapshotSizes(ctx, awsec2, resp.Images, selected)
+		if err != nil {
+			return records, err
+		}
+		for _, i := range toPurge {
+			records[i].SizeGB = sizes[records[i].AmiId]
+		}
+		sort.SliceStable(toPurge, func(a, b int) bool { return records[toPurge[a]].SizeGB > records[toPurge[b]].SizeGB })
+	}
+	// the whole plan is known before anything is deleted, so a runaway plan can be stopped outright
+	if c.maxPurgePerHost > 0 && len(toPurge) > c.maxPurgePerHost && !c.confirmLargePurge {
+		log.Printf("WARNING: the plan purges %d AMIs of %s in %s, more than --max-purge-per-host=%d:", len(toPurge), instanceNameTag, regionName, c.maxPurgePerHost)
+		for _, i := range toPurge {
+			log.Printf("  %s @ %s%s", records[i].AmiId, records[i].CreatedAt.Format(timeShortFormat), decisionNote(records[i], c))
+		}
+		if c.dryRun {
+			log.Printf("DRYRUN: purge of %s in %s would stop here without --confirm-large-purge", instanceNameTag, regionName)
+		} else if !confirmLargePurge(instanceNameTag, regionName, len(toPurge)) {
+			log.Printf("Not purging %s in %s - rerun with --confirm-large-purge if the plan is right", instanceNameTag, regionName)
+			for _, i := range toPurge {
+				records[i].Action = actionKeptLarge
+			}
+			return records, nil
+		}
+	}
+	reclaimed := int64(0)
+	for n, i := range toPurge {
+		if c.maxPurge > 0 && n == c.maxPurge {
+			log.Printf("Hit max-purge limit of %d - stopping purge for this run", c.maxPurge)
+			for _, j := range toPurge[n:] {
+				records[j].Action = actionKeptLimit
+			}
+			break
+		}
+		r := records[i]
+		id := r.AmiId
+		if err := purgeImage(ctx, awsec2, id, refs, deregistered, c); err != nil {
+			// leave out the decisions we never got to act on
+			pending := map[int]bool{}
+			for _, j := range toPurge[n:] {
+				pending[j] = true
+			}
+			done := []PurgeRecord{}
+			for j, r := range records {
+				if !pending[j] {
+					done = append(done, r)
+				}
+			}
+			return done, err
+		}
+		if c.purgeOrder == "size" {
+			reclaimed += r.SizeGB
+			if !c.dryRun {
+				log.Printf("Reclaimed %d GB so far in %s (%s: %d GB)", reclaimed, regionName, id, r.SizeGB)
+			} else {
+				log.Printf("DRYRUN: would have reclaimed %d GB so far in %s (%s: %d GB)", reclaimed, regionName, id, r.SizeGB)
+			}
+		}
+		if !c.dryRun {
+			log.Printf("Purged old AMI %s @ %s%s", id, images[id].Format(timeShortFormat), decisionNote(r, c))
+		} else {
+			records[i].Action = actionWouldPurge
+			log.Printf("DRYRUN: would have purged old AMI %s @ %s%s", id, images[id].Format(timeShortFormat), decisionNote(r, c))
+		}
+	}
+	if c.purgeOrder == "size" {
+		log.Printf("Reclaimed %d GB of snapshots for %s in %s", reclaimed, instanceNameTag, regionName)
+	}
+	return records, nil
+}
+
+// imageSnapshotSizes returns the total snapshot size in GB of each wanted image, looking the
+// snapshots up in batches
+func imageSnapshotSizes(ctx context.Context, awsec2 *ec2.Client, images []types.Image, wanted map[string]bool) (map[string]int64, error) {
+	owners := map[string]string{}
+	snapshotIds := []string{}
+	for _, image := range images {
+		if !wanted[*image.ImageId] {
+			continue
+		}
+		for _, bd := range image.BlockDeviceMappings {
+			if bd.Ebs != nil && bd.Ebs.SnapshotId != nil {
+				owners[*bd.Ebs.SnapshotId] = *image.ImageId
+				snapshotIds = append(snapshotIds, *bd.Ebs.SnapshotId)
+			}
+		}
+	}
+	sizes := map[string]int64{}
+	for len(snapshotIds) > 0 {
+		batch := snapshotIds
+		if len(batch) > 200 {
+			batch = batch[:200]
+		}
+		snapshotIds = snapshotIds[len(batch):]
+		var resp *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: batch})
+			return err
+		})
+		if err != nil {
+			return sizes, fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+		}
+		for _, snapshot := range resp.Snapshots {
+			if snapshot.VolumeSize != nil {
+				sizes[owners[*snapshot.SnapshotId]] += int64(*snapshot.VolumeSize)
+			}
+		}
+	}
+	return sizes, nil
+}
+
+// newestAvailableBackup returns the time of the newest available backup of a host, or the zero time if there are none
+func newestAvailableBackup(ctx context.Context, awsec2 *ec2.Client, instanceNameTag string, c *Config) (time.Time, error) {
+	newest := time.Time{}
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{Filters: []types.Filter{
+		{Name: aws.String("state"), Values: []string{"available"}},
+	}}, instanceNameTag, c)
+	if err != nil {
+		return newest, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	for _, image := range resp.Images {
+		timestamp, err := strconv.ParseInt(c.backupTag(image.Tags, "timestamp"), 10, 64)
+		if err == nil && time.Unix(timestamp, 0).After(newest) {
+			newest = time.Unix(timestamp, 0)
+		}
+	}
+	return newest, nil
+}
+
+// confirmLargePurge asks whoever is at the terminal to confirm a purge over --max-purge-per-host.
+// Without a terminal there is nobody to ask, so the answer is no.
+func confirmLargePurge(instanceNameTag, regionName string, count int) bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Purge %d AMIs of %s in %s? Type yes to continue: ", count, instanceNameTag, regionName)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// newestBackupIn returns the time of the newest available backup of a host in any of the regions
+func newestBackupIn(ctx context.Context, clients *clientPool, regions []string, instanceNameTag string, c *Config) (time.Time, error) {
+	newest := time.Time{}
+	for _, region := range regions {
+		t, err := newestAvailableBackup(ctx, clients.EC2(region, ""), instanceNameTag, c)
+		if err != nil {
+			return newest, fmt.Errorf("in %s: %s", region, err.Error())
+		}
+		if t.After(newest) {
+			newest = t
+		}
+	}
+	return newest, nil
+}
+
+// needsRecovery reports whether a host's newest available backup in the dest regions is older
+// than --recover-sla (or missing), for --recover-failed
+func needsRecovery(ctx context.Context, clients *clientPool, regions []string, instanceNameTag string, c *Config) (bool, error) {
+	newest, err := newestBackupIn(ctx, clients, regions, instanceNameTag, c)
+	if err != nil {
+		return false, err
+	}
+	if newest.IsZero() {
+		log.Printf("RECOVERY: creating backup for %s (last backup: never)", instanceNameTag)
+		return true, nil
+	}
+	age := time.Since(newest)
+	if age <= c.recoverSLA {
+		log.Printf("Last backup of %s is %s old - within the SLA", instanceNameTag, age.Round(time.Minute))
+		return false, nil
+	}
+	log.Printf("RECOVERY: creating backup for %s (last backup: %s ago)", instanceNameTag, age.Round(time.Minute))
+	return true, nil
+}
+
+// planPurge decides the fate of every image: in each purge window interval the oldest image
+// is kept and the rest are purged, and images outside every window are kept.  Every window is
+// planned before any decision is final, as overlapping windows can disagree - and keep wins, as
+// in purge.SelectForPurge: a purge of an image another window keeps becomes KEPT_OVERLAP.  It
+// makes no AWS calls, so --simulate runs exactly the same logic.  class is the retention class
+// the windows belong to, "" for the -p windows.
+func planPurge(instanceNameTag, regionName, class string, windows []purge.Window, images map[string]time.Time) []PurgeRecord {
+	records := []PurgeRecord{}
+	considered := map[string]bool{}
+	keptByAny := purge.KeptByAny(windows, images, false)
+	for _, w := range windows {
+		for _, b := range w.Buckets(images) {
+			kept := b.Kept(false)
+			for _, id := range b.Images {
+				action := actionPurged
+				if len(b.Images) == 1 {
+					action = actionKeptOnly
+				} else if id == kept {
+					action = actionKeptOldest
+				} else if keptByAny[id] {
+					action = actionKeptOverlap
+				}
+				records = append(records, PurgeRecord{instanceNameTag, regionName, id, images[id], w, action, 0, class, ""})
+				considered[id] = true
+			}
+		}
+	}
+	outside := []string{}
+	for id := range images {
+		if !considered[id] {
+			outside = append(outside, id)
+		}
+	}
+	purge.SortByTime(outside, images)
+	for _, id := range outside {
+		records = append(records, PurgeRecord{instanceNameTag, regionName, id, images[id], purge.Window{}, actionKeptNoWindow, 0, class, ""})
+	}
+	return records
+}
+
+// simulatePurge runs the purge windows over a file of historical backup times (one Unix
+// timestamp per line) and writes the resulting decisions as a purge report
+func simulatePurge(file string, c *Config) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	images := map[string]time.Time{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s line %d: not a Unix timestamp: %s", file, n+1, line)
+		}
+		images[line] = time.Unix(timestamp, 0)
+	}
+	records := planPurge("simulation", "simulation", "", c.windows, images)
+	if c.keepCount > 0 {
+		records, _ = applyKeepCount(records, images, c)
+	}
+	purged := map[string]bool{}
+	for _, r := range records {
+		if r.Action == actionPurged {
+			purged[r.AmiId] = true
+		}
+	}
+	log.Printf("Simulated %d backups: %d survive, %d would be purged", len(images), len(images)-len(purged), len(purged))
+	if c.purgeReport != "" {
+		return writePurgeReport(c.purgeReport, records)
+	}
+	return writePurgeCSV(os.Stdout, records)
+}
+
+// writePurgeReport writes the purge decisions to a CSV file
+func writePurgeReport(path string, records []PurgeRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writePurgeCSV(f, records)
+}
+
+// writePurgeCSV writes the purge decisions as CSV
+func writePurgeCSV(out io.Writer, records []PurgeRecord) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"timestamp", "instance_tag", "region", "ami_id", "ami_created_at", "window_interval", "window_start", "window_stop", "action", "size_gb", "retention_class", "rule"})
+	for _, r := range records {
+		interval, start, stop := "", "", ""
+		if r.Window.Interval > 0 {
+			interval = r.Window.Interval.String()
+			start = r.Window.Start.Format(time.RFC3339)
+			stop = r.Window.Stop.Format(time.RFC3339)
+		}
+		size := ""
+		if r.SizeGB > 0 {
+			size = strconv.FormatInt(r.SizeGB, 10)
+		}
+		w.Write([]string{
+			timeSecs,
+			r.InstanceTag,
+			r.Region,
+			r.AmiId,
+			r.CreatedAt.Format(time.RFC3339),
+			interval,
+			start,
+			stop,
+			r.Action,
+			size,
+			r.Class,
+			r.Rule,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// canonicalPlan returns the purge decisions in a fixed order, whatever order the regions, AMIs
+// and windows were looked at in
+func canonicalPlan(records []PurgeRecord) []PurgeRecord {
+	sorted := append([]PurgeRecord{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		switch {
+		case a.InstanceTag != b.InstanceTag:
+			return a.InstanceTag < b.InstanceTag
+		case a.Region != b.Region:
+			return a.Region < b.Region
+		case !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.Before(b.CreatedAt)
+		case a.AmiId != b.AmiId:
+			return a.AmiId < b.AmiId
+		case !a.Window.Start.Equal(b.Window.Start):
+			return a.Window.Start.Before(b.Window.Start)
+		case a.Window.Interval != b.Window.Interval:
+			return a.Window.Interval < b.Window.Interval
+		}
+		return a.Action < b.Action
+	})
+	return sorted
+}
+
+// planHash returns the SHA-256 of the purge plan's JSON, for --plan-hash
+func planHash(records []PurgeRecord) (string, error) {
+	var plan bytes.Buffer
+	if err := writePurgeJSON(&plan, records); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(plan.Bytes())), nil
+}
+
+// purgePlanEntry is one purge decision in the JSON plan, with the same fields as the CSV report
+type purgePlanEntry struct {
+	InstanceTag    string `json:"instance_tag"`
+	Region         string `json:"region"`
+	AmiId          string `json:"ami_id"`
+	AmiCreatedAt   string `json:"ami_created_at"`
+	WindowInterval string `json:"window_interval,omitempty"`
+	WindowStart    string `json:"window_start,omitempty"`
+	WindowStop     string `json:"window_stop,omitempty"`
+	Action         string `json:"action"`
+	SizeGB         int64  `json:"size_gb,omitempty"`
+	RetentionClass string `json:"retention_class,omitempty"`
+	Rule           string `json:"rule,omitempty"`
+}
+
+// purgePlanEntries returns the purge decisions in canonical order with times in UTC, so the same
+// decisions always give the same JSON
+func purgePlanEntries(records []PurgeRecord) []purgePlanEntry {
+	plan := []purgePlanEntry{}
+	for _, r := range canonicalPlan(records) {
+		e := purgePlanEntry{InstanceTag: r.InstanceTag, Region: r.Region, AmiId: r.AmiId, AmiCreatedAt: r.CreatedAt.UTC().Format(time.RFC3339), Action: r.Action, SizeGB: r.SizeGB, RetentionClass: r.Class, Rule: r.Rule}
+		if r.Window.Interval > 0 {
+			e.WindowInterval = r.Window.Interval.String()
+			e.WindowStart = r.Window.Start.UTC().Format(time.RFC3339)
+			e.WindowStop = r.Window.Stop.UTC().Format(time.RFC3339)
+		}
+		plan = append(plan, e)
+	}
+	return plan
+}
+
+// writePurgeJSON writes the purge decisions as a JSON array
+func writePurgeJSON(out io.Writer, records []PurgeRecord) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(purgePlanEntries(records))
+}
+
+// printPartialPlan prints the purge decisions made before an interrupt, as text and JSON
+func printPartialPlan(out io.Writer, records []PurgeRecord) {
+	fmt.Fprintf(out, "Interrupted - partial plan follows (%d AMIs considered):\n", len(records))
+	for _, r := range records {
+		fmt.Fprintf(out, "  %-17s %s %s %s @ %s\n", r.Action, quoteField(r.InstanceTag), r.Region, r.AmiId, r.CreatedAt.Format(timeShortFormat))
+	}
+	if err := writePurgeJSON(out, records); err != nil {
+		log.Printf("Error writing partial plan: %s", err.Error())
+	}
+}
+
+// errorCode returns the AWS error code of an API error, or "" for any other error
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// withFreshCredentials runs an API call, and if AWS rejects it because the credentials
+// expired mid-run, forces a credential refresh and retries exactly once
+func withFreshCredentials(ctx context.Context, awsec2 *ec2.Client, call func() error) error {
+	err := call()
+	code := errorCode(err)
+	if !expiredCredentialCodes[code] {
+		return err
+	}
+	creds, ok := awsec2.Options().Credentials.(interface {
+		aws.CredentialsProvider
+		Invalidate()
+	})
+	if !ok {
+		return err
+	}
+	creds.Invalidate()
+	v, cerr := creds.Retrieve(ctx)
+	if cerr != nil {
+		return fmt.Errorf("%s (refreshing credentials failed: %s)", err.Error(), cerr.Error())
+	}
+	if v.Source == config.CredentialsSourceName || v.Source == credentials.StaticCredentialsName {
+		return fmt.Errorf("%s (credentials from %s cannot be refreshed - use an IAM role or ~/.aws/credentials for long runs)", err.Error(), v.Source)
+	}
+	if code == "RequestExpired" || code == "SignatureDoesNotMatch" {
+		log.Printf("AWS rejected request signature (%s) - check the system clock if this persists", code)
+	}
+	log.Printf("Credentials rejected (%s) - retrying once with refreshed credentials from %s", code, v.Source)
+	return call()
+}
+
+// handleOptions parses CLI options, falling back to the environment
+func handleOptions(args []string) (*Config, error) {
+	return parseOptions(resolveArgs(args))
+}
+
+// parseOptions builds the config from a command line that already has environment fallbacks applied
+func parseOptions(args []string, opts []usageOption, sources map[string]string) (*Config, error) {
+	c := Config{runID: newRunID(), races: new(atomic.Int64)}
+	// docopt prints the usage for -h, --version and bad arguments, leaving the exit to us
+	arguments, err := docopt.Parse(usage, args, true, version, false, false)
+	if err != nil {
+		return nil, classErrorf(classConfig, "Error parsing arguments: %s", err.Error())
+	}
+	if arguments == nil {
+		return nil, errDone
+	}
+	c.instanceNameTags = arguments["<instance_name_tag>"].([]string)
+	c.sourceRegion = arguments["--source"].(string)
+	for _, region := range arguments["--dest"].([]string) {
+		if !stringIn(region, c.dests) {
+			c.dests = append(c.dests, region)
+		}
+	}
+	c.destRegion = c.dests[0]
+	c.timeoutString = arguments["--timeout"].(string)
+	c.timeoutDefault = sources["timeout"] == "default"
+	c.timeout, err = time.ParseDuration(c.timeoutString)
+	if err != nil {
+		return nil, classErrorf(classConfig, "Invalid timeout: %s", arguments["--timeout"].(string))
+	}
+	c.notFoundGrace, err = time.ParseDuration(arguments["--not-found-grace"].(string))
+	if err != nil || c.notFoundGrace < 0 {
+		return nil, classErrorf(classConfig, "Invalid not-found-grace: %s", arguments["--not-found-grace"].(string))
+	}
+	c.pollStaleLimit, err = time.ParseDuration(arguments["--poll-stale-limit"].(string))
+	if err != nil || c.pollStaleLimit <= 0 {
+		return nil, classErrorf(classConfig, "Invalid poll-stale-limit: %s", arguments["--poll-stale-limit"].(string))
+	}
+	c.copyRetries, err = strconv.Atoi(arguments["--copy-retries"].(string))
+	if err != nil || c.copyRetries < 0 {
+		return nil, classErrorf(classConfig, "Invalid copy-retries: %s", arguments["--copy-retries"].(string))
+	}
+	c.pipelineRetries, err = strconv.Atoi(arguments["--pipeline-retries"].(string))
+	if err != nil || c.pipelineRetries < 0 {
+		return nil, classErrorf(classConfig, "Invalid pipeline-retries: %s", arguments["--pipeline-retries"].(string))
+	}
+	c.perAccountCopyLimit, err = strconv.Atoi(arguments["--per-account-copy-limit"].(string))
+	if err != nil || c.perAccountCopyLimit < 0 {
+		return nil, classErrorf(classConfig, "Invalid per-account-copy-limit: %s", arguments["--per-account-copy-limit"].(string))
+	}
+	c.maxPurge, err = strconv.Atoi(arguments["--max-purge"].(string))
+	if err != nil || c.maxPurge < 0 {
+		return nil, classErrorf(classConfig, "Invalid max-purge: %s", arguments["--max-purge"].(string))
+	}
+	c.maxPurgePerHost, err = strconv.Atoi(arguments["--max-purge-per-host"].(string))
+	if err != nil || c.maxPurgePerHost < 0 {
+		return nil, classErrorf(classConfig, "Invalid max-purge-per-host: %s", arguments["--max-purge-per-host"].(string))
+	}
+	c.confirmLargePurge = arguments["--confirm-large-purge"].(bool)
+	c.instanceStateTag = arguments["--instance-state-tag"].(bool)
+	c.tagInstance = arguments["--tag-instance"].(bool)
+	c.windowsPolicy = arguments["--windows-policy"].(string)
+	if c.windowsPolicy != "warn" && c.windowsPolicy != "ignore" && c.windowsPolicy != "vss" {
+		return nil, classErrorf(classConfig, "Invalid windows-policy: %s (want warn, ignore or vss)", c.windowsPolicy)
+	}
+	if arg, ok := arguments["--pre-freeze-ssm"].(string); ok {
+		c.preFreezeSSM = arg
+	}
+	if arg, ok := arguments["--post-thaw-ssm"].(string); ok {
+		c.postThawSSM = arg
+	}
+	for _, v := range arguments["--ssm-parameter"].([]string) {
+		key, value, err := parseSSMParameter(v)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid ssm-parameter: %s (%s)", v, err.Error())
+		}
+		if c.ssmParameters == nil {
+			c.ssmParameters = map[string][]string{}
+		}
+		c.ssmParameters[key] = append(c.ssmParameters[key], value)
+	}
+	if c.ssmParameters != nil && c.preFreezeSSM == "" && c.postThawSSM == "" {
+		return nil, classErrorf(classConfig, "--ssm-parameter requires --pre-freeze-ssm or --post-thaw-ssm")
+	}
+	c.verifyLarge = arguments["--verify-large-snapshots"].(bool)
+	c.noWait = arguments["--no-wait"].(bool)
+	if arg, ok := arguments["--ami-store-bucket"].(string); ok {
+		c.amiStoreBucket = arg
+		if c.noWait {
+			return nil, classErrorf(classConfig, "--ami-store-bucket can't be used with --no-wait")
+		}
+	}
+	c.amiStorePrefix = arguments["--ami-store-prefix"].(string)
+	c.discardSource = arguments["--discard-source-after-copy"].(bool)
+	c.descTemplate, err = template.New("description").Option("missingkey=zero").Parse(arguments["--description-template"].(string))
+	if err == nil {
+		// catch unknown fields now rather than after the first instance is snapshotted
+		err = c.descTemplate.Execute(ioutil.Discard, descriptionData{Tags: map[string]string{}})
+	}
+	if err != nil {
+		return nil, classErrorf(classConfig, "Invalid description-template: %s", err.Error())
+	}
+	c.waitSnapshots = arguments["--wait-snapshots"].(bool)
+	if c.waitSnapshots && c.noWait {
+		return nil, classErrorf(classConfig, "--wait-snapshots can't be used with --no-wait")
+	}
+	c.copySnapshots = arguments["--copy-snapshots-independently"].(bool)
+	if c.copySnapshots && c.noWait {
+		return nil, classErrorf(classConfig, "--copy-snapshots-independently can't be used with --no-wait")
+	}
+	if c.discardSource && c.noWait {
+		return nil, classErrorf(classConfig, "--discard-source-after-copy can't be used with --no-wait")
+	}
+	c.overwriteSnapName = arguments["--overwrite-snapshot-name"].(bool)
+	c.tagEarly = arguments["--tag-snapshots-early"].(bool)
+	c.dedupByContent = arguments["--dedup-by-content"].(bool)
+	c.progress = arguments["--progress"].(bool) || (isTerminal(os.Stdout) && !arguments["--no-progress"].(bool))
+	if arguments["--progress"].(bool) && arguments["--no-progress"].(bool) {
+		return nil, classErrorf(classConfig, "--progress and --no-progress can't be used together")
+	}
+	if arg, ok := arguments["--progress-file"].(string); ok {
+		c.progressFile = arg
+	}
+	if arg, ok := arguments["--checkpoint-file"].(string); ok {
+		c.checkpointFile = arg
+	}
+	c.purgeOrder = arguments["--purge-order"].(string)
+	if c.purgeOrder != "time" && c.purgeOrder != "size" {
+		return nil, classErrorf(classConfig, "Invalid purge-order: %s (want time or size)", c.purgeOrder)
+	}
+	snapshotRate, err := strconv.ParseFloat(arguments["--rate-limit-snapshots"].(string), 64)
+	if err != nil || snapshotRate < 0 {
+		return nil, classErrorf(classConfig, "Invalid rate-limit-snapshots: %s", arguments["--rate-limit-snapshots"].(string))
+	}
+	if snapshotRate > 0 {
+		c.snapshotLimiter = rate.NewLimiter(rate.Limit(snapshotRate), 1)
+	}
+	c.cleanupFailedCopies = arguments["--cleanup-failed-copies"].(bool)
+	c.freeze, _, err = parseFreeze(arguments["--freeze"].(string), time.Now())
+	if err != nil || strings.Contains(arguments["--freeze"].(string), " until ") {
+		return nil, classErrorf(classConfig, "Invalid freeze: %s (want none, purge or all)", arguments["--freeze"].(string))
+	}
+	c.freezeSource = "--freeze"
+	if c.freezeParameter = arguments["--freeze-parameter"].(string); c.freezeParameter == "none" {
+		c.freezeParameter = ""
+	}
+	if arg, ok := arguments["--latest-parameter"].(string); ok {
+		if !strings.HasPrefix(arg, "/") {
+			return nil, classErrorf(classConfig, "Invalid latest-parameter: %s (want a path, e.g. /amibackup/latest)", arg)
+		}
+		c.latestParameter = arg
+	}
+	if c.gcReferences = arguments["--gc-references"].(bool); c.gcReferences && c.latestParameter == "" {
+		return nil, classErrorf(classConfig, "--gc-references needs --latest-parameter")
+	}
+	if arg, ok := arguments["--backup-vault"].(string); ok {
+		c.backupVault = arg
+		if c.backupRoleArn, ok = arguments["--backup-role-arn"].(string); !ok {
+			return nil, classErrorf(classConfig, "--backup-vault needs --backup-role-arn")
+		}
+	}
+	if arg, ok := arguments["--copy-billing-tags"].(string); ok {
+		for _, key := range strings.Split(arg, ",") {
+			key = strings.TrimSpace(key)
+			if key == "Name" || strings.HasPrefix(key, "aws:") {
+				return nil, classErrorf(classConfig, "Invalid copy-billing-tags: %s can't be copied", key)
+			}
+			if key != "" && !stringIn(key, c.billingTags) {
+				c.billingTags = append(c.billingTags, key)
+			}
+		}
+	}
+	c.reencrypt = arguments["--reencrypt"].(bool)
+	reencryptRate, err := strconv.ParseFloat(arguments["--reencrypt-rate"].(string), 64)
+	if err != nil || reencryptRate < 0 {
+		return nil, classErrorf(classConfig, "Invalid reencrypt-rate: %s", arguments["--reencrypt-rate"].(string))
+	}
+	c.reencryptLimiter = rate.NewLimiter(rate.Inf, 1)
+	if reencryptRate > 0 {
+		c.reencryptLimiter = rate.NewLimiter(rate.Limit(reencryptRate/3600), 1)
+	}
+	c.minKeep, err = strconv.Atoi(arguments["--min-keep"].(string))
+	if err != nil || c.minKeep < 0 {
+		return nil, classErrorf(classConfig, "Invalid min-keep: %s", arguments["--min-keep"].(string))
+	}
+	if arg, ok := arguments["--mutate-role-arn"].(string); ok {
+		if !strings.HasPrefix(arg, "arn:") || !strings.Contains(arg, ":role/") {
+			return nil, classErrorf(classConfig, "Invalid mutate-role-arn: %s (want an IAM role ARN)", arg)
+		}
+		c.mutateRoleArn = arg
+	}
+	if arg, ok := arguments["--endpoint-url"].(string); ok {
+		c.endpointURL = arg
+	}
+	if arg, ok := arguments["--otel-endpoint"].(string); ok {
+		c.otelEndpoint = arg
+	}
+	if arg, ok := arguments["--purge-report"].(string); ok {
+		c.purgeReport = arg
+	}
+	if arg, ok := arguments["--max-gap"].(string); ok {
+		converted, err := purge.DaysToHours(arg)
+		if err == nil {
+			c.maxGap, err = time.ParseDuration(converted)
+		}
+		if err != nil || c.maxGap <= 0 {
+			return nil, classErrorf(classConfig, "Invalid max-gap: %s", arg)
+		}
+	}
+	c.gapReport = arguments["--gap-report"].(bool)
+	if c.gapReport && c.maxGap == 0 {
+		return nil, classErrorf(classConfig, "--gap-report requires --max-gap")
+	}
+	if arg, ok := arguments["--deadline"].(string); ok {
+		if c.deadline, err = parseDeadline(arg, time.Now()); err != nil {
+			return nil, classErrorf(classConfig, "Invalid deadline: %s (%s)", arg, err.Error())
+		}
+	}
+	if arg, ok := arguments["--priority-tag"].(string); ok {
+		c.priorityTag = arg
+	}
+	c.maxNewGB, err = strconv.ParseInt(arguments["--max-new-gb"].(string), 10, 64)
+	if err != nil || c.maxNewGB < 0 {
+		return nil, classErrorf(classConfig, "Invalid max-new-gb: %s", arguments["--max-new-gb"].(string))
+	}
+	if arg, ok := arguments["--metrics-file"].(string); ok {
+		c.metricsFile = arg
+	}
+	if arg, ok := arguments["--cloudwatch-namespace"].(string); ok {
+		c.cloudWatchNamespace = arg
+	}
+	if arg, ok := arguments["--summary-s3"].(string); ok {
+		if c.summaryS3Bucket, c.summaryS3Prefix, err = parseS3URL(arg); err != nil {
+			return nil, classErrorf(classConfig, "Invalid summary-s3: %s", err.Error())
+		}
+	}
+	if arg, ok := arguments["--summary-s3-kms"].(string); ok {
+		if c.summaryS3Bucket == "" {
+			return nil, classErrorf(classConfig, "--summary-s3-kms requires --summary-s3")
+		}
+		c.summaryS3KMS = arg
+	}
+	if arg, ok := arguments["--simulate"].(string); ok {
+		c.simulate = arg
+	}
+	c.crossRegionGuard = !arguments["--no-cross-region-guard"].(bool)
+	if arguments["--purgeonly"].(bool) {
+		c.purgeonly = true
+	}
+	c.recoverFailed = arguments["--recover-failed"].(bool)
+	c.recoverSLA, err = time.ParseDuration(arguments["--recover-sla"].(string))
+	if err != nil {
+		return nil, classErrorf(classConfig, "Invalid recover-sla: %s", arguments["--recover-sla"].(string))
+	}
+	if arguments["--dry-run"].(bool) {
+		c.dryRun = true
+	}
+	c.debug = arguments["--debug"].(bool)
+	c.caseInsensitive = arguments["--case-insensitive"].(bool)
+	c.auditTags = arguments["--audit-tags"].(bool)
+	c.validateTags = arguments["--validate-tags"].(bool)
+	c.coverageReport = arguments["--coverage-report"].(bool)
+	c.coverageGroupTag = arguments["--coverage-group-tag"].(string)
+	converted, err := purge.DaysToHours(arguments["--coverage-max-age"].(string))
+	if err == nil {
+		c.coverageMaxAge, err = time.ParseDuration(converted)
+	}
+	if err != nil || c.coverageMaxAge <= 0 {
+		return nil, classErrorf(classConfig, "Invalid coverage-max-age: %s", arguments["--coverage-max-age"].(string))
+	}
+	c.coverageFormat = arguments["--coverage-format"].(string)
+	if c.coverageFormat != "table" && c.coverageFormat != "json" {
+		return nil, classErrorf(classConfig, "Invalid coverage-format: %s", c.coverageFormat)
+	}
+	if arg, ok := arguments["--coverage-csv"].(string); ok {
+		c.coverageCSV = arg
+	}
+	c.failOnUncovered = arguments["--fail-on-uncovered"].(bool)
+	if (c.coverageCSV != "" || c.failOnUncovered) && !c.coverageReport {
+		return nil, classErrorf(classConfig, "--coverage-csv and --fail-on-uncovered need --coverage-report")
+	}
+	c.retag = arguments["--retag"].(bool)
+	c.retagRemoveOld = arguments["--remove-old"].(bool)
+	c.retagAddPrefix = arguments["--add-prefix"].(bool)
+	for _, r := range arguments["--rename-tag"].([]string) {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, classErrorf(classConfig, "Malformed rename-tag (want old:new): %s", r)
+		}
+		c.retagRenames = append(c.retagRenames, [2]string{parts[0], parts[1]})
+	}
+	for _, a := range arguments["--add-tag"].([]string) {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, classErrorf(classConfig, "Malformed add-tag (want key=value): %s", a)
+		}
+		c.retagAdds = append(c.retagAdds, [2]string{parts[0], parts[1]})
+	}
+	if !c.retag && (len(c.retagRenames) > 0 || len(c.retagAdds) > 0 || c.retagRemoveOld || c.retagAddPrefix) {
+		return nil, classErrorf(classConfig, "--rename-tag, --add-tag, --add-prefix and --remove-old require --retag")
+	}
+	c.noReconcile = arguments["--no-reconcile"].(bool)
+	c.incompleteMaxAge, err = time.ParseDuration(arguments["--incomplete-max-age"].(string))
+	if err != nil {
+		return nil, classErrorf(classConfig, "Invalid incomplete-max-age: %s", arguments["--incomplete-max-age"].(string))
+	}
+	converted, err = purge.DaysToHours(arguments["--in-progress-stale"].(string))
+	if err == nil {
+		c.inProgressStale, err = time.ParseDuration(converted)
+	}
+	if err != nil || c.inProgressStale <= 0 {
+		return nil, classErrorf(classConfig, "Invalid in-progress-stale: %s", arguments["--in-progress-stale"].(string))
+	}
+	c.fixTags = arguments["--fix-tags"].(bool)
+	if c.fixTags && !c.validateTags {
+		return nil, classErrorf(classConfig, "--fix-tags requires --validate-tags")
+	}
+	c.normalize = arguments["--normalize"].(string)
+	if c.normalize != "lower" && c.normalize != "preserve" {
+		return nil, classErrorf(classConfig, "Invalid --normalize mode: %s (must be lower or preserve)", c.normalize)
+	}
+	if arg, ok := arguments["--tag-prefix"].(string); ok {
+		c.tagPrefix = arg
+	}
+	c.legacyTags = arguments["--legacy-tags"].(bool) || arguments["--also-read-unprefixed"].(bool)
+	if c.legacyTags && c.tagPrefix == "" {
+		return nil, classErrorf(classConfig, "--legacy-tags (--also-read-unprefixed) needs --tag-prefix")
+	}
+	if c.retagAddPrefix {
+		if c.tagPrefix == "" {
+			return nil, classErrorf(classConfig, "--add-prefix needs --tag-prefix")
+		}
+		for _, name := range backupTagNames {
+			c.retagRenames = append(c.retagRenames, [2]string{name, c.tagKey(name)})
+		}
+	}
+	if c.retagRemoveOld {
+		// deleting a key runs read backups by - the hostname above all - would orphan every backup
+		for _, rename := range c.retagRenames {
+			for _, name := range backupTagNames {
+				if rename[0] == c.tagKey(name) {
+					return nil, classErrorf(classConfig, "--remove-old would delete %s, the %s tag backups are found and read by - move backup tags with --tag-prefix and --add-prefix instead", rename[0], name)
+				}
+			}
+		}
+	}
+	if arg, ok := arguments["--dest-map"].(string); ok {
+		c.destMap, err = loadDestMap(arg)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid dest-map: %s", err.Error())
+		}
+		c.classificationTag, _ = arguments["--classification-tag"].(string)
+		if c.classificationTag == "" {
+			return nil, classErrorf(classConfig, "--dest-map needs --classification-tag")
+		}
+		if len(c.dests) > 1 {
+			return nil, classErrorf(classConfig, "--dest-map can't be used with more than one --dest")
+		}
+		if opt, ok := singleDestOption(arguments); ok {
+			return nil, classErrorf(classConfig, "%s can't be used with --dest-map", opt)
+		}
+	} else if arguments["--classification-tag"] != nil {
+		return nil, classErrorf(classConfig, "--classification-tag needs --dest-map")
+	}
+	if opt, ok := singleDestOption(arguments); ok && len(c.dests) > 1 {
+		return nil, classErrorf(classConfig, "%s can't be used with more than one --dest", opt)
+	}
+	if arg, ok := arguments["--require-policy-tag"].(string); ok {
+		c.policyTag = arg
+	}
+	if arg, ok := arguments["--allowed-policies"].(string); ok {
+		if c.policyTag == "" {
+			return nil, classErrorf(classConfig, "--allowed-policies needs --require-policy-tag")
+		}
+		for _, policy := range strings.Split(arg, ",") {
+			if policy = strings.TrimSpace(policy); policy != "" {
+				c.allowedPolicies = append(c.allowedPolicies, policy)
+			}
+		}
+	}
+	switch arguments["--policy-enforcement"].(string) {
+	case "enforce":
+	case "warn":
+		c.policyWarnOnly = true
+	default:
+		return nil, classErrorf(classConfig, "Invalid policy-enforcement: %s (want enforce or warn)", arguments["--policy-enforcement"].(string))
+	}
+	if arguments["--encrypted"].(bool) || arguments["--kms-key-id"] != nil { // TODO: can i cast that into a bool?
+		c.encrypted = true
+		if arguments["--kms-key-id"] != nil {
+			if !strings.Contains(arguments["--kms-key-id"].(string), c.destRegion) {
+				return nil, classErrorf(classConfig, "kms-key-id does not reside in destination.")
+			}
+			c.kmsKeyId = arguments["--kms-key-id"].(string)
+		}
+	}
+	if arg, ok := arguments["--kms-key-alias"].(string); ok {
+		if c.kmsKeyId != "" {
+			return nil, classErrorf(classConfig, "--kms-key-id and --kms-key-alias can't be used together")
+		}
+		c.kmsKeyAlias = arg
+		c.encrypted = true
+	}
+	c.asOf = time.Now()
+	if arg, ok := arguments["--as-of"].(string); ok {
+		c.asOf, err = parseAsOf(arg)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid as-of: %s (%s)", arg, err.Error())
+		}
+	}
+	c.planHash = arguments["--plan-hash"].(bool)
+	if arg, ok := arguments["--plan"].(string); ok {
+		if !c.dryRun {
+			return nil, classErrorf(classConfig, "--plan needs --dry-run")
+		}
+		c.planFile = arg
+		c.plan = newRunPlan()
+	}
+	for _, w := range arguments["--purge"].([]string) {
+		newWindow, err := purge.ParseWindow(w, c.asOf)
+		if err != nil {
+			return nil, classify(classConfig, err)
+		}
+		c.windows = append(c.windows, newWindow)
+	}
+	if retention := arguments["--retention"].([]string); len(retention) > 0 {
+		if len(c.windows) > 0 {
+			log.Printf("WARNING: both --purge and --retention given - purging by all of them combined")
+		}
+		windows, err := purge.ParseRetentionPolicy(retention, c.asOf)
+		if err != nil {
+			return nil, classify(classConfig, err)
+		}
+		c.windows = append(c.windows, windows...)
+	}
+	c.retentionClassTag = arguments["--retention-class-tag"].(string)
+	c.purgeSpec = fmt.Sprintf("%q %q %q %q", arguments["--purge"], arguments["--retention"], arguments["--retention-class"], c.retentionClassTag)
+	if arg, ok := arguments["--purge-cache"].(string); ok {
+		c.purgeCache, err = loadPurgeCache(arg)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid purge-cache: %s", err.Error())
+		}
+	}
+	c.forcePurgeScan = arguments["--force-purge-scan"].(bool)
+	for _, v := range arguments["--retention-class"].([]string) {
+		name, windows, err := parseRetentionClass(v, c.asOf)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid retention-class: %s (%s)", v, err.Error())
+		}
+		if c.retentionClasses == nil {
+			c.retentionClasses = map[string][]purge.Window{}
+		}
+		if _, dup := c.retentionClasses[name]; dup {
+			return nil, classErrorf(classConfig, "Invalid retention-class: %s is defined twice", name)
+		}
+		c.retentionClasses[name] = windows
+	}
+	if arg, ok := arguments["--keep-count"].(string); ok {
+		c.keepCount, err = strconv.Atoi(arg)
+		if err != nil || c.keepCount < 1 {
+			return nil, classErrorf(classConfig, "Invalid keep-count: %s", arg)
+		}
+		c.purgeSpec += fmt.Sprintf(" keep-count=%d", c.keepCount)
+	}
+	c.combineRetention = arguments["--combine-retention"].(bool)
+	windowed := len(c.windows) > 0 || len(c.retentionClasses) > 0
+	switch {
+	case c.keepCount > 0 && windowed && !c.combineRetention:
+		return nil, classErrorf(classConfig, "--keep-count replaces -p, --retention and --retention-class - add --combine-retention to keep what either keeps")
+	case c.combineRetention && (c.keepCount == 0 || !windowed):
+		return nil, classErrorf(classConfig, "--combine-retention needs --keep-count and -p, --retention or --retention-class")
+	}
+	if c.maxGap > 0 && !c.purging() {
+		return nil, classErrorf(classConfig, "--max-gap is measured by the purge, so needs -p, --retention, --retention-class or --keep-count")
+	}
+
+	for _, v := range arguments["--ignore"].([]string) {
+		c.ignoreVolumes = append(c.ignoreVolumes, v)
+	}
+	if arg, ok := arguments["--only-devices"].(string); ok {
+		for _, device := range strings.Split(arg, ",") {
+			if device = strings.TrimSpace(device); device != "" {
+				c.onlyDevices = append(c.onlyDevices, device)
+			}
+		}
+		if len(c.onlyDevices) == 0 {
+			return nil, classErrorf(classConfig, "Invalid only-devices: %s", arg)
+		}
+	}
+	if arg, ok := arguments["--shard"].(string); ok {
+		if c.shard, err = parseShard(arg); err != nil {
+			return nil, classErrorf(classConfig, "Invalid shard: %s (%s)", arg, err.Error())
+		}
+	}
+	c.unprotectedOKSpec = arguments["--unprotected-ok-tag"].(string)
+	c.unprotectedOK, err = parseTagMatch(c.unprotectedOKSpec)
+	if err != nil {
+		return nil, classErrorf(classConfig, "Invalid unprotected-ok-tag: %s (%s)", c.unprotectedOKSpec, err.Error())
+	}
+	c.strictUnprotected = arguments["--strict-unprotected"].(bool)
+	c.strictKMS = arguments["--strict-kms"].(bool)
+	for _, v := range arguments["--exclude-tag"].([]string) {
+		m, err := parseTagMatch(v)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid exclude-tag: %s (%s)", v, err.Error())
+		}
+		c.excludeTags = append(c.excludeTags, m)
+	}
+	if arg, ok := arguments["--instances-from"].(string); ok {
+		listed, err := loadInstanceList(arg)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Error reading --instances-from: %s", err.Error())
+		}
+		c.instancesFrom = arg
+		given := len(c.instanceNameTags)
+		c.instanceNameTags = mergeInstanceNames(c.instanceNameTags, listed)
+		log.Printf("Loaded %d instance name tags from %s (%d given as arguments, %d in total after removing duplicates)", len(listed), arg, given, len(c.instanceNameTags))
+	}
+	c.instanceIds = map[string]bool{}
+	c.filteredNames = map[string]bool{}
+	for _, v := range arguments["--filter-tag"].([]string) {
+		m, err := parseTagMatch(v)
+		if err != nil {
+			return nil, classErrorf(classConfig, "Invalid filter-tag: %s (%s)", v, err.Error())
+		}
+		c.filterTags = append(c.filterTags, m)
+	}
+	for _, id := range arguments["--instance-id"].([]string) {
+		if !instanceIdPattern.MatchString(id) {
+			return nil, classErrorf(classConfig, "Invalid instance-id: %s", id)
+		}
+		c.instanceIds[id] = true
+		c.instanceNameTags = mergeInstanceNames(c.instanceNameTags, []string{id})
+	}
+	if arguments["--generate-iam-policy"].(bool) {
+		// the policy doesn't depend on which hosts are backed up
+		if err := writeIAMPolicy(os.Stdout, &c); err != nil {
+			return nil, classErrorf(classInternal, "Error writing IAM policy: %s", err.Error())
+		}
+		return nil, errDone
+	}
+	if len(c.instanceNameTags) == 0 && len(c.filterTags) == 0 && c.simulate == "" && !c.coverageReport {
+		return nil, classErrorf(classConfig, "No instance name tags given - list them as arguments, with --instances-from, --instance-id or --filter-tag")
+	}
+	if c.checkpointFile != "" && (c.dryRun || c.purgeonly || c.simulate != "" || c.auditTags || c.validateTags || c.retag) {
+		return nil, classErrorf(classConfig, "--checkpoint-file only applies to runs that create backups or --reencrypt")
+	}
+	if c.reencrypt && c.kmsKeyId == "" && c.kmsKeyAlias == "" {
+		return nil, classErrorf(classConfig, "--reencrypt needs the new key as -k or --kms-key-alias")
+	}
+	if arguments["--print-config"].(bool) {
+		printConfig(os.Stdout, opts, arguments, sources)
+		return nil, errDone
+	}
+	return &c, nil
+}
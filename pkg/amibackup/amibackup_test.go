@@ -0,0 +1,903 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// image returns an available AMI using the snapshots given
+func image(id string, snaps ...string) types.Image {
+	img := types.Image{ImageId: aws.String(id), State: types.ImageStateAvailable}
+	for i, snap := range snaps {
+		img.BlockDeviceMappings = append(img.BlockDeviceMappings, types.BlockDeviceMapping{
+			DeviceName: aws.String("/dev/sd" + string(rune('a'+i))),
+			Ebs:        &types.EbsBlockDevice{SnapshotId: aws.String(snap)},
+		})
+	}
+	return img
+}
+
+func TestDeregisterAMIKeepsSharedSnapshots(t *testing.T) {
+	purged := image("ami-purged", "snap-shared", "snap-own")
+	kept := image("ami-kept", "snap-shared")
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			if len(input.(*ec2.DescribeImagesInput).ImageIds) > 0 {
+				return &ec2.DescribeImagesOutput{Images: []types.Image{purged}}, nil
+			}
+			return &ec2.DescribeImagesOutput{Images: []types.Image{purged, kept}}, nil
+		},
+		"DeregisterImage": func(interface{}) (interface{}, error) { return &ec2.DeregisterImageOutput{}, nil },
+		"DeleteSnapshot":  func(interface{}) (interface{}, error) { return &ec2.DeleteSnapshotOutput{}, nil },
+	})
+	if err := deregisterAMI(context.Background(), f.Client, "ami-purged", &Config{}); err != nil {
+		t.Fatalf("deregisterAMI: %s", err)
+	}
+	deleted := []string{}
+	for _, in := range f.inputs("DeleteSnapshot") {
+		deleted = append(deleted, aws.ToString(in.(*ec2.DeleteSnapshotInput).SnapshotId))
+	}
+	if !reflect.DeepEqual(deleted, []string{"snap-own"}) {
+		t.Errorf("deleted %v, want just snap-own - snap-shared is still used by ami-kept", deleted)
+	}
+	if n := f.count("DeregisterImage"); n != 1 {
+		t.Errorf("DeregisterImage called %d times, want 1", n)
+	}
+}
+
+func TestReleasedSnapshots(t *testing.T) {
+	refs := snapshotRefs([]types.Image{
+		image("ami-old", "snap-shared", "snap-old"),
+		image("ami-kept", "snap-shared"),
+	})
+	released, inUse := releasedSnapshots("ami-old", refs, map[string]bool{"ami-old": true})
+	if !reflect.DeepEqual(released, []string{"snap-old"}) {
+		t.Errorf("released = %v, want [snap-old]", released)
+	}
+	if !reflect.DeepEqual(inUse, map[string][]string{"snap-shared": {"ami-kept"}}) {
+		t.Errorf("inUse = %v, want snap-shared used by ami-kept", inUse)
+	}
+	// once the kept image goes too, the shared snapshot goes with it
+	released, _ = releasedSnapshots("ami-kept", refs, map[string]bool{"ami-old": true, "ami-kept": true})
+	if !reflect.DeepEqual(released, []string{"snap-shared"}) {
+		t.Errorf("released = %v, want [snap-shared]", released)
+	}
+}
+
+func TestAMINamePrefix(t *testing.T) {
+	for _, name := range []string{"web01", "web_01", "db-1.example.com", "(x) [y] @z/'w'"} {
+		if got := amiNamePrefix(name); got != name {
+			t.Errorf("amiNamePrefix(%q) = %q, want it unchanged", name, got)
+		}
+	}
+	if a, b := amiNamePrefix("web,01"), amiNamePrefix("web_01"); a == b {
+		t.Errorf("web,01 and web_01 share the prefix %q", a)
+	}
+	if got := amiNamePrefix("web,01"); !strings.HasPrefix(got, "web_01_") {
+		t.Errorf("amiNamePrefix(web,01) = %q, want web_01_<hash>", got)
+	}
+	long := strings.Repeat("a", 200)
+	if got := amiNamePrefix(long); len(got) != amiNamePrefixMax || got == amiNamePrefix(long+"b") {
+		t.Errorf("amiNamePrefix of a 200 character name = %q", got)
+	}
+}
+
+// checkAMIName checks that a backup AMI name made from a Name tag is one AWS accepts, and that
+// parseBackupName reads it back
+func checkAMIName(t *testing.T, name string) {
+	prefix := amiNamePrefix(name)
+	if amiNameUnsafe.MatchString(prefix) {
+		t.Errorf("amiNamePrefix(%q) = %q has characters AWS rejects", name, prefix)
+	}
+	when := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	copyName := prefix + "-" + when.Format("2006-01-02_15-04-05") + "-ami-0123456789abcdef0-ap-southeast-4"
+	if len(copyName) > 128 {
+		t.Errorf("copy name %q is %d characters, over AWS's 128", copyName, len(copyName))
+	}
+	created, suffix, ok := parseBackupName(copyName, prefix)
+	if !ok || !created.Equal(when) || suffix != "ami-0123456789abcdef0-ap-southeast-4" {
+		t.Errorf("parseBackupName(%q) = %s, %q, %v", copyName, created, suffix, ok)
+	}
+}
+
+func FuzzAMINamePrefix(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"web,01", "web_01"},
+		{"web 01", "web\t01"},
+		{"db\"quoted\"", "db_quoted_"},
+		{strings.Repeat("x", 130), strings.Repeat("x", 131)},
+		{"", "_"},
+		{"ホスト", "___"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		checkAMIName(t, a)
+		checkAMIName(t, b)
+		if a != b && amiNamePrefix(a) == amiNamePrefix(b) {
+			t.Errorf("%q and %q share the prefix %q", a, b, amiNamePrefix(a))
+		}
+	})
+}
+
+func FuzzQuoteField(f *testing.F) {
+	for _, seed := range []string{"web01", "web 01", "", "tab\there", "new\nline", `"quoted"`, "ホスト", "\xff"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		// the name is one field of its line: bare and without spaces, or a Go string that ends
+		// where the quoting does and unquotes to the name
+		q := quoteField(s)
+		if q == s {
+			if fields := strings.Fields("purge " + q + " us-east-1"); len(fields) != 3 || fields[1] != q {
+				t.Errorf("quoteField(%q) = %s, splitting into %q", s, q, fields)
+			}
+			return
+		}
+		if field, err := strconv.QuotedPrefix(q + " us-east-1"); err != nil || field != q {
+			t.Errorf("quoteField(%q) = %s, reading back as %s, %v", s, q, field, err)
+		}
+		if got, err := strconv.Unquote(q); err != nil || got != s || strings.ContainsAny(q, "\t\n\r") {
+			t.Errorf("quoteField(%q) = %s, unquoting to %q, %v", s, q, got, err)
+		}
+	})
+}
+
+// storeTaskIn answers DescribeStoreImageTasks with one task in a state
+func storeTaskIn(state string) fakeCall {
+	return func(interface{}) (interface{}, error) {
+		return &ec2.DescribeStoreImageTasksOutput{StoreImageTaskResults: []types.StoreImageTaskResult{{StoreTaskState: aws.String(state)}}}, nil
+	}
+}
+
+func TestStoreAMIPath(t *testing.T) {
+	fastPolls(t)
+	for _, name := range []string{"web01", "web/01", "../../etc", "web 01?x=1#y", "%2F"} {
+		c, err := parseTestOptions("--ami-store-bucket=backups", "--ami-store-prefix=/nightly/", name)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		f := newFakeEC2(t, map[string]fakeCall{
+			"CreateStoreImageTask": func(interface{}) (interface{}, error) {
+				return &ec2.CreateStoreImageTaskOutput{ObjectKey: aws.String("ami-1.bin")}, nil
+			},
+			"DescribeStoreImageTasks": script(storeTaskIn("InProgress"), storeTaskIn("Completed")),
+		})
+		if err := storeAMI(context.Background(), f.Client, c, "ami-1", name); err != nil {
+			t.Fatalf("storeAMI(%q): %s", name, err)
+		}
+		in := f.inputs("CreateStoreImageTask")[0].(*ec2.CreateStoreImageTaskInput)
+		path := aws.ToString(in.S3ObjectTags[0].Value)
+		// the hostname is always one segment, between the prefix and the timestamp
+		segments := strings.Split(path, "/")
+		if len(segments) != 5 || segments[0] != "nightly" || segments[3] != "ami-1" || segments[4] != "" {
+			t.Errorf("%q is stored under %s", name, path)
+		}
+		if host, err := url.PathUnescape(segments[1]); err != nil || host != name {
+			t.Errorf("%q is stored under %s, unescaping to %q", name, path, host)
+		}
+	}
+}
+
+// parseTestOptions parses a command line as amibackup would, without the environment
+func parseTestOptions(args ...string) (*Config, error) {
+	return parseOptions(args, parseUsageOptions(usage), map[string]string{})
+}
+
+func TestRetagRemoveOld(t *testing.T) {
+	tests := []struct {
+		args    []string
+		refused bool
+	}{
+		{[]string{"--retag", "--rename-tag=hostname:host", "--remove-old", "web"}, true},
+		{[]string{"--retag", "--rename-tag=timestamp:ts", "--remove-old", "web"}, true},
+		{[]string{"--retag", "--rename-tag=Owner:owner", "--remove-old", "web"}, false},
+		{[]string{"--retag", "--rename-tag=hostname:host", "web"}, false},
+		{[]string{"--retag", "--tag-prefix=amibackup:", "--add-prefix", "--remove-old", "web"}, false},
+		{[]string{"--retag", "--tag-prefix=bk-", "--rename-tag=bk-hostname:host", "--remove-old", "web"}, true},
+	}
+	for _, tt := range tests {
+		_, err := parseTestOptions(tt.args...)
+		refused := err != nil && strings.Contains(err.Error(), "--remove-old would delete")
+		if refused != tt.refused {
+			t.Errorf("%q: refused = %v (%v), want %v", tt.args, refused, err, tt.refused)
+		}
+	}
+}
+
+func TestFindSnapshotsFreshCredentials(t *testing.T) {
+	retrieved := 0
+	creds := aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		retrieved++
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", Source: "AssumeRoleProvider"}, nil
+	}))
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": script(
+			func(interface{}) (interface{}, error) { return nil, apiError("ExpiredToken") },
+			func(interface{}) (interface{}, error) {
+				return &ec2.DescribeImagesOutput{Images: []types.Image{image("ami-1", "snap-1")}}, nil
+			},
+		),
+	}, func(o *ec2.Options) { o.Credentials = creds })
+	snaps, err := findSnapshots(context.Background(), "ami-1", f.Client)
+	if err != nil {
+		t.Fatalf("findSnapshots: %s", err)
+	}
+	if len(snaps) != 1 || f.count("DescribeImages") != 2 || retrieved != 1 {
+		t.Errorf("got %v after %d calls and %d credential refreshes, want snap-1 after 2 and 1", snaps, f.count("DescribeImages"), retrieved)
+	}
+}
+
+// TestWaitForAMIFreshCredentials checks that a wait outlives its credentials: the poll AWS rejects
+// is retried once with refreshed ones, and the wait goes on
+func TestWaitForAMIFreshCredentials(t *testing.T) {
+	fastPolls(t)
+	retrieved := 0
+	creds := aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		retrieved++
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", Source: "AssumeRoleProvider"}, nil
+	}))
+	img := image("ami-new", "snap-1")
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": script(
+			imageIn(img, "pending"),
+			func(interface{}) (interface{}, error) { return nil, apiError("ExpiredToken") },
+			imageIn(img, "pending"),
+			imageIn(img, "available"),
+		),
+	}, func(o *ec2.Options) { o.Credentials = creds })
+	c := &Config{notFoundGrace: time.Minute, pollStaleLimit: time.Minute}
+	if err := waitForAMI(context.Background(), f.Client, "ami-new", "web", "i-1", false, c); err != nil {
+		t.Fatalf("waitForAMI: %s", err)
+	}
+	if n := f.count("DescribeImages"); n != 4 || retrieved != 1 {
+		t.Errorf("wait ended after %d polls and %d credential refreshes, want 4 and 1", n, retrieved)
+	}
+}
+
+func TestWaitForAMINotFound(t *testing.T) {
+	fastPolls(t)
+	img := image("ami-new", "snap-1")
+	tests := []struct {
+		name    string
+		answers []fakeCall
+		wantErr string
+	}{
+		{"visible late", []fakeCall{noImages, noImages, imageIn(img, "pending"), imageIn(img, "available")}, ""},
+		{"never visible", []fakeCall{noImages}, "still not found"},
+		{"disappeared", []fakeCall{imageIn(img, "pending"), noImages}, "disappeared while pending"},
+		{"failed", []fakeCall{noImages, imageIn(img, "failed")}, "is failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": script(tt.answers...)})
+			c := &Config{notFoundGrace: 50 * time.Millisecond, pollStaleLimit: time.Minute}
+			err := waitForAMI(context.Background(), f.Client, "ami-new", "web", "i-1", false, c)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("waitForAMI: %s", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("waitForAMI = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// twiceDaily returns n backups, one every 12 hours up to asOf, by AMI ID
+func twiceDaily(asOf time.Time, n int) map[string]time.Time {
+	images := map[string]time.Time{}
+	for i := 0; i < n; i++ {
+		images[fmt.Sprintf("ami-%03d", i)] = asOf.Add(-time.Duration(i) * 12 * time.Hour)
+	}
+	return images
+}
+
+func TestPlanHashStable(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	images := twiceDaily(asOf, 120)
+	hash := func(windows ...string) string {
+		args := []string{"--as-of=" + asOf.Format(time.RFC3339)}
+		for _, w := range windows {
+			args = append(args, "-p", w)
+		}
+		c, err := parseTestOptions(append(args, "web")...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		records := []PurgeRecord{}
+		for _, region := range []string{"us-west-1", "us-east-1"} {
+			records = append(records, planPurge("web", region, "", c.windows, images)...)
+		}
+		// the regions and AMIs in whatever order the run met them
+		rand.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+		h, err := planHash(records)
+		if err != nil {
+			t.Fatalf("planHash: %s", err)
+		}
+		return h
+	}
+	want := hash("1d:4d:30d", "7d:30d:90d")
+	for i := 0; i < 20; i++ {
+		// each run ranges over the images map in a new order, and starts at a new time
+		if got := hash("1d:4d:30d", "7d:30d:90d"); got != want {
+			t.Fatalf("run %d hashed the same plan as %s, want %s", i, got, want)
+		}
+	}
+	if hash("7d:30d:90d", "1d:4d:30d") != want {
+		t.Errorf("listing the windows in another order changed the hash")
+	}
+	if hash("1d:4d:30d", "7d:40d:90d") == want {
+		t.Errorf("changing a window left the hash the same")
+	}
+}
+
+// backupImages returns a host's backups taken at the times given, tagged as amibackup tags them
+func backupImages(hostname string, times map[string]time.Time) []types.Image {
+	images := []types.Image{}
+	for id, when := range times {
+		img := image(hostname+"-"+id, "snap-"+hostname+"-"+id)
+		img.Tags = []types.Tag{
+			{Key: aws.String("hostname"), Value: aws.String(hostname)},
+			{Key: aws.String("timestamp"), Value: aws.String(fmt.Sprint(when.Unix()))},
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+func TestDryRunPurgeInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	asked := []string{} // the hosts whose backups the purge listed
+	f := newFakeAWS(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			hostname := ""
+			for _, filter := range input.(*ec2.DescribeImagesInput).Filters {
+				if aws.ToString(filter.Name) != "tag:hostname" {
+					// resumePending, with nothing pending or copying
+					return &ec2.DescribeImagesOutput{}, nil
+				}
+				hostname = filter.Values[0]
+			}
+			asked = append(asked, hostname)
+			// Ctrl-C while the first host is planned
+			cancel()
+			return &ec2.DescribeImagesOutput{Images: backupImages(hostname, twiceDaily(time.Now(), 20))}, nil
+		},
+	})
+	fakeClients(t, f)
+	c, err := parseTestOptions("--dry-run", "--purgeonly", "-p", "1d:4d:30d", "--source=us-east-1", "--dest=us-west-2",
+		"--no-cross-region-guard", "--freeze-parameter=none", "--no-reconcile", "web", "db", "cache")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	_, err = run(ctx, c)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if err != errInterrupted {
+		t.Errorf("run = %v, want errInterrupted", err)
+	}
+	if strings.Join(asked, ",") != "web" {
+		t.Errorf("purge listed the backups of %v after the interrupt, want just web", asked)
+	}
+	text, plan, found := strings.Cut(string(out), "\n[")
+	if !found || !strings.HasPrefix(text, "Interrupted - partial plan follows") {
+		t.Fatalf("no partial plan on stdout:\n%s", out)
+	}
+	entries := []purgePlanEntry{}
+	if err := json.Unmarshal([]byte("["+plan), &entries); err != nil {
+		t.Fatalf("partial plan isn't JSON: %s\n%s", err, out)
+	}
+	if len(entries) == 0 || !strings.Contains(text, "WOULD_PURGE") {
+		t.Errorf("partial plan has no decisions for web:\n%s", out)
+	}
+	for _, e := range entries {
+		if e.InstanceTag != "web" || e.Region != "us-east-1" {
+			t.Errorf("partial plan has %s in %s, planned after the interrupt", e.InstanceTag, e.Region)
+		}
+	}
+}
+
+// TestPurgeCutOff checks that a real purge cut off by --timeout reports the AMIs it did deregister,
+// rather than printing them as a partial dry-run plan
+func TestPurgeCutOff(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	deregistered := []string{}
+	runFake(t, map[string]func(fakeCall) fakeCall{
+		"DescribeImages": func(fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				filters := input.(*ec2.DescribeImagesInput).Filters
+				if len(filters) != 1 || aws.ToString(filters[0].Name) != "tag:hostname" {
+					// resumePending, with nothing pending or copying
+					return &ec2.DescribeImagesOutput{}, nil
+				}
+				return &ec2.DescribeImagesOutput{Images: backupImages(filters[0].Values[0], twiceDaily(time.Now(), 20))}, nil
+			}
+		},
+		"DeregisterImage": func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				// the timeout comes after the second deregistration
+				if len(deregistered) == 2 {
+					cancel(errTimeout)
+					return nil, context.Cause(ctx)
+				}
+				deregistered = append(deregistered, aws.ToString(input.(*ec2.DeregisterImageInput).ImageId))
+				return next(input)
+			}
+		},
+	})
+	report := filepath.Join(t.TempDir(), "purge.csv")
+	c, err := parseTestOptions("--purgeonly", "-p", "1d:4d:30d", "--source=us-east-1", "--dest=us-west-2", "--purge-report="+report,
+		"--no-cross-region-guard", "--freeze-parameter=none", "--no-reconcile", "web", "db")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	_, err = run(ctx, c)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if err != errTimeout {
+		t.Errorf("run = %v, want errTimeout", err)
+	}
+	if strings.Contains(string(out), "partial plan") {
+		t.Errorf("real purge printed a partial plan:\n%s", out)
+	}
+	b, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("no purge report: %s", err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatalf("purge report isn't CSV: %s", err)
+	}
+	purged := []string{}
+	for _, row := range rows[1:] {
+		if row[8] == actionPurged {
+			purged = append(purged, row[3])
+		}
+	}
+	if len(deregistered) < 2 || !reflect.DeepEqual(purged, deregistered) {
+		t.Errorf("report lists %v purged, want the AMIs deregistered before the timeout %v", purged, deregistered)
+	}
+}
+
+func TestUsageOptions(t *testing.T) {
+	tests := []struct {
+		args  []string
+		check func(c *Config) bool
+	}{
+		{[]string{"web"}, func(c *Config) bool {
+			return c.unprotectedOK == tagMatch{key: "backup", value: "excluded-ok"} && !c.strictUnprotected && !c.overwriteSnapName
+		}},
+		// -i is repeatable, and each use is one volume
+		{[]string{"-i", "/data", "--ignore=/scratch", "--strict-unprotected", "web"}, func(c *Config) bool {
+			return reflect.DeepEqual(c.ignoreVolumes, []string{"/data", "/scratch"}) && c.strictUnprotected
+		}},
+		{[]string{"--only-devices=/dev/xvda, /dev/sdf", "--unprotected-ok-tag=Ephemeral", "web"}, func(c *Config) bool {
+			return reflect.DeepEqual(c.onlyDevices, []string{"/dev/xvda", "/dev/sdf"}) && c.unprotectedOK == tagMatch{key: "Ephemeral", any: true}
+		}},
+		{[]string{"--overwrite-snapshot-name", "web", "db"}, func(c *Config) bool {
+			return c.overwriteSnapName && reflect.DeepEqual(c.instanceNameTags, []string{"web", "db"})
+		}},
+	}
+	for _, tt := range tests {
+		c, err := parseTestOptions(tt.args...)
+		if err != nil {
+			t.Errorf("%q: %s", tt.args, err)
+			continue
+		}
+		if !tt.check(c) {
+			t.Errorf("%q parsed to %+v", tt.args, c)
+		}
+	}
+}
+
+func TestSnapshotTags(t *testing.T) {
+	at := time.Date(2026, 3, 1, 2, 30, 0, 0, time.UTC)
+	amiTags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String("web-2026-03-01_02-30-00")},
+		{Key: aws.String("hostname"), Value: aws.String("web")},
+		{Key: aws.String("timestamp"), Value: aws.String(fmt.Sprintf("%d", at.Unix()))},
+	}
+	stamp, _, _ := backupTimes(time.Unix(at.Unix(), 0))
+	hint := "web//dev/sdf/" + stamp
+	name := "web /dev/sdf " + time.Unix(at.Unix(), 0).Format("2006-01-02 15:04")
+	named := []types.Tag{{Key: aws.String("Name"), Value: aws.String("postgres data")}}
+	tests := []struct {
+		snapTags  []types.Tag
+		overwrite bool
+		wantName  string
+	}{
+		{nil, false, name},
+		// someone named this snapshot, so leave it
+		{named, false, ""},
+		{named, true, name},
+	}
+	for _, tt := range tests {
+		args := []string{"web"}
+		if tt.overwrite {
+			args = append([]string{"--overwrite-snapshot-name"}, args...)
+		}
+		c, err := parseTestOptions(args...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		tags := snapshotTags(amiTags, tt.snapTags, "/dev/sdf", c)
+		got := map[string]string{}
+		for _, tag := range tags {
+			if _, dup := got[*tag.Key]; dup {
+				t.Errorf("%s tagged twice", *tag.Key)
+			}
+			got[*tag.Key] = *tag.Value
+		}
+		if got[restoreHintTag] != hint || got["hostname"] != "web" {
+			t.Errorf("snapshot tagged %v, want the AMI's tags and restore hint %s", got, hint)
+		}
+		if got["Name"] != tt.wantName {
+			t.Errorf("snapshot named %q over %v with overwrite %v, want %q", got["Name"], tt.snapTags, tt.overwrite, tt.wantName)
+		}
+	}
+}
+
+func TestCleanupFailedCopies(t *testing.T) {
+	failed := func(id, name, hostname string, state types.ImageState, snaps ...string) types.Image {
+		img := image(id, snaps...)
+		img.Name, img.State = aws.String(name), state
+		if hostname != "" {
+			img.Tags = []types.Tag{{Key: aws.String("hostname"), Value: aws.String(hostname)}}
+		}
+		return img
+	}
+	images := []types.Image{
+		failed("ami-tagged", "web-2026-03-01_02-30-00-ami-1-us-west-2", "web", types.ImageStateFailed, "snap-tagged"),
+		// failed before it was tagged, leaving a snapshot it never attached
+		failed("ami-untagged", "web-2026-03-02_02-30-00-ami-2-us-west-2", "", types.ImageStateError),
+		failed("ami-ok", "web-2026-03-03_02-30-00-ami-3-us-west-2", "web", types.ImageStateAvailable, "snap-ok"),
+		failed("ami-db", "db-2026-03-01_02-30-00-ami-4-us-west-2", "db", types.ImageStateFailed, "snap-db"),
+		failed("ami-webserver", "webserver-2026-03-01_02-30-00-ami-5-us-west-2", "", types.ImageStateFailed),
+	}
+	orphans := []types.Snapshot{
+		{SnapshotId: aws.String("snap-orphan"), Description: aws.String("Copied for DestinationAmi ami-untagged from SourceAmi ami-2")},
+		{SnapshotId: aws.String("snap-other"), Description: aws.String("Copied for DestinationAmi ami-ok from SourceAmi ami-3")},
+	}
+	for _, dryRun := range []bool{false, true} {
+		f := newFakeEC2(t, map[string]fakeCall{
+			"DescribeImages": func(input interface{}) (interface{}, error) {
+				out := &ec2.DescribeImagesOutput{}
+				for _, img := range images {
+					matches := true
+					for _, filter := range input.(*ec2.DescribeImagesInput).Filters {
+						switch name := aws.ToString(filter.Name); name {
+						case "state":
+							matches = matches && stringIn(string(img.State), filter.Values)
+						case "name":
+							matches = matches && strings.HasPrefix(aws.ToString(img.Name), strings.TrimSuffix(filter.Values[0], "*"))
+						default:
+							key, ok := strings.CutPrefix(name, "tag:")
+							matches = matches && ok && stringIn(discovery.TagValue(img.Tags, key), filter.Values)
+						}
+					}
+					if matches {
+						out.Images = append(out.Images, img)
+					}
+				}
+				return out, nil
+			},
+			"DescribeSnapshots": func(input interface{}) (interface{}, error) {
+				id := strings.Trim(input.(*ec2.DescribeSnapshotsInput).Filters[0].Values[0], "*")
+				out := &ec2.DescribeSnapshotsOutput{}
+				for _, snap := range orphans {
+					if strings.Contains(aws.ToString(snap.Description), id) {
+						out.Snapshots = append(out.Snapshots, snap)
+					}
+				}
+				return out, nil
+			},
+			"DeregisterImage": func(interface{}) (interface{}, error) { return &ec2.DeregisterImageOutput{}, nil },
+			"DeleteSnapshot":  func(interface{}) (interface{}, error) { return &ec2.DeleteSnapshotOutput{}, nil },
+		})
+		args := []string{"--cleanup-failed-copies", "--dest=us-west-2", "web"}
+		if dryRun {
+			args = append([]string{"--dry-run"}, args...)
+		}
+		c, err := parseTestOptions(args...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		cleaned, err := cleanupFailedCopies(context.Background(), f.Client, "us-west-2", "web", c)
+		if err != nil {
+			t.Fatalf("cleanupFailedCopies: %s", err)
+		}
+		if want := []string{"ami-tagged", "ami-untagged"}; !reflect.DeepEqual(cleaned, want) {
+			t.Errorf("dry run %v: cleaned up %v, want %v", dryRun, cleaned, want)
+		}
+		deregistered, deleted := []string{}, []string{}
+		for _, in := range f.inputs("DeregisterImage") {
+			deregistered = append(deregistered, aws.ToString(in.(*ec2.DeregisterImageInput).ImageId))
+		}
+		for _, in := range f.inputs("DeleteSnapshot") {
+			deleted = append(deleted, aws.ToString(in.(*ec2.DeleteSnapshotInput).SnapshotId))
+		}
+		wantDeregistered, wantDeleted := []string{"ami-tagged", "ami-untagged"}, []string{"snap-tagged", "snap-orphan"}
+		if dryRun {
+			wantDeregistered, wantDeleted = []string{}, []string{}
+		}
+		if !reflect.DeepEqual(deregistered, wantDeregistered) || !reflect.DeepEqual(deleted, wantDeleted) {
+			t.Errorf("dry run %v: deregistered %v and deleted %v, want %v and %v", dryRun, deregistered, deleted, wantDeregistered, wantDeleted)
+		}
+	}
+}
+
+func TestCopyBillingTags(t *testing.T) {
+	fastPolls(t)
+	f := runFake(t, map[string]func(fakeCall) fakeCall{
+		"DescribeInstances": func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				out, err := next(input)
+				for _, r := range out.(*ec2.DescribeInstancesOutput).Reservations {
+					r.Instances[0].Tags = append(r.Instances[0].Tags,
+						types.Tag{Key: aws.String("CostCenter"), Value: aws.String("cc-42")},
+						types.Tag{Key: aws.String("Project"), Value: aws.String("atlas")},
+						types.Tag{Key: aws.String("Owner"), Value: aws.String("ops")})
+				}
+				return out, err
+			}
+		},
+	}, "web")
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+		"--no-reconcile", "--no-progress", "--copy-billing-tags=CostCenter, Project,Team", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	if _, err := run(context.Background(), c); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	tagged := map[string][]types.Tag{} // by resource
+	for _, in := range f.inputs("CreateTags") {
+		for _, id := range in.(*ec2.CreateTagsInput).Resources {
+			tagged[id] = append(tagged[id], in.(*ec2.CreateTagsInput).Tags...)
+		}
+	}
+	// the source AMI and its copy
+	if len(tagged) != 2 {
+		t.Errorf("tagged %d AMIs, want 2", len(tagged))
+	}
+	for id, tags := range tagged {
+		// the instance has no Team tag, and Owner isn't asked for
+		if discovery.TagValue(tags, "CostCenter") != "cc-42" || discovery.TagValue(tags, "Project") != "atlas" ||
+			discovery.TagValue(tags, "Team") != "" || discovery.TagValue(tags, "Owner") != "" {
+			t.Errorf("%s tagged %s, want CostCenter and Project copied from the instance", id, tagString(tags))
+		}
+		// and snapshots take their AMI's tags
+		if snapTags := snapshotTags(tags, nil, "/dev/xvda", c); discovery.TagValue(snapTags, "CostCenter") != "cc-42" {
+			t.Errorf("snapshots of %s would be tagged %s, without CostCenter", id, tagString(snapTags))
+		}
+	}
+
+	for _, arg := range []string{"--copy-billing-tags=CostCenter,Name", "--copy-billing-tags=aws:cloudformation:stack-name"} {
+		if _, err := parseTestOptions(arg, "web"); classOf(err, classInternal) != classConfig {
+			t.Errorf("parseOptions(%s) = %v, want a config error", arg, err)
+		}
+	}
+}
+
+// tagString formats tags as key=value pairs, for failure messages
+func tagString(tags []types.Tag) string {
+	pairs := []string{}
+	for _, tag := range tags {
+		pairs = append(pairs, aws.ToString(tag.Key)+"="+aws.ToString(tag.Value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func TestCreateAMI(t *testing.T) {
+	fastPolls(t)
+	instance := &types.Instance{InstanceId: aws.String("i-1")}
+	for _, duplicate := range []bool{false, true} {
+		c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "web")
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		f := newFakeEC2(t, map[string]fakeCall{
+			"CreateImage": func(interface{}) (interface{}, error) {
+				if duplicate {
+					// an interrupted run's image, by the same name
+					return nil, apiError("InvalidAMIName.Duplicate")
+				}
+				return &ec2.CreateImageOutput{ImageId: aws.String("ami-new")}, nil
+			},
+			"DescribeImages": imageIn(image("ami-new", "snap-1"), types.ImageStateAvailable),
+			"CreateTags":     func(interface{}) (interface{}, error) { return &ec2.CreateTagsOutput{}, nil },
+		})
+		amiId, err := createAMI(context.Background(), f.Client, instance, c, "web")
+		if err != nil || amiId != "ami-new" {
+			t.Fatalf("duplicate %v: createAMI = %q, %v; want ami-new", duplicate, amiId, err)
+		}
+		in := f.inputs("CreateImage")[0].(*ec2.CreateImageInput)
+		if aws.ToString(in.InstanceId) != "i-1" || !aws.ToBool(in.NoReboot) || !strings.HasPrefix(aws.ToString(in.Name), amiNamePrefix("web")+"-") {
+			t.Errorf("CreateImage(%s, %s, NoReboot %v)", aws.ToString(in.InstanceId), aws.ToString(in.Name), aws.ToBool(in.NoReboot))
+		}
+		tags := f.inputs("CreateTags")
+		if len(tags) != 1 || !reflect.DeepEqual(tags[0].(*ec2.CreateTagsInput).Resources, []string{"ami-new"}) ||
+			discovery.TagValue(tags[0].(*ec2.CreateTagsInput).Tags, "hostname") != "web" {
+			t.Errorf("duplicate %v: CreateTags(%v), want the new AMI tagged as web's backup", duplicate, tags)
+		}
+	}
+}
+
+func TestStartCopy(t *testing.T) {
+	start, max := copyRetryStart, copyRetryMax
+	copyRetryStart, copyRetryMax = time.Millisecond, 3*time.Millisecond
+	t.Cleanup(func() { copyRetryStart, copyRetryMax = start, max })
+	limited := func(interface{}) (interface{}, error) { return nil, apiError("CopyLimitExceeded") }
+	copied := func(interface{}) (interface{}, error) {
+		return &ec2.CopyImageOutput{ImageId: aws.String("ami-copy")}, nil
+	}
+	tests := []struct {
+		name      string
+		retries   string
+		answers   []fakeCall
+		wantCalls int
+		wantErr   bool
+		backoffs  []string // the waits logged before each retry
+	}{
+		// the wait doubles up to its cap
+		{"limit then copied", "10", []fakeCall{limited, limited, limited, limited, copied}, 5, false, []string{"1ms", "2ms", "3ms", "3ms"}},
+		{"out of retries", "2", []fakeCall{limited}, 3, true, []string{"1ms", "2ms"}},
+		{"other error", "10", []fakeCall{func(interface{}) (interface{}, error) { return nil, apiError("InvalidRequest") }}, 1, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+			c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--copy-retries="+tt.retries, "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			f := newFakeEC2(t, map[string]fakeCall{"CopyImage": script(tt.answers...)})
+			resp, err := startCopy(context.Background(), f.Client, &ec2.CopyImageInput{SourceImageId: aws.String("ami-1")}, c)
+			if (err != nil) != tt.wantErr || f.count("CopyImage") != tt.wantCalls {
+				t.Fatalf("startCopy = %v after %d calls, want an error %v after %d", err, f.count("CopyImage"), tt.wantErr, tt.wantCalls)
+			}
+			if !tt.wantErr && aws.ToString(resp.ImageId) != "ami-copy" {
+				t.Errorf("startCopy copied to %s, want ami-copy", aws.ToString(resp.ImageId))
+			}
+			backoffs := []string{}
+			for _, line := range strings.Split(out.String(), "\n") {
+				if _, rest, ok := strings.Cut(line, "retrying copy of ami-1 in "); ok {
+					backoffs = append(backoffs, strings.Fields(rest)[0])
+				}
+			}
+			if fmt.Sprint(backoffs) != fmt.Sprint(tt.backoffs) {
+				t.Errorf("waited %v between tries, want %v", backoffs, tt.backoffs)
+			}
+		})
+	}
+}
+
+func TestCopyAMI(t *testing.T) {
+	fastPolls(t)
+	instance := &types.Instance{InstanceId: aws.String("i-1")}
+	created := time.Date(2026, 3, 1, 2, 30, 0, 0, time.UTC)
+	key := "arn:aws:kms:us-west-2:123456789012:key/backup"
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "-k", key, "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"CopyImage": func(interface{}) (interface{}, error) {
+			return &ec2.CopyImageOutput{ImageId: aws.String("ami-copy")}, nil
+		},
+		"DescribeImages": imageIn(image("ami-copy", "snap-1"), types.ImageStateAvailable),
+		"CreateTags":     func(interface{}) (interface{}, error) { return &ec2.CreateTagsOutput{}, nil },
+	})
+	copyId, err := copyAMI(context.Background(), f.Client, c, "ami-new", instance, "web", created)
+	if err != nil || copyId != "ami-copy" {
+		t.Fatalf("copyAMI = %q, %v; want ami-copy", copyId, err)
+	}
+	in := f.inputs("CopyImage")[0].(*ec2.CopyImageInput)
+	if aws.ToString(in.SourceRegion) != "us-east-1" || aws.ToString(in.SourceImageId) != "ami-new" || !strings.HasSuffix(aws.ToString(in.Name), "-ami-new-us-west-2") ||
+		aws.ToString(in.ClientToken) == "" || !aws.ToBool(in.Encrypted) || aws.ToString(in.KmsKeyId) != key {
+		t.Errorf("CopyImage(%+v)", *in)
+	}
+	tags := f.inputs("CreateTags")
+	if len(tags) != 1 || discovery.TagValue(tags[0].(*ec2.CreateTagsInput).Tags, "sourceregion") != "us-east-1" {
+		t.Errorf("CreateTags(%v), want the copy tagged with its source region", tags)
+	}
+
+	// nothing to copy within a region
+	c, err = parseTestOptions("--source=us-east-1", "--dest=us-east-1", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f = newFakeEC2(t, map[string]fakeCall{})
+	if copyId, err := copyAMI(context.Background(), f.Client, c, "ami-new", instance, "web", created); copyId != "" || err != nil {
+		t.Errorf("copyAMI in one region = %q, %v; want nothing copied", copyId, err)
+	}
+}
+
+func TestFindInstances(t *testing.T) {
+	captureLog(t)
+	named := func(id, name string) types.Instance {
+		return types.Instance{InstanceId: aws.String(id), Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}}
+	}
+	pages := []*ec2.DescribeInstancesOutput{
+		{Reservations: []types.Reservation{{Instances: []types.Instance{named("i-1", "web"), named("i-2", "Web")}}}, NextToken: aws.String("page-2")},
+		{Reservations: []types.Reservation{{Instances: []types.Instance{named("i-3", "web"), {Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String("web")}}}}}}},
+	}
+	tests := []struct {
+		args       []string
+		wantFilter string
+		want       []string
+	}{
+		// EC2 matches the tag, so every instance it returns is one; a page without NextToken is the last
+		{nil, "tag:Name", []string{"i-1", "i-2", "i-3"}},
+		{[]string{"--case-insensitive"}, "tag-key", []string{"i-1", "i-2", "i-3"}},
+	}
+	for _, tt := range tests {
+		c, err := parseTestOptions(append(tt.args, "web")...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		f := newFakeEC2(t, map[string]fakeCall{"DescribeInstances": func(input interface{}) (interface{}, error) {
+			in := input.(*ec2.DescribeInstancesInput)
+			if aws.ToString(in.NextToken) == "page-2" {
+				return pages[1], nil
+			}
+			if aws.ToString(in.Filters[0].Name) == "tag-key" {
+				// every named instance, for us to match
+				return &ec2.DescribeInstancesOutput{Reservations: append([]types.Reservation{{Instances: []types.Instance{named("i-4", "db")}}},
+					pages[0].Reservations...), NextToken: pages[0].NextToken}, nil
+			}
+			return pages[0], nil
+		}})
+		instances, err := findInstances(context.Background(), f.Client, "web", c)
+		if err != nil {
+			t.Fatalf("%q: findInstances: %s", tt.args, err)
+		}
+		got := []string{}
+		for _, instance := range instances {
+			got = append(got, *instance.InstanceId)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: findInstances = %v, want %v", tt.args, got, tt.want)
+		}
+		if filter := f.inputs("DescribeInstances")[0].(*ec2.DescribeInstancesInput).Filters[0]; aws.ToString(filter.Name) != tt.wantFilter {
+			t.Errorf("%q: DescribeInstances filtered on %s, want %s", tt.args, aws.ToString(filter.Name), tt.wantFilter)
+		}
+	}
+}
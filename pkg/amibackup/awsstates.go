@@ -0,0 +1,29 @@
+package amibackup
+
+import (
+	"log"
+	"sync"
+)
+
+// the image states EC2 documents: those an image leaves on its own, and those it won't.  AWS
+// adds states now and then (disabled is recent), so anything else is unknown rather than failed.
+var (
+	imageWorkingStates = map[string]bool{"pending": true, "transient": true}
+	imageFailedStates  = map[string]bool{"failed": true, "error": true, "invalid": true, "deregistered": true, "disabled": true}
+)
+
+// knownImageState reports whether an image state is one EC2 documents
+func knownImageState(state string) bool {
+	return state == "available" || imageWorkingStates[state] || imageFailedStates[state]
+}
+
+// unknownStates holds the unknown states already logged this run
+var unknownStates sync.Map
+
+// unknownState logs, once a run, an AWS state this version doesn't know and what is being done
+// about it - a new state should slow a run down at worst, never fail it or leave it spinning
+func unknownState(kind, state, treatment string) {
+	if _, seen := unknownStates.LoadOrStore(kind+" "+state, true); !seen {
+		log.Printf("WARNING: unrecognized %s state %q - %s", kind, state, treatment)
+	}
+}
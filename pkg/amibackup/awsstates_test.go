@@ -0,0 +1,158 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestKnownImageState(t *testing.T) {
+	for state, want := range map[string]bool{
+		"available": true, "pending": true, "transient": true,
+		"failed": true, "error": true, "invalid": true, "deregistered": true, "disabled": true,
+		"": false, "Available": false, "archived": false,
+	} {
+		if got := knownImageState(state); got != want {
+			t.Errorf("knownImageState(%q) = %v, want %v", state, got, want)
+		}
+	}
+}
+
+// TestWaitForAMIUnknownState checks that an image state AWS adds is waited out like pending,
+// and logged once however often it's seen
+func TestWaitForAMIUnknownState(t *testing.T) {
+	fastPolls(t)
+	out := captureLog(t)
+	img := image("ami-new", "snap-1")
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": script(imageIn(img, "optimizing"), imageIn(img, "optimizing"), imageIn(img, "available"))})
+	c := &Config{notFoundGrace: time.Minute, pollStaleLimit: time.Minute}
+	if err := waitForAMI(context.Background(), f.Client, "ami-new", "web", "i-1", false, c); err != nil {
+		t.Errorf("waitForAMI: %s", err)
+	}
+	if n := strings.Count(out.String(), `unrecognized image state "optimizing"`); n != 1 {
+		t.Errorf("unknown state logged %d times, want once:\n%s", n, out)
+	}
+}
+
+func TestDescribeAllImagesWithoutID(t *testing.T) {
+	captureLog(t)
+	deregistered := image("ami-gone")
+	deregistered.State = types.ImageStateDeregistered
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": func(interface{}) (interface{}, error) {
+		return &ec2.DescribeImagesOutput{Images: []types.Image{{State: types.ImageStateAvailable}, image("ami-1"), deregistered}}, nil
+	}})
+	resp, err := describeAllImages(context.Background(), f.Client, &ec2.DescribeImagesInput{})
+	if err != nil {
+		t.Fatalf("describeAllImages: %s", err)
+	}
+	if len(resp.Images) != 1 || aws.ToString(resp.Images[0].ImageId) != "ami-1" {
+		t.Errorf("describeAllImages = %+v, want only ami-1", resp.Images)
+	}
+}
+
+// FuzzSnapshotTags checks that whatever tags an AMI comes back with, the snapshot tags made from
+// them are ones CreateTags takes
+func FuzzSnapshotTags(f *testing.F) {
+	f.Add("Name", "web", false, false)
+	f.Add("", "orphan", false, false)
+	f.Add("CostCenter", "", true, false)
+	f.Add("Owner", "ops", false, true)
+	// the default tag keys - parsing options in each fuzz worker is too slow
+	c := &Config{}
+	f.Fuzz(func(t *testing.T, key, value string, nilKey, nilValue bool) {
+		tag := types.Tag{Key: aws.String(key), Value: aws.String(value)}
+		if nilKey {
+			tag.Key = nil
+		}
+		if nilValue {
+			tag.Value = nil
+		}
+		amiTags := []types.Tag{{Key: aws.String("hostname"), Value: aws.String("web")}, tag}
+		for _, tag := range snapshotTags(amiTags, nil, "/dev/sda1", c) {
+			if tag.Key == nil || tag.Value == nil || *tag.Key == "" || *tag.Key == "Name" {
+				t.Errorf("snapshotTags(%q=%q) gave tag %v=%v", key, value, tag.Key, tag.Value)
+			}
+		}
+	})
+}
+
+// fuzzTags builds the tags of a fuzzed image or instance: none, empty, one with nil parts, or one
+func fuzzTags(kind uint8, key, value string) []types.Tag {
+	switch kind % 4 {
+	case 0:
+		return nil
+	case 1:
+		return []types.Tag{}
+	case 2:
+		return []types.Tag{{Key: aws.String(key)}, {Value: aws.String(value)}}
+	}
+	return []types.Tag{{Key: aws.String("hostname"), Value: aws.String("web")}, {Key: aws.String(key), Value: aws.String(value)}}
+}
+
+// FuzzDescribeShapes feeds images and instances of any shape EC2 could answer with through
+// discovery, image listing, the AMI wait and instance lookup: none may panic, and the wait
+// must end within a few polls once the image it waits for is available
+func FuzzDescribeShapes(f *testing.F) {
+	f.Add(uint8(1), "available", uint8(3), "timestamp", "1772332200", "running", false, false)
+	f.Add(uint8(0), "pending", uint8(0), "", "", "", true, true)
+	f.Add(uint8(1), "failed", uint8(2), "hostname", "web", "terminated", false, true)
+	f.Add(uint8(2), "optimizing", uint8(1), "instance", "i-1", "hibernating", true, false)
+	f.Add(uint8(1), "", uint8(3), "timestamp", "soon", "", false, false)
+	fastPolls(f)
+	c := &Config{notFoundGrace: time.Second, pollStaleLimit: 2 * time.Second}
+	f.Fuzz(func(t *testing.T, idKind uint8, state string, tagKind uint8, key, value, instanceState string, nilState, nilInstanceId bool) {
+		img := types.Image{State: types.ImageState(state), Tags: fuzzTags(tagKind, key, value)}
+		switch idKind % 3 {
+		case 1:
+			img.ImageId = aws.String("ami-new")
+		case 2:
+			img.ImageId = aws.String("ami-other")
+		}
+		discovery.Classify([]types.Image{img}, c.tags())
+
+		fuzzed := func(interface{}) (interface{}, error) {
+			return &ec2.DescribeImagesOutput{Images: []types.Image{img}}, nil
+		}
+		listed := newFakeEC2(t, map[string]fakeCall{"DescribeImages": fuzzed})
+		if _, err := describeAllImages(context.Background(), listed.Client, &ec2.DescribeImagesInput{}); err != nil {
+			t.Errorf("describeAllImages: %s", err)
+		}
+		images := newFakeEC2(t, map[string]fakeCall{"DescribeImages": script(fuzzed, imageIn(image("ami-new"), "available"))})
+		shape := fmt.Sprintf("%s in state %q tagged %v", aws.ToString(img.ImageId), state, discovery.TagValue(img.Tags, key))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := waitForAMI(ctx, images.Client, "ami-new", "web", "i-1", false, c)
+		if ctx.Err() != nil {
+			t.Fatalf("waitForAMI after image %s still waiting after %d polls", shape, images.count("DescribeImages"))
+		}
+		if failed := img.ImageId != nil && *img.ImageId == "ami-new" && imageFailedStates[state]; (err != nil) != failed {
+			t.Errorf("waitForAMI after image %s = %v", shape, err)
+		}
+		// the fuzzed answer, the available image and the odd poll in between
+		if n := images.count("DescribeImages"); n > 5 {
+			t.Errorf("waitForAMI polled %d times", n)
+		}
+
+		instance := types.Instance{Tags: fuzzTags(tagKind, key, value)}
+		if !nilInstanceId {
+			instance.InstanceId = aws.String("i-1")
+		}
+		if !nilState {
+			instance.State = &types.InstanceState{Name: types.InstanceStateName(instanceState)}
+		}
+		instances := newFakeEC2(t, map[string]fakeCall{"DescribeInstances": func(interface{}) (interface{}, error) {
+			return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{instance}}}}, nil
+		}})
+		found, err := findInstances(context.Background(), instances.Client, "web", c)
+		if err != nil || len(found) > 1 || (nilInstanceId && len(found) > 0) {
+			t.Errorf("findInstances(%+v) = %d instances, %v", instance, len(found), err)
+		}
+	})
+}
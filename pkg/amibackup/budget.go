@@ -0,0 +1,154 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// backupResult status of an instance --max-new-gb left for a later run
+const statusDeferredBudget = "deferred (budget)"
+
+// candidate is an instance waiting to be backed up, with its estimated new snapshot data
+type candidate struct {
+	instanceNameTag string
+	instance        *types.Instance
+	estimateGB      int64
+}
+
+// instancePriority is an instance's --priority-tag value.  Lower values go first; instances
+// without a numeric value go last.
+func instancePriority(instance *types.Instance, c *Config) (int, bool) {
+	if c.priorityTag == "" {
+		return 0, false
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(discovery.TagValue(instance.Tags, c.priorityTag)))
+	return priority, err == nil
+}
+
+// prioritize lists the instances in the order their backups should start: those --deadline
+// deferred last run first, then by --priority-tag, then by name and ID, so the same fleet always
+// comes out in the same order
+func prioritize(instanceset map[string][]*types.Instance, c *Config) []candidate {
+	candidates := []candidate{}
+	for instanceNameTag, instances := range instanceset {
+		for _, instance := range instances {
+			candidates = append(candidates, candidate{instanceNameTag: instanceNameTag, instance: instance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		pi, oki := instancePriority(candidates[i].instance, c)
+		pj, okj := instancePriority(candidates[j].instance, c)
+		di := discovery.TagValue(candidates[i].instance.Tags, deferredTag) != ""
+		dj := discovery.TagValue(candidates[j].instance.Tags, deferredTag) != ""
+		switch {
+		case di != dj:
+			return di
+		case oki != okj:
+			return oki
+		case pi != pj:
+			return pi < pj
+		case candidates[i].instanceNameTag != candidates[j].instanceNameTag:
+			return candidates[i].instanceNameTag < candidates[j].instanceNameTag
+		}
+		return *candidates[i].instance.InstanceId < *candidates[j].instance.InstanceId
+	})
+	return candidates
+}
+
+// estimateNewGB estimates the new snapshot data each candidate's backup makes: the full size of
+// every volume its image includes.  It is an upper bound - EBS snapshots are incremental, so
+// most backups store far less.
+func estimateNewGB(ctx context.Context, awsec2 *ec2.Client, candidates []candidate, c *Config) error {
+	volumeIds := []string{}
+	for _, cand := range candidates {
+		excluded := excludedDevices(cand.instance, c)
+		for _, mapping := range cand.instance.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil && !excluded[aws.ToString(mapping.DeviceName)] {
+				volumeIds = append(volumeIds, *mapping.Ebs.VolumeId)
+			}
+		}
+	}
+	sizes := map[string]int64{}
+	for len(volumeIds) > 0 {
+		batch := volumeIds
+		if len(batch) > 200 {
+			batch = batch[:200]
+		}
+		volumeIds = volumeIds[len(batch):]
+		var resp *ec2.DescribeVolumesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: batch})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeVolumes failed: %s", err.Error())
+		}
+		for _, volume := range resp.Volumes {
+			sizes[aws.ToString(volume.VolumeId)] = int64(aws.ToInt32(volume.Size))
+		}
+	}
+	for i, cand := range candidates {
+		excluded := excludedDevices(cand.instance, c)
+		for _, mapping := range cand.instance.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil && !excluded[aws.ToString(mapping.DeviceName)] {
+				candidates[i].estimateGB += sizes[*mapping.Ebs.VolumeId]
+			}
+		}
+	}
+	return nil
+}
+
+// withinBudget splits the candidates, in priority order, into those to back up and those to
+// defer: backups start in order until the next one's estimate would take the total over maxGB,
+// and that one and every one after it wait for a later run - a smaller, lower priority backup
+// never jumps the queue.  A maxGB of 0 is no limit.
+func withinBudget(candidates []candidate, maxGB int64) ([]candidate, []candidate, int64) {
+	if maxGB <= 0 {
+		return candidates, nil, 0
+	}
+	total := int64(0)
+	for i, cand := range candidates {
+		if total+cand.estimateGB > maxGB {
+			return candidates[:i], candidates[i:], total
+		}
+		total += cand.estimateGB
+	}
+	return candidates, nil, total
+}
+
+// applyBudget drops the instances --max-new-gb defers from instanceset, returning their results
+func applyBudget(ctx context.Context, awsec2 *ec2.Client, instanceset map[string][]*types.Instance, c *Config) ([]backupResult, error) {
+	candidates := prioritize(instanceset, c)
+	if err := estimateNewGB(ctx, awsec2, candidates, c); err != nil {
+		return nil, classErrorf(apiErrorClass(err, classDiscovery), "Error estimating new snapshot data for --max-new-gb: %s", err.Error())
+	}
+	start, deferred, total := withinBudget(candidates, c.maxNewGB)
+	log.Printf("Estimated new snapshot data (full volume sizes - an upper bound): %d GB for %d instances, within --max-new-gb=%d", total, len(start), c.maxNewGB)
+	results := []backupResult{}
+	if len(deferred) == 0 {
+		return results, nil
+	}
+	if len(start) == 0 {
+		log.Printf("WARNING: the first instance's estimate alone, %d GB, is over --max-new-gb=%d - nothing is backed up", deferred[0].estimateGB, c.maxNewGB)
+	}
+	for name := range instanceset {
+		instanceset[name] = []*types.Instance{}
+	}
+	for _, cand := range start {
+		instanceset[cand.instanceNameTag] = append(instanceset[cand.instanceNameTag], cand.instance)
+	}
+	for _, cand := range deferred {
+		log.Printf("Deferring %s (%s) to a later run: its estimated %d GB would pass --max-new-gb=%d", cand.instanceNameTag, *cand.instance.InstanceId, cand.estimateGB, c.maxNewGB)
+		results = append(results, backupResult{Instance: cand.instanceNameTag, InstanceId: *cand.instance.InstanceId, Status: statusDeferredBudget, EstimatedGB: cand.estimateGB})
+	}
+	return results, nil
+}
@@ -0,0 +1,84 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestApplyBudget(t *testing.T) {
+	sizes := map[string]int32{"vol-web": 100, "vol-web-scratch": 500, "vol-db": 300, "vol-api": 80, "vol-cache": 20}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeVolumes": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeVolumesOutput{}
+			for _, id := range input.(*ec2.DescribeVolumesInput).VolumeIds {
+				out.Volumes = append(out.Volumes, types.Volume{VolumeId: aws.String(id), Size: aws.Int32(sizes[id])})
+			}
+			return out, nil
+		},
+	})
+	instance := func(name, priority string, volumes ...string) []*types.Instance {
+		i := &types.Instance{InstanceId: aws.String("i-" + name), Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}}
+		if priority != "" {
+			i.Tags = append(i.Tags, types.Tag{Key: aws.String("backup-priority"), Value: aws.String(priority)})
+		}
+		for n, volume := range volumes {
+			i.BlockDeviceMappings = append(i.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+				DeviceName: aws.String("/dev/sd" + string(rune('f'+n))),
+				Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String(volume)},
+			})
+		}
+		return []*types.Instance{i}
+	}
+	tests := []struct {
+		maxGB    string
+		started  []string
+		deferred []string
+		estimate []int64
+	}{
+		// web's scratch volume on /dev/sdg is ignored, so isn't counted
+		{"1000", []string{"web", "db", "api", "cache"}, nil, nil},
+		// api's 80 GB would pass the cap, and cache, though small enough, mustn't jump the queue
+		{"450", []string{"web", "db"}, []string{"api", "cache"}, []int64{80, 20}},
+		{"50", nil, []string{"web", "db", "api", "cache"}, []int64{100, 300, 80, 20}},
+	}
+	for _, tt := range tests {
+		c, err := parseTestOptions("--max-new-gb="+tt.maxGB, "--priority-tag=backup-priority", "-i", "/dev/sdg", "web", "db", "api", "cache")
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		instanceset := map[string][]*types.Instance{
+			"web":   instance("web", "1", "vol-web", "vol-web-scratch"),
+			"db":    instance("db", "2", "vol-db"),
+			"api":   instance("api", "3", "vol-api"),
+			"cache": instance("cache", "", "vol-cache"),
+		}
+		results, err := applyBudget(context.Background(), f.Client, instanceset, c)
+		if err != nil {
+			t.Fatalf("applyBudget: %s", err)
+		}
+		started := []string{}
+		for _, cand := range prioritize(instanceset, c) {
+			started = append(started, cand.instanceNameTag)
+		}
+		deferred, estimate := []string(nil), []int64(nil)
+		for _, r := range results {
+			if r.Status != statusDeferredBudget {
+				t.Errorf("--max-new-gb=%s: %s is %q, want %q", tt.maxGB, r.Instance, r.Status, statusDeferredBudget)
+			}
+			deferred = append(deferred, r.Instance)
+			estimate = append(estimate, r.EstimatedGB)
+		}
+		if len(started) == 0 {
+			started = nil
+		}
+		if !reflect.DeepEqual(started, tt.started) || !reflect.DeepEqual(deferred, tt.deferred) || !reflect.DeepEqual(estimate, tt.estimate) {
+			t.Errorf("--max-new-gb=%s started %v and deferred %v estimated at %v GB, want %v and %v at %v GB",
+				tt.maxGB, started, deferred, estimate, tt.started, tt.deferred, tt.estimate)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package amibackup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// checkpointVersion changes whenever the checkpoint format or meaning of its steps does
+const checkpointVersion = 1
+
+// pipeline steps recorded in the checkpoint, in the order they happen
+const (
+	stepCreated         = "created"          // the source AMI is available (or started, with --no-wait)
+	stepStored          = "stored"           // the source AMI is archived to S3
+	stepCopyStarted     = "copy-started"     // a copy to the region has been asked for
+	stepCopied          = "copied"           // the copy in the region is available
+	stepTagged          = "tagged"           // the region's snapshots are tagged
+	stepSnapshotsCopied = "snapshots-copied" // --copy-snapshots-independently is done for the region
+	stepDone            = "done"             // the instance is backed up
+
+	stepReencryptCopied = "reencrypt-copied" // --reencrypt: the old AMI's copy under the new key has been asked for
+)
+
+// checkpointLine is one line of the checkpoint file: the header that identifies the run, or a
+// step done for one instance.  Sum is the CRC-32 of the line with Sum empty.
+type checkpointLine struct {
+	Version  int    `json:"version,omitempty"`
+	Key      string `json:"key,omitempty"`
+	RunID    string `json:"run_id,omitempty"`
+	Started  int64  `json:"started,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Step     string `json:"step,omitempty"`
+	Region   string `json:"region,omitempty"`
+	AMI      string `json:"ami,omitempty"`
+	Sum      string `json:"sum"`
+}
+
+// checkpoint is the --checkpoint-file: a JSON-lines journal of each instance's pipeline steps,
+// synced to disk as they happen, so a run that dies can be run again with the same file and
+// pick up where it left off.  A nil checkpoint records nothing and has nothing recorded.
+type checkpoint struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	steps map[string]string // instance, step and region to AMI
+}
+
+// stepKey indexes a step in checkpoint.steps
+func stepKey(instanceId, step, region string) string {
+	return instanceId + " " + step + " " + region
+}
+
+// checkpointKey identifies the hosts and options a checkpoint is good for - a run with a
+// different key must not trust its steps
+func checkpointKey(c *Config) string {
+	hosts := append([]string{}, c.instanceNameTags...)
+	sort.Strings(hosts)
+	ignored := append([]string{}, c.ignoreVolumes...)
+	sort.Strings(ignored)
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%q\n%q\n%q\n%q\n", checkpointVersion, hosts, c.sourceRegion, c.destRegions(), c.classificationTag)
+	fmt.Fprintf(h, "%t %q %q %q %q %q %t\n", c.encrypted, c.kmsKeyId, c.kmsKeyAlias, ignored, c.tagPrefix, c.normalize, c.caseInsensitive)
+	fmt.Fprintf(h, "%t %t %q %q %t %t %t\n", c.copySnapshots, c.discardSource, c.amiStoreBucket, c.amiStorePrefix, c.noWait, c.tagEarly, c.dedupByContent)
+	fmt.Fprintf(h, "%t\n", c.reencrypt)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// checksum returns the line's sum
+func (l checkpointLine) checksum() string {
+	l.Sum = ""
+	data, _ := json.Marshal(l)
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+// readCheckpoint reads a checkpoint file, reporting the first line that is corrupt
+func readCheckpoint(path string) (*checkpointLine, []checkpointLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var header *checkpointLine
+	lines := []checkpointLine{}
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		var line checkpointLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", n, err.Error())
+		}
+		if line.Sum != line.checksum() {
+			return nil, nil, fmt.Errorf("line %d: checksum mismatch", n)
+		}
+		if n == 1 {
+			if line.Version == 0 || line.Key == "" || line.RunID == "" || line.Started == 0 {
+				return nil, nil, fmt.Errorf("line 1: not a checkpoint header")
+			}
+			header = &line
+			continue
+		}
+		if line.Instance == "" || line.Step == "" {
+			return nil, nil, fmt.Errorf("line %d: not a checkpoint step", n)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		return nil, nil, fmt.Errorf("file is empty")
+	}
+	return header, lines, nil
+}
+
+// openCheckpoint opens --checkpoint-file.  A checkpoint left by an earlier run of the same hosts
+// and options is resumed - the run takes on that run's ID and start time, so AMI names and copy
+// client tokens match what it already started.  One for other hosts or options is started over;
+// a corrupt one is an error, as trusting it could skip a backup.
+func openCheckpoint(path string, c *Config) (*checkpoint, error) {
+	cp := &checkpoint{path: path, steps: map[string]string{}}
+	key := checkpointKey(c)
+	header, lines, err := readCheckpoint(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("Checkpoint file %s is corrupt (%s) - check it, or delete it to start over", path, err.Error())
+	case header.Version != checkpointVersion || header.Key != key:
+		log.Printf("Checkpoint file %s is for other hosts or options - starting over", path)
+		header = nil
+	default:
+		for _, line := range lines {
+			cp.steps[stepKey(line.Instance, line.Step, line.Region)] = line.AMI
+		}
+		c.runID = header.RunID
+		setRunStart(time.Unix(header.Started, 0))
+		cp.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening checkpoint file: %s", err.Error())
+		}
+		log.Printf("Resuming run %s of %s from checkpoint file %s (%d steps done)", c.runID, timeString, path, len(lines))
+		return cp, nil
+	}
+	cp.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating checkpoint file: %s", err.Error())
+	}
+	if err := cp.write(checkpointLine{Version: checkpointVersion, Key: key, RunID: c.runID, Started: runStart.Unix()}); err != nil {
+		return nil, fmt.Errorf("Error writing checkpoint file: %s", err.Error())
+	}
+	return cp, nil
+}
+
+// write appends a line and syncs it to disk.  Callers must hold cp.mu, or own cp.
+func (cp *checkpoint) write(line checkpointLine) error {
+	line.Sum = line.checksum()
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if _, err := cp.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return cp.file.Sync()
+}
+
+// record notes that an instance's step is done (region "" for steps that aren't per region).
+// Failing to write is logged, not fatal - a resumed run just repeats the step.
+func (cp *checkpoint) record(instanceId, step, region, ami string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.steps[stepKey(instanceId, step, region)] = ami
+	if err := cp.write(checkpointLine{Instance: instanceId, Step: step, Region: region, AMI: ami}); err != nil {
+		log.Printf("Error writing checkpoint for %s %s: %s", instanceId, step, err.Error())
+	}
+}
+
+// done returns the AMI recorded with an instance's step, and whether the step is done
+func (cp *checkpoint) done(instanceId, step, region string) (string, bool) {
+	if cp == nil {
+		return "", false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	ami, ok := cp.steps[stepKey(instanceId, step, region)]
+	return ami, ok
+}
+
+// finish closes the checkpoint, deleting it if every instance is backed up so the next run
+// starts afresh
+func (cp *checkpoint) finish(failed int) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.file.Close()
+	if failed > 0 {
+		log.Printf("Kept checkpoint file %s - run again with it to resume the %d failed instances", cp.path, failed)
+		return
+	}
+	if err := os.Remove(cp.path); err != nil {
+		log.Printf("Error removing checkpoint file: %s", err.Error())
+	}
+}
+
+// findAMIByName returns our pending or available AMI with this exact name, or ""
+func findAMIByName(ctx context.Context, awsec2 *ec2.Client, name string) (string, error) {
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+			Owners: []string{"self"},
+			Filters: []types.Filter{
+				{Name: aws.String("name"), Values: []string{name}},
+				{Name: aws.String("state"), Values: []string{"pending", "available"}},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	if len(resp.Images) == 0 {
+		return "", nil
+	}
+	return aws.ToString(resp.Images[0].ImageId), nil
+}
@@ -0,0 +1,194 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// checkpointArgs back up web from us-east-1 to us-west-2, recording progress in path
+func checkpointArgs(path string, extra ...string) []string {
+	return append([]string{"--source=us-east-1", "--dest=us-west-2", "--checkpoint-file=" + path, "--timeout=10m",
+		"--freeze-parameter=none", "--no-reconcile", "--no-progress"}, append(extra, "web")...)
+}
+
+// writeCheckpoint leaves a checkpoint as a run killed after these steps would have
+func writeCheckpoint(t *testing.T, path string, steps []checkpointLine) *Config {
+	t.Helper()
+	c, err := parseTestOptions(checkpointArgs(path)...)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	cp, err := openCheckpoint(path, c)
+	if err != nil {
+		t.Fatalf("openCheckpoint: %s", err)
+	}
+	for _, step := range steps {
+		cp.record(step.Instance, step.Step, step.Region, step.AMI)
+	}
+	cp.file.Close()
+	return c
+}
+
+func TestCheckpointResume(t *testing.T) {
+	fastPolls(t)
+	start := runStart
+	t.Cleanup(func() { setRunStart(start) })
+
+	const instanceId = "i-0123456789abcdef0"
+	instance := types.Instance{
+		InstanceId:     aws.String(instanceId),
+		State:          &types.InstanceState{Name: types.InstanceStateNameRunning},
+		RootDeviceName: aws.String("/dev/xvda"),
+		Tags:           []types.Tag{{Key: aws.String("Name"), Value: aws.String("web")}},
+		BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")}},
+		},
+	}
+	// the steps of the whole pipeline, in order - the run is killed after each in turn
+	steps := []checkpointLine{
+		{Instance: instanceId, Step: stepCreated, AMI: "ami-source"},
+		{Instance: instanceId, Step: stepCopyStarted, Region: "us-west-2", AMI: "ami-source"},
+		{Instance: instanceId, Step: stepCopied, Region: "us-west-2", AMI: "ami-copy"},
+		{Instance: instanceId, Step: stepTagged, Region: "us-west-2", AMI: "ami-copy"},
+		{Instance: instanceId, Step: stepDone, AMI: "ami-source"},
+	}
+	for killed := 0; killed <= len(steps); killed++ {
+		path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+		first := writeCheckpoint(t, path, steps[:killed])
+
+		images := &fakeImages{images: map[string]types.Image{}}
+		images.set(image("ami-source", "snap-source"), types.ImageStateAvailable)
+		images.set(image("ami-copy", "snap-copy"), types.ImageStateAvailable)
+		ok := func(out interface{}) fakeCall {
+			return func(interface{}) (interface{}, error) { return out, nil }
+		}
+		f := newFakeAWS(t, map[string]fakeCall{
+			"GetEbsEncryptionByDefault": ok(&ec2.GetEbsEncryptionByDefaultOutput{EbsEncryptionByDefault: aws.Bool(false)}),
+			"DescribeInstances": ok(&ec2.DescribeInstancesOutput{Reservations: []types.Reservation{
+				{Instances: []types.Instance{instance}},
+			}}),
+			"GetCallerIdentity": ok(&sts.GetCallerIdentityOutput{Account: aws.String("123456789012"), Arn: aws.String("arn:aws:iam::123456789012:user/backup")}),
+			"DescribeVolumes": ok(&ec2.DescribeVolumesOutput{Volumes: []types.Volume{
+				{VolumeId: aws.String("vol-root"), Size: aws.Int32(8), Encrypted: aws.Bool(false)},
+			}}),
+			"DescribeImages":    images.describe,
+			"DescribeSnapshots": ok(&ec2.DescribeSnapshotsOutput{}),
+			"CreateTags":        ok(&ec2.CreateTagsOutput{}),
+			"DeleteTags":        ok(&ec2.DeleteTagsOutput{}),
+			"CreateImage":       ok(&ec2.CreateImageOutput{ImageId: aws.String("ami-source")}),
+			"CopyImage":         ok(&ec2.CopyImageOutput{ImageId: aws.String("ami-copy")}),
+		})
+		fakeClients(t, f)
+		c, err := parseTestOptions(checkpointArgs(path)...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+
+		summary, err := run(context.Background(), c)
+		if err != nil {
+			t.Fatalf("killed after %d steps: run: %s", killed, err)
+		}
+		if c.runID != first.runID {
+			t.Errorf("killed after %d steps: resumed as run %s, want the checkpoint's %s", killed, c.runID, first.runID)
+		}
+		if len(summary.Backups) != 1 || summary.Backups[0].SourceAMI != "ami-source" || summary.Backups[0].CopyAMI != "ami-copy" {
+			t.Errorf("killed after %d steps: backups %+v, want ami-source copied to ami-copy", killed, summary.Backups)
+		}
+		want := map[string]int{"CreateImage": 0, "CopyImage": 0, "DescribeSnapshots": 0}
+		if killed < 1 {
+			want["CreateImage"] = 1
+		}
+		if killed < 3 {
+			want["CopyImage"] = 1
+		}
+		if killed < 4 {
+			want["DescribeSnapshots"] = 2 // tagging looks in both regions
+		}
+		for op, n := range want {
+			if got := f.count(op); got != n {
+				t.Errorf("killed after %d steps: %s called %d times, want %d", killed, op, got, n)
+			}
+		}
+		// a copy started before the kill is found again by its client token
+		for _, in := range f.inputs("CopyImage") {
+			if token := aws.ToString(in.(*ec2.CopyImageInput).ClientToken); token != first.runID+"-ami-source" {
+				t.Errorf("killed after %d steps: copied with client token %q, want %q", killed, token, first.runID+"-ami-source")
+			}
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("killed after %d steps: checkpoint file left behind after a clean run: %v", killed, err)
+		}
+	}
+}
+
+func TestCheckpointInvalid(t *testing.T) {
+	steps := []checkpointLine{{Instance: "i-0123456789abcdef0", Step: stepCreated, AMI: "ami-source"}}
+
+	// another host set starts over
+	path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	first := writeCheckpoint(t, path, steps)
+	c, err := parseTestOptions(append(checkpointArgs(path), "db")...)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	cp, err := openCheckpoint(path, c)
+	if err != nil {
+		t.Fatalf("openCheckpoint: %s", err)
+	}
+	cp.file.Close()
+	if _, done := cp.done("i-0123456789abcdef0", stepCreated, ""); done || c.runID == first.runID {
+		t.Errorf("checkpoint for web trusted by a run of web and db")
+	}
+
+	// so do other key options
+	writeCheckpoint(t, path, steps)
+	c, err = parseTestOptions(checkpointArgs(path, "-i", "/dev/sdf")...)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	cp, err = openCheckpoint(path, c)
+	if err != nil {
+		t.Fatalf("openCheckpoint: %s", err)
+	}
+	cp.file.Close()
+	if _, done := cp.done("i-0123456789abcdef0", stepCreated, ""); done {
+		t.Errorf("checkpoint trusted by a run ignoring another volume")
+	}
+
+	// a damaged file is reported, not trusted or overwritten
+	for i, damage := range []func(string) string{
+		func(s string) string { return strings.Replace(s, "ami-source", "ami-sourcf", 1) },
+		func(s string) string { return s[:len(s)-10] },
+		func(s string) string { return "" },
+	} {
+		path := filepath.Join(t.TempDir(), fmt.Sprintf("damaged-%d.jsonl", i))
+		writeCheckpoint(t, path, steps)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damaged := damage(string(data))
+		if err := os.WriteFile(path, []byte(damaged), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := parseTestOptions(checkpointArgs(path)...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		if _, err := openCheckpoint(path, c); err == nil || !strings.Contains(err.Error(), "is corrupt") {
+			t.Errorf("opened damaged checkpoint %q: %v", damaged, err)
+		}
+		if after, _ := os.ReadFile(path); string(after) != damaged {
+			t.Errorf("damaged checkpoint was overwritten")
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/backup"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ebs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// clientKey identifies one client: its service, and its region and role ("" for the default credentials)
+type clientKey struct {
+	service string
+	region  string
+	role    string
+}
+
+// clientPool lazily creates AWS clients and caches them per service, region and role.  Every client
+// shares one base config - and so one HTTP client, endpoint, user-agent and mutation log - and
+// the pool is safe for concurrent use.
+type clientPool struct {
+	cfg       aws.Config
+	mutate    aws.CredentialsProvider // --mutate-role-arn's credentials, if set
+	mutations mutationLog
+	mu        sync.Mutex
+	creds     map[string]*aws.CredentialsCache
+	clients   map[clientKey]interface{}
+}
+
+// extraAPIOptions go on every pooled client's middleware stack after our own - tests answer
+// AWS calls with them
+var extraAPIOptions []func(*middleware.Stack) error
+
+// newClientPool loads the default AWS config for the pool; endpoint overrides the AWS API endpoint
+// if set.  Every request carries the run ID in its User-Agent, so CloudTrail events can be tied to the run.
+func newClientPool(ctx context.Context, endpoint, runID string) (*clientPool, error) {
+	p := &clientPool{
+		creds:   map[string]*aws.CredentialsCache{},
+		clients: map[clientKey]interface{}{},
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithAPIOptions(append([]func(*middleware.Stack) error{
+		p.mutations.middleware(),
+		awsmiddleware.AddUserAgentKeyValue("amibackup", version),
+		awsmiddleware.AddUserAgentKeyValue("run", runID),
+	}, extraAPIOptions...)))
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS config: %s", err.Error())
+	}
+	if endpoint != "" {
+		cfg.BaseEndpoint = aws.String(endpoint)
+	}
+	p.cfg = cfg
+	return p, nil
+}
+
+// config returns the client config for a region and role.  Callers must hold p.mu.
+func (p *clientPool) config(region, role string) aws.Config {
+	cfg := p.cfg.Copy()
+	cfg.Region = region
+	if role != "" {
+		cfg.Credentials = p.roleCredentials(cfg, role)
+	} else if p.mutate != nil {
+		cfg.Credentials = &routedCredentials{read: p.cfg.Credentials, mutate: p.mutate}
+	}
+	return cfg
+}
+
+// roleCredentials returns the credentials for assuming a role, from cfg's credentials.  Callers must hold p.mu.
+func (p *clientPool) roleCredentials(cfg aws.Config, role string) *aws.CredentialsCache {
+	// one credential cache per role, so every region refreshes the same assumed-role session
+	if p.creds[role] == nil {
+		p.creds[role] = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role))
+	}
+	return p.creds[role]
+}
+
+// setMutateRole sends every call that changes something through the role, for --mutate-role-arn.
+// Call it before making any clients.
+func (p *clientPool) setMutateRole(role string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mutate = p.roleCredentials(p.cfg, role)
+}
+
+// routedCredentials signs each call with the read credentials or, for a mutating one, the
+// --mutate-role-arn credentials, so the run's read-only identity can't change anything itself
+type routedCredentials struct {
+	read   aws.CredentialsProvider
+	mutate aws.CredentialsProvider
+}
+
+// Retrieve returns the credentials for the operation being signed
+func (r *routedCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if isMutating(awsmiddleware.GetOperationName(ctx)) {
+		return r.mutate.Retrieve(ctx)
+	}
+	return r.read.Retrieve(ctx)
+}
+
+// Invalidate expires both sets of credentials, as we can't tell which a failed call used
+func (r *routedCredentials) Invalidate() {
+	for _, creds := range []aws.CredentialsProvider{r.read, r.mutate} {
+		if cache, ok := creds.(*aws.CredentialsCache); ok {
+			cache.Invalidate()
+		}
+	}
+}
+
+// callerIdentity returns the ARN the region and role's credentials act as - with role "",
+// the default credentials, even under --mutate-role-arn
+func (p *clientPool) callerIdentity(ctx context.Context, region, role string) (string, error) {
+	p.mu.Lock()
+	cfg := p.cfg.Copy()
+	cfg.Region = region
+	if role != "" {
+		cfg.Credentials = p.roleCredentials(cfg, role)
+	}
+	p.mu.Unlock()
+	resp, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("STS API GetCallerIdentity failed: %s", err.Error())
+	}
+	return aws.ToString(resp.Arn), nil
+}
+
+// pooled returns the pool's client of a service for a region and role, making it the first time
+func pooled[C, O any](p *clientPool, service, region, role string, newClient func(aws.Config, ...func(*O)) *C) *C {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := clientKey{service, region, role}
+	if client, ok := p.clients[key]; ok {
+		return client.(*C)
+	}
+	client := newClient(p.config(region, role))
+	p.clients[key] = client
+	return client
+}
+
+// EC2 returns the EC2 client for a region and role
+func (p *clientPool) EC2(region, role string) *ec2.Client {
+	return pooled(p, "ec2", region, role, ec2.NewFromConfig)
+}
+
+// EBS returns the EBS direct API client for a region and role
+func (p *clientPool) EBS(region, role string) *ebs.Client {
+	return pooled(p, "ebs", region, role, ebs.NewFromConfig)
+}
+
+// STS returns the STS client for a region and role
+func (p *clientPool) STS(region, role string) *sts.Client {
+	return pooled(p, "sts", region, role, sts.NewFromConfig)
+}
+
+// CloudWatch returns the CloudWatch client for a region and role
+func (p *clientPool) CloudWatch(region, role string) *cloudwatch.Client {
+	return pooled(p, "cloudwatch", region, role, cloudwatch.NewFromConfig)
+}
+
+// KMS returns the KMS client for a region and role
+func (p *clientPool) KMS(region, role string) *kms.Client {
+	return pooled(p, "kms", region, role, kms.NewFromConfig)
+}
+
+// SSM returns the Systems Manager client for a region and role
+func (p *clientPool) SSM(region, role string) *ssm.Client {
+	return pooled(p, "ssm", region, role, ssm.NewFromConfig)
+}
+
+// Backup returns the AWS Backup client for a region and role
+func (p *clientPool) Backup(region, role string) *backup.Client {
+	return pooled(p, "backup", region, role, backup.NewFromConfig)
+}
+
+// S3 returns the S3 client for a region and role
+func (p *clientPool) S3(region, role string) *s3.Client {
+	return pooled(p, "s3", region, role, s3.NewFromConfig)
+}
+
+// resolveKMSKey returns the ARN of the KMS key a --kms-key-alias names, with or without its alias/ prefix
+func resolveKMSKey(ctx context.Context, awskms *kms.Client, alias string) (string, error) {
+	if !strings.HasPrefix(alias, "alias/") {
+		alias = "alias/" + alias
+	}
+	resp, err := awskms.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(alias)})
+	if err != nil {
+		if errorCode(err) == "NotFoundException" {
+			return "", fmt.Errorf("KMS key alias %s does not exist in %s", alias, awskms.Options().Region)
+		}
+		return "", fmt.Errorf("KMS API DescribeKey failed for %s: %s", alias, err.Error())
+	}
+	if resp.KeyMetadata == nil || aws.ToString(resp.KeyMetadata.Arn) == "" {
+		return "", fmt.Errorf("KMS API DescribeKey returned no key for %s", alias)
+	}
+	return *resp.KeyMetadata.Arn, nil
+}
+
+// accountID returns the AWS account the region and role's credentials belong to
+func (p *clientPool) accountID(ctx context.Context, region, role string) (string, error) {
+	resp, err := p.STS(region, role).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("STS API GetCallerIdentity failed: %s", err.Error())
+	}
+	return aws.ToString(resp.Account), nil
+}
+
+// copySlots holds a semaphore per AWS account, limiting its simultaneous AMI copies
+var copySlots = struct {
+	sync.Mutex
+	accounts map[string]chan struct{}
+}{accounts: map[string]chan struct{}{}}
+
+// acquireCopySlot waits for one of an account's copy slots (limit 0 means no limit), and
+// returns the function that frees it again
+func acquireCopySlot(account string, limit int) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+	copySlots.Lock()
+	slots := copySlots.accounts[account]
+	if slots == nil {
+		slots = make(chan struct{}, limit)
+		copySlots.accounts[account] = slots
+	}
+	copySlots.Unlock()
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("All %d copy slots for account %s are busy - waiting", limit, account)
+		slots <- struct{}{}
+	}
+	return func() { <-slots }
+}
@@ -0,0 +1,104 @@
+package amibackup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// testPool returns a client pool with static credentials from the environment, reaching endpoint if set
+func testPool(t *testing.T, endpoint string) *clientPool {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	p, err := newClientPool(context.Background(), endpoint, "test-run")
+	if err != nil {
+		t.Fatalf("newClientPool: %s", err)
+	}
+	return p
+}
+
+func TestClientPoolOneClientPerKey(t *testing.T) {
+	p := testPool(t, "")
+	clients := make([]*ec2.Client, 20)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i] = p.EC2("us-west-2", "")
+		}(i)
+	}
+	wg.Wait()
+	for i, client := range clients {
+		if client != clients[0] {
+			t.Fatalf("call %d got a different client for the same region and role", i)
+		}
+	}
+	if p.EC2("us-west-2", "arn:aws:iam::123456789012:role/backup") == clients[0] {
+		t.Errorf("another role shared the default credentials' client")
+	}
+	if p.EC2("eu-west-1", "") == clients[0] {
+		t.Errorf("another region shared the client")
+	}
+	p.KMS("us-west-2", "")
+	if len(p.clients) != 4 {
+		t.Errorf("pool holds %d clients, want 4", len(p.clients))
+	}
+	if region := p.EC2("eu-west-1", "").Options().Region; region != "eu-west-1" {
+		t.Errorf("client region = %s, want eu-west-1", region)
+	}
+}
+
+func TestRoutedCredentials(t *testing.T) {
+	r := &routedCredentials{
+		read:   credentials.NewStaticCredentialsProvider("READ", "secret", ""),
+		mutate: credentials.NewStaticCredentialsProvider("MUTATE", "secret", ""),
+	}
+	for op, want := range map[string]string{
+		"DescribeImages":      "READ",
+		"GetSnapshotBlock":    "READ",
+		"ListTagsForResource": "READ",
+		"CreateImage":         "MUTATE",
+		"DeregisterImage":     "MUTATE",
+	} {
+		ctx := awsmiddleware.SetOperationName(context.Background(), op)
+		creds, err := r.Retrieve(ctx)
+		if err != nil {
+			t.Fatalf("Retrieve for %s: %s", op, err)
+		}
+		if creds.AccessKeyID != want {
+			t.Errorf("%s signed with %s, want %s", op, creds.AccessKeyID, want)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<DescribeImagesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>1</requestId><imagesSet/></DescribeImagesResponse>`))
+	}))
+	defer srv.Close()
+	p := testPool(t, srv.URL)
+	if _, err := p.EC2("us-east-1", "").DescribeImages(context.Background(), &ec2.DescribeImagesInput{}); err != nil {
+		t.Fatalf("DescribeImages: %s", err)
+	}
+	agent := <-agents
+	for _, want := range []string{"amibackup/" + version, "run/test-run"} {
+		if !strings.Contains(agent, want) {
+			t.Errorf("User-Agent %q lacks %q", agent, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// contract is the fake AWS state in discovery/testdata/contract.json, and the backups every tool
+// must find in it - amiinventory's tests check it against the same file
+type contract struct {
+	Hostname  string        `json:"hostname"`
+	TagPrefix string        `json:"tag_prefix"`
+	Images    []types.Image `json:"images"`
+	Backups   []string      `json:"backups"`
+}
+
+// describe answers DescribeImages as EC2 would, by the tag filters asked for
+func (k *contract) describe(input interface{}) (interface{}, error) {
+	out := &ec2.DescribeImagesOutput{}
+	for _, img := range k.Images {
+		matches := true
+		for _, filter := range input.(*ec2.DescribeImagesInput).Filters {
+			key, ok := strings.CutPrefix(aws.ToString(filter.Name), "tag:")
+			matches = matches && ok && stringIn(discovery.TagValue(img.Tags, key), filter.Values)
+		}
+		if matches {
+			out.Images = append(out.Images, img)
+		}
+	}
+	return out, nil
+}
+
+func TestDiscoveryContract(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "discovery", "testdata", "contract.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k contract
+	if err := json.Unmarshal(data, &k); err != nil {
+		t.Fatalf("contract.json: %s", err)
+	}
+	c, err := parseTestOptions("--dry-run", "--tag-prefix="+k.TagPrefix, "--legacy-tags", "-p", "1d:4d:30d", k.Hostname)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": k.describe})
+
+	records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", k.Hostname, c, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	seen := map[string]bool{}
+	for _, r := range records {
+		seen[r.AmiId] = true
+	}
+	found := []string{}
+	for id := range seen {
+		found = append(found, id)
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, k.Backups) {
+		t.Errorf("purge planned for %v, want the contract's backups %v", found, k.Backups)
+	}
+}
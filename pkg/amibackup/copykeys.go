@@ -0,0 +1,134 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// sourceKeys caches the KMS keys behind instances' volumes, looked up once per run in the source
+// region, as many instances share a key
+type sourceKeys struct {
+	mu   sync.Mutex
+	keys map[string]*kmstypes.KeyMetadata
+	errs map[string]error
+}
+
+// newSourceKeys returns an empty key cache
+func newSourceKeys() *sourceKeys {
+	return &sourceKeys{keys: map[string]*kmstypes.KeyMetadata{}, errs: map[string]error{}}
+}
+
+// describe returns a key's metadata, from the cache if it has been looked up.  keyId may be a key
+// ID, key ARN, alias name or alias ARN.
+func (k *sourceKeys) describe(ctx context.Context, awskms *kms.Client, keyId string) (*kmstypes.KeyMetadata, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.keys[keyId]; ok {
+		return key, k.errs[keyId]
+	}
+	var key *kmstypes.KeyMetadata
+	resp, err := awskms.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+	switch {
+	case err != nil:
+		err = fmt.Errorf("KMS API DescribeKey failed for %s: %s", keyId, err.Error())
+	case resp.KeyMetadata == nil:
+		err = fmt.Errorf("KMS API DescribeKey returned no metadata for %s", keyId)
+	default:
+		key = resp.KeyMetadata
+	}
+	k.keys[keyId], k.errs[keyId] = key, err
+	return key, err
+}
+
+// copyKeyProblem predicts why copying a snapshot encrypted under key to destRegion would fail,
+// and what to do about it, or returns "" if it shouldn't.  EC2 encrypts a cross-region copy with
+// a key in the dest region: -k (or --kms-key-alias) names one; the AWS managed aws/ebs key
+// has its own counterpart there; a multi-Region key can use its replica.  A customer managed
+// single-Region key has none of these.
+func copyKeyProblem(key *kmstypes.KeyMetadata, destRegion string, c *Config) string {
+	arn := aws.ToString(key.Arn)
+	switch {
+	case key.KeyState != kmstypes.KeyStateEnabled:
+		return fmt.Sprintf("KMS key %s is %s, so EC2 can't read the snapshot to copy it - enable the key", arn, key.KeyState)
+	case c.kmsKeyId != "":
+		return ""
+	case key.KeyManager == kmstypes.KeyManagerTypeAws:
+		return ""
+	case aws.ToBool(key.MultiRegion) && multiRegionKeyIn(key, destRegion):
+		return ""
+	case aws.ToBool(key.MultiRegion):
+		return fmt.Sprintf("multi-Region KMS key %s has no replica in %s - replicate it there, or add -k (--kms-key-id) or --kms-key-alias with a key in %s to re-encrypt the copy",
+			arn, destRegion, destRegion)
+	}
+	return fmt.Sprintf("KMS key %s is a single-Region key - add -k (--kms-key-id) or --kms-key-alias with a key in %s to re-encrypt the copy", arn, destRegion)
+}
+
+// multiRegionKeyIn reports whether a multi-Region key has its primary or a replica in region
+func multiRegionKeyIn(key *kmstypes.KeyMetadata, region string) bool {
+	config := key.MultiRegionConfiguration
+	if config == nil {
+		return false
+	}
+	if config.PrimaryKey != nil && aws.ToString(config.PrimaryKey.Region) == region {
+		return true
+	}
+	for _, replica := range config.ReplicaKeys {
+		if aws.ToString(replica.Region) == region {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCopyKeys predicts which of an instance's included volumes can't be copied to which of
+// regions because of the KMS key they're encrypted with, describing each problem
+func checkCopyKeys(ctx context.Context, awsec2 *ec2.Client, awskms *kms.Client, keys *sourceKeys, instance *types.Instance, regions []string, c *Config) ([]string, error) {
+	excluded := excludedDevices(instance, c)
+	devices := map[string]string{} // volume to device
+	volumeIds := []string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		device := aws.ToString(mapping.DeviceName)
+		if excluded[device] || mapping.Ebs == nil || mapping.Ebs.VolumeId == nil {
+			continue
+		}
+		devices[*mapping.Ebs.VolumeId] = device
+		volumeIds = append(volumeIds, *mapping.Ebs.VolumeId)
+	}
+	if len(volumeIds) == 0 {
+		return nil, nil
+	}
+	var resp *ec2.DescribeVolumesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: volumeIds})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeVolumes failed: %s", err.Error())
+	}
+	problems := []string{}
+	for _, volume := range resp.Volumes {
+		if !aws.ToBool(volume.Encrypted) || aws.ToString(volume.KmsKeyId) == "" {
+			continue
+		}
+		key, err := keys.describe(ctx, awskms, *volume.KmsKeyId)
+		if err != nil {
+			return problems, err
+		}
+		for _, region := range regions {
+			if region == c.sourceRegion {
+				continue
+			}
+			if problem := copyKeyProblem(key, region, c); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s (%s) to %s: %s", *volume.VolumeId, devices[*volume.VolumeId], region, problem))
+			}
+		}
+	}
+	return problems, nil
+}
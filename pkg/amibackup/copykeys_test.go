@@ -0,0 +1,165 @@
+package amibackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// testKeys are the source region's KMS keys, by ID
+var testKeys = map[string]kmstypes.KeyMetadata{
+	"aws-ebs": {
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/aws-ebs"), KeyState: kmstypes.KeyStateEnabled,
+		KeyManager: kmstypes.KeyManagerTypeAws,
+	},
+	"single": {
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/single"), KeyState: kmstypes.KeyStateEnabled,
+		KeyManager: kmstypes.KeyManagerTypeCustomer,
+	},
+	"mrk-replicated": {
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/mrk-replicated"), KeyState: kmstypes.KeyStateEnabled,
+		KeyManager: kmstypes.KeyManagerTypeCustomer, MultiRegion: aws.Bool(true),
+		MultiRegionConfiguration: &kmstypes.MultiRegionConfiguration{
+			PrimaryKey:  &kmstypes.MultiRegionKey{Region: aws.String("us-east-1")},
+			ReplicaKeys: []kmstypes.MultiRegionKey{{Region: aws.String("us-west-2")}},
+		},
+	},
+	"mrk-replica": {
+		// a replica whose primary is in the dest region
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/mrk-replica"), KeyState: kmstypes.KeyStateEnabled,
+		KeyManager: kmstypes.KeyManagerTypeCustomer, MultiRegion: aws.Bool(true),
+		MultiRegionConfiguration: &kmstypes.MultiRegionConfiguration{
+			PrimaryKey: &kmstypes.MultiRegionKey{Region: aws.String("us-west-2")},
+		},
+	},
+	"mrk-alone": {
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/mrk-alone"), KeyState: kmstypes.KeyStateEnabled,
+		KeyManager: kmstypes.KeyManagerTypeCustomer, MultiRegion: aws.Bool(true),
+		MultiRegionConfiguration: &kmstypes.MultiRegionConfiguration{
+			PrimaryKey: &kmstypes.MultiRegionKey{Region: aws.String("us-east-1")},
+		},
+	},
+	"disabled": {
+		Arn: aws.String("arn:aws:kms:us-east-1:123456789012:key/disabled"), KeyState: kmstypes.KeyStateDisabled,
+		KeyManager: kmstypes.KeyManagerTypeAws,
+	},
+}
+
+func TestCopyKeyProblem(t *testing.T) {
+	plain, err := parseTestOptions("web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	reencrypt, err := parseTestOptions("--dest=us-west-2", "-k", "arn:aws:kms:us-west-2:123456789012:key/dest", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	tests := []struct {
+		key  string
+		c    *Config
+		want string // in the problem, "" for none
+	}{
+		// the default EBS encryption key has a counterpart in every region
+		{"aws-ebs", plain, ""},
+		{"single", plain, "single-Region key - add -k (--kms-key-id) or --kms-key-alias with a key in us-west-2"},
+		{"single", reencrypt, ""},
+		{"mrk-replicated", plain, ""},
+		{"mrk-replica", plain, ""},
+		{"mrk-alone", plain, "has no replica in us-west-2 - replicate it there, or add -k"},
+		{"mrk-alone", reencrypt, ""},
+		// re-encrypting can't help when the snapshot can't be read
+		{"disabled", reencrypt, "is Disabled"},
+	}
+	for _, tt := range tests {
+		key := testKeys[tt.key]
+		got := copyKeyProblem(&key, "us-west-2", tt.c)
+		if tt.want == "" && got != "" || tt.want != "" && !strings.Contains(got, tt.want) {
+			t.Errorf("copying under %s with -k %q: got %q, want %q", tt.key, tt.c.kmsKeyId, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCopyKeys(t *testing.T) {
+	c, err := parseTestOptions("-i", "/dev/sdh", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	// the volumes name their keys by alias as well as by ID
+	volumeKeys := map[string]string{
+		"vol-root":    "alias/aws/ebs",
+		"vol-data":    "arn:aws:kms:us-east-1:123456789012:alias/data",
+		"vol-logs":    "mrk-replicated",
+		"vol-plain":   "",
+		"vol-ignored": "single",
+	}
+	aliases := map[string]string{"alias/aws/ebs": "aws-ebs", "arn:aws:kms:us-east-1:123456789012:alias/data": "single"}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeVolumes": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeVolumesOutput{}
+			for _, id := range input.(*ec2.DescribeVolumesInput).VolumeIds {
+				volume := types.Volume{VolumeId: aws.String(id), Encrypted: aws.Bool(volumeKeys[id] != "")}
+				if volumeKeys[id] != "" {
+					volume.KmsKeyId = aws.String(volumeKeys[id])
+				}
+				out.Volumes = append(out.Volumes, volume)
+			}
+			return out, nil
+		},
+	})
+	k := newFakeAWS(t, map[string]fakeCall{
+		"DescribeKey": func(input interface{}) (interface{}, error) {
+			id := aws.ToString(input.(*kms.DescribeKeyInput).KeyId)
+			if alias, ok := aliases[id]; ok {
+				id = alias
+			}
+			key, ok := testKeys[id]
+			if !ok {
+				return nil, apiError("NotFoundException")
+			}
+			return &kms.DescribeKeyOutput{KeyMetadata: &key}, nil
+		},
+	})
+	awskms := kms.New(kms.Options{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}, APIOptions: []func(*middleware.Stack) error{k.apiOption}})
+	instance := &types.Instance{InstanceId: aws.String("i-0123456789abcdef0")}
+	for device, volume := range map[string]string{"/dev/xvda": "vol-root", "/dev/sdf": "vol-data", "/dev/sdg": "vol-logs", "/dev/sdi": "vol-plain", "/dev/sdh": "vol-ignored"} {
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(device), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String(volume)},
+		})
+	}
+
+	keys := newSourceKeys()
+	problems, err := checkCopyKeys(context.Background(), f.Client, awskms, keys, instance, []string{"us-east-1", "us-west-2", "eu-west-1"}, c)
+	if err != nil {
+		t.Fatalf("checkCopyKeys: %s", err)
+	}
+	want := []string{
+		"vol-data (/dev/sdf) to us-west-2: KMS key arn:aws:kms:us-east-1:123456789012:key/single is a single-Region key",
+		"vol-data (/dev/sdf) to eu-west-1: KMS key arn:aws:kms:us-east-1:123456789012:key/single is a single-Region key",
+		"vol-logs (/dev/sdg) to eu-west-1: multi-Region KMS key arn:aws:kms:us-east-1:123456789012:key/mrk-replicated has no replica in eu-west-1",
+	}
+	got := strings.Join(problems, "\n")
+	for _, problem := range want {
+		if !strings.Contains(got, problem) {
+			t.Errorf("problems don't include %q:\n%s", problem, got)
+		}
+	}
+	if len(problems) != len(want) {
+		t.Errorf("got %d problems, want %d:\n%s", len(problems), len(want), got)
+	}
+
+	// another instance on the same keys doesn't look them up again
+	before := k.count("DescribeKey")
+	if _, err := checkCopyKeys(context.Background(), f.Client, awskms, keys, instance, []string{"us-west-2"}, c); err != nil {
+		t.Fatalf("checkCopyKeys: %s", err)
+	}
+	if after := k.count("DescribeKey"); after != before {
+		t.Errorf("looked up %d keys again", after-before)
+	}
+}
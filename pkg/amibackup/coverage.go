@@ -0,0 +1,249 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// --coverage-report statuses, worst first
+const (
+	coverageUntagged = "untagged"        // no Name tag, so amibackup can't be pointed at it
+	coverageNever    = "never-backed-up" // no backups under its Name
+	coverageStale    = "stale"           // its newest backup is older than --coverage-max-age
+	coverageNoCopy   = "no-dr-copy"      // backed up, but missing from a dest region
+	coverageOK       = "covered"
+)
+
+var coverageRank = map[string]int{coverageUntagged: 0, coverageNever: 1, coverageStale: 2, coverageNoCopy: 3, coverageOK: 4}
+
+// coverageEntry is one running instance in the --coverage-report
+type coverageEntry struct {
+	Group       string   `json:"group"`
+	InstanceId  string   `json:"instance_id"`
+	Name        string   `json:"name"`
+	Status      string   `json:"status"`
+	Backups     int      `json:"backups"`
+	LastBackup  string   `json:"last_backup,omitempty"`
+	MissingFrom []string `json:"missing_from,omitempty"` // dest regions without a copy of a recent backup
+}
+
+// backupIndex is the newest backup time and backup count of each hostname in one region
+type backupIndex struct {
+	newest map[string]time.Time
+	count  map[string]int
+}
+
+// indexBackups lists every backup of ours in a region, by hostname tag, in one pass rather than
+// a DescribeImages per host
+func indexBackups(ctx context.Context, awsec2 *ec2.Client, c *Config) (*backupIndex, error) {
+	resp, err := describeAllImages(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("tag-key"), Values: c.hostnameKeys()}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	index := &backupIndex{newest: map[string]time.Time{}, count: map[string]int{}}
+	backups, _ := discovery.Classify(resp.Images, c.tags()) // the rest are incomplete, or not backups
+	for _, b := range backups {
+		if b.Image.State != types.ImageStateAvailable {
+			continue
+		}
+		host := coverageKey(b.Hostname, c)
+		index.count[host]++
+		if b.When.After(index.newest[host]) {
+			index.newest[host] = b.When
+		}
+	}
+	return index, nil
+}
+
+// coverageKey is the key a hostname is joined on: with --case-insensitive, any casing matches
+func coverageKey(hostname string, c *Config) string {
+	if c.caseInsensitive {
+		return strings.ToLower(hostname)
+	}
+	return hostname
+}
+
+// runningInstances lists every running instance in the source region
+func runningInstances(ctx context.Context, awsec2 *ec2.Client) ([]types.Instance, error) {
+	instances := []types.Instance{}
+	pages := ec2.NewDescribeInstancesPaginator(awsec2, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{{Name: aws.String("instance-state-name"), Values: []string{"running"}}},
+	})
+	for pages.HasMorePages() {
+		var page *ec2.DescribeInstancesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			page, err = pages.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, classErrorf(apiErrorClass(err, classDiscovery), "EC2 API DescribeInstances failed: %s", err.Error())
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceId != nil {
+					instances = append(instances, instance)
+				}
+			}
+		}
+	}
+	return instances, nil
+}
+
+// coverage joins every running instance in the source region against our backups there and in
+// the dest regions - an outer join, so an instance nobody backs up shows up too
+func coverage(ctx context.Context, clients *clientPool, dests []string, c *Config) ([]coverageEntry, error) {
+	instances, err := runningInstances(ctx, clients.EC2(c.sourceRegion, ""))
+	if err != nil {
+		return nil, err
+	}
+	source, err := indexBackups(ctx, clients.EC2(c.sourceRegion, ""), c)
+	if err != nil {
+		return nil, classify(classDiscovery, err)
+	}
+	copies := map[string]*backupIndex{}
+	for _, region := range dests {
+		if copies[region], err = indexBackups(ctx, clients.EC2(region, ""), c); err != nil {
+			return nil, classify(classDiscovery, fmt.Errorf("%s: %s", region, err.Error()))
+		}
+	}
+	entries := []coverageEntry{}
+	for i := range instances {
+		instance := &instances[i]
+		name := discovery.TagValue(instance.Tags, "Name")
+		e := coverageEntry{Group: discovery.TagValue(instance.Tags, c.coverageGroupTag), InstanceId: *instance.InstanceId, Name: name}
+		if e.Group == "" {
+			e.Group = "(none)"
+		}
+		host := coverageKey(c.hostname(name), c)
+		newest := source.newest[host]
+		e.Backups = source.count[host]
+		if !newest.IsZero() {
+			e.LastBackup = newest.UTC().Format(time.RFC3339)
+		}
+		for _, region := range dests {
+			// a copy lags its source by the copy time, so it counts if it is within the max age too
+			if copied := copies[region].newest[host]; name != "" && (copied.IsZero() || c.asOf.Sub(copied) > c.coverageMaxAge) {
+				e.MissingFrom = append(e.MissingFrom, region)
+			}
+		}
+		switch {
+		case name == "":
+			e.Status = coverageUntagged
+		case e.Backups == 0:
+			e.Status = coverageNever
+		case c.asOf.Sub(newest) > c.coverageMaxAge:
+			e.Status = coverageStale
+		case len(e.MissingFrom) > 0:
+			e.Status = coverageNoCopy
+		default:
+			e.Status = coverageOK
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch {
+		case a.Group != b.Group:
+			return a.Group < b.Group
+		case a.Status != b.Status:
+			return coverageRank[a.Status] < coverageRank[b.Status]
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		}
+		return a.InstanceId < b.InstanceId
+	})
+	return entries, nil
+}
+
+// coverageReport runs --coverage-report: it prints the report, writes --coverage-csv, and with
+// --fail-on-uncovered fails if any running instance isn't covered
+func coverageReport(ctx context.Context, clients *clientPool, dests []string, c *Config) error {
+	entries, err := coverage(ctx, clients, dests, c)
+	if err != nil {
+		return err
+	}
+	if c.coverageFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(entries)
+	} else {
+		printCoverage(os.Stdout, entries, c)
+	}
+	if err != nil {
+		return classErrorf(classInternal, "Error writing coverage report: %s", err.Error())
+	}
+	if c.coverageCSV != "" {
+		if err := writeCoverageCSV(c.coverageCSV, entries); err != nil {
+			return classErrorf(classInternal, "Error writing coverage-csv: %s", err.Error())
+		}
+		log.Printf("Wrote the coverage report to %s", c.coverageCSV)
+	}
+	uncovered := 0
+	for _, e := range entries {
+		if e.Status != coverageOK {
+			uncovered++
+		}
+	}
+	log.Printf("%d of %d running instances in %s are covered", len(entries)-uncovered, len(entries), c.sourceRegion)
+	if uncovered > 0 && c.failOnUncovered {
+		return classErrorf(classUncovered, "%d running instances in %s are not covered", uncovered, c.sourceRegion)
+	}
+	return nil
+}
+
+// printCoverage prints the coverage report as a table per group
+func printCoverage(out io.Writer, entries []coverageEntry, c *Config) {
+	if len(entries) == 0 {
+		fmt.Fprintf(out, "No running instances in %s\n", c.sourceRegion)
+		return
+	}
+	group := ""
+	for i, e := range entries {
+		if i == 0 || e.Group != group {
+			group = e.Group
+			fmt.Fprintf(out, "%s=%s:\n", c.coverageGroupTag, group)
+			fmt.Fprintf(out, "  %-16s %-20s %-24s %7s  %-20s %s\n", "STATUS", "INSTANCE", "NAME", "BACKUPS", "LAST BACKUP", "MISSING FROM")
+		}
+		last, missing := e.LastBackup, strings.Join(e.MissingFrom, ",")
+		if last == "" {
+			last = "-"
+		}
+		if missing == "" {
+			missing = "-"
+		}
+		fmt.Fprintf(out, "  %-16s %-20s %-24s %7d  %-20s %s\n", e.Status, e.InstanceId, quoteField(e.Name), e.Backups, last, missing)
+	}
+}
+
+// writeCoverageCSV writes the coverage report as CSV, for --coverage-csv
+func writeCoverageCSV(path string, entries []coverageEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"group", "instance_id", "name", "status", "backups", "last_backup", "missing_from"})
+	for _, e := range entries {
+		w.Write([]string{e.Group, e.InstanceId, e.Name, e.Status, strconv.Itoa(e.Backups), e.LastBackup, strings.Join(e.MissingFrom, " ")})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,126 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// coverageRegions returns a client pool whose source region runs these instances, and whose
+// regions hold these backups
+func coverageRegions(t *testing.T, instances []types.Instance, backups map[string][]types.Image) *clientPool {
+	clients := &clientPool{clients: map[clientKey]interface{}{}}
+	for region, images := range backups {
+		images := images
+		ops := map[string]fakeCall{"DescribeImages": func(interface{}) (interface{}, error) {
+			return &ec2.DescribeImagesOutput{Images: images}, nil
+		}}
+		if region == "us-east-1" {
+			ops["DescribeInstances"] = func(interface{}) (interface{}, error) {
+				return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: instances}}}, nil
+			}
+		}
+		clients.clients[clientKey{"ec2", region, ""}] = newFakeEC2(t, ops).Client
+	}
+	return clients
+}
+
+func TestCoverage(t *testing.T) {
+	asOf := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	instance := func(id, name, team string) types.Instance {
+		i := types.Instance{InstanceId: aws.String(id)}
+		for key, value := range map[string]string{"Name": name, "Team": team} {
+			if value != "" {
+				i.Tags = append(i.Tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+			}
+		}
+		return i
+	}
+	instances := []types.Instance{
+		instance("i-1", "web", "ops"), instance("i-2", "db", "ops"),
+		instance("i-3", "old", "data"), instance("i-4", "new", "data"),
+		instance("i-5", "", ""),
+	}
+	ago := func(hours int) time.Time { return asOf.Add(-time.Duration(hours) * time.Hour) }
+	failed := backupImages("db", map[string]time.Time{"failed": ago(1)})
+	failed[0].State = types.ImageStateFailed
+	clients := coverageRegions(t, instances, map[string][]types.Image{
+		"us-east-1": append(append(append(backupImages("web", map[string]time.Time{"1": ago(2), "2": ago(26)}),
+			backupImages("db", map[string]time.Time{"1": ago(2)})...),
+			backupImages("old", map[string]time.Time{"1": ago(30)})...), failed...),
+		// a copy lags its source, but within --coverage-max-age still covers it
+		"us-west-2": append(backupImages("web", map[string]time.Time{"1": ago(3)}), backupImages("old", map[string]time.Time{"1": ago(30)})...),
+	})
+	c, err := parseTestOptions("--coverage-report", "--source=us-east-1", "--as-of="+asOf.Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	entries, err := coverage(context.Background(), clients, []string{"us-west-2"}, c)
+	if err != nil {
+		t.Fatalf("coverage: %s", err)
+	}
+	// by group, worst first
+	want := []coverageEntry{
+		{Group: "(none)", InstanceId: "i-5", Status: coverageUntagged},
+		{Group: "data", InstanceId: "i-4", Name: "new", Status: coverageNever, MissingFrom: []string{"us-west-2"}},
+		{Group: "data", InstanceId: "i-3", Name: "old", Status: coverageStale, Backups: 1, LastBackup: "2026-03-09T06:00:00Z", MissingFrom: []string{"us-west-2"}},
+		{Group: "ops", InstanceId: "i-2", Name: "db", Status: coverageNoCopy, Backups: 1, LastBackup: "2026-03-10T10:00:00Z", MissingFrom: []string{"us-west-2"}},
+		{Group: "ops", InstanceId: "i-1", Name: "web", Status: coverageOK, Backups: 2, LastBackup: "2026-03-10T10:00:00Z"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("coverage() =\n%+v\nwant\n%+v", entries, want)
+	}
+
+	var out bytes.Buffer
+	printCoverage(&out, entries, c)
+	for _, line := range []string{"Team=(none):\n", "Team=data:\n", "  never-backed-up  i-4", "  covered          i-1                  web"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("coverage table doesn't have %q:\n%s", line, out.String())
+		}
+	}
+	path := filepath.Join(t.TempDir(), "coverage.csv")
+	if err := writeCoverageCSV(path, entries); err != nil {
+		t.Fatalf("writeCoverageCSV: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 6 || lines[3] != "data,i-3,old,stale,1,2026-03-09T06:00:00Z,us-west-2" {
+		t.Errorf("coverage CSV:\n%s", b)
+	}
+}
+
+func TestFailOnUncovered(t *testing.T) {
+	captureLog(t)
+	instances := []types.Instance{{InstanceId: aws.String("i-1"), Tags: []types.Tag{{Key: aws.String("Name"), Value: aws.String("web")}}}}
+	for _, backedUp := range []bool{true, false} {
+		backups := map[string][]types.Image{"us-east-1": nil}
+		if backedUp {
+			backups["us-east-1"] = backupImages("web", map[string]time.Time{"1": time.Now().Add(-time.Hour)})
+		}
+		c, err := parseTestOptions("--coverage-report", "--fail-on-uncovered", "--coverage-format=json", "--source=us-east-1")
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		err = coverageReport(context.Background(), coverageRegions(t, instances, backups), nil, c)
+		if backedUp && err != nil || !backedUp && classOf(err, classInternal) != classUncovered {
+			t.Errorf("backed up %v: coverageReport = %v", backedUp, err)
+		}
+	}
+	if classExitCodes[classUncovered] != 11 {
+		t.Errorf("uncovered exits %d, want 11", classExitCodes[classUncovered])
+	}
+	if _, err := parseTestOptions("--fail-on-uncovered", "web"); classOf(err, classInternal) != classConfig {
+		t.Errorf("--fail-on-uncovered without --coverage-report = %v, want a config error", err)
+	}
+}
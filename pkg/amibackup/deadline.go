@@ -0,0 +1,190 @@
+package amibackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// backupResult status of an instance --deadline left for a later run
+const statusDeferredDeadline = "deferred (deadline)"
+
+// deferredTag marks an instance --deadline left for a later run, which backs it up first.  Its
+// next successful backup removes it.
+const deferredTag = "amibackup:deferred"
+
+// errDeadline is the cause of the run's context being cancelled at --deadline
+var errDeadline = errors.New("deadline")
+
+// cutOff reports whether the run's context being cancelled stopped any work: a backup, or the
+// run itself
+func cutOff(summary *runSummary, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	for _, result := range summary.Backups {
+		if result.Stopped {
+			return true
+		}
+	}
+	return false
+}
+
+// the estimate of a backup's time for an instance with no recorded duration: a fixed part for
+// the image and copy to get going, and a part for each GB of its volumes.  Like --max-new-gb's
+// estimate it is on the high side - snapshots are incremental.
+var deadlineBaseEstimate = 10 * time.Minute
+var deadlineEstimatePerGB = 15 * time.Second
+
+// parseDeadline parses --deadline: a duration from now (4h), a time of day (05:00, the next one
+// to come), or an RFC 3339 time
+func parseDeadline(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("must be in the future")
+		}
+		return now.Add(d), nil
+	}
+	if clock, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		deadline := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !deadline.After(now) {
+			deadline = deadline.AddDate(0, 0, 1)
+		}
+		return deadline, nil
+	}
+	deadline, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("want a duration (4h), a time of day (05:00) or an RFC 3339 time")
+	}
+	if !deadline.After(now) {
+		return time.Time{}, fmt.Errorf("must be in the future")
+	}
+	return deadline, nil
+}
+
+// lastDuration is how long the newest backup of an instance with a recorded duration took
+func lastDuration(ctx context.Context, awsec2 *ec2.Client, instanceNameTag, instanceId string, c *Config) (time.Duration, bool, error) {
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{Owners: []string{"self"}}, instanceNameTag, c)
+	if err != nil {
+		return 0, false, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	backups, _ := discovery.Classify(resp.Images, c.tags())
+	newest, took := time.Time{}, time.Duration(0)
+	for _, b := range backups {
+		seconds, err := strconv.ParseInt(c.backupTag(b.Image.Tags, "duration"), 10, 64)
+		if err != nil || b.InstanceId != instanceId || !b.When.After(newest) {
+			continue
+		}
+		newest, took = b.When, time.Duration(seconds)*time.Second
+	}
+	return took, !newest.IsZero(), nil
+}
+
+// estimateDurations estimates each candidate's backup time: what its last recorded backup took,
+// or from the size of its volumes
+func estimateDurations(ctx context.Context, awsec2 *ec2.Client, candidates []candidate, c *Config) (map[string]time.Duration, error) {
+	if err := estimateNewGB(ctx, awsec2, candidates, c); err != nil {
+		return nil, err
+	}
+	estimates := map[string]time.Duration{}
+	for _, cand := range candidates {
+		id := *cand.instance.InstanceId
+		took, ok, err := lastDuration(ctx, awsec2, cand.instanceNameTag, id, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			took = deadlineBaseEstimate + time.Duration(cand.estimateGB)*deadlineEstimatePerGB
+		}
+		estimates[id] = took
+	}
+	return estimates, nil
+}
+
+// applyDeadline drops the instances whose backups won't finish by --deadline from instanceset,
+// returning their results.  Backups start in priority order, and each that is estimated to take
+// longer than the time left waits for a later run, tagged so that run starts it first.
+func applyDeadline(ctx context.Context, awsec2 *ec2.Client, instanceset map[string][]*types.Instance, c *Config) ([]backupResult, error) {
+	candidates := prioritize(instanceset, c)
+	estimates, err := estimateDurations(ctx, awsec2, candidates, c)
+	if err != nil {
+		return nil, classErrorf(apiErrorClass(err, classDiscovery), "Error estimating backup times for --deadline: %s", err.Error())
+	}
+	c.deadlineEstimates = estimates
+	left := time.Until(c.deadline)
+	log.Printf("%s left before --deadline %s", left.Round(time.Second), c.deadline.Format(time.RFC3339))
+	results := []backupResult{}
+	for name := range instanceset {
+		instanceset[name] = []*types.Instance{}
+	}
+	deferred := []string{}
+	for _, cand := range candidates {
+		id := *cand.instance.InstanceId
+		if estimates[id] <= left {
+			instanceset[cand.instanceNameTag] = append(instanceset[cand.instanceNameTag], cand.instance)
+			continue
+		}
+		log.Printf("Deferring %s (%s) to a later run: its backup is estimated at %s, with %s left before --deadline", cand.instanceNameTag, id, estimates[id].Round(time.Second), left.Round(time.Second))
+		results = append(results, backupResult{Instance: cand.instanceNameTag, InstanceId: id, Status: statusDeferredDeadline, EstimatedSeconds: int64(estimates[id].Seconds())})
+		deferred = append(deferred, id)
+	}
+	markDeferred(ctx, awsec2, deferred, c)
+	return results, nil
+}
+
+// markDeferred tags the instances --deadline deferred.  Failing to is logged, never fatal: they
+// are still backed up next run, just not first.
+func markDeferred(ctx context.Context, awsec2 *ec2.Client, ids []string, c *Config) {
+	if len(ids) == 0 {
+		return
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have tagged %d deferred instances %s", len(ids), deferredTag)
+		return
+	}
+	when := time.Now().UTC().Format(time.RFC3339)
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: ids, Tags: []types.Tag{{Key: aws.String(deferredTag), Value: aws.String(when)}}})
+		return err
+	})
+	if err != nil {
+		log.Printf("WARNING: can't tag deferred instances %s: EC2 API CreateTags failed: %s", deferredTag, err.Error())
+	}
+}
+
+// finishDeferred records how long an instance's new backup took on its source AMI, for the next
+// --deadline estimate, and removes the instance's deferredTag now that it is backed up - with or
+// without --deadline.  Failing to is logged, never fatal.
+func finishDeferred(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, amiId string, took time.Duration, c *Config) {
+	if c.dryRun {
+		return
+	}
+	if amiId != "" && !c.deadline.IsZero() {
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{amiId},
+				Tags: []types.Tag{{Key: aws.String(c.tagKey("duration")), Value: aws.String(strconv.FormatInt(int64(took.Seconds()), 10))}}})
+			return err
+		})
+		if err != nil {
+			log.Printf("WARNING: can't record the backup time on %s: EC2 API CreateTags failed: %s", amiId, err.Error())
+		}
+	}
+	if discovery.TagValue(instance.Tags, deferredTag) == "" {
+		return
+	}
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.DeleteTags(ctx, &ec2.DeleteTagsInput{Resources: []string{*instance.InstanceId}, Tags: []types.Tag{{Key: aws.String(deferredTag)}}})
+		return err
+	})
+	if err != nil && !raced(err, "DeleteTags", *instance.InstanceId, c) {
+		log.Printf("WARNING: can't remove %s from %s: EC2 API DeleteTags failed: %s", deferredTag, *instance.InstanceId, err.Error())
+	}
+}
@@ -0,0 +1,258 @@
+package amibackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestCutOff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups []backupResult
+		err     error
+		want    bool
+	}{
+		{"all finished", []backupResult{{Instance: "web"}, {Instance: "db"}}, nil, false},
+		{"failed on its own", []backupResult{{Instance: "web", Error: "EC2 API CreateImage failed"}}, errors.New("1 backup failed"), false},
+		{"backup stopped", []backupResult{{Instance: "web"}, {Instance: "db", Error: "context deadline exceeded", Stopped: true}}, nil, true},
+		{"run stopped", nil, fmt.Errorf("Error purging: %w", context.DeadlineExceeded), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cutOff(&runSummary{Backups: tt.backups}, tt.err); got != tt.want {
+				t.Errorf("cutOff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	grace := timeoutGrace
+	timeoutGrace = 20 * time.Millisecond
+	t.Cleanup(func() { timeoutGrace = grace })
+	captureLog(t)
+
+	expired := make(chan time.Duration, 1)
+	ctx, w := startWatchdog(context.Background(), 50*time.Millisecond, func(timeout time.Duration) { expired <- timeout })
+	// a later timeout holds it off; an earlier one doesn't bring it forward
+	w.extend(150*time.Millisecond, "more volumes")
+	w.extend(10*time.Millisecond, "fewer volumes")
+	select {
+	case <-ctx.Done():
+		t.Fatalf("cancelled before the extended timeout")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("not cancelled at the timeout")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, errTimeout) {
+		t.Errorf("cancelled by %v, want %v", cause, errTimeout)
+	}
+	// once it's up, it stays up
+	w.extend(time.Hour, "too late")
+	select {
+	case timeout := <-expired:
+		if timeout != 150*time.Millisecond {
+			t.Errorf("expired after %s, want the extended timeout", timeout)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("a run still going after the grace period wasn't ended")
+	}
+	var none *watchdog
+	none.extend(time.Hour, "no watchdog")
+
+	start := time.Now()
+	if err := pause(ctx, time.Hour); !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+		t.Errorf("pause on a cancelled context = %v after %s", err, time.Since(start))
+	}
+}
+
+// TestTimeoutRun checks that a run out of time stops its waits, cleans up and ends as a timeout
+func TestTimeoutRun(t *testing.T) {
+	fastPolls(t)
+	f := runFake(t, map[string]func(fakeCall) fakeCall{
+		"DescribeImages": func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				out, err := next(input)
+				if filters := input.(*ec2.DescribeImagesInput).Filters; len(filters) > 0 && aws.ToString(filters[0].Name) == "image-id" {
+					// the poller's: the new image never becomes available
+					for i := range out.(*ec2.DescribeImagesOutput).Images {
+						out.(*ec2.DescribeImagesOutput).Images[i].State = types.ImageStatePending
+					}
+				}
+				return out, err
+			}
+		},
+	}, "web")
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+		"--no-reconcile", "--no-progress", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	expired := make(chan time.Duration, 1)
+	ctx, w := startWatchdog(context.Background(), 200*time.Millisecond, func(timeout time.Duration) { expired <- timeout })
+	c.watchdog = w
+	summary, err := run(ctx, c)
+	if errors.Is(context.Cause(ctx), errTimeout) {
+		err = errTimeout
+	}
+	code := summary.setOutcome(err)
+	if summary.Status != statusTimeout || code != exitTimeout || len(expired) > 0 {
+		t.Errorf("run ended %s, exiting %d (watchdog expired %v); want %s, exiting %d", summary.Status, code, len(expired) > 0, statusTimeout, exitTimeout)
+	}
+	if len(summary.Backups) != 1 || !summary.Backups[0].Stopped || !cutOff(summary, nil) {
+		t.Errorf("backups %+v, want web's stopped by the timeout", summary.Backups)
+	}
+	// the in-progress tag comes off after the timeout
+	cleared := false
+	for _, in := range f.inputs("DeleteTags") {
+		for _, tag := range in.(*ec2.DeleteTagsInput).Tags {
+			cleared = cleared || aws.ToString(tag.Key) == inProgressTag
+		}
+	}
+	if !cleared {
+		t.Errorf("in-progress tag left on the stopped backup's image")
+	}
+}
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2026, 3, 1, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"4h", now.Add(4 * time.Hour), false},
+		{"90m", now.Add(90 * time.Minute), false},
+		// a time of day is the next one to come
+		{"23:00", time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC), false},
+		{"05:00", time.Date(2026, 3, 2, 5, 0, 0, 0, time.UTC), false},
+		{"22:30", time.Date(2026, 3, 2, 22, 30, 0, 0, time.UTC), false},
+		{"2026-03-02T05:00:00Z", time.Date(2026, 3, 2, 5, 0, 0, 0, time.UTC), false},
+		{"2026-03-01T22:30:00Z", time.Time{}, true},
+		{"0s", time.Time{}, true},
+		{"-1h", time.Time{}, true},
+		{"25:00", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDeadline(tt.value, now)
+		if !got.Equal(tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseDeadline(%q) = %s, %v; want %s, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := parseTestOptions("--deadline=yesterday", "web"); classOf(err, classInternal) != classConfig {
+		t.Errorf("--deadline=yesterday = %v, want a config error", err)
+	}
+}
+
+// TestDeadlineRun checks that a backup estimated to run past --deadline is deferred and tagged,
+// and that one that fits runs, records its time and clears its instance's deferral
+func TestDeadlineRun(t *testing.T) {
+	fastPolls(t)
+	when := time.Now().Add(-24 * time.Hour)
+	past := []types.Image{}
+	for _, b := range []struct {
+		id, instance, duration string
+		age                    time.Duration
+	}{
+		{"newest", "i-00000000000000001", "3600", 0},
+		{"older", "i-00000000000000001", "60", time.Hour},
+		// another instance's time, and a backup from before durations were recorded
+		{"other", "i-00000000000000009", "60", 0},
+		{"unrecorded", "i-00000000000000001", "", -time.Hour},
+	} {
+		img := backupImages("web", map[string]time.Time{b.id: when.Add(-b.age)})[0]
+		img.Tags = append(img.Tags, types.Tag{Key: aws.String("instance"), Value: aws.String(b.instance)})
+		if b.duration != "" {
+			img.Tags = append(img.Tags, types.Tag{Key: aws.String("duration"), Value: aws.String(b.duration)})
+		}
+		past = append(past, img)
+	}
+	f := runFake(t, map[string]func(fakeCall) fakeCall{
+		"DescribeImages": func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				for _, filter := range input.(*ec2.DescribeImagesInput).Filters {
+					if aws.ToString(filter.Name) == "tag:hostname" {
+						return (&contract{Images: past}).describe(input)
+					}
+				}
+				return next(input)
+			}
+		},
+		// db was deferred by an earlier run
+		"DescribeInstances": func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				out, err := next(input)
+				for _, r := range out.(*ec2.DescribeInstancesOutput).Reservations {
+					if discovery.TagValue(r.Instances[0].Tags, "Name") == "db" {
+						r.Instances[0].Tags = append(r.Instances[0].Tags, types.Tag{Key: aws.String(deferredTag), Value: aws.String("2026-03-01T05:00:00Z")})
+					}
+				}
+				return out, err
+			}
+		},
+	}, "web", "db")
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+		"--no-reconcile", "--no-progress", "--deadline=30m", "web", "db")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	summary, err := run(context.Background(), c)
+	summary.setOutcome(err)
+
+	// web's last backup took an hour; db has none, so 10m plus 15s for each of its 8 GB
+	if want := []string{"web (i-00000000000000001)"}; fmt.Sprint(summary.DeadlineDeferred) != fmt.Sprint(want) {
+		t.Errorf("deadline_deferred = %v, want %v", summary.DeadlineDeferred, want)
+	}
+	if c.deadlineEstimates["i-00000000000000002"] != deadlineBaseEstimate+8*deadlineEstimatePerGB {
+		t.Errorf("db's estimate is %s", c.deadlineEstimates["i-00000000000000002"])
+	}
+	results := map[string]backupResult{}
+	for _, r := range summary.Backups {
+		results[r.Instance] = r
+	}
+	if web := results["web"]; web.Status != statusDeferredDeadline || web.EstimatedSeconds != 3600 {
+		t.Errorf("web ended %q with an estimate of %ds, want deferred at 3600s", web.Status, web.EstimatedSeconds)
+	}
+	if db := results["db"]; db.SourceAMI == "" || db.Error != "" {
+		t.Errorf("db ended %+v (%v), want it backed up", db, err)
+	}
+	if n := f.count("CreateImage"); n != 1 {
+		t.Errorf("%d CreateImage calls, want only db's", n)
+	}
+
+	deferred, recorded := false, false
+	for _, in := range f.inputs("CreateTags") {
+		in := in.(*ec2.CreateTagsInput)
+		for _, tag := range in.Tags {
+			switch aws.ToString(tag.Key) {
+			case deferredTag:
+				deferred = fmt.Sprint(in.Resources) == "[i-00000000000000001]"
+			case "duration":
+				recorded = in.Resources[0] == results["db"].SourceAMI
+			}
+		}
+	}
+	if !deferred || !recorded {
+		t.Errorf("web tagged %s: %v; db's new AMI given its duration: %v", deferredTag, deferred, recorded)
+	}
+	cleared := false
+	for _, in := range f.inputs("DeleteTags") {
+		in := in.(*ec2.DeleteTagsInput)
+		cleared = cleared || (in.Resources[0] == "i-00000000000000002" && aws.ToString(in.Tags[0].Key) == deferredTag)
+	}
+	if !cleared {
+		t.Errorf("db's %s wasn't removed", deferredTag)
+	}
+}
@@ -0,0 +1,197 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// unchangedBackup returns the instance's newest available backup if none of the volumes it
+// backed up have been written to since their snapshots started, for --dedup-by-content, or nil
+// if the instance needs a new backup.  EC2 doesn't record when a volume was last written, so the
+// writes come from the volume's VolumeWriteOps metric; a volume with no metrics counts as changed.
+func unchangedBackup(ctx context.Context, awsec2, awsec2dest *ec2.Client, cw *cloudwatch.Client, instance *types.Instance, instanceNameTag string, c *Config) (*types.Image, error) {
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"available"}}},
+	}, instanceNameTag, c)
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	var latest *types.Image
+	latestTime := int64(0)
+	for i, image := range resp.Images {
+		if c.backupTag(image.Tags, "instance") != *instance.InstanceId {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(c.backupTag(image.Tags, "timestamp"), 10, 64)
+		if err == nil && timestamp > latestTime {
+			latest, latestTime = &resp.Images[i], timestamp
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	// every volume we'd back up now must be the one the backup's snapshot was taken of
+	snapDevices := map[string]string{}
+	for _, bd := range latest.BlockDeviceMappings {
+		if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+			snapDevices[aws.ToString(bd.DeviceName)] = *bd.Ebs.SnapshotId
+		}
+	}
+	volumes := map[string]string{}
+	for _, bd := range instance.BlockDeviceMappings {
+		device := aws.ToString(bd.DeviceName)
+		if bd.Ebs == nil || stringIn(device, c.ignoreVolumes) {
+			continue
+		}
+		if snapDevices[device] == "" {
+			log.Printf("%s has a volume at %s that %s didn't back up", instanceNameTag, device, *latest.ImageId)
+			return nil, nil
+		}
+		volumes[snapDevices[device]] = aws.ToString(bd.Ebs.VolumeId)
+	}
+	if len(volumes) != len(snapDevices) {
+		log.Printf("%s has fewer volumes than %s backed up", instanceNameTag, *latest.ImageId)
+		return nil, nil
+	}
+	snapIds := []string{}
+	for snap := range volumes {
+		snapIds = append(snapIds, snap)
+	}
+	var snaps *ec2.DescribeSnapshotsOutput
+	err = withFreshCredentials(ctx, awsec2, func() (err error) {
+		snaps, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: snapIds})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+	}
+	if len(snaps.Snapshots) != len(snapIds) {
+		return nil, nil
+	}
+	for _, snap := range snaps.Snapshots {
+		volumeId := volumes[*snap.SnapshotId]
+		if aws.ToString(snap.VolumeId) != volumeId || snap.StartTime == nil {
+			log.Printf("Volume %s of %s is not the volume snapshot %s was taken of", volumeId, instanceNameTag, *snap.SnapshotId)
+			return nil, nil
+		}
+		written, err := volumeWritten(ctx, cw, volumeId, *snap.StartTime, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if written {
+			return nil, nil
+		}
+	}
+
+	// a backup that never made it to the dest region isn't one to keep extending
+	if c.destRegion != c.sourceRegion {
+		copyId, err := findCopy(ctx, awsec2dest, *latest.ImageId, instanceNameTag, c)
+		if err != nil {
+			return nil, err
+		}
+		if copyId == "" {
+			log.Printf("%s has no copy in %s - backing %s up again", *latest.ImageId, c.destRegion, instanceNameTag)
+			return nil, nil
+		}
+	}
+	return latest, nil
+}
+
+// volumeWritten reports whether CloudWatch saw any writes to a volume between start and end, or
+// has no data for it at all
+func volumeWritten(ctx context.Context, cw *cloudwatch.Client, volumeId string, start, end time.Time) (bool, error) {
+	// hourly sums cover 60 days in CloudWatch's 1440 datapoint limit; daily sums go back further
+	period := int32(3600)
+	if end.Sub(start) > 60*24*time.Hour {
+		period = 86400
+	}
+	resp, err := cw.GetMetricStatistics(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/EBS"),
+		MetricName: aws.String("VolumeWriteOps"),
+		Dimensions: []cwtypes.Dimension{{Name: aws.String("VolumeId"), Value: aws.String(volumeId)}},
+		StartTime:  aws.Time(start),
+		EndTime:    aws.Time(end),
+		Period:     aws.Int32(period),
+		Statistics: []cwtypes.Statistic{cwtypes.StatisticSum},
+	})
+	if err != nil {
+		return true, fmt.Errorf("CloudWatch API GetMetricStatistics failed: %s", err.Error())
+	}
+	if len(resp.Datapoints) == 0 {
+		return true, nil
+	}
+	for _, point := range resp.Datapoints {
+		if aws.ToFloat64(point.Sum) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findCopy returns the dest region copy of a source AMI, found by the source AMI ID that ends
+// every copy's name (followed by the dest region, since copies were named for it), or "" if
+// there is none
+func findCopy(ctx context.Context, awsec2dest *ec2.Client, amiId, instanceNameTag string, c *Config) (string, error) {
+	resp, err := describeBackups(ctx, awsec2dest, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"available"}}},
+	}, instanceNameTag, c)
+	if err != nil {
+		return "", fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	for _, image := range resp.Images {
+		if name := aws.ToString(image.Name); strings.HasSuffix(name, "-"+amiId) || strings.HasSuffix(name, "-"+amiId+"-"+c.destRegion) {
+			return *image.ImageId, nil
+		}
+	}
+	return "", nil
+}
+
+// extendBackup moves an unchanged instance's last backup, and its copy, to this run's date and
+// timestamp, so purge windows treat it as the newest backup
+func extendBackup(ctx context.Context, awsec2, awsec2dest *ec2.Client, image *types.Image, instanceNameTag string, c *Config) error {
+	tags := []types.Tag{
+		{Key: aws.String(c.tagKey("date")), Value: aws.String(timeString)},
+		{Key: aws.String(c.tagKey("timestamp")), Value: aws.String(timeSecs)},
+	}
+	copyId := ""
+	if c.destRegion != c.sourceRegion {
+		var err error
+		if copyId, err = findCopy(ctx, awsec2dest, *image.ImageId, instanceNameTag, c); err != nil {
+			return err
+		}
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have extended timestamp on %s and its copy %s to %s", *image.ImageId, copyId, timeString)
+		return nil
+	}
+	err := withFreshCredentials(ctx, awsec2, func() error {
+		_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{*image.ImageId}, Tags: tags})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("EC2 API CreateTags failed for %s: %s", *image.ImageId, err.Error())
+	}
+	if copyId != "" {
+		err = withFreshCredentials(ctx, awsec2dest, func() error {
+			_, err := awsec2dest.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{copyId}, Tags: tags})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API CreateTags failed for %s: %s", copyId, err.Error())
+		}
+	}
+	return nil
+}
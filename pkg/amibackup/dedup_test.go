@@ -0,0 +1,181 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// dedupBackup is a backup of instance i-1 at when, of a root and a data volume
+func dedupBackup(id string, when time.Time) types.Image {
+	img := types.Image{ImageId: aws.String(id), Name: aws.String("web-" + id), State: types.ImageStateAvailable}
+	for _, device := range []string{"/dev/xvda", "/dev/sdf"} {
+		img.BlockDeviceMappings = append(img.BlockDeviceMappings, types.BlockDeviceMapping{
+			DeviceName: aws.String(device),
+			Ebs:        &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id + device[5:])},
+		})
+	}
+	img.Tags = []types.Tag{
+		{Key: aws.String("hostname"), Value: aws.String("web")},
+		{Key: aws.String("instance"), Value: aws.String("i-1")},
+		{Key: aws.String("timestamp"), Value: aws.String(fmt.Sprint(when.Unix()))},
+	}
+	return img
+}
+
+// dedupInstance is instance i-1, with volumes at the devices given, each named vol-<device>
+func dedupInstance(devices ...string) *types.Instance {
+	instance := &types.Instance{InstanceId: aws.String("i-1")}
+	for _, device := range devices {
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(device),
+			Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-" + device[5:])},
+		})
+	}
+	return instance
+}
+
+func TestUnchangedBackup(t *testing.T) {
+	now := time.Now()
+	older, newer := dedupBackup("ami-older", now.Add(-48*time.Hour)), dedupBackup("ami-newer", now.Add(-24*time.Hour))
+	// the newer backup's snapshots, each taken of its device's volume
+	snapshots := func(input interface{}) (interface{}, error) {
+		out := &ec2.DescribeSnapshotsOutput{}
+		for _, id := range input.(*ec2.DescribeSnapshotsInput).SnapshotIds {
+			out.Snapshots = append(out.Snapshots, types.Snapshot{
+				SnapshotId: aws.String(id),
+				VolumeId:   aws.String("vol-" + id[len("snap-ami-newer"):]),
+				StartTime:  aws.Time(now.Add(-24 * time.Hour)),
+			})
+		}
+		return out, nil
+	}
+	writes := func(sum float64) fakeCall {
+		return func(interface{}) (interface{}, error) {
+			return &cloudwatch.GetMetricStatisticsOutput{Datapoints: []cwtypes.Datapoint{{Sum: aws.Float64(0)}, {Sum: aws.Float64(sum)}}}, nil
+		}
+	}
+	copies := func(names ...string) fakeCall {
+		return func(interface{}) (interface{}, error) {
+			out := &ec2.DescribeImagesOutput{}
+			for _, name := range names {
+				out.Images = append(out.Images, types.Image{ImageId: aws.String("ami-copy"), Name: aws.String(name), State: types.ImageStateAvailable})
+			}
+			return out, nil
+		}
+	}
+	tests := []struct {
+		name      string
+		instance  *types.Instance
+		snapshots fakeCall
+		metrics   fakeCall
+		copies    fakeCall
+		want      string // the backup to extend, "" for a new backup
+	}{
+		{"unchanged", dedupInstance("/dev/xvda", "/dev/sdf"), snapshots, writes(0), copies("web-ami-newer-us-west-2"), "ami-newer"},
+		{"copy named before per-region names", dedupInstance("/dev/xvda", "/dev/sdf"), snapshots, writes(0), copies("web-ami-newer"), "ami-newer"},
+		// the data volume changed though the root didn't
+		{"written", dedupInstance("/dev/xvda", "/dev/sdf"), snapshots, writes(12), copies("web-ami-newer-us-west-2"), ""},
+		{"no metrics", dedupInstance("/dev/xvda", "/dev/sdf"), snapshots, func(interface{}) (interface{}, error) {
+			return &cloudwatch.GetMetricStatisticsOutput{}, nil
+		}, copies("web-ami-newer-us-west-2"), ""},
+		{"volume added", dedupInstance("/dev/xvda", "/dev/sdf", "/dev/sdg"), snapshots, writes(0), copies("web-ami-newer-us-west-2"), ""},
+		{"volume detached", dedupInstance("/dev/xvda"), snapshots, writes(0), copies("web-ami-newer-us-west-2"), ""},
+		{"volume replaced", dedupInstance("/dev/xvda", "/dev/sdf"), func(input interface{}) (interface{}, error) {
+			out, _ := snapshots(input)
+			out.(*ec2.DescribeSnapshotsOutput).Snapshots[0].VolumeId = aws.String("vol-restored")
+			return out, nil
+		}, writes(0), copies("web-ami-newer-us-west-2"), ""},
+		{"no copy", dedupInstance("/dev/xvda", "/dev/sdf"), snapshots, writes(0), copies("web-ami-older-us-west-2"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions("--dedup-by-content", "--dest=us-west-2", "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			source := newFakeEC2(t, map[string]fakeCall{
+				"DescribeImages": func(interface{}) (interface{}, error) {
+					return &ec2.DescribeImagesOutput{Images: []types.Image{older, newer}}, nil
+				},
+				"DescribeSnapshots": tt.snapshots,
+			})
+			dest := newFakeEC2(t, map[string]fakeCall{"DescribeImages": tt.copies})
+			f := newFakeAWS(t, map[string]fakeCall{"GetMetricStatistics": tt.metrics})
+			cw := cloudwatch.New(cloudwatch.Options{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}, APIOptions: []func(*middleware.Stack) error{f.apiOption}})
+
+			existing, err := unchangedBackup(context.Background(), source.Client, dest.Client, cw, tt.instance, "web", c)
+			if err != nil {
+				t.Fatalf("unchangedBackup: %s", err)
+			}
+			got := ""
+			if existing != nil {
+				got = aws.ToString(existing.ImageId)
+			}
+			if got != tt.want {
+				t.Errorf("unchangedBackup = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVolumeWrittenPeriod(t *testing.T) {
+	f := newFakeAWS(t, map[string]fakeCall{"GetMetricStatistics": func(interface{}) (interface{}, error) {
+		return &cloudwatch.GetMetricStatisticsOutput{Datapoints: []cwtypes.Datapoint{{Sum: aws.Float64(0)}}}, nil
+	}})
+	cw := cloudwatch.New(cloudwatch.Options{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}, APIOptions: []func(*middleware.Stack) error{f.apiOption}})
+	now := time.Now()
+	for _, age := range []time.Duration{24 * time.Hour, 90 * 24 * time.Hour} {
+		if written, err := volumeWritten(context.Background(), cw, "vol-1", now.Add(-age), now); err != nil || written {
+			t.Errorf("volumeWritten over %s = %v, %v, want false", age, written, err)
+		}
+	}
+	// hourly sums for a day, but daily ones past CloudWatch's 1440 datapoint limit
+	inputs := f.inputs("GetMetricStatistics")
+	for i, want := range []int32{3600, 86400} {
+		if period := aws.ToInt32(inputs[i].(*cloudwatch.GetMetricStatisticsInput).Period); period != want {
+			t.Errorf("call %d asked for a period of %d, want %d", i, period, want)
+		}
+	}
+}
+
+func TestExtendBackup(t *testing.T) {
+	c, err := parseTestOptions("--dedup-by-content", "--dest=us-west-2", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	ok := func(interface{}) (interface{}, error) { return &ec2.CreateTagsOutput{}, nil }
+	source := newFakeEC2(t, map[string]fakeCall{"CreateTags": ok})
+	dest := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(interface{}) (interface{}, error) {
+			return &ec2.DescribeImagesOutput{Images: []types.Image{{ImageId: aws.String("ami-copy"), Name: aws.String("web-ami-newer-us-west-2")}}}, nil
+		},
+		"CreateTags": ok,
+	})
+	img := dedupBackup("ami-newer", time.Now().Add(-24*time.Hour))
+	if err := extendBackup(context.Background(), source.Client, dest.Client, &img, "web", c); err != nil {
+		t.Fatalf("extendBackup: %s", err)
+	}
+	for _, tagged := range []struct {
+		f  *fakeEC2
+		id string
+	}{{source, "ami-newer"}, {dest, "ami-copy"}} {
+		inputs := tagged.f.inputs("CreateTags")
+		if len(inputs) != 1 {
+			t.Fatalf("%s tagged %d times, want once", tagged.id, len(inputs))
+		}
+		in := inputs[0].(*ec2.CreateTagsInput)
+		if in.Resources[0] != tagged.id || discovery.TagValue(in.Tags, "timestamp") != timeSecs || discovery.TagValue(in.Tags, "date") != timeString {
+			t.Errorf("CreateTags(%v, %v), want %s moved to this run", in.Resources, in.Tags, tagged.id)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package amibackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// regionPattern is what an AWS region name looks like, e.g. us-west-2 or us-gov-east-1
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]*)?-[a-z]+-\d+$`)
+
+// loadDestMap reads a --dest-map file
+func loadDestMap(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDestMap(data, path)
+}
+
+// parseDestMap parses a --dest-map file: a JSON object from data classification to its approved
+// destination region, or list of regions, e.g. {"pci": "us-west-2", "internal": ["us-east-2", "eu-west-1"]}.
+// Errors give the line of the classification at fault.
+func parseDestMap(data []byte, source string) (map[string][]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	lineAt := func(offset int64) int {
+		if offset > int64(len(data)) {
+			offset = int64(len(data))
+		}
+		return 1 + bytes.Count(data[:offset], []byte("\n"))
+	}
+	syntaxError := func(err error) error {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return fmt.Errorf("%s line %d: %s", source, lineAt(se.Offset), se.Error())
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%s: unexpected end of file", source)
+		}
+		return fmt.Errorf("%s line %d: %s", source, lineAt(dec.InputOffset()), err.Error())
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("%s line %d: want a JSON object of classification to region(s)", source, lineAt(dec.InputOffset()))
+	}
+	destMap := map[string][]string{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		classification := tok.(string)
+		line := lineAt(dec.InputOffset())
+		if classification == "" {
+			return nil, fmt.Errorf("%s line %d: empty classification", source, line)
+		}
+		if _, dup := destMap[classification]; dup {
+			return nil, fmt.Errorf("%s line %d: classification %q is listed twice", source, line, classification)
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, syntaxError(err)
+		}
+		var regions []string
+		var region string
+		if json.Unmarshal(raw, &region) == nil {
+			regions = []string{region}
+		} else if json.Unmarshal(raw, &regions) != nil {
+			return nil, fmt.Errorf("%s line %d: classification %q: want a region or a list of regions, not %s", source, line, classification, raw)
+		}
+		if len(regions) == 0 {
+			return nil, fmt.Errorf("%s line %d: classification %q maps to no region", source, line, classification)
+		}
+		for _, r := range regions {
+			if !regionPattern.MatchString(r) {
+				return nil, fmt.Errorf("%s line %d: classification %q: %q is not an AWS region", source, line, classification, r)
+			}
+		}
+		destMap[classification] = regions
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, syntaxError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%s line %d: unexpected data after the map", source, lineAt(dec.InputOffset()))
+	}
+	if len(destMap) == 0 {
+		return nil, fmt.Errorf("%s: the map is empty", source)
+	}
+	return destMap, nil
+}
+
+// destRegions returns every region backups may be copied to: each --dest, or with --dest-map every
+// region in the map
+func (c *Config) destRegions() []string {
+	if c.destMap == nil {
+		return c.dests
+	}
+	seen := map[string]bool{}
+	regions := []string{}
+	for _, list := range c.destMap {
+		for _, region := range list {
+			if !seen[region] {
+				seen[region] = true
+				regions = append(regions, region)
+			}
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// forDest returns the config for copying to one dest region
+func (c *Config) forDest(region string) *Config {
+	if region == c.destRegion {
+		return c
+	}
+	dc := *c
+	dc.destRegion = region
+	return &dc
+}
+
+// copyIndex is the place of c's dest region among an instance's destinations, from 1 - or 1 if
+// they can't be worked out
+func copyIndex(instance *types.Instance, c *Config) int {
+	regions, err := instanceDestinations(instance, c)
+	if err != nil {
+		return 1
+	}
+	for i, region := range regions {
+		if region == c.destRegion {
+			return i + 1
+		}
+	}
+	return 1
+}
+
+// instanceDestinations returns the regions to copy an instance's backup to: each --dest, or with
+// --dest-map the regions approved for the instance's classification tag
+func instanceDestinations(instance *types.Instance, c *Config) ([]string, error) {
+	if c.destMap == nil {
+		return c.dests, nil
+	}
+	classification := discovery.TagValue(instance.Tags, c.classificationTag)
+	if classification == "" {
+		return nil, fmt.Errorf("instance %s has no %s tag, so no approved destination region", *instance.InstanceId, c.classificationTag)
+	}
+	regions := c.destMap[classification]
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("classification %q of instance %s maps to no region in the dest map", classification, *instance.InstanceId)
+	}
+	return regions, nil
+}
+
+// singleDestOption returns the first option given that acts on a single dest region, so can't be
+// used with --dest-map or more than one --dest
+func singleDestOption(arguments map[string]interface{}) (string, bool) {
+	for _, opt := range []string{"--kms-key-id", "--kms-key-alias", "--no-wait", "--dedup-by-content"} {
+		if v := arguments[opt]; v != nil && v != false {
+			return opt, true
+		}
+	}
+	return "", false
+}
+
+// copiesElsewhere reports whether any of an instance's dest regions is not the source region
+func copiesElsewhere(regions []string, c *Config) bool {
+	for _, region := range regions {
+		if region != c.sourceRegion {
+			return true
+		}
+	}
+	return false
+}
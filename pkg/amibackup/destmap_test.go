@@ -0,0 +1,157 @@
+package amibackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestCopiesToTwoDestinations(t *testing.T) {
+	fastPolls(t)
+	f := runFake(t, nil, "web")
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--dest=eu-west-1", "--timeout=10m",
+		"--freeze-parameter=none", "--no-reconcile", "--no-progress",
+		"--description-template={{.InstanceNameTag}} copy {{.CopyIndex}} in {{.DestRegion}}", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	if _, err := run(context.Background(), c); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	copies := f.inputs("CopyImage")
+	if len(copies) != 2 {
+		t.Fatalf("CopyImage called %d times, want once for each dest", len(copies))
+	}
+	tags := map[string][]types.Tag{} // by copy
+	for _, in := range f.inputs("CreateTags") {
+		in := in.(*ec2.CreateTagsInput)
+		for _, id := range in.Resources {
+			tags[id] = append(tags[id], in.Tags...)
+		}
+	}
+	images := []types.Image{}
+	names := map[string]bool{}
+	for _, in := range copies {
+		in := in.(*ec2.CopyImageInput)
+		name, description := aws.ToString(in.Name), aws.ToString(in.Description)
+		region := strings.TrimPrefix(description[strings.LastIndex(description, " "):], " ")
+		if !strings.HasSuffix(name, "-"+region) || names[name] {
+			t.Errorf("copy to %s named %s, want a name of its own ending in its region", region, name)
+		}
+		names[name] = true
+		index := map[string]string{"us-west-2": "1", "eu-west-1": "2"}[region]
+		if index == "" || description != "web copy "+index+" in "+region {
+			t.Errorf("copy described as %q, want its index and region", description)
+		}
+		img := image("ami-"+name, "snap-"+name)
+		img.Name, img.Tags = aws.String(name), tags["ami-"+name]
+		if got := c.backupTag(img.Tags, "destregion"); got != region {
+			t.Errorf("copy %s tagged destregion %q, want %s", name, got, region)
+		}
+		if got := c.backupTag(img.Tags, "sourceregion"); got != "us-east-1" {
+			t.Errorf("copy %s tagged sourceregion %q, want us-east-1", name, got)
+		}
+		images = append(images, img)
+	}
+
+	// whatever the copies are named, the purge and snapshot tagging find them by their tags
+	k := &contract{Images: images}
+	fake := newFakeEC2(t, map[string]fakeCall{"DescribeImages": k.describe})
+	records, err := purgeAMIs(context.Background(), fake.Client, "us-west-2", "web", c, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	purged := []string{}
+	for _, r := range records {
+		purged = append(purged, r.AmiId)
+	}
+	amis, _, err := findAMIs(context.Background(), "web", fake.Client, fake.Client, c)
+	if err != nil {
+		t.Fatalf("findAMIs: %s", err)
+	}
+	found := []string{}
+	for id := range amis {
+		found = append(found, id)
+	}
+	sort.Strings(purged)
+	sort.Strings(found)
+	want := []string{}
+	for name := range names {
+		want = append(want, "ami-"+name)
+	}
+	sort.Strings(want)
+	if strings.Join(purged, ",") != strings.Join(want, ",") || strings.Join(found, ",") != strings.Join(want, ",") {
+		t.Errorf("purge considered %v and findAMIs found %v, want both copies %v", purged, found, want)
+	}
+}
+
+func TestMultipleDestOptions(t *testing.T) {
+	// a repeated region is copied to once
+	c, err := parseTestOptions("-d", "us-west-2", "-d", "eu-west-1", "--dest=us-west-2", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	if want := []string{"us-west-2", "eu-west-1"}; !reflect.DeepEqual(c.destRegions(), want) || c.destRegion != "us-west-2" {
+		t.Errorf("dest regions %v (first %s), want %v", c.destRegions(), c.destRegion, want)
+	}
+	// --retag shares the pattern -d is repeated in
+	if c, err := parseTestOptions("--retag", "-d", "us-west-2", "-d", "eu-west-1", "web"); err != nil || len(c.destRegions()) != 2 {
+		t.Errorf("--retag with two -d: %v", err)
+	}
+
+	destMap := filepath.Join(t.TempDir(), "dests.json")
+	if err := os.WriteFile(destMap, []byte(`{"pci": "us-west-2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][]string{{"--kms-key-id=arn:aws:kms:us-west-2:123456789012:key/backup"}, {"--kms-key-alias=alias/backup"}, {"--no-wait"},
+		{"--dedup-by-content"}, {"--dest-map=" + destMap, "--classification-tag=DataClass"}} {
+		if _, err := parseTestOptions(append(opts, "-d", "us-west-2", "-d", "eu-west-1", "web")...); classOf(err, classInternal) != classConfig ||
+			!strings.Contains(err.Error(), "more than one --dest") {
+			t.Errorf("%s with two -d = %v, want it refused", opts[0], err)
+		}
+		if _, err := parseTestOptions(append(opts, "-d", "us-west-2", "web")...); err != nil && strings.Contains(err.Error(), "more than one --dest") {
+			t.Errorf("%s with one -d refused: %s", opts[0], err)
+		}
+	}
+}
+
+func TestMultipleDestResults(t *testing.T) {
+	fastPolls(t)
+	f := runFake(t, nil, "web")
+	c, err := parseTestOptions("--source=us-east-1", "-d", "us-west-2", "-d", "eu-west-1", "--timeout=10m",
+		"--freeze-parameter=none", "--no-reconcile", "--no-progress", "-p", "1d:4d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	summary, err := run(context.Background(), c)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if len(summary.Backups) != 1 {
+		t.Fatalf("%d backups, want 1", len(summary.Backups))
+	}
+	r := summary.Backups[0]
+	if want := []string{"us-west-2", "eu-west-1"}; !reflect.DeepEqual(r.DestRegions, want) || len(r.Copies) != 2 || r.Copies["eu-west-1"] == "" {
+		t.Errorf("result copied to %v as %v, want a copy in each of %v", r.DestRegions, r.Copies, want)
+	}
+	if f.count("CopyImage") != 2 {
+		t.Errorf("%d copies made, want 2", f.count("CopyImage"))
+	}
+	// each region is purged on its own: the source and both dests
+	regions := map[string]bool{}
+	for _, stat := range summary.Retention {
+		regions[stat.Region] = true
+	}
+	if len(regions) != 3 || !regions["us-east-1"] || !regions["us-west-2"] || !regions["eu-west-1"] {
+		t.Errorf("purged %v, want the source and both dest regions", regions)
+	}
+}
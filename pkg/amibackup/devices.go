@@ -0,0 +1,276 @@
+package amibackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// most block device mappings EC2 takes for one image - the most EBS volumes any instance type
+// can have attached
+const maxBlockDeviceMappings = 128
+
+// the default --timeout covers instances with up to timeoutBaseVolumes volumes; each included
+// volume past that adds timeoutPerVolume, as snapshotting fans out per volume
+const (
+	timeoutBaseVolumes = 8
+	timeoutPerVolume   = 5 * time.Minute
+)
+
+// excludedDevices returns the devices an instance's image leaves out: its --ignore devices, and
+// every device --only-devices doesn't list
+func excludedDevices(instance *types.Instance, c *Config) map[string]bool {
+	excluded := map[string]bool{}
+	for _, device := range c.ignoreVolumes {
+		excluded[device] = true
+	}
+	if len(c.onlyDevices) > 0 {
+		for _, mapping := range instance.BlockDeviceMappings {
+			if device := aws.ToString(mapping.DeviceName); !stringIn(device, c.onlyDevices) {
+				excluded[device] = true
+			}
+		}
+	}
+	return excluded
+}
+
+// imageBlockDevices returns the CreateImage block device mappings that leave out an instance's
+// excludedDevices, along with how many of its volumes the image includes
+func imageBlockDevices(instance *types.Instance, c *Config) ([]types.BlockDeviceMapping, int, error) {
+	if root := aws.ToString(instance.RootDeviceName); len(c.onlyDevices) > 0 && root != "" && !stringIn(root, c.onlyDevices) {
+		return nil, 0, fmt.Errorf("--only-devices must include %s's root device %s - EC2 can't image an instance without it", aws.ToString(instance.InstanceId), root)
+	}
+	excluded := excludedDevices(instance, c)
+	included := 0
+	for _, mapping := range instance.BlockDeviceMappings {
+		if !excluded[aws.ToString(mapping.DeviceName)] {
+			included++
+		}
+	}
+	devices := make([]string, 0, len(excluded))
+	for device := range excluded {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	if len(devices) > maxBlockDeviceMappings || included > maxBlockDeviceMappings {
+		return nil, 0, fmt.Errorf("imaging %s would take more block device mappings than EC2's limit of %d (%d volumes kept, %d devices left out)",
+			aws.ToString(instance.InstanceId), maxBlockDeviceMappings, included, len(devices))
+	}
+	mappings := []types.BlockDeviceMapping{}
+	for _, device := range devices {
+		mappings = append(mappings, types.BlockDeviceMapping{DeviceName: aws.String(device), NoDevice: aws.String("")})
+	}
+	return mappings, included, nil
+}
+
+// unprotectedVolumes returns the volumes an instance's image leaves out that outlive the instance
+// (DeleteOnTermination is off) and aren't tagged --unprotected-ok-tag, as "vol-id (device)".
+// Leaving out scratch space is fine, but a persistent volume left out is data nothing backs up.
+func unprotectedVolumes(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, c *Config) ([]string, error) {
+	excluded := excludedDevices(instance, c)
+	devices := map[string]string{} // volume to device
+	volumeIds := []string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		device := aws.ToString(mapping.DeviceName)
+		if !excluded[device] || mapping.Ebs == nil || mapping.Ebs.VolumeId == nil || aws.ToBool(mapping.Ebs.DeleteOnTermination) {
+			continue
+		}
+		devices[*mapping.Ebs.VolumeId] = device
+		volumeIds = append(volumeIds, *mapping.Ebs.VolumeId)
+	}
+	if len(volumeIds) == 0 {
+		return nil, nil
+	}
+	var resp *ec2.DescribeVolumesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: volumeIds})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeVolumes failed: %s", err.Error())
+	}
+	acknowledged := map[string]bool{}
+	for _, volume := range resp.Volumes {
+		for _, tag := range volume.Tags {
+			if aws.ToString(tag.Key) == c.unprotectedOK.key && (c.unprotectedOK.any || aws.ToString(tag.Value) == c.unprotectedOK.value) {
+				acknowledged[aws.ToString(volume.VolumeId)] = true
+			}
+		}
+	}
+	unprotected := []string{}
+	for _, id := range volumeIds {
+		if !acknowledged[id] {
+			unprotected = append(unprotected, fmt.Sprintf("%s (%s)", id, devices[id]))
+		}
+	}
+	return unprotected, nil
+}
+
+// deviceCheck is whether one of an instance's volumes is in the image made of it as it should
+// be - a volume left out that ends up in the image is data leaking to wherever the image is copied
+type deviceCheck struct {
+	Device   string `json:"device"`
+	VolumeId string `json:"volume_id,omitempty"`
+	Excluded bool   `json:"excluded"`
+	InImage  bool   `json:"in_image"`
+	OK       bool   `json:"ok"`
+}
+
+// deviceKey spells a device name the way EC2 may have spelled it back - /dev/xvdf and sdf are
+// /dev/sdf - so a mapping isn't missed for its spelling
+func deviceKey(device string) string {
+	device = strings.TrimPrefix(device, "/dev/")
+	if strings.HasPrefix(device, "xvd") {
+		device = "sd" + strings.TrimPrefix(device, "xvd")
+	}
+	return device
+}
+
+// verifyExclusions checks a new image against the instance it was made of: every device
+// excludedDevices leaves out must be absent, and every other attached EBS volume present.  A
+// volume counts as in the image if a mapping has its device, whatever the spelling, or a
+// snapshot was taken of it.  It returns the check of each volume, failing if any is wrong.
+func verifyExclusions(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, amiId string, c *Config) ([]deviceCheck, error) {
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiId}})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeImages failed for %s: %s", amiId, err.Error())
+	}
+	if len(resp.Images) != 1 {
+		return nil, fmt.Errorf("AMI %s not found", amiId)
+	}
+	imaged := map[string]bool{} // device keys and source volumes in the image
+	snapshotIds := []string{}
+	for _, mapping := range resp.Images[0].BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.NoDevice != nil {
+			continue
+		}
+		imaged[deviceKey(aws.ToString(mapping.DeviceName))] = true
+		if id := aws.ToString(mapping.Ebs.SnapshotId); id != "" {
+			snapshotIds = append(snapshotIds, id)
+		}
+	}
+	if len(snapshotIds) > 0 {
+		var snaps *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			snaps, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: snapshotIds})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("EC2 API DescribeSnapshots failed for %s: %s", amiId, err.Error())
+		}
+		for _, snap := range snaps.Snapshots {
+			imaged[aws.ToString(snap.VolumeId)] = true
+		}
+	}
+	excluded := map[string]bool{}
+	for device := range excludedDevices(instance, c) {
+		excluded[deviceKey(device)] = true
+	}
+	checks := []deviceCheck{}
+	leaked, missing := []string{}, []string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs == nil || mapping.Ebs.VolumeId == nil {
+			continue
+		}
+		device := aws.ToString(mapping.DeviceName)
+		check := deviceCheck{Device: device, VolumeId: *mapping.Ebs.VolumeId, Excluded: excluded[deviceKey(device)]}
+		check.InImage = imaged[deviceKey(device)] || imaged[check.VolumeId]
+		check.OK = check.Excluded != check.InImage
+		switch {
+		case !check.OK && check.Excluded:
+			leaked = append(leaked, fmt.Sprintf("%s (%s)", check.VolumeId, device))
+		case !check.OK:
+			missing = append(missing, fmt.Sprintf("%s (%s)", check.VolumeId, device))
+		}
+		checks = append(checks, check)
+	}
+	switch {
+	case len(leaked) > 0:
+		return checks, fmt.Errorf("AMI %s includes volumes that were meant to be left out: %s", amiId, strings.Join(leaked, ", "))
+	case len(missing) > 0:
+		return checks, fmt.Errorf("AMI %s is missing volumes that were meant to be in it: %s", amiId, strings.Join(missing, ", "))
+	}
+	return checks, nil
+}
+
+// scaledTimeout is the default --timeout stretched for an instance with this many included volumes
+func scaledTimeout(base time.Duration, volumes int) time.Duration {
+	if volumes <= timeoutBaseVolumes {
+		return base
+	}
+	return base + time.Duration(volumes-timeoutBaseVolumes)*timeoutPerVolume
+}
+
+// time the run gets to wind down after --timeout before the watchdog exits without it, for a
+// call that doesn't heed its context
+var timeoutGrace = 2 * time.Minute
+
+// errTimeout is the cause of the run's context being cancelled when --timeout is up
+var errTimeout = errors.New("timeout")
+
+// watchdog ends the run once --timeout is up, by cancelling its context: in-flight calls stop,
+// and the run cleans up and returns.  If it hasn't within timeoutGrace, expire is called.
+type watchdog struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	started time.Time
+	timeout time.Duration
+}
+
+// startWatchdog returns a context that is cancelled with errTimeout once the timeout is up, and
+// calls expire with the timeout if the run is still going timeoutGrace after that
+func startWatchdog(ctx context.Context, timeout time.Duration, expire func(timeout time.Duration)) (context.Context, *watchdog) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &watchdog{started: time.Now(), timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.mu.Lock()
+		timeout := w.timeout
+		w.mu.Unlock()
+		log.Printf("Hit timeout of %s before we finished - stopping", timeout)
+		cancel(errTimeout)
+		time.AfterFunc(timeoutGrace, func() { expire(timeout) })
+	})
+	return ctx, w
+}
+
+// extend pushes the timeout back, if this one is later
+func (w *watchdog) extend(timeout time.Duration, why string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timeout <= w.timeout {
+		return
+	}
+	if !w.timer.Stop() {
+		// already expired
+		return
+	}
+	log.Printf("Extending the timeout from %s to %s: %s", w.timeout, timeout, why)
+	w.timeout = timeout
+	w.timer.Reset(time.Until(w.started.Add(timeout)))
+}
+
+// pause waits for d, or until ctx is done, returning ctx's error if it is
+func pause(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceWithVolumes returns an instance with n volumes, its root on /dev/xvda and the rest
+// on /dev/sdf onwards, /dev/sdfa after /dev/sdfz
+func instanceWithVolumes(n int) *types.Instance {
+	instance := &types.Instance{InstanceId: aws.String("i-0123456789abcdef0"), RootDeviceName: aws.String("/dev/xvda")}
+	for i := 0; i < n; i++ {
+		device := "/dev/xvda"
+		if i > 0 {
+			device = fmt.Sprintf("/dev/sd%c%c", 'f'+rune((i-1)/26), 'a'+rune((i-1)%26))
+		}
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(device),
+			Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String(fmt.Sprintf("vol-%03d", i))},
+		})
+	}
+	return instance
+}
+
+func TestImageBlockDevices(t *testing.T) {
+	tests := []struct {
+		volumes      int
+		args         []string
+		wantMappings int
+		wantIncluded int
+		wantErr      string
+	}{
+		{1, nil, 0, 1, ""},
+		{25, nil, 0, 25, ""},
+		{60, nil, 0, 60, ""},
+		{25, []string{"-i", "/dev/sdfa", "-i", "/dev/sdfb"}, 2, 23, ""},
+		{60, []string{"--only-devices=/dev/xvda,/dev/sdfa"}, 58, 2, ""},
+		// ignoring a device the instance doesn't have still costs a mapping
+		{1, []string{"-i", "/dev/sdz"}, 1, 1, ""},
+		{60, []string{"--only-devices=/dev/sdfa"}, 0, 0, "root device /dev/xvda"},
+		{130, nil, 0, 0, "limit of 128"},
+	}
+	for _, tt := range tests {
+		c, err := parseTestOptions(append(tt.args, "web")...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		mappings, included, err := imageBlockDevices(instanceWithVolumes(tt.volumes), c)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%d volumes %q: got error %v, want one about %q", tt.volumes, tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d volumes %q: %s", tt.volumes, tt.args, err)
+			continue
+		}
+		if len(mappings) != tt.wantMappings || included != tt.wantIncluded {
+			t.Errorf("%d volumes %q: got %d mappings including %d volumes, want %d including %d",
+				tt.volumes, tt.args, len(mappings), included, tt.wantMappings, tt.wantIncluded)
+		}
+		for _, mapping := range mappings {
+			if mapping.NoDevice == nil || mapping.Ebs != nil {
+				t.Errorf("%d volumes %q: mapping for %s doesn't just leave it out", tt.volumes, tt.args, aws.ToString(mapping.DeviceName))
+			}
+		}
+	}
+}
+
+func TestScaledTimeout(t *testing.T) {
+	tests := []struct {
+		volumes int
+		want    time.Duration
+	}{
+		{1, time.Hour},
+		{timeoutBaseVolumes, time.Hour},
+		{25, time.Hour + 17*timeoutPerVolume},
+		{60, time.Hour + 52*timeoutPerVolume},
+	}
+	for _, tt := range tests {
+		if got := scaledTimeout(time.Hour, tt.volumes); got != tt.want {
+			t.Errorf("scaledTimeout(1h, %d) = %s, want %s", tt.volumes, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyExclusions(t *testing.T) {
+	// the root on /dev/xvda, vol-001 on /dev/sdfa to keep and vol-002 on /dev/sdfb to leave out
+	instance := instanceWithVolumes(3)
+	c, err := parseTestOptions("-i", "/dev/sdfb", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	mapping := func(device, snap string) types.BlockDeviceMapping {
+		return types.BlockDeviceMapping{DeviceName: aws.String(device), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String(snap)}}
+	}
+	snapshotVolumes := map[string]string{"snap-root": "vol-000", "snap-keep": "vol-001", "snap-leak": "vol-002"}
+	tests := []struct {
+		name     string
+		mappings []types.BlockDeviceMapping
+		wantErr  string // "" for a good image
+	}{
+		{"good", []types.BlockDeviceMapping{mapping("/dev/xvda", "snap-root"), mapping("/dev/sdfa", "snap-keep")}, ""},
+		// EC2 may spell a device back differently
+		{"respelled", []types.BlockDeviceMapping{mapping("sda", "snap-root"), mapping("/dev/xvdfa", "snap-keep")}, ""},
+		{"left out by NoDevice", []types.BlockDeviceMapping{mapping("/dev/xvda", "snap-root"), mapping("/dev/sdfa", "snap-keep"),
+			{DeviceName: aws.String("/dev/sdfb"), NoDevice: aws.String("")}}, ""},
+		{"leaked", []types.BlockDeviceMapping{mapping("/dev/xvda", "snap-root"), mapping("/dev/sdfa", "snap-keep"), mapping("/dev/sdfb", "snap-leak")},
+			"meant to be left out: vol-002 (/dev/sdfb)"},
+		// a device by a name we don't know is still found by its snapshot's volume
+		{"leaked elsewhere", []types.BlockDeviceMapping{mapping("/dev/xvda", "snap-root"), mapping("/dev/sdfa", "snap-keep"), mapping("/dev/sdz", "snap-leak")},
+			"meant to be left out: vol-002 (/dev/sdfb)"},
+		{"missing", []types.BlockDeviceMapping{mapping("/dev/xvda", "snap-root")}, "missing volumes that were meant to be in it: vol-001 (/dev/sdfa)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEC2(t, map[string]fakeCall{
+				"DescribeImages": func(interface{}) (interface{}, error) {
+					return &ec2.DescribeImagesOutput{Images: []types.Image{{ImageId: aws.String("ami-new"), BlockDeviceMappings: tt.mappings}}}, nil
+				},
+				"DescribeSnapshots": func(input interface{}) (interface{}, error) {
+					out := &ec2.DescribeSnapshotsOutput{}
+					for _, id := range input.(*ec2.DescribeSnapshotsInput).SnapshotIds {
+						out.Snapshots = append(out.Snapshots, types.Snapshot{SnapshotId: aws.String(id), VolumeId: aws.String(snapshotVolumes[id])})
+					}
+					return out, nil
+				},
+			})
+			checks, err := verifyExclusions(context.Background(), f.Client, instance, "ami-new", c)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("verifyExclusions = %v, want error %q", err, tt.wantErr)
+			}
+			if len(checks) != 3 {
+				t.Fatalf("%d checks, want one for each volume: %+v", len(checks), checks)
+			}
+			for _, check := range checks {
+				if check.Excluded != (check.VolumeId == "vol-002") || check.OK != (check.Excluded != check.InImage) {
+					t.Errorf("check %+v", check)
+				}
+			}
+		})
+	}
+}
+
+// TestVerifyExclusionsRun checks that an image whose exclusions didn't take is never copied
+func TestVerifyExclusionsRun(t *testing.T) {
+	fastPolls(t)
+	for _, leak := range []bool{false, true} {
+		f := runFake(t, map[string]func(fakeCall) fakeCall{
+			"DescribeInstances": func(next fakeCall) fakeCall {
+				return func(input interface{}) (interface{}, error) {
+					out, err := next(input)
+					for _, r := range out.(*ec2.DescribeInstancesOutput).Reservations {
+						for i := range r.Instances {
+							r.Instances[i].BlockDeviceMappings = append(r.Instances[i].BlockDeviceMappings, types.InstanceBlockDeviceMapping{
+								DeviceName: aws.String("/dev/sdf"),
+								Ebs:        &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-scratch"), DeleteOnTermination: aws.Bool(true)},
+							})
+						}
+					}
+					return out, err
+				}
+			},
+			"DescribeImages": func(next fakeCall) fakeCall {
+				return func(input interface{}) (interface{}, error) {
+					out, err := next(input)
+					if out := out.(*ec2.DescribeImagesOutput); leak && len(input.(*ec2.DescribeImagesInput).ImageIds) > 0 {
+						for i := range out.Images {
+							out.Images[i].BlockDeviceMappings = append(out.Images[i].BlockDeviceMappings, types.BlockDeviceMapping{
+								DeviceName: aws.String("/dev/sdf"), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-scratch")},
+							})
+						}
+					}
+					return out, err
+				}
+			},
+		}, "web")
+		c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+			"--no-reconcile", "--no-progress", "-i", "/dev/sdf", "web")
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		summary, err := run(context.Background(), c)
+		summary.setOutcome(err)
+		wantStatus, wantClass, wantCopies := statusSuccess, "", 1
+		if leak {
+			wantStatus, wantClass, wantCopies = statusFailed, string(classVerify), 0
+		}
+		if summary.Status != wantStatus || summary.ErrorClass != wantClass || f.count("CopyImage") != wantCopies {
+			t.Errorf("leak %v: run ended %s (%s) with %d copies; want %s (%s) with %d", leak, summary.Status, summary.ErrorClass,
+				f.count("CopyImage"), wantStatus, wantClass, wantCopies)
+		}
+		if n := f.count("DeregisterImage"); n > 0 {
+			t.Errorf("leak %v: %d images deregistered, want the source AMI kept", leak, n)
+		}
+		if len(summary.Backups) != 1 || len(summary.Backups[0].DeviceChecks) != 2 {
+			t.Errorf("leak %v: device checks %+v, want one for each volume", leak, summary.Backups)
+		}
+	}
+}
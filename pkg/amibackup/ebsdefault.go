@@ -0,0 +1,56 @@
+package amibackup
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// ebsEncryptionByDefault looks up whether EBS encryption by default is on in each region, logging
+// the regions where it is, as it encrypts backups there that our flags didn't ask for.  A region
+// that can't be checked counts as off.
+func ebsEncryptionByDefault(ctx context.Context, clients *clientPool, regions []string) map[string]bool {
+	on := map[string]bool{}
+	for _, region := range regions {
+		if _, ok := on[region]; ok {
+			continue
+		}
+		awsec2 := clients.EC2(region, "")
+		var resp *ec2.GetEbsEncryptionByDefaultOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.GetEbsEncryptionByDefault(ctx, &ec2.GetEbsEncryptionByDefaultInput{})
+			return err
+		})
+		if err != nil {
+			log.Printf("WARNING: can't tell whether EBS encryption by default is on in %s: EC2 API GetEbsEncryptionByDefault failed: %s", region, err.Error())
+			on[region] = false
+			continue
+		}
+		on[region] = aws.ToBool(resp.EbsEncryptionByDefault)
+		if on[region] {
+			log.Printf("EBS encryption by default is on in %s: volumes and snapshot copies made there are encrypted, so backups there may be even without -e", region)
+		}
+	}
+	return on
+}
+
+// encryptedByDefault lists the regions where EBS encryption by default is on, for the summary
+func encryptedByDefault(on map[string]bool) []string {
+	regions := []string{}
+	for region, enabled := range on {
+		if enabled {
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// copiesEncrypted reports whether every copy made in region is encrypted: with -e, or by EBS
+// encryption by default there.  Without either, a copy is only encrypted where its source is.
+func (c *Config) copiesEncrypted(region string) bool {
+	return c.encrypted || c.ebsDefaultOn[region]
+}
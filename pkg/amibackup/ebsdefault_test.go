@@ -0,0 +1,89 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// ebsDefaults answers GetEbsEncryptionByDefault for each region as on says, for the rest of the test
+func ebsDefaults(t *testing.T, on map[string]bool) {
+	options := extraAPIOptions
+	extraAPIOptions = append(extraAPIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ebsDefaults", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if awsmiddleware.GetOperationName(ctx) != "GetEbsEncryptionByDefault" {
+				return next.HandleInitialize(ctx, in)
+			}
+			out := &ec2.GetEbsEncryptionByDefaultOutput{EbsEncryptionByDefault: aws.Bool(on[awsmiddleware.GetRegion(ctx)])}
+			return middleware.InitializeOutput{Result: out}, middleware.Metadata{}, nil
+		}), middleware.Before)
+	})
+	t.Cleanup(func() { extraAPIOptions = options })
+}
+
+func TestEBSEncryptionByDefault(t *testing.T) {
+	for _, tt := range []struct{ sourceOn, destOn bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		t.Run(fmt.Sprintf("source %v dest %v", tt.sourceOn, tt.destOn), func(t *testing.T) {
+			// anything but GetEbsEncryptionByDefault fails the test
+			fakeClients(t, newFakeAWS(t, map[string]fakeCall{}))
+			ebsDefaults(t, map[string]bool{"us-east-1": tt.sourceOn, "us-west-2": tt.destOn})
+			c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			clients, err := newClientPool(context.Background(), "", c.runID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.ebsDefaultOn = ebsEncryptionByDefault(context.Background(), clients, []string{"us-east-1", "us-west-2", "us-west-2"})
+			want := []string{}
+			if tt.sourceOn {
+				want = append(want, "us-east-1")
+			}
+			if tt.destOn {
+				want = append(want, "us-west-2")
+			}
+			if got := encryptedByDefault(c.ebsDefaultOn); !reflect.DeepEqual(got, want) {
+				t.Errorf("summary has encryption by default in %v, want %v", got, want)
+			}
+			if c.copiesEncrypted("us-west-2") != tt.destOn {
+				t.Errorf("copies to us-west-2 expected encrypted %v, want %v", c.copiesEncrypted("us-west-2"), tt.destOn)
+			}
+
+			// the source comes out encrypted where the default is on, and a copy is encrypted if
+			// its source is or the default is on in its region
+			images := map[string]types.Image{}
+			snapshot := func(id string, encrypted bool) types.Image {
+				img := image(id, "snap-"+id)
+				img.BlockDeviceMappings[0].Ebs.Encrypted = aws.Bool(encrypted)
+				return img
+			}
+			images["ami-source"] = snapshot("ami-source", tt.sourceOn)
+			images["ami-copy"] = snapshot("ami-copy", tt.sourceOn || tt.destOn)
+			images["ami-plain"] = snapshot("ami-plain", false)
+			describe := func(input interface{}) (interface{}, error) {
+				out := &ec2.DescribeImagesOutput{}
+				for _, id := range input.(*ec2.DescribeImagesInput).ImageIds {
+					out.Images = append(out.Images, images[id])
+				}
+				return out, nil
+			}
+			f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": describe})
+			if err := verifyCopy(context.Background(), f.Client, f.Client, "ami-source", "ami-copy", c.copiesEncrypted("us-west-2")); err != nil {
+				t.Errorf("verifying the copy: %s", err)
+			}
+			// a copy that came out unencrypted where it had to be encrypted fails
+			err = verifyCopy(context.Background(), f.Client, f.Client, "ami-source", "ami-plain", c.copiesEncrypted("us-west-2"))
+			if wantErr := tt.sourceOn || tt.destOn; (err != nil) != wantErr {
+				t.Errorf("verifying an unencrypted copy: got %v, want an error %v", err, wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package amibackup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Environment variable fallbacks for amibackup's options.  Every option in the usage text can
+// also be set as AMIBACKUP_<OPTION> (--kms-key-id is AMIBACKUP_KMS_KEY_ID); flags on the command
+// line win.  Env values are turned into extra arguments before docopt sees them, so they are
+// validated exactly like flags.
+
+// usageOption is one entry of the Options section of the usage text
+type usageOption struct {
+	short      string
+	long       string
+	takesArg   bool
+	repeatable bool
+	def        string
+	hasDefault bool
+}
+
+var optionLine = regexp.MustCompile(`^\s+(?:-(\w), )?--([\w-]+)(=<[^>]+>)?`)
+var optionDefault = regexp.MustCompile(`\[default: ([^\]]*)\]`)
+var repeatedOption = regexp.MustCompile(`\[(-\w|--[\w-]+)[ =]<[^>]+>\]\.\.\.`)
+
+// options that make no sense from the environment
+var noEnvOptions = map[string]bool{"help": true, "version": true, "print-config": true}
+
+// parseUsageOptions lists the options described in a docopt usage text
+func parseUsageOptions(text string) []usageOption {
+	repeated := map[string]bool{}
+	for _, m := range repeatedOption.FindAllStringSubmatch(text, -1) {
+		repeated[strings.TrimLeft(m[1], "-")] = true
+	}
+	// each option's lines: its own, and the continuation lines of its description after it
+	entries := []string{}
+	inOptions := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "Options:") {
+			inOptions = true
+			continue
+		}
+		if !inOptions {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if optionLine.MatchString(line) || len(entries) == 0 {
+			entries = append(entries, line)
+		} else {
+			entries[len(entries)-1] += " " + strings.TrimSpace(line)
+		}
+	}
+	opts := []usageOption{}
+	for _, entry := range entries {
+		m := optionLine.FindStringSubmatch(entry)
+		if m == nil {
+			continue
+		}
+		o := usageOption{short: m[1], long: m[2], takesArg: m[3] != ""}
+		o.repeatable = repeated[o.long] || (o.short != "" && repeated[o.short])
+		if d := optionDefault.FindStringSubmatch(entry); d != nil {
+			o.def, o.hasDefault = d[1], true
+		}
+		opts = append(opts, o)
+	}
+	return opts
+}
+
+// envName is the environment variable for an option
+func envName(long string) string {
+	return "AMIBACKUP_" + strings.ToUpper(strings.Replace(long, "-", "_", -1))
+}
+
+// explicitOptions finds the options given on the command line, allowing for docopt's
+// abbreviated long options and stacked short options
+func explicitOptions(args []string, opts []usageOption) map[string]bool {
+	given := map[string]bool{}
+	byShort := map[string]usageOption{}
+	for _, o := range opts {
+		if o.short != "" {
+			byShort[o.short] = o
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return given
+		case strings.HasPrefix(arg, "--"):
+			name := strings.SplitN(arg[2:], "=", 2)[0]
+			matches := []usageOption{}
+			for _, o := range opts {
+				if o.long == name {
+					matches = []usageOption{o}
+					break
+				}
+				if strings.HasPrefix(o.long, name) {
+					matches = append(matches, o)
+				}
+			}
+			if len(matches) != 1 {
+				continue
+			}
+			given[matches[0].long] = true
+			if matches[0].takesArg && !strings.Contains(arg, "=") {
+				i++
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for j := 1; j < len(arg); j++ {
+				o, ok := byShort[arg[j:j+1]]
+				if !ok {
+					break
+				}
+				given[o.long] = true
+				if o.takesArg {
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+		}
+	}
+	return given
+}
+
+// applyEnv adds arguments for options set in the environment but not on the command line,
+// and returns the new arguments with where each option's value came from
+func applyEnv(args []string, opts []usageOption, getenv func(string) string) ([]string, map[string]string) {
+	given := explicitOptions(args, opts)
+	sources := map[string]string{}
+	envArgs := []string{}
+	for _, o := range opts {
+		if noEnvOptions[o.long] {
+			continue
+		}
+		if given[o.long] {
+			sources[o.long] = "flag"
+			continue
+		}
+		value := getenv(envName(o.long))
+		if value == "" {
+			if o.hasDefault {
+				sources[o.long] = "default"
+			}
+			continue
+		}
+		sources[o.long] = "env " + envName(o.long)
+		switch {
+		case !o.takesArg:
+			if v := strings.ToLower(value); v == "1" || v == "true" || v == "yes" {
+				envArgs = append(envArgs, "--"+o.long)
+			} else {
+				delete(sources, o.long)
+			}
+		case o.repeatable:
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					envArgs = append(envArgs, "--"+o.long+"="+v)
+				}
+			}
+		default:
+			envArgs = append(envArgs, "--"+o.long+"="+value)
+		}
+	}
+	return append(envArgs, args...), sources
+}
+
+// printConfig shows the effective value of every option and where it came from
+func printConfig(out io.Writer, opts []usageOption, arguments map[string]interface{}, sources map[string]string) {
+	names := []string{}
+	for _, o := range opts {
+		if !noEnvOptions[o.long] {
+			names = append(names, o.long)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := ""
+		switch v := arguments["--"+name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = fmt.Sprintf("%t", v)
+		case []string:
+			value = strings.Join(v, ",")
+		}
+		source := sources[name]
+		if source == "" {
+			source = "unset"
+		}
+		fmt.Fprintf(out, "%-24s %-40s (%s)\n", "--"+name, value, source)
+	}
+}
+
+// resolveArgs returns the command line with environment fallbacks applied
+func resolveArgs(args []string) ([]string, []usageOption, map[string]string) {
+	opts := parseUsageOptions(usage)
+	args, sources := applyEnv(args, opts, os.Getenv)
+	return args, opts, sources
+}
@@ -0,0 +1,66 @@
+package amibackup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUsageOptionsContinuationDefaults(t *testing.T) {
+	want := map[string]string{
+		"dest":               "us-west-1",
+		"max-new-gb":         "0",
+		"pipeline-retries":   "0",
+		"unprotected-ok-tag": "backup=excluded-ok",
+		"in-progress-stale":  "24h",
+	}
+	got := map[string]string{}
+	for _, o := range parseUsageOptions(usage) {
+		if _, ok := want[o.long]; ok && o.hasDefault {
+			got[o.long] = o.def
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("defaults = %v, want %v", got, want)
+	}
+}
+
+func TestApplyEnvResolutionOrder(t *testing.T) {
+	opts := parseUsageOptions(usage)
+	env := map[string]string{
+		"AMIBACKUP_DEST":       "eu-west-1,eu-central-1",
+		"AMIBACKUP_SOURCE":     "us-east-2",
+		"AMIBACKUP_MAX_NEW_GB": "500",
+	}
+	getenv := func(name string) string { return env[name] }
+	args, sources := applyEnv([]string{"--source=us-east-1", "web"}, opts, getenv)
+
+	// the flag wins over the environment, the environment over the default
+	wantArgs := []string{"--dest=eu-west-1", "--dest=eu-central-1", "--max-new-gb=500", "--source=us-east-1", "web"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %q, want %q", args, wantArgs)
+	}
+	wantSources := map[string]string{
+		"source":           "flag",
+		"dest":             "env AMIBACKUP_DEST",
+		"max-new-gb":       "env AMIBACKUP_MAX_NEW_GB",
+		"pipeline-retries": "default",
+	}
+	for name, want := range wantSources {
+		if sources[name] != want {
+			t.Errorf("source of --%s = %q, want %q", name, sources[name], want)
+		}
+	}
+}
+
+func TestExplicitOptions(t *testing.T) {
+	opts := parseUsageOptions(usage)
+	given := explicitOptions([]string{"-d", "eu-west-1", "--sour=us-east-1", "--", "--dry-run"}, opts)
+	for _, name := range []string{"dest", "source"} {
+		if !given[name] {
+			t.Errorf("--%s not found on the command line", name)
+		}
+	}
+	if given["dry-run"] {
+		t.Errorf("--dry-run after -- counted as an option")
+	}
+}
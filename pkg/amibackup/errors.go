@@ -0,0 +1,151 @@
+package amibackup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errorClass says what kind of failure ended a run, or failed an instance's backup, so scripts
+// can tell them apart without reading the log.  It is the summary's error_class, and picks the
+// exit code.
+type errorClass string
+
+const (
+	classConfig      errorClass = "config"      // bad options, or an instance refused by its tags
+	classCredentials errorClass = "credentials" // AWS rejected the credentials, or they lack permission
+	classDiscovery   errorClass = "discovery"   // finding the instances failed, or none matched
+	classCreate      errorClass = "create"      // creating (or tagging) a source AMI failed
+	classCopy        errorClass = "copy"        // the source AMI was made, but a copy failed
+	classVerify      errorClass = "verify"      // a copy didn't check out against its source
+	classPurge       errorClass = "purge"       // backups went fine, but purging old ones failed
+	classPartial     errorClass = "partial"     // some instances were backed up and some weren't
+	classUncovered   errorClass = "uncovered"   // --fail-on-uncovered found instances without current backups
+	classInternal    errorClass = "internal"    // anything else
+)
+
+// exit codes, by error class - documented in the usage.  A run that a freeze held back exits
+// exitFrozen, and one stopped by a signal exitInterrupted.
+var classExitCodes = map[errorClass]int{
+	classInternal:    1,
+	classConfig:      2,
+	classDiscovery:   4,
+	classCredentials: 5,
+	classCreate:      6,
+	classCopy:        7,
+	classVerify:      8,
+	classPurge:       9,
+	classPartial:     10,
+	classUncovered:   11,
+}
+
+// exit code of a run that hit --timeout
+const exitTimeout = 124
+
+// runSummary statuses
+const (
+	statusSuccess     = "success"
+	statusFailed      = "failed"
+	statusPartial     = "partial"
+	statusFrozen      = "frozen"
+	statusInterrupted = "interrupted"
+	statusTimeout     = "timeout"
+)
+
+// when every instance failed, the class of the earliest failure in the pipeline is the run's
+var classPrecedence = []errorClass{classCredentials, classConfig, classDiscovery, classCreate, classCopy, classVerify, classPurge}
+
+// errDone means the options asked for something that is already done, like --print-config
+var errDone = errors.New("done")
+
+// classedError is an error with its errorClass
+type classedError struct {
+	class errorClass
+	err   error
+}
+
+func (e classedError) Error() string { return e.err.Error() }
+func (e classedError) Unwrap() error { return e.err }
+
+// classify gives err a class, unless it already has one
+func classify(class errorClass, err error) error {
+	var ce classedError
+	if err == nil || errors.As(err, &ce) {
+		return err
+	}
+	return classedError{class, err}
+}
+
+// classErrorf formats an error of a class
+func classErrorf(class errorClass, format string, args ...interface{}) error {
+	return classedError{class, fmt.Errorf(format, args...)}
+}
+
+// classOf returns err's class, or fallback if it has none
+func classOf(err error, fallback errorClass) errorClass {
+	var ce classedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return fallback
+}
+
+// apiErrorClass is classCredentials for an AWS API error rejecting our credentials or
+// permissions, or class for any other
+func apiErrorClass(err error, class errorClass) errorClass {
+	if code := errorCode(err); terminalPollCodes[code] || expiredCredentialCodes[code] {
+		return classCredentials
+	}
+	return class
+}
+
+// runOutcome works out a run's status and error class from its summary and the error that
+// ended it, if any, along with the exit code they call for
+func runOutcome(summary *runSummary, err error) (string, errorClass, int) {
+	switch {
+	case err == errInterrupted:
+		return statusInterrupted, "", exitInterrupted
+	case err == errTimeout:
+		return statusTimeout, "", exitTimeout
+	case err != nil:
+		class := classOf(err, classInternal)
+		return statusFailed, class, classExitCodes[class]
+	}
+	failed := map[errorClass]bool{}
+	succeeded := 0
+	for _, r := range summary.Backups {
+		if r.Error == "" {
+			succeeded++
+		} else {
+			failed[errorClass(r.ErrorClass)] = true
+		}
+	}
+	if len(summary.Errors) > 0 {
+		// resuming an earlier run's pending backups - their source AMIs were made
+		failed[classCopy] = true
+	}
+	if len(summary.PurgeErrors) > 0 {
+		failed[classPurge] = true
+	}
+	if len(failed) > 0 && succeeded > 0 && !(len(failed) == 1 && failed[classPurge]) {
+		return statusPartial, classPartial, classExitCodes[classPartial]
+	}
+	for _, class := range classPrecedence {
+		if failed[class] {
+			return statusFailed, class, classExitCodes[class]
+		}
+	}
+	if len(failed) > 0 {
+		return statusFailed, classInternal, classExitCodes[classInternal]
+	}
+	if summary.Frozen != "" {
+		return statusFrozen, "", exitFrozen
+	}
+	return statusSuccess, "", 0
+}
+
+// setOutcome records the run's outcome in its summary, returning the exit code
+func (summary *runSummary) setOutcome(err error) int {
+	status, class, code := runOutcome(summary, err)
+	summary.Status, summary.ErrorClass = status, string(class)
+	return code
+}
@@ -0,0 +1,139 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// runFake answers everything a backup of the named instances from us-east-1 to us-west-2 asks
+// of AWS, succeeding; failures are injected by wrapping operations' answers in wrap
+func runFake(t *testing.T, wrap map[string]func(fakeCall) fakeCall, names ...string) *fakeAWS {
+	images := &fakeImages{images: map[string]types.Image{}}
+	ok := func(out interface{}) fakeCall {
+		return func(interface{}) (interface{}, error) { return out, nil }
+	}
+	all := map[string]fakeCall{
+		"GetEbsEncryptionByDefault": ok(&ec2.GetEbsEncryptionByDefaultOutput{EbsEncryptionByDefault: aws.Bool(false)}),
+		"DescribeInstances": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeInstancesOutput{}
+			for _, filter := range input.(*ec2.DescribeInstancesInput).Filters {
+				if aws.ToString(filter.Name) != "tag:Name" {
+					continue
+				}
+				for i, name := range names {
+					if !stringIn(name, filter.Values) {
+						continue
+					}
+					id := fmt.Sprintf("i-%017x", i+1)
+					out.Reservations = append(out.Reservations, types.Reservation{Instances: []types.Instance{{
+						InstanceId:     aws.String(id),
+						State:          &types.InstanceState{Name: types.InstanceStateNameRunning},
+						RootDeviceName: aws.String("/dev/xvda"),
+						Tags:           []types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+						BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+							{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-" + name)}},
+						},
+					}}})
+				}
+			}
+			return out, nil
+		},
+		"GetCallerIdentity": ok(&sts.GetCallerIdentityOutput{Account: aws.String("123456789012"), Arn: aws.String("arn:aws:iam::123456789012:user/backup")}),
+		"DescribeVolumes": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeVolumesOutput{}
+			for _, id := range input.(*ec2.DescribeVolumesInput).VolumeIds {
+				out.Volumes = append(out.Volumes, types.Volume{VolumeId: aws.String(id), Size: aws.Int32(8), Encrypted: aws.Bool(false)})
+			}
+			return out, nil
+		},
+		"DescribeImages":    images.describe,
+		"DescribeSnapshots": ok(&ec2.DescribeSnapshotsOutput{}),
+		"CreateTags":        ok(&ec2.CreateTagsOutput{}),
+		"DeleteTags":        ok(&ec2.DeleteTagsOutput{}),
+		"DeregisterImage":   ok(&ec2.DeregisterImageOutput{}),
+		"DeleteSnapshot":    ok(&ec2.DeleteSnapshotOutput{}),
+		"CreateImage": func(input interface{}) (interface{}, error) {
+			name := aws.ToString(input.(*ec2.CreateImageInput).Name)
+			img := image("ami-"+name, "snap-"+name)
+			img.Name = aws.String(name)
+			images.set(img, types.ImageStateAvailable)
+			return &ec2.CreateImageOutput{ImageId: img.ImageId}, nil
+		},
+		"CopyImage": func(input interface{}) (interface{}, error) {
+			// copy names differ by dest region, so their IDs do too
+			id := "ami-" + aws.ToString(input.(*ec2.CopyImageInput).Name)
+			images.set(image(id, "snap-"+id), types.ImageStateAvailable)
+			return &ec2.CopyImageOutput{ImageId: aws.String(id)}, nil
+		},
+	}
+	for op, w := range wrap {
+		all[op] = w(all[op])
+	}
+	f := newFakeAWS(t, all)
+	fakeClients(t, f)
+	return f
+}
+
+func TestExitCodes(t *testing.T) {
+	fastPolls(t)
+	fail := func(code string) func(fakeCall) fakeCall {
+		return func(fakeCall) fakeCall {
+			return func(interface{}) (interface{}, error) { return nil, apiError(code) }
+		}
+	}
+	// failCreate fails the create of one host's image
+	failCreate := func(name string) func(fakeCall) fakeCall {
+		return func(next fakeCall) fakeCall {
+			return func(input interface{}) (interface{}, error) {
+				if strings.HasPrefix(aws.ToString(input.(*ec2.CreateImageInput).Name), name+"-") {
+					return nil, apiError("InvalidParameterValue")
+				}
+				return next(input)
+			}
+		}
+	}
+	tests := []struct {
+		name   string
+		hosts  []string
+		wrap   map[string]func(fakeCall) fakeCall
+		status string
+		class  errorClass
+	}{
+		{"success", []string{"web"}, nil, statusSuccess, ""},
+		{"credentials", []string{"web"}, map[string]func(fakeCall) fakeCall{"DescribeInstances": fail("AuthFailure")}, statusFailed, classCredentials},
+		{"nothing matched", []string{"nosuchhost"}, nil, statusFailed, classDiscovery},
+		{"create", []string{"web"}, map[string]func(fakeCall) fakeCall{"CreateImage": fail("InvalidParameterValue")}, statusFailed, classCreate},
+		{"copy", []string{"web"}, map[string]func(fakeCall) fakeCall{"CopyImage": fail("InvalidRequest")}, statusFailed, classCopy},
+		{"partial", []string{"web", "db"}, map[string]func(fakeCall) fakeCall{"CreateImage": failCreate("db")}, statusPartial, classPartial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runFake(t, tt.wrap, "web", "db")
+			args := append([]string{"--source=us-east-1", "--dest=us-west-2", "--timeout=10m",
+				"--freeze-parameter=none", "--no-reconcile", "--no-progress"}, tt.hosts...)
+			c, err := parseTestOptions(args...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			summary, err := run(context.Background(), c)
+			code := summary.setOutcome(err)
+			if summary.Status != tt.status || summary.ErrorClass != string(tt.class) || code != classExitCodes[tt.class] {
+				t.Errorf("run ended %s (%s), exiting %d with error %v; want %s (%s), exiting %d",
+					summary.Status, summary.ErrorClass, code, err, tt.status, tt.class, classExitCodes[tt.class])
+			}
+		})
+	}
+
+	// bad options never reach AWS
+	_, err := parseTestOptions("--dest=us-west-2", "--pipeline-retries=many", "web")
+	if classOf(err, classInternal) != classConfig || classExitCodes[classConfig] != 2 {
+		t.Errorf("bad option gave error %v of class %s, want a config error", err, classOf(err, classInternal))
+	}
+}
@@ -0,0 +1,136 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// fakeCall answers one EC2 call: its typed output, or an error
+type fakeCall func(input interface{}) (interface{}, error)
+
+// fakeAWS answers AWS calls in place of AWS: each operation is answered by its fakeCall, and
+// every call is recorded
+type fakeAWS struct {
+	t     *testing.T
+	ops   map[string]fakeCall
+	mu    sync.Mutex
+	calls []string
+	input map[string][]interface{}
+}
+
+// fakeEC2 is an EC2 client that never reaches AWS
+type fakeEC2 struct {
+	*ec2.Client
+	*fakeAWS
+}
+
+// newFakeAWS returns a fake answering the operations given; any other operation fails the test
+func newFakeAWS(t *testing.T, ops map[string]fakeCall) *fakeAWS {
+	return &fakeAWS{t: t, ops: ops, input: map[string][]interface{}{}}
+}
+
+// apiOption adds the fake to a client's middleware stack, ahead of signing and sending
+func (f *fakeAWS) apiOption(stack *middleware.Stack) error {
+	answer := middleware.InitializeMiddlewareFunc("fakeAWS", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		op := awsmiddleware.GetOperationName(ctx)
+		f.mu.Lock()
+		f.calls = append(f.calls, op)
+		f.input[op] = append(f.input[op], in.Parameters)
+		f.mu.Unlock()
+		call, ok := f.ops[op]
+		if !ok {
+			f.t.Errorf("unexpected AWS call %s", op)
+			return middleware.InitializeOutput{}, middleware.Metadata{}, fmt.Errorf("unexpected AWS call %s", op)
+		}
+		out, err := call(in.Parameters)
+		return middleware.InitializeOutput{Result: out}, middleware.Metadata{}, err
+	})
+	return stack.Initialize.Add(answer, middleware.Before)
+}
+
+// newFakeEC2 returns an EC2 client answering the operations given; any other operation fails the test
+func newFakeEC2(t *testing.T, ops map[string]fakeCall, optFns ...func(*ec2.Options)) *fakeEC2 {
+	t.Helper()
+	f := newFakeAWS(t, ops)
+	client := ec2.New(ec2.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{f.apiOption},
+	}, optFns...)
+	return &fakeEC2{client, f}
+}
+
+// fakeClients makes every client the run's pool makes answer with f, for the rest of the test
+func fakeClients(t *testing.T, f *fakeAWS) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+	options := extraAPIOptions
+	extraAPIOptions = append(extraAPIOptions, f.apiOption)
+	t.Cleanup(func() { extraAPIOptions = options })
+}
+
+// count returns how many times an operation was called
+func (f *fakeAWS) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.input[op])
+}
+
+// inputs returns the inputs of every call to an operation, in order
+func (f *fakeAWS) inputs(op string) []interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]interface{}{}, f.input[op]...)
+}
+
+// apiError is an AWS error with an error code, as the SDK returns them
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code}
+}
+
+// script answers successive calls with successive answers, repeating the last once they run out
+func script(answers ...fakeCall) fakeCall {
+	var mu sync.Mutex
+	n := 0
+	return func(input interface{}) (interface{}, error) {
+		mu.Lock()
+		answer := answers[n]
+		if n < len(answers)-1 {
+			n++
+		}
+		mu.Unlock()
+		return answer(input)
+	}
+}
+
+// fastPolls makes waits poll every few milliseconds for the rest of the test
+func fastPolls(t testing.TB) {
+	interval := apiPollInterval
+	apiPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { apiPollInterval = interval })
+}
+
+// imageIn answers DescribeImages with one image in a state
+func imageIn(img types.Image, state types.ImageState) fakeCall {
+	return func(interface{}) (interface{}, error) {
+		img.State = state
+		return &ec2.DescribeImagesOutput{Images: []types.Image{img}}, nil
+	}
+}
+
+// noImages answers DescribeImages with nothing, as for an image not visible yet
+func noImages(interface{}) (interface{}, error) {
+	return &ec2.DescribeImagesOutput{}, nil
+}
@@ -0,0 +1,87 @@
+package amibackup
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// tagFilters returns the DescribeInstances filters for --filter-tag: every one must match
+func tagFilters(matches []tagMatch) []types.Filter {
+	filters := []types.Filter{}
+	for _, m := range matches {
+		if m.any {
+			filters = append(filters, types.Filter{Name: aws.String("tag-key"), Values: []string{m.key}})
+		} else {
+			filters = append(filters, types.Filter{Name: aws.String("tag:" + m.key), Values: []string{m.value}})
+		}
+	}
+	return filters
+}
+
+// filterTagSpec is --filter-tag as given, for logs and errors
+func filterTagSpec(matches []tagMatch) string {
+	specs := []string{}
+	for _, m := range matches {
+		if m.any {
+			specs = append(specs, m.key)
+		} else {
+			specs = append(specs, m.key+"="+m.value)
+		}
+	}
+	return strings.Join(specs, ", ")
+}
+
+// resolveFilterTags adds the instances --filter-tag selects to the hosts backed up, each under its
+// own Name tag - or, without one, its instance ID, as with --instance-id.  Their backups are named
+// and hostname-tagged after it, so each is purged on its own.
+func resolveFilterTags(ctx context.Context, awsec2 *ec2.Client, c *Config) error {
+	spec := filterTagSpec(c.filterTags)
+	names := []string{}
+	pages := ec2.NewDescribeInstancesPaginator(awsec2, &ec2.DescribeInstancesInput{Filters: tagFilters(c.filterTags)})
+	for pages.HasMorePages() {
+		var page *ec2.DescribeInstancesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			page, err = pages.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return classErrorf(apiErrorClass(err, classDiscovery), "EC2 API DescribeInstances failed: %s", err.Error())
+		}
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				id := aws.ToString(instance.InstanceId)
+				if id == "" {
+					log.Printf("WARNING: DescribeInstances returned an instance tagged %s with no ID - skipping it", spec)
+					continue
+				}
+				name := discovery.TagValue(instance.Tags, "Name")
+				if match, excluded := excludedBy(&instance, c); excluded {
+					// left out here, so a host with nothing left to back up doesn't fail the run
+					log.Printf("Excluding instance %s (%s): tagged %s", id, name, match)
+					continue
+				}
+				if name == "" {
+					name = id
+					c.instanceIds[id] = true
+				} else if !stringIn(name, c.instanceNameTags) {
+					// so findInstances doesn't pick up other instances that share the name
+					c.filteredNames[name] = true
+				}
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return classErrorf(classDiscovery, "No instances tagged %s", spec)
+	}
+	given := len(c.instanceNameTags)
+	c.instanceNameTags = mergeInstanceNames(c.instanceNameTags, names)
+	log.Printf("Found %d instances tagged %s (%d hosts given otherwise, %d in total after removing duplicates)", len(names), spec, given, len(c.instanceNameTags))
+	return nil
+}
@@ -0,0 +1,73 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestResolveFilterTags(t *testing.T) {
+	captureLog(t)
+	tagged := func(id string, tags ...string) types.Instance {
+		instance := types.Instance{InstanceId: aws.String(id)}
+		for i := 0; i+1 < len(tags); i += 2 {
+			instance.Tags = append(instance.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+		return instance
+	}
+	instances := []types.Instance{
+		tagged("i-1", "Name", "web"),
+		tagged("i-2"), // no Name, so backed up by ID
+		tagged("i-3", "Name", "db"),
+		tagged("i-4", "Name", "batch", "Skip", "yes"),
+		tagged(""),
+	}
+	c, err := parseTestOptions("--filter-tag=Env=prod", "--filter-tag=Backup", "--exclude-tag=Skip", "db")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeInstances": func(interface{}) (interface{}, error) {
+		return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: instances}}}, nil
+	}})
+	if err := resolveFilterTags(context.Background(), f.Client, c); err != nil {
+		t.Fatalf("resolveFilterTags: %s", err)
+	}
+	// every --filter-tag must match
+	wantFilters := []types.Filter{{Name: aws.String("tag:Env"), Values: []string{"prod"}}, {Name: aws.String("tag-key"), Values: []string{"Backup"}}}
+	if got := f.inputs("DescribeInstances")[0].(*ec2.DescribeInstancesInput).Filters; !reflect.DeepEqual(got, wantFilters) {
+		t.Errorf("DescribeInstances filtered on %v, want %v", got, wantFilters)
+	}
+	if filterTagSpec(c.filterTags) != "Env=prod, Backup" {
+		t.Errorf("filter spec %q", filterTagSpec(c.filterTags))
+	}
+	if want := []string{"db", "web", "i-2"}; !reflect.DeepEqual(c.instanceNameTags, want) {
+		t.Errorf("hosts %v, want %v", c.instanceNameTags, want)
+	}
+	// db was given by name, so any instance of that name is backed up; web only as filtered
+	if !c.instanceIds["i-2"] || !c.filteredNames["web"] || c.filteredNames["db"] {
+		t.Errorf("IDs %v, filtered names %v", c.instanceIds, c.filteredNames)
+	}
+
+	// web is looked up again with the filter, so another instance named web isn't backed up too
+	f = newFakeEC2(t, map[string]fakeCall{"DescribeInstances": func(interface{}) (interface{}, error) { return &ec2.DescribeInstancesOutput{}, nil }})
+	if _, err := findInstances(context.Background(), f.Client, "web", c); err != nil {
+		t.Fatalf("findInstances: %s", err)
+	}
+	want := append([]types.Filter{{Name: aws.String("tag:Name"), Values: []string{"web"}}}, wantFilters...)
+	if got := f.inputs("DescribeInstances")[0].(*ec2.DescribeInstancesInput).Filters; !reflect.DeepEqual(got, want) {
+		t.Errorf("findInstances filtered on %v, want %v", got, want)
+	}
+
+	c, err = parseTestOptions("--filter-tag=Env=prod")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f = newFakeEC2(t, map[string]fakeCall{"DescribeInstances": func(interface{}) (interface{}, error) { return &ec2.DescribeInstancesOutput{}, nil }})
+	if err := resolveFilterTags(context.Background(), f.Client, c); classOf(err, classInternal) != classDiscovery {
+		t.Errorf("resolveFilterTags matching nothing = %v, want a discovery error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package amibackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// freeze modes, weakest first: a purge freeze still takes backups but deletes nothing, an all
+// freeze does nothing at all
+const (
+	freezeNone  = ""
+	freezePurge = "purge"
+	freezeAll   = "all"
+)
+
+// exit code of a run that a freeze held back, so schedulers can tell it from success and failure
+const exitFrozen = 3
+
+// errFrozen is what a deletion gets while backups are frozen - a backstop for any path that
+// doesn't check the freeze itself
+var errFrozen = errors.New("backups are frozen - nothing may be deleted")
+
+// parseFreeze parses a freeze mode, optionally time-boxed: "purge", "all", or "none", each
+// maybe followed by " until <RFC 3339 time>".  A freeze whose time is up is no freeze.
+func parseFreeze(value string, now time.Time) (string, time.Time, error) {
+	value = strings.TrimSpace(value)
+	var until time.Time
+	if i := strings.Index(value, " until "); i >= 0 {
+		var err error
+		until, err = time.Parse(time.RFC3339, strings.TrimSpace(value[i+len(" until "):]))
+		if err != nil {
+			return "", until, fmt.Errorf("bad until time: %s", err.Error())
+		}
+		value = strings.TrimSpace(value[:i])
+	}
+	mode := strings.ToLower(value)
+	switch mode {
+	case "none", "":
+		return freezeNone, until, nil
+	case freezePurge, freezeAll:
+	default:
+		return "", until, fmt.Errorf("want none, purge or all")
+	}
+	if !until.IsZero() && !now.Before(until) {
+		return freezeNone, until, nil
+	}
+	return mode, until, nil
+}
+
+// strongerFreeze returns the stronger of two freeze modes
+func strongerFreeze(a, b string) string {
+	if a == freezeAll || b == freezeAll {
+		return freezeAll
+	}
+	if a == freezePurge || b == freezePurge {
+		return freezePurge
+	}
+	return freezeNone
+}
+
+// checkFreeze applies the --freeze-parameter marker, if it is set, on top of --freeze.  The
+// parameter lets a central operator freeze every scheduled job at once.  A parameter that
+// doesn't exist is no freeze; one that can't be read is logged and ignored, as is a bad value.
+func checkFreeze(ctx context.Context, awsssm *ssm.Client, c *Config) {
+	if c.freezeParameter != "" {
+		resp, err := awsssm.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(c.freezeParameter)})
+		switch {
+		case errorCode(err) == "ParameterNotFound":
+		case err != nil:
+			log.Printf("WARNING: can't read freeze parameter %s - ignoring it: %s", c.freezeParameter, err.Error())
+		case resp.Parameter != nil:
+			value := aws.ToString(resp.Parameter.Value)
+			mode, until, err := parseFreeze(value, time.Now())
+			switch {
+			case err != nil:
+				log.Printf("WARNING: freeze parameter %s is %q, which is not a freeze (%s) - ignoring it", c.freezeParameter, value, err.Error())
+			case mode == freezeNone && !until.IsZero():
+				log.Printf("Freeze parameter %s expired at %s", c.freezeParameter, until.Format(time.RFC3339))
+			case strongerFreeze(c.freeze, mode) != c.freeze:
+				c.freeze = mode
+				c.freezeSource = "parameter " + c.freezeParameter
+				if !until.IsZero() {
+					c.freezeSource += " until " + until.Format(time.RFC3339)
+				}
+			}
+		}
+	}
+	switch c.freeze {
+	case freezeAll:
+		log.Printf("FROZEN (%s): taking no backups and deleting nothing", c.freezeSource)
+	case freezePurge:
+		log.Printf("FROZEN (%s): taking backups but deleting nothing", c.freezeSource)
+	}
+}
@@ -0,0 +1,123 @@
+package amibackup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+func TestParseFreeze(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", freezeNone, false},
+		{"none", freezeNone, false},
+		{" Purge ", freezePurge, false},
+		{"all", freezeAll, false},
+		{"all until 2026-03-02T00:00:00Z", freezeAll, false},
+		// a freeze whose time is up is no freeze
+		{"all until 2026-02-28T00:00:00Z", freezeNone, false},
+		{"all until 2026-03-01T00:00:00Z", freezeNone, false},
+		{"everything", "", true},
+		{"purge until tomorrow", "", true},
+	}
+	for _, tt := range tests {
+		mode, _, err := parseFreeze(tt.value, now)
+		if mode != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseFreeze(%q) = %q, %v; want %q, error %v", tt.value, mode, err, tt.want, tt.wantErr)
+		}
+	}
+	if strongerFreeze(freezePurge, freezeAll) != freezeAll || strongerFreeze(freezeNone, freezePurge) != freezePurge || strongerFreeze(freezeNone, freezeNone) != freezeNone {
+		t.Errorf("strongerFreeze doesn't pick the stronger freeze")
+	}
+}
+
+func TestFreezeRun(t *testing.T) {
+	fastPolls(t)
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	earlier := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		flag       string // --freeze
+		parameter  string // the freeze parameter's value, "" if it doesn't exist
+		wantFrozen string
+		wantCreate bool
+	}{
+		{"not frozen", "", "", freezeNone, true},
+		{"flag", "purge", "", freezePurge, true},
+		{"parameter", "", "all until " + later, freezeAll, false},
+		{"parameter expired", "", "all until " + earlier, freezeNone, true},
+		{"parameter not a freeze", "", "yes", freezeNone, true},
+		// the stronger of the two wins, either way round
+		{"flag stronger", "all", "purge", freezeAll, false},
+		{"parameter stronger", "purge", "all", freezeAll, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+			f := runFake(t, map[string]func(fakeCall) fakeCall{
+				"GetParameter": func(fakeCall) fakeCall {
+					return func(input interface{}) (interface{}, error) {
+						if name := aws.ToString(input.(*ssm.GetParameterInput).Name); name != "/amibackup/freeze" || tt.parameter == "" {
+							return nil, apiError("ParameterNotFound")
+						}
+						return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(tt.parameter)}}, nil
+					}
+				},
+			}, "web")
+			args := []string{"--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--no-reconcile", "--no-progress", "-p", "1d:4d:30d"}
+			if tt.flag != "" {
+				args = append(args, "--freeze="+tt.flag)
+			}
+			c, err := parseTestOptions(append(args, "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			summary, err := run(context.Background(), c)
+			code := summary.setOutcome(err)
+			if summary.Frozen != tt.wantFrozen {
+				t.Errorf("run frozen %q, want %q", summary.Frozen, tt.wantFrozen)
+			}
+			wantStatus, wantCode := statusSuccess, 0
+			if tt.wantFrozen != freezeNone {
+				wantStatus, wantCode = statusFrozen, exitFrozen
+				if !strings.Contains(out.String(), "FROZEN") {
+					t.Errorf("log doesn't say the run is frozen:\n%s", out)
+				}
+			}
+			if summary.Status != wantStatus || code != wantCode {
+				t.Errorf("run ended %s, exiting %d (%v); want %s, exiting %d", summary.Status, code, err, wantStatus, wantCode)
+			}
+			if created := f.count("CreateImage") > 0; created != tt.wantCreate {
+				t.Errorf("backup taken = %v, want %v", created, tt.wantCreate)
+			}
+			if n := f.count("DeregisterImage") + f.count("DeleteSnapshot"); tt.wantFrozen != freezeNone && n > 0 {
+				t.Errorf("frozen run made %d deletions", n)
+			}
+		})
+	}
+}
+
+// TestFrozenDeletions checks the backstop: deletions refuse while frozen, without calling AWS
+func TestFrozenDeletions(t *testing.T) {
+	c, err := parseTestOptions("--freeze=purge", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{})
+	if err := deregisterImage(context.Background(), f.Client, "ami-1", c); !errors.Is(err, errFrozen) {
+		t.Errorf("deregisterImage = %v, want %v", err, errFrozen)
+	}
+	if err := deleteSnapshots(context.Background(), f.Client, []string{"snap-1"}, c); !errors.Is(err, errFrozen) {
+		t.Errorf("deleteSnapshots = %v, want %v", err, errFrozen)
+	}
+}
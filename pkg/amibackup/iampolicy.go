@@ -0,0 +1,319 @@
+package amibackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// iamFeatureActions maps each feature to the IAM actions its code paths call.  Add to it
+// whenever a feature starts making a new AWS call, or --generate-iam-policy falls behind.
+var iamFeatureActions = map[string][]string{
+	"describe":           {"ec2:DescribeImages", "ec2:DescribeInstances", "ec2:DescribeSnapshots"},
+	"describe-volumes":   {"ec2:DescribeVolumes"},
+	"create":             {"ec2:CreateImage", "ec2:CreateTags", "ec2:DeleteTags"},
+	"copy":               {"ec2:CopyImage", "ec2:CreateTags", "ec2:DeleteTags"},
+	"tag-snapshots":      {"ec2:CreateTags"},
+	"reconcile":          {"ec2:CreateTags", "ec2:DeregisterImage", "ec2:DeleteSnapshot"},
+	"resume":             {"ec2:CopyImage", "ec2:CreateTags", "ec2:DeleteTags"},
+	"purge":              {"ec2:DeregisterImage", "ec2:DeleteSnapshot"},
+	"cleanup-failed":     {"ec2:DeregisterImage", "ec2:DeleteSnapshot"},
+	"discard-source":     {"ec2:DeregisterImage", "ec2:DeleteSnapshot"},
+	"pipeline-retries":   {"ec2:DeregisterImage", "ec2:DeleteSnapshot"},
+	"deadline":           {"ec2:CreateTags", "ec2:DeleteTags"},
+	"retag":              {"ec2:CreateTags", "ec2:DeleteTags"},
+	"fix-tags":           {"ec2:CreateTags"},
+	"instance-state-tag": {"ec2:CreateTags"},
+	"tag-instance":       {"ec2:CreateTags"},
+	"copy-limit":         {"sts:GetCallerIdentity"},
+	"copy-snapshots":     {"ec2:CopySnapshot", "ec2:CreateTags"},
+	"verify-large":       {"ebs:ListSnapshotBlocks"},
+	"backup-vault":       {"backup:StartBackupJob", "iam:PassRole", "sts:GetCallerIdentity"},
+	"ami-store":          {"ec2:CreateStoreImageTask", "ec2:DescribeStoreImageTasks", "ebs:GetSnapshotBlock", "ebs:ListSnapshotBlocks", "s3:AbortMultipartUpload", "s3:GetObject", "s3:ListBucket", "s3:PutObject"},
+	"dedup":              {"cloudwatch:GetMetricStatistics", "ec2:CreateTags"},
+	"vss":                {"ssm:GetCommandInvocation", "ssm:SendCommand"},
+	"quiesce":            {"ssm:GetCommandInvocation", "ssm:SendCommand"},
+	"freeze":             {"ssm:GetParameter"},
+	"latest-parameter":   {"ssm:DeleteParameter", "ssm:GetParameter", "ssm:PutParameter"},
+	"reencrypt":          {"ec2:CopyImage", "ec2:CreateTags", "ec2:DeregisterImage", "ec2:DeleteSnapshot", "sts:GetCallerIdentity"},
+	"encrypted":          {"kms:CreateGrant", "kms:Decrypt", "kms:DescribeKey", "kms:Encrypt", "kms:GenerateDataKeyWithoutPlaintext", "kms:ReEncryptFrom", "kms:ReEncryptTo"},
+	"put-metrics":        {"cloudwatch:PutMetricData"},
+	"kms-preflight":      {"kms:DescribeKey", "kms:GenerateDataKeyWithoutPlaintext", "kms:GetKeyPolicy", "sts:GetCallerIdentity"},
+	"copy-keys":          {"ec2:DescribeVolumes", "kms:DescribeKey"},
+	"encryption-default": {"ec2:GetEbsEncryptionByDefault"},
+	"summary-s3":         {"s3:PutObject"},
+	"summary-s3-kms":     {"kms:GenerateDataKey"},
+}
+
+// iamStatement is one statement of an IAM policy document
+type iamStatement struct {
+	Sid       string                            `json:"Sid"`
+	Effect    string                            `json:"Effect"`
+	Action    []string                          `json:"Action"`
+	Resource  []string                          `json:"Resource"`
+	Condition map[string]map[string]interface{} `json:"Condition,omitempty"`
+}
+
+// iamPolicyDocument is an IAM policy
+type iamPolicyDocument struct {
+	Version   string         `json:"Version"`
+	Statement []iamStatement `json:"Statement"`
+}
+
+// iamFeatures lists the features a run with this config uses
+func iamFeatures(c *Config) []string {
+	features := append([]string{"describe"}, summaryS3Features(c)...)
+	if c.freezeParameter != "" {
+		features = append(features, "freeze")
+	}
+	copying := false
+	for _, region := range c.destRegions() {
+		copying = copying || region != c.sourceRegion
+	}
+	switch {
+	case c.coverageReport:
+		return append([]string{"describe"}, summaryS3Features(c)...)
+	case c.auditTags || c.validateTags:
+		if c.fixTags {
+			features = append(features, "fix-tags")
+		}
+		return features
+	case c.retag:
+		return append(features, "retag")
+	case c.gcReferences:
+		return append(features, "latest-parameter")
+	case c.reencrypt:
+		return append(features, "reencrypt", "encrypted", "kms-preflight")
+	case c.simulate != "":
+		return nil
+	}
+	if !c.noReconcile {
+		features = append(features, "reconcile")
+	}
+	features = append(features, "resume")
+	if copying && c.perAccountCopyLimit > 0 {
+		// resumed copies take a copy slot too, even with --purgeonly
+		features = append(features, "copy-limit")
+	}
+	if c.purging() {
+		features = append(features, "purge")
+		if c.latestParameter != "" {
+			features = append(features, "latest-parameter")
+		}
+	}
+	if c.cloudWatchNamespace != "" {
+		features = append(features, "put-metrics")
+	}
+	if c.cleanupFailedCopies && copying {
+		features = append(features, "cleanup-failed")
+	}
+	if c.purgeonly {
+		return features
+	}
+	features = append(features, "create", "tag-snapshots", "encryption-default")
+	if copying {
+		features = append(features, "copy", "copy-keys")
+		if c.encrypted {
+			features = append(features, "encrypted")
+		}
+		if c.kmsKeyId != "" || c.kmsKeyAlias != "" {
+			features = append(features, "kms-preflight")
+		}
+		if c.copySnapshots {
+			features = append(features, "copy-snapshots")
+		}
+		if c.pipelineRetries > 0 {
+			features = append(features, "pipeline-retries")
+		}
+	}
+	if c.discardSource {
+		features = append(features, "discard-source")
+	}
+	if len(c.ignoreVolumes) > 0 || len(c.onlyDevices) > 0 || c.plan != nil || c.maxNewGB > 0 || !c.deadline.IsZero() {
+		features = append(features, "describe-volumes")
+	}
+	if !c.deadline.IsZero() {
+		features = append(features, "deadline")
+	}
+	if c.instanceStateTag {
+		features = append(features, "instance-state-tag")
+	}
+	if c.tagInstance {
+		features = append(features, "tag-instance")
+	}
+	if c.verifyLarge {
+		features = append(features, "verify-large")
+	}
+	if c.amiStoreBucket != "" {
+		features = append(features, "ami-store")
+	}
+	if c.backupVault != "" {
+		features = append(features, "backup-vault")
+	}
+	if c.dedupByContent {
+		features = append(features, "dedup")
+	}
+	if c.windowsPolicy == "vss" {
+		features = append(features, "vss")
+	}
+	if c.preFreezeSSM != "" || c.postThawSSM != "" {
+		features = append(features, "quiesce")
+	}
+	return features
+}
+
+// iamPolicy builds the least-privilege policy document for a run with this config: the actions
+// its features call, limited to the run's regions, bucket and KMS key where IAM allows it
+func iamPolicy(c *Config) iamPolicyDocument {
+	actions := map[string]bool{}
+	for _, feature := range iamFeatures(c) {
+		for _, action := range iamFeatureActions[feature] {
+			actions[action] = true
+		}
+	}
+	regions := []string{c.sourceRegion}
+	for _, region := range c.destRegions() {
+		if region != c.sourceRegion {
+			regions = append(regions, region)
+		}
+	}
+	inRegions := map[string]map[string]interface{}{"StringEquals": {"aws:RequestedRegion": regions}}
+	arns := func(format string) []string {
+		list := []string{}
+		for _, region := range regions {
+			list = append(list, fmt.Sprintf(format, region))
+		}
+		return list
+	}
+	pick := func(prefix string, exclude ...string) []string {
+		list := []string{}
+		for action := range actions {
+			if strings.HasPrefix(action, prefix) && !stringIn(action, exclude) {
+				list = append(list, action)
+			}
+		}
+		sort.Strings(list)
+		return list
+	}
+
+	statements := []iamStatement{}
+	add := func(s iamStatement) {
+		if len(s.Action) > 0 {
+			statements = append(statements, s)
+		}
+	}
+	// Describe calls, and GetEbsEncryptionByDefault, can't be limited to resources
+	add(iamStatement{Sid: "Describe", Action: append(pick("ec2:Describe"), pick("ec2:GetEbs")...), Resource: []string{"*"}, Condition: inRegions})
+	ec2Resources := append(arns("arn:aws:ec2:%s::image/*"), arns("arn:aws:ec2:%s::snapshot/*")...)
+	if actions["ec2:CreateImage"] {
+		ec2Resources = append(ec2Resources, arns("arn:aws:ec2:%s:*:instance/*")...)
+	}
+	add(iamStatement{Sid: "Backup", Action: pick("ec2:", "ec2:DescribeImages", "ec2:DescribeInstances", "ec2:DescribeSnapshots", "ec2:DescribeStoreImageTasks", "ec2:DescribeVolumes", "ec2:DeregisterImage", "ec2:GetEbsEncryptionByDefault"), Resource: ec2Resources, Condition: inRegions})
+	if actions["ec2:DeregisterImage"] {
+		// we only ever deregister AMIs with our hostname tag
+		deregister := iamStatement{Sid: "Deregister", Action: []string{"ec2:DeregisterImage"}, Resource: arns("arn:aws:ec2:%s::image/*"), Condition: inRegions}
+		if !c.legacyTags {
+			deregister.Condition = map[string]map[string]interface{}{
+				"StringEquals": {"aws:RequestedRegion": regions},
+				"StringLike":   {"ec2:ResourceTag/" + c.tagKey("hostname"): "*"},
+			}
+		}
+		add(deregister)
+	}
+	add(iamStatement{Sid: "SnapshotBlocks", Action: pick("ebs:"), Resource: arns("arn:aws:ec2:%s::snapshot/*")})
+	if c.amiStoreBucket != "" {
+		add(iamStatement{Sid: "AMIStore", Action: pick("s3:"), Resource: []string{
+			"arn:aws:s3:::" + c.amiStoreBucket,
+			"arn:aws:s3:::" + c.amiStoreBucket + "/" + c.amiStorePrefix + "/*",
+		}})
+	}
+	if actions["s3:PutObject"] && c.summaryS3Bucket != "" {
+		// the summary's own statement, as the AMI store's is limited to its bucket
+		summary := "arn:aws:s3:::" + c.summaryS3Bucket + "/*"
+		if c.summaryS3Prefix != "" {
+			summary = "arn:aws:s3:::" + c.summaryS3Bucket + "/" + c.summaryS3Prefix + "/*"
+		}
+		add(iamStatement{Sid: "RunSummary", Action: []string{"s3:PutObject"}, Resource: []string{summary}})
+	}
+	if actions["kms:GenerateDataKey"] {
+		key := iamStatement{Sid: "RunSummaryKey", Action: []string{"kms:GenerateDataKey"}, Resource: []string{"*"},
+			Condition: map[string]map[string]interface{}{"StringEquals": {"kms:ViaService": "s3." + c.sourceRegion + ".amazonaws.com"}}}
+		if strings.HasPrefix(c.summaryS3KMS, "arn:") {
+			key.Resource = []string{c.summaryS3KMS}
+		}
+		add(key)
+	}
+	if actions["backup:StartBackupJob"] {
+		add(iamStatement{Sid: "BackupVault", Action: []string{"backup:StartBackupJob"}, Resource: []string{fmt.Sprintf("arn:aws:backup:%s:*:backup-vault:%s", c.sourceRegion, c.backupVault)}})
+		add(iamStatement{Sid: "BackupVaultRole", Action: []string{"iam:PassRole"}, Resource: []string{c.backupRoleArn},
+			Condition: map[string]map[string]interface{}{"StringEquals": {"iam:PassedToService": "backup.amazonaws.com"}}})
+	}
+	if actions["kms:CreateGrant"] {
+		services := []string{}
+		for _, region := range c.destRegions() {
+			services = append(services, "ec2."+region+".amazonaws.com")
+		}
+		kms := iamStatement{Sid: "Encrypt", Action: pick("kms:", "kms:GenerateDataKey", "kms:GetKeyPolicy"), Resource: []string{"*"},
+			Condition: map[string]map[string]interface{}{"StringEquals": {"kms:ViaService": services}}}
+		if c.kmsKeyId != "" {
+			kms.Resource = []string{c.kmsKeyId}
+		}
+		add(kms)
+	}
+	if actions["kms:GetKeyPolicy"] {
+		// the KMS preflight calls KMS itself, not through EC2; its probe is a DryRun
+		preflight := iamStatement{Sid: "KMSPreflight", Action: []string{"kms:DescribeKey", "kms:GenerateDataKeyWithoutPlaintext", "kms:GetKeyPolicy"}, Resource: []string{"*"}}
+		if c.kmsKeyId != "" {
+			preflight.Resource = []string{c.kmsKeyId}
+		}
+		add(preflight)
+	}
+	if stringIn("copy-keys", iamFeatures(c)) {
+		// the keys behind the instances' volumes, which could be any key
+		add(iamStatement{Sid: "SourceKeys", Action: []string{"kms:DescribeKey"}, Resource: []string{"*"},
+			Condition: map[string]map[string]interface{}{"StringEquals": {"aws:RequestedRegion": []string{c.sourceRegion}}}})
+	}
+	add(iamStatement{Sid: "Metrics", Action: pick("cloudwatch:"), Resource: []string{"*"}, Condition: inRegions})
+	if actions["ssm:SendCommand"] {
+		// SendCommand is limited to our documents on our instances; command status can't be limited
+		resources := []string{}
+		for _, document := range []string{vssDocument, c.preFreezeSSM, c.postThawSSM} {
+			switch {
+			case document == "" || (document == vssDocument && c.windowsPolicy != "vss"):
+			case strings.HasPrefix(document, "arn:"):
+				resources = append(resources, document)
+			case strings.HasPrefix(document, "AWS"):
+				// AWS's own documents have no account in their ARN
+				resources = append(resources, arns("arn:aws:ssm:%s::document/"+document)...)
+			default:
+				resources = append(resources, arns("arn:aws:ssm:%s:*:document/"+document)...)
+			}
+		}
+		add(iamStatement{Sid: "RunCommand", Action: []string{"ssm:SendCommand"}, Resource: append(resources, arns("arn:aws:ec2:%s:*:instance/*")...)})
+		add(iamStatement{Sid: "RunCommandStatus", Action: []string{"ssm:GetCommandInvocation"}, Resource: []string{"*"}, Condition: inRegions})
+	}
+	if actions["ssm:GetParameter"] && c.freezeParameter != "" {
+		add(iamStatement{Sid: "Freeze", Action: []string{"ssm:GetParameter"}, Resource: []string{fmt.Sprintf("arn:aws:ssm:%s:*:parameter/%s", c.sourceRegion, strings.TrimPrefix(c.freezeParameter, "/"))}})
+	}
+	if actions["ssm:PutParameter"] {
+		add(iamStatement{Sid: "LatestParameter", Action: pick("ssm:", "ssm:GetCommandInvocation", "ssm:SendCommand"),
+			Resource: arns("arn:aws:ssm:%s:*:parameter" + strings.TrimSuffix(c.latestParameter, "/") + "/*")})
+	}
+	add(iamStatement{Sid: "Account", Action: pick("sts:"), Resource: []string{"*"}})
+	for i := range statements {
+		statements[i].Effect = "Allow"
+	}
+	return iamPolicyDocument{"2012-10-17", statements}
+}
+
+// writeIAMPolicy prints the policy document for --generate-iam-policy
+func writeIAMPolicy(out io.Writer, c *Config) error {
+	policy, err := json.MarshalIndent(iamPolicy(c), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", policy)
+	return err
+}
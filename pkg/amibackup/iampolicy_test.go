@@ -0,0 +1,138 @@
+package amibackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// opServices are the IAM service prefixes of the non-EC2 operations a run makes
+var opServices = map[string]string{
+	"GetCallerIdentity":               "sts",
+	"GetParameter":                    "ssm",
+	"PutParameter":                    "ssm",
+	"DeleteParameter":                 "ssm",
+	"SendCommand":                     "ssm",
+	"GetCommandInvocation":            "ssm",
+	"DescribeKey":                     "kms",
+	"GetKeyPolicy":                    "kms",
+	"GenerateDataKeyWithoutPlaintext": "kms",
+	"PutMetricData":                   "cloudwatch",
+	"GetMetricStatistics":             "cloudwatch",
+	"PutObject":                       "s3",
+}
+
+// policyActions returns every action a policy allows
+func policyActions(doc iamPolicyDocument) map[string]bool {
+	actions := map[string]bool{}
+	for _, s := range doc.Statement {
+		for _, action := range s.Action {
+			actions[action] = true
+		}
+	}
+	return actions
+}
+
+// policyStatement returns a policy's statement by Sid, or nil
+func policyStatement(doc iamPolicyDocument, sid string) *iamStatement {
+	for i := range doc.Statement {
+		if doc.Statement[i].Sid == sid {
+			return &doc.Statement[i]
+		}
+	}
+	return nil
+}
+
+// TestIAMPolicyCoversRun runs backups against a fake AWS and checks that --generate-iam-policy
+// for the same options allows every call they made, so iamFeatureActions can't fall behind
+// the code
+func TestIAMPolicyCoversRun(t *testing.T) {
+	fastPolls(t)
+	base := []string{"--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--no-progress"}
+	tests := []struct {
+		name string
+		args []string
+		not  []string // actions the policy mustn't allow
+	}{
+		{"backup", []string{"--freeze-parameter=none", "--no-reconcile"}, []string{"ssm:GetParameter", "ec2:DeregisterImage"}},
+		{"reconcile and purge", []string{"-p", "1d:4d:30d"}, nil},
+		{"purge only", []string{"-o", "-p", "1d:4d:30d", "--freeze-parameter=none"}, []string{"ec2:CreateImage"}},
+		{"instance tags", []string{"--tag-instance", "--instance-state-tag", "--freeze-parameter=none"}, nil},
+		{"metrics", []string{"-p", "1d:4d:30d", "--cloudwatch-namespace=Backups", "--freeze-parameter=none"}, nil},
+		{"latest parameter", []string{"-p", "1d:4d:30d", "--latest-parameter=/amibackup/latest", "--freeze-parameter=none"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := runFake(t, map[string]func(fakeCall) fakeCall{
+				"GetParameter": func(fakeCall) fakeCall {
+					return func(interface{}) (interface{}, error) { return nil, apiError("ParameterNotFound") }
+				},
+				"PutMetricData": func(fakeCall) fakeCall {
+					return func(interface{}) (interface{}, error) { return &cloudwatch.PutMetricDataOutput{}, nil }
+				},
+			}, "web")
+			c, err := parseTestOptions(append(append(base, tt.args...), "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			if _, err := run(context.Background(), c); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+
+			allowed := policyActions(iamPolicy(c))
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, op := range f.calls {
+				service := opServices[op]
+				if service == "" {
+					service = "ec2"
+				}
+				if action := service + ":" + op; !allowed[action] {
+					t.Errorf("run called %s, which the policy doesn't allow", action)
+				}
+			}
+			for _, action := range tt.not {
+				if allowed[action] {
+					t.Errorf("policy allows %s, which the run has no need of", action)
+				}
+			}
+		})
+	}
+}
+
+func TestIAMPolicyResources(t *testing.T) {
+	key := "arn:aws:kms:us-west-2:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	tests := []struct {
+		name     string
+		args     []string
+		sid      string
+		resource string // "" when the statement mustn't be there
+	}{
+		{"encrypt", []string{"--dest=us-west-2", "-k", key}, "Encrypt", key},
+		{"kms preflight", []string{"--dest=us-west-2", "-k", key}, "KMSPreflight", key},
+		{"freeze", nil, "Freeze", "arn:aws:ssm:us-east-1:*:parameter/amibackup/freeze"},
+		{"no freeze", []string{"--freeze-parameter=none"}, "Freeze", ""},
+		{"pre-freeze document", []string{"--pre-freeze-ssm=FlushDB"}, "RunCommand", "arn:aws:ssm:us-east-1:*:document/FlushDB"},
+		{"latest parameter", []string{"-p", "1d:4d:30d", "--latest-parameter=/amibackup/latest"}, "LatestParameter", "arn:aws:ssm:us-west-1:*:parameter/amibackup/latest/*"},
+		{"gc references", []string{"--gc-references", "--latest-parameter=/amibackup/latest/"}, "LatestParameter", "arn:aws:ssm:us-east-1:*:parameter/amibackup/latest/*"},
+		{"no latest parameter", []string{"-p", "1d:4d:30d"}, "LatestParameter", ""},
+		{"summary", []string{"--summary-s3=s3://reports/amibackup"}, "RunSummary", "arn:aws:s3:::reports/amibackup/*"},
+	}
+	for _, tt := range tests {
+		c, err := parseTestOptions(append(tt.args, "web")...)
+		if err != nil {
+			t.Fatalf("%s: parseOptions: %s", tt.name, err)
+		}
+		s := policyStatement(iamPolicy(c), tt.sid)
+		switch {
+		case tt.resource == "" && s != nil:
+			t.Errorf("%s: policy has a %s statement: %+v", tt.name, tt.sid, *s)
+		case tt.resource != "" && s == nil:
+			t.Errorf("%s: policy has no %s statement", tt.name, tt.sid)
+		case tt.resource != "" && !stringIn(tt.resource, s.Resource):
+			t.Errorf("%s: %s statement is on %s, want %s", tt.name, tt.sid, strings.Join(s.Resource, ", "), tt.resource)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// incompleteImages are web's backups as crashed runs left them, by what reconcile should do
+// with them under the default --incomplete-max-age of 48h
+func incompleteImages() []types.Image {
+	now := time.Now()
+	named := func(id string, age time.Duration, state types.ImageState, tags ...string) types.Image {
+		img := image(id, "snap-"+id)
+		img.Name = aws.String(fmt.Sprintf("web-%s-i-1", now.Add(-age).Format("2006-01-02_15-04-05")))
+		img.State = state
+		for i := 0; i < len(tags); i += 2 {
+			img.Tags = append(img.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+		return img
+	}
+	return []types.Image{
+		named("ami-finished", 72*time.Hour, types.ImageStateAvailable, "hostname", "web", "timestamp", "1"),
+		named("ami-young-failed", 3*time.Hour, types.ImageStateFailed),
+		named("ami-old-failed", 72*time.Hour, types.ImageStateFailed),
+		named("ami-old-marked", 72*time.Hour, types.ImageStateAvailable, "timestamp", "1", "amibackup:incomplete", "true"),
+		named("ami-old-pending", 72*time.Hour, types.ImageStatePending),
+		named("ami-untagged", 3*time.Hour, types.ImageStateAvailable),
+		named("ami-other-host", 72*time.Hour, types.ImageStateFailed, "hostname", "webserver"),
+	}
+}
+
+// reconcileFake answers reconcile's calls for the images given
+func reconcileFake(t *testing.T, images []types.Image) *fakeEC2 {
+	byId := map[string]types.Image{}
+	for _, img := range images {
+		byId[*img.ImageId] = img
+	}
+	ok := func(out interface{}) fakeCall { return func(interface{}) (interface{}, error) { return out, nil } }
+	return newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			in := input.(*ec2.DescribeImagesInput)
+			out := &ec2.DescribeImagesOutput{}
+			for _, id := range in.ImageIds {
+				out.Images = append(out.Images, byId[id])
+			}
+			for _, filter := range in.Filters {
+				for _, img := range images {
+					switch aws.ToString(filter.Name) {
+					case "name":
+						out.Images = append(out.Images, img)
+					case "block-device-mapping.snapshot-id":
+						if stringIn("snap-"+*img.ImageId, filter.Values) {
+							out.Images = append(out.Images, img)
+						}
+					}
+				}
+			}
+			return out, nil
+		},
+		"DeregisterImage": ok(&ec2.DeregisterImageOutput{}),
+		"DeleteSnapshot":  ok(&ec2.DeleteSnapshotOutput{}),
+		"CreateTags":      ok(&ec2.CreateTagsOutput{}),
+	})
+}
+
+func TestReconcileIncomplete(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantDelete []string
+		wantTag    []string
+	}{
+		// the young failed image is left for now, as is anything still working or not ours
+		{"default age", nil, []string{"ami-old-failed", "ami-old-marked"}, []string{"ami-untagged"}},
+		{"short age", []string{"--incomplete-max-age=1h"}, []string{"ami-old-failed", "ami-old-marked", "ami-untagged", "ami-young-failed"}, nil},
+		{"dry run", []string{"--dry-run"}, nil, nil},
+		{"frozen", []string{"--freeze=purge"}, nil, []string{"ami-untagged"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions(append(tt.args, "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			f := reconcileFake(t, incompleteImages())
+			if err := reconcileIncomplete(context.Background(), f.Client, "us-east-1", "web", c); err != nil {
+				t.Fatalf("reconcileIncomplete: %s", err)
+			}
+			deleted, tagged := []string{}, []string{}
+			for _, in := range f.inputs("DeregisterImage") {
+				deleted = append(deleted, aws.ToString(in.(*ec2.DeregisterImageInput).ImageId))
+			}
+			for _, in := range f.inputs("CreateTags") {
+				in := in.(*ec2.CreateTagsInput)
+				tagged = append(tagged, in.Resources...)
+				// the tags are recovered from the image's name
+				keys := []string{}
+				for _, tag := range in.Tags {
+					keys = append(keys, aws.ToString(tag.Key))
+				}
+				if want := []string{"hostname", "instance", "date", "timestamp"}; !reflect.DeepEqual(keys, want) {
+					t.Errorf("%v tagged %v, want %v", in.Resources, keys, want)
+				}
+			}
+			sort.Strings(deleted)
+			if fmt.Sprint(deleted) != fmt.Sprint(tt.wantDelete) || fmt.Sprint(tagged) != fmt.Sprint(tt.wantTag) {
+				t.Errorf("deleted %v and tagged %v, want %v and %v", deleted, tagged, tt.wantDelete, tt.wantTag)
+			}
+		})
+	}
+}
+
+func TestNoReconcile(t *testing.T) {
+	fastPolls(t)
+	for _, reconcile := range []bool{true, false} {
+		f := runFake(t, nil, "web")
+		args := []string{"--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none", "--no-progress"}
+		if !reconcile {
+			args = append(args, "--no-reconcile")
+		}
+		c, err := parseTestOptions(append(args, "web")...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		summary, err := run(context.Background(), c)
+		summary.setOutcome(err)
+		if summary.Status != statusSuccess {
+			t.Errorf("run ended %s (%v)", summary.Status, err)
+		}
+		// reconcile lists the images named like web's backups in both regions
+		listed := 0
+		for _, in := range f.inputs("DescribeImages") {
+			for _, filter := range in.(*ec2.DescribeImagesInput).Filters {
+				if aws.ToString(filter.Name) == "name" && reflect.DeepEqual(filter.Values, []string{"web-*"}) {
+					listed++
+				}
+			}
+		}
+		if want := map[bool]int{true: 2, false: 0}[reconcile]; listed != want {
+			t.Errorf("reconcile %v: listed incomplete backups %d times, want %d", reconcile, listed, want)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	if _, err := parseTestOptions("--fix-tags", "web"); err == nil {
+		t.Errorf("--fix-tags without --validate-tags was accepted")
+	}
+	taken := time.Date(2026, 3, 1, 12, 30, 0, 0, time.Local)
+	named := func(id, name string, tags ...string) types.Image {
+		img := image(id, "snap-"+id)
+		img.Name = aws.String(name)
+		for i := 0; i < len(tags); i += 2 {
+			img.Tags = append(img.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+		return img
+	}
+	backup := "web-" + taken.Format("2006-01-02_15-04-05") + "-i-1"
+	images := []types.Image{
+		named("ami-whole", backup, "hostname", "web", "instance", "i-1", "date", "d", "timestamp", "1"),
+		named("ami-partial", backup, "hostname", "web", "instance", "i-1"),
+		named("ami-bare", backup),
+		// nothing but the hostname can be recovered from a name that isn't ours
+		named("ami-renamed", "web-golden"),
+	}
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string // the tags added to each AMI, by key
+	}{
+		{"fix", []string{"--validate-tags", "--fix-tags"}, map[string]string{
+			"ami-partial": "date timestamp",
+			"ami-bare":    "hostname instance date timestamp",
+			"ami-renamed": "hostname",
+		}},
+		{"report only", []string{"--validate-tags"}, map[string]string{}},
+		{"dry run", []string{"--validate-tags", "--fix-tags", "--dry-run"}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions(append(tt.args, "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			f := reconcileFake(t, images)
+			if err := validateTags(context.Background(), f.Client, c.sourceRegion, "web", c); err != nil {
+				t.Fatalf("validateTags: %s", err)
+			}
+			got := map[string]string{}
+			for _, in := range f.inputs("CreateTags") {
+				in := in.(*ec2.CreateTagsInput)
+				keys := []string{}
+				for _, tag := range in.Tags {
+					keys = append(keys, aws.ToString(tag.Key))
+					// recovered from the name the backup was given when it was taken
+					want := map[string]string{"hostname": "web", "instance": "i-1", "date": taken.Format("2006-01-02 15:04:05 -0700"), "timestamp": fmt.Sprint(taken.Unix())}[aws.ToString(tag.Key)]
+					if aws.ToString(tag.Value) != want {
+						t.Errorf("%v tagged %s=%s, want %s", in.Resources, aws.ToString(tag.Key), aws.ToString(tag.Value), want)
+					}
+				}
+				got[in.Resources[0]] = strings.Join(keys, " ")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("added %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
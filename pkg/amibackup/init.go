@@ -0,0 +1,343 @@
+package amibackup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/docopt/docopt-go"
+)
+
+var initUsage = `amibackup init: set amibackup up for the first time
+
+Usage:
+  amibackup init [options]
+  amibackup init -h --help
+
+Options:
+  -s, --source=<region>     AWS region of the instances to back up.
+  -d, --dest=<region>       AWS region to store the backup AMIs in.
+  --name-tag=<tag>          Name tag of the instances to back up.
+  --daily=<days>            Keep one backup per day for this many days (0 for none).
+  --weekly=<weeks>          Then one per week for this many weeks (0 for none).
+  --monthly=<months>        Then one per month for this many months (0 for none).
+  -o, --output=<file>       Settings file to write, as AMIBACKUP_* variables [default: amibackup.env].
+  --force                   Overwrite the settings file if it exists.
+  --dry-run                 Finish with a dry run of the new settings.
+  --endpoint-url=<url>      Send AWS API calls to this endpoint instead of the regional AWS one.
+  -h, --help                Show this screen.
+
+Each question is asked at the terminal unless its option answers it.  Without a terminal, every
+option must be given (--force and --dry-run default to no), and a missing one is an error.
+`
+
+// initAnswers are what init asks for
+type initAnswers struct {
+	source, dest, nameTag  string
+	daily, weekly, monthly int
+	output                 string
+	force, dryRun          bool
+	endpointURL            string
+}
+
+// prompter asks init's questions at the terminal, or fails naming the option that answers them
+type prompter struct {
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+}
+
+// ask asks a question, returning def for an empty answer
+func (p *prompter) ask(question, def, option string) (string, error) {
+	if !p.terminal {
+		return "", classErrorf(classConfig, "no terminal to ask %q - give %s", question, option)
+	}
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if err != nil && answer == "" {
+		return "", classErrorf(classConfig, "no answer to %q", question)
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// askCount asks for a count until it gets one
+func (p *prompter) askCount(question, def, option string) (int, error) {
+	for {
+		answer, err := p.ask(question, def, option)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 0 {
+			return n, nil
+		}
+		fmt.Fprintf(p.out, "Please enter a whole number, 0 or more.\n")
+	}
+}
+
+// confirm asks a yes or no question, answering no without a terminal
+func (p *prompter) confirm(question string) bool {
+	if !p.terminal {
+		return false
+	}
+	answer, err := p.ask(question+" (y/N)", "", "")
+	answer = strings.ToLower(answer)
+	return err == nil && (answer == "y" || answer == "yes")
+}
+
+// initMain runs the init subcommand, returning the arguments for a dry run of the new settings
+// if one was asked for
+func initMain(args []string) ([]string, error) {
+	arguments, err := docopt.Parse(initUsage, append([]string{"init"}, args...), true, version, false, false)
+	if err != nil {
+		return nil, classErrorf(classConfig, "Error parsing arguments: %s", err.Error())
+	}
+	if arguments == nil {
+		return nil, errDone
+	}
+	a := &initAnswers{output: arguments["--output"].(string), force: arguments["--force"].(bool), dryRun: arguments["--dry-run"].(bool)}
+	a.source, _ = arguments["--source"].(string)
+	a.dest, _ = arguments["--dest"].(string)
+	a.nameTag, _ = arguments["--name-tag"].(string)
+	a.endpointURL, _ = arguments["--endpoint-url"].(string)
+	a.daily, a.weekly, a.monthly = -1, -1, -1
+	for _, count := range []struct {
+		option string
+		n      *int
+	}{{"--daily", &a.daily}, {"--weekly", &a.weekly}, {"--monthly", &a.monthly}} {
+		if arg, ok := arguments[count.option].(string); ok {
+			*count.n, err = strconv.Atoi(arg)
+			if err != nil || *count.n < 0 {
+				return nil, classErrorf(classConfig, "Invalid %s: %s", strings.TrimPrefix(count.option, "--"), arg)
+			}
+		}
+	}
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stderr, terminal: isTerminal(os.Stdin)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	clients, err := newClientPool(ctx, a.endpointURL, newRunID())
+	if err != nil {
+		return nil, classify(classConfig, err)
+	}
+	return runInit(ctx, clients, a, p)
+}
+
+// runInit asks what init's options didn't answer, checking each answer against AWS, and writes
+// the settings file
+func runInit(ctx context.Context, clients *clientPool, a *initAnswers, p *prompter) ([]string, error) {
+	home := a.source
+	if home == "" {
+		home = "us-east-1"
+	}
+	caller, err := clients.callerIdentity(ctx, home, "")
+	if err != nil {
+		return nil, classErrorf(classCredentials, "Your AWS credentials don't work: %s - see amibackup --help under AWS Authentication", err.Error())
+	}
+	fmt.Fprintf(p.out, "AWS credentials work: %s\n", caller)
+
+	regions, err := enabledRegions(ctx, clients.EC2(home, ""))
+	if err != nil {
+		return nil, classErrorf(apiErrorClass(err, classDiscovery), "Error listing regions: %s", err.Error())
+	}
+	fmt.Fprintf(p.out, "Regions enabled for your account: %s\n", strings.Join(regions, ", "))
+	if a.source, err = askRegion(p, "Region of the instances to back up", a.source, "us-east-1", "--source", regions); err != nil {
+		return nil, err
+	}
+	if a.dest, err = askRegion(p, "Region to keep the backups in", a.dest, "us-west-1", "--dest", regions); err != nil {
+		return nil, err
+	}
+	if a.dest == a.source {
+		fmt.Fprintf(p.out, "WARNING: backups kept in the region they were made in don't survive losing that region.\n")
+	}
+
+	for {
+		if a.nameTag == "" {
+			if a.nameTag, err = p.ask("Name tag of the instances to back up", "", "--name-tag"); err != nil {
+				return nil, err
+			}
+		}
+		instances, err := findInstances(ctx, clients.EC2(a.source, ""), a.nameTag, &Config{})
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) > 0 {
+			fmt.Fprintf(p.out, "Found %d instances named %s in %s:\n", len(instances), a.nameTag, a.source)
+			for _, instance := range instances {
+				state := "unknown"
+				if instance.State != nil {
+					state = string(instance.State.Name)
+				}
+				fmt.Fprintf(p.out, "  %s  %s  %d volumes\n", *instance.InstanceId, state, len(instance.BlockDeviceMappings))
+			}
+			break
+		}
+		if !p.terminal {
+			return nil, classErrorf(classDiscovery, "No instances with Name tag %s in %s", a.nameTag, a.source)
+		}
+		fmt.Fprintf(p.out, "No instances with Name tag %s in %s - the tag is matched exactly.\n", a.nameTag, a.source)
+		a.nameTag = ""
+	}
+
+	fmt.Fprintf(p.out, "How long should backups be kept?\n")
+	if a.daily < 0 {
+		if a.daily, err = p.askCount("Keep one backup per day for how many days?", "14", "--daily"); err != nil {
+			return nil, err
+		}
+	}
+	if a.weekly < 0 {
+		if a.weekly, err = p.askCount("Then one per week for how many weeks?", "8", "--weekly"); err != nil {
+			return nil, err
+		}
+	}
+	if a.monthly < 0 {
+		if a.monthly, err = p.askCount("Then one per month for how many months?", "6", "--monthly"); err != nil {
+			return nil, err
+		}
+	}
+	windows := initWindows(a.daily, a.weekly, a.monthly)
+	for _, w := range windows {
+		if _, err := purge.ParseWindow(w, time.Now()); err != nil {
+			return nil, classErrorf(classInternal, "Error building purge windows: %s", err.Error())
+		}
+	}
+	if len(windows) == 0 {
+		fmt.Fprintf(p.out, "WARNING: with no purge windows, no backup is ever deleted.\n")
+	} else {
+		fmt.Fprintf(p.out, "Purge windows: -p %s\n", strings.Join(windows, " -p "))
+		fmt.Fprintf(p.out, "Backups are only thinned out by purge windows: those older than %s are kept until you delete them.\n", windowsEnd(windows))
+	}
+
+	if _, err := os.Stat(a.output); err == nil && !a.force && !p.confirm(fmt.Sprintf("%s exists - overwrite it?", a.output)) {
+		return nil, classErrorf(classConfig, "%s exists - remove it, give --force, or choose another --output", a.output)
+	}
+	if err := writeInitSettings(a.output, a, windows); err != nil {
+		return nil, classErrorf(classInternal, "Error writing %s: %s", a.output, err.Error())
+	}
+	args := append([]string{"-s", a.source, "-d", a.dest}, windowArgs(windows)...)
+	if a.endpointURL != "" {
+		args = append(args, "--endpoint-url", a.endpointURL)
+	}
+	quoted := []string{}
+	for _, arg := range append(args, a.nameTag) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	fmt.Fprintf(p.out, "Wrote %s.  To back up with it:\n  set -a; . %s; set +a; amibackup %s\n", a.output, shellQuote(a.output), shellQuote(a.nameTag))
+	fmt.Fprintf(p.out, "Or as one command:\n  amibackup %s\n", strings.Join(quoted, " "))
+	if a.dryRun || p.confirm("Run a dry run now?") {
+		return append(append(args, "--dry-run"), a.nameTag), nil
+	}
+	return nil, nil
+}
+
+// enabledRegions lists the regions the account can use
+func enabledRegions(ctx context.Context, awsec2 *ec2.Client) ([]string, error) {
+	resp, err := awsec2.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeRegions failed: %s", err.Error())
+	}
+	regions := []string{}
+	for _, region := range resp.Regions {
+		regions = append(regions, aws.ToString(region.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// askRegion asks for one of regions, unless given already names one
+func askRegion(p *prompter, question, given, def, option string, regions []string) (string, error) {
+	for {
+		region := given
+		if region == "" {
+			var err error
+			if region, err = p.ask(question, def, option); err != nil {
+				return "", err
+			}
+		}
+		if stringIn(region, regions) {
+			return region, nil
+		}
+		if given != "" || !p.terminal {
+			return "", classErrorf(classConfig, "Invalid %s: %s is not a region enabled for the account", strings.TrimPrefix(option, "--"), region)
+		}
+		fmt.Fprintf(p.out, "%s is not one of the regions above.\n", region)
+	}
+}
+
+// initWindows renders init's retention answers as purge windows: after the newest day, one per
+// day for days, then one per week for weeks, then one per month (30 days) for months
+func initWindows(days, weeks, months int) []string {
+	windows := []string{}
+	reach := 0 // how many days back the windows so far reach
+	for _, step := range []struct{ interval, count int }{{1, days}, {7, weeks}, {30, months}} {
+		from := reach
+		if from == 0 {
+			from = 1 // every backup of the newest day is kept
+		}
+		reach += step.interval * step.count
+		if reach > from {
+			windows = append(windows, fmt.Sprintf("%dd:%dd:%dd", step.interval, from, reach))
+		}
+	}
+	return windows
+}
+
+// windowsEnd is how far back the last of init's windows reaches
+func windowsEnd(windows []string) string {
+	parts := strings.Split(windows[len(windows)-1], ":")
+	return parts[2]
+}
+
+// windowArgs turns purge windows into -p arguments
+func windowArgs(windows []string) []string {
+	args := []string{}
+	for _, w := range windows {
+		args = append(args, "-p", w)
+	}
+	return args
+}
+
+// writeInitSettings writes init's answers as AMIBACKUP_* variables, for a shell to source or a
+// scheduler's environment file
+func writeInitSettings(path string, a *initAnswers, windows []string) error {
+	lines := []string{
+		fmt.Sprintf("# amibackup settings written by amibackup init on %s", time.Now().Format("2006-01-02")),
+		fmt.Sprintf("# back up with: set -a; . %s; set +a; amibackup %s", shellQuote(path), shellQuote(a.nameTag)),
+		envName("source") + "=" + a.source,
+		envName("dest") + "=" + a.dest,
+	}
+	if len(windows) > 0 {
+		lines = append(lines, envName("purge")+"="+strings.Join(windows, ","))
+	}
+	if a.endpointURL != "" {
+		lines = append(lines, envName("endpoint-url")+"="+shellQuote(a.endpointURL))
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+var shellSafe = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// shellQuote quotes s for a POSIX shell, if it needs it
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
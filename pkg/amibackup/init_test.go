@@ -0,0 +1,150 @@
+package amibackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+func TestInitWindows(t *testing.T) {
+	tests := []struct {
+		days, weeks, months int
+		want                []string
+	}{
+		{14, 8, 6, []string{"1d:1d:14d", "7d:14d:70d", "30d:70d:250d"}},
+		// every backup of the newest day is kept, whichever window comes first
+		{0, 4, 0, []string{"7d:1d:28d"}},
+		{1, 0, 2, []string{"30d:1d:61d"}},
+		{0, 0, 0, []string{}},
+	}
+	for _, tt := range tests {
+		got := initWindows(tt.days, tt.weeks, tt.months)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("initWindows(%d, %d, %d) = %q, want %q", tt.days, tt.weeks, tt.months, got, tt.want)
+		}
+		if len(got) > 0 && windowsEnd(got) != strings.Split(tt.want[len(tt.want)-1], ":")[2] {
+			t.Errorf("windowsEnd(%q) = %s", got, windowsEnd(got))
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"web-01":              "web-01",
+		"alias/backup":        "alias/backup",
+		"web server":          "'web server'",
+		"it's":                `'it'\''s'`,
+		"$(rm -rf /)":         "'$(rm -rf /)'",
+		"http://localhost:80": "http://localhost:80",
+	} {
+		if got := shellQuote(s); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+// initAWS answers init's calls: the caller, three regions, and one instance named web
+func initAWS(t *testing.T, credentials error) *clientPool {
+	fakeClients(t, newFakeAWS(t, map[string]fakeCall{
+		"GetCallerIdentity": func(interface{}) (interface{}, error) {
+			return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:iam::123456789012:user/admin")}, credentials
+		},
+		"DescribeRegions": func(interface{}) (interface{}, error) {
+			return &ec2.DescribeRegionsOutput{Regions: []types.Region{
+				{RegionName: aws.String("us-west-2")}, {RegionName: aws.String("us-east-1")}, {RegionName: aws.String("eu-west-1")},
+			}}, nil
+		},
+		"DescribeInstances": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeInstancesOutput{}
+			if filters := input.(*ec2.DescribeInstancesInput).Filters; stringIn("web", filters[0].Values) {
+				out.Reservations = []types.Reservation{{Instances: []types.Instance{{InstanceId: aws.String("i-1"),
+					State: &types.InstanceState{Name: types.InstanceStateNameRunning}}}}}
+			}
+			return out, nil
+		},
+	}))
+	clients, err := newClientPool(context.Background(), "", "test-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clients
+}
+
+func TestRunInit(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "amibackup.env")
+	// the default source; a region that isn't enabled, then one that is; a name tag that matches
+	// nothing, then one that does; the default days, a bad count, then weeks; no months; a dry run
+	answers := "\nmars-1\nus-west-2\nnosuch\nweb\n\nsome\n4\n0\ny\n"
+	var out bytes.Buffer
+	p := &prompter{in: bufio.NewReader(strings.NewReader(answers)), out: &out, terminal: true}
+	a := &initAnswers{output: output, daily: -1, weekly: -1, monthly: -1}
+	args, err := runInit(context.Background(), initAWS(t, nil), a, p)
+	if err != nil {
+		t.Fatalf("runInit: %s\n%s", err, out.String())
+	}
+	want := []string{"-s", "us-east-1", "-d", "us-west-2", "-p", "1d:1d:14d", "-p", "7d:14d:42d", "--dry-run", "web"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("dry run args %q, want %q", args, want)
+	}
+	for _, said := range []string{"mars-1 is not one of the regions above", "No instances with Name tag nosuch", "Please enter a whole number",
+		"Found 1 instances named web", "those older than 42d are kept"} {
+		if !strings.Contains(out.String(), said) {
+			t.Errorf("init didn't say %q:\n%s", said, out.String())
+		}
+	}
+
+	// the settings file is read back as amibackup's environment
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+			env[key] = value
+		}
+	}
+	opts := parseUsageOptions(usage)
+	args, sources := applyEnv([]string{"web"}, opts, func(name string) string { return env[name] })
+	c, err := parseOptions(args, opts, sources)
+	if err != nil {
+		t.Fatalf("parseOptions from %s: %s\n%s", output, err, b)
+	}
+	if c.sourceRegion != "us-east-1" || c.destRegion != "us-west-2" || len(c.windows) != 2 {
+		t.Errorf("settings read back as %s to %s with %d windows:\n%s", c.sourceRegion, c.destRegion, len(c.windows), b)
+	}
+
+	// without a terminal, init never waits on stdin
+	tests := []struct {
+		name    string
+		a       initAnswers
+		creds   error
+		class   errorClass
+		wantErr string
+	}{
+		{"unanswered", initAnswers{source: "us-east-1", dest: "us-west-2", daily: 7, weekly: 0, monthly: 0}, nil, classConfig, "--name-tag"},
+		{"not enabled", initAnswers{source: "us-east-1", dest: "mars-1", nameTag: "web", daily: 7, weekly: 0, monthly: 0}, nil, classConfig, "dest"},
+		{"no instances", initAnswers{source: "us-east-1", dest: "us-west-2", nameTag: "nosuch", daily: 7, weekly: 0, monthly: 0}, nil, classDiscovery, "nosuch"},
+		{"exists", initAnswers{source: "us-east-1", dest: "us-west-2", nameTag: "web", daily: 7, weekly: 0, monthly: 0}, nil, classConfig, "--force"},
+		{"credentials", initAnswers{}, apiError("InvalidClientTokenId"), classCredentials, "credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.a.output = output
+			p := &prompter{in: bufio.NewReader(strings.NewReader("")), out: &bytes.Buffer{}}
+			if _, err := runInit(context.Background(), initAWS(t, tt.creds), &tt.a, p); classOf(err, classInternal) != tt.class || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("runInit = %v, want a %s error about %s", err, tt.class, tt.wantErr)
+			}
+		})
+	}
+}
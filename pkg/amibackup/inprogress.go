@@ -0,0 +1,71 @@
+package amibackup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// inProgressTag marks an image a run is still working on with the run's ID, from its CreateImage
+// or CopyImage until the instance's pipeline is done, so amicleanup and other runs' purges leave
+// it alone.  A run that crashes leaves the tag behind; once it is older than --in-progress-stale
+// the image is fair game again, and reconciliation deals with it.
+const inProgressTag = "amibackup:in-progress"
+
+// inProgressTags returns the tag specification that marks a new image as this run's
+func inProgressTags(c *Config) []types.TagSpecification {
+	return []types.TagSpecification{{
+		ResourceType: types.ResourceTypeImage,
+		Tags:         []types.Tag{{Key: aws.String(inProgressTag), Value: aws.String(c.runID)}},
+	}}
+}
+
+// runStarted returns the start time at the head of a run ID (2006-01-02_15-04-05-xxxxxxxx), in
+// local time like our AMI names
+func runStarted(runID string) (time.Time, bool) {
+	if len(runID) < 19 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation("2006-01-02_15-04-05", runID[:19], time.Local)
+	return t, err == nil
+}
+
+// inFlight returns the run still working on an image: the run ID in its in-progress tag, if that
+// run started less than --in-progress-stale ago.  A tag whose run ID has no start time can't be
+// told apart from a crash leftover, so it doesn't protect the image.
+func inFlight(image types.Image, c *Config) (string, bool) {
+	runID := discovery.TagValue(image.Tags, inProgressTag)
+	if runID == "" || runID == c.runID {
+		return "", false
+	}
+	started, ok := runStarted(runID)
+	if !ok {
+		log.Printf("WARNING: AMI %s has %s=%s, which doesn't start with a run's start time - treating it as stale", aws.ToString(image.ImageId), inProgressTag, runID)
+		return "", false
+	}
+	return runID, time.Since(started) < c.inProgressStale
+}
+
+// clearInProgress removes the in-progress tag from an instance's images once its pipeline is
+// done with them, whether it succeeded or not.  Failing to is logged, never fatal: the tag goes
+// stale in time anyway.
+func clearInProgress(ctx context.Context, clients *clientPool, images map[string]string, c *Config) {
+	if c.dryRun {
+		return
+	}
+	for id, region := range images {
+		awsec2 := clients.EC2(region, "")
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.DeleteTags(ctx, &ec2.DeleteTagsInput{Resources: []string{id}, Tags: []types.Tag{{Key: aws.String(inProgressTag)}}})
+			return err
+		})
+		if err != nil && !raced(err, "DeleteTags", id, c) {
+			log.Printf("WARNING: can't remove %s from %s in %s: EC2 API DeleteTags failed: %s", inProgressTag, id, region, err.Error())
+		}
+	}
+}
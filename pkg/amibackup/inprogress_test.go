@@ -0,0 +1,104 @@
+package amibackup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestPurgeSkipsInFlight(t *testing.T) {
+	asOf := time.Now()
+	purging, err := parseTestOptions("-p", "1d:4d:30d", "--in-progress-stale=24h", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	// another run is making a backup of web while this one purges; one that crashed two days
+	// ago left its tag behind
+	other, err := parseTestOptions("web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	crashed := *other
+	crashed.runID = asOf.Add(-48*time.Hour).Format("2006-01-02_15-04-05") + "-0badcafe"
+
+	images := backupImages("web", map[string]time.Time{
+		// all in the middle of one of the 1d window's days
+		"oldest":   asOf.Add(-231 * time.Hour),
+		"inflight": asOf.Add(-230 * time.Hour),
+		"crashed":  asOf.Add(-229 * time.Hour),
+		"ours":     asOf.Add(-228 * time.Hour),
+	})
+	for i := range images {
+		switch aws.ToString(images[i].ImageId) {
+		case "web-inflight":
+			images[i].Tags = append(images[i].Tags, inProgressTags(other)[0].Tags...)
+		case "web-crashed":
+			images[i].Tags = append(images[i].Tags, inProgressTags(&crashed)[0].Tags...)
+		case "web-ours":
+			// this run's own tag doesn't protect an image from it
+			images[i].Tags = append(images[i].Tags, inProgressTags(purging)[0].Tags...)
+		}
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			if len(input.(*ec2.DescribeImagesInput).ImageIds) > 0 {
+				return &ec2.DescribeImagesOutput{}, nil
+			}
+			return &ec2.DescribeImagesOutput{Images: images}, nil
+		},
+		"DeregisterImage": func(interface{}) (interface{}, error) { return &ec2.DeregisterImageOutput{}, nil },
+		"DeleteSnapshot":  func(interface{}) (interface{}, error) { return &ec2.DeleteSnapshotOutput{}, nil },
+	})
+
+	records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", "web", purging, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	actions := map[string]string{}
+	for _, r := range records {
+		if actions[r.AmiId] == "" || r.Action == actionPurged {
+			actions[r.AmiId] = r.Action
+		}
+	}
+	if actions["web-inflight"] != actionKeptInProgress {
+		t.Errorf("the other run's in-flight image was %s, want %s", actions["web-inflight"], actionKeptInProgress)
+	}
+	deregistered := []string{}
+	for _, in := range f.inputs("DeregisterImage") {
+		deregistered = append(deregistered, aws.ToString(in.(*ec2.DeregisterImageInput).ImageId))
+	}
+	sort.Strings(deregistered)
+	if got := strings.Join(deregistered, ","); got != "web-crashed,web-ours" {
+		t.Errorf("deregistered %s with actions %v, want web-crashed and web-ours", got, actions)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	c, err := parseTestOptions("--in-progress-stale=2d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	tests := []struct {
+		runID string
+		want  bool
+	}{
+		{time.Now().Add(-time.Hour).Format("2006-01-02_15-04-05") + "-0000beef", true},
+		{time.Now().Add(-47*time.Hour).Format("2006-01-02_15-04-05") + "-0000beef", true},
+		{time.Now().Add(-49*time.Hour).Format("2006-01-02_15-04-05") + "-0000beef", false},
+		{c.runID, false},
+		{"manual", false},
+	}
+	for _, tt := range tests {
+		img := image("ami-1")
+		img.Tags = []types.Tag{{Key: aws.String(inProgressTag), Value: aws.String(tt.runID)}}
+		if _, got := inFlight(img, c); got != tt.want {
+			t.Errorf("inFlight with run %s = %v, want %v", tt.runID, got, tt.want)
+		}
+	}
+}
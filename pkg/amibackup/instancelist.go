@@ -0,0 +1,67 @@
+package amibackup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// instanceIdPattern is what an EC2 instance ID looks like, old (8 hex digits) or new (17)
+var instanceIdPattern = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+
+// readInstanceList reads --instances-from: one instance name tag per line, with blank lines
+// and lines starting with # ignored.  A list with no names, or anything that looks like binary
+// rather than text, is an error.
+func readInstanceList(r io.Reader, source string) ([]string, error) {
+	names := []string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if !utf8.ValidString(line) || strings.IndexFunc(line, func(r rune) bool { return unicode.IsControl(r) && r != '\t' && r != '\r' }) >= 0 {
+			return nil, fmt.Errorf("%s line %d is not text - is this the right file?", source, n)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", source, err.Error())
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s lists no instance name tags", source)
+	}
+	return names, nil
+}
+
+// loadInstanceList reads --instances-from from a file, or from stdin if path is -
+func loadInstanceList(path string) ([]string, error) {
+	if path == "-" {
+		return readInstanceList(os.Stdin, "stdin")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readInstanceList(f, path)
+}
+
+// mergeInstanceNames appends the names from a list to those given as arguments, dropping duplicates
+func mergeInstanceNames(args, listed []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, name := range append(append([]string{}, args...), listed...) {
+		if !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
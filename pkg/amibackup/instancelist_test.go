@@ -0,0 +1,111 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestInstanceIdOptions(t *testing.T) {
+	c, err := parseTestOptions("--instance-id=i-0123456789abcdef0", "--instance-id=i-0123abcd", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	if want := []string{"web", "i-0123456789abcdef0", "i-0123abcd"}; !reflect.DeepEqual(c.instanceNameTags, want) || !c.instanceIds["i-0123abcd"] || c.instanceIds["web"] {
+		t.Errorf("instances %v, IDs %v", c.instanceNameTags, c.instanceIds)
+	}
+	// an ID alone is enough to back up
+	if _, err := parseTestOptions("--instance-id=i-0123abcd"); err != nil {
+		t.Errorf("--instance-id without a Name tag: %s", err)
+	}
+	for _, id := range []string{"web", "i-0123", "i-0123456789ABCDEF0", "vol-0123abcd"} {
+		if _, err := parseTestOptions("--instance-id="+id, "web"); classOf(err, classInternal) != classConfig {
+			t.Errorf("--instance-id=%s = %v, want a config error", id, err)
+		}
+	}
+}
+
+func TestInstanceIdRun(t *testing.T) {
+	fastPolls(t)
+	tests := []struct {
+		name   string
+		id     string
+		status string
+	}{
+		{"found", "i-0000000000000abcd", statusSuccess},
+		// an ID that matches nothing is an error, not an empty backup
+		{"not found", "i-0000000000000dead", statusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := runFake(t, map[string]func(fakeCall) fakeCall{
+				"DescribeInstances": func(next fakeCall) fakeCall {
+					return func(input interface{}) (interface{}, error) {
+						ids := input.(*ec2.DescribeInstancesInput).InstanceIds
+						switch {
+						case len(ids) == 0:
+							return next(input)
+						case ids[0] != "i-0000000000000abcd":
+							return nil, apiError("InvalidInstanceID.NotFound")
+						}
+						// no Name tag: why it's backed up by ID
+						return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{{
+							InstanceId:     aws.String(ids[0]),
+							State:          &types.InstanceState{Name: types.InstanceStateNameRunning},
+							RootDeviceName: aws.String("/dev/xvda"),
+							BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+								{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-unnamed")}},
+							},
+						}}}}}, nil
+					}
+				},
+			}, "web")
+			c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+				"--no-reconcile", "--no-progress", "--instance-id="+tt.id, "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			summary, err := run(context.Background(), c)
+			summary.setOutcome(err)
+			if summary.Status != tt.status {
+				t.Fatalf("run ended %s (%v), want %s", summary.Status, err, tt.status)
+			}
+			if tt.status != statusSuccess {
+				if classOf(err, classInternal) != classDiscovery || !strings.Contains(err.Error(), tt.id+" not found in us-east-1") {
+					t.Errorf("run failed with %v, want a discovery error naming the instance", err)
+				}
+				return
+			}
+
+			backedUp := []string{}
+			for _, r := range summary.Backups {
+				backedUp = append(backedUp, r.Instance)
+			}
+			sort.Strings(backedUp)
+			if want := []string{tt.id, "web"}; !reflect.DeepEqual(backedUp, want) {
+				t.Errorf("backed up %v, want %v", backedUp, want)
+			}
+			// its image is named and tagged for its ID
+			for _, in := range f.inputs("CreateImage") {
+				in := in.(*ec2.CreateImageInput)
+				if aws.ToString(in.InstanceId) == tt.id && !strings.HasPrefix(aws.ToString(in.Name), amiNamePrefix(tt.id)+"-") {
+					t.Errorf("image of %s named %s", tt.id, aws.ToString(in.Name))
+				}
+			}
+			tagged := false
+			for _, in := range f.inputs("CreateTags") {
+				tagged = tagged || discovery.TagValue(in.(*ec2.CreateTagsInput).Tags, "hostname") == tt.id
+			}
+			if !tagged {
+				t.Errorf("no backup tagged hostname=%s", tt.id)
+			}
+		})
+	}
+}
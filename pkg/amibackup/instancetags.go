@@ -0,0 +1,99 @@
+package amibackup
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// --tag-instance tags on the source instance.  amiinventory --instance-tags reads lastSuccessTag.
+const (
+	lastSuccessTag = "amibackup:last-success" // RFC 3339 time of the last fully successful backup
+	lastAMITag     = "amibackup:last-ami"     // its source AMI
+	lastFailureTag = "amibackup:last-failure" // RFC 3339 time of the last failed backup, and why
+)
+
+// longest EC2 tag value, in characters
+const maxTagValueLength = 256
+
+// most resources one CreateTags call takes
+const createTagsBatchSize = 1000
+
+// truncateTagValue cuts a tag value to EC2's limit, marking that it was cut
+func truncateTagValue(value string) string {
+	if utf8.RuneCountInString(value) <= maxTagValueLength {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:maxTagValueLength-3]) + "..."
+}
+
+// instanceResultTags returns the --tag-instance tags for a finished backup, or nil for one that
+// was neither a success nor a failure (skipped by policy, left pending by --no-wait, or deferred
+// by --max-new-gb)
+func instanceResultTags(r backupResult, when string) []types.Tag {
+	switch {
+	case r.Error != "":
+		reason := strings.Join(strings.Fields(r.Error), " ")
+		return []types.Tag{{Key: aws.String(lastFailureTag), Value: aws.String(truncateTagValue(when + " " + reason))}}
+	case r.Pending || r.Status == statusPolicyMissing || r.Status == statusDeferredBudget || r.Status == statusDeferredDeadline:
+		return nil
+	}
+	tags := []types.Tag{{Key: aws.String(lastSuccessTag), Value: aws.String(when)}}
+	if r.SourceAMI != "" {
+		tags = append(tags, types.Tag{Key: aws.String(lastAMITag), Value: aws.String(r.SourceAMI)})
+	}
+	return tags
+}
+
+// tagInstanceResults writes the --tag-instance tags for a run's backups.  Instances that get the
+// same tags - every success's last-success time, the same failure at the same time - share
+// CreateTags calls.  Failing to tag is logged but never fails the run.
+func tagInstanceResults(ctx context.Context, awsec2 *ec2.Client, results []backupResult, when time.Time, c *Config) {
+	if !c.tagInstance {
+		return
+	}
+	stamp := when.UTC().Format(time.RFC3339)
+	batches := map[string][]string{} // one tag, as key=value, to the instances getting it
+	tags := map[string]types.Tag{}
+	for _, r := range results {
+		for _, tag := range instanceResultTags(r, stamp) {
+			kv := *tag.Key + "=" + *tag.Value
+			batches[kv] = append(batches[kv], r.InstanceId)
+			tags[kv] = tag
+		}
+	}
+	keys := make([]string, 0, len(batches))
+	for kv := range batches {
+		keys = append(keys, kv)
+	}
+	sort.Strings(keys)
+	for _, kv := range keys {
+		instanceIds := batches[kv]
+		if c.dryRun {
+			log.Printf("DRYRUN: would have tagged %d instances %s (%s)", len(instanceIds), kv, strings.Join(instanceIds, ", "))
+			continue
+		}
+		for len(instanceIds) > 0 {
+			batch := instanceIds
+			if len(batch) > createTagsBatchSize {
+				batch = batch[:createTagsBatchSize]
+			}
+			instanceIds = instanceIds[len(batch):]
+			err := withFreshCredentials(ctx, awsec2, func() error {
+				_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: batch, Tags: []types.Tag{tags[kv]}})
+				return err
+			})
+			if err != nil {
+				log.Printf("Error tagging instances %s with %s: %s", strings.Join(batch, ", "), kv, err.Error())
+			}
+		}
+	}
+}
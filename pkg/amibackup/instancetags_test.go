@@ -0,0 +1,90 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+func TestInstanceResultTags(t *testing.T) {
+	when := "2026-03-01T02:30:00Z"
+	long := strings.Repeat("é", 300)
+	tests := []struct {
+		name   string
+		result backupResult
+		want   map[string]string // nil for no tags
+	}{
+		{"success", backupResult{SourceAMI: "ami-1"}, map[string]string{lastSuccessTag: when, lastAMITag: "ami-1"}},
+		{"failure", backupResult{SourceAMI: "ami-1", Error: "EC2 API CreateImage failed:\n\tInvalidParameterValue"},
+			map[string]string{lastFailureTag: when + " EC2 API CreateImage failed: InvalidParameterValue"}},
+		// EC2 counts characters, not bytes
+		{"long failure", backupResult{Error: long}, map[string]string{lastFailureTag: string([]rune(when + " " + long)[:253]) + "..."}},
+		{"pending", backupResult{SourceAMI: "ami-1", Pending: true}, nil},
+		{"no policy", backupResult{Status: statusPolicyMissing}, nil},
+		{"deferred", backupResult{Status: statusDeferredBudget}, nil},
+	}
+	for _, tt := range tests {
+		var got map[string]string
+		for _, tag := range instanceResultTags(tt.result, when) {
+			if got == nil {
+				got = map[string]string{}
+			}
+			got[*tag.Key] = *tag.Value
+			if n := utf8.RuneCountInString(*tag.Value); n > maxTagValueLength {
+				t.Errorf("%s: %s is %d characters, over EC2's limit", tt.name, *tag.Key, n)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tags = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTagInstanceResults(t *testing.T) {
+	when := time.Date(2026, 3, 1, 2, 30, 0, 0, time.UTC)
+	results := []backupResult{}
+	for i := 0; i < createTagsBatchSize+1; i++ {
+		results = append(results, backupResult{InstanceId: fmt.Sprintf("i-%d", i)})
+	}
+	results = append(results,
+		backupResult{InstanceId: "i-failed-1", Error: "copy failed"},
+		backupResult{InstanceId: "i-failed-2", Error: "copy failed"},
+		backupResult{InstanceId: "i-pending", Pending: true})
+	for _, dryRun := range []bool{false, true} {
+		args := []string{"--tag-instance", "web"}
+		if dryRun {
+			args = append([]string{"--dry-run"}, args...)
+		}
+		c, err := parseTestOptions(args...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		f := newFakeEC2(t, map[string]fakeCall{"CreateTags": func(interface{}) (interface{}, error) { return nil, apiError("RequestLimitExceeded") }})
+		// a failure to tag is only logged
+		tagInstanceResults(context.Background(), f.Client, results, when, c)
+
+		calls := map[string][]int{} // tag to the size of each call
+		for _, in := range f.inputs("CreateTags") {
+			in := in.(*ec2.CreateTagsInput)
+			tag := aws.ToString(in.Tags[0].Key) + "=" + aws.ToString(in.Tags[0].Value)
+			calls[tag] = append(calls[tag], len(in.Resources))
+		}
+		want := map[string][]int{
+			lastSuccessTag + "=2026-03-01T02:30:00Z":             {createTagsBatchSize, 1},
+			lastFailureTag + "=2026-03-01T02:30:00Z copy failed": {2},
+		}
+		if dryRun {
+			want = map[string][]int{}
+		}
+		if !reflect.DeepEqual(calls, want) {
+			t.Errorf("dry run %v: CreateTags calls %v, want %v", dryRun, calls, want)
+		}
+	}
+}
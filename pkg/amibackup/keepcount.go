@@ -0,0 +1,97 @@
+package amibackup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+)
+
+// the rule behind a purge decision, recorded when --keep-count is in play
+const (
+	ruleWindow = "window"
+	ruleCount  = "count"
+	ruleBoth   = "window+count"
+)
+
+// newestImages returns the n newest of images, ties going to the higher ID as in purge.SortByTime
+func newestImages(images map[string]time.Time, n int) map[string]bool {
+	ids := []string{}
+	for id := range images {
+		ids = append(ids, id)
+	}
+	purge.SortByTime(ids, images)
+	newest := map[string]bool{}
+	for i := len(ids) - 1; i >= 0 && len(newest) < n; i-- {
+		newest[ids[i]] = true
+	}
+	return newest
+}
+
+// applyKeepCount folds --keep-count into the window plan of one host and region.  Without
+// windows the count decides every image: the newest are KEPT_COUNT and the rest purged.  With
+// --combine-retention an image is kept if either rule keeps it, so a window's purge of one of
+// the newest becomes KEPT_COUNT.  Each record gets the rule that decided it, and the images
+// left to purge are returned oldest first.
+func applyKeepCount(records []PurgeRecord, images map[string]time.Time, c *Config) ([]PurgeRecord, []string) {
+	newest := newestImages(images, c.keepCount)
+	for i, r := range records {
+		countKeeps := newest[r.AmiId]
+		if !c.combineRetention {
+			records[i].Action, records[i].Rule = actionPurged, ruleCount
+			if countKeeps {
+				records[i].Action = actionKeptCount
+			}
+			continue
+		}
+		windowKeeps := r.Action != actionPurged
+		switch {
+		case windowKeeps && countKeeps:
+			records[i].Rule = ruleBoth
+		case windowKeeps:
+			records[i].Rule = ruleWindow
+		case countKeeps:
+			records[i].Action, records[i].Rule = actionKeptCount, ruleCount
+		default:
+			records[i].Rule = ruleBoth
+		}
+	}
+	purged := map[string]bool{}
+	purgeIds := []string{}
+	for _, r := range records {
+		if r.Action == actionPurged && !purged[r.AmiId] {
+			purged[r.AmiId] = true
+			purgeIds = append(purgeIds, r.AmiId)
+		}
+	}
+	purge.SortByTime(purgeIds, images)
+	return records, purgeIds
+}
+
+// keptByCount lists the images --keep-count alone kept, oldest first, for the log
+func keptByCount(records []PurgeRecord) []PurgeRecord {
+	seen := map[string]bool{}
+	kept := []PurgeRecord{}
+	for _, r := range records {
+		if r.Action == actionKeptCount && !seen[r.AmiId] {
+			seen[r.AmiId] = true
+			kept = append(kept, r)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].CreatedAt.Before(kept[j].CreatedAt) })
+	return kept
+}
+
+// decisionNote describes the rule behind a purge decision, for the log: the window (and its
+// retention class) and/or the --keep-count the image fell outside of
+func decisionNote(r PurgeRecord, c *Config) string {
+	note := ""
+	if r.Rule != ruleCount {
+		note = fmt.Sprintf(" (%s->%s)%s", r.Window.Start.Format(timeShortFormat), r.Window.Stop.Format(timeShortFormat), classNote(r.Class))
+	}
+	if r.Rule == ruleCount || r.Rule == ruleBoth {
+		note += fmt.Sprintf(" [not among the newest %d]", c.keepCount)
+	}
+	return note
+}
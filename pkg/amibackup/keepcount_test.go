@@ -0,0 +1,112 @@
+package amibackup
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepCountAlone(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	images := twiceDaily(asOf, 10)
+	c, err := parseTestOptions("--keep-count=3", "--as-of="+asOf.Format(time.RFC3339), "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	records, purgeIds := applyKeepCount(planPurge("web", "us-east-1", "", nil, images), images, c)
+	if len(records) != 10 {
+		t.Fatalf("got %d records, want one per image", len(records))
+	}
+	for _, r := range records {
+		// twiceDaily numbers images newest first
+		want := actionPurged
+		if r.AmiId <= "ami-002" {
+			want = actionKeptCount
+		}
+		if r.Action != want || r.Rule != ruleCount {
+			t.Errorf("%s %s by %s, want %s by %s", r.AmiId, r.Action, r.Rule, want, ruleCount)
+		}
+	}
+	if got := strings.Join(purgeIds, ","); got != "ami-009,ami-008,ami-007,ami-006,ami-005,ami-004,ami-003" {
+		t.Errorf("purging %s, want everything past the newest 3, oldest first", got)
+	}
+}
+
+func TestKeepCountCombined(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	images := twiceDaily(asOf, 60)
+	c, err := parseTestOptions("--keep-count=10", "--combine-retention", "-p", "1d:4d:30d", "--as-of="+asOf.Format(time.RFC3339), "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	windowRecords := planPurge("web", "us-east-1", "", c.windows, images)
+	windowPurges := map[string]bool{}
+	for _, r := range windowRecords {
+		if r.Action == actionPurged {
+			windowPurges[r.AmiId] = true
+		}
+	}
+	// the newest day is before the windows start, so the count reaches into their purges
+	newest := map[string]bool{}
+	for id := range images {
+		if id <= "ami-009" {
+			newest[id] = true
+		}
+	}
+
+	records, purgeIds := applyKeepCount(append([]PurgeRecord{}, windowRecords...), images, c)
+	rules := map[string]bool{}
+	bothKeep := false
+	for i, r := range records {
+		windowKeeps, countKeeps := windowRecords[i].Action != actionPurged, newest[r.AmiId]
+		want, wantRule := windowRecords[i].Action, ruleBoth
+		switch {
+		case windowKeeps && !countKeeps:
+			wantRule = ruleWindow
+		case !windowKeeps && countKeeps:
+			want, wantRule = actionKeptCount, ruleCount
+		}
+		if r.Action != want || r.Rule != wantRule {
+			t.Errorf("%s %s by %s, want %s by %s", r.AmiId, r.Action, r.Rule, want, wantRule)
+		}
+		rules[r.Action+" "+r.Rule] = true
+		bothKeep = bothKeep || windowKeeps && countKeeps
+	}
+	// the test covers each way the two rules can combine
+	for _, seen := range []string{actionKeptCount + " " + ruleCount, actionPurged + " " + ruleBoth} {
+		if !rules[seen] {
+			t.Errorf("no image was %s, have %v", seen, rules)
+		}
+	}
+	if !rules[actionKeptOldest+" "+ruleWindow] || !bothKeep {
+		t.Errorf("the windows and count never both kept an image, or the windows never kept one alone: %v", rules)
+	}
+	for _, id := range purgeIds {
+		if !windowPurges[id] || newest[id] {
+			t.Errorf("purging %s, which the windows or the count keep", id)
+		}
+	}
+	if len(purgeIds) == 0 || len(purgeIds) >= len(windowPurges) {
+		t.Errorf("purging %d images, want fewer than the windows' %d and some", len(purgeIds), len(windowPurges))
+	}
+}
+
+func TestKeepCountOptions(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--keep-count=14"}, ""},
+		{[]string{"--keep-count=14", "--combine-retention", "-p", "1d:4d:30d"}, ""},
+		{[]string{"--keep-count=0"}, "Invalid keep-count"},
+		{[]string{"--keep-count=14", "-p", "1d:4d:30d"}, "add --combine-retention"},
+		{[]string{"--combine-retention", "-p", "1d:4d:30d"}, "needs --keep-count"},
+		{[]string{"--keep-count=14", "--combine-retention"}, "needs --keep-count and -p"},
+	}
+	for _, tt := range tests {
+		_, err := parseTestOptions(append(tt.args, "web")...)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%q: got error %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/smithy-go"
+)
+
+// ebsKeyActions are what the key policy must let whoever copies an AMI do with its KMS key, for
+// EC2 to encrypt the copy's snapshots
+var ebsKeyActions = []string{"kms:CreateGrant", "kms:Decrypt", "kms:DescribeKey", "kms:GenerateDataKeyWithoutPlaintext", "kms:ReEncryptFrom", "kms:ReEncryptTo"}
+
+// preflightKMS checks that EC2 can encrypt copies with the -k key before any copy starts - a bad
+// key otherwise shows up as copies that sit pending for an hour, then fail with a vague reason.
+// It fails on a key that is missing, disabled, in the wrong region, not a symmetric encryption
+// key, or whose key policy doesn't let caller (the identity that makes the copies) use it.  What
+// it lacks the permissions to check is a warning, and the run goes ahead.
+func preflightKMS(ctx context.Context, awskms *kms.Client, keyId, region, caller string) error {
+	resp, err := awskms.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+	switch {
+	case errorCode(err) == "NotFoundException":
+		return classErrorf(classConfig, "KMS key %s does not exist in %s", keyId, region)
+	case err != nil:
+		log.Printf("WARNING: can't check KMS key %s (going ahead): KMS API DescribeKey failed: %s", keyId, err.Error())
+	case resp.KeyMetadata != nil:
+		if err := checkKeyMetadata(resp.KeyMetadata, region); err != nil {
+			return err
+		}
+	}
+
+	viaService := false
+	policy, err := awskms.GetKeyPolicy(ctx, &kms.GetKeyPolicyInput{KeyId: aws.String(keyId), PolicyName: aws.String("default")})
+	switch {
+	case err != nil:
+		log.Printf("WARNING: can't check the key policy of KMS key %s (going ahead): KMS API GetKeyPolicy failed: %s", keyId, err.Error())
+	case caller == "":
+		log.Printf("WARNING: can't check the key policy of KMS key %s (going ahead): the caller's identity is unknown", keyId)
+	default:
+		var missing []string
+		missing, viaService, err = keyPolicyGaps(aws.ToString(policy.Policy), caller)
+		if err != nil {
+			log.Printf("WARNING: can't check the key policy of KMS key %s (going ahead): %s", keyId, err.Error())
+		} else if len(missing) > 0 {
+			return classErrorf(classConfig, "the key policy of KMS key %s doesn't allow %s to %s - EC2 needs them to encrypt copies; allow them for that identity or its account root in the key policy",
+				keyId, caller, strings.Join(missing, ", "))
+		}
+	}
+
+	// DryRun: KMS checks the request and permissions, and makes no key
+	_, err = awskms.GenerateDataKeyWithoutPlaintext(ctx, &kms.GenerateDataKeyWithoutPlaintextInput{
+		KeyId:   aws.String(keyId),
+		KeySpec: kmstypes.DataKeySpecAes256,
+		DryRun:  aws.Bool(true),
+	})
+	code := errorCode(err)
+	switch {
+	case err == nil || code == "DryRunOperationException":
+		return nil
+	case code == "DisabledException" || code == "KMSInvalidStateException":
+		return classErrorf(classConfig, "KMS key %s can't be used: %s", keyId, apiErrorMessage(err))
+	case code == "AccessDeniedException" && viaService:
+		log.Printf("WARNING: can't probe KMS key %s directly, as its key policy only allows use through AWS services (going ahead): %s", keyId, apiErrorMessage(err))
+	case code == "AccessDeniedException" && strings.Contains(apiErrorMessage(err), "resource-based policy"):
+		return classErrorf(classConfig, "the key policy of KMS key %s denies %s: %s", keyId, caller, apiErrorMessage(err))
+	case code == "AccessDeniedException":
+		// an IAM policy without the probe's permission - which may just be limited to kms:ViaService
+		log.Printf("WARNING: can't probe KMS key %s (going ahead) - check that %s has kms:GenerateDataKeyWithoutPlaintext on it: %s", keyId, caller, apiErrorMessage(err))
+	default:
+		log.Printf("WARNING: can't probe KMS key %s (going ahead): KMS API GenerateDataKeyWithoutPlaintext failed: %s", keyId, err.Error())
+	}
+	return nil
+}
+
+// checkKeyMetadata fails a key EBS can't encrypt with in region
+func checkKeyMetadata(key *kmstypes.KeyMetadata, region string) error {
+	arn := aws.ToString(key.Arn)
+	if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[3] != region {
+		return classErrorf(classConfig, "KMS key %s is in %s, but the copies are made in %s - use a key (or a multi-Region replica key) in %s", arn, parts[3], region, region)
+	}
+	if key.KeyState != kmstypes.KeyStateEnabled {
+		return classErrorf(classConfig, "KMS key %s is %s - EBS can only encrypt with an enabled key", arn, key.KeyState)
+	}
+	if key.KeyUsage != kmstypes.KeyUsageTypeEncryptDecrypt || key.KeySpec != kmstypes.KeySpecSymmetricDefault {
+		return classErrorf(classConfig, "KMS key %s has key spec %s and usage %s - EBS needs a symmetric encryption key (SYMMETRIC_DEFAULT, ENCRYPT_DECRYPT)", arn, key.KeySpec, key.KeyUsage)
+	}
+	return nil
+}
+
+// apiErrorMessage is an AWS error's message, without the SDK's request details
+func apiErrorMessage(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorMessage()
+	}
+	return err.Error()
+}
+
+// keyPolicyStatement is the part of a key policy statement keyPolicyGaps reads
+type keyPolicyStatement struct {
+	Effect    string
+	Principal json.RawMessage
+	Action    json.RawMessage
+	Condition map[string]map[string]json.RawMessage
+}
+
+// keyPolicyGaps returns which ebsKeyActions no Allow statement of a key policy grants caller (an
+// IAM or assumed-role ARN), and whether a statement that grants them only does so through an AWS
+// service (kms:ViaService).  Granting the caller's account root counts, as that hands the
+// decision to IAM policies; conditions other than kms:ViaService, and Deny statements, aren't
+// weighed - the probe that follows catches those.
+func keyPolicyGaps(policy, caller string) ([]string, bool, error) {
+	var doc struct {
+		Statement json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return nil, false, fmt.Errorf("can't parse it: %s", err.Error())
+	}
+	statements := []keyPolicyStatement{}
+	if err := json.Unmarshal(doc.Statement, &statements); err != nil {
+		var one keyPolicyStatement
+		if err := json.Unmarshal(doc.Statement, &one); err != nil {
+			return nil, false, fmt.Errorf("can't parse its statements: %s", err.Error())
+		}
+		statements = append(statements, one)
+	}
+	granted := map[string]bool{}
+	viaService := false
+	for _, s := range statements {
+		if s.Effect != "Allow" || !principalAllowed(s.Principal, caller) {
+			continue
+		}
+		for _, action := range ebsKeyActions {
+			for _, pattern := range jsonStrings(s.Action) {
+				if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(action)); matched {
+					granted[action] = true
+					for _, conditions := range s.Condition {
+						for key := range conditions {
+							if strings.EqualFold(key, "kms:ViaService") {
+								viaService = true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	missing := []string{}
+	for _, action := range ebsKeyActions {
+		if !granted[action] {
+			missing = append(missing, action)
+		}
+	}
+	return missing, viaService, nil
+}
+
+// principalAllowed reports whether a key policy statement's Principal covers caller: "*", the
+// caller's account, or the caller itself - for an assumed role, its role, whatever its path
+func principalAllowed(principal json.RawMessage, caller string) bool {
+	principals := jsonStrings(principal)
+	var byType map[string]json.RawMessage
+	if json.Unmarshal(principal, &byType) == nil {
+		principals = jsonStrings(byType["AWS"])
+	}
+	parts := strings.SplitN(caller, ":", 6)
+	if len(parts) < 6 {
+		return false
+	}
+	partition, account, resource := parts[1], parts[4], parts[5]
+	role := ""
+	if strings.HasPrefix(resource, "assumed-role/") {
+		role = strings.SplitN(strings.TrimPrefix(resource, "assumed-role/"), "/", 2)[0]
+	}
+	rolePrefix := fmt.Sprintf("arn:%s:iam::%s:role/", partition, account)
+	for _, p := range principals {
+		switch {
+		case p == "*", p == account, p == fmt.Sprintf("arn:%s:iam::%s:root", partition, account), p == caller:
+			return true
+		case role != "" && strings.HasPrefix(p, rolePrefix) && (p == rolePrefix+role || strings.HasSuffix(p, "/"+role)):
+			return true
+		}
+	}
+	return false
+}
+
+// jsonStrings reads a policy element that is a string or a list of them
+func jsonStrings(raw json.RawMessage) []string {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return []string{one}
+	}
+	var list []string
+	json.Unmarshal(raw, &list)
+	return list
+}
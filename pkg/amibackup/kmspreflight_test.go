@@ -0,0 +1,129 @@
+package amibackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	preflightKey    = "arn:aws:kms:us-west-2:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	preflightCaller = "arn:aws:sts::123456789012:assumed-role/backup/i-0123456789abcdef0"
+)
+
+// rootKeyPolicy is the default key policy, handing the account's use of the key to IAM
+const rootKeyPolicy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow",
+	"Principal": {"AWS": "arn:aws:iam::123456789012:root"}, "Action": "kms:*", "Resource": "*"}]}`
+
+// kmsAnswer answers a fake KMS call
+func kmsAnswer(out interface{}, code, message string) fakeCall {
+	return func(interface{}) (interface{}, error) {
+		if code != "" {
+			return nil, &smithy.GenericAPIError{Code: code, Message: message}
+		}
+		return out, nil
+	}
+}
+
+// preflightKeyIn describes the test key, as it is in region and in state
+func preflightKeyIn(region string, state kmstypes.KeyState) fakeCall {
+	return kmsAnswer(&kms.DescribeKeyOutput{KeyMetadata: &kmstypes.KeyMetadata{
+		Arn:      aws.String(strings.Replace(preflightKey, "us-west-2", region, 1)),
+		KeyState: state,
+		KeyUsage: kmstypes.KeyUsageTypeEncryptDecrypt,
+		KeySpec:  kmstypes.KeySpecSymmetricDefault,
+	}}, "", "")
+}
+
+func TestPreflightKMS(t *testing.T) {
+	enabled := preflightKeyIn("us-west-2", kmstypes.KeyStateEnabled)
+	policy := func(p string) fakeCall { return kmsAnswer(&kms.GetKeyPolicyOutput{Policy: aws.String(p)}, "", "") }
+	dryRunOK := kmsAnswer(nil, "DryRunOperationException", "The request would have succeeded")
+	tests := []struct {
+		name     string
+		describe fakeCall
+		policy   fakeCall
+		probe    fakeCall
+		wantErr  string // "" to go ahead
+		wantLog  string
+	}{
+		{"usable", enabled, policy(rootKeyPolicy), dryRunOK, "", ""},
+		{"missing", kmsAnswer(nil, "NotFoundException", "Key not found"), policy(rootKeyPolicy), dryRunOK, "does not exist in us-west-2", ""},
+		{"disabled", preflightKeyIn("us-west-2", kmstypes.KeyStateDisabled), policy(rootKeyPolicy), dryRunOK, "is Disabled", ""},
+		{"pending deletion", preflightKeyIn("us-west-2", kmstypes.KeyStatePendingDeletion), policy(rootKeyPolicy), dryRunOK, "is PendingDeletion", ""},
+		{"wrong region", preflightKeyIn("us-east-1", kmstypes.KeyStateEnabled), policy(rootKeyPolicy), dryRunOK, "is in us-east-1, but the copies are made in us-west-2", ""},
+		{"asymmetric", kmsAnswer(&kms.DescribeKeyOutput{KeyMetadata: &kmstypes.KeyMetadata{
+			Arn: aws.String(preflightKey), KeyState: kmstypes.KeyStateEnabled, KeyUsage: kmstypes.KeyUsageTypeSignVerify, KeySpec: kmstypes.KeySpecRsa2048,
+		}}, "", ""), policy(rootKeyPolicy), dryRunOK, "EBS needs a symmetric encryption key", ""},
+		{"policy for another account", enabled, policy(`{"Statement": [{"Effect": "Allow",
+			"Principal": {"AWS": "arn:aws:iam::210987654321:root"}, "Action": "kms:*", "Resource": "*"}]}`), dryRunOK,
+			"doesn't allow " + preflightCaller + " to kms:CreateGrant", ""},
+		{"policy without grants", enabled, policy(`{"Statement": [{"Effect": "Allow",
+			"Principal": {"AWS": "arn:aws:iam::123456789012:role/service/backup"}, "Action": ["kms:Decrypt", "kms:DescribeKey", "kms:Encrypt", "kms:GenerateDataKey*", "kms:ReEncrypt*"], "Resource": "*"}]}`), dryRunOK,
+			"to kms:CreateGrant -", ""},
+		{"probe denied by the key policy", enabled, policy(rootKeyPolicy),
+			kmsAnswer(nil, "AccessDeniedException", "User is not authorized to perform: kms:GenerateDataKeyWithoutPlaintext because no resource-based policy allows it"),
+			"the key policy of KMS key " + preflightKey + " denies", ""},
+		{"probe on a disabled key", enabled, policy(rootKeyPolicy), kmsAnswer(nil, "DisabledException", "key is disabled"), "can't be used: key is disabled", ""},
+		// what preflight can't check is a warning
+		{"probe not allowed by IAM", enabled, policy(rootKeyPolicy),
+			kmsAnswer(nil, "AccessDeniedException", "User is not authorized to perform: kms:GenerateDataKeyWithoutPlaintext because no identity-based policy allows it"),
+			"", "check that " + preflightCaller + " has kms:GenerateDataKeyWithoutPlaintext"},
+		{"probe through EC2 only", enabled, policy(`{"Statement": [{"Effect": "Allow", "Principal": {"AWS": "arn:aws:iam::123456789012:root"},
+			"Action": "kms:*", "Resource": "*", "Condition": {"StringEquals": {"kms:ViaService": "ec2.us-west-2.amazonaws.com"}}}]}`),
+			kmsAnswer(nil, "AccessDeniedException", "not authorized"), "", "only allows use through AWS services"},
+		{"no KMS permissions", kmsAnswer(nil, "AccessDeniedException", "not authorized"), kmsAnswer(nil, "AccessDeniedException", "not authorized"),
+			kmsAnswer(nil, "AccessDeniedException", "not authorized"), "", "can't check KMS key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureLog(t)
+			k := newFakeAWS(t, map[string]fakeCall{
+				"DescribeKey":                     tt.describe,
+				"GetKeyPolicy":                    tt.policy,
+				"GenerateDataKeyWithoutPlaintext": tt.probe,
+			})
+			awskms := kms.New(kms.Options{Region: "us-west-2", Credentials: aws.AnonymousCredentials{}, APIOptions: []func(*middleware.Stack) error{k.apiOption}})
+			err := preflightKMS(context.Background(), awskms, preflightKey, "us-west-2", preflightCaller)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("preflightKMS: %s", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("preflightKMS = %v, want an error with %q", err, tt.wantErr)
+			case err != nil && classOf(err, classInternal) != classConfig:
+				t.Errorf("preflightKMS failed with class %s, want %s", classOf(err, classInternal), classConfig)
+			}
+			if !strings.Contains(out.String(), tt.wantLog) {
+				t.Errorf("log doesn't say %q:\n%s", tt.wantLog, out)
+			}
+		})
+	}
+}
+
+func TestPrincipalAllowed(t *testing.T) {
+	tests := []struct {
+		principal string
+		want      bool
+	}{
+		{`"*"`, true},
+		{`{"AWS": "123456789012"}`, true},
+		{`{"AWS": "arn:aws:iam::123456789012:root"}`, true},
+		{`{"AWS": ["arn:aws:iam::123456789012:role/other", "arn:aws:iam::123456789012:role/backup"]}`, true},
+		// the role has a path, which the assumed-role ARN leaves out
+		{`{"AWS": "arn:aws:iam::123456789012:role/service/backup"}`, true},
+		{`{"AWS": "arn:aws:iam::123456789012:role/backup-old"}`, false},
+		{`{"AWS": "arn:aws:iam::210987654321:role/backup"}`, false},
+		{`{"Service": "ec2.amazonaws.com"}`, false},
+	}
+	for _, tt := range tests {
+		if got := principalAllowed([]byte(tt.principal), preflightCaller); got != tt.want {
+			t.Errorf("principalAllowed(%s) = %v, want %v", tt.principal, got, tt.want)
+		}
+	}
+}
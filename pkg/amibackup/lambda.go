@@ -0,0 +1,118 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Running amibackup as an AWS Lambda function.  The event carries options by their long names,
+// with the instance name tags under "hostnames":
+//
+//	{"hostnames": ["web"], "source": "us-east-1", "dest": "us-west-2", "purge": ["1d:4d:30d"], "dry-run": true}
+//
+// Credentials come from the execution role, and AMIBACKUP_* environment variables still apply.
+// Lambda runs are always --no-wait: each invocation starts new backups and resumes the ones
+// earlier invocations started, so none has to sit out a long copy.
+
+// inLambda reports whether we were started by the Lambda runtime
+func inLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+// startLambda serves invocations until the runtime shuts us down
+func startLambda() {
+	log.SetFlags(0)
+	log.SetOutput(jsonLog{})
+	lambda.Start(handleLambda)
+}
+
+// jsonLog writes each log line as a JSON object
+type jsonLog struct{}
+
+func (jsonLog) Write(b []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Message string `json:"message"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), strings.TrimRight(string(b), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stdout.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// eventArgs turns a Lambda event into command line arguments
+func eventArgs(event map[string]interface{}) ([]string, error) {
+	keys := []string{}
+	for key := range event {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{}
+	hostnames := []string{}
+	for _, key := range keys {
+		switch v := event[key].(type) {
+		case bool:
+			if v {
+				args = append(args, "--"+key)
+			}
+		case string:
+			if key == "hostnames" {
+				hostnames = append(hostnames, v)
+			} else {
+				args = append(args, "--"+key+"="+v)
+			}
+		case float64:
+			args = append(args, fmt.Sprintf("--%s=%v", key, v))
+		case []interface{}:
+			for _, item := range v {
+				if key == "hostnames" {
+					hostnames = append(hostnames, fmt.Sprintf("%v", item))
+				} else {
+					args = append(args, fmt.Sprintf("--%s=%v", key, item))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported value for %s in event: %v", key, v)
+		}
+	}
+	return append(args, hostnames...), nil
+}
+
+// handleLambda runs one invocation, returning the run summary, with its status and error class,
+// as the function's result
+func handleLambda(ctx context.Context, event map[string]interface{}) (*runSummary, error) {
+	setRunStart(time.Now())
+	ui = &progressUI{rows: map[string]*progressRow{}}
+	args, err := eventArgs(event)
+	if err != nil {
+		return nil, classify(classConfig, err)
+	}
+	opts := parseUsageOptions(usage)
+	args, sources := applyEnv(args, opts, os.Getenv)
+	c, err := parseOptions(args, opts, sources)
+	if err == errDone {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.noWait = true
+	c.progress = false
+	summary, err := run(ctx, c)
+	summary.setOutcome(err)
+	if c.summaryS3Bucket != "" && c.simulate == "" {
+		uploadSummary(ctx, summary, c)
+	}
+	return summary, err
+}
@@ -0,0 +1,104 @@
+package amibackup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// mutation is one successful AWS call that changed something, for the end-of-run manifest
+type mutation struct {
+	Operation string `json:"operation"`
+	Resource  string `json:"resource"`
+	Region    string `json:"region"`
+}
+
+// mutationLog collects the mutating calls made by every client in a pool
+type mutationLog struct {
+	mu      sync.Mutex
+	entries []mutation
+}
+
+// newRunID returns an ID for this run, for the User-Agent and idempotency tokens
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", timeStamp, hex.EncodeToString(b))
+}
+
+// isMutating reports whether an API operation changes anything
+func isMutating(operation string) bool {
+	for _, prefix := range []string{"Describe", "List", "Get"} {
+		if strings.HasPrefix(operation, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// resourceIds pulls the resource IDs out of an API input or output struct
+func resourceIds(v interface{}) []string {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	ids := []string{}
+	for _, name := range []string{"InstanceId", "SourceImageId", "ImageId", "SnapshotId"} {
+		if f := rv.FieldByName(name); f.IsValid() {
+			if id, ok := f.Interface().(*string); ok && id != nil {
+				ids = append(ids, *id)
+			}
+		}
+	}
+	if f := rv.FieldByName("Resources"); f.IsValid() {
+		if resources, ok := f.Interface().([]string); ok {
+			ids = append(ids, resources...)
+		}
+	}
+	return ids
+}
+
+// middleware returns the API option that logs each successful mutating call
+func (m *mutationLog) middleware() func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("amibackupMutationLog",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				operation := awsmiddleware.GetOperationName(ctx)
+				if err == nil && isMutating(operation) {
+					m.record(operation, awsmiddleware.GetRegion(ctx), append(resourceIds(in.Parameters), resourceIds(out.Result)...))
+				}
+				return out, metadata, err
+			}), middleware.After)
+	}
+}
+
+// record logs one mutating call
+func (m *mutationLog) record(operation, region string, ids []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, mutation{operation, strings.Join(ids, ","), region})
+}
+
+// list returns the calls recorded so far
+func (m *mutationLog) list() []mutation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mutation{}, m.entries...)
+}
+
+// logMutations prints the run's mutating calls, CloudTrail style
+func logMutations(runID string, mutations []mutation) {
+	log.Printf("Run %s made %d changes:", runID, len(mutations))
+	for _, m := range mutations {
+		log.Printf("  %s %s %s", m.Region, m.Operation, m.Resource)
+	}
+}
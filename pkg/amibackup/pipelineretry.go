@@ -0,0 +1,62 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// backoff between attempts at an instance's pipeline, for --pipeline-retries
+var pipelineRetryStart = 2 * time.Minute
+var pipelineRetryMax = 15 * time.Minute
+
+// forAttempt returns c for an attempt at an instance's pipeline.  A retry gets a copy of its own,
+// so its copies get client tokens of their own - the failed attempt's token would just hand back
+// the failed copy.
+func (c *Config) forAttempt(attempt int) *Config {
+	if attempt <= 1 {
+		return c
+	}
+	ac := *c
+	ac.attempt = attempt
+	return &ac
+}
+
+// copyToken is the CopyImage client token for a copy of amiId.  It is the same for every run
+// resumed from a checkpoint, so a resumed run finds the copy it already started.
+func copyToken(amiId string, c *Config) string {
+	if c.attempt > 1 {
+		return fmt.Sprintf("%s-%s-%d", c.runID, amiId, c.attempt)
+	}
+	return c.runID + "-" + amiId
+}
+
+// retryPipeline says whether a failed attempt at an instance's pipeline is worth another.  Making,
+// copying or checking images can fail and then work minutes later; the options and the instance's
+// tags will be just as wrong next time, and a dry run has nothing to retry.
+func retryPipeline(ctx context.Context, err error, class errorClass, attempt int, c *Config) bool {
+	if err == nil || attempt > c.pipelineRetries || ctx.Err() != nil {
+		return false
+	}
+	switch class {
+	case classCreate, classCopy, classVerify:
+		return !c.dryRun
+	}
+	return false
+}
+
+// discardAttempt deregisters the copies a failed attempt left unfinished, so the retry's copies
+// don't run into their names.  Failing to is logged, not fatal: cleanup of failed copies and the
+// purge catch them later.
+func discardAttempt(ctx context.Context, clients *clientPool, copies map[string]string, inProgress map[string]string, c *Config) {
+	for id, region := range copies {
+		log.Printf("Deregistering copy %s in %s from the failed attempt", id, region)
+		if err := deregisterAMI(ctx, clients.EC2(region, ""), id, c); err != nil {
+			log.Printf("WARNING: can't deregister copy %s in %s before retrying: %s", id, region, err.Error())
+			continue
+		}
+		delete(copies, id)
+		delete(inProgress, id)
+	}
+}
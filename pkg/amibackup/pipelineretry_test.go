@@ -0,0 +1,152 @@
+package amibackup
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// fakeImages answers DescribeImages from a set of images that can change during the test: by ID,
+// as the poller and findAMIByName ask for them; listings by tag find nothing
+type fakeImages struct {
+	mu     sync.Mutex
+	images map[string]types.Image
+}
+
+func (f *fakeImages) set(img types.Image, state types.ImageState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img.State = state
+	f.images[aws.ToString(img.ImageId)] = img
+}
+
+func (f *fakeImages) describe(input interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in := input.(*ec2.DescribeImagesInput)
+	out := &ec2.DescribeImagesOutput{}
+	for _, id := range in.ImageIds {
+		if img, ok := f.images[id]; ok {
+			out.Images = append(out.Images, img)
+		}
+	}
+	for _, filter := range in.Filters {
+		for _, img := range f.images {
+			switch aws.ToString(filter.Name) {
+			case "image-id":
+				if stringIn(aws.ToString(img.ImageId), filter.Values) {
+					out.Images = append(out.Images, img)
+				}
+			case "name":
+				if stringIn(aws.ToString(img.Name), filter.Values) {
+					out.Images = append(out.Images, img)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func TestPipelineRetryAfterFailedCopy(t *testing.T) {
+	fastPolls(t)
+	start, max := pipelineRetryStart, pipelineRetryMax
+	pipelineRetryStart, pipelineRetryMax = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() { pipelineRetryStart, pipelineRetryMax = start, max })
+
+	instance := types.Instance{
+		InstanceId:     aws.String("i-0123456789abcdef0"),
+		State:          &types.InstanceState{Name: types.InstanceStateNameRunning},
+		RootDeviceName: aws.String("/dev/xvda"),
+		Tags:           []types.Tag{{Key: aws.String("Name"), Value: aws.String("web")}},
+		BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")}},
+		},
+	}
+	images := &fakeImages{images: map[string]types.Image{}}
+	ok := func(out interface{}) fakeCall {
+		return func(interface{}) (interface{}, error) { return out, nil }
+	}
+	f := newFakeAWS(t, map[string]fakeCall{
+		"GetEbsEncryptionByDefault": ok(&ec2.GetEbsEncryptionByDefaultOutput{EbsEncryptionByDefault: aws.Bool(false)}),
+		"DescribeInstances": ok(&ec2.DescribeInstancesOutput{Reservations: []types.Reservation{
+			{Instances: []types.Instance{instance}},
+		}}),
+		"GetCallerIdentity": ok(&sts.GetCallerIdentityOutput{Account: aws.String("123456789012"), Arn: aws.String("arn:aws:iam::123456789012:user/backup")}),
+		"DescribeVolumes": ok(&ec2.DescribeVolumesOutput{Volumes: []types.Volume{
+			{VolumeId: aws.String("vol-root"), Size: aws.Int32(8), Encrypted: aws.Bool(false)},
+		}}),
+		"DescribeImages":    images.describe,
+		"DescribeSnapshots": ok(&ec2.DescribeSnapshotsOutput{}),
+		"CreateTags":        ok(&ec2.CreateTagsOutput{}),
+		"DeleteTags":        ok(&ec2.DeleteTagsOutput{}),
+		"DeregisterImage":   ok(&ec2.DeregisterImageOutput{}),
+		"DeleteSnapshot":    ok(&ec2.DeleteSnapshotOutput{}),
+		"CreateImage": script(
+			func(input interface{}) (interface{}, error) {
+				src := image("ami-source", "snap-source")
+				src.Name = input.(*ec2.CreateImageInput).Name
+				images.set(src, types.ImageStateAvailable)
+				return &ec2.CreateImageOutput{ImageId: aws.String("ami-source")}, nil
+			},
+			// the retry's CreateImage runs into the first attempt's AMI, and adopts it
+			func(interface{}) (interface{}, error) { return nil, apiError("InvalidAMIName.Duplicate") },
+		),
+		"CopyImage": script(
+			func(interface{}) (interface{}, error) {
+				images.set(image("ami-copy1", "snap-copy1"), types.ImageStateFailed)
+				return &ec2.CopyImageOutput{ImageId: aws.String("ami-copy1")}, nil
+			},
+			func(interface{}) (interface{}, error) {
+				images.set(image("ami-copy2", "snap-copy2"), types.ImageStateAvailable)
+				return &ec2.CopyImageOutput{ImageId: aws.String("ami-copy2")}, nil
+			},
+		),
+	})
+	fakeClients(t, f)
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--pipeline-retries=2", "--timeout=10m",
+		"--freeze-parameter=none", "--no-reconcile", "--no-progress", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+
+	summary, err := run(context.Background(), c)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if len(summary.Backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(summary.Backups))
+	}
+	result := summary.Backups[0]
+	if result.Error != "" || result.Attempts != 2 || summary.Retries != 1 || summary.Failed != 0 {
+		t.Errorf("backup %+v after %d retries, want it done on attempt 2", result, summary.Retries)
+	}
+	if result.SourceAMI != "ami-source" || result.CopyAMI != "ami-copy2" {
+		t.Errorf("backup made %s and copied it to %s, want ami-source copied to ami-copy2", result.SourceAMI, result.CopyAMI)
+	}
+	if n := f.count("CreateImage"); n != 2 {
+		t.Errorf("CreateImage called %d times, want 2", n)
+	}
+	copies := f.inputs("CopyImage")
+	if len(copies) != 2 {
+		t.Fatalf("CopyImage called %d times, want 2", len(copies))
+	}
+	first, second := aws.ToString(copies[0].(*ec2.CopyImageInput).ClientToken), aws.ToString(copies[1].(*ec2.CopyImageInput).ClientToken)
+	if first == second || aws.ToString(copies[1].(*ec2.CopyImageInput).SourceImageId) != "ami-source" {
+		t.Errorf("retry copied %s with client token %q after %q, want the adopted ami-source under a new token",
+			aws.ToString(copies[1].(*ec2.CopyImageInput).SourceImageId), second, first)
+	}
+	deregistered := []string{}
+	for _, in := range f.inputs("DeregisterImage") {
+		deregistered = append(deregistered, aws.ToString(in.(*ec2.DeregisterImageInput).ImageId))
+	}
+	if strings.Join(deregistered, ",") != "ami-copy1" {
+		t.Errorf("deregistered %v, want just the failed copy ami-copy1", deregistered)
+	}
+}
@@ -0,0 +1,197 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// planVersion changes whenever the --plan format does; schema/plan.schema.json describes it
+const planVersion = 1
+
+// runPlan is the --plan file: everything a dry run would have done, for change-review tools to
+// approve before the real run.  It is filled in by the dry-run branches of the code that would do
+// the work - createAMI, copyAMI and the purge planner - so it says what that code would do.
+type runPlan struct {
+	mu      sync.Mutex
+	creates map[string]*createPlan // by instance ID
+	purges  []PurgeRecord
+}
+
+// createPlan is the backup a run would make of one instance
+type createPlan struct {
+	InstanceTag     string            `json:"instance_tag"`
+	InstanceId      string            `json:"instance_id"`
+	Method          string            `json:"method,omitempty"`
+	AmiName         string            `json:"ami_name"`
+	Description     string            `json:"description"`
+	NoReboot        bool              `json:"no_reboot"`
+	Volumes         []volumePlan      `json:"volumes"`
+	EstimatedSizeGB int64             `json:"estimated_size_gb"`
+	Tags            map[string]string `json:"tags"`
+	Copies          []copyPlan        `json:"copies"`
+}
+
+// volumePlan is one of an instance's volumes, and whether its backup would include it
+type volumePlan struct {
+	Device   string `json:"device"`
+	VolumeId string `json:"volume_id,omitempty"`
+	SizeGB   int64  `json:"size_gb"`
+	Included bool   `json:"included"`
+}
+
+// copyPlan is a copy a run would make of a backup
+type copyPlan struct {
+	Region    string            `json:"region"`
+	AmiName   string            `json:"ami_name"`
+	Encrypted bool              `json:"encrypted"`
+	KmsKeyId  string            `json:"kms_key_id,omitempty"`           // "" for the account's default key
+	ByDefault bool              `json:"encrypted_by_default,omitempty"` // encrypted by the region's EBS encryption by default, not -e
+	Tags      map[string]string `json:"tags"`
+}
+
+// newRunPlan starts an empty plan
+func newRunPlan() *runPlan {
+	return &runPlan{creates: map[string]*createPlan{}}
+}
+
+// addCreate records the CreateImage a dry run skipped, with the volumes it would have included
+// (sized with DescribeVolumes) and the tags finishAMI would have applied.  method is how the AMI
+// would have been made, create-image or vss.
+func (p *runPlan) addCreate(ctx context.Context, awsec2 *ec2.Client, instance *types.Instance, instanceNameTag, method string, params *ec2.CreateImageInput, c *Config) error {
+	if p == nil {
+		return nil
+	}
+	excluded := map[string]bool{}
+	for _, mapping := range params.BlockDeviceMappings {
+		if mapping.NoDevice != nil {
+			excluded[aws.ToString(mapping.DeviceName)] = true
+		}
+	}
+	volumeIds := []string{}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+			volumeIds = append(volumeIds, *mapping.Ebs.VolumeId)
+		}
+	}
+	sizes := map[string]int64{}
+	if len(volumeIds) > 0 {
+		var resp *ec2.DescribeVolumesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: volumeIds})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeVolumes failed: %s", err.Error())
+		}
+		for _, volume := range resp.Volumes {
+			sizes[aws.ToString(volume.VolumeId)] = int64(aws.ToInt32(volume.Size))
+		}
+	}
+	cp := &createPlan{
+		InstanceTag: instanceNameTag,
+		InstanceId:  aws.ToString(instance.InstanceId),
+		Method:      method,
+		AmiName:     aws.ToString(params.Name),
+		Description: aws.ToString(params.Description),
+		NoReboot:    aws.ToBool(params.NoReboot),
+		Volumes:     []volumePlan{},
+		Tags:        map[string]string{},
+		Copies:      []copyPlan{},
+	}
+	for _, mapping := range instance.BlockDeviceMappings {
+		v := volumePlan{Device: aws.ToString(mapping.DeviceName), Included: !excluded[aws.ToString(mapping.DeviceName)]}
+		if mapping.Ebs != nil {
+			v.VolumeId = aws.ToString(mapping.Ebs.VolumeId)
+			v.SizeGB = sizes[v.VolumeId]
+		}
+		if v.Included {
+			cp.EstimatedSizeGB += v.SizeGB
+		}
+		cp.Volumes = append(cp.Volumes, v)
+	}
+	for _, tag := range backupTags(instance, c, instanceNameTag) {
+		cp.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old := p.creates[cp.InstanceId]; old != nil {
+		cp.Copies = old.Copies
+	}
+	p.creates[cp.InstanceId] = cp
+	return nil
+}
+
+// addCopy records the CopyImage a dry run skipped.  byDefault is whether EBS encryption by default
+// is on in region, which encrypts the copy whatever params say.
+func (p *runPlan) addCopy(instance *types.Instance, instanceNameTag, region string, params *ec2.CopyImageInput, tags []types.Tag, byDefault bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := aws.ToString(instance.InstanceId)
+	if p.creates[id] == nil {
+		p.creates[id] = &createPlan{InstanceTag: instanceNameTag, InstanceId: id, Volumes: []volumePlan{}, Tags: map[string]string{}, Copies: []copyPlan{}}
+	}
+	cp := copyPlan{
+		Region:    region,
+		AmiName:   aws.ToString(params.Name),
+		Encrypted: aws.ToBool(params.Encrypted) || byDefault,
+		KmsKeyId:  aws.ToString(params.KmsKeyId),
+		ByDefault: byDefault && !aws.ToBool(params.Encrypted),
+		Tags:      map[string]string{},
+	}
+	for _, tag := range tags {
+		cp.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	p.creates[id].Copies = append(p.creates[id].Copies, cp)
+}
+
+// setPurges records the purge planner's decisions
+func (p *runPlan) setPurges(records []PurgeRecord) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purges = records
+}
+
+// write saves the plan as JSON, creates in instance order and purges in canonical order
+func (p *runPlan) write(path string, c *Config) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	creates := []*createPlan{}
+	for _, cp := range p.creates {
+		sort.Slice(cp.Copies, func(i, j int) bool { return cp.Copies[i].Region < cp.Copies[j].Region })
+		creates = append(creates, cp)
+	}
+	sort.Slice(creates, func(i, j int) bool {
+		if creates[i].InstanceTag != creates[j].InstanceTag {
+			return creates[i].InstanceTag < creates[j].InstanceTag
+		}
+		return creates[i].InstanceId < creates[j].InstanceId
+	})
+	doc := struct {
+		Version      int              `json:"version"`
+		RunID        string           `json:"run_id"`
+		GeneratedAt  string           `json:"generated_at"`
+		SourceRegion string           `json:"source_region"`
+		Creates      []*createPlan    `json:"creates"`
+		Purges       []purgePlanEntry `json:"purges"`
+	}{planVersion, c.runID, time.Now().UTC().Format(time.RFC3339), c.sourceRegion, creates, purgePlanEntries(p.purges)}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
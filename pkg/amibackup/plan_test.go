@@ -0,0 +1,103 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// planSchema compiles schema/plan.schema.json, asserting its date-time formats
+func planSchema(t *testing.T) *jsonschema.Schema {
+	t.Helper()
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	schema, err := compiler.Compile(filepath.Join("..", "..", "schema", "plan.schema.json"))
+	if err != nil {
+		t.Fatalf("compiling the plan schema: %s", err)
+	}
+	return schema
+}
+
+// validatePlan checks a --plan file against the schema
+func validatePlan(t *testing.T, schema *jsonschema.Schema, data []byte) error {
+	t.Helper()
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("plan isn't JSON: %s", err)
+	}
+	return schema.Validate(doc)
+}
+
+func TestPlanSchema(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	c, err := parseTestOptions("--dry-run", "--plan=plan.json", "-e", "--as-of="+asOf.Format(time.RFC3339), "-p", "1d:4d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeVolumes": func(interface{}) (interface{}, error) {
+			return &ec2.DescribeVolumesOutput{Volumes: []types.Volume{
+				{VolumeId: aws.String("vol-root"), Size: aws.Int32(8)},
+				{VolumeId: aws.String("vol-scratch"), Size: aws.Int32(100)},
+			}}, nil
+		},
+	})
+	instance := &types.Instance{
+		InstanceId: aws.String("i-0123456789abcdef0"),
+		Tags:       []types.Tag{{Key: aws.String("Name"), Value: aws.String("web")}},
+		BlockDeviceMappings: []types.InstanceBlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")}},
+			{DeviceName: aws.String("/dev/sdf"), Ebs: &types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-scratch")}},
+		},
+	}
+	plan := newRunPlan()
+	err = plan.addCreate(context.Background(), f.Client, instance, "web", methodCreateImage, &ec2.CreateImageInput{
+		Name:                aws.String("web-2026-03-01_00-00-00"),
+		Description:         aws.String("web 2026-03-01_00-00-00 i-0123456789abcdef0"),
+		NoReboot:            aws.Bool(true),
+		BlockDeviceMappings: []types.BlockDeviceMapping{{DeviceName: aws.String("/dev/sdf"), NoDevice: aws.String("")}},
+	}, c)
+	if err != nil {
+		t.Fatalf("addCreate: %s", err)
+	}
+	plan.addCopy(instance, "web", "us-west-1", &ec2.CopyImageInput{
+		Name:      aws.String("web-2026-03-01_00-00-00-ami-unknown-us-west-1"),
+		Encrypted: aws.Bool(true),
+	}, copyTags(instance, c, "web", asOf), false)
+	plan.setPurges(planPurge("web", "us-west-1", "", c.windows, twiceDaily(asOf, 20)))
+	c.plan = plan
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.write(path, c); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := planSchema(t)
+	if err := validatePlan(t, schema, data); err != nil {
+		t.Errorf("plan doesn't match schema/plan.schema.json: %s\n%s", err, data)
+	}
+	if !bytes.Contains(data, []byte(`"estimated_size_gb": 8`)) {
+		t.Errorf("plan doesn't estimate just the included volume:\n%s", data)
+	}
+	if !bytes.Contains(data, []byte(`"action": "PURGED"`)) {
+		t.Errorf("plan has no purges:\n%s", data)
+	}
+
+	// the schema is strict, so a field the code adds without a schema change fails this test
+	extra := bytes.Replace(data, []byte(`"no_reboot": true`), []byte(`"no_reboot": true, "reboot_window": "02:00"`), 1)
+	if err := validatePlan(t, schema, extra); err == nil || !strings.Contains(err.Error(), "reboot_window") {
+		t.Errorf("schema accepted a create with an undocumented field: %v", err)
+	}
+}
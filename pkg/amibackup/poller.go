@@ -0,0 +1,333 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// longest a throttled or failing poll backs off between DescribeImages calls
+var maxPollBackoff = 5 * time.Minute
+
+// most AMI IDs asked about in one DescribeImages call
+const pollBatchSize = 200
+
+// error codes that mean polling will never work, so waiting is pointless - anything else (a
+// throttle, a network error, a 5xx) is retried by the poller and never seen by a waiter
+var terminalPollCodes = map[string]bool{
+	"UnauthorizedOperation": true,
+	"AuthFailure":           true,
+	"InvalidClientTokenId":  true,
+	"OptInRequired":         true,
+}
+
+// imageUpdate is what a waiter hears from the poller: its AMI (nil while DescribeImages doesn't
+// list it), or an error that ends the wait
+type imageUpdate struct {
+	image *types.Image
+	err   error
+}
+
+// imageWatch is one waiter's interest in an AMI
+type imageWatch struct {
+	amiId   string
+	updates chan imageUpdate
+	since   time.Time // when the wait started
+	last    string    // state last sent, so only changes are sent
+}
+
+// imagePoller polls DescribeImages for every AMI being waited on through one EC2 client, in one
+// batched call per interval rather than one call per waiter - with many instances in a run, the
+// per-waiter calls were what got throttled.  The poller owns retrying and backing off: a failed
+// poll is logged once, not once per waiter, and waiters hear only state changes and terminal
+// errors.  What they can see of a failing poller is its staleness, the time since it last got
+// an answer.
+type imagePoller struct {
+	awsec2 *ec2.Client
+
+	mu       sync.Mutex
+	watches  map[*imageWatch]bool
+	lastPoll time.Time // last successful poll
+	running  bool
+}
+
+var (
+	imagePollersMu sync.Mutex
+	imagePollers   = map[*ec2.Client]*imagePoller{}
+)
+
+// pollerFor returns the shared image poller for an EC2 client
+func pollerFor(awsec2 *ec2.Client) *imagePoller {
+	imagePollersMu.Lock()
+	defer imagePollersMu.Unlock()
+	p := imagePollers[awsec2]
+	if p == nil {
+		p = &imagePoller{awsec2: awsec2, watches: map[*imageWatch]bool{}}
+		imagePollers[awsec2] = p
+	}
+	return p
+}
+
+// watch starts polling for an AMI; stop must be called once the waiter is done with it
+func (p *imagePoller) watch(amiId string) *imageWatch {
+	w := &imageWatch{amiId: amiId, updates: make(chan imageUpdate, 1), since: time.Now()}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watches[w] = true
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+	return w
+}
+
+// stop ends a watch
+func (p *imagePoller) stop(w *imageWatch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.watches, w)
+}
+
+// staleness is how long a watch has gone without a successful poll
+func (p *imagePoller) staleness(w *imageWatch) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastPoll.After(w.since) {
+		return time.Since(p.lastPoll)
+	}
+	return time.Since(w.since)
+}
+
+// send hands a watch its latest update, replacing one it hasn't read yet - only the newest
+// state matters, and the poller must never block on a slow waiter
+func (w *imageWatch) send(u imageUpdate) {
+	for {
+		select {
+		case w.updates <- u:
+			return
+		default:
+		}
+		select {
+		case <-w.updates:
+		default:
+		}
+	}
+}
+
+// pollBackoff is the wait before the next poll after this many failed polls in a row
+func pollBackoff(failures int) time.Duration {
+	interval := apiPollInterval << uint(failures)
+	if interval > maxPollBackoff || interval <= 0 {
+		return maxPollBackoff
+	}
+	return interval
+}
+
+// run polls until nothing is being watched, backing off exponentially while polls fail
+func (p *imagePoller) run() {
+	ctx := context.Background()
+	interval := apiPollInterval
+	failures := 0
+	for {
+		time.Sleep(interval)
+		p.mu.Lock()
+		if len(p.watches) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		ids := map[string]bool{}
+		for w := range p.watches {
+			ids[w.amiId] = true
+		}
+		p.mu.Unlock()
+		images, err := p.describe(ctx, ids)
+		if err != nil {
+			if terminalPollCodes[errorCode(err)] {
+				p.fail(ids, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error()))
+			}
+			failures++
+			interval = pollBackoff(failures)
+			log.Printf("Polling %d AMIs failed (retrying in %s): %s", len(ids), interval, err.Error())
+			continue
+		}
+		if failures > 0 {
+			log.Printf("Polling %d AMIs recovered after %d failed attempts", len(ids), failures)
+		}
+		failures = 0
+		interval = apiPollInterval
+		p.deliver(images)
+	}
+}
+
+// describe asks for the AMIs in batches.  It filters by image-id rather than asking for the IDs,
+// as asking for one AMI that isn't visible yet fails the whole call.
+func (p *imagePoller) describe(ctx context.Context, ids map[string]bool) (map[string]types.Image, error) {
+	all := make([]string, 0, len(ids))
+	for id := range ids {
+		all = append(all, id)
+	}
+	sort.Strings(all)
+	images := map[string]types.Image{}
+	for len(all) > 0 {
+		batch := all
+		if len(batch) > pollBatchSize {
+			batch = batch[:pollBatchSize]
+		}
+		all = all[len(batch):]
+		params := &ec2.DescribeImagesInput{Filters: []types.Filter{{Name: aws.String("image-id"), Values: batch}}}
+		for {
+			var resp *ec2.DescribeImagesOutput
+			err := withFreshCredentials(ctx, p.awsec2, func() (err error) {
+				resp, err = p.awsec2.DescribeImages(ctx, params)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, image := range resp.Images {
+				images[aws.ToString(image.ImageId)] = image
+			}
+			if resp.NextToken == nil {
+				break
+			}
+			params.NextToken = resp.NextToken
+		}
+	}
+	return images, nil
+}
+
+// deliver records a successful poll and sends each watch its AMI, if that changed
+func (p *imagePoller) deliver(images map[string]types.Image) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPoll = time.Now()
+	for w := range p.watches {
+		image, ok := images[w.amiId]
+		state := "missing"
+		if ok {
+			state = string(image.State)
+			if image.StateReason != nil {
+				state += " " + aws.ToString(image.StateReason.Message)
+			}
+		}
+		if state == w.last {
+			continue
+		}
+		w.last = state
+		if ok {
+			w.send(imageUpdate{image: &image})
+		} else {
+			w.send(imageUpdate{})
+		}
+	}
+}
+
+// fail sends a terminal error to every watch of the AMIs
+func (p *imagePoller) fail(ids map[string]bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for w := range p.watches {
+		if ids[w.amiId] {
+			w.send(imageUpdate{err: err})
+		}
+	}
+}
+
+// waitForSnapshots waits, for --wait-snapshots, until every snapshot of an available AMI has
+// finished copying its data (completed, at 100%) - an AMI copy is available well before that,
+// and instances launched from it meanwhile read slowly.  It polls like the image poller: every
+// apiPollInterval, backing off while DescribeSnapshots fails, giving up on a terminal error or
+// after --poll-stale-limit without an answer.  Returns how long the data copy took, from its
+// first snapshot's start.
+func waitForSnapshots(ctx context.Context, awsec2 *ec2.Client, amiId, instanceNameTag, instanceId string, c *Config) (time.Duration, error) {
+	var images *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		images, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiId}})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("EC2 API DescribeImages failed for %s: %s", amiId, err.Error())
+	}
+	snapshotIds := []string{}
+	for _, image := range images.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+				snapshotIds = append(snapshotIds, *mapping.Ebs.SnapshotId)
+			}
+		}
+	}
+	if len(snapshotIds) == 0 {
+		return 0, nil
+	}
+	log.Printf("Waiting for the %d snapshots of %s for %s to finish copying", len(snapshotIds), amiId, instanceNameTag)
+	lastAnswer := time.Now()
+	interval := time.Duration(0)
+	failures := 0
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("Stopped waiting for the snapshots of %s for %s: %s", amiId, instanceNameTag, ctx.Err())
+		case <-time.After(interval):
+		}
+		var resp *ec2.DescribeSnapshotsOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: snapshotIds})
+			return err
+		})
+		if err != nil {
+			if terminalPollCodes[errorCode(err)] {
+				return 0, fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+			}
+			if stale := time.Since(lastAnswer); stale > c.pollStaleLimit {
+				return 0, fmt.Errorf("Gave up waiting for the snapshots of %s for %s: no answer from DescribeSnapshots for %s", amiId, instanceNameTag, stale.Round(time.Second))
+			}
+			failures++
+			interval = pollBackoff(failures)
+			log.Printf("Polling the snapshots of %s failed (retrying in %s): %s", amiId, interval, err.Error())
+			continue
+		}
+		lastAnswer = time.Now()
+		failures = 0
+		interval = apiPollInterval
+		done := 0
+		var started time.Time
+		for _, snapshot := range resp.Snapshots {
+			if snapshot.StartTime != nil && (started.IsZero() || snapshot.StartTime.Before(started)) {
+				started = *snapshot.StartTime
+			}
+			switch {
+			case snapshot.State == types.SnapshotStateError:
+				return 0, fmt.Errorf("snapshot %s of %s for %s failed to copy: %s", aws.ToString(snapshot.SnapshotId), amiId, instanceNameTag, aws.ToString(snapshot.StateMessage))
+			case snapshot.State == types.SnapshotStateCompleted && aws.ToString(snapshot.Progress) == "100%":
+				done++
+			case snapshot.State == types.SnapshotStateCompleted, snapshot.State == types.SnapshotStatePending:
+				// still copying its data
+			default:
+				unknownState("snapshot", string(snapshot.State), "counting it as still copying")
+			}
+		}
+		if done == len(snapshotIds) {
+			took := time.Duration(0)
+			if !started.IsZero() {
+				took = time.Since(started)
+			}
+			log.Printf("The snapshots of %s for %s finished copying, %s after they started", amiId, instanceNameTag, took.Round(time.Second))
+			return took, nil
+		}
+		status := fmt.Sprintf("%d/%d snapshots copied", done, len(snapshotIds))
+		if status != last {
+			log.Printf("Waiting for the snapshots of %s for %s: %s", amiId, instanceNameTag, status)
+			last = status
+		}
+		ui.update(instanceId, "", amiId+" "+status)
+	}
+}
@@ -0,0 +1,222 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// throttledPolls answers DescribeImages with a throttle for the first throttles calls, then every
+// AMI asked about pending once, then available
+func throttledPolls(throttles int) fakeCall {
+	var mu sync.Mutex
+	n := 0
+	return func(input interface{}) (interface{}, error) {
+		mu.Lock()
+		call := n
+		n++
+		mu.Unlock()
+		if call < throttles {
+			return nil, apiError("RequestLimitExceeded")
+		}
+		state := types.ImageStateAvailable
+		if call == throttles {
+			state = types.ImageStatePending
+		}
+		out := &ec2.DescribeImagesOutput{}
+		for _, id := range input.(*ec2.DescribeImagesInput).Filters[0].Values {
+			img := image(id, "snap-"+id)
+			img.State = state
+			out.Images = append(out.Images, img)
+		}
+		return out, nil
+	}
+}
+
+// captureLog sends the log to a buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+func TestPollerThrottled(t *testing.T) {
+	fastPolls(t)
+	backoff := maxPollBackoff
+	maxPollBackoff = 20 * time.Millisecond
+	t.Cleanup(func() { maxPollBackoff = backoff })
+	out := captureLog(t)
+
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": throttledPolls(3)})
+	c := &Config{notFoundGrace: time.Minute, pollStaleLimit: time.Minute}
+	const waiters = 10
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(amiId string) {
+			errs <- waitForAMI(context.Background(), f.Client, amiId, "web", "i-1", false, c)
+		}(fmt.Sprintf("ami-%02d", i))
+	}
+	for i := 0; i < waiters; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("waitForAMI: %s", err)
+		}
+	}
+
+	// the poller retries the batch call; the waiters never hear of the throttles
+	if n := strings.Count(out.String(), "AMIs failed (retrying in"); n != 3 {
+		t.Errorf("logged %d failed polls for 3 throttles:\n%s", n, out)
+	}
+	if n := strings.Count(out.String(), "recovered after 3 failed attempts"); n != 1 {
+		t.Errorf("logged the recovery %d times:\n%s", n, out)
+	}
+	if strings.Contains(out.String(), "Error waiting") {
+		t.Errorf("a throttle reached a waiter:\n%s", out)
+	}
+	// one batched call per poll, not one per waiter
+	if n := f.count("DescribeImages"); n >= waiters {
+		t.Errorf("DescribeImages called %d times for %d waiters", n, waiters)
+	}
+}
+
+func TestPollerStale(t *testing.T) {
+	fastPolls(t)
+	backoff := maxPollBackoff
+	maxPollBackoff = 20 * time.Millisecond
+	t.Cleanup(func() { maxPollBackoff = backoff })
+	captureLog(t)
+
+	tests := []struct {
+		name    string
+		code    string
+		wantErr string
+	}{
+		{"throttled past the stale limit", "RequestLimitExceeded", "no answer from DescribeImages"},
+		{"terminal", "UnauthorizedOperation", "Error waiting for AMI ami-new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEC2(t, map[string]fakeCall{
+				"DescribeImages": func(interface{}) (interface{}, error) { return nil, apiError(tt.code) },
+			})
+			c := &Config{notFoundGrace: time.Minute, pollStaleLimit: 100 * time.Millisecond}
+			err := waitForAMI(context.Background(), f.Client, "ami-new", "web", "i-1", false, c)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("waitForAMI = %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPollerStaleness(t *testing.T) {
+	now := time.Now()
+	p := &imagePoller{watches: map[*imageWatch]bool{}, lastPoll: now.Add(-10 * time.Minute)}
+	tests := []struct {
+		name  string
+		since time.Time
+		want  time.Duration
+	}{
+		// polls answered since the wait started: stale since the last of them
+		{"waiting before the last poll", now.Add(-time.Hour), 10 * time.Minute},
+		// no poll has answered for this wait yet: stale since it started
+		{"waiting since", now.Add(-time.Minute), time.Minute},
+	}
+	for _, tt := range tests {
+		got := p.staleness(&imageWatch{amiId: "ami-1", since: tt.since})
+		if got < tt.want || got > tt.want+time.Second {
+			t.Errorf("%s: staleness %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// snapshotsIn answers DescribeSnapshots with every snapshot asked about in a state, at progress,
+// started an hour ago
+func snapshotsIn(state types.SnapshotState, progress string) fakeCall {
+	return func(input interface{}) (interface{}, error) {
+		out := &ec2.DescribeSnapshotsOutput{}
+		for _, id := range input.(*ec2.DescribeSnapshotsInput).SnapshotIds {
+			out.Snapshots = append(out.Snapshots, types.Snapshot{
+				SnapshotId:   aws.String(id),
+				State:        state,
+				Progress:     aws.String(progress),
+				StartTime:    aws.Time(time.Now().Add(-time.Hour)),
+				StateMessage: aws.String("copy failed"),
+			})
+		}
+		return out, nil
+	}
+}
+
+func TestWaitForSnapshots(t *testing.T) {
+	fastPolls(t)
+	backoff := maxPollBackoff
+	maxPollBackoff = 20 * time.Millisecond
+	t.Cleanup(func() { maxPollBackoff = backoff })
+	captureLog(t)
+	throttled := func(interface{}) (interface{}, error) { return nil, apiError("RequestLimitExceeded") }
+	done := snapshotsIn(types.SnapshotStateCompleted, "100%")
+	tests := []struct {
+		name      string
+		image     fakeCall
+		snapshots fakeCall
+		wantErr   string // "" for done
+	}{
+		// an available copy's snapshots can be completed short of 100% while their data copies
+		{"copying", imageIn(image("ami-copy", "snap-1", "snap-2"), types.ImageStateAvailable),
+			script(snapshotsIn(types.SnapshotStatePending, "40%"), snapshotsIn(types.SnapshotStateCompleted, "99%"), done), ""},
+		{"throttled", imageIn(image("ami-copy", "snap-1"), types.ImageStateAvailable), script(throttled, throttled, done), ""},
+		{"no snapshots", imageIn(image("ami-copy"), types.ImageStateAvailable), nil, ""},
+		{"snapshot failed", imageIn(image("ami-copy", "snap-1", "snap-2"), types.ImageStateAvailable),
+			script(snapshotsIn(types.SnapshotStatePending, "40%"), snapshotsIn(types.SnapshotStateError, "40%")), "snapshot snap-1 of ami-copy for web failed to copy: copy failed"},
+		{"terminal", imageIn(image("ami-copy", "snap-1"), types.ImageStateAvailable),
+			func(interface{}) (interface{}, error) { return nil, apiError("UnauthorizedOperation") }, "DescribeSnapshots failed"},
+		{"stale", imageIn(image("ami-copy", "snap-1"), types.ImageStateAvailable), throttled, "no answer from DescribeSnapshots"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": tt.image, "DescribeSnapshots": tt.snapshots})
+			c := &Config{pollStaleLimit: 100 * time.Millisecond}
+			took, err := waitForSnapshots(context.Background(), f.Client, "ami-copy", "web", "i-1", c)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("waitForSnapshots: %s", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("waitForSnapshots = %v, want an error with %q", err, tt.wantErr)
+			case tt.wantErr == "" && tt.snapshots != nil && took < time.Hour:
+				t.Errorf("data copy took %s, want it timed from the snapshots' start an hour ago", took)
+			}
+		})
+	}
+}
+
+func TestWaitSnapshotsRun(t *testing.T) {
+	fastPolls(t)
+	runFake(t, map[string]func(fakeCall) fakeCall{
+		"DescribeSnapshots": func(fakeCall) fakeCall { return snapshotsIn(types.SnapshotStateCompleted, "100%") },
+	}, "web")
+	c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+		"--no-reconcile", "--no-progress", "--wait-snapshots", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	summary, err := run(context.Background(), c)
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if len(summary.Backups) != 1 || summary.Backups[0].DataCopySeconds["us-west-2"] < 3600 || summary.DataCopySeconds != summary.Backups[0].DataCopySeconds["us-west-2"] {
+		t.Errorf("data copy took %v, %d in all; want an hour in us-west-2", summary.Backups, summary.DataCopySeconds)
+	}
+	if _, err := parseTestOptions("--wait-snapshots", "--no-wait", "web"); classOf(err, classInternal) != classConfig {
+		t.Errorf("--wait-snapshots with --no-wait = %v, want a config error", err)
+	}
+}
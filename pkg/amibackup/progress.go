@@ -0,0 +1,272 @@
+package amibackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A compact status block for interactive runs: one line per instance plus a totals line,
+// redrawn in place.  Log lines written while it is running are printed above the block.
+
+type progressRow struct {
+	label  string
+	phase  string
+	detail string
+	start  time.Time
+}
+
+type progressUI struct {
+	mu      sync.Mutex
+	out     io.Writer
+	enabled bool
+	start   time.Time
+	order   []string
+	rows    map[string]*progressRow
+	drawn   int // lines of the block currently on screen
+	stopped chan bool
+}
+
+// ui is the run's progress display - a no-op until started
+var ui = &progressUI{rows: map[string]*progressRow{}}
+
+var percentPattern = regexp.MustCompile(`(\d+)%`)
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth uses $COLUMNS when the shell exports it, else assumes 80 columns
+func terminalWidth() int {
+	if w, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
+
+// startProgress begins redrawing the status block on out every interval
+func (p *progressUI) startProgress(out io.Writer, interval time.Duration) {
+	p.mu.Lock()
+	p.out = out
+	p.enabled = true
+	p.start = time.Now()
+	p.stopped = make(chan bool)
+	p.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.clear()
+				p.draw()
+				p.mu.Unlock()
+			case <-p.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// stopProgress draws the block a final time and leaves it on screen
+func (p *progressUI) stopProgress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.enabled {
+		return
+	}
+	close(p.stopped)
+	p.clear()
+	p.draw()
+	p.enabled = false
+	p.drawn = 0
+}
+
+// set moves an instance to a new phase (create/wait/store/copy/tag/snaps/done/failed)
+func (p *progressUI) set(key, label, phase, detail string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	row, ok := p.rows[key]
+	if !ok {
+		row = &progressRow{label: label, start: time.Now()}
+		p.rows[key] = row
+		p.order = append(p.order, key)
+	}
+	row.phase = phase
+	row.detail = detail
+}
+
+// update changes an instance's phase (unless phase is empty) and detail
+func (p *progressUI) update(key, phase, detail string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if row, ok := p.rows[key]; ok {
+		if phase != "" {
+			row.phase = phase
+		}
+		row.detail = detail
+	}
+}
+
+// Write sends a log line to stderr above the status block, for when both share a terminal
+func (p *progressUI) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.enabled {
+		return os.Stderr.Write(b)
+	}
+	p.clear()
+	n, err := os.Stderr.Write(b)
+	p.draw()
+	return n, err
+}
+
+// clear erases the block last drawn - the caller holds the lock
+func (p *progressUI) clear() {
+	for ; p.drawn > 0; p.drawn-- {
+		fmt.Fprint(p.out, "\x1b[1A\x1b[2K")
+	}
+}
+
+// draw prints the block - the caller holds the lock
+func (p *progressUI) draw() {
+	width := terminalWidth()
+	lines := []string{}
+	counts := map[string]int{}
+	for _, key := range p.order {
+		row := p.rows[key]
+		counts[row.phase]++
+		if width < 40 {
+			// too narrow for a line per instance - just show the totals
+			continue
+		}
+		elapsed := time.Since(row.start).Truncate(time.Second)
+		line := fmt.Sprintf("%-6s %8s  %s", row.phase, elapsed, row.label)
+		if row.detail != "" {
+			line += " " + row.detail
+		}
+		lines = append(lines, line)
+	}
+	running := len(p.order) - counts["done"] - counts["failed"]
+	lines = append(lines, fmt.Sprintf("%d instances: %d running, %d done, %d failed - %s elapsed",
+		len(p.order), running, counts["done"], counts["failed"], time.Since(p.start).Truncate(time.Second)))
+	for _, line := range lines {
+		if len(line) > width-1 {
+			line = line[:width-1]
+		}
+		fmt.Fprintln(p.out, line)
+	}
+	p.drawn = len(lines)
+}
+
+// copyPercent pulls a progress percentage out of an image's StateReason message, if it has one
+func copyPercent(message string) string {
+	if m := percentPattern.FindStringSubmatch(message); m != nil {
+		return m[1] + "%"
+	}
+	return ""
+}
+
+// progressLabel names an instance in the status block
+func progressLabel(instanceNameTag, instanceId string) string {
+	return fmt.Sprintf("%s (%s)", instanceNameTag, instanceId)
+}
+
+// progressFile is the --progress-file status, rewritten after every change so monitoring tools
+// can poll it.  A nil progressFile does nothing.
+type progressFile struct {
+	mu        sync.Mutex
+	path      string
+	StartedAt time.Time        `json:"started_at"`
+	Instances []*progressEntry `json:"instances"`
+}
+
+// progressEntry is one instance's backup in the progress file
+type progressEntry struct {
+	Tag        string     `json:"tag"`
+	InstanceId string     `json:"instance_id"`
+	Phase      string     `json:"phase"` // creating, copying, done or error
+	AmiId      string     `json:"ami_id,omitempty"`
+	CopyAmiId  string     `json:"copy_ami_id,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// newProgressFile starts the progress file at path, or returns nil if path is empty
+func newProgressFile(path string, started time.Time) *progressFile {
+	if path == "" {
+		return nil
+	}
+	f := &progressFile{path: path, StartedAt: started, Instances: []*progressEntry{}}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.write()
+	return f
+}
+
+// set moves an instance to a new phase; empty AMI IDs leave those already recorded alone
+func (f *progressFile) set(tag, instanceId, phase, amiId, copyAmiId string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var entry *progressEntry
+	for _, e := range f.Instances {
+		if e.InstanceId == instanceId {
+			entry = e
+		}
+	}
+	if entry == nil {
+		entry = &progressEntry{Tag: tag, InstanceId: instanceId, StartedAt: time.Now()}
+		f.Instances = append(f.Instances, entry)
+	}
+	entry.Phase = phase
+	if amiId != "" {
+		entry.AmiId = amiId
+	}
+	if copyAmiId != "" {
+		entry.CopyAmiId = copyAmiId
+	}
+	if phase == "done" || phase == "error" {
+		now := time.Now()
+		entry.FinishedAt = &now
+	}
+	f.write()
+}
+
+// write replaces the file with a temp file renamed into place, so readers never see half of
+// it - the caller holds the lock.  Failing to write is logged but never fails the backup.
+func (f *progressFile) write() {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err == nil {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".")
+		if err == nil {
+			_, err = tmp.Write(append(data, '\n'))
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), f.path)
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error writing progress file %s: %s", f.path, err.Error())
+	}
+}
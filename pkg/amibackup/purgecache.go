@@ -0,0 +1,203 @@
+package amibackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+)
+
+// purgeCache is the --purge-cache file: for each host and dest region, the backups its last
+// full purge scan left behind.  A later purge can be planned from that alone, and skipped, as
+// long as two things hold:
+//
+//   - every window ends before the scan's boundary - the run's start, as that run's own backups
+//     (and anything since) are newer than the boundary but missing from the cache - so any image
+//     the cache doesn't know about is outside every window
+//   - planning the cached backups with today's windows purges nothing, so no bucket holds two
+//     of them - and the backups really there are the cached ones, less any deleted since, plus
+//     ones outside every window, so no bucket holds two of them either
+//
+// Windows slide forward every day, so a skipped host is scanned again once its youngest window
+// reaches the boundary, or as soon as a cached backup would be purged.
+// Skipping can only delay a purge, never cause one: a backup that turns up with an old timestamp
+// outside a normal run (a --reencrypt copy kept by --min-keep, say) waits for the next full scan,
+// which --force-purge-scan forces.
+type purgeCache struct {
+	mu      sync.Mutex
+	path    string
+	Entries map[string]*purgeCacheEntry `json:"entries"`
+}
+
+// purgeCacheEntry is the last full purge scan of one host in one region
+type purgeCacheEntry struct {
+	Spec     string                 `json:"spec"`     // the purge options it was planned with
+	Boundary int64                  `json:"boundary"` // backups from this time on may be missing
+	Took     float64                `json:"took_seconds"`
+	Images   map[string]cachedImage `json:"images"`
+}
+
+// cachedImage is one backup a purge scan kept
+type cachedImage struct {
+	Timestamp int64  `json:"timestamp"`
+	Class     string `json:"class,omitempty"`
+}
+
+// loadPurgeCache reads the --purge-cache file; one that doesn't exist yet is empty
+func loadPurgeCache(path string) (*purgeCache, error) {
+	pc := &purgeCache{path: path, Entries: map[string]*purgeCacheEntry{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, pc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if pc.Entries == nil {
+		pc.Entries = map[string]*purgeCacheEntry{}
+	}
+	return pc, nil
+}
+
+// purgeCacheKey indexes purgeCache.Entries
+func purgeCacheKey(regionName, instanceNameTag string) string {
+	return regionName + "/" + instanceNameTag
+}
+
+// canSkip reports whether a host's purge scan in a region can be skipped, and why not if it can't
+func (pc *purgeCache) canSkip(regionName, instanceNameTag string, c *Config) (*purgeCacheEntry, string) {
+	if pc == nil {
+		return nil, "no --purge-cache"
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	e := pc.Entries[purgeCacheKey(regionName, instanceNameTag)]
+	switch {
+	case e == nil:
+		return nil, "never scanned"
+	case e.Spec != c.purgeSpec:
+		return nil, "the purge options changed"
+	case c.keepCount > 0:
+		return nil, "--keep-count counts the backups since the last scan too"
+	}
+	boundary := time.Unix(e.Boundary, 0)
+	classImages := map[string]map[string]time.Time{}
+	for id, image := range e.Images {
+		class := image.Class
+		if _, ok := c.retentionClasses[class]; !ok {
+			class = ""
+		}
+		if classImages[class] == nil {
+			classImages[class] = map[string]time.Time{}
+		}
+		classImages[class][id] = time.Unix(image.Timestamp, 0)
+	}
+	all := append([]purge.Window{}, c.windows...)
+	for _, windows := range c.retentionClasses {
+		all = append(all, windows...)
+	}
+	for _, w := range all {
+		if w.Stop.After(boundary) {
+			return nil, fmt.Sprintf("a window reaches past the last scan (%s)", boundary.Format(timeShortFormat))
+		}
+	}
+	for class, images := range classImages {
+		if purged, _ := purge.SelectForPurge(c.classWindows(class), images, false); len(purged) > 0 {
+			return nil, fmt.Sprintf("%d cached backups are due for purging", len(purged))
+		}
+	}
+	return e, ""
+}
+
+// record notes a finished purge scan of a host in a region: the backups it kept, and the
+// boundary past which it may not have seen every backup
+func (pc *purgeCache) record(regionName, instanceNameTag string, records []PurgeRecord, boundary time.Time, took time.Duration, c *Config) {
+	if pc == nil {
+		return
+	}
+	images := map[string]cachedImage{}
+	for _, r := range records {
+		if r.Action != actionPurged {
+			images[r.AmiId] = cachedImage{Timestamp: r.CreatedAt.Unix(), Class: r.Class}
+		}
+	}
+	for _, r := range records {
+		if r.Action == actionPurged {
+			delete(images, r.AmiId)
+		}
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.Entries[purgeCacheKey(regionName, instanceNameTag)] = &purgeCacheEntry{
+		Spec:     c.purgeSpec,
+		Boundary: boundary.Unix(),
+		Took:     took.Seconds(),
+		Images:   images,
+	}
+}
+
+// forget drops a host's entry, after a purge scan that didn't finish
+func (pc *purgeCache) forget(regionName, instanceNameTag string) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.Entries, purgeCacheKey(regionName, instanceNameTag))
+}
+
+// save writes the cache back, replacing the file in one rename
+func (pc *purgeCache) save() error {
+	if pc == nil {
+		return nil
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	data, err := json.MarshalIndent(pc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(pc.path), "."+filepath.Base(pc.path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), pc.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// skipPurgeScan decides whether to skip a host's purge scan in a dest region, logging why
+func skipPurgeScan(regionName, instanceNameTag string, c *Config) bool {
+	if c.purgeCache == nil {
+		return false
+	}
+	if c.forcePurgeScan {
+		log.Printf("Scanning %s in %s for purging: --force-purge-scan", instanceNameTag, regionName)
+		return false
+	}
+	e, why := c.purgeCache.canSkip(regionName, instanceNameTag, c)
+	if e == nil {
+		log.Printf("Scanning %s in %s for purging: %s", instanceNameTag, regionName, why)
+		return false
+	}
+	log.Printf("Skipping purge scan of %s in %s: none of the %d backups known at %s can be purged, and no newer one is in a window (saved about %s)",
+		instanceNameTag, regionName, len(e.Images), time.Unix(e.Boundary, 0).Format(timeShortFormat), time.Duration(e.Took*float64(time.Second)).Round(time.Second))
+	return true
+}
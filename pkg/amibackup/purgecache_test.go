@@ -0,0 +1,164 @@
+package amibackup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+)
+
+// cacheOptions parses the options of a run with a purge cache as of a time
+func cacheOptions(t *testing.T, path string, asOf time.Time, args ...string) *Config {
+	t.Helper()
+	args = append([]string{"--purge-cache=" + path, "--as-of=" + asOf.Format(time.RFC3339)}, args...)
+	c, err := parseTestOptions(append(args, "web")...)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	return c
+}
+
+// TestPurgeCacheHistory runs a month of nightly runs over synthetic backup histories.  Every
+// night the purge scan is either skipped from the cache or done in full; a skip must never leave
+// behind a backup the full scan would have purged.
+func TestPurgeCacheHistory(t *testing.T) {
+	day0 := time.Date(2026, 3, 1, 1, 0, 0, 0, time.UTC)
+	windows := []string{"-p", "1d:4d:30d", "-p", "7d:30d:90d"}
+	tests := []struct {
+		name     string
+		history  map[string]time.Time // backups before the first night
+		every    time.Duration        // how often the host is backed up from then on, 0 for never
+		wantSkip bool
+	}{
+		// windows slide a day each night, so some backup is due nearly every night
+		{"twice daily", twiceDaily(day0, 120), 12 * time.Hour, false},
+		{"weekly", weekly(day0, 20), 7 * 24 * time.Hour, true},
+		// a host that's gone: once its backups are purged, nothing is due until windows move on
+		{"decommissioned", twiceDaily(day0.Add(-60*24*time.Hour), 40), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "purge-cache.json")
+			backups := tt.history // what's really in the region
+			next := day0.Add(tt.every)
+			skipped, scanned := 0, 0
+			for day := 0; day <= 30; day++ {
+				asOf := day0.Add(time.Duration(day) * 24 * time.Hour)
+				for ; tt.every > 0 && !next.After(asOf); next = next.Add(tt.every) {
+					backups[fmt.Sprintf("ami-%d", next.Unix())] = next
+				}
+				c := cacheOptions(t, path, asOf, windows...)
+				due, _ := purge.SelectForPurge(c.windows, backups, false)
+				if skipPurgeScan("us-west-2", "web", c) {
+					skipped++
+					if len(due) > 0 {
+						t.Errorf("day %d: skipped the scan with %d backups due for purging: %v", day, len(due), due)
+					}
+					continue
+				}
+				scanned++
+				records := planPurge("web", "us-west-2", "", c.windows, backups)
+				for _, r := range records {
+					if r.Action == actionPurged {
+						delete(backups, r.AmiId)
+					}
+				}
+				// the run's own backups come after its start
+				c.purgeCache.record("us-west-2", "web", records, asOf.Add(-time.Minute), 42*time.Second, c)
+				if err := c.purgeCache.save(); err != nil {
+					t.Fatalf("save: %s", err)
+				}
+			}
+			if tt.wantSkip && (skipped == 0 || scanned < 2) {
+				t.Errorf("skipped %d scans and did %d, want some of each", skipped, scanned)
+			}
+		})
+	}
+}
+
+// weekly returns n backups, one a week up to asOf, by AMI ID
+func weekly(asOf time.Time, n int) map[string]time.Time {
+	images := map[string]time.Time{}
+	for i := 0; i < n; i++ {
+		images[fmt.Sprintf("ami-w%03d", i)] = asOf.Add(-time.Duration(i) * 7 * 24 * time.Hour)
+	}
+	return images
+}
+
+func TestPurgeCacheCanSkip(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 1, 0, 0, 0, time.UTC)
+	backups := weekly(asOf, 20)
+	scan := func(t *testing.T, args ...string) string {
+		path := filepath.Join(t.TempDir(), "purge-cache.json")
+		c := cacheOptions(t, path, asOf, args...)
+		records := planPurge("web", "us-west-2", "", c.windows, backups)
+		kept := []PurgeRecord{}
+		for _, r := range records {
+			if r.Action != actionPurged {
+				kept = append(kept, r)
+			}
+		}
+		c.purgeCache.record("us-west-2", "web", kept, asOf, time.Minute, c)
+		if err := c.purgeCache.save(); err != nil {
+			t.Fatalf("save: %s", err)
+		}
+		return path
+	}
+	tomorrow := asOf.Add(24 * time.Hour)
+	tests := []struct {
+		name    string
+		scanned []string // the options of the scan that filled the cache, nil for none
+		args    []string // the options of the next run
+		asOf    time.Time
+		wantWhy string // "" when the scan is skipped
+	}{
+		{"next day", []string{"-p", "1d:4d:30d"}, []string{"-p", "1d:4d:30d"}, tomorrow, ""},
+		{"never scanned", nil, []string{"-p", "1d:4d:30d"}, tomorrow, "never scanned"},
+		{"options changed", []string{"-p", "1d:4d:30d"}, []string{"-p", "1d:2d:30d"}, tomorrow, "the purge options changed"},
+		{"window reaches the boundary", []string{"-p", "1d:4d:30d"}, []string{"-p", "1d:4d:30d"}, asOf.Add(5 * 24 * time.Hour), "a window reaches past the last scan"},
+		{"keep count", []string{"--keep-count=10"}, []string{"--keep-count=10"}, tomorrow, "--keep-count"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "purge-cache.json")
+			if tt.scanned != nil {
+				path = scan(t, tt.scanned...)
+			}
+			c := cacheOptions(t, path, tt.asOf, tt.args...)
+			e, why := c.purgeCache.canSkip("us-west-2", "web", c)
+			switch {
+			case tt.wantWhy == "" && e == nil:
+				t.Errorf("scanned: %s", why)
+			case tt.wantWhy != "" && (e != nil || !strings.Contains(why, tt.wantWhy)):
+				t.Errorf("skip = %v (%s), want a scan because %s", e != nil, why, tt.wantWhy)
+			}
+		})
+	}
+}
+
+func TestSkipPurgeScanLogged(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 1, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "purge-cache.json")
+	c := cacheOptions(t, path, asOf, "-p", "1d:4d:30d")
+	records := planPurge("web", "us-west-2", "", c.windows, map[string]time.Time{"ami-1": asOf.Add(-10 * 24 * time.Hour)})
+	c.purgeCache.record("us-west-2", "web", records, asOf, 42*time.Second, c)
+	if err := c.purgeCache.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	out := captureLog(t)
+	c = cacheOptions(t, path, asOf.Add(24*time.Hour), "-p", "1d:4d:30d")
+	if !skipPurgeScan("us-west-2", "web", c) {
+		t.Fatalf("scanned:\n%s", out)
+	}
+	if !strings.Contains(out.String(), "saved about 42s") {
+		t.Errorf("skip doesn't say what it saved:\n%s", out)
+	}
+	c = cacheOptions(t, path, asOf.Add(24*time.Hour), "-p", "1d:4d:30d", "--force-purge-scan")
+	if skipPurgeScan("us-west-2", "web", c) || !strings.Contains(out.String(), "--force-purge-scan") {
+		t.Errorf("--force-purge-scan skipped the scan:\n%s", out)
+	}
+}
@@ -0,0 +1,210 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// purgeAsOf is when the purge tests purge, with backups of web twice a day for 20 days before
+var purgeAsOf = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// purgeWeb purges web's backups in us-east-1 with the options given, returning the fake it
+// purged from and the decisions made
+func purgeWeb(t *testing.T, args ...string) (*fakeEC2, []PurgeRecord) {
+	t.Helper()
+	c, err := parseTestOptions(append([]string{"--as-of=" + purgeAsOf.Format(time.RFC3339), "-p", "1d:1d:30d", "--rate-limit-snapshots=0"}, append(args, "web")...)...)
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages":  (&contract{Images: backupImages("web", twiceDaily(purgeAsOf, 40))}).describe,
+		"DeregisterImage": func(interface{}) (interface{}, error) { return &ec2.DeregisterImageOutput{}, nil },
+		"DeleteSnapshot":  func(interface{}) (interface{}, error) { return &ec2.DeleteSnapshotOutput{}, nil },
+		"DescribeSnapshots": func(input interface{}) (interface{}, error) {
+			out := &ec2.DescribeSnapshotsOutput{}
+			for _, id := range input.(*ec2.DescribeSnapshotsInput).SnapshotIds {
+				out.Snapshots = append(out.Snapshots, types.Snapshot{SnapshotId: aws.String(id), VolumeSize: aws.Int32(snapshotSize(id))})
+			}
+			return out, nil
+		},
+	})
+	records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", "web", c, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	return f, records
+}
+
+// snapshotSize is the size in GB of snap-web-ami-<n>: sizes that don't follow the backups' ages
+func snapshotSize(id string) int32 {
+	var n int32
+	fmt.Sscanf(id, "snap-web-ami-%d", &n)
+	return n*7%23 + 1
+}
+
+// actions counts the purge decisions by action
+func actions(records []PurgeRecord) map[string]int {
+	counts := map[string]int{}
+	for _, r := range records {
+		counts[r.Action]++
+	}
+	return counts
+}
+
+func TestMaxPurge(t *testing.T) {
+	// the plan purges 18 of the 40 backups, keeping one a day
+	tests := []struct {
+		maxPurge  string
+		wantPurge int
+	}{
+		{"5", 5},
+		{"18", 18},
+		{"0", 18},
+	}
+	for _, tt := range tests {
+		f, records := purgeWeb(t, "--max-purge="+tt.maxPurge, "--max-purge-per-host=0")
+		got := actions(records)
+		if got[actionPurged] != tt.wantPurge || got[actionKeptLimit] != 18-tt.wantPurge || f.count("DeregisterImage") != tt.wantPurge {
+			t.Errorf("--max-purge=%s: %v with %d deregistrations, want %d purged and the rest kept", tt.maxPurge, got, f.count("DeregisterImage"), tt.wantPurge)
+		}
+		// the oldest go first, so the limit keeps the newest
+		for _, r := range records {
+			if r.Action == actionKeptLimit {
+				for _, p := range records {
+					if p.Action == actionPurged && p.CreatedAt.After(r.CreatedAt) {
+						t.Errorf("--max-purge=%s purged %s but kept the older %s", tt.maxPurge, p.AmiId, r.AmiId)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMaxPurgePerHost(t *testing.T) {
+	// nobody is at the terminal to confirm, even when the tests are run from one
+	stdin := os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	os.Stdin = r
+	t.Cleanup(func() { os.Stdin = stdin; r.Close() })
+	tests := []struct {
+		name       string
+		args       []string
+		wantAction string // of the 18 the plan purges
+	}{
+		// a plan over the limit purges nothing unconfirmed
+		{"refused", []string{"--max-purge-per-host=10"}, actionKeptLarge},
+		{"confirmed", []string{"--max-purge-per-host=10", "--confirm-large-purge"}, actionPurged},
+		{"within", []string{"--max-purge-per-host=18"}, actionPurged},
+		{"dry run", []string{"--max-purge-per-host=10", "--dry-run"}, actionWouldPurge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, records := purgeWeb(t, append(tt.args, "--max-purge=0")...)
+			got := actions(records)
+			wantDeregistered := 0
+			if tt.wantAction == actionPurged {
+				wantDeregistered = 18
+			}
+			if got[tt.wantAction] != 18 || f.count("DeregisterImage") != wantDeregistered {
+				t.Errorf("%v with %d deregistrations, want 18 %s", got, f.count("DeregisterImage"), tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestPurgeOrderSize(t *testing.T) {
+	for _, order := range []string{"time", "size"} {
+		f, records := purgeWeb(t, "--purge-order="+order, "--max-purge=5", "--max-purge-per-host=0")
+		planned := map[string]PurgeRecord{}
+		for _, r := range records {
+			if r.Action == actionPurged || r.Action == actionKeptLimit {
+				planned[r.AmiId] = r
+			}
+		}
+		deleted := []PurgeRecord{}
+		for _, in := range f.inputs("DeregisterImage") {
+			deleted = append(deleted, planned[aws.ToString(in.(*ec2.DeregisterImageInput).ImageId)])
+		}
+		if len(deleted) != 5 {
+			t.Fatalf("--purge-order=%s: %d deregistrations, want 5", order, len(deleted))
+		}
+		for i, r := range deleted {
+			if order == "size" && r.SizeGB != int64(snapshotSize("snap-"+r.AmiId)) {
+				t.Errorf("%s is %d GB, want its snapshot's %d", r.AmiId, r.SizeGB, snapshotSize("snap-"+r.AmiId))
+			}
+			if i == 0 {
+				continue
+			}
+			if order == "size" && r.SizeGB > deleted[i-1].SizeGB || order == "time" && r.CreatedAt.Before(deleted[i-1].CreatedAt) {
+				t.Errorf("--purge-order=%s deregistered %s (%d GB, %s) after %s (%d GB, %s)", order,
+					r.AmiId, r.SizeGB, r.CreatedAt, deleted[i-1].AmiId, deleted[i-1].SizeGB, deleted[i-1].CreatedAt)
+			}
+		}
+		// the limit keeps the smallest
+		for _, r := range planned {
+			if order == "size" && r.Action == actionKeptLimit && r.SizeGB > deleted[4].SizeGB {
+				t.Errorf("kept %s of %d GB, but deregistered %s of %d GB", r.AmiId, r.SizeGB, deleted[4].AmiId, deleted[4].SizeGB)
+			}
+		}
+		if n := f.count("DescribeSnapshots"); (n > 0) != (order == "size") {
+			t.Errorf("--purge-order=%s looked up snapshot sizes %d times", order, n)
+		}
+	}
+}
+
+func TestPurgeReport(t *testing.T) {
+	_, records := purgeWeb(t, "--purge-order=size", "--max-purge=5", "--max-purge-per-host=0")
+	// a Name tag with the CSV's own separators stays one field
+	odd := records[0]
+	odd.InstanceTag = `web,"01"`
+	records = append(records, odd)
+	path := filepath.Join(t.TempDir(), "purge.csv")
+	if err := writePurgeReport(path, records); err != nil {
+		t.Fatalf("writePurgeReport: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("report isn't CSV: %s", err)
+	}
+	header := []string{"timestamp", "instance_tag", "region", "ami_id", "ami_created_at", "window_interval", "window_start", "window_stop", "action", "size_gb", "retention_class", "rule"}
+	if !reflect.DeepEqual(rows[0], header) {
+		t.Errorf("header %q, want %q", rows[0], header)
+	}
+	if len(rows) != len(records)+1 {
+		t.Fatalf("%d rows for %d decisions", len(rows)-1, len(records))
+	}
+	for i, row := range rows[1:] {
+		r := records[i]
+		if row[1] != r.InstanceTag || row[2] != "us-east-1" || row[3] != r.AmiId || row[4] != r.CreatedAt.Format(time.RFC3339) || row[8] != r.Action {
+			t.Errorf("row %q for %+v", row, r)
+		}
+		if sized := row[9] != ""; sized != (r.SizeGB > 0) || (sized && row[9] != fmt.Sprint(r.SizeGB)) {
+			t.Errorf("size_gb %q for a %d GB backup", row[9], r.SizeGB)
+		}
+		if windowed := row[5] != ""; windowed != (r.Window.Interval > 0) || (windowed && row[6] != r.Window.Start.Format(time.RFC3339)) {
+			t.Errorf("window %q %q for %+v", row[5], row[6], r.Window)
+		}
+	}
+	if got := actions(records[:len(records)-1]); got[actionPurged] != 5 || got[actionKeptLimit] != 13 {
+		t.Errorf("report has %v, want 5 purged and 13 kept by --max-purge", got)
+	}
+}
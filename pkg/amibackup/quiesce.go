@@ -0,0 +1,124 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// commandFailed is an SSM command that ran on an instance and didn't succeed
+type commandFailed struct {
+	document, instanceId, status, reason string
+}
+
+func (e commandFailed) Error() string {
+	return fmt.Sprintf("%s %s on %s: %s", e.document, e.status, e.instanceId, e.reason)
+}
+
+// createQuiescedAMI is createAMI run between the --pre-freeze-ssm and --post-thaw-ssm documents,
+// so the instance's applications can flush and hold their writes while it's imaged.  The thaw
+// runs once the AMI is available (or just started, with --no-wait), and whenever the freeze was
+// sent at all - a freeze that failed part way may still have frozen something.
+func createQuiescedAMI(ctx context.Context, awsec2 *ec2.Client, awsssm *ssm.Client, instance *types.Instance, c *Config, instanceNameTag string) (string, error) {
+	if c.preFreezeSSM == "" && c.postThawSSM == "" {
+		return createAMI(ctx, awsec2, instance, c, instanceNameTag)
+	}
+	thaw := func() error {
+		if c.postThawSSM == "" {
+			return nil
+		}
+		if err := runSSMDocument(ctx, awsssm, c.postThawSSM, *instance.InstanceId, c); err != nil {
+			return fmt.Errorf("Error thawing %s (%s) - its applications may still be frozen: %s", instanceNameTag, *instance.InstanceId, err.Error())
+		}
+		return nil
+	}
+
+	if c.preFreezeSSM != "" {
+		if err := runSSMDocument(ctx, awsssm, c.preFreezeSSM, *instance.InstanceId, c); err != nil {
+			if terr := thaw(); terr != nil {
+				log.Print(terr.Error())
+			}
+			return "", fmt.Errorf("Error freezing %s (%s) - not imaging it: %s", instanceNameTag, *instance.InstanceId, err.Error())
+		}
+	}
+	newAMI, err := createAMI(ctx, awsec2, instance, c, instanceNameTag)
+	if terr := thaw(); terr != nil {
+		if err != nil {
+			log.Print(terr.Error())
+			return newAMI, err
+		}
+		return newAMI, terr
+	}
+	return newAMI, err
+}
+
+// runSSMDocument runs an SSM document on an instance, with the --ssm-parameter parameters, and
+// waits for it to finish
+func runSSMDocument(ctx context.Context, awsssm *ssm.Client, document, instanceId string, c *Config) error {
+	if c.dryRun {
+		log.Printf("DRYRUN: would have run SSM document %s on %s", document, instanceId)
+		return nil
+	}
+	send, err := awsssm.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String(document),
+		InstanceIds:  []string{instanceId},
+		Comment:      aws.String("amibackup " + c.runID),
+		Parameters:   c.ssmParameters,
+	})
+	if err != nil {
+		return fmt.Errorf("SSM API SendCommand failed for %s: %s", document, err.Error())
+	}
+	commandId := aws.ToString(send.Command.CommandId)
+	log.Printf("Running SSM document %s on %s (command %s)", document, instanceId, commandId)
+	return waitForCommand(ctx, awsssm, document, commandId, instanceId)
+}
+
+// waitForCommand waits for an SSM command to finish on an instance.  A command that ran and
+// didn't succeed is a commandFailed error.
+func waitForCommand(ctx context.Context, awsssm *ssm.Client, document, commandId, instanceId string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for SSM command %s on %s: %s", commandId, instanceId, ctx.Err())
+		case <-time.After(apiPollInterval):
+		}
+		resp, err := awsssm.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandId),
+			InstanceId: aws.String(instanceId),
+		})
+		if err != nil {
+			// a brand new command can take a moment to be visible
+			log.Printf("Error waiting for SSM command %s on %s (trying again): %s", commandId, instanceId, err.Error())
+			continue
+		}
+		switch resp.Status {
+		case ssmtypes.CommandInvocationStatusSuccess:
+			return nil
+		case ssmtypes.CommandInvocationStatusPending, ssmtypes.CommandInvocationStatusInProgress, ssmtypes.CommandInvocationStatusDelayed:
+			log.Printf("Waiting for %s SSM command %s on %s", resp.Status, commandId, instanceId)
+		default:
+			reason := strings.TrimSpace(aws.ToString(resp.StandardErrorContent))
+			if reason == "" {
+				reason = aws.ToString(resp.StatusDetails)
+			}
+			return commandFailed{document, instanceId, string(resp.Status), reason}
+		}
+	}
+}
+
+// parseSSMParameter parses an --ssm-parameter key=value
+func parseSSMParameter(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("want key=value")
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,105 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// TestQuiescedBackup checks that the instance is frozen before it's imaged, and thawed after
+// whatever happens to the image or the freeze
+func TestQuiescedBackup(t *testing.T) {
+	fastPolls(t)
+	tests := []struct {
+		name       string
+		failed     string // the document whose command fails, if any
+		failCreate bool
+		wantCalls  []string // the freeze and thaw commands and the create, in order
+		status     string
+	}{
+		{"frozen and thawed", "", false, []string{"SendCommand FlushDB", "CreateImage", "SendCommand ResumeDB"}, statusSuccess},
+		// nothing is imaged unfrozen, and a half-done freeze is undone
+		{"freeze failed", "FlushDB", false, []string{"SendCommand FlushDB", "SendCommand ResumeDB"}, statusFailed},
+		{"image failed", "", true, []string{"SendCommand FlushDB", "CreateImage", "SendCommand ResumeDB"}, statusFailed},
+		{"thaw failed", "ResumeDB", false, []string{"SendCommand FlushDB", "CreateImage", "SendCommand ResumeDB"}, statusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrap := map[string]func(fakeCall) fakeCall{
+				"SendCommand": func(fakeCall) fakeCall {
+					return func(input interface{}) (interface{}, error) {
+						// command IDs are the document's name, so the invocation knows which ran
+						return &ssm.SendCommandOutput{Command: &ssmtypes.Command{CommandId: input.(*ssm.SendCommandInput).DocumentName}}, nil
+					}
+				},
+				"GetCommandInvocation": func(fakeCall) fakeCall {
+					return func(input interface{}) (interface{}, error) {
+						if aws.ToString(input.(*ssm.GetCommandInvocationInput).CommandId) == tt.failed {
+							return &ssm.GetCommandInvocationOutput{Status: ssmtypes.CommandInvocationStatusFailed, StandardErrorContent: aws.String("database busy\n")}, nil
+						}
+						return &ssm.GetCommandInvocationOutput{Status: ssmtypes.CommandInvocationStatusSuccess}, nil
+					}
+				},
+			}
+			if tt.failCreate {
+				wrap["CreateImage"] = func(fakeCall) fakeCall {
+					return func(interface{}) (interface{}, error) { return nil, apiError("InvalidParameterValue") }
+				}
+			}
+			f := runFake(t, wrap, "web")
+			c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+				"--no-reconcile", "--no-progress", "--pre-freeze-ssm=FlushDB", "--post-thaw-ssm=ResumeDB", "--ssm-parameter=mode=fast", "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			summary, err := run(context.Background(), c)
+			summary.setOutcome(err)
+			if summary.Status != tt.status {
+				t.Errorf("run ended %s (%v), want %s", summary.Status, err, tt.status)
+			}
+
+			calls, sends := []string{}, f.inputs("SendCommand")
+			f.mu.Lock()
+			for _, op := range f.calls {
+				switch op {
+				case "SendCommand":
+					in := sends[0].(*ssm.SendCommandInput)
+					sends = sends[1:]
+					calls = append(calls, op+" "+aws.ToString(in.DocumentName))
+					if !reflect.DeepEqual(in.InstanceIds, []string{"i-00000000000000001"}) || !reflect.DeepEqual(in.Parameters, map[string][]string{"mode": {"fast"}}) {
+						t.Errorf("SendCommand(%v, %v), want the instance and --ssm-parameter", in.InstanceIds, in.Parameters)
+					}
+				case "CreateImage":
+					calls = append(calls, op)
+				}
+			}
+			f.mu.Unlock()
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls = %q, want %q", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSSMParameterOptions(t *testing.T) {
+	c, err := parseTestOptions("--pre-freeze-ssm=FlushDB", "--ssm-parameter=mode=fast", "--ssm-parameter=mode=safe", "--ssm-parameter=wait=a=b", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	if want := map[string][]string{"mode": {"fast", "safe"}, "wait": {"a=b"}}; !reflect.DeepEqual(c.ssmParameters, want) {
+		t.Errorf("ssmParameters = %v, want %v", c.ssmParameters, want)
+	}
+	for _, args := range [][]string{
+		{"--ssm-parameter=mode=fast", "web"},
+		{"--pre-freeze-ssm=FlushDB", "--ssm-parameter=mode", "web"},
+		{"--pre-freeze-ssm=FlushDB", "--ssm-parameter==fast", "web"},
+	} {
+		if _, err := parseTestOptions(args...); classOf(err, classInternal) != classConfig {
+			t.Errorf("parseOptions(%q) = %v, want a config error", args, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package amibackup
+
+import (
+	"fmt"
+	"log"
+)
+
+// raceCodes are the error codes of a call that lost a race with a concurrent run - another
+// shard, a resume or an overlapping cron job that deregistered the image, or deleted the snapshot
+// or the --latest-parameter, first.  The work is done either way, so they count as success.  CreateTags overwrites, so
+// tagging twice never fails; tagging an image or snapshot that has since gone does.
+var raceCodes = map[string]bool{
+	"InvalidAMIID.Unavailable":   true,
+	"InvalidAMIID.NotFound":      true,
+	"InvalidSnapshot.NotFound":   true,
+	"InvalidSnapshotID.NotFound": true,
+	"ParameterNotFound":          true,
+}
+
+// raced reports whether a call on a resource failed only because a concurrent run got there
+// first, counting it for the summary and logging it with --debug
+func raced(err error, call, resource string, c *Config) bool {
+	code := errorCode(err)
+	if !raceCodes[code] {
+		return false
+	}
+	if c.races != nil {
+		c.races.Add(1)
+	}
+	debugf(c, "%s on %s raced with concurrent run (%s) - counting it as done", call, resource, code)
+	return true
+}
+
+// debugf logs with --debug only
+func debugf(c *Config, format string, args ...interface{}) {
+	if c.debug {
+		log.Printf("DEBUG: %s", fmt.Sprintf(format, args...))
+	}
+}
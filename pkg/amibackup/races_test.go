@@ -0,0 +1,226 @@
+package amibackup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// lingeringEC2 is EC2 as it behaves after DeregisterImage: the image goes on being listed, in
+// the deregistered state, for a while
+type lingeringEC2 struct {
+	mu      sync.Mutex
+	images  []types.Image
+	deleted map[string]bool // snapshots
+}
+
+func (l *lingeringEC2) describe(input interface{}) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	in := input.(*ec2.DescribeImagesInput)
+	out := &ec2.DescribeImagesOutput{}
+	for _, img := range l.images {
+		matches := len(in.ImageIds) == 0 || stringIn(aws.ToString(img.ImageId), in.ImageIds)
+		for _, filter := range in.Filters {
+			name := aws.ToString(filter.Name)
+			switch {
+			case strings.HasPrefix(name, "tag:"):
+				matches = matches && stringIn(discovery.TagValue(img.Tags, strings.TrimPrefix(name, "tag:")), filter.Values)
+			case name == "block-device-mapping.snapshot-id":
+				uses := false
+				for snap := range imageSnaps(img) {
+					uses = uses || stringIn(snap, filter.Values)
+				}
+				matches = matches && uses
+			}
+		}
+		if matches {
+			out.Images = append(out.Images, img)
+		}
+	}
+	return out, nil
+}
+
+func (l *lingeringEC2) deregister(input interface{}) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, img := range l.images {
+		if aws.ToString(img.ImageId) != aws.ToString(input.(*ec2.DeregisterImageInput).ImageId) {
+			continue
+		}
+		if img.State == types.ImageStateDeregistered {
+			return nil, apiError("InvalidAMIID.Unavailable")
+		}
+		l.images[i].State = types.ImageStateDeregistered
+		return &ec2.DeregisterImageOutput{}, nil
+	}
+	return nil, apiError("InvalidAMIID.NotFound")
+}
+
+func (l *lingeringEC2) deleteSnapshot(input interface{}) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap := aws.ToString(input.(*ec2.DeleteSnapshotInput).SnapshotId)
+	if l.deleted[snap] {
+		return nil, apiError("InvalidSnapshot.NotFound")
+	}
+	l.deleted[snap] = true
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+// imageSnaps returns the snapshots an image's block devices use
+func imageSnaps(img types.Image) map[string]bool {
+	snaps := map[string]bool{}
+	for _, bd := range img.BlockDeviceMappings {
+		if bd.Ebs != nil {
+			snaps[aws.ToString(bd.Ebs.SnapshotId)] = true
+		}
+	}
+	return snaps
+}
+
+func TestPurgeLingeringDeregistered(t *testing.T) {
+	asOf := time.Now()
+	c, err := parseTestOptions("-p", "1d:4d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	images := backupImages("web", map[string]time.Time{
+		// all in the middle of one of the 1d window's days
+		"oldest": asOf.Add(-231 * time.Hour),
+		"b":      asOf.Add(-230 * time.Hour),
+		"c":      asOf.Add(-229 * time.Hour),
+	})
+	// an image deregistered long ago that EC2 still lists, using one of web-b's snapshots
+	ghost := backupImages("web", map[string]time.Time{"ghost": asOf.Add(-228 * time.Hour)})[0]
+	ghost.State = types.ImageStateDeregistered
+	ghost.BlockDeviceMappings = append(ghost.BlockDeviceMappings, image("", "snap-web-b").BlockDeviceMappings...)
+	l := &lingeringEC2{images: append(images, ghost), deleted: map[string]bool{}}
+
+	// two runs back to back, the second seeing the first's images still listed
+	for run := 1; run <= 2; run++ {
+		f := newFakeEC2(t, map[string]fakeCall{
+			"DescribeImages":  l.describe,
+			"DeregisterImage": l.deregister,
+			"DeleteSnapshot":  l.deleteSnapshot,
+		})
+		records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", "web", c, nil)
+		if err != nil {
+			t.Fatalf("run %d: purgeAMIs: %s", run, err)
+		}
+		purged, considered := []string{}, map[string]bool{}
+		for _, r := range records {
+			considered[r.AmiId] = true
+			if r.Action == actionPurged {
+				purged = append(purged, r.AmiId)
+			}
+		}
+		sort.Strings(purged)
+		deregistered := []string{}
+		for _, in := range f.inputs("DeregisterImage") {
+			deregistered = append(deregistered, aws.ToString(in.(*ec2.DeregisterImageInput).ImageId))
+		}
+		sort.Strings(deregistered)
+		wantPurged := map[int]string{1: "web-b,web-c", 2: ""}[run]
+		if strings.Join(purged, ",") != wantPurged || strings.Join(deregistered, ",") != wantPurged {
+			t.Errorf("run %d purged %v and deregistered %v, want %s", run, purged, deregistered, wantPurged)
+		}
+		if considered["web-ghost"] || run == 2 && (considered["web-b"] || considered["web-c"]) {
+			t.Errorf("run %d counted deregistered images: %v", run, considered)
+		}
+		if n := f.count("DeleteSnapshot"); run == 2 && n != 0 {
+			t.Errorf("run %d deleted %d snapshots again", run, n)
+		}
+	}
+	// the ghost's reference didn't keep web-b's snapshot
+	for _, snap := range []string{"snap-web-b", "snap-web-c"} {
+		if !l.deleted[snap] {
+			t.Errorf("%s not deleted", snap)
+		}
+	}
+	if l.deleted["snap-web-oldest"] {
+		t.Errorf("the kept image's snapshot was deleted")
+	}
+}
+
+func TestDeregisterAlreadyDeregistered(t *testing.T) {
+	c, err := parseTestOptions("web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DeregisterImage": func(interface{}) (interface{}, error) { return nil, apiError("InvalidAMIID.Unavailable") },
+	})
+	if err := deregisterImage(context.Background(), f.Client, "ami-gone", c); err != nil {
+		t.Errorf("deregistering an already deregistered image: %s", err)
+	}
+	if n := c.races.Load(); n != 1 {
+		t.Errorf("counted %d races, want 1", n)
+	}
+}
+
+func TestPurgeRaces(t *testing.T) {
+	asOf := time.Now()
+	c, err := parseTestOptions("-p", "1d:4d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	images := backupImages("web", map[string]time.Time{
+		"oldest": asOf.Add(-231 * time.Hour),
+		"b":      asOf.Add(-230 * time.Hour),
+		"c":      asOf.Add(-229 * time.Hour),
+	})
+	// a concurrent run deregistered web-b, and deleted web-c's snapshot, after this one listed them
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			return &ec2.DescribeImagesOutput{Images: images}, nil
+		},
+		"DeregisterImage": func(input interface{}) (interface{}, error) {
+			if aws.ToString(input.(*ec2.DeregisterImageInput).ImageId) == "web-b" {
+				return nil, apiError("InvalidAMIID.Unavailable")
+			}
+			return &ec2.DeregisterImageOutput{}, nil
+		},
+		"DeleteSnapshot": func(input interface{}) (interface{}, error) {
+			if aws.ToString(input.(*ec2.DeleteSnapshotInput).SnapshotId) == "snap-web-c" {
+				return nil, apiError("InvalidSnapshot.NotFound")
+			}
+			return &ec2.DeleteSnapshotOutput{}, nil
+		},
+	})
+
+	records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", "web", c, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	purged := 0
+	for _, r := range records {
+		if r.Action == actionPurged {
+			purged++
+		}
+	}
+	if purged != 2 || c.races.Load() != 2 {
+		t.Errorf("purged %d images with %d races, want both purged and both races counted", purged, c.races.Load())
+	}
+	// web-b's snapshot still goes, though another run deregistered it
+	deleted := []string{}
+	for _, in := range f.inputs("DeleteSnapshot") {
+		deleted = append(deleted, aws.ToString(in.(*ec2.DeleteSnapshotInput).SnapshotId))
+	}
+	sort.Strings(deleted)
+	if got := strings.Join(deleted, ","); got != "snap-web-b,snap-web-c" {
+		t.Errorf("deleted %s, want snap-web-b and snap-web-c", got)
+	}
+	summary := &runSummary{Raced: int(c.races.Load())}
+	if status, class, code := runOutcome(summary, nil); status != statusSuccess || code != 0 {
+		t.Errorf("a run that only raced ended %s (%s), exiting %d", status, class, code)
+	}
+}
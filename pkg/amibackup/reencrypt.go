@@ -0,0 +1,312 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/time/rate"
+)
+
+// reencryptedFromTag marks a --reencrypt copy with the image it replaces
+const reencryptedFromTag = "amibackup:reencrypted-from"
+
+// reencrypt statuses in the audit records
+const (
+	reencryptDone   = "reencrypted"
+	reencryptWould  = "would-reencrypt"
+	reencryptKept   = "kept-min-keep"
+	reencryptFailed = "failed"
+)
+
+// reencryptRecord is the audit record of one image --reencrypt looked at
+type reencryptRecord struct {
+	Time     string   `json:"time"`
+	Region   string   `json:"region"`
+	Hostname string   `json:"hostname"`
+	OldAMI   string   `json:"old_ami"`
+	OldKeys  []string `json:"old_keys"`
+	NewAMI   string   `json:"new_ami,omitempty"`
+	NewKey   string   `json:"new_key"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// reencryptAudit writes audit records, one JSON object per line, from any goroutine
+type reencryptAudit struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// write prints one record
+func (a *reencryptAudit) write(r reencryptRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r.Time = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Error writing audit record for %s: %s", r.OldAMI, err.Error())
+		return
+	}
+	fmt.Fprintf(a.out, "%s\n", data)
+}
+
+// snapshotKeys returns the KMS keys of an image's snapshots ("" for an unencrypted snapshot)
+func snapshotKeys(ctx context.Context, awsec2 *ec2.Client, image types.Image) ([]string, error) {
+	ids := []string{}
+	for _, bd := range image.BlockDeviceMappings {
+		if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+			ids = append(ids, *bd.Ebs.SnapshotId)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var resp *ec2.DescribeSnapshotsOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: ids})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("EC2 API DescribeSnapshots failed for %s: %s", *image.ImageId, err.Error())
+	}
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, snap := range resp.Snapshots {
+		key := ""
+		if aws.ToBool(snap.Encrypted) {
+			key = aws.ToString(snap.KmsKeyId)
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// findReencrypted returns the --reencrypt copy already made of an image, or ""
+func findReencrypted(ctx context.Context, awsec2 *ec2.Client, amiId string) (string, error) {
+	var resp *ec2.DescribeImagesOutput
+	err := withFreshCredentials(ctx, awsec2, func() (err error) {
+		resp, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+			Owners: []string{"self"},
+			Filters: []types.Filter{
+				{Name: aws.String("tag:" + reencryptedFromTag), Values: []string{amiId}},
+				{Name: aws.String("state"), Values: []string{"pending", "available"}},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	if len(resp.Images) == 0 {
+		return "", nil
+	}
+	return *resp.Images[0].ImageId, nil
+}
+
+// reencryptAll runs --reencrypt for every host in every dest region, a host at a time in each
+// region, printing the audit records to stdout.  It returns how many backups failed.
+func reencryptAll(ctx context.Context, clients *clientPool, c *Config, cp *checkpoint) int {
+	audit := &reencryptAudit{out: os.Stdout}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, region := range c.destRegions() {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			for _, instanceNameTag := range c.instanceNameTags {
+				n, err := reencryptBackups(ctx, clients.EC2(region, ""), region, instanceNameTag, c, cp, c.reencryptLimiter, audit)
+				if err != nil {
+					log.Printf("Error re-encrypting backups for %s in %s: %s", instanceNameTag, region, err.Error())
+					n++
+				}
+				mu.Lock()
+				failed += n
+				mu.Unlock()
+			}
+		}(region)
+	}
+	wg.Wait()
+	return failed
+}
+
+// reencryptBackups re-encrypts a host's backups in one region with c.kmsKeyId, for --reencrypt:
+// every available backup with a snapshot under another key is copied in-region under the new
+// key with all its tags, checked, and only then deregistered along with its snapshots.  Images
+// go oldest first, one at a time.  It returns how many images failed.
+func reencryptBackups(ctx context.Context, awsec2 *ec2.Client, region, instanceNameTag string, c *Config, cp *checkpoint, limiter *rate.Limiter, audit *reencryptAudit) (int, error) {
+	c = c.forDest(region)
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"available"}}},
+	}, instanceNameTag, c)
+	if err != nil {
+		return 0, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	images := resp.Images
+	sort.SliceStable(images, func(i, j int) bool {
+		return c.backupTag(images[i].Tags, "timestamp") < c.backupTag(images[j].Tags, "timestamp")
+	})
+	failed := 0
+	for _, image := range images {
+		keys, err := snapshotKeys(ctx, awsec2, image)
+		if err != nil {
+			return failed, err
+		}
+		stale := false
+		for _, key := range keys {
+			stale = stale || (key != "" && key != c.kmsKeyId)
+		}
+		if !stale {
+			continue
+		}
+		r := reencryptImage(ctx, awsec2, region, instanceNameTag, image, c, cp, limiter)
+		r.OldKeys = keys
+		audit.write(r)
+		if r.Status == reencryptFailed {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// reencryptImage re-encrypts one backup.  The copy's client token and reencrypted-from tag let a
+// resumed run find a copy already started rather than start another.
+func reencryptImage(ctx context.Context, awsec2 *ec2.Client, region, instanceNameTag string, image types.Image, c *Config, cp *checkpoint, limiter *rate.Limiter) reencryptRecord {
+	id := *image.ImageId
+	r := reencryptRecord{Region: region, Hostname: c.hostname(instanceNameTag), OldAMI: id, NewKey: c.kmsKeyId}
+	fail := func(err error) reencryptRecord {
+		log.Printf("Error re-encrypting %s of %s in %s: %s", id, instanceNameTag, region, err.Error())
+		r.Status, r.Error = reencryptFailed, err.Error()
+		return r
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have re-encrypted %s of %s in %s with %s", id, instanceNameTag, region, c.kmsKeyId)
+		r.Status = reencryptWould
+		return r
+	}
+	timestamp, err := strconv.ParseInt(c.backupTag(image.Tags, "timestamp"), 10, 64)
+	if err != nil {
+		return fail(fmt.Errorf("no usable timestamp tag"))
+	}
+	tags := []types.Tag{{Key: aws.String(reencryptedFromTag), Value: aws.String(id)}}
+	for _, tag := range image.Tags {
+		// an earlier re-encrypt's copy gets its reencrypted-from replaced
+		if key := aws.ToString(tag.Key); !strings.HasPrefix(key, "aws:") && key != reencryptedFromTag {
+			tags = append(tags, tag)
+		}
+	}
+
+	newAMI, copied := cp.done(id, stepReencryptCopied, region)
+	if !copied {
+		if newAMI, err = findReencrypted(ctx, awsec2, id); err != nil {
+			return fail(err)
+		}
+		if newAMI == "" {
+			if err := limiter.Wait(ctx); err != nil {
+				return fail(err)
+			}
+			release := acquireCopySlot(c.accountID, c.perAccountCopyLimit)
+			defer release()
+			stamp, _, _ := backupTimes(time.Unix(timestamp, 0))
+			copyResp, err := startCopy(ctx, awsec2, &ec2.CopyImageInput{
+				SourceRegion:  aws.String(region),
+				SourceImageId: aws.String(id),
+				// named like any copy: the backup's time, then the AMI it was copied from
+				Name:        aws.String(fmt.Sprintf("%s-%s-%s", amiNamePrefix(instanceNameTag), stamp, id)),
+				Description: image.Description,
+				Encrypted:   aws.Bool(true),
+				KmsKeyId:    aws.String(c.kmsKeyId),
+				ClientToken: aws.String(c.runID + "-reencrypt-" + id),
+			}, c)
+			if err != nil {
+				return fail(err)
+			}
+			newAMI = *copyResp.ImageId
+			log.Printf("Started re-encrypting copy of %s of %s in %s (%s)", id, instanceNameTag, region, newAMI)
+			if err := pause(ctx, apiPollInterval); err != nil {
+				return fail(fmt.Errorf("Stopped before tagging copy %s: %s", newAMI, err))
+			}
+		}
+		// tag it now, with the original timestamp, so purge and a resumed run both see it
+		err = withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{newAMI}, Tags: tags})
+			return err
+		})
+		if err != nil {
+			return fail(fmt.Errorf("EC2 API CreateTags failed for %s: %s", newAMI, err.Error()))
+		}
+		cp.record(id, stepReencryptCopied, region, newAMI)
+	}
+	r.NewAMI = newAMI
+	if err := waitForAMI(ctx, awsec2, newAMI, instanceNameTag, "", true, c); err != nil {
+		return fail(err)
+	}
+	if err := verifyCopy(ctx, awsec2, awsec2, id, newAMI, true); err != nil {
+		return fail(err)
+	}
+	snaps, err := findSnapshots(ctx, newAMI, awsec2)
+	if err != nil {
+		return fail(err)
+	}
+	var describe *ec2.DescribeImagesOutput
+	err = withFreshCredentials(ctx, awsec2, func() (err error) {
+		describe, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{newAMI}})
+		return err
+	})
+	if err != nil || len(describe.Images) != 1 {
+		return fail(fmt.Errorf("EC2 API DescribeImages failed for %s: %v", newAMI, err))
+	}
+	newKeys, err := snapshotKeys(ctx, awsec2, describe.Images[0])
+	if err != nil {
+		return fail(err)
+	}
+	if len(newKeys) != 1 || newKeys[0] != c.kmsKeyId {
+		return fail(fmt.Errorf("copy %s has snapshots under %s, not just %s", newAMI, strings.Join(newKeys, ", "), c.kmsKeyId))
+	}
+	for snap, device := range snaps {
+		err := withFreshCredentials(ctx, awsec2, func() error {
+			_, err := awsec2.CreateTags(ctx, &ec2.CreateTagsInput{Resources: []string{snap}, Tags: snapshotTags(tags, nil, device, c)})
+			return err
+		})
+		if err != nil {
+			return fail(fmt.Errorf("EC2 API CreateTags failed for %s: %s", snap, err.Error()))
+		}
+	}
+
+	// the copy counts towards --min-keep, the image it replaces doesn't
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"available"}}},
+	}, instanceNameTag, c)
+	if err != nil {
+		return fail(fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error()))
+	}
+	if len(resp.Images)-1 < c.minKeep {
+		log.Printf("Keeping %s of %s in %s: deregistering it would leave fewer than --min-keep=%d backups", id, instanceNameTag, region, c.minKeep)
+		r.Status = reencryptKept
+		return r
+	}
+	if err := deregisterAMI(ctx, awsec2, id, c); err != nil {
+		return fail(err)
+	}
+	log.Printf("Re-encrypted %s of %s in %s as %s", id, instanceNameTag, region, newAMI)
+	r.Status = reencryptDone
+	return r
+}
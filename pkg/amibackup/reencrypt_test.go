@@ -0,0 +1,252 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/time/rate"
+)
+
+const (
+	reencryptOldKey = "arn:aws:kms:us-west-2:123456789012:key/old"
+	reencryptNewKey = "arn:aws:kms:us-west-2:123456789012:key/new"
+)
+
+// reencryptRegion is a dest region's images and snapshots, as EC2 would answer for them
+type reencryptRegion struct {
+	mu        sync.Mutex
+	images    map[string]types.Image
+	keys      map[string]string // snapshot ID to its KMS key, "" if unencrypted
+	copyKey   string            // the key CopyImage really uses, if not the one asked for
+	deleted   []string          // snapshots
+	copyCalls int
+}
+
+// backup adds a backup of web at when, with one snapshot under key
+func (r *reencryptRegion) backup(id string, when time.Time, key string) {
+	snap := "snap-" + id
+	r.keys[snap] = key
+	r.images[id] = types.Image{
+		ImageId: aws.String(id),
+		Name:    aws.String("web-" + id),
+		State:   types.ImageStateAvailable,
+		BlockDeviceMappings: []types.BlockDeviceMapping{{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &types.EbsBlockDevice{SnapshotId: aws.String(snap), Encrypted: aws.Bool(key != "")},
+		}},
+		Tags: []types.Tag{
+			{Key: aws.String("hostname"), Value: aws.String("web")},
+			{Key: aws.String("timestamp"), Value: aws.String(fmt.Sprint(when.Unix()))},
+			{Key: aws.String("Owner"), Value: aws.String("ops")},
+		},
+	}
+}
+
+// matches reports whether an image passes the DescribeImages filters given
+func (r *reencryptRegion) matches(img types.Image, filters []types.Filter) bool {
+	for _, filter := range filters {
+		name := aws.ToString(filter.Name)
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			if !stringIn(discovery.TagValue(img.Tags, name[4:]), filter.Values) {
+				return false
+			}
+		case name == "state":
+			if !stringIn(string(img.State), filter.Values) {
+				return false
+			}
+		case name == "block-device-mapping.snapshot-id":
+			uses := false
+			for _, bd := range img.BlockDeviceMappings {
+				uses = uses || stringIn(aws.ToString(bd.Ebs.SnapshotId), filter.Values)
+			}
+			if !uses {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *reencryptRegion) client(t *testing.T) *fakeEC2 {
+	return newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			in := input.(*ec2.DescribeImagesInput)
+			out := &ec2.DescribeImagesOutput{}
+			for _, img := range r.images {
+				if (len(in.ImageIds) == 0 || stringIn(*img.ImageId, in.ImageIds)) && r.matches(img, in.Filters) {
+					out.Images = append(out.Images, img)
+				}
+			}
+			return out, nil
+		},
+		"DescribeSnapshots": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			out := &ec2.DescribeSnapshotsOutput{}
+			for _, id := range input.(*ec2.DescribeSnapshotsInput).SnapshotIds {
+				key := r.keys[id]
+				out.Snapshots = append(out.Snapshots, types.Snapshot{SnapshotId: aws.String(id), Encrypted: aws.Bool(key != ""), KmsKeyId: aws.String(key)})
+			}
+			return out, nil
+		},
+		"CopyImage": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			in := input.(*ec2.CopyImageInput)
+			r.copyCalls++
+			id := "ami-re-" + aws.ToString(in.SourceImageId)
+			key := aws.ToString(in.KmsKeyId)
+			if r.copyKey != "" {
+				key = r.copyKey
+			}
+			r.keys["snap-"+id] = key
+			r.images[id] = types.Image{
+				ImageId: aws.String(id),
+				Name:    in.Name,
+				State:   types.ImageStateAvailable,
+				BlockDeviceMappings: []types.BlockDeviceMapping{{
+					DeviceName: aws.String("/dev/xvda"),
+					Ebs:        &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id), Encrypted: aws.Bool(true)},
+				}},
+			}
+			return &ec2.CopyImageOutput{ImageId: aws.String(id)}, nil
+		},
+		"CreateTags": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			in := input.(*ec2.CreateTagsInput)
+			for _, id := range in.Resources {
+				if img, ok := r.images[id]; ok {
+					img.Tags = append(img.Tags, in.Tags...)
+					r.images[id] = img
+				}
+			}
+			return &ec2.CreateTagsOutput{}, nil
+		},
+		"DeregisterImage": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			id := aws.ToString(input.(*ec2.DeregisterImageInput).ImageId)
+			img := r.images[id]
+			img.State = types.ImageStateDeregistered
+			r.images[id] = img
+			return &ec2.DeregisterImageOutput{}, nil
+		},
+		"DeleteSnapshot": func(input interface{}) (interface{}, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.deleted = append(r.deleted, aws.ToString(input.(*ec2.DeleteSnapshotInput).SnapshotId))
+			return &ec2.DeleteSnapshotOutput{}, nil
+		},
+	})
+}
+
+func TestReencryptBackups(t *testing.T) {
+	fastPolls(t)
+	now := time.Now()
+	tests := []struct {
+		name       string
+		args       []string
+		copyKey    string
+		already    bool // a copy of ami-old was started by an earlier run
+		wantStatus string
+		wantCopies int
+		wantGone   bool // whether ami-old is deregistered
+	}{
+		{"reencrypted", nil, "", false, reencryptDone, 1, true},
+		{"dry run", []string{"--dry-run"}, "", false, reencryptWould, 0, false},
+		{"resumed", nil, "", true, reencryptDone, 0, true},
+		// the copy, ami-new and ami-plain leave 3 backups; ami-old has to stay for 4
+		{"min keep", []string{"--min-keep=4"}, "", false, reencryptKept, 1, false},
+		{"copied under the wrong key", nil, reencryptOldKey, false, reencryptFailed, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions(append(tt.args, "--reencrypt", "--dest=us-west-2", "-k", reencryptNewKey, "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			r := &reencryptRegion{images: map[string]types.Image{}, keys: map[string]string{}, copyKey: tt.copyKey}
+			r.backup("ami-old", now.Add(-48*time.Hour), reencryptOldKey)
+			r.backup("ami-new", now.Add(-24*time.Hour), reencryptNewKey)
+			// unencrypted backups aren't under another key; --reencrypt leaves them to -e
+			r.backup("ami-plain", now.Add(-72*time.Hour), "")
+			f := r.client(t)
+			if tt.already {
+				if _, err := f.CopyImage(context.Background(), &ec2.CopyImageInput{SourceImageId: aws.String("ami-old"), KmsKeyId: aws.String(reencryptNewKey)}); err != nil {
+					t.Fatal(err)
+				}
+				f.CreateTags(context.Background(), &ec2.CreateTagsInput{Resources: []string{"ami-re-ami-old"}, Tags: []types.Tag{{Key: aws.String(reencryptedFromTag), Value: aws.String("ami-old")}}})
+				r.copyCalls = 0
+			}
+			var out bytes.Buffer
+			failed, err := reencryptBackups(context.Background(), f.Client, "us-west-2", "web", c, nil, rate.NewLimiter(rate.Inf, 1), &reencryptAudit{out: &out})
+			if err != nil {
+				t.Fatalf("reencryptBackups: %s", err)
+			}
+
+			var records []reencryptRecord
+			for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+				var record reencryptRecord
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("audit record %q: %s", line, err)
+				}
+				records = append(records, record)
+			}
+			if len(records) != 1 || records[0].OldAMI != "ami-old" || records[0].Status != tt.wantStatus || records[0].OldKeys[0] != reencryptOldKey {
+				t.Fatalf("audit records = %+v, want ami-old %s", records, tt.wantStatus)
+			}
+			if wantFailed := map[bool]int{true: 1}[tt.wantStatus == reencryptFailed]; failed != wantFailed {
+				t.Errorf("%d failed, want %d", failed, wantFailed)
+			}
+			if r.copyCalls != tt.wantCopies {
+				t.Errorf("%d copies started, want %d", r.copyCalls, tt.wantCopies)
+			}
+			if gone := r.images["ami-old"].State == types.ImageStateDeregistered; gone != tt.wantGone {
+				t.Errorf("ami-old deregistered = %v, want %v", gone, tt.wantGone)
+			}
+			if tt.wantGone && (len(r.deleted) != 1 || r.deleted[0] != "snap-ami-old") {
+				t.Errorf("deleted snapshots %v, want ami-old's", r.deleted)
+			}
+			for _, id := range []string{"ami-new", "ami-plain"} {
+				if r.images[id].State != types.ImageStateAvailable {
+					t.Errorf("%s is %s, want it left alone", id, r.images[id].State)
+				}
+			}
+			if tt.wantStatus == reencryptDone {
+				// the copy carries the backup's tags, so purge sees it as the same backup
+				copied := r.images["ami-re-ami-old"].Tags
+				want := map[string]string{
+					"hostname":         "web",
+					"timestamp":        discovery.TagValue(r.images["ami-old"].Tags, "timestamp"),
+					"Owner":            "ops",
+					reencryptedFromTag: "ami-old",
+				}
+				for key, value := range want {
+					if got := discovery.TagValue(copied, key); got != value {
+						t.Errorf("copy's %s tag = %q, want %q", key, got, value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReencryptNeedsKey(t *testing.T) {
+	if _, err := parseTestOptions("--reencrypt", "web"); err == nil || !strings.Contains(err.Error(), "--reencrypt needs the new key") {
+		t.Errorf("parseOptions = %v, want an error asking for the key", err)
+	}
+}
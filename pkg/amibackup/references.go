@@ -0,0 +1,140 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// imageGoneCodes are the DescribeImages error codes for an AMI ID that names no image
+var imageGoneCodes = map[string]bool{
+	"InvalidAMIID.NotFound":    true,
+	"InvalidAMIID.Unavailable": true,
+	"InvalidAMIID.Malformed":   true,
+}
+
+// latestParameterName is the SSM parameter holding a host's latest backup, for --latest-parameter
+func (c *Config) latestParameterName(instanceNameTag string) string {
+	return strings.TrimSuffix(c.latestParameter, "/") + "/" + c.hostname(instanceNameTag)
+}
+
+// gcLatestParameter keeps the purge from leaving a host's --latest-parameter in a region naming an
+// AMI it just deregistered: the parameter is pointed at the newest backup the purge kept, or
+// deleted if none is left.  A parameter naming any other AMI - one a concurrent run has already
+// moved on to a newer backup, say - is left alone.
+func gcLatestParameter(ctx context.Context, awsssm *ssm.Client, regionName, instanceNameTag string, records []PurgeRecord, c *Config) error {
+	if c.latestParameter == "" {
+		return nil
+	}
+	purged := map[string]bool{}
+	for _, r := range records {
+		if r.Action == actionPurged || r.Action == actionWouldPurge {
+			purged[r.AmiId] = true
+		}
+	}
+	if len(purged) == 0 {
+		return nil
+	}
+	newest := PurgeRecord{}
+	for _, r := range records {
+		// an image another run is still making isn't a backup yet
+		if !purged[r.AmiId] && r.Action != actionKeptInProgress && r.CreatedAt.After(newest.CreatedAt) {
+			newest = r
+		}
+	}
+	stale := func(amiId string) (bool, error) { return purged[amiId], nil }
+	return fixLatestParameter(ctx, awsssm, regionName, instanceNameTag, stale, newest.AmiId, c)
+}
+
+// gcReferences reconciles a host's --latest-parameter in a region with its backups there, for
+// --gc-references: a parameter naming an AMI that no longer exists is pointed at the newest
+// available backup, or deleted if there is none.
+func gcReferences(ctx context.Context, awsec2 *ec2.Client, awsssm *ssm.Client, regionName, instanceNameTag string, c *Config) error {
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{Filters: []types.Filter{
+		{Name: aws.String("state"), Values: []string{"available"}},
+	}}, instanceNameTag, c)
+	if err != nil {
+		return fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	newest, newestAt := "", time.Time{}
+	backups, _ := discovery.Classify(resp.Images, c.tags())
+	for _, b := range backups {
+		if _, ok := inFlight(b.Image, c); !ok && b.When.After(newestAt) {
+			newest, newestAt = b.Id, b.When
+		}
+	}
+	stale := func(amiId string) (bool, error) {
+		var images *ec2.DescribeImagesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			images, err = awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiId}})
+			return err
+		})
+		if imageGoneCodes[errorCode(err)] {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("EC2 API DescribeImages failed for %s: %s", amiId, err.Error())
+		}
+		for _, image := range images.Images {
+			if image.State != types.ImageStateDeregistered {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	return fixLatestParameter(ctx, awsssm, regionName, instanceNameTag, stale, newest, c)
+}
+
+// fixLatestParameter points a host's --latest-parameter at replacement, or deletes it when
+// replacement is "", if stale says the AMI it names is gone.  SSM can't make the update
+// conditional on the value read, so a concurrent run's update in between is lost; the next
+// purge or --gc-references puts it right.
+func fixLatestParameter(ctx context.Context, awsssm *ssm.Client, regionName, instanceNameTag string, stale func(amiId string) (bool, error), replacement string, c *Config) error {
+	name := c.latestParameterName(instanceNameTag)
+	resp, err := awsssm.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name)})
+	if errorCode(err) == "ParameterNotFound" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("SSM API GetParameter failed for %s: %s", name, err.Error())
+	}
+	current := aws.ToString(resp.Parameter.Value)
+	gone, err := stale(current)
+	if err != nil {
+		return err
+	}
+	if !gone {
+		debugf(c, "Parameter %s in %s names %s, which is still there - leaving it", name, regionName, current)
+		return nil
+	}
+	switch {
+	case c.dryRun && replacement != "":
+		log.Printf("DRYRUN: would have pointed parameter %s in %s at %s, as %s is gone", name, regionName, replacement, current)
+	case c.dryRun:
+		log.Printf("DRYRUN: would have deleted parameter %s in %s, as %s is gone and no backup of %s is left", name, regionName, current, instanceNameTag)
+	case replacement != "":
+		_, err := awsssm.PutParameter(ctx, &ssm.PutParameterInput{Name: aws.String(name), Value: aws.String(replacement), Overwrite: aws.Bool(true)})
+		if err != nil {
+			return fmt.Errorf("SSM API PutParameter failed for %s: %s", name, err.Error())
+		}
+		log.Printf("Pointed parameter %s in %s at %s, as %s is gone", name, regionName, replacement, current)
+	default:
+		_, err := awsssm.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(name)})
+		if raced(err, "DeleteParameter", name, c) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("SSM API DeleteParameter failed for %s: %s", name, err.Error())
+		}
+		log.Printf("Deleted parameter %s in %s, as %s is gone and no backup of %s is left", name, regionName, current, instanceNameTag)
+	}
+	return nil
+}
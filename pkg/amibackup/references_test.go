@@ -0,0 +1,180 @@
+package amibackup
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// fakeParameters is an SSM parameter store, by name
+type fakeParameters map[string]string
+
+// client returns an SSM client answering from the store, and the fake to count its calls by
+func (p fakeParameters) client(t *testing.T) (*ssm.Client, *fakeAWS) {
+	f := newFakeAWS(t, map[string]fakeCall{
+		"GetParameter": func(input interface{}) (interface{}, error) {
+			name := aws.ToString(input.(*ssm.GetParameterInput).Name)
+			value, ok := p[name]
+			if !ok {
+				return nil, apiError("ParameterNotFound")
+			}
+			return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value)}}, nil
+		},
+		"PutParameter": func(input interface{}) (interface{}, error) {
+			in := input.(*ssm.PutParameterInput)
+			p[aws.ToString(in.Name)] = aws.ToString(in.Value)
+			return &ssm.PutParameterOutput{}, nil
+		},
+		"DeleteParameter": func(input interface{}) (interface{}, error) {
+			name := aws.ToString(input.(*ssm.DeleteParameterInput).Name)
+			if _, ok := p[name]; !ok {
+				return nil, apiError("ParameterNotFound")
+			}
+			delete(p, name)
+			return &ssm.DeleteParameterOutput{}, nil
+		},
+	})
+	return ssm.New(ssm.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{f.apiOption},
+	}), f
+}
+
+func TestGCLatestParameter(t *testing.T) {
+	asOf := time.Now()
+	record := func(id string, age time.Duration, action string) PurgeRecord {
+		return PurgeRecord{InstanceTag: "web", Region: "us-east-1", AmiId: id, CreatedAt: asOf.Add(-age), Action: action}
+	}
+	purgeKeeping := []PurgeRecord{
+		record("ami-old", 90*24*time.Hour, actionPurged),
+		record("ami-kept", 24*time.Hour, actionKeptOldest),
+		record("ami-older", 60*24*time.Hour, actionKeptOldest),
+		// another run is still making it, so it isn't the newest backup
+		record("ami-making", time.Hour, actionKeptInProgress),
+	}
+	purgeAll := []PurgeRecord{record("ami-old", 90*24*time.Hour, actionPurged)}
+	tests := []struct {
+		name    string
+		args    []string
+		current string // the parameter's value before the purge, "" if it has none
+		records []PurgeRecord
+		want    string // its value after, "" if it has none
+	}{
+		{"names the purged AMI", nil, "ami-old", purgeKeeping, "ami-kept"},
+		// a concurrent run already pointed it at a newer backup
+		{"already updated", nil, "ami-newer", purgeKeeping, "ami-newer"},
+		{"names a kept AMI", nil, "ami-older", purgeKeeping, "ami-older"},
+		{"nothing left", nil, "ami-old", purgeAll, ""},
+		{"no parameter", nil, "", purgeKeeping, ""},
+		{"dry run", []string{"--dry-run"}, "ami-old", []PurgeRecord{record("ami-old", 90*24*time.Hour, actionWouldPurge)}, "ami-old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions(append(tt.args, "--latest-parameter=/amibackup/latest", "-p", "1d:4d:30d", "web")...)
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			params := fakeParameters{}
+			if tt.current != "" {
+				params["/amibackup/latest/web"] = tt.current
+			}
+			awsssm, f := params.client(t)
+			if err := gcLatestParameter(context.Background(), awsssm, "us-east-1", "web", tt.records, c); err != nil {
+				t.Fatalf("gcLatestParameter: %s", err)
+			}
+			if got := params["/amibackup/latest/web"]; got != tt.want {
+				t.Errorf("parameter names %q after the purge, want %q", got, tt.want)
+			}
+			if tt.current == tt.want && f.count("PutParameter")+f.count("DeleteParameter") > 0 {
+				t.Errorf("parameter written though it didn't change")
+			}
+		})
+	}
+}
+
+func TestGCLatestParameterDeleteRaced(t *testing.T) {
+	c, err := parseTestOptions("--latest-parameter=/amibackup/latest", "-p", "1d:4d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	params := fakeParameters{"/amibackup/latest/web": "ami-old"}
+	awsssm, f := params.client(t)
+	// another run deletes it between our read and our delete
+	f.ops["DeleteParameter"] = func(interface{}) (interface{}, error) { return nil, apiError("ParameterNotFound") }
+	records := []PurgeRecord{{InstanceTag: "web", AmiId: "ami-old", Action: actionPurged}}
+	if err := gcLatestParameter(context.Background(), awsssm, "us-east-1", "web", records, c); err != nil {
+		t.Errorf("gcLatestParameter: %s", err)
+	}
+	if c.races.Load() != 1 {
+		t.Errorf("counted %d races, want 1", c.races.Load())
+	}
+}
+
+func TestGCReferences(t *testing.T) {
+	asOf := time.Now()
+	k := contract{Images: backupImages("web", map[string]time.Time{
+		"a": asOf.Add(-48 * time.Hour),
+		"b": asOf.Add(-24 * time.Hour),
+	})}
+	tests := []struct {
+		name    string
+		current string
+		lookup  fakeCall // DescribeImages by ID
+		want    string
+	}{
+		{"gone", "ami-purged", func(interface{}) (interface{}, error) { return nil, apiError("InvalidAMIID.NotFound") }, "web-b"},
+		{"deregistered", "ami-purged", imageIn(image("ami-purged"), "deregistered"), "web-b"},
+		{"still there", "web-a", imageIn(image("web-a"), "available"), "web-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseTestOptions("--gc-references", "--latest-parameter=/amibackup/latest", "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			f := newFakeEC2(t, map[string]fakeCall{
+				"DescribeImages": func(input interface{}) (interface{}, error) {
+					if ids := input.(*ec2.DescribeImagesInput).ImageIds; len(ids) > 0 {
+						return tt.lookup(input)
+					}
+					// drop the listing's state filter, which every backup here passes
+					listing := *input.(*ec2.DescribeImagesInput)
+					listing.Filters = nil
+					for _, filter := range input.(*ec2.DescribeImagesInput).Filters {
+						if strings.HasPrefix(aws.ToString(filter.Name), "tag:") {
+							listing.Filters = append(listing.Filters, filter)
+						}
+					}
+					return k.describe(&listing)
+				},
+			})
+			params := fakeParameters{"/amibackup/latest/web": tt.current}
+			awsssm, _ := params.client(t)
+			if err := gcReferences(context.Background(), f.Client, awsssm, "us-east-1", "web", c); err != nil {
+				t.Fatalf("gcReferences: %s", err)
+			}
+			if got := params["/amibackup/latest/web"]; got != tt.want {
+				t.Errorf("parameter names %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestParameterOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"--gc-references", "web"},
+		{"--latest-parameter=amibackup/latest", "web"},
+	} {
+		if _, err := parseTestOptions(args...); err == nil || !strings.Contains(err.Error(), "latest-parameter") {
+			t.Errorf("parseOptions(%v) = %v, want a latest-parameter error", args, err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/docopt/docopt-go"
+)
+
+var restoreUsage = `amibackup restore: launch an instance from an amibackup backup
+
+Usage:
+  amibackup restore [options] --instance-type=<type> --key-name=<name> [--security-group-id=<sg>]... <hostname>
+  amibackup restore -h --help
+
+Options:
+  --as-of=<time>            Restore the newest backup made at or before this time - RFC 3339, "2006-01-02 15:04" or a date (default now).
+  -r, --region=<region>     AWS region to restore in, where the backups are [default: us-west-1].
+  --subnet-id=<id>          Subnet to launch the instance in - this or --eni-id is required.
+  --eni-id=<eni>            Existing network interface to launch the instance with, keeping its subnet, addresses
+                            and security groups - can't be used with --subnet-id or --security-group-id.
+  --instance-type=<type>    Instance type to launch, e.g. m5.large.
+  --key-name=<name>         EC2 key pair for the new instance.
+  --security-group-id=<sg>  Security group for the new instance - multiple use ok (default: the VPC's default group).
+  -t, --timeout=<secs>      Timeout waiting for the instance to be running [default: 15m].
+  --tag-prefix=<prefix>     Prefix the backups were tagged with (see amibackup --tag-prefix).
+  --legacy-tags             With --tag-prefix, also find backups tagged without the prefix.
+  --also-read-unprefixed    Same as --legacy-tags.
+  --normalize=<mode>        Hostname tag the backups were written with: lower or preserve [default: preserve].
+  --endpoint-url=<url>      Send AWS API calls to this endpoint instead of the regional AWS one.
+  -D, --dry-run             Show the RunInstances request instead of launching anything.
+  -h, --help                Show this screen.
+`
+
+// restoreRequest is what to restore, and where
+type restoreRequest struct {
+	hostname       string
+	asOf           time.Time
+	region         string
+	subnetId       string
+	eniId          string
+	instanceType   string
+	keyName        string
+	securityGroups []string
+	timeout        time.Duration
+}
+
+// restoreResult is a restored instance's connection details
+type restoreResult struct {
+	Hostname   string
+	AmiId      string
+	BackupTime time.Time
+	InstanceId string
+	State      string
+	PrivateIP  string
+	PublicIP   string
+	Zone       string
+	KeyName    string
+}
+
+// asOfFormats are the layouts --as-of accepts, besides a Unix timestamp
+var asOfFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseAsOf parses --as-of, in local time unless it says otherwise
+func parseAsOf(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	for _, layout := range asOfFormats {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("want RFC 3339, 2006-01-02 15:04, a date or a Unix timestamp")
+}
+
+// restoreMain runs the restore subcommand
+func restoreMain(args []string) error {
+	c, r, err := parseRestoreOptions(args)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	clients, err := newClientPool(ctx, c.endpointURL, c.runID)
+	if err != nil {
+		return classify(classConfig, err)
+	}
+	result, err := restoreBackup(ctx, clients.EC2(r.region, ""), c, r)
+	if err != nil {
+		return classify(classInternal, fmt.Errorf("Error restoring %s: %w", r.hostname, err))
+	}
+	if result != nil {
+		printRestore(os.Stdout, result)
+	}
+	return nil
+}
+
+// parseRestoreOptions parses the restore subcommand's options
+func parseRestoreOptions(args []string) (*Config, *restoreRequest, error) {
+	// docopt prints the usage for -h, --version and bad arguments, leaving the exit to us
+	arguments, err := docopt.Parse(restoreUsage, append([]string{"restore"}, args...), true, version, false, false)
+	if err != nil {
+		return nil, nil, classErrorf(classConfig, "Error parsing arguments: %s", err.Error())
+	}
+	if arguments == nil {
+		return nil, nil, errDone
+	}
+	c := &Config{runID: newRunID()}
+	r := &restoreRequest{
+		hostname:       arguments["<hostname>"].(string),
+		asOf:           time.Now(),
+		region:         arguments["--region"].(string),
+		instanceType:   arguments["--instance-type"].(string),
+		keyName:        arguments["--key-name"].(string),
+		securityGroups: arguments["--security-group-id"].([]string),
+	}
+	if arg, ok := arguments["--subnet-id"].(string); ok {
+		r.subnetId = arg
+	}
+	if arg, ok := arguments["--eni-id"].(string); ok {
+		r.eniId = arg
+	}
+	switch {
+	case r.eniId != "" && (r.subnetId != "" || len(r.securityGroups) > 0):
+		// RunInstances takes the subnet and groups from the interface
+		return nil, nil, classErrorf(classConfig, "--eni-id can't be used with --subnet-id or --security-group-id")
+	case r.eniId == "" && r.subnetId == "":
+		return nil, nil, classErrorf(classConfig, "restore needs --subnet-id or --eni-id")
+	}
+	if arg, ok := arguments["--as-of"].(string); ok {
+		r.asOf, err = parseAsOf(arg)
+		if err != nil {
+			return nil, nil, classErrorf(classConfig, "Invalid as-of: %s (%s)", arg, err.Error())
+		}
+	}
+	r.timeout, err = time.ParseDuration(arguments["--timeout"].(string))
+	if err != nil {
+		return nil, nil, classErrorf(classConfig, "Invalid timeout: %s", arguments["--timeout"].(string))
+	}
+	c.dryRun = arguments["--dry-run"].(bool)
+	c.normalize = arguments["--normalize"].(string)
+	if c.normalize != "lower" && c.normalize != "preserve" {
+		return nil, nil, classErrorf(classConfig, "Invalid --normalize mode: %s (must be lower or preserve)", c.normalize)
+	}
+	if arg, ok := arguments["--tag-prefix"].(string); ok {
+		c.tagPrefix = arg
+	}
+	c.legacyTags = arguments["--legacy-tags"].(bool) || arguments["--also-read-unprefixed"].(bool)
+	if c.legacyTags && c.tagPrefix == "" {
+		return nil, nil, classErrorf(classConfig, "--legacy-tags (--also-read-unprefixed) needs --tag-prefix")
+	}
+	if arg, ok := arguments["--endpoint-url"].(string); ok {
+		c.endpointURL = arg
+	}
+	return c, r, nil
+}
+
+// selectRestoreBackup picks the newest backup made at or before asOf, reading backup times from
+// the timestamp tag just as purge does
+func selectRestoreBackup(images []types.Image, asOf time.Time, c *Config) (string, time.Time, bool) {
+	bestId, best := "", time.Time{}
+	for _, image := range images {
+		timestamp, err := strconv.ParseInt(c.backupTag(image.Tags, "timestamp"), 10, 64)
+		if err != nil {
+			continue
+		}
+		created := time.Unix(timestamp, 0)
+		if created.After(asOf) || (bestId != "" && !created.After(best)) {
+			continue
+		}
+		bestId, best = *image.ImageId, created
+	}
+	return bestId, best, bestId != ""
+}
+
+// restoreBackup launches an instance from the newest available backup of a host at or before the
+// requested time, tags it with where it came from, and waits for it to be running
+func restoreBackup(ctx context.Context, awsec2 *ec2.Client, c *Config, r *restoreRequest) (*restoreResult, error) {
+	resp, err := describeBackups(ctx, awsec2, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("state"), Values: []string{"available"}}},
+	}, r.hostname, c)
+	if err != nil {
+		return nil, classErrorf(apiErrorClass(err, classDiscovery), "EC2 API DescribeImages failed: %s", err.Error())
+	}
+	amiId, backupTime, ok := selectRestoreBackup(resp.Images, r.asOf, c)
+	if !ok {
+		return nil, classErrorf(classDiscovery, "no available backup of %s in %s at or before %s", r.hostname, r.region, r.asOf.Format(timeShortFormat))
+	}
+	log.Printf("Restoring %s from %s, the backup of %s", r.hostname, amiId, backupTime.Format(timeShortFormat))
+
+	params := &ec2.RunInstancesInput{
+		ImageId:      aws.String(amiId),
+		InstanceType: types.InstanceType(r.instanceType),
+		KeyName:      aws.String(r.keyName),
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		ClientToken:  aws.String(c.runID + "-" + amiId),
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeInstance,
+			Tags: []types.Tag{
+				{Key: aws.String("restored-from"), Value: aws.String(amiId)},
+				{Key: aws.String("restore-of"), Value: aws.String(r.hostname)},
+			},
+		}},
+	}
+	if r.eniId != "" {
+		params.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{{NetworkInterfaceId: aws.String(r.eniId), DeviceIndex: aws.Int32(0)}}
+	} else {
+		params.SubnetId = aws.String(r.subnetId)
+	}
+	if len(r.securityGroups) > 0 {
+		params.SecurityGroupIds = r.securityGroups
+	}
+	if c.dryRun {
+		request, err := json.MarshalIndent(params, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("DRYRUN: would have called RunInstances in %s with:\n%s", r.region, request)
+		return nil, nil
+	}
+	var run *ec2.RunInstancesOutput
+	err = withFreshCredentials(ctx, awsec2, func() (err error) {
+		run, err = awsec2.RunInstances(ctx, params)
+		return err
+	})
+	if err != nil {
+		return nil, classErrorf(apiErrorClass(err, classCreate), "EC2 API RunInstances failed: %s", err.Error())
+	}
+	if len(run.Instances) != 1 {
+		return nil, fmt.Errorf("RunInstances started %d instances, not 1", len(run.Instances))
+	}
+	instanceId := *run.Instances[0].InstanceId
+	log.Printf("Launched %s from %s - waiting for it to be running", instanceId, amiId)
+	waitCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	instance, err := waitForInstance(waitCtx, awsec2, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	result := &restoreResult{
+		Hostname:   r.hostname,
+		AmiId:      amiId,
+		BackupTime: backupTime,
+		InstanceId: instanceId,
+		State:      string(instance.State.Name),
+		PrivateIP:  aws.ToString(instance.PrivateIpAddress),
+		PublicIP:   aws.ToString(instance.PublicIpAddress),
+		KeyName:    aws.ToString(instance.KeyName),
+	}
+	if instance.Placement != nil {
+		result.Zone = aws.ToString(instance.Placement.AvailabilityZone)
+	}
+	return result, nil
+}
+
+// waitForInstance waits for a new instance to be running, giving up if it stops or ctx ends
+func waitForInstance(ctx context.Context, awsec2 *ec2.Client, instanceId string) (*types.Instance, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for %s to be running: %s", instanceId, ctx.Err())
+		case <-time.After(apiPollInterval):
+		}
+		var resp *ec2.DescribeInstancesOutput
+		err := withFreshCredentials(ctx, awsec2, func() (err error) {
+			resp, err = awsec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}})
+			return err
+		})
+		if errorCode(err) == "InvalidInstanceID.NotFound" {
+			// a brand new instance can take a moment to be visible
+			log.Printf("Waiting for new instance %s to be visible", instanceId)
+			continue
+		}
+		if err != nil {
+			return nil, classErrorf(apiErrorClass(err, classCreate), "EC2 API DescribeInstances failed for %s: %s", instanceId, err.Error())
+		}
+		for _, reservation := range resp.Reservations {
+			for i := range reservation.Instances {
+				instance := &reservation.Instances[i]
+				if instance.State == nil {
+					unknownState("instance", "", "waiting for it to be running")
+					continue
+				}
+				switch instance.State.Name {
+				case types.InstanceStateNameRunning:
+					return instance, nil
+				case types.InstanceStateNamePending:
+					log.Printf("Waiting for pending instance %s", instanceId)
+				case types.InstanceStateNameShuttingDown, types.InstanceStateNameTerminated, types.InstanceStateNameStopping, types.InstanceStateNameStopped:
+					return instance, fmt.Errorf("instance %s is %s, not running", instanceId, instance.State.Name)
+				default:
+					unknownState("instance", string(instance.State.Name), "waiting for it to be running")
+				}
+			}
+		}
+	}
+}
+
+// printRestore prints a restored instance's connection details
+func printRestore(out io.Writer, r *restoreResult) {
+	publicIP := r.PublicIP
+	if publicIP == "" {
+		publicIP = "none"
+	}
+	fmt.Fprintf(out, "Restored %s from %s (backup of %s)\n", quoteField(r.Hostname), r.AmiId, r.BackupTime.Format(timeShortFormat))
+	fmt.Fprintf(out, "  Instance:    %s (%s)\n", r.InstanceId, r.State)
+	fmt.Fprintf(out, "  Zone:        %s\n", r.Zone)
+	fmt.Fprintf(out, "  Private IP:  %s\n", r.PrivateIP)
+	fmt.Fprintf(out, "  Public IP:   %s\n", publicIP)
+	fmt.Fprintf(out, "  Key pair:    %s\n", r.KeyName)
+}
@@ -0,0 +1,252 @@
+package amibackup
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestParseAsOf(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"1772332200", time.Unix(1772332200, 0), false},
+		{"2026-03-01T02:30:00Z", time.Date(2026, 3, 1, 2, 30, 0, 0, time.UTC), false},
+		// without a zone, times are local
+		{"2026-03-01 02:30:05", time.Date(2026, 3, 1, 2, 30, 5, 0, time.Local), false},
+		{"2026-03-01 02:30", time.Date(2026, 3, 1, 2, 30, 0, 0, time.Local), false},
+		{"2026-03-01", time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), false},
+		{"yesterday", time.Time{}, true},
+		{"2026-03-01 2:30pm", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAsOf(tt.value)
+		if !got.Equal(tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseAsOf(%q) = %s, %v; want %s, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSelectRestoreBackup(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	images := backupImages("web", map[string]time.Time{
+		"before":  asOf.Add(-time.Hour),
+		"older":   asOf.Add(-25 * time.Hour),
+		"at":      asOf,
+		"after":   asOf.Add(time.Minute),
+		"earlier": asOf.Add(-2 * time.Hour),
+	})
+	// a timestamp tag that isn't one is never picked, however it sorts
+	bad := image("web-bad")
+	bad.Tags = []types.Tag{{Key: aws.String("hostname"), Value: aws.String("web")}, {Key: aws.String("timestamp"), Value: aws.String("soon")}}
+	images = append(images, bad)
+	c := &Config{}
+
+	tests := []struct {
+		asOf   time.Time
+		wantId string
+	}{
+		{asOf, "web-at"},
+		{asOf.Add(-time.Second), "web-before"},
+		{asOf.Add(time.Hour), "web-after"},
+		{asOf.Add(-24 * time.Hour), "web-older"},
+		{asOf.Add(-26 * time.Hour), ""},
+	}
+	for _, tt := range tests {
+		id, when, ok := selectRestoreBackup(images, tt.asOf, c)
+		if id != tt.wantId || ok != (tt.wantId != "") || when.After(tt.asOf) {
+			t.Errorf("as of %s: selected %q of %s (%v), want %q", tt.asOf, id, when, ok, tt.wantId)
+		}
+	}
+	if _, _, ok := selectRestoreBackup([]types.Image{bad}, asOf, c); ok {
+		t.Errorf("selected a backup with a bad timestamp tag")
+	}
+}
+
+// restoreImages answers the restore's DescribeImages with two backups of web, a day apart
+func restoreImages(asOf time.Time) fakeCall {
+	return func(interface{}) (interface{}, error) {
+		return &ec2.DescribeImagesOutput{Images: backupImages("web", map[string]time.Time{
+			"today": asOf.Add(-time.Hour), "yesterday": asOf.Add(-25 * time.Hour),
+		})}, nil
+	}
+}
+
+func TestRestoreDryRun(t *testing.T) {
+	out := captureLog(t)
+	asOf := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c, r, err := parseRestoreOptions([]string{"--dry-run", "--subnet-id=subnet-1", "--instance-type=m5.large", "--key-name=ops",
+		"--security-group-id=sg-1", "--security-group-id=sg-2", "--as-of=2026-03-01T02:00:00Z", "web"})
+	if err != nil {
+		t.Fatalf("parseRestoreOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": restoreImages(asOf)})
+	result, err := restoreBackup(context.Background(), f.Client, c, r)
+	if err != nil || result != nil {
+		t.Fatalf("restoreBackup = %v, %v; want nothing launched", result, err)
+	}
+	if n := f.count("RunInstances"); n != 0 {
+		t.Errorf("dry run made %d RunInstances calls", n)
+	}
+	in := f.inputs("DescribeImages")[0].(*ec2.DescribeImagesInput)
+	if !reflect.DeepEqual(in.Owners, []string{"self"}) {
+		t.Errorf("DescribeImages owners %v, want self", in.Owners)
+	}
+
+	_, request, found := strings.Cut(out.String(), "with:\n")
+	if !found {
+		t.Fatalf("no RunInstances request logged:\n%s", out)
+	}
+	var params ec2.RunInstancesInput
+	if err := json.Unmarshal([]byte(request), &params); err != nil {
+		t.Fatalf("logged request isn't JSON: %s\n%s", err, request)
+	}
+	// the newest backup at or before --as-of
+	if aws.ToString(params.ImageId) != "web-yesterday" || aws.ToString(params.SubnetId) != "subnet-1" || params.InstanceType != "m5.large" ||
+		aws.ToString(params.KeyName) != "ops" || !reflect.DeepEqual(params.SecurityGroupIds, []string{"sg-1", "sg-2"}) ||
+		aws.ToInt32(params.MinCount) != 1 || aws.ToInt32(params.MaxCount) != 1 {
+		t.Errorf("RunInstances request:\n%s", request)
+	}
+	tags := map[string]string{}
+	for _, spec := range params.TagSpecifications {
+		if spec.ResourceType != types.ResourceTypeInstance {
+			t.Errorf("tags for %s, want the instance", spec.ResourceType)
+		}
+		for _, tag := range spec.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	if want := map[string]string{"restored-from": "web-yesterday", "restore-of": "web"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("instance tagged %v, want %v", tags, want)
+	}
+
+	// nothing old enough
+	r.asOf = asOf.Add(-48 * time.Hour)
+	if _, err := restoreBackup(context.Background(), f.Client, c, r); classOf(err, classInternal) != classDiscovery {
+		t.Errorf("restoreBackup with no backup = %v, want a discovery error", err)
+	}
+}
+
+// instanceIn answers DescribeInstances with the instance in a state
+func instanceIn(state types.InstanceStateName) fakeCall {
+	return func(input interface{}) (interface{}, error) {
+		return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: []types.Instance{{
+			InstanceId:       aws.String(input.(*ec2.DescribeInstancesInput).InstanceIds[0]),
+			State:            &types.InstanceState{Name: state},
+			PrivateIpAddress: aws.String("10.0.0.5"),
+			KeyName:          aws.String("ops"),
+			Placement:        &types.Placement{AvailabilityZone: aws.String("us-west-1a")},
+		}}}}}, nil
+	}
+}
+
+func TestWaitForInstance(t *testing.T) {
+	fastPolls(t)
+	notFound := func(interface{}) (interface{}, error) { return nil, apiError("InvalidInstanceID.NotFound") }
+	tests := []struct {
+		name      string
+		answers   []fakeCall
+		wantState types.InstanceStateName
+		wantErr   bool
+		wantCalls int
+	}{
+		// a new instance can take a moment to be visible
+		{"running", []fakeCall{notFound, instanceIn(types.InstanceStateNamePending), instanceIn(types.InstanceStateNameRunning)},
+			types.InstanceStateNameRunning, false, 3},
+		{"terminated", []fakeCall{instanceIn(types.InstanceStateNamePending), instanceIn(types.InstanceStateNameTerminated)},
+			types.InstanceStateNameTerminated, true, 2},
+		// any other error isn't waited out
+		{"unauthorized", []fakeCall{func(interface{}) (interface{}, error) { return nil, apiError("UnauthorizedOperation") }}, "", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEC2(t, map[string]fakeCall{"DescribeInstances": script(tt.answers...)})
+			instance, err := waitForInstance(context.Background(), f.Client, "i-1")
+			state := types.InstanceStateName("")
+			if instance != nil {
+				state = instance.State.Name
+			}
+			if state != tt.wantState || (err != nil) != tt.wantErr || f.count("DescribeInstances") != tt.wantCalls {
+				t.Errorf("waitForInstance = %s, %v after %d calls; want %s, error %v after %d", state, err, f.count("DescribeInstances"), tt.wantState, tt.wantErr, tt.wantCalls)
+			}
+		})
+	}
+
+	// the timeout bounds the wait
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeInstances": notFound})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := waitForInstance(ctx, f.Client, "i-1"); err == nil || !strings.Contains(err.Error(), "gave up waiting") {
+		t.Errorf("waitForInstance = %v, want it to give up", err)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	fastPolls(t)
+	c, r, err := parseRestoreOptions([]string{"--subnet-id=subnet-1", "--instance-type=m5.large", "--key-name=ops", "web"})
+	if err != nil {
+		t.Fatalf("parseRestoreOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{
+		"DescribeImages": restoreImages(time.Now()),
+		"RunInstances": func(interface{}) (interface{}, error) {
+			return &ec2.RunInstancesOutput{Instances: []types.Instance{{InstanceId: aws.String("i-restored")}}}, nil
+		},
+		"DescribeInstances": script(instanceIn(types.InstanceStateNamePending), instanceIn(types.InstanceStateNameRunning)),
+	})
+	result, err := restoreBackup(context.Background(), f.Client, c, r)
+	if err != nil {
+		t.Fatalf("restoreBackup: %s", err)
+	}
+	want := restoreResult{Hostname: "web", AmiId: "web-today", BackupTime: result.BackupTime, InstanceId: "i-restored", State: "running",
+		PrivateIP: "10.0.0.5", Zone: "us-west-1a", KeyName: "ops"}
+	if !reflect.DeepEqual(*result, want) {
+		t.Errorf("restored %+v, want %+v", *result, want)
+	}
+	in := f.inputs("RunInstances")[0].(*ec2.RunInstancesInput)
+	if aws.ToString(in.ClientToken) != c.runID+"-web-today" || in.SecurityGroupIds != nil {
+		t.Errorf("RunInstances(token %s, groups %v), want the run's token and the VPC's default group", aws.ToString(in.ClientToken), in.SecurityGroupIds)
+	}
+}
+
+func TestRestoreENI(t *testing.T) {
+	out := captureLog(t)
+	c, r, err := parseRestoreOptions([]string{"--dry-run", "--eni-id=eni-1", "--instance-type=m5.large", "--key-name=ops", "web"})
+	if err != nil {
+		t.Fatalf("parseRestoreOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": restoreImages(time.Now())})
+	if _, err := restoreBackup(context.Background(), f.Client, c, r); err != nil {
+		t.Fatalf("restoreBackup: %s", err)
+	}
+	_, request, _ := strings.Cut(out.String(), "with:\n")
+	var params ec2.RunInstancesInput
+	if err := json.Unmarshal([]byte(request), &params); err != nil {
+		t.Fatalf("logged request isn't JSON: %s\n%s", err, request)
+	}
+	// the interface brings its own subnet and groups, which RunInstances won't take alongside it
+	want := []types.InstanceNetworkInterfaceSpecification{{NetworkInterfaceId: aws.String("eni-1"), DeviceIndex: aws.Int32(0)}}
+	if !reflect.DeepEqual(params.NetworkInterfaces, want) || params.SubnetId != nil || params.SecurityGroupIds != nil {
+		t.Errorf("RunInstances request:\n%s", request)
+	}
+
+	for _, args := range [][]string{
+		{"--eni-id=eni-1", "--subnet-id=subnet-1"},
+		{"--eni-id=eni-1", "--security-group-id=sg-1"},
+		{},
+	} {
+		args = append(args, "--instance-type=m5.large", "--key-name=ops", "web")
+		if _, _, err := parseRestoreOptions(args); classOf(err, classInternal) != classConfig {
+			t.Errorf("parseRestoreOptions(%q) = %v, want a config error", args, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// most datums one PutMetricData call takes
+const cloudWatchBatch = 1000
+
+// retentionStat is how far back one host's retained backups in one region reach, and the longest
+// stretch they leave without a backup - measured by the purge pass once its purges are done (in
+// a dry run, as its plan would leave them)
+type retentionStat struct {
+	Host             string `json:"host"`
+	Region           string `json:"region"`
+	Backups          int    `json:"backups"`
+	OldestAgeSeconds int64  `json:"oldest_backup_age_seconds"`
+	MaxGapSeconds    int64  `json:"max_gap_seconds"`
+	GapStart         string `json:"gap_start,omitempty"` // RFC 3339 time of the backup the longest gap follows
+}
+
+// measureRetention measures the backups a host's purge records in a region leave behind.  An
+// AMI in several windows has a record in each, and only the one acted on changes when a limit
+// or guard keeps it, so any record that keeps an AMI means it was kept.
+func measureRetention(instanceNameTag, regionName string, records []PurgeRecord, now time.Time) retentionStat {
+	retained := map[string]time.Time{}
+	for _, r := range records {
+		if r.Action != actionPurged && r.Action != actionWouldPurge {
+			retained[r.AmiId] = r.CreatedAt
+		}
+	}
+	times := []time.Time{}
+	for _, when := range retained {
+		times = append(times, when)
+	}
+	return retentionOf(instanceNameTag, regionName, times, now)
+}
+
+// retentionOf measures a host's backups made at these times in a region
+func retentionOf(instanceNameTag, regionName string, times []time.Time, now time.Time) retentionStat {
+	coverage := purge.MeasureCoverage(times, now)
+	stat := retentionStat{Host: instanceNameTag, Region: regionName, Backups: coverage.Backups}
+	if coverage.Backups > 0 {
+		stat.OldestAgeSeconds = int64(now.Sub(coverage.Oldest).Seconds())
+		stat.MaxGapSeconds = int64(coverage.MaxGap.Seconds())
+		stat.GapStart = coverage.GapStart.UTC().Format(time.RFC3339)
+	}
+	return stat
+}
+
+// cachedRetention measures a host's backups in a region from its --purge-cache entry, for a
+// purge scan the cache let us skip
+func cachedRetention(instanceNameTag, regionName string, c *Config) (retentionStat, bool) {
+	if c.purgeCache == nil {
+		return retentionStat{}, false
+	}
+	c.purgeCache.mu.Lock()
+	defer c.purgeCache.mu.Unlock()
+	e := c.purgeCache.Entries[purgeCacheKey(regionName, instanceNameTag)]
+	if e == nil {
+		return retentionStat{}, false
+	}
+	times := []time.Time{}
+	for _, image := range e.Images {
+		times = append(times, time.Unix(image.Timestamp, 0))
+	}
+	return retentionOf(instanceNameTag, regionName, times, c.asOf), true
+}
+
+// overGap reports whether a host's backups in a region miss the --max-gap requirement
+func overGap(stat retentionStat, c *Config) bool {
+	return c.maxGap > 0 && (stat.Backups == 0 || time.Duration(stat.MaxGapSeconds)*time.Second > c.maxGap)
+}
+
+// gapViolation describes a host and region over --max-gap
+func gapViolation(stat retentionStat) string {
+	if stat.Backups == 0 {
+		return fmt.Sprintf("%s in %s: no retained backups", stat.Host, stat.Region)
+	}
+	return fmt.Sprintf("%s in %s: %s without a backup after %s (oldest backup %s old)", stat.Host, stat.Region,
+		time.Duration(stat.MaxGapSeconds)*time.Second, stat.GapStart, (time.Duration(stat.OldestAgeSeconds) * time.Second).Round(time.Hour))
+}
+
+// reportRetention checks the purge pass's retention stats against --max-gap and prints the
+// --gap-report, returning the hosts and regions over --max-gap
+func reportRetention(stats []retentionStat, c *Config) []string {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Host == stats[j].Host {
+			return stats[i].Region < stats[j].Region
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	violations := []string{}
+	for _, stat := range stats {
+		if overGap(stat, c) {
+			violations = append(violations, gapViolation(stat))
+		}
+	}
+	if len(violations) > 0 {
+		log.Printf("WARNING: %d hosts and regions have gaps over --max-gap=%s: %s", len(violations), c.maxGap, strings.Join(violations, "; "))
+	}
+	if c.gapReport {
+		printGapReport(os.Stdout, violations, c)
+	}
+	return violations
+}
+
+// publishMetrics publishes a run's metrics - the purge pass's retention stats and the instances
+// --max-new-gb deferred - to --metrics-file and --cloudwatch-namespace.  Failing to publish is
+// logged, never fatal.
+func publishMetrics(ctx context.Context, clients *clientPool, summary *runSummary, c *Config) {
+	if c.metricsFile != "" {
+		if c.dryRun {
+			log.Printf("DRYRUN: would have written metrics for %d hosts and regions to %s", len(summary.Retention), c.metricsFile)
+		} else if err := writeMetricsFile(c.metricsFile, summary); err != nil {
+			log.Printf("Error writing metrics file: %s", err.Error())
+		}
+	}
+	if c.cloudWatchNamespace != "" {
+		if c.dryRun {
+			log.Printf("DRYRUN: would have put metrics for %d hosts and regions to CloudWatch namespace %s", len(summary.Retention), c.cloudWatchNamespace)
+		} else if err := putMetrics(ctx, clients.CloudWatch(c.sourceRegion, ""), summary, c); err != nil {
+			log.Printf("Error putting metrics: %s", err.Error())
+		}
+	}
+}
+
+// printGapReport prints the hosts and regions over --max-gap, for --gap-report
+func printGapReport(out io.Writer, violations []string, c *Config) {
+	if len(violations) == 0 {
+		fmt.Fprintf(out, "No gaps over %s\n", c.maxGap)
+		return
+	}
+	fmt.Fprintf(out, "%d hosts and regions with gaps over %s:\n", len(violations), c.maxGap)
+	for _, v := range violations {
+		fmt.Fprintf(out, "  %s\n", v)
+	}
+}
+
+// writeMetricsFile writes a run's metrics in the Prometheus text format, for node_exporter's
+// textfile collector, replacing the file in one rename so it is never read half written
+func writeMetricsFile(path string, summary *runSummary) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	err = writeMetrics(tmp, summary)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// TempFile's 0600 would hide it from the collector
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeMetrics writes a run's metrics in the Prometheus text format.  A host and region without
+// backups gets only its backup count.
+func writeMetrics(out io.Writer, summary *runSummary) error {
+	stats := summary.Retention
+	metrics := []struct {
+		name, help string
+		value      func(retentionStat) int64
+	}{
+		{"amibackup_retained_backups", "Backups kept after the last purge.", func(s retentionStat) int64 { return int64(s.Backups) }},
+		{"amibackup_oldest_backup_age_seconds", "Age of the oldest backup kept after the last purge.", func(s retentionStat) int64 { return s.OldestAgeSeconds }},
+		{"amibackup_max_gap_seconds", "Longest time between kept backups, or from the newest to the last purge.", func(s retentionStat) int64 { return s.MaxGapSeconds }},
+	}
+	for i, m := range metrics {
+		if _, err := fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for _, s := range stats {
+			if i > 0 && s.Backups == 0 {
+				continue
+			}
+			if _, err := fmt.Fprintf(out, "%s{host=%q,region=%q} %d\n", m.name, s.Host, s.Region, m.value(s)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprintf(out, "# HELP amibackup_deferred_instances Instances --max-new-gb left for a later run.\n# TYPE amibackup_deferred_instances gauge\namibackup_deferred_instances %d\n", len(summary.Deferred)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "# HELP amibackup_pipeline_retries Instance pipelines re-run by --pipeline-retries in the last run.\n# TYPE amibackup_pipeline_retries gauge\namibackup_pipeline_retries %d\n", summary.Retries)
+	return err
+}
+
+// putMetrics puts a run's metrics to CloudWatch under --cloudwatch-namespace, the retention
+// stats with Host and Region dimensions
+func putMetrics(ctx context.Context, cw *cloudwatch.Client, summary *runSummary, c *Config) error {
+	now := time.Now()
+	datums := []cwtypes.MetricDatum{{MetricName: aws.String("DeferredInstances"), Timestamp: &now,
+		Value: aws.Float64(float64(len(summary.Deferred))), Unit: cwtypes.StandardUnitCount},
+		{MetricName: aws.String("PipelineRetries"), Timestamp: &now, Value: aws.Float64(float64(summary.Retries)), Unit: cwtypes.StandardUnitCount}}
+	for _, s := range summary.Retention {
+		dimensions := []cwtypes.Dimension{{Name: aws.String("Host"), Value: aws.String(s.Host)}, {Name: aws.String("Region"), Value: aws.String(s.Region)}}
+		datums = append(datums, cwtypes.MetricDatum{MetricName: aws.String("RetainedBackups"), Dimensions: dimensions, Timestamp: &now,
+			Value: aws.Float64(float64(s.Backups)), Unit: cwtypes.StandardUnitCount})
+		if s.Backups == 0 {
+			continue
+		}
+		datums = append(datums,
+			cwtypes.MetricDatum{MetricName: aws.String("OldestBackupAge"), Dimensions: dimensions, Timestamp: &now,
+				Value: aws.Float64(float64(s.OldestAgeSeconds)), Unit: cwtypes.StandardUnitSeconds},
+			cwtypes.MetricDatum{MetricName: aws.String("MaxGap"), Dimensions: dimensions, Timestamp: &now,
+				Value: aws.Float64(float64(s.MaxGapSeconds)), Unit: cwtypes.StandardUnitSeconds})
+	}
+	for start := 0; start < len(datums); start += cloudWatchBatch {
+		end := start + cloudWatchBatch
+		if end > len(datums) {
+			end = len(datums)
+		}
+		_, err := cw.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(c.cloudWatchNamespace), MetricData: datums[start:end]})
+		if err != nil {
+			return fmt.Errorf("CloudWatch API PutMetricData failed: %s", err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package amibackup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func TestMeasureRetention(t *testing.T) {
+	now := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	records := []PurgeRecord{
+		{AmiId: "ami-1", Action: actionKeptOldest, CreatedAt: now.Add(-10 * day)},
+		{AmiId: "ami-2", Action: actionPurged, CreatedAt: now.Add(-6 * day)},
+		{AmiId: "ami-3", Action: actionWouldPurge, CreatedAt: now.Add(-5 * day)},
+		// in two windows: purged by one, kept by the other
+		{AmiId: "ami-4", Action: actionWouldPurge, CreatedAt: now.Add(-4 * day)},
+		{AmiId: "ami-4", Action: actionKeptOverlap, CreatedAt: now.Add(-4 * day)},
+		{AmiId: "ami-5", Action: actionKeptOnly, CreatedAt: now.Add(-day)},
+	}
+	want := retentionStat{Host: "web", Region: "us-east-1", Backups: 3, OldestAgeSeconds: int64((10 * day).Seconds()),
+		MaxGapSeconds: int64((6 * day).Seconds()), GapStart: "2026-02-28T00:00:00Z"}
+	if got := measureRetention("web", "us-east-1", records, now); !reflect.DeepEqual(got, want) {
+		t.Errorf("measureRetention() = %+v, want %+v", got, want)
+	}
+	if got := measureRetention("web", "us-east-1", records[1:3], now); got.Backups != 0 || got.GapStart != "" {
+		t.Errorf("measureRetention() of nothing kept = %+v", got)
+	}
+}
+
+func TestReportRetention(t *testing.T) {
+	captureLog(t)
+	c, err := parseTestOptions("-p", "1d:1d:30d", "--max-gap=2d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	day := int64((24 * time.Hour).Seconds())
+	stats := []retentionStat{
+		{Host: "web", Region: "us-west-2", Backups: 4, OldestAgeSeconds: 30 * day, MaxGapSeconds: 3 * day, GapStart: "2026-03-01T00:00:00Z"},
+		{Host: "db", Region: "us-east-1", Backups: 0},
+		{Host: "web", Region: "us-east-1", Backups: 4, OldestAgeSeconds: 30 * day, MaxGapSeconds: 2 * day, GapStart: "2026-03-01T00:00:00Z"},
+	}
+	want := []string{
+		"db in us-east-1: no retained backups",
+		"web in us-west-2: 72h0m0s without a backup after 2026-03-01T00:00:00Z (oldest backup 720h0m0s old)",
+	}
+	if got := reportRetention(stats, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("reportRetention() = %q, want %q", got, want)
+	}
+	var out bytes.Buffer
+	printGapReport(&out, want, c)
+	if !strings.HasPrefix(out.String(), "2 hosts and regions with gaps over 48h0m0s:\n  db in us-east-1") {
+		t.Errorf("gap report:\n%s", out.String())
+	}
+	out.Reset()
+	printGapReport(&out, nil, c)
+	if out.String() != "No gaps over 48h0m0s\n" {
+		t.Errorf("empty gap report: %q", out.String())
+	}
+
+	for _, args := range [][]string{{"-p", "1d:1d:30d", "--max-gap=0d", "web"}, {"-p", "1d:1d:30d", "--max-gap=soon", "web"}, {"-p", "1d:1d:30d", "--gap-report", "web"}, {"--max-gap=2d", "web"}} {
+		if _, err := parseTestOptions(args...); classOf(err, classInternal) != classConfig {
+			t.Errorf("parseOptions(%q) = %v, want a config error", args, err)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	summary := &runSummary{
+		Retention: []retentionStat{
+			{Host: "web", Region: "us-east-1", Backups: 3, OldestAgeSeconds: 864000, MaxGapSeconds: 86400},
+			{Host: "db", Region: "us-east-1"},
+		},
+		Deferred: []string{"big (i-1)"},
+		Retries:  2,
+	}
+	path := filepath.Join(t.TempDir(), "amibackup.prom")
+	if err := writeMetricsFile(path, summary); err != nil {
+		t.Fatalf("writeMetricsFile: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{
+		"# TYPE amibackup_retained_backups gauge\namibackup_retained_backups{host=\"web\",region=\"us-east-1\"} 3\namibackup_retained_backups{host=\"db\",region=\"us-east-1\"} 0\n",
+		"amibackup_oldest_backup_age_seconds{host=\"web\",region=\"us-east-1\"} 864000\n",
+		"amibackup_max_gap_seconds{host=\"web\",region=\"us-east-1\"} 86400\n",
+		"amibackup_deferred_instances 1\n",
+		"amibackup_pipeline_retries 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics file doesn't have %q:\n%s", want, got)
+		}
+	}
+	// a host without backups has only its count
+	if strings.Count(got, `host="db"`) != 1 {
+		t.Errorf("db has more than its backup count:\n%s", got)
+	}
+	// the textfile collector must be able to read it
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("metrics file mode %v, %v; want 0644", info.Mode().Perm(), err)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*")); len(leftover) > 0 {
+		t.Errorf("temporary files left behind: %v", leftover)
+	}
+}
+
+func TestPutMetrics(t *testing.T) {
+	c, err := parseTestOptions("--cloudwatch-namespace=Backups", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	summary := &runSummary{}
+	for i := 0; i < 400; i++ {
+		summary.Retention = append(summary.Retention, retentionStat{Host: "web", Region: "us-east-1", Backups: 1, OldestAgeSeconds: 60, MaxGapSeconds: 60})
+	}
+	summary.Retention = append(summary.Retention, retentionStat{Host: "db", Region: "us-east-1"})
+	f := newFakeAWS(t, map[string]fakeCall{"PutMetricData": func(interface{}) (interface{}, error) { return &cloudwatch.PutMetricDataOutput{}, nil }})
+	cw := cloudwatch.New(cloudwatch.Options{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}, APIOptions: []func(*middleware.Stack) error{f.apiOption}})
+	if err := putMetrics(context.Background(), cw, summary, c); err != nil {
+		t.Fatalf("putMetrics: %s", err)
+	}
+	// the two run totals, three for each host with backups and one for the host without
+	sizes := []int{}
+	for _, in := range f.inputs("PutMetricData") {
+		in := in.(*cloudwatch.PutMetricDataInput)
+		if aws.ToString(in.Namespace) != "Backups" {
+			t.Errorf("metrics put to namespace %q", aws.ToString(in.Namespace))
+		}
+		sizes = append(sizes, len(in.MetricData))
+	}
+	if want := []int{cloudWatchBatch, 2 + 400*3 + 1 - cloudWatchBatch}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("PutMetricData batches %v, want %v", sizes, want)
+	}
+}
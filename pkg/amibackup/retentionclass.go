@@ -0,0 +1,106 @@
+package amibackup
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// parseRetentionClass parses a --retention-class name=SPEC;SPEC..., where each SPEC is a purge
+// window (1d:4d:30d) or a retention rule (3xday, 1xweek:30d+) measured back from now
+func parseRetentionClass(arg string, now time.Time) (string, []purge.Window, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", nil, fmt.Errorf("want name=WINDOW;WINDOW...")
+	}
+	name := strings.TrimSpace(parts[0])
+	windows := []purge.Window{}
+	rules := []string{}
+	for _, spec := range strings.Split(parts[1], ";") {
+		spec = strings.TrimSpace(spec)
+		switch {
+		case spec == "":
+		case strings.Contains(spec, "x"):
+			rules = append(rules, spec)
+		default:
+			w, err := purge.ParseWindow(spec, now)
+			if err != nil {
+				return "", nil, err
+			}
+			windows = append(windows, w)
+		}
+	}
+	if len(rules) > 0 {
+		ruleWindows, err := purge.ParseRetentionPolicy(rules, now)
+		if err != nil {
+			return "", nil, err
+		}
+		windows = append(windows, ruleWindows...)
+	}
+	if len(windows) == 0 {
+		return "", nil, fmt.Errorf("class %s has no windows", name)
+	}
+	return name, windows, nil
+}
+
+// retentionClass returns the retention class an instance picks with its --retention-class-tag,
+// or "" for none or one that isn't defined
+func retentionClass(instance *types.Instance, c *Config) string {
+	class := discovery.TagValue(instance.Tags, c.retentionClassTag)
+	if _, ok := c.retentionClasses[class]; !ok {
+		return ""
+	}
+	return class
+}
+
+// retentionClassTags returns the instance's retention class tag to stamp on its backups, so
+// the purge applies that class's windows to them
+func retentionClassTags(instance *types.Instance, c *Config) []types.Tag {
+	class := retentionClass(instance, c)
+	if class == "" {
+		return nil
+	}
+	return []types.Tag{{Key: aws.String(c.retentionClassTag), Value: aws.String(class)}}
+}
+
+// imageRetentionClass returns the retention class that governs a backup: the class stamped on
+// it if that is still defined, otherwise "" for the -p windows
+func imageRetentionClass(image types.Image, c *Config) string {
+	class := discovery.TagValue(image.Tags, c.retentionClassTag)
+	if class == "" || len(c.retentionClasses) == 0 {
+		return ""
+	}
+	if _, ok := c.retentionClasses[class]; !ok {
+		log.Printf("AMI %s has retention class %s, which is not defined - purging it by the -p windows", *image.ImageId, class)
+		return ""
+	}
+	return class
+}
+
+// classWindows returns the purge windows of a retention class, "" being the -p windows
+func (c *Config) classWindows(class string) []purge.Window {
+	if class == "" {
+		return c.windows
+	}
+	return c.retentionClasses[class]
+}
+
+// classNote describes the retention class behind a purge decision, for the log
+func classNote(class string) string {
+	if class == "" {
+		return ""
+	}
+	return " [retention class " + class + "]"
+}
+
+// purging reports whether the run purges: by -p or --retention windows, retention classes or
+// --keep-count
+func (c *Config) purging() bool {
+	return len(c.windows) > 0 || len(c.retentionClasses) > 0 || c.keepCount > 0
+}
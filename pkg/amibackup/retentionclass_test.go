@@ -0,0 +1,102 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestPurgeRetentionClasses(t *testing.T) {
+	asOf := time.Date(2026, 3, 1, 1, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	classes := map[string]string{ // backup to its amibackup:retention tag
+		"gold-2": "gold", "gold-3": "gold", "gold-4": "gold",
+		// a class that isn't defined any more is purged like untagged backups
+		"platinum-5": "platinum",
+	}
+	images := backupImages("web", map[string]time.Time{
+		"plain-2": asOf.Add(-2*day - time.Hour), "plain-3": asOf.Add(-3*day - time.Hour), "plain-4": asOf.Add(-4*day - time.Hour),
+		"gold-2": asOf.Add(-2*day - 2*time.Hour), "gold-3": asOf.Add(-3*day - 2*time.Hour), "gold-4": asOf.Add(-4*day - 2*time.Hour),
+		"platinum-5": asOf.Add(-5*day - time.Hour),
+	})
+	for i, img := range images {
+		if class := classes[strings.TrimPrefix(*img.ImageId, "web-")]; class != "" {
+			images[i].Tags = append(img.Tags, types.Tag{Key: aws.String("amibackup:retention"), Value: aws.String(class)})
+		}
+	}
+	c, err := parseTestOptions("--dry-run", "--as-of="+asOf.Format(time.RFC3339), "-p", "30d:1d:60d", "--retention-class=gold=1d:1d:60d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": (&contract{Images: images}).describe})
+	records, err := purgeAMIs(context.Background(), f.Client, "us-east-1", "web", c, nil)
+	if err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+
+	purged := map[string]bool{}
+	for _, r := range records {
+		wantClass := ""
+		if classes[strings.TrimPrefix(r.AmiId, "web-")] == "gold" {
+			wantClass = "gold"
+		}
+		if r.Class != wantClass {
+			t.Errorf("%s was planned by class %q, want %q", r.AmiId, r.Class, wantClass)
+		}
+		if r.Action == actionWouldPurge {
+			purged[r.AmiId] = true
+		}
+	}
+	got := []string{}
+	for id := range purged {
+		got = append(got, id)
+	}
+	sort.Strings(got)
+	// gold keeps one a day; the rest share a 30 day bucket, keeping only the oldest
+	want := []string{"web-plain-2", "web-plain-3", "web-plain-4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("would purge %v, want %v", got, want)
+	}
+}
+
+func TestRetentionClassTags(t *testing.T) {
+	c, err := parseTestOptions("-p", "1d:4d:30d", "--retention-class=gold=1d:1d:60d;1xweek:60d+", "--retention-class=bronze=7d:1d:30d", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	tagged := func(class string) *types.Instance {
+		return &types.Instance{InstanceId: aws.String("i-1"), Tags: []types.Tag{{Key: aws.String("amibackup:retention"), Value: aws.String(class)}}}
+	}
+	if tags := retentionClassTags(tagged("gold"), c); len(tags) != 1 || aws.ToString(tags[0].Value) != "gold" {
+		t.Errorf("gold instance's backups are tagged %v", tags)
+	}
+	if tags := retentionClassTags(tagged("platinum"), c); tags != nil {
+		t.Errorf("instance of an undefined class has its backups tagged %v", tags)
+	}
+	if n := len(c.classWindows("gold")); n < 2 {
+		t.Errorf("gold has %d windows, want its window and its rule's", n)
+	}
+	if !reflect.DeepEqual(c.classWindows(""), c.windows) {
+		t.Errorf("untagged backups don't use the -p windows")
+	}
+}
+
+func TestRetentionClassOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"--retention-class=gold", "web"},
+		{"--retention-class==1d:1d:60d", "web"},
+		{"--retention-class=gold=", "web"},
+		{"--retention-class=gold=1d:nope:60d", "web"},
+		{"--retention-class=gold=1d:1d:60d", "--retention-class=gold=7d:1d:60d", "web"},
+	} {
+		if _, err := parseTestOptions(args...); classOf(err, classInternal) != classConfig || !strings.Contains(err.Error(), "retention-class") {
+			t.Errorf("parseOptions(%q) = %v, want a retention-class error", args, err)
+		}
+	}
+}
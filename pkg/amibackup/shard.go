@@ -0,0 +1,85 @@
+package amibackup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// shard is a --shard: this worker's part (1 to count) of a fleet split across count workers.
+// The zero shard is the whole fleet.
+type shard struct {
+	index int
+	count int
+}
+
+// parseShard parses a --shard, "i/n"
+func parseShard(s string) (shard, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return shard{}, fmt.Errorf("want i/n")
+	}
+	index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return shard{}, fmt.Errorf("want i/n")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || count < 1 || index < 1 || index > count {
+		return shard{}, fmt.Errorf("want i/n, with i from 1 to n")
+	}
+	return shard{index, count}, nil
+}
+
+func (s shard) String() string {
+	return fmt.Sprintf("%d/%d", s.index, s.count)
+}
+
+// shardOf is the shard (1 to count) a key belongs to.  It hashes the key alone with FNV-1a, so
+// every worker agrees whatever order AWS lists things in, and whatever Go version built it.
+func shardOf(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(count)) + 1
+}
+
+// owns reports whether this shard has the key
+func (s shard) owns(key string) bool {
+	return s.count <= 1 || shardOf(key, s.count) == s.index
+}
+
+// shardInstances keeps the instances this shard backs up, by instance ID, logging the rest
+func shardInstances(instances []*types.Instance, instanceNameTag string, s shard) []*types.Instance {
+	if s.count <= 1 {
+		return instances
+	}
+	owned := []*types.Instance{}
+	for _, instance := range instances {
+		if s.owns(*instance.InstanceId) {
+			owned = append(owned, instance)
+		} else {
+			log.Printf("Skipping %s (%s) - it belongs to shard %d/%d", instanceNameTag, *instance.InstanceId, shardOf(*instance.InstanceId, s.count), s.count)
+		}
+	}
+	return owned
+}
+
+// shardHosts returns the instance name tags whose backups this shard purges, reconciles and
+// resumes, by hostname - so case variants of one name, which share backups, share a shard
+func shardHosts(c *Config) []string {
+	if c.shard.count <= 1 {
+		return c.instanceNameTags
+	}
+	owned := []string{}
+	for _, instanceNameTag := range c.instanceNameTags {
+		if hostname := c.hostname(instanceNameTag); c.shard.owns(hostname) {
+			owned = append(owned, instanceNameTag)
+		} else {
+			log.Printf("Leaving the old backups of %s to shard %d/%d", instanceNameTag, shardOf(hostname, c.shard.count), c.shard.count)
+		}
+	}
+	return owned
+}
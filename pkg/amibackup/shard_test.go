@@ -0,0 +1,84 @@
+package amibackup
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestShardOfPinned(t *testing.T) {
+	// workers built at different times must agree, so the hash can never change
+	tests := []struct {
+		key   string
+		count int
+		want  int
+	}{
+		{"i-0123456789abcdef0", 4, 2},
+		{"i-0123456789abcdef0", 7, 5},
+		{"i-0fedcba9876543210", 7, 6},
+		{"web-01", 4, 4},
+		{"db", 7, 4},
+	}
+	for _, tt := range tests {
+		if got := shardOf(tt.key, tt.count); got != tt.want {
+			t.Errorf("shardOf(%s, %d) = %d, want %d", tt.key, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestShardInstancesPartition(t *testing.T) {
+	instances := []*types.Instance{}
+	for i := 0; i < 200; i++ {
+		instances = append(instances, &types.Instance{InstanceId: aws.String(fmt.Sprintf("i-%017x", i*7919))})
+	}
+	const workers = 5
+	claimed := map[string]int{}
+	for index := 1; index <= workers; index++ {
+		s := shard{index, workers}
+		owned := shardInstances(instances, "web", s)
+		// another worker gets the instances in another order
+		shuffled := append([]*types.Instance{}, instances...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if again := shardInstances(shuffled, "web", s); len(again) != len(owned) {
+			t.Errorf("shard %s claimed %d instances, then %d listed in another order", s, len(owned), len(again))
+		}
+		for _, instance := range owned {
+			claimed[*instance.InstanceId]++
+		}
+	}
+	for _, instance := range instances {
+		if n := claimed[*instance.InstanceId]; n != 1 {
+			t.Errorf("%s claimed by %d shards, want 1", *instance.InstanceId, n)
+		}
+	}
+}
+
+func TestShardHostsPartition(t *testing.T) {
+	hosts := []string{"web-01", "Web-01", "web-02", "db", "DB", "cache", "queue", "api-01", "api-02", "api-03"}
+	const workers = 3
+	claimed := map[string][]string{} // hostname to the shards purging it
+	for index := 1; index <= workers; index++ {
+		args := []string{fmt.Sprintf("--shard=%d/%d", index, workers), "--normalize=lower"}
+		c, err := parseTestOptions(append(args, hosts...)...)
+		if err != nil {
+			t.Fatalf("parseOptions: %s", err)
+		}
+		for _, instanceNameTag := range shardHosts(c) {
+			hostname := c.hostname(instanceNameTag)
+			claimed[hostname] = append(claimed[hostname], c.shard.String())
+		}
+	}
+	for _, hostname := range []string{"web-01", "web-02", "db", "cache", "queue", "api-01", "api-02", "api-03"} {
+		shards := map[string]bool{}
+		for _, s := range claimed[hostname] {
+			shards[s] = true
+		}
+		// Web-01 and web-01 share backups, so one shard has both
+		if len(shards) != 1 {
+			t.Errorf("%s purged by shards %v, want exactly one", hostname, claimed[hostname])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package amibackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// summaryS3Attempts is how many times the summary upload is tried before giving up
+const summaryS3Attempts = 3
+
+// summaryS3Backoff is the wait before the first retry of the summary upload, doubling after
+var summaryS3Backoff = 2 * time.Second
+
+// summaryS3Features lists the IAM features --summary-s3 needs, for iamFeatures: every mode but
+// --simulate uploads its summary
+func summaryS3Features(c *Config) []string {
+	switch {
+	case c.summaryS3Bucket == "" || c.simulate != "":
+		return nil
+	case c.summaryS3KMS != "":
+		return []string{"summary-s3", "summary-s3-kms"}
+	}
+	return []string{"summary-s3"}
+}
+
+// parseS3URL splits an s3://bucket/prefix URL into its bucket and prefix, without slashes at
+// either end of the prefix
+func parseS3URL(s3url string) (string, string, error) {
+	if !strings.HasPrefix(s3url, "s3://") {
+		return "", "", fmt.Errorf("%s doesn't start with s3://", s3url)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s3url, "s3://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("%s has no bucket", s3url)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], strings.Trim(parts[1], "/"), nil
+}
+
+// summaryKey returns the object key of a run's summary under a prefix, partitioned Hive-style
+// by the day the run started in UTC so Athena can prune by date
+func summaryKey(prefix, runID string, started time.Time) string {
+	started = started.UTC()
+	key := fmt.Sprintf("year=%04d/month=%02d/day=%02d/run-%s.json.gz", started.Year(), started.Month(), started.Day(), runID)
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// gzipSummary returns a run summary as gzip'd JSON
+func gzipSummary(summary *runSummary) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(summary); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadSummary uploads a finished run's summary for --summary-s3, retrying a failed upload a
+// few times.  The run's own clients are gone by now, so it makes its own.  Failing to upload is
+// logged, never fatal - the backups are what matter.
+func uploadSummary(ctx context.Context, summary *runSummary, c *Config) {
+	key := summaryKey(c.summaryS3Prefix, summary.RunID, runStart)
+	if c.dryRun {
+		log.Printf("DRYRUN: would have uploaded the run summary to s3://%s/%s", c.summaryS3Bucket, key)
+		return
+	}
+	body, err := gzipSummary(summary)
+	if err != nil {
+		log.Printf("WARNING: can't upload the run summary: %s", err.Error())
+		return
+	}
+	clients, err := newClientPool(ctx, c.endpointURL, summary.RunID)
+	if err != nil {
+		log.Printf("WARNING: can't upload the run summary: %s", err.Error())
+		return
+	}
+	if err := putSummary(ctx, clients.S3(c.sourceRegion, ""), key, body, c); err != nil {
+		log.Printf("WARNING: giving up uploading the run summary to s3://%s/%s after %d attempts: %s", c.summaryS3Bucket, key, summaryS3Attempts, err.Error())
+		return
+	}
+	log.Printf("Uploaded the run summary to s3://%s/%s", c.summaryS3Bucket, key)
+}
+
+// putSummary puts the gzip'd summary at key, backing off between attempts
+func putSummary(ctx context.Context, awss3 *s3.Client, key string, body []byte, c *Config) error {
+	input := &s3.PutObjectInput{
+		Bucket:          aws.String(c.summaryS3Bucket),
+		Key:             aws.String(key),
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+		ContentLength:   aws.Int64(int64(len(body))),
+	}
+	if c.summaryS3KMS != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(c.summaryS3KMS)
+	}
+	backoff := summaryS3Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		input.Body = bytes.NewReader(body)
+		if _, err = awss3.PutObject(ctx, input); err == nil || attempt == summaryS3Attempts {
+			break
+		}
+		log.Printf("S3 API PutObject failed for the run summary - retrying in %s (attempt %d of %d): %s", backoff, attempt, summaryS3Attempts, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		return fmt.Errorf("S3 API PutObject failed: %s", err.Error())
+	}
+	return nil
+}
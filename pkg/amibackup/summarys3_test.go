@@ -0,0 +1,89 @@
+package amibackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestSummaryKey(t *testing.T) {
+	// late on the 31st in Denver is the 1st in UTC
+	denver := time.FixedZone("MST", -7*60*60)
+	tests := []struct {
+		prefix  string
+		started time.Time
+		want    string
+	}{
+		{"amibackup", time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC), "amibackup/year=2026/month=03/day=09/run-r1.json.gz"},
+		{"", time.Date(2026, 3, 9, 12, 0, 0, 0, time.UTC), "year=2026/month=03/day=09/run-r1.json.gz"},
+		{"lake/amibackup", time.Date(2026, 12, 31, 20, 0, 0, 0, denver), "lake/amibackup/year=2027/month=01/day=01/run-r1.json.gz"},
+	}
+	for _, tt := range tests {
+		if got := summaryKey(tt.prefix, "r1", tt.started); got != tt.want {
+			t.Errorf("summaryKey(%q, r1, %s) = %s, want %s", tt.prefix, tt.started, got, tt.want)
+		}
+	}
+}
+
+func TestUploadSummary(t *testing.T) {
+	backoff := summaryS3Backoff
+	summaryS3Backoff = time.Millisecond
+	t.Cleanup(func() { summaryS3Backoff = backoff })
+
+	f := newFakeAWS(t, map[string]fakeCall{
+		"PutObject": script(
+			func(interface{}) (interface{}, error) { return nil, apiError("SlowDown") },
+			func(interface{}) (interface{}, error) { return nil, apiError("InternalError") },
+			func(interface{}) (interface{}, error) { return &s3.PutObjectOutput{}, nil },
+		),
+	})
+	fakeClients(t, f)
+	c, err := parseTestOptions("--summary-s3=s3://lake/amibackup/", "--summary-s3-kms=alias/lake", "web")
+	if err != nil {
+		t.Fatalf("parseOptions: %s", err)
+	}
+	summary := &runSummary{RunID: c.runID, Backups: []backupResult{{Instance: "web", SourceAMI: "ami-source"}}}
+
+	uploadSummary(context.Background(), summary, c)
+	puts := f.inputs("PutObject")
+	if len(puts) != summaryS3Attempts {
+		t.Fatalf("PutObject called %d times, want %d", len(puts), summaryS3Attempts)
+	}
+	put := puts[len(puts)-1].(*s3.PutObjectInput)
+	if key := aws.ToString(put.Key); aws.ToString(put.Bucket) != "lake" || key != summaryKey("amibackup", c.runID, runStart) {
+		t.Errorf("uploaded to s3://%s/%s, want s3://lake/%s", aws.ToString(put.Bucket), key, summaryKey("amibackup", c.runID, runStart))
+	}
+	if aws.ToString(put.ContentType) != "application/json" || aws.ToString(put.ContentEncoding) != "gzip" {
+		t.Errorf("uploaded as %s encoded %s, want gzip'd application/json", aws.ToString(put.ContentType), aws.ToString(put.ContentEncoding))
+	}
+	if put.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(put.SSEKMSKeyId) != "alias/lake" {
+		t.Errorf("uploaded with %s key %s, want aws:kms with alias/lake", put.ServerSideEncryption, aws.ToString(put.SSEKMSKeyId))
+	}
+	// each attempt sends the whole body again
+	body, err := io.ReadAll(put.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != aws.ToInt64(put.ContentLength) {
+		t.Errorf("last attempt sent %d bytes, want %d", len(body), aws.ToInt64(put.ContentLength))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("summary isn't gzip'd: %s", err)
+	}
+	var uploaded runSummary
+	if err := json.NewDecoder(zr).Decode(&uploaded); err != nil {
+		t.Fatalf("summary isn't JSON: %s", err)
+	}
+	if uploaded.RunID != c.runID || len(uploaded.Backups) != 1 || uploaded.Backups[0].SourceAMI != "ami-source" {
+		t.Errorf("uploaded summary %+v, want the run's", uploaded)
+	}
+}
@@ -0,0 +1,98 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracing for amibackup runs. Until setupTracing is called the
+// global tracer is a no-op, so the spans around each phase cost nothing.
+
+var tracer = otel.Tracer("amibackup")
+
+// shutdownTracing flushes any buffered spans - replaced by setupTracing
+var shutdownTracing = func() {}
+
+// setupTracing exports spans to an OTLP collector: http(s)://host:port[/path] or grpc(s)://host:port
+func setupTracing(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Invalid otel endpoint %s: %s", endpoint, err.Error())
+	}
+	ctx := context.Background()
+	var exporter *otlptrace.Exporter
+	switch u.Scheme {
+	case "http", "https":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+		if u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+		}
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "grpc", "grpcs":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(u.Host)}
+		if u.Scheme == "grpc" {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return fmt.Errorf("Invalid otel endpoint %s: scheme must be http, https, grpc or grpcs", endpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating otel exporter: %s", err.Error())
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "amibackup"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	shutdownTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Error flushing traces: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// snapshotAttributes describes an image's snapshots for its span: how many, and their volumes' total size
+func snapshotAttributes(image types.Image) []attribute.KeyValue {
+	count, sizeGB := 0, int64(0)
+	for _, bd := range image.BlockDeviceMappings {
+		if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+			count++
+			sizeGB += int64(aws.ToInt32(bd.Ebs.VolumeSize))
+		}
+	}
+	return []attribute.KeyValue{attribute.Int("ami.snapshots", count), attribute.Int64("ami.size_gb", sizeGB)}
+}
+
+// endSpan marks a span failed if err is set, then ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
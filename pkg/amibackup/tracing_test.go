@@ -0,0 +1,59 @@
+package amibackup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWaitSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	fastPolls(t)
+	img := image("ami-wait", "snap-1", "snap-2")
+	img.BlockDeviceMappings[0].Ebs.VolumeSize = aws.Int32(8)
+	img.BlockDeviceMappings[1].Ebs.VolumeSize = aws.Int32(100)
+	f := newFakeEC2(t, map[string]fakeCall{"DescribeImages": imageIn(img, "available")})
+	c := &Config{notFoundGrace: time.Minute, pollStaleLimit: time.Minute}
+
+	ctx, parent := tracer.Start(context.Background(), "create")
+	if err := waitForAMI(ctx, f.Client, "ami-wait", "web", "i-1", false, c); err != nil {
+		t.Fatalf("waitForAMI: %s", err)
+	}
+	parent.End()
+
+	var wait sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "wait" {
+			wait = span
+		}
+	}
+	if wait == nil {
+		t.Fatalf("no wait span")
+	}
+	if wait.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("the wait span isn't a child of the create span")
+	}
+	want := map[attribute.Key]attribute.Value{
+		"ami.id":        attribute.StringValue("ami-wait"),
+		"ami.snapshots": attribute.IntValue(2),
+		"ami.size_gb":   attribute.Int64Value(108),
+	}
+	for _, kv := range wait.Attributes() {
+		if v, ok := want[kv.Key]; ok {
+			if v != kv.Value {
+				t.Errorf("%s = %v, want %v", kv.Key, kv.Value.Emit(), v.Emit())
+			}
+			delete(want, kv.Key)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("wait span lacks %v", want)
+	}
+}
@@ -0,0 +1,51 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/backup"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// startVaultBackup starts an AWS Backup job for an instance into --backup-vault, once its AMI is
+// available, so the backup also shows up in the vault, tagged like the AMI.  AWS Backup can't
+// adopt an AMI made elsewhere as a recovery point, so the job images the instance itself; the
+// amibackup AMI and its copies carry on regardless.  The job is started, not waited for - its
+// progress is in the AWS Backup console.  Returns the backup job ID.
+func startVaultBackup(ctx context.Context, awsbackup *backup.Client, instance *types.Instance, c *Config, instanceNameTag string) (string, error) {
+	resource := fmt.Sprintf("arn:aws:ec2:%s:%s:instance/%s", c.sourceRegion, c.accountID, *instance.InstanceId)
+	tags := map[string]string{}
+	for _, tag := range backupTags(instance, c, instanceNameTag) {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if c.dryRun {
+		keys := []string{}
+		for key, value := range tags {
+			keys = append(keys, key+"="+value)
+		}
+		sort.Strings(keys)
+		log.Printf("DRYRUN: would have called AWS Backup StartBackupJob for %s into vault %s as %s, tagged %s", resource, c.backupVault, c.backupRoleArn, strings.Join(keys, ", "))
+		return "", nil
+	}
+	if c.accountID == "" {
+		return "", fmt.Errorf("the AWS account is unknown, so the instance ARN can't be built")
+	}
+	resp, err := awsbackup.StartBackupJob(ctx, &backup.StartBackupJobInput{
+		BackupVaultName:   aws.String(c.backupVault),
+		IamRoleArn:        aws.String(c.backupRoleArn),
+		ResourceArn:       aws.String(resource),
+		IdempotencyToken:  aws.String(c.runID + "-" + *instance.InstanceId),
+		RecoveryPointTags: tags,
+	})
+	if err != nil {
+		return "", fmt.Errorf("AWS Backup API StartBackupJob failed: %s", err.Error())
+	}
+	jobId := aws.ToString(resp.BackupJobId)
+	log.Printf("Started AWS Backup job %s for %s into vault %s", jobId, instanceNameTag, c.backupVault)
+	return jobId, nil
+}
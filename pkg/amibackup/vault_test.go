@@ -0,0 +1,81 @@
+package amibackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/backup"
+)
+
+func TestBackupVault(t *testing.T) {
+	fastPolls(t)
+	role := "arn:aws:iam::123456789012:role/backup"
+	tests := []struct {
+		name      string
+		startErr  string // StartBackupJob's error code, "" to start the job
+		wantJob   string
+		wantError bool
+	}{
+		{"started", "", "job-1", false},
+		// the vault job failing to start never fails the AMI backup
+		{"not started", "AccessDeniedException", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := runFake(t, map[string]func(fakeCall) fakeCall{
+				"StartBackupJob": func(fakeCall) fakeCall {
+					return func(interface{}) (interface{}, error) {
+						if tt.startErr != "" {
+							return nil, apiError(tt.startErr)
+						}
+						return &backup.StartBackupJobOutput{BackupJobId: aws.String("job-1")}, nil
+					}
+				},
+			}, "web")
+			c, err := parseTestOptions("--source=us-east-1", "--dest=us-west-2", "--timeout=10m", "--freeze-parameter=none",
+				"--no-reconcile", "--no-progress", "--backup-vault=Default", "--backup-role-arn="+role, "web")
+			if err != nil {
+				t.Fatalf("parseOptions: %s", err)
+			}
+			summary, err := run(context.Background(), c)
+			summary.setOutcome(err)
+			if summary.Status != statusSuccess || len(summary.Backups) != 1 {
+				t.Fatalf("run ended %s with %d backups (%v), want a success", summary.Status, len(summary.Backups), err)
+			}
+			result := summary.Backups[0]
+			if result.VaultJob != tt.wantJob || (result.VaultError != "") != tt.wantError {
+				t.Errorf("vault job %q, error %q; want job %q, an error %v", result.VaultJob, result.VaultError, tt.wantJob, tt.wantError)
+			}
+			if failed := len(summary.VaultFailed) > 0; failed != tt.wantError {
+				t.Errorf("vault_failed = %v, want it set %v", summary.VaultFailed, tt.wantError)
+			}
+
+			inputs := f.inputs("StartBackupJob")
+			if len(inputs) != 1 {
+				t.Fatalf("%d StartBackupJob calls, want 1", len(inputs))
+			}
+			in := inputs[0].(*backup.StartBackupJobInput)
+			want := backup.StartBackupJobInput{
+				BackupVaultName:  aws.String("Default"),
+				IamRoleArn:       aws.String(role),
+				ResourceArn:      aws.String("arn:aws:ec2:us-east-1:123456789012:instance/i-00000000000000001"),
+				IdempotencyToken: aws.String(c.runID + "-i-00000000000000001"),
+			}
+			got := *in
+			got.RecoveryPointTags = nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("StartBackupJob(%+v), want %+v", got, want)
+			}
+			// the recovery point is tagged like the AMI
+			if in.RecoveryPointTags["hostname"] != "web" || in.RecoveryPointTags["instance"] != "i-00000000000000001" {
+				t.Errorf("recovery point tagged %v, want the AMI's tags", in.RecoveryPointTags)
+			}
+		})
+	}
+
+	if _, err := parseTestOptions("--backup-vault=Default", "web"); classOf(err, classInternal) != classConfig {
+		t.Errorf("--backup-vault without --backup-role-arn = %v, want a config error", err)
+	}
+}
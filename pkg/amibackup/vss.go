@@ -0,0 +1,102 @@
+package amibackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// vssDocument is the SSM document that takes VSS application-consistent snapshots of a Windows
+// instance, and can make an AMI of them
+const vssDocument = "AWSEC2-CreateVssSnapshot"
+
+// how backups were taken, as recorded in the summary
+const (
+	methodCreateImage = "create-image"
+	methodVSS         = "vss"
+)
+
+// vssUnavailable is why VSS can't back an instance up - it gets a NoReboot image instead
+type vssUnavailable struct{ reason string }
+
+func (e vssUnavailable) Error() string { return e.reason }
+
+// isWindows reports whether an instance runs Windows
+func isWindows(instance *types.Instance) bool {
+	return instance.Platform == types.PlatformValuesWindows
+}
+
+// createVSSAMI backs a Windows instance up with VSS, for --windows-policy=vss.  The SSM document
+// snapshots the volumes with the VSS writers quiesced and creates the AMI under our usual name,
+// which is how we find it again.  The document creates the image, rather than us registering one
+// from its snapshots, because a Windows AMI registered from snapshots loses its Windows platform
+// and licensing.  A vssUnavailable error means the backup should fall back to createAMI.
+func createVSSAMI(ctx context.Context, awsec2 *ec2.Client, awsssm *ssm.Client, instance *types.Instance, c *Config, instanceNameTag string) (string, error) {
+	for _, bd := range instance.BlockDeviceMappings {
+		device := aws.ToString(bd.DeviceName)
+		if stringIn(device, c.ignoreVolumes) || len(c.onlyDevices) > 0 && !stringIn(device, c.onlyDevices) {
+			return "", vssUnavailable{fmt.Sprintf("%s can't leave out the volume at %s", vssDocument, device)}
+		}
+	}
+	backupAmiName := fmt.Sprintf("%s-%s-%s", amiNamePrefix(instanceNameTag), timeStamp, *instance.InstanceId)
+	backupDesc, err := c.description(instanceNameTag, timeString, *instance.InstanceId, instance)
+	if err != nil {
+		return "", err
+	}
+	if c.dryRun {
+		log.Printf("DRYRUN: would have run %s on %s (%s) to create a VSS AMI", vssDocument, instanceNameTag, *instance.InstanceId)
+		params := &ec2.CreateImageInput{InstanceId: instance.InstanceId, Name: aws.String(backupAmiName), Description: aws.String(backupDesc), NoReboot: aws.Bool(true), TagSpecifications: inProgressTags(c)}
+		return "", c.plan.addCreate(ctx, awsec2, instance, instanceNameTag, methodVSS, params, c)
+	}
+
+	// a resumed run may find the AMI already made
+	newAMI, err := findAMIByName(ctx, awsec2, backupAmiName)
+	if err != nil {
+		return "", err
+	}
+	if newAMI != "" {
+		log.Printf("VSS AMI %s already exists as %s - resuming it", backupAmiName, newAMI)
+		return finishAMI(ctx, awsec2, instance, c, instanceNameTag, newAMI)
+	}
+
+	send, err := awsssm.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String(vssDocument),
+		InstanceIds:  []string{*instance.InstanceId},
+		Comment:      aws.String("amibackup " + c.runID),
+		Parameters: map[string][]string{
+			"ExcludeBootVolume": {"False"},
+			"CreateAmi":         {"True"},
+			"AmiName":           {backupAmiName},
+			"description":       {backupDesc},
+			"tags":              {fmt.Sprintf("Key=%s,Value=%s;Key=%s,Value=%s", c.tagKey("hostname"), c.hostname(instanceNameTag), inProgressTag, c.runID)},
+		},
+	})
+	if err != nil {
+		// InvalidInstanceId is how SSM says the agent isn't running or registered
+		return "", vssUnavailable{fmt.Sprintf("SSM API SendCommand failed: %s", err.Error())}
+	}
+	commandId := aws.ToString(send.Command.CommandId)
+	log.Printf("Creating VSS AMI for %s (%s) with SSM command %s", instanceNameTag, *instance.InstanceId, commandId)
+	if err := waitForCommand(ctx, awsssm, vssDocument, commandId, *instance.InstanceId); err != nil {
+		if failed, ok := err.(commandFailed); ok {
+			// e.g. no VSS components - nothing was snapshotted
+			return "", vssUnavailable{failed.Error()}
+		}
+		return "", err
+	}
+
+	newAMI, err = findAMIByName(ctx, awsec2, backupAmiName)
+	if err != nil {
+		return "", err
+	}
+	if newAMI == "" {
+		return "", fmt.Errorf("%s finished on %s but there is no AMI named %s", vssDocument, *instance.InstanceId, backupAmiName)
+	}
+	log.Printf("Creating new VSS AMI %s for %s (%s)", newAMI, instanceNameTag, *instance.InstanceId)
+	return finishAMI(ctx, awsec2, instance, c, instanceNameTag, newAMI)
+}
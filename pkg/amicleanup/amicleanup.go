@@ -0,0 +1,371 @@
+package amicleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/docopt/docopt-go"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const version = "0.1"
+
+var usage = `amicleanup: clean up old AWS AMI backups and snapshots
+
+Usage:
+  amicleanup [options] <ami_name_regex>
+  amicleanup -h --help
+  amicleanup --version
+
+Options:
+  -r, --region=<region>     AWS region of running instance [default: us-east-1].
+  -d, --dry-run             Show what would be purged without purging it.
+  --include-snapshots       Also delete snapshots whose description matches the regex and that no registered AMI uses.
+  --account-id=<id>         AWS account that owns the snapshots, for --include-snapshots.
+  --in-progress-stale=<t>   Purge AMIs an amibackup run still has tagged amibackup:in-progress
+                            only once the run started longer ago than this [default: 24h].
+  --debug                   Also log benign details, such as deletes that raced with a concurrent run.
+  -K, --awskey=<keyid>      AWS key ID (or use AWS_ACCESS_KEY_ID environemnt variable).
+  -S, --awssecret=<secret>  AWS secret key (or use AWS_SECRET_ACCESS_KEY environemnt variable).
+  --version                 Show version.
+  -h, --help                Show this screen.
+
+AWS Authentication:
+  Either use the -K and -S flags, or
+  set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+
+`
+
+type session struct {
+	dryRun             bool
+	includeSnapshots   bool
+	accountid          string
+	inProgressStale    time.Duration
+	debug              bool
+	races              int // deregisters and deletes a concurrent run had already done
+	nameRegex          string
+	region             string
+	cfg                aws.Config
+	awsAccessKeyId     string
+	awsSecretAccessKey string
+}
+
+// time formatting
+var timeSecs = fmt.Sprintf("%d", time.Now().Unix())
+var timeStamp = time.Now().Format("2006-01-02_15-04-05")
+var timeShortFormat = "01/02/2006@15:04:05"
+var timeString = time.Now().Format("2006-01-02 15:04:05 -0700")
+
+// Main runs amicleanup with the given command line arguments (without the program name)
+func Main(args []string) {
+	s := &session{}
+
+	handleOptions(s, args)
+	ctx := context.Background()
+
+	// connect to AWS
+	awsec2 := ec2.NewFromConfig(s.cfg, func(o *ec2.Options) {
+		o.Region = s.region
+	})
+
+	// standalone snapshots first - a dry run stops after listing the AMIs
+	if s.includeSnapshots {
+		if err := purgeSnapshots(ctx, awsec2, s); err != nil {
+			log.Printf("Error purging snapshots: %s", err.Error())
+		}
+	}
+
+	// purge old AMIs and snapshots
+	err := purgeAMIs(ctx, awsec2, s)
+	if err != nil {
+		log.Printf("Error purging old AMIs: %s", err.Error())
+	}
+	if s.races > 0 {
+		log.Printf("%d deregisters and deletes raced with a concurrent run and were already done", s.races)
+	}
+	log.Printf("Finished puring AMIs and snapshots - exiting")
+}
+
+// findSnapshots returns a map of snapshots associated with an AMI
+func findSnapshots(ctx context.Context, amiid string, awsec2 *ec2.Client) (map[string]string, error) {
+	snaps := make(map[string]string)
+	resp, err := awsec2.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiid}})
+	if err != nil {
+		return snaps, fmt.Errorf("EC2 API DescribeImages failed: %w", err)
+	}
+	for _, image := range resp.Images {
+		for id, device := range imageSnapshots(image) {
+			snaps[id] = device
+		}
+	}
+	return snaps, nil
+}
+
+// imageSnapshots returns an image's snapshots, to the devices they back
+func imageSnapshots(image types.Image) map[string]string {
+	snaps := map[string]string{}
+	for _, bd := range image.BlockDeviceMappings {
+		if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+			snaps[*bd.Ebs.SnapshotId] = aws.ToString(bd.DeviceName)
+		}
+	}
+	return snaps
+}
+
+// describeImages runs DescribeImages through every page of results
+func describeImages(ctx context.Context, awsec2 *ec2.Client, input *ec2.DescribeImagesInput) ([]types.Image, error) {
+	images := []types.Image{}
+	pages := ec2.NewDescribeImagesPaginator(awsec2, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+		}
+		images = append(images, page.Images...)
+	}
+	return images, nil
+}
+
+// purgeAMIs purges AMIs based on name regex
+func purgeAMIs(ctx context.Context, awsec2 *ec2.Client, s *session) error {
+	imageList, err := describeImages(ctx, awsec2, &ec2.DescribeImagesInput{
+		Filters: []types.Filter{{Name: aws.String("is-public"), Values: []string{"false"}}},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d total images in %s", len(imageList), s.region)
+	images := map[string]int{}
+	r, err := regexp.Compile(s.nameRegex)
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	for _, image := range imageList {
+		if r.MatchString(aws.ToString(image.Name)) {
+			if runID, ok := inFlight(image, s); ok {
+				log.Printf("Skipping in-progress AMI %s (run %s)", aws.ToString(image.ImageId), runID)
+				skipped++
+				continue
+			}
+			log.Printf("Found: %s", aws.ToString(image.Name))
+			images[aws.ToString(image.ImageId)] = 0
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d matching images an amibackup run is still working on", skipped)
+	}
+	log.Printf("Found %d matching images in %s", len(images), s.region)
+	if s.dryRun {
+		log.Fatal("dryrun")
+	}
+	for id, _ := range images {
+		// find snapshots associated with this AMI.
+		snaps, err := findSnapshots(ctx, id, awsec2)
+		if raced(err, "DescribeImages", id, s) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("EC2 API findSnapshots failed for %s: %s", id, err.Error())
+		}
+		// deregister the AMI.
+		_, err = awsec2.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(id)})
+		switch {
+		case raced(err, "DeregisterImage", id, s):
+			// gone already - its snapshots may not be
+		case err != nil:
+			log.Printf("EC2 API DeregisterImage failed for %s: %s", id, err.Error())
+			time.Sleep(time.Second * 3)
+			continue
+		}
+		// delete snapshots associated with this AMI.
+		for snap, _ := range snaps {
+			_, err := awsec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snap)})
+			if raced(err, "DeleteSnapshot", snap, s) {
+				continue
+			}
+			if err != nil {
+				log.Printf("EC2 API DeleteSnapshot failed for %s: %s", snap, err.Error())
+				time.Sleep(time.Second * 3)
+				continue
+			}
+			log.Printf("Deleted snapshot: %s (%s)", snap, id)
+		}
+		log.Printf("Purged old AMI %s", id)
+	}
+	return nil
+}
+
+// inFlight returns the amibackup run still working on an image: the run ID in its
+// amibackup:in-progress tag, if that run started less than --in-progress-stale ago.  Run IDs
+// start with the run's local start time, like amibackup's AMI names.
+func inFlight(image types.Image, s *session) (string, bool) {
+	for _, tag := range image.Tags {
+		if aws.ToString(tag.Key) != "amibackup:in-progress" {
+			continue
+		}
+		value := aws.ToString(tag.Value)
+		if len(value) < 19 {
+			return "", false
+		}
+		started, err := time.ParseInLocation("2006-01-02_15-04-05", value[:19], time.Local)
+		if err != nil {
+			return "", false
+		}
+		return value, time.Since(started) < s.inProgressStale
+	}
+	return "", false
+}
+
+// purgeSnapshots deletes the account's snapshots whose descriptions match the regex, sparing
+// any snapshot a registered AMI still uses whatever its description
+func purgeSnapshots(ctx context.Context, awsec2 *ec2.Client, s *session) error {
+	r, err := regexp.Compile(s.nameRegex)
+	if err != nil {
+		return err
+	}
+	images, err := describeImages(ctx, awsec2, &ec2.DescribeImagesInput{Owners: []string{"self"}})
+	if err != nil {
+		return err
+	}
+	inUse := map[string]bool{}
+	for _, image := range images {
+		for id := range imageSnapshots(image) {
+			inUse[id] = true
+		}
+	}
+	snaps := []types.Snapshot{}
+	pages := ec2.NewDescribeSnapshotsPaginator(awsec2, &ec2.DescribeSnapshotsInput{
+		Filters: []types.Filter{{Name: aws.String("owner-id"), Values: []string{s.accountid}}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+		}
+		snaps = append(snaps, page.Snapshots...)
+	}
+	matched := 0
+	for _, snap := range snaps {
+		id, description := aws.ToString(snap.SnapshotId), aws.ToString(snap.Description)
+		if !r.MatchString(description) {
+			continue
+		}
+		matched++
+		if inUse[id] {
+			log.Printf("Keeping snapshot %s (%s): a registered AMI uses it", id, description)
+			continue
+		}
+		if s.dryRun {
+			log.Printf("DRYRUN: would have deleted snapshot: %s (%s)", id, description)
+			continue
+		}
+		if _, err := awsec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(id)}); err != nil && !raced(err, "DeleteSnapshot", id, s) {
+			log.Printf("EC2 API DeleteSnapshot failed for %s: %s", id, err.Error())
+			time.Sleep(time.Second * 3)
+			continue
+		}
+		log.Printf("Deleted snapshot: %s (%s)", id, description)
+	}
+	log.Printf("Found %d matching snapshots of %d in %s, checked against %d AMIs", matched, len(snaps), s.region, len(images))
+	return nil
+}
+
+// raceCodes are the error codes of a call that lost a race with a concurrent run - an amibackup
+// purge or another cleanup that got to the image or snapshot first - which already did our work
+var raceCodes = map[string]bool{
+	"InvalidAMIID.Unavailable":   true,
+	"InvalidAMIID.NotFound":      true,
+	"InvalidSnapshot.NotFound":   true,
+	"InvalidSnapshotID.NotFound": true,
+}
+
+// raced reports whether a call failed only because a concurrent run got there first, counting
+// it and logging it with --debug
+func raced(err error, call, resource string, s *session) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || !raceCodes[apiErr.ErrorCode()] {
+		return false
+	}
+	s.races++
+	if s.debug {
+		log.Printf("DEBUG: %s on %s raced with concurrent run (%s) - counting it as done", call, resource, apiErr.ErrorCode())
+	}
+	return true
+}
+
+// daysToHours is a helper to support 2d notation
+func daysToHours(in string) (string, error) {
+	r, err := regexp.Compile(`^(\d+)d$`)
+	if err != nil {
+		return in, err
+	}
+	m := r.FindStringSubmatch(in)
+	if len(m) > 0 {
+		num, err := strconv.Atoi(m[1])
+		if err != nil {
+			return in, err
+		}
+		return fmt.Sprintf("%dh", num*24), nil
+	}
+	return in, nil
+}
+
+// handleOptions parses CLI options
+func handleOptions(s *session, args []string) {
+	arguments, err := docopt.Parse(usage, args, true, version, false)
+	if err != nil {
+		log.Fatalf("Error parsing arguments: %s", err.Error())
+	}
+	s.nameRegex = arguments["<ami_name_regex>"].(string)
+	s.region = arguments["--region"].(string)
+	if arguments["--dry-run"].(bool) {
+		s.dryRun = true
+	}
+	s.debug = arguments["--debug"].(bool)
+	s.includeSnapshots = arguments["--include-snapshots"].(bool)
+	if arg, ok := arguments["--account-id"].(string); ok {
+		s.accountid = arg
+	}
+	if s.includeSnapshots && s.accountid == "" {
+		log.Fatalf("--include-snapshots needs --account-id")
+	}
+	stale, err := daysToHours(arguments["--in-progress-stale"].(string))
+	if err != nil {
+		log.Fatalf("Bad in-progress-stale: %s", err.Error())
+	}
+	if s.inProgressStale, err = time.ParseDuration(stale); err != nil {
+		log.Fatalf("Bad in-progress-stale: %s", err.Error())
+	}
+	if arg, ok := arguments["--awskey"].(string); ok {
+		s.awsAccessKeyId = arg
+	}
+	if arg, ok := arguments["--awssecret"].(string); ok {
+		s.awsSecretAccessKey = arg
+	}
+	// parse environment variables
+	if len(s.awsAccessKeyId) < 1 {
+		s.awsAccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(s.awsSecretAccessKey) < 1 {
+		s.awsSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(s.awsAccessKeyId) < 1 || len(s.awsSecretAccessKey) < 1 {
+		log.Fatal("Must use -K and -S options or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
+	}
+	s.cfg, err = config.LoadDefaultConfig(context.Background(),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s.awsAccessKeyId, s.awsSecretAccessKey, "")))
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %s", err.Error())
+	}
+}
@@ -0,0 +1,151 @@
+package amicleanup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// fakeEC2 returns an EC2 client whose calls are answered by answer instead of AWS
+func fakeEC2(answer func(op string, input interface{}) (interface{}, error)) *ec2.Client {
+	fake := func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("fakeEC2", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, err := answer(awsmiddleware.GetOperationName(ctx), in.Parameters)
+			return middleware.InitializeOutput{Result: out}, middleware.Metadata{}, err
+		}), middleware.Before)
+	}
+	return ec2.New(ec2.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{fake},
+	})
+}
+
+// TestPurgeSkipsInFlight runs a cleanup while an amibackup run is still making a backup whose
+// name matches the cleanup's regex
+func TestPurgeSkipsInFlight(t *testing.T) {
+	runID := func(started time.Time) string { return started.Format("2006-01-02_15-04-05") + "-0000beef" }
+	image := func(id string, tags ...types.Tag) types.Image {
+		return types.Image{
+			ImageId: aws.String(id),
+			Name:    aws.String("web-" + id),
+			Tags:    tags,
+			BlockDeviceMappings: []types.BlockDeviceMapping{
+				{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id)}},
+			},
+		}
+	}
+	inProgress := func(started time.Time) types.Tag {
+		return types.Tag{Key: aws.String("amibackup:in-progress"), Value: aws.String(runID(started))}
+	}
+	images := []types.Image{
+		image("ami-done"),
+		image("ami-inflight", inProgress(time.Now().Add(-time.Hour))),
+		image("ami-crashed", inProgress(time.Now().Add(-48*time.Hour))),
+		image("ami-garbled", types.Tag{Key: aws.String("amibackup:in-progress"), Value: aws.String("manual")}),
+	}
+	deregistered, deleted := []string{}, []string{}
+	awsec2 := fakeEC2(func(op string, input interface{}) (interface{}, error) {
+		switch op {
+		case "DescribeImages":
+			in := input.(*ec2.DescribeImagesInput)
+			if len(in.ImageIds) == 0 {
+				return &ec2.DescribeImagesOutput{Images: images}, nil
+			}
+			out := &ec2.DescribeImagesOutput{}
+			for _, img := range images {
+				if aws.ToString(img.ImageId) == in.ImageIds[0] {
+					out.Images = append(out.Images, img)
+				}
+			}
+			return out, nil
+		case "DeregisterImage":
+			deregistered = append(deregistered, aws.ToString(input.(*ec2.DeregisterImageInput).ImageId))
+			return &ec2.DeregisterImageOutput{}, nil
+		case "DeleteSnapshot":
+			deleted = append(deleted, aws.ToString(input.(*ec2.DeleteSnapshotInput).SnapshotId))
+			return &ec2.DeleteSnapshotOutput{}, nil
+		}
+		t.Errorf("unexpected EC2 call %s", op)
+		return nil, nil
+	})
+	s := &session{nameRegex: "^web-", region: "us-east-1", inProgressStale: 24 * time.Hour}
+
+	if err := purgeAMIs(context.Background(), awsec2, s); err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	sort.Strings(deregistered)
+	sort.Strings(deleted)
+	if got := strings.Join(deregistered, ","); got != "ami-crashed,ami-done,ami-garbled" {
+		t.Errorf("deregistered %s, want everything but the in-flight ami-inflight", got)
+	}
+	if got := strings.Join(deleted, ","); got != "snap-ami-crashed,snap-ami-done,snap-ami-garbled" {
+		t.Errorf("deleted %s, want the snapshots of the deregistered images", got)
+	}
+}
+
+func TestPurgeRaces(t *testing.T) {
+	images := []types.Image{}
+	for _, id := range []string{"ami-1", "ami-2", "ami-3"} {
+		images = append(images, types.Image{
+			ImageId: aws.String(id),
+			Name:    aws.String("web-" + id),
+			BlockDeviceMappings: []types.BlockDeviceMapping{
+				{DeviceName: aws.String("/dev/xvda"), Ebs: &types.EbsBlockDevice{SnapshotId: aws.String("snap-" + id)}},
+			},
+		})
+	}
+	deleted := []string{}
+	// a concurrent cleanup got to ami-1 first, and ami-2's snapshot; ami-3 is gone altogether
+	awsec2 := fakeEC2(func(op string, input interface{}) (interface{}, error) {
+		switch op {
+		case "DescribeImages":
+			in := input.(*ec2.DescribeImagesInput)
+			if len(in.ImageIds) == 0 {
+				return &ec2.DescribeImagesOutput{Images: images}, nil
+			}
+			if in.ImageIds[0] == "ami-3" {
+				return nil, &smithy.GenericAPIError{Code: "InvalidAMIID.NotFound"}
+			}
+			for _, img := range images {
+				if aws.ToString(img.ImageId) == in.ImageIds[0] {
+					return &ec2.DescribeImagesOutput{Images: []types.Image{img}}, nil
+				}
+			}
+		case "DeregisterImage":
+			if aws.ToString(input.(*ec2.DeregisterImageInput).ImageId) == "ami-1" {
+				return nil, &smithy.GenericAPIError{Code: "InvalidAMIID.Unavailable"}
+			}
+			return &ec2.DeregisterImageOutput{}, nil
+		case "DeleteSnapshot":
+			snap := aws.ToString(input.(*ec2.DeleteSnapshotInput).SnapshotId)
+			if snap == "snap-ami-2" {
+				return nil, &smithy.GenericAPIError{Code: "InvalidSnapshot.NotFound"}
+			}
+			deleted = append(deleted, snap)
+			return &ec2.DeleteSnapshotOutput{}, nil
+		}
+		t.Errorf("unexpected EC2 call %s", op)
+		return nil, nil
+	})
+	s := &session{nameRegex: "^web-", region: "us-east-1", inProgressStale: 24 * time.Hour}
+
+	if err := purgeAMIs(context.Background(), awsec2, s); err != nil {
+		t.Fatalf("purgeAMIs: %s", err)
+	}
+	if s.races != 3 {
+		t.Errorf("counted %d races, want 3", s.races)
+	}
+	if got := strings.Join(deleted, ","); got != "snap-ami-1" {
+		t.Errorf("deleted %s, want ami-1's snapshot, though another run deregistered ami-1", got)
+	}
+}
@@ -0,0 +1,679 @@
+package amiinventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/AppliedTrust/amibackup/pkg/purge"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/docopt/docopt-go"
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v2"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const version = "0.1"
+
+var usage = `amiinventory: show AMIs created with amibackup 
+Usage:
+  amiinventory [options] <instance_name_tag>
+  amiinventory -h --help
+  amiinventory --version
+
+Options:
+  -s, --source=<region>     AWS region of running instance [default: us-east-1].
+  -d, --dest=<region>       AWS region where backup AMIs are stored [default: us-west-1].
+  -K, --awskey=<keyid>      AWS key ID (instead of the default credentials).
+  -S, --awssecret=<secret>  AWS secret key, with -K.
+  -P, --policy=<file>       Check backups against a YAML retention policy instead of rendering the report.
+  -l, --restore-latest      Print only the newest available backup AMI in either region, as AMI_ID=<id>.
+  -f, --format=<format>     Output format for --restore-latest: shell or json [default: shell].
+                            With json, the report is also written as JSON instead of HTML.
+  --fresh-within=<age>      Check only that the newest backup is younger than this (e.g. 26h or 2d) instead of
+                            rendering the report.  Exits with status 3 if it isn't.
+  --max-gap=<age>           Check only that the available backups in the dest region leave no gap longer than this
+                            (e.g. 26h or 2d) - between two backups, or since the newest - instead of rendering the
+                            report.  Exits with status 3 if they do.  Can be combined with --fresh-within.
+  --instance-tags           With --fresh-within, read the amibackup:last-success tag that amibackup --tag-instance
+                            writes on each instance, rather than listing AMIs - faster, but only as good as the tags.
+  --tag-prefix=<prefix>     Prefix the backups were tagged with (see amibackup --tag-prefix).
+  --legacy-tags             With --tag-prefix, also find and read backups tagged without the prefix.
+  --also-read-unprefixed    Same as --legacy-tags.
+  --since=<when>            Only consider AMIs newer than this age (e.g. 36h or 7d) or date (2006-01-02 or RFC3339).
+  --days=<n>                Days of backup coverage to show in the report [default: 90].
+  --tz=<zone>               Time zone for the coverage days, e.g. America/Denver [default: Local].
+  --version                 Show version.
+  -h, --help                Show this screen.
+
+AWS Authentication:
+  Either use the -K and -S flags,
+	OR setup a ~/.aws/credentials or ~/.aws/config file (AWS_PROFILE selects a profile)
+	OR set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	OR run on an instance with an IAM role.
+
+Retention policy:
+  A YAML file mapping host classes to purge-window style requirements, and hosts to classes
+  (first match by instance tag KEY=VALUE or Name glob pattern wins):
+    classes:
+      prod: ["1d:0d:30d", "7d:30d:90d"]   # 1/day for 30 days, then 1/week until 90 days
+    hosts:
+      - {tag: "env=prod", class: prod}
+      - {pattern: "db-*", class: prod}
+  Exits with status 3 if any region has gaps.
+`
+
+// exit status when backups violate the retention policy
+const exitPolicyViolation = 3
+
+// exit status when the newest backup is older than --fresh-within
+const exitStale = 3
+
+// exit status when the backups leave a gap over --max-gap
+const exitGap = 3
+
+// instance tag amibackup --tag-instance sets to the time of the last successful backup
+const lastSuccessTag = "amibackup:last-success"
+
+type policy struct {
+	Classes map[string][]string `yaml:"classes"`
+	Hosts   []struct {
+		Class   string `yaml:"class"`
+		Pattern string `yaml:"pattern"`
+		Tag     string `yaml:"tag"`
+	} `yaml:"hosts"`
+}
+
+type session struct {
+	InstanceNameTag    string
+	SourceRegion       string
+	DestRegion         string
+	cfg                aws.Config
+	policyFile         string
+	freshWithin        time.Duration
+	maxGap             time.Duration
+	instanceTags       bool
+	restoreLatest      bool
+	tagPrefix          string
+	legacyTags         bool
+	format             string
+	since              time.Time
+	days               int
+	location           *time.Location
+	awsAccessKeyId     string
+	awsSecretAccessKey string
+}
+type ami struct {
+	Id           string
+	Region       string
+	When         time.Time
+	Relative     string
+	Name         string
+	State        string
+	InstanceId   string
+	InstanceName string
+}
+type amiList []ami
+
+func (t amiList) Len() int {
+	return len(t)
+}
+func (t amiList) Less(i, j int) bool {
+	return t[j].When.Before(t[i].When)
+}
+func (t amiList) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// Main runs amiinventory with the given command line arguments (without the program name)
+func Main(args []string) {
+	s := handleOptions(args)
+	ctx := context.Background()
+
+	if s.restoreLatest {
+		if err := s.printLatest(ctx, os.Stdout); err != nil {
+			log.Fatalf("Error finding latest AMI: %s", err.Error())
+		}
+		return
+	}
+
+	// search for our instances
+	instances, err := s.findInstances(ctx, s.SourceRegion)
+	if err != nil {
+		log.Fatalf("EC2 API DescribeInstances failed: %s", err.Error())
+	} else if len(instances) < 1 {
+		log.Fatalf("No instances with matching name tag: %s", s.InstanceNameTag)
+	} else if len(instances) > 1 {
+		log.Printf("Warning: Found %d instances with matching Name tag: %s", len(instances), s.InstanceNameTag)
+	}
+
+	if s.freshWithin > 0 && s.instanceTags {
+		os.Exit(s.reportTagFreshness(os.Stdout, instances, time.Now()))
+	}
+
+	sourceAmis, err := s.findAMIs(ctx, s.SourceRegion)
+	if err != nil {
+		log.Fatalf("EC2 API FindAMIs failed: %s", err.Error())
+	}
+	destAmis, err := s.findAMIs(ctx, s.DestRegion)
+	if err != nil {
+		log.Fatalf("EC2 API FindAMIs failed: %s", err.Error())
+	}
+
+	if s.freshWithin > 0 || s.maxGap > 0 {
+		status := 0
+		if s.freshWithin > 0 {
+			status = s.reportFreshness(os.Stdout, destAmis, time.Now())
+		}
+		if s.maxGap > 0 {
+			if gapStatus := s.reportGap(os.Stdout, destAmis, time.Now()); gapStatus != 0 {
+				status = gapStatus
+			}
+		}
+		os.Exit(status)
+	}
+	if s.policyFile != "" {
+		os.Exit(s.reportPolicy(instances, sourceAmis, destAmis))
+	}
+
+	tSrc := template.New("report")
+	templateText, err := Asset("static/index.html")
+	if err != nil {
+		log.Fatalf("Error loading html template: %s", err.Error())
+	}
+	t, err := tSrc.Parse(string(templateText))
+	if err != nil {
+		log.Fatalf("Error parsing html template: %s", err.Error())
+	}
+
+	sort.Sort(sourceAmis)
+	sort.Sort(destAmis)
+	now := time.Now()
+	coverage := buildCoverage(sourceAmis, destAmis, s.SourceRegion, s.DestRegion, s.days, now, s.location)
+	if s.format == "json" {
+		err = writeReportJSON(os.Stdout, s, sourceAmis, destAmis, coverage, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	data := struct {
+		Instances   []types.Instance
+		Session     *session
+		Now         time.Time
+		SourceAmis  *amiList
+		DestAmis    *amiList
+		SourceCount int
+		DestCount   int
+		Coverage    []coverageRow
+		Location    string
+	}{
+		instances,
+		s,
+		now,
+		sourceAmis,
+		destAmis,
+		len(*sourceAmis),
+		len(*destAmis),
+		coverage,
+		s.location.String(),
+	}
+	err = t.Execute(os.Stdout, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+}
+
+// client returns an EC2 client for a region
+func (s *session) client(region string) *ec2.Client {
+	return ec2.NewFromConfig(s.cfg, func(o *ec2.Options) {
+		o.Region = region
+	})
+}
+
+// findInstances searches for our instances
+func (s *session) findInstances(ctx context.Context, region string) ([]types.Instance, error) {
+	instances := []types.Instance{}
+	pages := ec2.NewDescribeInstancesPaginator(s.client(region), &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{{Name: aws.String("tag:Name"), Values: []string{s.InstanceNameTag}}},
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return instances, err
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	return instances, nil
+}
+
+// findAMIs finds AMIs for a given instance name tag - the backups amibackup's purge sees, as both
+// find them with the discovery package
+func (s *session) findAMIs(ctx context.Context, region string) (*amiList, error) {
+	images := amiList{}
+	backups, skipped, err := discovery.Find(ctx, s.client(region), s.InstanceNameTag, discovery.Tags{Prefix: s.tagPrefix, Legacy: s.legacyTags})
+	if err != nil {
+		return &images, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+	}
+	discovery.LogSkipped(skipped)
+	for _, b := range backups {
+		if b.When.Before(s.since) {
+			continue
+		}
+		images = append(images, ami{
+			Id:           b.Id,
+			Region:       region,
+			When:         b.When,
+			Relative:     humanize.Time(b.When),
+			Name:         aws.ToString(b.Image.Name),
+			State:        string(b.Image.State),
+			InstanceId:   b.InstanceId,
+			InstanceName: b.Hostname,
+		})
+	}
+	return &images, nil
+}
+
+// printLatest prints the newest available AMI across both regions, for shell scripts (eval $(amiinventory -l web))
+func (s *session) printLatest(ctx context.Context, out io.Writer) error {
+	var latest *ami
+	for _, region := range []string{s.SourceRegion, s.DestRegion} {
+		amis, err := s.findAMIs(ctx, region)
+		if err != nil {
+			return err
+		}
+		for i, a := range *amis {
+			if a.State != "available" {
+				continue
+			}
+			if latest == nil || a.When.After(latest.When) {
+				latest = &(*amis)[i]
+			}
+		}
+	}
+	if latest == nil {
+		return fmt.Errorf("no available AMIs for %s", s.InstanceNameTag)
+	}
+	if s.format == "json" {
+		return json.NewEncoder(out).Encode(struct {
+			Id        string    `json:"ami_id"`
+			Region    string    `json:"region"`
+			Name      string    `json:"name"`
+			Timestamp time.Time `json:"timestamp"`
+		}{latest.Id, latest.Region, latest.Name, latest.When})
+	}
+	_, err := fmt.Fprintf(out, "AMI_ID=%s\n", latest.Id)
+	return err
+}
+
+// coverage statuses of a day in the report
+const (
+	coverageBackup      = "backup"       // at least one backup that day
+	coverageNone        = "none"         // no backup that day
+	coverageCopyMissing = "copy-missing" // backed up in the source region, but no copy in the dest region
+)
+
+// coverageRow is one region's backups per day, oldest day first
+type coverageRow struct {
+	Region string        `json:"region"`
+	Days   []coverageDay `json:"days"`
+}
+
+type coverageDay struct {
+	Date    string `json:"date"`
+	Backups int    `json:"backups"`
+	Status  string `json:"status"`
+}
+
+// buildCoverage counts the backups made on each of the last days days in each region, with day
+// boundaries in loc.  Failed AMIs don't count, and a dest region day is copy-missing when the source
+// region has a backup that day but the dest region has none.
+func buildCoverage(sourceAmis, destAmis *amiList, sourceRegion, destRegion string, days int, now time.Time, loc *time.Location) []coverageRow {
+	perDay := func(amis *amiList) map[string]int {
+		counts := map[string]int{}
+		for _, a := range *amis {
+			if a.State != "failed" {
+				counts[a.When.In(loc).Format("2006-01-02")]++
+			}
+		}
+		return counts
+	}
+	sourceDays, destDays := perDay(sourceAmis), perDay(destAmis)
+	source := coverageRow{Region: sourceRegion, Days: []coverageDay{}}
+	dest := coverageRow{Region: destRegion, Days: []coverageDay{}}
+	today := now.In(loc)
+	for i := days - 1; i >= 0; i-- {
+		date := time.Date(today.Year(), today.Month(), today.Day()-i, 0, 0, 0, 0, loc).Format("2006-01-02")
+		sourceDay := coverageDay{date, sourceDays[date], coverageBackup}
+		if sourceDay.Backups == 0 {
+			sourceDay.Status = coverageNone
+		}
+		destDay := coverageDay{date, destDays[date], coverageBackup}
+		if destDay.Backups == 0 {
+			destDay.Status = coverageNone
+			if sourceDay.Backups > 0 {
+				destDay.Status = coverageCopyMissing
+			}
+		}
+		source.Days = append(source.Days, sourceDay)
+		dest.Days = append(dest.Days, destDay)
+	}
+	if sourceRegion == destRegion {
+		return []coverageRow{source}
+	}
+	return []coverageRow{source, dest}
+}
+
+// writeReportJSON writes the report - the AMIs in each region and the coverage matrix - as JSON
+func writeReportJSON(out io.Writer, s *session, sourceAmis, destAmis *amiList, coverage []coverageRow, now time.Time) error {
+	type amiEntry struct {
+		Id         string    `json:"ami_id"`
+		Region     string    `json:"region"`
+		Name       string    `json:"name"`
+		State      string    `json:"state"`
+		InstanceId string    `json:"instance_id"`
+		Timestamp  time.Time `json:"timestamp"`
+	}
+	amis := []amiEntry{}
+	for _, list := range []*amiList{sourceAmis, destAmis} {
+		for _, a := range *list {
+			amis = append(amis, amiEntry{a.Id, a.Region, a.Name, a.State, a.InstanceId, a.When})
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Hostname string        `json:"hostname"`
+		Date     time.Time     `json:"report_date"`
+		TimeZone string        `json:"time_zone"`
+		AMIs     []amiEntry    `json:"amis"`
+		Coverage []coverageRow `json:"coverage"`
+	}{s.InstanceNameTag, now, s.location.String(), amis, coverage})
+}
+
+// loadPolicy reads and validates a retention policy file
+func loadPolicy(file string) (*policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := policy{}
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("Error parsing policy %s: %s", file, err.Error())
+	}
+	for class, windows := range p.Classes {
+		for _, w := range windows {
+			if _, err := purge.ParseWindow(w, time.Now()); err != nil {
+				return nil, fmt.Errorf("Policy class %s: %s", class, err.Error())
+			}
+		}
+	}
+	for _, h := range p.Hosts {
+		if _, ok := p.Classes[h.Class]; !ok {
+			return nil, fmt.Errorf("Policy host mapping refers to unknown class: %s", h.Class)
+		}
+	}
+	return &p, nil
+}
+
+// classFor finds the policy class for a host, by instance tag or Name pattern
+func (p *policy) classFor(name string, instances []types.Instance) (string, bool) {
+	for _, h := range p.Hosts {
+		if h.Pattern != "" {
+			if ok, _ := path.Match(h.Pattern, name); ok {
+				return h.Class, true
+			}
+		}
+		if h.Tag != "" {
+			kv := strings.SplitN(h.Tag, "=", 2)
+			for _, instance := range instances {
+				for _, tag := range instance.Tags {
+					if aws.ToString(tag.Key) == kv[0] && (len(kv) == 1 || aws.ToString(tag.Value) == kv[1]) {
+						return h.Class, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// checkPolicy lists every window interval that has no backup, using the same bucketing as amibackup's purge
+func checkPolicy(windows []string, amis *amiList, now time.Time) []string {
+	images := map[string]time.Time{}
+	for _, a := range *amis {
+		images[a.Id] = a.When
+	}
+	gaps := []string{}
+	for _, spec := range windows {
+		w, err := purge.ParseWindow(spec, now)
+		if err != nil {
+			gaps = append(gaps, err.Error())
+			continue
+		}
+		for _, b := range w.Buckets(images) {
+			if len(b.Images) == 0 {
+				gaps = append(gaps, fmt.Sprintf("no backup between %s and %s (%s requires 1 per %s)", b.Start.Format("2006-01-02 15:04"), b.End.Format("2006-01-02 15:04"), spec, w.Interval))
+			}
+		}
+	}
+	return gaps
+}
+
+// reportPolicy prints whether this host's backups satisfy the policy file and returns the exit status
+func (s *session) reportPolicy(instances []types.Instance, sourceAmis, destAmis *amiList) int {
+	p, err := loadPolicy(s.policyFile)
+	if err != nil {
+		log.Fatalf("Error loading policy: %s", err.Error())
+	}
+	class, ok := p.classFor(s.InstanceNameTag, instances)
+	if !ok {
+		fmt.Printf("%s: no policy class matches - not checked\n", s.InstanceNameTag)
+		return 0
+	}
+	status := 0
+	now := time.Now()
+	for _, r := range []struct {
+		region string
+		amis   *amiList
+	}{{s.SourceRegion, sourceAmis}, {s.DestRegion, destAmis}} {
+		gaps := checkPolicy(p.Classes[class], r.amis, now)
+		if len(gaps) == 0 {
+			fmt.Printf("%s (%s) in %s: COMPLIANT\n", s.InstanceNameTag, class, r.region)
+			continue
+		}
+		status = exitPolicyViolation
+		fmt.Printf("%s (%s) in %s: %d GAPS\n", s.InstanceNameTag, class, r.region, len(gaps))
+		for _, gap := range gaps {
+			fmt.Printf("  %s\n", gap)
+		}
+	}
+	return status
+}
+
+// reportFreshness prints whether the newest available backup in the dest region is within
+// --fresh-within and returns the exit status
+func (s *session) reportFreshness(out io.Writer, amis *amiList, now time.Time) int {
+	var newest *ami
+	for i, a := range *amis {
+		if a.State == "available" && (newest == nil || a.When.After(newest.When)) {
+			newest = &(*amis)[i]
+		}
+	}
+	if newest == nil {
+		fmt.Fprintf(out, "%s in %s: STALE (no available backup)\n", s.InstanceNameTag, s.DestRegion)
+		return exitStale
+	}
+	age := now.Sub(newest.When)
+	if age > s.freshWithin {
+		fmt.Fprintf(out, "%s in %s: STALE (newest backup %s is %s old)\n", s.InstanceNameTag, s.DestRegion, newest.Id, age.Round(time.Minute))
+		return exitStale
+	}
+	fmt.Fprintf(out, "%s in %s: FRESH (newest backup %s is %s old)\n", s.InstanceNameTag, s.DestRegion, newest.Id, age.Round(time.Minute))
+	return 0
+}
+
+// reportGap prints whether the available backups in the dest region leave a gap longer than
+// --max-gap and returns the exit status.  Gaps are measured as amibackup's purge measures them.
+func (s *session) reportGap(out io.Writer, amis *amiList, now time.Time) int {
+	times := []time.Time{}
+	for _, a := range *amis {
+		if a.State == "available" {
+			times = append(times, a.When)
+		}
+	}
+	coverage := purge.MeasureCoverage(times, now)
+	if coverage.Backups == 0 {
+		fmt.Fprintf(out, "%s in %s: GAP (no available backup)\n", s.InstanceNameTag, s.DestRegion)
+		return exitGap
+	}
+	if coverage.MaxGap > s.maxGap {
+		fmt.Fprintf(out, "%s in %s: GAP (%s without a backup after %s; oldest backup %s old)\n", s.InstanceNameTag, s.DestRegion,
+			coverage.MaxGap.Round(time.Minute), coverage.GapStart.Format(time.RFC3339), now.Sub(coverage.Oldest).Round(time.Hour))
+		return exitGap
+	}
+	fmt.Fprintf(out, "%s in %s: NO GAP (longest gap %s; oldest backup %s old)\n", s.InstanceNameTag, s.DestRegion,
+		coverage.MaxGap.Round(time.Minute), now.Sub(coverage.Oldest).Round(time.Hour))
+	return 0
+}
+
+// reportTagFreshness is reportFreshness from each instance's amibackup:last-success tag
+func (s *session) reportTagFreshness(out io.Writer, instances []types.Instance, now time.Time) int {
+	status := 0
+	for _, instance := range instances {
+		value := discovery.TagValue(instance.Tags, lastSuccessTag)
+		if value == "" {
+			fmt.Fprintf(out, "%s (%s): STALE (no %s tag)\n", s.InstanceNameTag, aws.ToString(instance.InstanceId), lastSuccessTag)
+			status = exitStale
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			fmt.Fprintf(out, "%s (%s): STALE (bad %s tag %q)\n", s.InstanceNameTag, aws.ToString(instance.InstanceId), lastSuccessTag, value)
+			status = exitStale
+			continue
+		}
+		age := now.Sub(when)
+		if age > s.freshWithin {
+			fmt.Fprintf(out, "%s (%s): STALE (last backed up %s ago)\n", s.InstanceNameTag, aws.ToString(instance.InstanceId), age.Round(time.Minute))
+			status = exitStale
+			continue
+		}
+		fmt.Fprintf(out, "%s (%s): FRESH (last backed up %s ago)\n", s.InstanceNameTag, aws.ToString(instance.InstanceId), age.Round(time.Minute))
+	}
+	return status
+}
+
+// parseSince parses --since as an age (36h, 7d) or an absolute date
+func parseSince(in string, now time.Time) (time.Time, error) {
+	if converted, err := purge.DaysToHours(in); err == nil {
+		if age, err := time.ParseDuration(converted); err == nil {
+			return now.Add(-age), nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, in); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", in, time.Local)
+}
+
+// handleOptions parses CLI options
+func handleOptions(args []string) *session {
+	s := session{}
+	arguments, err := docopt.Parse(usage, args, true, version, false)
+	if err != nil {
+		log.Fatalf("Error parsing arguments: %s", err.Error())
+	}
+	s.InstanceNameTag = arguments["<instance_name_tag>"].(string)
+	s.SourceRegion = arguments["--source"].(string)
+	s.DestRegion = arguments["--dest"].(string)
+	if arg, ok := arguments["--policy"].(string); ok {
+		s.policyFile = arg
+	}
+	if arg, ok := arguments["--fresh-within"].(string); ok {
+		converted, err := purge.DaysToHours(arg)
+		if err == nil {
+			s.freshWithin, err = time.ParseDuration(converted)
+		}
+		if err != nil || s.freshWithin <= 0 {
+			log.Fatalf("Bad fresh-within: %s", arg)
+		}
+	}
+	if arg, ok := arguments["--max-gap"].(string); ok {
+		converted, err := purge.DaysToHours(arg)
+		if err == nil {
+			s.maxGap, err = time.ParseDuration(converted)
+		}
+		if err != nil || s.maxGap <= 0 {
+			log.Fatalf("Bad max-gap: %s", arg)
+		}
+	}
+	s.instanceTags = arguments["--instance-tags"].(bool)
+	if s.instanceTags && s.freshWithin == 0 {
+		log.Fatalf("--instance-tags needs --fresh-within")
+	}
+	if s.instanceTags && s.maxGap > 0 {
+		log.Fatalf("--max-gap needs the AMIs themselves, so can't be used with --instance-tags")
+	}
+	s.restoreLatest = arguments["--restore-latest"].(bool)
+	s.format = arguments["--format"].(string)
+	if s.format != "shell" && s.format != "json" {
+		log.Fatalf("Bad format: %s", s.format)
+	}
+	if arg, ok := arguments["--tag-prefix"].(string); ok {
+		s.tagPrefix = arg
+	}
+	s.legacyTags = arguments["--legacy-tags"].(bool) || arguments["--also-read-unprefixed"].(bool)
+	if s.legacyTags && s.tagPrefix == "" {
+		log.Fatalf("--legacy-tags (--also-read-unprefixed) needs --tag-prefix")
+	}
+	if arg, ok := arguments["--since"].(string); ok {
+		s.since, err = parseSince(arg, time.Now())
+		if err != nil {
+			log.Fatalf("Bad since: %s", arg)
+		}
+	}
+	s.days, err = strconv.Atoi(arguments["--days"].(string))
+	if err != nil || s.days < 1 {
+		log.Fatalf("Bad days: %s", arguments["--days"].(string))
+	}
+	s.location, err = time.LoadLocation(arguments["--tz"].(string))
+	if err != nil {
+		log.Fatalf("Bad tz: %s", arguments["--tz"].(string))
+	}
+	if arg, ok := arguments["--awskey"].(string); ok {
+		s.awsAccessKeyId = arg
+	}
+	if arg, ok := arguments["--awssecret"].(string); ok {
+		s.awsSecretAccessKey = arg
+	}
+	if (s.awsAccessKeyId == "") != (s.awsSecretAccessKey == "") {
+		log.Fatalf("-K and -S must be used together")
+	}
+	// -K and -S, or else the default credential chain
+	opts := []func(*config.LoadOptions) error{}
+	if s.awsAccessKeyId != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s.awsAccessKeyId, s.awsSecretAccessKey, "")))
+	}
+	s.cfg, err = config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %s", err.Error())
+	}
+	return &s
+}
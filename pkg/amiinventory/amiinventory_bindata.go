@@ -0,0 +1,270 @@
+package amiinventory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func bindata_read(data []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("Read %q: %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, gz)
+	gz.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("Read %q: %v", name, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func static_index_html() ([]byte, error) {
+	return bindata_read([]byte{
+		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xec, 0x58,
+		0x5f, 0x8f, 0xdb, 0xb8, 0x11, 0x7f, 0xb6, 0x3f, 0xc5, 0x9c, 0xb2, 0x05,
+		0x92, 0x34, 0x92, 0xec, 0xcd, 0xee, 0x35, 0x75, 0x64, 0xb7, 0xb9, 0xdb,
+		0xa2, 0x5d, 0xe0, 0x92, 0x1e, 0xb2, 0x0b, 0x1c, 0xda, 0x37, 0x4a, 0x1c,
+		0x5b, 0x44, 0x28, 0x52, 0x25, 0x29, 0xdb, 0x1b, 0xc3, 0xdf, 0xbd, 0x18,
+		0x51, 0x94, 0x65, 0xaf, 0x77, 0x83, 0x03, 0xda, 0x3e, 0x14, 0xe7, 0x04,
+		0x6b, 0x69, 0xfe, 0x71, 0xfe, 0xfd, 0xc8, 0xa1, 0xb3, 0xef, 0x6e, 0xfe,
+		0xfe, 0xe3, 0xfd, 0x3f, 0x7e, 0xfe, 0x0b, 0x94, 0xae, 0x92, 0x8b, 0x71,
+		0x46, 0x5f, 0x20, 0x99, 0x5a, 0xcd, 0x23, 0x54, 0xd1, 0x62, 0x0c, 0x90,
+		0x95, 0xc8, 0x38, 0x3d, 0x00, 0x64, 0x15, 0x3a, 0x06, 0x45, 0xc9, 0x8c,
+		0x45, 0x37, 0x8f, 0x1a, 0xb7, 0x8c, 0xdf, 0x45, 0x43, 0x96, 0x62, 0x15,
+		0xce, 0xa3, 0xb5, 0xc0, 0x4d, 0xad, 0x8d, 0x8b, 0xa0, 0xd0, 0xca, 0xa1,
+		0x72, 0xf3, 0x68, 0x23, 0xb8, 0x2b, 0xe7, 0x1c, 0xd7, 0xa2, 0xc0, 0xb8,
+		0x7d, 0x79, 0x03, 0x42, 0x09, 0x27, 0x98, 0x8c, 0x6d, 0xc1, 0x24, 0xce,
+		0xa7, 0x67, 0x0c, 0x71, 0xb4, 0x85, 0x11, 0xb5, 0x13, 0x5a, 0x0d, 0x6c,
+		0x9d, 0x11, 0x64, 0x8d, 0x2b, 0xb5, 0x39, 0x23, 0xe3, 0x84, 0x93, 0xb8,
+		0xf8, 0xf0, 0xf1, 0x16, 0x3e, 0x23, 0xb9, 0x04, 0x4b, 0x6d, 0x60, 0xb7,
+		0x83, 0xe4, 0x0e, 0xad, 0x15, 0x5a, 0x25, 0xb7, 0xca, 0x3a, 0xa6, 0x0a,
+		0xfc, 0xc4, 0x2a, 0xbc, 0x67, 0x2b, 0xd8, 0xef, 0xb3, 0xd4, 0x2b, 0x8d,
+		0x47, 0xa3, 0x4c, 0x0a, 0xf5, 0x05, 0x0c, 0xca, 0x79, 0x64, 0xdd, 0x83,
+		0x44, 0x5b, 0x22, 0xba, 0x08, 0x4a, 0x83, 0xcb, 0x79, 0x54, 0x3a, 0x57,
+		0xdb, 0x59, 0x9a, 0x56, 0x6c, 0x5b, 0x70, 0x95, 0xe4, 0x5a, 0x3b, 0xeb,
+		0x0c, 0xab, 0xe9, 0xa5, 0xd0, 0x55, 0xda, 0x13, 0xd2, 0xb7, 0xc9, 0xdb,
+		0xe4, 0x3a, 0x2d, 0xac, 0x3d, 0xd0, 0x92, 0x4a, 0xa8, 0xa4, 0xb0, 0x36,
+		0xfa, 0xef, 0x2e, 0x13, 0xbb, 0x12, 0x2b, 0x3c, 0x5e, 0xac, 0x8d, 0x64,
+		0x31, 0x1e, 0xa7, 0xaf, 0xc7, 0xf0, 0x1a, 0x7e, 0x60, 0x16, 0xc1, 0x3a,
+		0xd3, 0x14, 0xae, 0x31, 0x38, 0x86, 0xd7, 0x29, 0x71, 0xe0, 0xa3, 0x5e,
+		0x23, 0x70, 0xbd, 0x51, 0x21, 0xa5, 0x90, 0x63, 0xc1, 0x1a, 0x8b, 0xb0,
+		0x41, 0x28, 0xd9, 0x1a, 0x81, 0xc1, 0x52, 0x6c, 0x91, 0x83, 0x62, 0xeb,
+		0x9c, 0x19, 0x70, 0x25, 0x73, 0x20, 0x2c, 0x5c, 0x4f, 0xea, 0x2d, 0x38,
+		0x26, 0x25, 0x59, 0xca, 0x35, 0x7f, 0x80, 0xdd, 0x18, 0xa0, 0x66, 0x9c,
+		0x0b, 0xb5, 0x8a, 0x9d, 0xae, 0x67, 0xad, 0xc8, 0xfb, 0xf1, 0x7e, 0x1c,
+		0x5c, 0xf8, 0xab, 0xd4, 0x39, 0x93, 0xc0, 0x38, 0x8f, 0xb5, 0xb2, 0xde,
+		0x85, 0xc4, 0x36, 0x79, 0x4c, 0x8d, 0x87, 0xe6, 0xc8, 0x40, 0xae, 0x9d,
+		0xd3, 0xd5, 0x0c, 0xa6, 0xad, 0x0d, 0x80, 0x5c, 0x1b, 0x8e, 0xe6, 0x40,
+		0xae, 0xb7, 0x60, 0xb5, 0x14, 0x1c, 0x5e, 0x20, 0x62, 0xbb, 0x88, 0x5f,
+		0xe3, 0x5e, 0xd7, 0xe4, 0xa9, 0x58, 0x31, 0x6a, 0x26, 0xa2, 0xfc, 0x4d,
+		0x70, 0x04, 0x8e, 0x4b, 0xd6, 0x48, 0xd7, 0x99, 0x01, 0xa7, 0xc1, 0x60,
+		0x45, 0xa1, 0x4f, 0xeb, 0x2d, 0x48, 0xa1, 0x30, 0x69, 0xdd, 0x49, 0x7c,
+		0x90, 0x71, 0x1b, 0x31, 0x05, 0xd1, 0xfa, 0xe4, 0x95, 0x66, 0x30, 0x19,
+		0xac, 0x73, 0x27, 0x38, 0xe6, 0xcc, 0xf4, 0x79, 0x6c, 0x57, 0xa1, 0x9e,
+		0xab, 0x74, 0x2e, 0x24, 0xbe, 0x01, 0x5b, 0xea, 0x0d, 0x48, 0xe6, 0xd0,
+		0x90, 0x48, 0x62, 0xbd, 0x7c, 0x6b, 0x8f, 0x0b, 0x5b, 0x4b, 0xf6, 0x30,
+		0x03, 0xa5, 0x55, 0xeb, 0xfb, 0x9f, 0x2b, 0xe4, 0x82, 0xc1, 0xcb, 0x4a,
+		0x28, 0x8f, 0x99, 0x19, 0xfc, 0xe1, 0xfb, 0x77, 0xf5, 0xf6, 0x55, 0x2b,
+		0x7e, 0xa4, 0x0b, 0x50, 0x6b, 0x2b, 0x28, 0xb6, 0x99, 0xaf, 0xcb, 0xfb,
+		0x96, 0xe8, 0xf3, 0x3d, 0xf5, 0xb9, 0xa2, 0x6c, 0xf9, 0x34, 0x4d, 0xfc,
+		0xab, 0xc4, 0xa5, 0xeb, 0x5f, 0xbe, 0xc6, 0x42, 0x71, 0xdc, 0x52, 0x6a,
+		0x27, 0x1d, 0xa9, 0x77, 0x28, 0x97, 0xba, 0xf8, 0xe2, 0x69, 0x5d, 0x21,
+		0x66, 0x70, 0xd9, 0x55, 0x00, 0x40, 0xaf, 0xd1, 0x2c, 0xa5, 0xde, 0xc4,
+		0xdb, 0x19, 0x94, 0x82, 0x73, 0x54, 0x27, 0xf4, 0x87, 0x19, 0xb0, 0xc6,
+		0xe9, 0xf7, 0x90, 0xbe, 0x86, 0xbb, 0xc2, 0x68, 0x29, 0x59, 0x2e, 0x31,
+		0x74, 0x96, 0x05, 0xb1, 0x84, 0xb0, 0x65, 0x50, 0x0b, 0xd9, 0x52, 0x1b,
+		0xca, 0x8f, 0x2b, 0x59, 0xdf, 0x7e, 0x09, 0x65, 0x8b, 0x8c, 0xe6, 0xac,
+		0xf8, 0xb2, 0x32, 0xba, 0x51, 0x3c, 0x2e, 0xb4, 0xd4, 0x66, 0x06, 0x2f,
+		0x96, 0xd7, 0xf4, 0x2f, 0x44, 0x48, 0x35, 0x89, 0x8d, 0x58, 0x95, 0xee,
+		0x71, 0x3b, 0x00, 0xec, 0x7d, 0xa9, 0x42, 0x9d, 0x06, 0x3d, 0x11, 0xea,
+		0x1c, 0x0f, 0xd3, 0x5a, 0x31, 0xb3, 0x12, 0x2a, 0x98, 0x8b, 0x2f, 0x29,
+		0x93, 0x14, 0x05, 0x05, 0x1f, 0x52, 0x01, 0xbf, 0x6f, 0xd7, 0xe9, 0x5a,
+		0xe8, 0x75, 0x7a, 0x50, 0x0b, 0xe9, 0x0e, 0xa9, 0xea, 0xc8, 0x3e, 0xed,
+		0xf1, 0x65, 0x07, 0x83, 0xa3, 0x45, 0x17, 0x20, 0x05, 0x2c, 0x80, 0x1d,
+		0x35, 0x7d, 0xb7, 0x7c, 0x30, 0x13, 0xc8, 0xde, 0xce, 0x13, 0x66, 0x12,
+		0x56, 0x38, 0xb1, 0x46, 0xb2, 0xf5, 0xe6, 0x19, 0xde, 0xac, 0xa4, 0x2a,
+		0x3d, 0x2b, 0xb1, 0xd4, 0x45, 0x63, 0x5b, 0x7f, 0xfa, 0x84, 0x2f, 0x97,
+		0xef, 0xc7, 0x67, 0x4b, 0x71, 0x75, 0xf9, 0x2e, 0x2f, 0xd8, 0x10, 0xdc,
+		0x1f, 0x99, 0xe8, 0x8b, 0xd8, 0x41, 0xbb, 0x22, 0xd2, 0x20, 0xbe, 0x43,
+		0x0c, 0xdf, 0x68, 0xf8, 0x5e, 0xf1, 0x51, 0x6a, 0xae, 0xba, 0xd4, 0x1c,
+		0x18, 0x3e, 0x39, 0x81, 0x4e, 0x65, 0xf7, 0xea, 0x49, 0xcd, 0x56, 0x38,
+		0xdc, 0x59, 0xba, 0xa2, 0xb4, 0x48, 0x99, 0x0c, 0x3d, 0xff, 0x59, 0xb2,
+		0x02, 0x4b, 0x2d, 0x49, 0x90, 0x33, 0x5b, 0xe6, 0x9a, 0x19, 0x0e, 0x82,
+		0x23, 0x0b, 0x7b, 0x54, 0x7d, 0x90, 0xb0, 0xb0, 0x7b, 0x5c, 0xf7, 0xb7,
+		0xdd, 0xea, 0x0e, 0xb7, 0x2e, 0x66, 0x52, 0xac, 0xd4, 0x0c, 0x0a, 0x54,
+		0x0e, 0x0d, 0xad, 0x73, 0xac, 0x5e, 0x5e, 0x9d, 0xb3, 0x30, 0x39, 0x15,
+		0x3c, 0x27, 0xd4, 0x77, 0xc0, 0x50, 0x4e, 0x54, 0xab, 0xe3, 0x4d, 0x45,
+		0x28, 0xda, 0xcf, 0xe2, 0x1e, 0xca, 0x01, 0x29, 0x8c, 0x8b, 0xc6, 0xd2,
+		0xa6, 0xfc, 0xbb, 0xc1, 0x36, 0xf6, 0x23, 0x75, 0x05, 0x5b, 0x21, 0x94,
+		0xc8, 0x5c, 0xc5, 0xea, 0x2e, 0xe0, 0x22, 0x90, 0x0f, 0xdb, 0x1f, 0x95,
+		0x5e, 0xb2, 0xda, 0xe2, 0x0c, 0x2c, 0xd6, 0xcc, 0x30, 0x87, 0x03, 0xeb,
+		0xb6, 0x66, 0x45, 0x5b, 0xe1, 0x6e, 0x0b, 0x3a, 0xf1, 0x7c, 0x1a, 0x3c,
+		0xef, 0x0d, 0xbb, 0xf2, 0x5c, 0xe7, 0x87, 0xdd, 0x7e, 0xa9, 0x95, 0x8b,
+		0x37, 0xe8, 0x89, 0x4a, 0x9b, 0x8a, 0x49, 0x22, 0x6f, 0x4a, 0xe1, 0xb0,
+		0x5d, 0x0b, 0x89, 0xbc, 0x31, 0xac, 0x3e, 0xb1, 0xca, 0x5b, 0xab, 0x5d,
+		0x4b, 0xbd, 0xf3, 0xc6, 0xca, 0xce, 0xce, 0xf4, 0xfb, 0x23, 0x58, 0x85,
+		0xa4, 0x17, 0x7a, 0x1d, 0x53, 0x87, 0x37, 0x35, 0xec, 0xce, 0xb5, 0xfa,
+		0x75, 0x91, 0xbf, 0xbb, 0x2e, 0xde, 0x43, 0x27, 0x4a, 0x7b, 0xf6, 0x79,
+		0x41, 0xfe, 0xc7, 0xeb, 0xb7, 0x57, 0xcb, 0x5e, 0xb0, 0xd0, 0xf5, 0x43,
+		0x5c, 0x09, 0x6b, 0x85, 0x5a, 0x9d, 0x57, 0x58, 0x4e, 0x18, 0xbf, 0xc2,
+		0xa0, 0xd0, 0x46, 0x10, 0x4b, 0x5c, 0xa1, 0xe2, 0x60, 0x6b, 0xa6, 0x9e,
+		0x2f, 0x6b, 0x17, 0xe3, 0x74, 0x72, 0x12, 0x64, 0xf7, 0xee, 0x0b, 0x30,
+		0x83, 0x09, 0x5c, 0xd5, 0x5b, 0x98, 0xc0, 0xf4, 0x92, 0xe8, 0x7b, 0x9a,
+		0x0b, 0xd2, 0x6e, 0x30, 0x00, 0xc8, 0x52, 0xc2, 0xc7, 0x62, 0x4c, 0xc3,
+		0x1f, 0x1d, 0xe1, 0xed, 0x13, 0x40, 0xa6, 0xd8, 0x1a, 0x0a, 0xc9, 0xac,
+		0x9d, 0x47, 0xdd, 0xa9, 0xdf, 0x9d, 0x8b, 0x42, 0xad, 0xd1, 0x58, 0x84,
+		0xd3, 0x63, 0xb2, 0x9b, 0xc2, 0x00, 0x32, 0x2e, 0x7a, 0x55, 0xda, 0x0c,
+		0x98, 0x50, 0x68, 0xe2, 0xa5, 0x6c, 0x04, 0xef, 0x65, 0x8e, 0xa5, 0x3a,
+		0x53, 0xe4, 0x08, 0x9a, 0x76, 0x70, 0x19, 0x8d, 0x46, 0x19, 0x3b, 0x61,
+		0xe7, 0x86, 0x29, 0x1e, 0x26, 0xa5, 0x17, 0xd1, 0xa2, 0x1b, 0xf2, 0x38,
+		0x73, 0x38, 0x6b, 0xc7, 0xbc, 0x4f, 0x7a, 0xd3, 0x8e, 0x74, 0x6c, 0xb0,
+		0x4a, 0xca, 0xc5, 0x3a, 0xbc, 0x0e, 0x5e, 0xb2, 0x54, 0xb1, 0x75, 0x08,
+		0xf5, 0x59, 0x7f, 0x47, 0xa3, 0x11, 0x8d, 0xc5, 0xd3, 0x20, 0x31, 0xd8,
+		0x52, 0xa2, 0x5f, 0x3b, 0x6b, 0x96, 0xd3, 0x10, 0x5b, 0x23, 0xbb, 0xa7,
+		0xd1, 0x6e, 0x07, 0x86, 0xa9, 0x15, 0xc2, 0xc5, 0x97, 0x37, 0x70, 0x21,
+		0x60, 0x36, 0x87, 0x5e, 0xd7, 0xc2, 0x7e, 0xdf, 0x89, 0x65, 0x52, 0x2c,
+		0x6e, 0xf9, 0x0c, 0x32, 0xeb, 0x8c, 0x56, 0xab, 0xc5, 0x6e, 0x07, 0x17,
+		0xa2, 0x17, 0xbc, 0xe5, 0x6d, 0xe0, 0x1d, 0x2f, 0x4b, 0xa5, 0x08, 0xe6,
+		0x49, 0xef, 0xfe, 0xa1, 0xc6, 0xa7, 0x34, 0x89, 0xf7, 0x9c, 0xee, 0xcd,
+		0xa7, 0x3b, 0xa0, 0x10, 0x4e, 0xf5, 0x7f, 0x6e, 0x72, 0x29, 0x8a, 0x1b,
+		0x65, 0x89, 0xf9, 0x9c, 0x81, 0x0f, 0x6b, 0x26, 0x24, 0xcb, 0x85, 0x14,
+		0xee, 0x01, 0xfe, 0xa9, 0xd5, 0x63, 0x4b, 0xb4, 0x91, 0x55, 0x74, 0xec,
+		0x0f, 0x45, 0x49, 0xf2, 0x39, 0xb3, 0x3f, 0xb1, 0x46, 0x15, 0x25, 0xdc,
+		0x8b, 0xc7, 0xae, 0x79, 0xd6, 0xbd, 0x78, 0xde, 0xaf, 0x3b, 0xc7, 0xdc,
+		0x23, 0xd5, 0x96, 0x98, 0x3c, 0x17, 0xd2, 0x6e, 0x07, 0x84, 0xcd, 0x50,
+		0x97, 0x2c, 0xa5, 0x4a, 0xd2, 0xf3, 0xb0, 0x8b, 0x8c, 0xde, 0x74, 0x5d,
+		0x7c, 0xdc, 0x5b, 0x32, 0xb6, 0x55, 0x3c, 0xbd, 0x04, 0x7a, 0xaa, 0x78,
+		0xfc, 0x7d, 0xdf, 0xea, 0xe5, 0x65, 0x10, 0x3a, 0x8c, 0xc2, 0x11, 0xf9,
+		0x94, 0xdc, 0xe9, 0xc6, 0x14, 0xf8, 0xa3, 0x6e, 0x94, 0x83, 0xfd, 0x1e,
+		0x3e, 0x7c, 0xbc, 0xb5, 0x20, 0x14, 0x78, 0x32, 0x7c, 0xc6, 0x15, 0x4d,
+		0x33, 0xc3, 0xbe, 0xf3, 0x9c, 0x8e, 0x41, 0x09, 0x2c, 0x2f, 0x0f, 0x70,
+		0x38, 0x6e, 0x76, 0x47, 0x93, 0x59, 0x6c, 0xd0, 0xd6, 0x5a, 0x59, 0xb1,
+		0xc6, 0x01, 0x3a, 0xe9, 0x7f, 0xd6, 0xf2, 0x8f, 0x84, 0xa1, 0xfd, 0x1b,
+		0x5b, 0x67, 0x44, 0x8d, 0x43, 0x34, 0x07, 0x8d, 0xc3, 0xf5, 0x71, 0xf8,
+		0xc9, 0x9c, 0x09, 0xf9, 0xa3, 0x9c, 0xb8, 0xb2, 0x05, 0xce, 0x2d, 0xcf,
+		0x52, 0x57, 0x9e, 0x30, 0x42, 0x5f, 0x9e, 0xe7, 0xfe, 0x52, 0xa2, 0x3a,
+		0x43, 0xfe, 0x8c, 0x92, 0xd1, 0x08, 0x73, 0x86, 0xe5, 0x49, 0xc1, 0x91,
+		0xf0, 0xc9, 0x52, 0xf2, 0xe8, 0x11, 0xed, 0x9c, 0xf7, 0x99, 0xf3, 0xbb,
+		0xe2, 0x68, 0x74, 0x0e, 0xaf, 0xac, 0xc5, 0xab, 0xcf, 0xf9, 0x87, 0x4a,
+		0xb4, 0x80, 0x0d, 0x9a, 0x4f, 0x45, 0xcf, 0xa9, 0xb0, 0x17, 0x2c, 0xe9,
+		0x40, 0xeb, 0xf8, 0x79, 0xee, 0x31, 0xb4, 0x9f, 0x90, 0xa2, 0x84, 0x3c,
+		0xc7, 0x0f, 0x99, 0x39, 0x2f, 0x73, 0xd8, 0x62, 0x73, 0xa7, 0x20, 0x77,
+		0x2a, 0xae, 0x8d, 0xa8, 0x98, 0x79, 0x68, 0x9f, 0xb7, 0xf6, 0xf4, 0x5a,
+		0x5a, 0x68, 0x65, 0xb5, 0xc4, 0x84, 0x6d, 0x6c, 0xc2, 0x2a, 0xf6, 0x55,
+		0xfb, 0xcb, 0x2f, 0x16, 0x97, 0xe9, 0xfa, 0x32, 0x2d, 0x75, 0x85, 0x7f,
+		0x32, 0x6d, 0xe3, 0xcd, 0x69, 0xf5, 0xbe, 0x25, 0x6f, 0xd0, 0xba, 0xbe,
+		0x21, 0x5f, 0x78, 0x78, 0x86, 0xf0, 0x7e, 0x11, 0x5f, 0x99, 0xe1, 0x33,
+		0x56, 0x89, 0xf9, 0x20, 0x2b, 0x11, 0x18, 0x2d, 0x71, 0x1e, 0xe5, 0x8d,
+		0x73, 0x5a, 0x45, 0x1d, 0xda, 0xb3, 0x94, 0x2d, 0x7c, 0x26, 0x42, 0x6a,
+		0xc3, 0xc7, 0xd7, 0x73, 0x34, 0x3a, 0xc5, 0xe8, 0x23, 0x29, 0x5f, 0xcb,
+		0x13, 0x22, 0xf5, 0xf4, 0x90, 0xd8, 0x9d, 0x13, 0x64, 0xaa, 0x7b, 0xfc,
+		0xcf, 0x60, 0x99, 0xf2, 0xf0, 0x08, 0xc9, 0x44, 0x3c, 0x87, 0xe3, 0xa3,
+		0xa4, 0xfd, 0x86, 0xe2, 0xff, 0x01, 0x8a, 0x29, 0xe3, 0xbf, 0x61, 0xf8,
+		0xff, 0x16, 0xc3, 0xc7, 0x68, 0xfe, 0x15, 0xc7, 0xf5, 0x37, 0x90, 0xfd,
+		0x83, 0xbf, 0x37, 0xf4, 0xf7, 0x0f, 0x1a, 0x04, 0x5d, 0x89, 0x20, 0x99,
+		0x75, 0x34, 0x96, 0x4a, 0x54, 0xf0, 0xb2, 0xfd, 0xb9, 0x05, 0x92, 0xfe,
+		0xaa, 0x35, 0x79, 0x95, 0xdc, 0xb0, 0x07, 0x3a, 0x2e, 0x80, 0xd3, 0xf7,
+		0x4b, 0x82, 0xfe, 0x4f, 0xba, 0xf0, 0xbf, 0x4e, 0xec, 0xf7, 0xaf, 0x3c,
+		0xe2, 0x47, 0xa7, 0x4e, 0x9d, 0x01, 0x7b, 0x68, 0x85, 0x21, 0xcc, 0x83,
+		0x33, 0x3d, 0x7b, 0xd0, 0xf0, 0xa6, 0x6d, 0xf6, 0xde, 0x93, 0x7e, 0xc2,
+		0x1c, 0x1d, 0xf5, 0x38, 0xa1, 0x8e, 0x8a, 0x69, 0x92, 0xc1, 0x26, 0xe4,
+		0xca, 0x73, 0x08, 0xe2, 0x64, 0xf0, 0xc2, 0x84, 0x80, 0x32, 0xc7, 0x07,
+		0x6e, 0xc4, 0x64, 0x84, 0xb7, 0x83, 0x55, 0x43, 0xdc, 0x08, 0xda, 0x1f,
+		0x5c, 0xe7, 0x91, 0xa7, 0xdf, 0x30, 0x87, 0xb0, 0xdf, 0xb7, 0xf3, 0xfb,
+		0x05, 0x4f, 0x7c, 0x2e, 0x49, 0xae, 0xbd, 0x2b, 0x35, 0xb5, 0xdd, 0xed,
+		0xe8, 0x17, 0x23, 0xfc, 0xd7, 0xc0, 0x48, 0x34, 0xbc, 0x55, 0x45, 0x24,
+		0xfb, 0x92, 0x28, 0xd0, 0x51, 0x5e, 0xf5, 0xad, 0x13, 0xf9, 0x4e, 0x3b,
+		0xb4, 0x52, 0xe7, 0xfa, 0x51, 0xa7, 0x9d, 0x72, 0xfb, 0x5e, 0x1a, 0x1d,
+		0xf7, 0xce, 0x68, 0x94, 0xd5, 0xa7, 0xe9, 0xed, 0x6e, 0x6a, 0x87, 0x22,
+		0xb4, 0x57, 0xb6, 0x41, 0xf0, 0x3e, 0x08, 0xf2, 0x83, 0x38, 0x0b, 0x7a,
+		0x45, 0x0e, 0x4d, 0xfd, 0x94, 0xfc, 0x51, 0x64, 0x41, 0xcb, 0xb6, 0xd3,
+		0x45, 0x97, 0x90, 0x37, 0xa0, 0x34, 0x90, 0xd8, 0x53, 0x26, 0xe8, 0x6e,
+		0xda, 0x2f, 0xa8, 0x74, 0xa7, 0xd6, 0x45, 0x90, 0xd6, 0xdf, 0x80, 0x84,
+		0x67, 0x7f, 0xd2, 0x34, 0x1a, 0xbb, 0x52, 0x58, 0x30, 0xfe, 0x76, 0xa3,
+		0x95, 0x7c, 0x00, 0xa1, 0x0a, 0xd9, 0x70, 0xb4, 0xfe, 0xec, 0xaa, 0x18,
+		0x47, 0xd8, 0x08, 0x57, 0xb6, 0xdd, 0x9e, 0x89, 0x05, 0xab, 0x84, 0x5f,
+		0x2c, 0x4b, 0xc5, 0x02, 0x9c, 0xd6, 0x32, 0x19, 0xae, 0xd0, 0xdd, 0xbb,
+		0xe8, 0x05, 0xb2, 0xef, 0xe2, 0x18, 0xd2, 0xfe, 0xb2, 0x05, 0x71, 0x4c,
+		0x80, 0xce, 0x52, 0x0f, 0xed, 0x2c, 0x2d, 0x5d, 0x25, 0x17, 0xe3, 0x7f,
+		0x0f, 0x00, 0x2a, 0xef, 0xfb, 0x3b, 0xb0, 0x18, 0x00, 0x00,
+	},
+		"static/index.html",
+	)
+}
+
+// Asset loads and returns the asset for the given name.
+// It returns an error if the asset could not be found or
+// could not be loaded.
+func Asset(name string) ([]byte, error) {
+	cannonicalName := strings.Replace(name, "\\", "/", -1)
+	if f, ok := _bindata[cannonicalName]; ok {
+		return f()
+	}
+	return nil, fmt.Errorf("Asset %s not found", name)
+}
+
+// AssetNames returns the names of the assets.
+func AssetNames() []string {
+	names := make([]string, 0, len(_bindata))
+	for name := range _bindata {
+		names = append(names, name)
+	}
+	return names
+}
+
+// _bindata is a table, holding each asset generator, mapped to its name.
+var _bindata = map[string]func() ([]byte, error){
+	"static/index.html": static_index_html,
+}
+// AssetDir returns the file names below a certain
+// directory embedded in the file by go-bindata.
+// For example if you run go-bindata on data/... and data contains the
+// following hierarchy:
+//     data/
+//       foo.txt
+//       img/
+//         a.png
+//         b.png
+// then AssetDir("data") would return []string{"foo.txt", "img"}
+// AssetDir("data/img") would return []string{"a.png", "b.png"}
+// AssetDir("foo.txt") and AssetDir("notexist") would return an error
+// AssetDir("") will return []string{"data"}.
+func AssetDir(name string) ([]string, error) {
+	node := _bintree
+	if len(name) != 0 {
+		cannonicalName := strings.Replace(name, "\\", "/", -1)
+		pathList := strings.Split(cannonicalName, "/")
+		for _, p := range pathList {
+			node = node.Children[p]
+			if node == nil {
+				return nil, fmt.Errorf("Asset %s not found", name)
+			}
+		}
+	}
+	if node.Func != nil {
+		return nil, fmt.Errorf("Asset %s not found", name)
+	}
+	rv := make([]string, 0, len(node.Children))
+	for name := range node.Children {
+		rv = append(rv, name)
+	}
+	return rv, nil
+}
+
+type _bintree_t struct {
+	Func func() ([]byte, error)
+	Children map[string]*_bintree_t
+}
+var _bintree = &_bintree_t{nil, map[string]*_bintree_t{
+	"static": &_bintree_t{nil, map[string]*_bintree_t{
+		"index.html": &_bintree_t{static_index_html, map[string]*_bintree_t{
+		}},
+	}},
+}}
@@ -0,0 +1,241 @@
+package amiinventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AppliedTrust/amibackup/pkg/discovery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// contract is the fake AWS state in discovery/testdata/contract.json, and the backups every tool
+// must find in it - amibackup's tests check its purge against the same file
+type contract struct {
+	Hostname  string        `json:"hostname"`
+	TagPrefix string        `json:"tag_prefix"`
+	Images    []types.Image `json:"images"`
+	Backups   []string      `json:"backups"`
+}
+
+// apiOption answers DescribeImages as EC2 would, by the tag filters asked for, ahead of sending
+func (k *contract) apiOption(t *testing.T) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("contract", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if op := awsmiddleware.GetOperationName(ctx); op != "DescribeImages" {
+				t.Errorf("unexpected EC2 call %s", op)
+				return middleware.InitializeOutput{}, middleware.Metadata{}, fmt.Errorf("unexpected EC2 call %s", op)
+			}
+			out := &ec2.DescribeImagesOutput{}
+			for _, img := range k.Images {
+				matches := true
+				for _, filter := range in.Parameters.(*ec2.DescribeImagesInput).Filters {
+					key, ok := strings.CutPrefix(aws.ToString(filter.Name), "tag:")
+					matches = matches && ok && slices.Contains(filter.Values, discovery.TagValue(img.Tags, key))
+				}
+				if matches {
+					out.Images = append(out.Images, img)
+				}
+			}
+			return middleware.InitializeOutput{Result: out}, middleware.Metadata{}, nil
+		}), middleware.Before)
+	}
+}
+
+func TestDiscoveryContract(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "discovery", "testdata", "contract.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k contract
+	if err := json.Unmarshal(data, &k); err != nil {
+		t.Fatalf("contract.json: %s", err)
+	}
+	s := &session{InstanceNameTag: k.Hostname, tagPrefix: k.TagPrefix, legacyTags: true}
+	s.cfg = aws.Config{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{k.apiOption(t)},
+	}
+
+	amis, err := s.findAMIs(context.Background(), "us-east-1")
+	if err != nil {
+		t.Fatalf("findAMIs: %s", err)
+	}
+	found := []string{}
+	for _, ami := range *amis {
+		found = append(found, ami.Id)
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, k.Backups) {
+		t.Errorf("inventory found %v, want the contract's backups %v", found, k.Backups)
+	}
+}
+
+func TestBuildCoverage(t *testing.T) {
+	denver := time.FixedZone("MST", -7*60*60)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, denver)
+	at := func(day, hour int) time.Time { return time.Date(2026, 3, day, hour, 0, 0, 0, denver) }
+	source := &amiList{
+		{Id: "ami-s1", When: at(8, 1)},
+		{Id: "ami-s2", When: at(8, 13)},
+		// 23:00 in Denver is the next day in UTC; the day is Denver's
+		{Id: "ami-s3", When: at(9, 23)},
+		{Id: "ami-s4", When: at(10, 1), State: "failed"},
+	}
+	dest := &amiList{{Id: "ami-d1", When: at(8, 2)}}
+
+	coverage := buildCoverage(source, dest, "us-east-1", "us-west-2", 3, now, denver)
+	want := []coverageRow{
+		{"us-east-1", []coverageDay{
+			{"2026-03-08", 2, coverageBackup},
+			{"2026-03-09", 1, coverageBackup},
+			{"2026-03-10", 0, coverageNone},
+		}},
+		{"us-west-2", []coverageDay{
+			{"2026-03-08", 1, coverageBackup},
+			{"2026-03-09", 0, coverageCopyMissing},
+			// the source's only backup that day failed, so no copy is missing
+			{"2026-03-10", 0, coverageNone},
+		}},
+	}
+	if !reflect.DeepEqual(coverage, want) {
+		t.Errorf("coverage = %+v, want %+v", coverage, want)
+	}
+
+	same := buildCoverage(source, source, "us-east-1", "us-east-1", 3, now, denver)
+	if len(same) != 1 || !reflect.DeepEqual(same[0], want[0]) {
+		t.Errorf("coverage with one region = %+v, want %+v", same, want[:1])
+	}
+	if days := buildCoverage(source, dest, "us-east-1", "us-west-2", 90, now, denver)[0].Days; len(days) != 90 || days[89].Date != "2026-03-10" {
+		t.Errorf("--days=90 covered %d days to %s, want 90 to 2026-03-10", len(days), days[len(days)-1].Date)
+	}
+}
+
+func TestWriteReportJSON(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	source := &amiList{{Id: "ami-s1", Region: "us-east-1", Name: "web-1", State: "available", When: now.Add(-time.Hour)}}
+	dest := &amiList{}
+	s := &session{InstanceNameTag: "web", location: time.UTC}
+	coverage := buildCoverage(source, dest, "us-east-1", "us-west-2", 2, now, time.UTC)
+
+	var out bytes.Buffer
+	if err := writeReportJSON(&out, s, source, dest, coverage, now); err != nil {
+		t.Fatalf("writeReportJSON: %s", err)
+	}
+	var report struct {
+		Hostname string `json:"hostname"`
+		TimeZone string `json:"time_zone"`
+		AMIs     []struct {
+			Id     string `json:"ami_id"`
+			Region string `json:"region"`
+		} `json:"amis"`
+		Coverage []coverageRow `json:"coverage"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("report isn't JSON: %s\n%s", err, out.String())
+	}
+	if report.Hostname != "web" || report.TimeZone != "UTC" || len(report.AMIs) != 1 || report.AMIs[0].Id != "ami-s1" {
+		t.Errorf("report = %+v", report)
+	}
+	if !reflect.DeepEqual(report.Coverage, coverage) {
+		t.Errorf("report coverage = %+v, want %+v", report.Coverage, coverage)
+	}
+}
+
+func TestReportFreshness(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	s := &session{InstanceNameTag: "web", DestRegion: "us-west-2", freshWithin: 26 * time.Hour}
+	tests := []struct {
+		name   string
+		amis   amiList
+		status int
+		want   string
+	}{
+		{"fresh", amiList{{Id: "ami-1", State: "available", When: now.Add(-30 * time.Hour)}, {Id: "ami-2", State: "available", When: now.Add(-2 * time.Hour)}}, 0, "FRESH (newest backup ami-2 is 2h0m0s old)"},
+		// a newer copy that isn't available yet doesn't count
+		{"stale", amiList{{Id: "ami-1", State: "available", When: now.Add(-30 * time.Hour)}, {Id: "ami-2", State: "pending", When: now.Add(-time.Hour)}}, exitStale, "STALE (newest backup ami-1 is 30h0m0s old)"},
+		{"none", amiList{{Id: "ami-1", State: "failed", When: now.Add(-time.Hour)}}, exitStale, "STALE (no available backup)"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if status := s.reportFreshness(&out, &tt.amis, now); status != tt.status || !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: reportFreshness = %d, %q; want %d, %q", tt.name, status, out.String(), tt.status, tt.want)
+		}
+	}
+}
+
+func TestReportGap(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	s := &session{InstanceNameTag: "web", DestRegion: "us-west-2", maxGap: 26 * time.Hour}
+	tests := []struct {
+		name   string
+		amis   amiList
+		status int
+		want   string
+	}{
+		{"no gap", amiList{{Id: "ami-1", State: "available", When: now.Add(-50 * time.Hour)}, {Id: "ami-2", State: "available", When: now.Add(-26 * time.Hour)}, {Id: "ami-3", State: "available", When: now.Add(-2 * time.Hour)}},
+			0, "web in us-west-2: NO GAP (longest gap 24h0m0s; oldest backup 50h0m0s old)"},
+		// a failed backup doesn't fill the gap it was meant to
+		{"gap", amiList{{Id: "ami-1", State: "available", When: now.Add(-50 * time.Hour)}, {Id: "ami-2", State: "failed", When: now.Add(-26 * time.Hour)}, {Id: "ami-3", State: "available", When: now.Add(-2 * time.Hour)}},
+			exitGap, "web in us-west-2: GAP (48h0m0s without a backup after 2026-03-08T10:00:00Z; oldest backup 50h0m0s old)"},
+		{"since the newest", amiList{{Id: "ami-1", State: "available", When: now.Add(-30 * time.Hour)}}, exitGap, "GAP (30h0m0s without a backup after"},
+		{"none", amiList{}, exitGap, "web in us-west-2: GAP (no available backup)"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if status := s.reportGap(&out, &tt.amis, now); status != tt.status || !strings.Contains(out.String(), tt.want) {
+			t.Errorf("%s: reportGap = %d, %q; want %d, %q", tt.name, status, out.String(), tt.status, tt.want)
+		}
+	}
+}
+
+func TestReportTagFreshness(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	s := &session{InstanceNameTag: "web", freshWithin: 26 * time.Hour}
+	instance := func(id, lastSuccess string) types.Instance {
+		i := types.Instance{InstanceId: aws.String(id)}
+		if lastSuccess != "" {
+			i.Tags = []types.Tag{{Key: aws.String(lastSuccessTag), Value: aws.String(lastSuccess)}}
+		}
+		return i
+	}
+	tests := []struct {
+		name      string
+		instances []types.Instance
+		status    int
+		want      []string
+	}{
+		{"fresh", []types.Instance{instance("i-1", "2026-03-10T02:00:00Z")}, 0, []string{"web (i-1): FRESH (last backed up 10h0m0s ago)"}},
+		// one stale instance makes the host stale
+		{"one stale", []types.Instance{instance("i-1", "2026-03-10T02:00:00Z"), instance("i-2", "2026-03-08T02:00:00Z")}, exitStale,
+			[]string{"web (i-1): FRESH", "web (i-2): STALE (last backed up 58h0m0s ago)"}},
+		{"untagged", []types.Instance{instance("i-1", "")}, exitStale, []string{"STALE (no amibackup:last-success tag)"}},
+		{"bad tag", []types.Instance{instance("i-1", "yesterday")}, exitStale, []string{`STALE (bad amibackup:last-success tag "yesterday")`}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		status := s.reportTagFreshness(&out, tt.instances, now)
+		if status != tt.status {
+			t.Errorf("%s: reportTagFreshness = %d, want %d", tt.name, status, tt.status)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: report doesn't say %q:\n%s", tt.name, want, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package discovery finds a host's backups and reads their tags, shared by amibackup (purging)
+// and amiinventory (reporting) so both tools see exactly the same backups - and skip the same
+// images, for the same reasons.
+package discovery
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Problem is why an image found under a host's hostname tag isn't counted as a backup
+type Problem string
+
+const (
+	MissingTimestamp Problem = "missing timestamp tag" // made by hand, or a run died before tagging it
+	CorruptTimestamp Problem = "corrupt timestamp tag"
+)
+
+// Tags are the keys backup tags are written and read under: Prefix before each name, and with
+// Legacy, the unprefixed name too
+type Tags struct {
+	Prefix string
+	Legacy bool
+}
+
+// Key returns the key one of the backup tags is written under
+func (t Tags) Key(name string) string {
+	return t.Prefix + name
+}
+
+// HostnameKeys returns the hostname tag keys backups are found by: the prefixed one, and with
+// Legacy the unprefixed one too
+func (t Tags) HostnameKeys() []string {
+	keys := []string{t.Key("hostname")}
+	if t.Legacy && t.Prefix != "" {
+		keys = append(keys, "hostname")
+	}
+	return keys
+}
+
+// Value returns the value of one of the backup tags, falling back to the unprefixed key with Legacy
+func (t Tags) Value(tags []types.Tag, name string) string {
+	value := TagValue(tags, t.Key(name))
+	if value == "" && t.Legacy {
+		value = TagValue(tags, name)
+	}
+	return value
+}
+
+// TagValue returns the value of the named tag, or "" if it isn't set
+func TagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if tag.Key != nil && *tag.Key == key && tag.Value != nil {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// Backup is an image with a good timestamp tag
+type Backup struct {
+	Image      types.Image
+	Id         string
+	When       time.Time // from the timestamp tag
+	Hostname   string
+	InstanceId string
+}
+
+// Skipped is an image found for a host that isn't a backup, and why
+type Skipped struct {
+	Id      string
+	Problem Problem
+}
+
+// Classify splits a host's images into backups, in the order given, and the images that aren't
+func Classify(images []types.Image, t Tags) ([]Backup, []Skipped) {
+	backups := []Backup{}
+	skipped := []Skipped{}
+	for _, image := range images {
+		id := aws.ToString(image.ImageId)
+		timestampTag := t.Value(image.Tags, "timestamp")
+		if timestampTag == "" {
+			skipped = append(skipped, Skipped{id, MissingTimestamp})
+			continue
+		}
+		timestamp, err := strconv.ParseInt(timestampTag, 10, 64)
+		if err != nil {
+			skipped = append(skipped, Skipped{id, CorruptTimestamp})
+			continue
+		}
+		backups = append(backups, Backup{
+			Image:      image,
+			Id:         id,
+			When:       time.Unix(timestamp, 0),
+			Hostname:   t.Value(image.Tags, "hostname"),
+			InstanceId: t.Value(image.Tags, "instance"),
+		})
+	}
+	return backups, skipped
+}
+
+// LogSkipped logs each image Classify skipped - every tool logs them the same way, so a report
+// and a purge that disagree can be told apart from one that quietly dropped an image
+func LogSkipped(skipped []Skipped) {
+	for _, s := range skipped {
+		log.Printf("Skipping AMI %s: %s", s.Id, s.Problem)
+	}
+}
+
+// DescribeBackups runs DescribeImages for a host's images, once per hostname tag key, adding
+// the hostname filter to input's filters
+func DescribeBackups(ctx context.Context, awsec2 *ec2.Client, input *ec2.DescribeImagesInput, hostname string, t Tags) (*ec2.DescribeImagesOutput, error) {
+	out := &ec2.DescribeImagesOutput{}
+	seen := map[string]bool{}
+	for _, key := range t.HostnameKeys() {
+		in := *input
+		in.Filters = append([]types.Filter{{Name: aws.String("tag:" + key), Values: []string{hostname}}}, input.Filters...)
+		resp, err := DescribeAllImages(ctx, awsec2, &in)
+		if err != nil {
+			return out, err
+		}
+		for _, image := range resp.Images {
+			if !seen[*image.ImageId] {
+				seen[*image.ImageId] = true
+				out.Images = append(out.Images, image)
+			}
+		}
+	}
+	return out, nil
+}
+
+// DescribeAllImages runs DescribeImages through every page of results, leaving out deregistered
+// images: EC2 can go on returning an image for a while after DeregisterImage, and counting it
+// again would purge it twice and hold its snapshots for an AMI that is gone
+func DescribeAllImages(ctx context.Context, awsec2 *ec2.Client, input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	out := &ec2.DescribeImagesOutput{}
+	pages := ec2.NewDescribeImagesPaginator(awsec2, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, err
+		}
+		for _, image := range page.Images {
+			switch {
+			case image.ImageId == nil:
+				log.Printf("WARNING: DescribeImages returned an image with no ID - ignoring it")
+			case image.State != types.ImageStateDeregistered:
+				out.Images = append(out.Images, image)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Find lists a host's backups in a region and the images found for it that aren't backups
+func Find(ctx context.Context, awsec2 *ec2.Client, hostname string, t Tags) ([]Backup, []Skipped, error) {
+	resp, err := DescribeBackups(ctx, awsec2, &ec2.DescribeImagesInput{}, hostname, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	backups, skipped := Classify(resp.Images, t)
+	return backups, skipped, nil
+}
@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// image returns an AMI with the tags given as key, value pairs
+func image(id string, kv ...string) types.Image {
+	img := types.Image{ImageId: aws.String(id)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		img.Tags = append(img.Tags, types.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+	}
+	return img
+}
+
+func TestClassifyMixedPrefixes(t *testing.T) {
+	images := []types.Image{
+		image("ami-prefixed", "amibackup:hostname", "web", "amibackup:timestamp", "1700000000"),
+		image("ami-unprefixed", "hostname", "web", "timestamp", "1600000000"),
+		image("ami-both", "amibackup:hostname", "web", "amibackup:timestamp", "1700000100", "timestamp", "1"),
+		image("ami-untagged", "Name", "web"),
+	}
+	tests := []struct {
+		name    string
+		tags    Tags
+		backups map[string]int64
+		skipped []string
+	}{
+		{
+			name:    "prefix only",
+			tags:    Tags{Prefix: "amibackup:"},
+			backups: map[string]int64{"ami-prefixed": 1700000000, "ami-both": 1700000100},
+			skipped: []string{"ami-unprefixed", "ami-untagged"},
+		},
+		{
+			name:    "prefix and the unprefixed tags",
+			tags:    Tags{Prefix: "amibackup:", Legacy: true},
+			backups: map[string]int64{"ami-prefixed": 1700000000, "ami-unprefixed": 1600000000, "ami-both": 1700000100},
+			skipped: []string{"ami-untagged"},
+		},
+		{
+			name:    "no prefix",
+			tags:    Tags{},
+			backups: map[string]int64{"ami-unprefixed": 1600000000, "ami-both": 1},
+			skipped: []string{"ami-prefixed", "ami-untagged"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backups, skipped := Classify(images, tt.tags)
+			got := map[string]int64{}
+			for _, b := range backups {
+				got[b.Id] = b.When.Unix()
+				if b.Hostname != "" && b.Hostname != "web" {
+					t.Errorf("%s has hostname %q", b.Id, b.Hostname)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.backups) {
+				t.Errorf("backups = %v, want %v", got, tt.backups)
+			}
+			ids := []string{}
+			for _, s := range skipped {
+				ids = append(ids, s.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.skipped) {
+				t.Errorf("skipped = %v, want %v", ids, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestHostnameKeys(t *testing.T) {
+	for _, tt := range []struct {
+		tags Tags
+		want []string
+	}{
+		{Tags{}, []string{"hostname"}},
+		{Tags{Legacy: true}, []string{"hostname"}},
+		{Tags{Prefix: "amibackup:"}, []string{"amibackup:hostname"}},
+		{Tags{Prefix: "amibackup:", Legacy: true}, []string{"amibackup:hostname", "hostname"}},
+	} {
+		if got := tt.tags.HostnameKeys(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.HostnameKeys() = %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Package purge holds the purge window logic shared by amibackup (deciding what to purge)
+// and amiinventory (checking what a retention policy requires), so both tools bucket backups
+// - and measure the gaps between them - in exactly the same way.
+package purge
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window keeps one backup per Interval for backups made between Start and Stop
+type Window struct {
+	Interval time.Duration
+	Start    time.Time
+	Stop     time.Time
+}
+
+// Bucket is one interval of a window and the images that fall inside it
+type Bucket struct {
+	Start  time.Time
+	End    time.Time
+	Images []string
+}
+
+// Buckets splits a window into interval-sized buckets, oldest first, and sorts images into them (oldest first).
+// Each bucket is half-open, [Start, End), so an image made exactly on a boundary lands in exactly one bucket.
+func (w Window) Buckets(images map[string]time.Time) []Bucket {
+	buckets := []Bucket{}
+	for cursor := w.Start; cursor.Before(w.Stop); cursor = cursor.Add(w.Interval) {
+		b := Bucket{Start: cursor, End: cursor.Add(w.Interval)}
+		if b.End.After(w.Stop) {
+			b.End = w.Stop
+		}
+		for id, when := range images {
+			if !when.Before(b.Start) && when.Before(b.End) {
+				b.Images = append(b.Images, id)
+			}
+		}
+		SortByTime(b.Images, images)
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// Kept returns the image a bucket keeps - its oldest, or its newest if keepNewest - or "" if it is empty
+func (b Bucket) Kept(keepNewest bool) string {
+	if len(b.Images) == 0 {
+		return ""
+	}
+	if keepNewest {
+		return b.Images[len(b.Images)-1]
+	}
+	return b.Images[0]
+}
+
+// SelectForPurge decides which images the windows purge: every interval of every window keeps
+// one of its images and purges the rest.  Where windows overlap they can disagree, and keep wins:
+// an image any window keeps is kept, so the denser window rules the overlap.  Images outside
+// every window are kept.  Both lists are sorted oldest first.
+func SelectForPurge(windows []Window, images map[string]time.Time, keepNewest bool) (purge []string, keep []string) {
+	kept := KeptByAny(windows, images, keepNewest)
+	bucketed := map[string]bool{}
+	for _, w := range windows {
+		for _, b := range w.Buckets(images) {
+			for _, id := range b.Images {
+				bucketed[id] = true
+			}
+		}
+	}
+	purge, keep = []string{}, []string{}
+	for id := range images {
+		if bucketed[id] && !kept[id] {
+			purge = append(purge, id)
+		} else {
+			keep = append(keep, id)
+		}
+	}
+	SortByTime(purge, images)
+	SortByTime(keep, images)
+	return purge, keep
+}
+
+// KeptByAny returns the images some window's interval keeps
+func KeptByAny(windows []Window, images map[string]time.Time, keepNewest bool) map[string]bool {
+	kept := map[string]bool{}
+	for _, w := range windows {
+		for _, b := range w.Buckets(images) {
+			if id := b.Kept(keepNewest); id != "" {
+				kept[id] = true
+			}
+		}
+	}
+	return kept
+}
+
+// Overlap is a span of time two windows both cover
+type Overlap struct {
+	A, B       Window
+	Start, End time.Time
+}
+
+// Overlaps lists every span two of the windows both cover, where they may disagree
+func Overlaps(windows []Window) []Overlap {
+	overlaps := []Overlap{}
+	for i := range windows {
+		for j := i + 1; j < len(windows); j++ {
+			a, b := windows[i], windows[j]
+			start, end := a.Start, a.Stop
+			if b.Start.After(start) {
+				start = b.Start
+			}
+			if b.Stop.Before(end) {
+				end = b.Stop
+			}
+			if start.Before(end) {
+				overlaps = append(overlaps, Overlap{a, b, start, end})
+			}
+		}
+	}
+	return overlaps
+}
+
+// Coverage is how far back a host's backups reach, and the longest stretch they leave without
+// one - "restorable to any point in the last N days" holds while MaxGap stays under the
+// backup interval and Oldest is at least N days back
+type Coverage struct {
+	Backups  int
+	Oldest   time.Time     // zero without backups
+	MaxGap   time.Duration // between two backups in a row, or from the newest to now
+	GapStart time.Time     // the backup MaxGap follows
+}
+
+// MeasureCoverage measures the coverage of backups made at these times, as of now
+func MeasureCoverage(times []time.Time, now time.Time) Coverage {
+	if len(times) == 0 {
+		return Coverage{}
+	}
+	sorted := append([]time.Time{}, times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+	c := Coverage{Backups: len(sorted), Oldest: sorted[0]}
+	for i, t := range sorted {
+		next := now
+		if i+1 < len(sorted) {
+			next = sorted[i+1]
+		}
+		if gap := next.Sub(t); gap > c.MaxGap {
+			c.MaxGap, c.GapStart = gap, t
+		}
+	}
+	return c
+}
+
+// SortByTime sorts image ids oldest first
+func SortByTime(ids []string, images map[string]time.Time) {
+	sort.Slice(ids, func(i, j int) bool {
+		if images[ids[i]].Equal(images[ids[j]]) {
+			return ids[i] < ids[j]
+		}
+		return images[ids[i]].Before(images[ids[j]])
+	})
+}
+
+// ParseWindow parses a PURGE_INTERVAL:PURGE_START:PURGE_END window relative to now
+func ParseWindow(w string, now time.Time) (Window, error) {
+	newWindow := Window{}
+	parts := strings.Split(w, ":")
+	if len(parts) != 3 {
+		return newWindow, fmt.Errorf("Malformed purge window: %s", w)
+	}
+	converted, err := DaysToHours(parts[0])
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window interval: %s %s", w, err.Error())
+	}
+	newWindow.Interval, err = time.ParseDuration(converted)
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window interval: %s %s", w, err.Error())
+	}
+	if newWindow.Interval <= 0 {
+		return newWindow, fmt.Errorf("Malformed purge window interval: %s must be positive", w)
+	}
+	converted, err = DaysToHours(parts[1])
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window start: %s %s", w, err.Error())
+	}
+	timeAgo, err := time.ParseDuration(converted)
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window start: %s %s", w, err.Error())
+	}
+	newWindow.Stop = now.Add(-timeAgo)
+	converted, err = DaysToHours(parts[2])
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window stop: %s %s", w, err.Error())
+	}
+	timeAgo, err = time.ParseDuration(converted)
+	if err != nil {
+		return newWindow, fmt.Errorf("Malformed purge window stop: %s %s", w, err.Error())
+	}
+	newWindow.Start = now.Add(-timeAgo)
+	return newWindow, nil
+}
+
+// retentionForever is how far back an open-ended retention rule (30d+) reaches
+var retentionForever = 10 * 365 * 24 * time.Hour
+
+// retention periods understood by ParseRetentionPolicy
+var retentionPeriods = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+}
+
+// ParseRetentionPolicy translates COUNTxPERIOD[:FROM-TO|:FROM+] rules into purge windows.  A rule
+// without a range applies from now until the next rule starts (or forever if none does).
+func ParseRetentionPolicy(rules []string, now time.Time) ([]Window, error) {
+	type rule struct {
+		interval time.Duration
+		from, to time.Duration
+		ranged   bool
+		spec     string
+	}
+	parsed := []rule{}
+	for _, spec := range rules {
+		r := rule{spec: spec, to: retentionForever}
+		parts := strings.SplitN(spec, ":", 2)
+		cp := strings.SplitN(parts[0], "x", 2)
+		if len(cp) != 2 {
+			return nil, fmt.Errorf("Malformed retention rule: %s", spec)
+		}
+		count, err := strconv.Atoi(cp[0])
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("Malformed retention rule count: %s", spec)
+		}
+		period, ok := retentionPeriods[cp[1]]
+		if !ok {
+			return nil, fmt.Errorf("Malformed retention rule period: %s (want hour, day, week, month or year)", spec)
+		}
+		r.interval = period / time.Duration(count)
+		if len(parts) == 2 {
+			r.ranged = true
+			rng := parts[1]
+			if strings.HasSuffix(rng, "+") {
+				if r.from, err = parseRetentionAge(strings.TrimSuffix(rng, "+")); err != nil {
+					return nil, fmt.Errorf("Malformed retention rule range: %s %s", spec, err.Error())
+				}
+			} else {
+				fromTo := strings.SplitN(rng, "-", 2)
+				if len(fromTo) != 2 {
+					return nil, fmt.Errorf("Malformed retention rule range: %s (want FROM-TO or FROM+)", spec)
+				}
+				if r.from, err = parseRetentionAge(fromTo[0]); err != nil {
+					return nil, fmt.Errorf("Malformed retention rule range: %s %s", spec, err.Error())
+				}
+				if r.to, err = parseRetentionAge(fromTo[1]); err != nil {
+					return nil, fmt.Errorf("Malformed retention rule range: %s %s", spec, err.Error())
+				}
+			}
+			if r.to <= r.from {
+				return nil, fmt.Errorf("Malformed retention rule range: %s ends before it starts", spec)
+			}
+		}
+		parsed = append(parsed, r)
+	}
+	windows := []Window{}
+	for _, r := range parsed {
+		if !r.ranged {
+			// run until the nearest later rule takes over
+			for _, other := range parsed {
+				if other.ranged && other.from > 0 && other.from < r.to {
+					r.to = other.from
+				}
+			}
+		}
+		windows = append(windows, Window{Interval: r.interval, Start: now.Add(-r.to), Stop: now.Add(-r.from)})
+	}
+	return windows, nil
+}
+
+// parseRetentionAge parses an age such as 7d or 36h
+func parseRetentionAge(in string) (time.Duration, error) {
+	converted, err := DaysToHours(in)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(converted)
+}
+
+// DaysToHours is a helper to support 2d notation
+func DaysToHours(in string) (string, error) {
+	r, err := regexp.Compile(`^(\d+)d$`)
+	if err != nil {
+		return in, err
+	}
+	m := r.FindStringSubmatch(in)
+	if len(m) > 0 {
+		num, err := strconv.Atoi(m[1])
+		if err != nil {
+			return in, err
+		}
+		return fmt.Sprintf("%dh", num*24), nil
+	}
+	return in, nil
+}
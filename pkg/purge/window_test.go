@@ -0,0 +1,179 @@
+package purge
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectForPurge(t *testing.T) {
+	now := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	ago := func(h int) time.Time { return now.Add(-time.Duration(h) * time.Hour) }
+	daily := Window{Interval: 24 * time.Hour, Start: ago(96), Stop: now}
+	hourly := Window{Interval: time.Hour, Start: ago(24), Stop: now}
+
+	tests := []struct {
+		name       string
+		windows    []Window
+		images     map[string]time.Time
+		keepNewest bool
+		purge      []string
+		keep       []string
+	}{
+		{
+			name:    "no images",
+			windows: []Window{daily},
+			images:  map[string]time.Time{},
+			purge:   []string{},
+			keep:    []string{},
+		},
+		{
+			name:    "single image",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(30)},
+			purge:   []string{},
+			keep:    []string{"ami-1"},
+		},
+		{
+			name:    "empty buckets keep nothing and purge nothing",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(90), "ami-2": ago(5)},
+			purge:   []string{},
+			keep:    []string{"ami-1", "ami-2"},
+		},
+		{
+			name:    "one kept per bucket, oldest first",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(40), "ami-2": ago(36), "ami-3": ago(30)},
+			purge:   []string{"ami-2", "ami-3"},
+			keep:    []string{"ami-1"},
+		},
+		{
+			name:       "keep newest",
+			windows:    []Window{daily},
+			images:     map[string]time.Time{"ami-1": ago(40), "ami-2": ago(36), "ami-3": ago(30)},
+			keepNewest: true,
+			purge:      []string{"ami-1", "ami-2"},
+			keep:       []string{"ami-3"},
+		},
+		{
+			name:    "overlapping windows: the denser one wins",
+			windows: []Window{daily, hourly},
+			images:  map[string]time.Time{"ami-1": ago(23), "ami-2": ago(22), "ami-3": ago(21).Add(30 * time.Minute)},
+			purge:   []string{},
+			keep:    []string{"ami-1", "ami-2", "ami-3"},
+		},
+		{
+			name:    "overlapping windows: duplicates inside an hour still go",
+			windows: []Window{daily, hourly},
+			images:  map[string]time.Time{"ami-1": ago(23), "ami-2": ago(23).Add(10 * time.Minute)},
+			purge:   []string{"ami-2"},
+			keep:    []string{"ami-1"},
+		},
+		{
+			name:    "image on a bucket boundary belongs to the later bucket",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(48), "ami-2": ago(47)},
+			purge:   []string{"ami-2"},
+			keep:    []string{"ami-1"},
+		},
+		{
+			name:    "image on the window start is inside it",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(96), "ami-2": ago(95)},
+			purge:   []string{"ami-2"},
+			keep:    []string{"ami-1"},
+		},
+		{
+			name:    "image on the window stop is outside it",
+			windows: []Window{{Interval: 24 * time.Hour, Start: ago(96), Stop: ago(48)}},
+			images:  map[string]time.Time{"ami-1": ago(49), "ami-2": ago(48)},
+			purge:   []string{},
+			keep:    []string{"ami-1", "ami-2"},
+		},
+		{
+			name:    "images outside every window are kept",
+			windows: []Window{daily},
+			images:  map[string]time.Time{"ami-1": ago(200), "ami-2": ago(199)},
+			purge:   []string{},
+			keep:    []string{"ami-1", "ami-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purge, keep := SelectForPurge(tt.windows, tt.images, tt.keepNewest)
+			if !reflect.DeepEqual(purge, tt.purge) {
+				t.Errorf("purge = %v, want %v", purge, tt.purge)
+			}
+			if !reflect.DeepEqual(keep, tt.keep) {
+				t.Errorf("keep = %v, want %v", keep, tt.keep)
+			}
+		})
+	}
+}
+
+func TestBucketsBoundary(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := Window{Interval: time.Hour, Start: start, Stop: start.Add(3 * time.Hour)}
+	images := map[string]time.Time{"ami-1": start.Add(time.Hour)}
+	found := 0
+	for _, b := range w.Buckets(images) {
+		found += len(b.Images)
+		if len(b.Images) == 1 && !b.Start.Equal(images["ami-1"]) {
+			t.Errorf("ami-1 landed in the bucket starting %s, want %s", b.Start, images["ami-1"])
+		}
+	}
+	if found != 1 {
+		t.Errorf("ami-1 landed in %d buckets, want 1", found)
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	a := Window{Interval: 24 * time.Hour, Start: day(1), Stop: day(10)}
+	b := Window{Interval: 7 * 24 * time.Hour, Start: day(5), Stop: day(20)}
+	c := Window{Interval: time.Hour, Start: day(10), Stop: day(12)}
+	d := Window{Interval: time.Hour, Start: day(2), Stop: day(3)}
+
+	tests := []struct {
+		name    string
+		windows []Window
+		want    []Overlap
+	}{
+		{"none", nil, []Overlap{}},
+		{"one window", []Window{a}, []Overlap{}},
+		{"partial overlap", []Window{a, b}, []Overlap{{a, b, day(5), day(10)}}},
+		{"touching windows don't overlap", []Window{a, c}, []Overlap{}},
+		{"one inside the other", []Window{a, d}, []Overlap{{a, d, day(2), day(3)}}},
+		{"every pair", []Window{a, b, c}, []Overlap{{a, b, day(5), day(10)}, {b, c, day(10), day(12)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Overlaps(tt.windows); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Overlaps() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasureCoverage(t *testing.T) {
+	now := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name  string
+		times []time.Time
+		want  Coverage
+	}{
+		{"none", nil, Coverage{}},
+		{"one", []time.Time{day(30)}, Coverage{Backups: 1, Oldest: day(30), MaxGap: 24 * time.Hour, GapStart: day(30)}},
+		// out of order, with the longest gap between two backups
+		{"between", []time.Time{day(29), day(20), day(28), day(30)}, Coverage{Backups: 4, Oldest: day(20), MaxGap: 8 * 24 * time.Hour, GapStart: day(20)}},
+		// the newest backup to now is a gap too
+		{"since the newest", []time.Time{day(20), day(21)}, Coverage{Backups: 2, Oldest: day(20), MaxGap: 10 * 24 * time.Hour, GapStart: day(21)}},
+	}
+	for _, tt := range tests {
+		if got := MeasureCoverage(tt.times, now); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: MeasureCoverage() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package snapcleanup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/docopt/docopt-go"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const version = "0.1"
+
+var usage = `snapcleanup: clean up AWS snapshots by trying to delete ALL OF THEM
+
+Usage:
+  snapcleanup [options] [-f <key=value>]... <accountid>
+  snapcleanup -h --help
+  snapcleanup --version
+
+Options:
+  -r, --region=<region>     AWS region of running instance [default: us-east-1].
+  -d, --dry-run             Show what would be purged without purging it.
+  -l, --list                Print the snapshots that would be purged as JSON, with their count and monthly cost, without purging.
+  -o, --older-than=<age>    Only purge snapshots started more than this long ago (e.g. 36h or 30d).
+  -f, --tag-filter=<k=v>    Only purge snapshots with this tag - multiple use ok.
+  --report-orphan-snapshots  Print the snapshots not used by any of the account's AMIs as JSON, without purging.
+  --delete-orphan-snapshots  Delete the snapshots not used by any of the account's AMIs (honors --dry-run).
+  --orphan-min-age=<age>    Only delete orphan snapshots started more than this long ago (e.g. 36h or 30d), as a
+                            snapshot being made for a new AMI has no AMI yet [default: 24h].
+  --cost-per-gb-month=<n>   Snapshot storage price used for --list cost estimates [default: 0.05].
+  --debug                   Also log benign details, such as deletes that raced with a concurrent run.
+  -K, --awskey=<keyid>      AWS key ID (or use AWS_ACCESS_KEY_ID environemnt variable).
+  -S, --awssecret=<secret>  AWS secret key (or use AWS_SECRET_ACCESS_KEY environemnt variable).
+  --version                 Show version.
+  -h, --help                Show this screen.
+
+AWS Authentication:
+  Either use the -K and -S flags, or
+  set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+
+`
+
+type session struct {
+	dryRun             bool
+	list               bool
+	reportOrphans      bool
+	deleteOrphans      bool
+	olderThan          time.Duration
+	orphanMinAge       time.Duration
+	tagFilters         map[string]string
+	costPerGBMonth     float64
+	region             string
+	cfg                aws.Config
+	awsAccessKeyId     string
+	awsSecretAccessKey string
+	accountid          string
+	debug              bool
+}
+
+// time formatting
+var timeSecs = fmt.Sprintf("%d", time.Now().Unix())
+var timeStamp = time.Now().Format("2006-01-02_15-04-05")
+var timeShortFormat = "01/02/2006@15:04:05"
+var timeString = time.Now().Format("2006-01-02 15:04:05 -0700")
+
+// Main runs snapcleanup with the given command line arguments (without the program name)
+func Main(args []string) {
+	s := &session{}
+
+	handleOptions(s, args)
+	ctx := context.Background()
+
+	// connect to AWS
+	awsec2 := ec2.NewFromConfig(s.cfg, func(o *ec2.Options) {
+		o.Region = s.region
+	})
+
+	if s.list {
+		if err := listSnapshots(ctx, awsec2, s); err != nil {
+			log.Fatalf("Error listing snapshots: %s", err.Error())
+		}
+		return
+	}
+	if s.reportOrphans || s.deleteOrphans {
+		if err := orphanSnapshots(ctx, awsec2, s); err != nil {
+			log.Fatalf("Error finding orphan snapshots: %s", err.Error())
+		}
+		return
+	}
+
+	// purge old AMIs and snapshots
+	err := purgeAMIs(ctx, awsec2, s)
+	if err != nil {
+		log.Printf("Error purging snapshots: %s", err.Error())
+	}
+	log.Printf("Finished puring snapshots - exiting")
+}
+
+// snapshotListing is one snapshot in the --list output
+type snapshotListing struct {
+	Id          string            `json:"id"`
+	StartTime   string            `json:"startTime"`
+	VolumeId    string            `json:"volumeId"`
+	VolumeSize  int               `json:"volumeSize"`
+	Description string            `json:"description"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// findSnapshots returns the account's snapshots that match the --older-than and --tag-filter options
+func findSnapshots(ctx context.Context, awsec2 *ec2.Client, s *session) ([]types.Snapshot, error) {
+	filters := []types.Filter{{Name: aws.String("owner-id"), Values: []string{s.accountid}}}
+	for k, v := range s.tagFilters {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + k), Values: []string{v}})
+	}
+	snaps := []types.Snapshot{}
+	pages := ec2.NewDescribeSnapshotsPaginator(awsec2, &ec2.DescribeSnapshotsInput{Filters: filters})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("EC2 API DescribeSnapshots failed: %s", err.Error())
+		}
+		snaps = append(snaps, page.Snapshots...)
+	}
+	if s.olderThan == 0 {
+		return snaps, nil
+	}
+	return startedBefore(snaps, time.Now().Add(-s.olderThan)), nil
+}
+
+// startedBefore returns the snapshots started before cutoff
+func startedBefore(snaps []types.Snapshot, cutoff time.Time) []types.Snapshot {
+	matched := []types.Snapshot{}
+	for _, snap := range snaps {
+		if snap.StartTime == nil {
+			log.Printf("Skipping snapshot %s with no start time", aws.ToString(snap.SnapshotId))
+			continue
+		}
+		if snap.StartTime.Before(cutoff) {
+			matched = append(matched, snap)
+		}
+	}
+	return matched
+}
+
+// startTime formats a snapshot's start time for the JSON listings
+func startTime(snap types.Snapshot) string {
+	if snap.StartTime == nil {
+		return ""
+	}
+	return snap.StartTime.UTC().Format(time.RFC3339)
+}
+
+// tagValue returns the value of the named tag, or "" if it isn't set
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// listSnapshots prints the snapshots that would be purged as JSON, deleting nothing
+func listSnapshots(ctx context.Context, awsec2 *ec2.Client, s *session) error {
+	snaps, err := findSnapshots(ctx, awsec2, s)
+	if err != nil {
+		return err
+	}
+	listing := struct {
+		Snapshots            []snapshotListing `json:"snapshots"`
+		Count                int               `json:"count"`
+		TotalGB              int               `json:"totalGB"`
+		EstimatedMonthlyCost float64           `json:"estimatedMonthlyCost"`
+	}{Snapshots: []snapshotListing{}}
+	for _, snap := range snaps {
+		size := int(aws.ToInt32(snap.VolumeSize))
+		tags := map[string]string{}
+		for _, t := range snap.Tags {
+			tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+		}
+		listing.Snapshots = append(listing.Snapshots, snapshotListing{aws.ToString(snap.SnapshotId), startTime(snap), aws.ToString(snap.VolumeId), size, aws.ToString(snap.Description), tags})
+		listing.TotalGB += size
+	}
+	listing.Count = len(listing.Snapshots)
+	listing.EstimatedMonthlyCost = float64(listing.TotalGB) * s.costPerGBMonth
+	out, err := json.MarshalIndent(listing, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// orphanListing is one snapshot in the --report-orphan-snapshots output
+type orphanListing struct {
+	Id          string `json:"id"`
+	VolumeSize  int    `json:"volumeSize"`
+	StartTime   string `json:"startTime"`
+	Description string `json:"description"`
+	Name        string `json:"name,omitempty"`
+	RestoreHint string `json:"restoreHint,omitempty"`
+}
+
+// findOrphans returns the matching snapshots that no AMI owned by the account refers to
+func findOrphans(ctx context.Context, awsec2 *ec2.Client, s *session) ([]types.Snapshot, error) {
+	snaps, err := findSnapshots(ctx, awsec2, s)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	images := 0
+	pages := ec2.NewDescribeImagesPaginator(awsec2, &ec2.DescribeImagesInput{Owners: []string{"self"}})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("EC2 API DescribeImages failed: %s", err.Error())
+		}
+		images += len(page.Images)
+		for _, image := range page.Images {
+			for _, bd := range image.BlockDeviceMappings {
+				if bd.Ebs != nil && aws.ToString(bd.Ebs.SnapshotId) != "" {
+					used[*bd.Ebs.SnapshotId] = true
+				}
+			}
+		}
+	}
+	orphans := []types.Snapshot{}
+	for _, snap := range snaps {
+		if !used[aws.ToString(snap.SnapshotId)] {
+			orphans = append(orphans, snap)
+		}
+	}
+	log.Printf("Found %d orphan snaps of %d total (%d AMIs) in %s", len(orphans), len(snaps), images, s.region)
+	return orphans, nil
+}
+
+// orphanSnapshots prints the orphan snapshots as JSON, and with --delete-orphan-snapshots deletes them
+func orphanSnapshots(ctx context.Context, awsec2 *ec2.Client, s *session) error {
+	orphans, err := findOrphans(ctx, awsec2, s)
+	if err != nil {
+		return err
+	}
+	if s.reportOrphans {
+		listing := []orphanListing{}
+		for _, snap := range orphans {
+			listing = append(listing, orphanListing{
+				Id:          aws.ToString(snap.SnapshotId),
+				VolumeSize:  int(aws.ToInt32(snap.VolumeSize)),
+				StartTime:   startTime(snap),
+				Description: aws.ToString(snap.Description),
+				Name:        tagValue(snap.Tags, "Name"),
+				RestoreHint: tagValue(snap.Tags, "amibackup:restore-hint"),
+			})
+		}
+		out, err := json.MarshalIndent(listing, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	}
+	if s.deleteOrphans {
+		// a snapshot CreateImage or a copy is still making has no AMI yet
+		old := startedBefore(orphans, time.Now().Add(-s.orphanMinAge))
+		if young := len(orphans) - len(old); young > 0 {
+			log.Printf("Keeping %d orphan snapshots started less than %s ago", young, s.orphanMinAge)
+		}
+		deleteSnapshots(ctx, awsec2, old, s)
+	}
+	return nil
+}
+
+// deleteSnapshots deletes snapshots one at a time, slowing down if AWS throttles us.  A snapshot
+// a concurrent run deleted first counts as deleted.
+func deleteSnapshots(ctx context.Context, awsec2 *ec2.Client, snaps []types.Snapshot, s *session) {
+	races := 0
+	for _, snap := range snaps {
+		id := aws.ToString(snap.SnapshotId)
+		if s.dryRun {
+			log.Printf("DRYRUN: would have deleted snapshot: %s", id)
+			continue
+		}
+		_, err := awsec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(id)})
+		if raced(err, id, s) {
+			races++
+			continue
+		}
+		if err != nil {
+			log.Printf("EC2 API DeleteSnapshot failed for %s: %s", id, err.Error())
+			if errorCode(err) == "RequestLimitExceeded" {
+				log.Printf("Throttled - sleeping %s", throttleSleep)
+				time.Sleep(throttleSleep)
+			}
+			continue
+		}
+		log.Printf("Deleted snapshot: %s", id)
+	}
+	if races > 0 {
+		log.Printf("%d snapshots were already deleted by a concurrent run", races)
+	}
+}
+
+// raceCodes are the DeleteSnapshot error codes for a snapshot a concurrent run - another
+// snapcleanup, or an amibackup purge - deleted after we listed it
+var raceCodes = map[string]bool{"InvalidSnapshot.NotFound": true, "InvalidSnapshotID.NotFound": true}
+
+// throttleSleep is how long a throttled delete waits before going on
+var throttleSleep = 8 * time.Second
+
+// errorCode returns the AWS error code of err, or "" if it isn't an AWS API error
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// raced reports whether deleting a snapshot failed only because a concurrent run got there
+// first, logging it with --debug
+func raced(err error, snap string, s *session) bool {
+	code := errorCode(err)
+	if !raceCodes[code] {
+		return false
+	}
+	if s.debug {
+		log.Printf("DEBUG: DeleteSnapshot on %s raced with concurrent run (%s) - counting it as done", snap, code)
+	}
+	return true
+}
+
+// purgeAMIs purges AMIs based on name regex
+func purgeAMIs(ctx context.Context, awsec2 *ec2.Client, s *session) error {
+	snaps, err := findSnapshots(ctx, awsec2, s)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d total snaps in %s", len(snaps), s.region)
+	if s.dryRun {
+		log.Fatal("dryrun")
+	}
+	deleteSnapshots(ctx, awsec2, snaps, s)
+	return nil
+}
+
+// handleOptions parses CLI options
+func handleOptions(s *session, args []string) {
+	var ok bool
+	arguments, err := docopt.Parse(usage, args, true, version, false)
+	if err != nil {
+		log.Fatalf("Error parsing arguments: %s", err.Error())
+	}
+	s.region = arguments["--region"].(string)
+	s.accountid, ok = arguments["<accountid>"].(string)
+	if !ok {
+		log.Fatalf("Bad accountid: %s", arguments["<accountid>"].(string))
+	}
+	s.debug = arguments["--debug"].(bool)
+	if arguments["--dry-run"].(bool) {
+		s.dryRun = true
+	}
+	s.list = arguments["--list"].(bool)
+	s.reportOrphans = arguments["--report-orphan-snapshots"].(bool)
+	s.deleteOrphans = arguments["--delete-orphan-snapshots"].(bool)
+	if arg, ok := arguments["--older-than"].(string); ok {
+		s.olderThan, err = parseAge(arg)
+		if err != nil || s.olderThan <= 0 {
+			log.Fatalf("Bad older-than: %s", arg)
+		}
+	}
+	s.orphanMinAge, err = parseAge(arguments["--orphan-min-age"].(string))
+	if err != nil || s.orphanMinAge < 0 {
+		log.Fatalf("Bad orphan-min-age: %s", arguments["--orphan-min-age"].(string))
+	}
+	s.tagFilters = map[string]string{}
+	for _, f := range arguments["--tag-filter"].([]string) {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Fatalf("Bad tag-filter (want key=value): %s", f)
+		}
+		s.tagFilters[parts[0]] = parts[1]
+	}
+	s.costPerGBMonth, err = strconv.ParseFloat(arguments["--cost-per-gb-month"].(string), 64)
+	if err != nil || s.costPerGBMonth < 0 {
+		log.Fatalf("Bad cost-per-gb-month: %s", arguments["--cost-per-gb-month"].(string))
+	}
+	if arg, ok := arguments["--awskey"].(string); ok {
+		s.awsAccessKeyId = arg
+	}
+	if arg, ok := arguments["--awssecret"].(string); ok {
+		s.awsSecretAccessKey = arg
+	}
+	// parse environment variables
+	if len(s.awsAccessKeyId) < 1 {
+		s.awsAccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(s.awsSecretAccessKey) < 1 {
+		s.awsSecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(s.awsAccessKeyId) < 1 || len(s.awsSecretAccessKey) < 1 {
+		log.Fatal("Must use -K and -S options or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
+	}
+	s.cfg, err = config.LoadDefaultConfig(context.Background(),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(s.awsAccessKeyId, s.awsSecretAccessKey, "")))
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %s", err.Error())
+	}
+}
+
+// parseAge parses an age such as 36h or 30d
+func parseAge(arg string) (time.Duration, error) {
+	converted := arg
+	if strings.HasSuffix(arg, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(arg, "d"))
+		if err != nil {
+			return 0, err
+		}
+		converted = fmt.Sprintf("%dh", days*24)
+	}
+	return time.ParseDuration(converted)
+}
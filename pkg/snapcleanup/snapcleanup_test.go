@@ -0,0 +1,101 @@
+package snapcleanup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func TestStartedBefore(t *testing.T) {
+	now := time.Now()
+	snaps := []types.Snapshot{
+		{SnapshotId: aws.String("snap-old"), StartTime: aws.Time(now.Add(-48 * time.Hour))},
+		{SnapshotId: aws.String("snap-new"), StartTime: aws.Time(now.Add(-time.Hour))},
+		{SnapshotId: aws.String("snap-unknown")},
+	}
+	got := startedBefore(snaps, now.Add(-24*time.Hour))
+	if len(got) != 1 || aws.ToString(got[0].SnapshotId) != "snap-old" {
+		t.Errorf("startedBefore kept %v, want just snap-old", got)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for in, want := range map[string]time.Duration{"36h": 36 * time.Hour, "30d": 30 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		got, err := parseAge(in)
+		if err != nil || got != want {
+			t.Errorf("parseAge(%q) = %s, %v, want %s", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "xd", "3 days"} {
+		if _, err := parseAge(in); err == nil {
+			t.Errorf("parseAge(%q) succeeded", in)
+		}
+	}
+}
+
+func TestRaced(t *testing.T) {
+	s := &session{}
+	if !raced(fmt.Errorf("operation error: %w", &smithy.GenericAPIError{Code: "InvalidSnapshot.NotFound"}), "snap-1", s) {
+		t.Errorf("a snapshot already gone didn't count as raced")
+	}
+	if raced(&smithy.GenericAPIError{Code: "RequestLimitExceeded"}, "snap-1", s) || raced(nil, "snap-1", s) {
+		t.Errorf("a throttled or successful delete counted as raced")
+	}
+}
+
+func TestDeleteSnapshotsRaced(t *testing.T) {
+	deleted := []string{}
+	fake := func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("fakeEC2", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if op := awsmiddleware.GetOperationName(ctx); op != "DeleteSnapshot" {
+				t.Fatalf("unexpected EC2 call %s", op)
+			}
+			// another snapcleanup, or an amibackup purge, deleted these after we listed them
+			switch id := aws.ToString(in.Parameters.(*ec2.DeleteSnapshotInput).SnapshotId); id {
+			case "snap-gone":
+				return middleware.InitializeOutput{}, middleware.Metadata{}, &smithy.GenericAPIError{Code: "InvalidSnapshot.NotFound"}
+			case "snap-gone-id":
+				return middleware.InitializeOutput{}, middleware.Metadata{}, &smithy.GenericAPIError{Code: "InvalidSnapshotID.NotFound"}
+			default:
+				deleted = append(deleted, id)
+			}
+			return middleware.InitializeOutput{Result: &ec2.DeleteSnapshotOutput{}}, middleware.Metadata{}, nil
+		}), middleware.Before)
+	}
+	awsec2 := ec2.New(ec2.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{fake},
+	})
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	snaps := []types.Snapshot{}
+	for _, id := range []string{"snap-a", "snap-gone", "snap-gone-id", "snap-b"} {
+		snaps = append(snaps, types.Snapshot{SnapshotId: aws.String(id)})
+	}
+	deleteSnapshots(context.Background(), awsec2, snaps, &session{region: "us-east-1"})
+
+	if got := strings.Join(deleted, ","); got != "snap-a,snap-b" {
+		t.Errorf("deleted %s, want snap-a and snap-b", got)
+	}
+	if strings.Contains(out.String(), "failed") {
+		t.Errorf("races logged as failures:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "2 snapshots were already deleted by a concurrent run") {
+		t.Errorf("races not counted:\n%s", out.String())
+	}
+}